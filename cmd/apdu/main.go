@@ -0,0 +1,225 @@
+/*
+Command apdu runs APDU scripts (see package smartcard/script for the
+language) or reads commands interactively.
+
+Usage:
+
+    apdu [ -reader <index|name|regexp> ] [ -aid <aid> ] [ -D NAME=HEX ]...
+         [ -tlv ] [ -k ] [ -no-get-response ] [ <script> ]
+    apdu -list
+
+Without -reader the only reader with a card is used. The exit status is 1
+if expectations of the script failed and 2 on other errors. In CI, a
+virtual card can be served with smartcard/pcscd, pointing
+PCSCLITE_CSOCK_NAME at its socket.
+
+Example:
+
+    $ apdu -reader /Yubico/ -D PIN=313233343536 perso.apdu
+*/
+package main
+
+import (
+    "bufio"
+    "encoding/hex"
+    "flag"
+    "fmt"
+    "io"
+    "os"
+    "regexp"
+    "strconv"
+    "strings"
+    "github.com/sf1/go-card/smartcard"
+    "github.com/sf1/go-card/smartcard/script"
+)
+
+// Variables given with -D.
+type varsFlag map[string][]byte
+
+func (v varsFlag) String() string {
+    return ""
+}
+
+func (v varsFlag) Set(s string) error {
+    i := strings.Index(s, "=")
+    if i <= 0 { return fmt.Errorf("expected NAME=HEX") }
+    value, err := hex.DecodeString(strings.Replace(s[i+1:], " ", "", -1))
+    if err != nil { return err }
+    v[s[:i]] = value
+    return nil
+}
+
+// Error for expectations failed with -k.
+type failures int
+
+func (n failures) Error() string {
+    return fmt.Sprintf("%d expectations failed", int(n))
+}
+
+type options struct {
+    reader, aid, script string
+    vars varsFlag
+    tlv, keepGoing, noGetResponse bool
+}
+
+func main() {
+    opts := &options{vars: varsFlag{}}
+    var list bool
+    flag.StringVar(&opts.reader, "reader", "",
+        "reader index, name or /regexp/")
+    flag.StringVar(&opts.aid, "aid", "", "select applet id first")
+    flag.Var(opts.vars, "D", "set variable (NAME=HEX)")
+    flag.BoolVar(&opts.tlv, "tlv", false, "print response data as BER-TLV")
+    flag.BoolVar(&opts.keepGoing, "k", false,
+        "continue after failed expectations")
+    flag.BoolVar(&opts.noGetResponse, "no-get-response", false,
+        "do not retrieve response data on SW 61xx/6Cxx")
+    flag.BoolVar(&list, "list", false, "list readers")
+    flag.Usage = func() {
+        fmt.Fprintf(os.Stderr, "\nusage: apdu [ options ] [ <script> ]\n" +
+            "       apdu -list\n\n")
+        flag.PrintDefaults()
+        fmt.Fprintln(os.Stderr)
+    }
+    flag.Parse()
+    if flag.NArg() > 1 {
+        flag.Usage()
+        os.Exit(2)
+    }
+    opts.script = flag.Arg(0)
+    var err error
+    if list {
+        err = listReaders()
+    } else {
+        err = run(opts)
+    }
+    if err != nil {
+        fmt.Fprintf(os.Stderr, "error: %s\n", err)
+        switch err.(type) {
+            case *script.ExpectationError, failures:
+                os.Exit(1)
+        }
+        os.Exit(2)
+    }
+}
+
+// Print readers with index.
+func listReaders() error {
+    ctx, err := smartcard.EstablishContext()
+    if err != nil { return err }
+    defer ctx.Release()
+    readers, err := ctx.ListReaders()
+    if err != nil { return err }
+    for i, r := range readers {
+        card := ""
+        if r.IsCardPresent() { card = " (card present)" }
+        fmt.Printf("%d: %s%s\n", i, r.Name(), card)
+    }
+    return nil
+}
+
+// Return reader selected by spec: index, name or /regexp/, or the only
+// reader with a card if spec is empty.
+func selectReader(ctx *smartcard.Context, spec string) (*smartcard.Reader,
+    error) {
+    if spec == "" {
+        readers, err := ctx.ListReadersWithCard()
+        if err != nil { return nil, err }
+        switch len(readers) {
+            case 0:
+                return nil, fmt.Errorf("please insert smart card")
+            case 1:
+                return readers[0], nil
+        }
+        return nil, fmt.Errorf("%d readers with card, select one with " +
+            "-reader (see -list)", len(readers))
+    }
+    readers, err := ctx.ListReaders()
+    if err != nil { return nil, err }
+    if i, err := strconv.Atoi(spec); err == nil {
+        if i < 0 || i >= len(readers) {
+            return nil, fmt.Errorf("no reader %d", i)
+        }
+        return readers[i], nil
+    }
+    if len(spec) > 1 && strings.HasPrefix(spec, "/") &&
+        strings.HasSuffix(spec, "/") {
+        re, err := regexp.Compile(spec[1:len(spec)-1])
+        if err != nil { return nil, err }
+        var matches []*smartcard.Reader
+        for _, r := range readers {
+            if re.MatchString(r.Name()) { matches = append(matches, r) }
+        }
+        if len(matches) != 1 {
+            return nil, fmt.Errorf("%d readers match %s", len(matches), spec)
+        }
+        return matches[0], nil
+    }
+    for _, r := range readers {
+        if r.Name() == spec { return r, nil }
+    }
+    return nil, fmt.Errorf("no reader %q", spec)
+}
+
+func run(opts *options) error {
+    ctx, err := smartcard.EstablishContext()
+    if err != nil { return err }
+    defer ctx.Release()
+    reader, err := selectReader(ctx, opts.reader)
+    if err != nil { return err }
+    card, err := reader.Connect()
+    if err != nil { return err }
+    defer card.Disconnect()
+    runner := script.NewRunner(card, os.Stdout)
+    for name, value := range opts.vars {
+        runner.Vars[name] = value
+    }
+    runner.TLV = opts.tlv
+    runner.KeepGoing = opts.keepGoing
+    runner.GetResponse = !opts.noGetResponse
+    if opts.aid != "" {
+        s, err := script.ParseString("select " + opts.aid)
+        if err != nil { return err }
+        if err := runner.Run(s); err != nil { return err }
+    }
+    if opts.script == "" {
+        return runInteractive(runner, os.Stdin)
+    }
+    file, err := os.Open(opts.script)
+    if err != nil { return err }
+    defer file.Close()
+    s, err := script.Parse(file)
+    if err != nil { return err }
+    err = runner.Run(s)
+    if err == nil && runner.Failures > 0 {
+        return failures(runner.Failures)
+    }
+    return err
+}
+
+// Run statements read from in, continuing after errors. Blocks are run
+// once complete.
+func runInteractive(runner *script.Runner, in io.Reader) error {
+    runner.Echo = false
+    runner.KeepGoing = true
+    scanner := bufio.NewScanner(in)
+    var lines []string
+    for {
+        if len(lines) == 0 {
+            fmt.Print("\n>> ")
+        } else {
+            fmt.Print(".. ")
+        }
+        if !scanner.Scan() { break }
+        line := scanner.Text()
+        if len(lines) == 0 && strings.TrimSpace(line) == "" { break }
+        lines = append(lines, line)
+        s, err := script.ParseString(strings.Join(lines, "\n"))
+        if _, ok := err.(*script.UnterminatedError); ok { continue }
+        lines = nil
+        if err == nil { err = runner.Run(s) }
+        if err != nil { fmt.Printf("error: %s\n", err) }
+    }
+    fmt.Println("")
+    return scanner.Err()
+}
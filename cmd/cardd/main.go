@@ -0,0 +1,73 @@
+/*
+Command cardd serves the local smart card readers to other programs over a
+JSON-RPC API on HTTP and WebSocket (see package smartcard/httpapi).
+
+Usage:
+
+    cardd [ -listen <addr> ] [ -token <token> ] [ -idle <duration> ]
+          [ -cert <file> -key <file> ]
+
+The token is taken from -token or the CARDD_TOKEN environment variable. If
+neither is set a random token is generated and printed. Serving on other
+than a loopback address should use TLS (-cert and -key).
+
+Example:
+
+    $ CARDD_TOKEN=secret cardd &
+    $ curl -H "Authorization: Bearer secret" -d \
+        '{"jsonrpc": "2.0", "id": 1, "method": "listReaders"}' \
+        http://127.0.0.1:7480/rpc
+*/
+package main
+
+import (
+    "crypto/rand"
+    "encoding/hex"
+    "flag"
+    "fmt"
+    "net/http"
+    "os"
+    "time"
+    "github.com/sf1/go-card/smartcard"
+    "github.com/sf1/go-card/smartcard/httpapi"
+)
+
+func main() {
+    var addr, token, cert, key string
+    var idle time.Duration
+    flag.StringVar(&addr, "listen", "127.0.0.1:7480", "listen address")
+    flag.StringVar(&token, "token", os.Getenv("CARDD_TOKEN"),
+        "authentication token")
+    flag.StringVar(&cert, "cert", "", "TLS certificate file")
+    flag.StringVar(&key, "key", "", "TLS key file")
+    flag.DurationVar(&idle, "idle", httpapi.DEFAULT_IDLE_TIMEOUT,
+        "release unused sessions after")
+    flag.Parse()
+    err := run(addr, token, cert, key, idle)
+    if err != nil {
+        fmt.Fprintf(os.Stderr, "cardd: %s\n", err)
+        os.Exit(1)
+    }
+}
+
+func run(addr, token, cert, key string, idle time.Duration) error {
+    if (cert == "") != (key == "") {
+        return fmt.Errorf("-cert and -key must be given together")
+    }
+    if token == "" {
+        b := make([]byte, 16)
+        if _, err := rand.Read(b); err != nil { return err }
+        token = hex.EncodeToString(b)
+        fmt.Fprintf(os.Stderr, "token: %s\n", token)
+    }
+    ctx, err := smartcard.EstablishContext()
+    if err != nil { return err }
+    defer ctx.Release()
+    server := httpapi.NewServer(ctx, token)
+    server.IdleTimeout = idle
+    defer server.Close()
+    if cert != "" {
+        return http.ListenAndServeTLS(addr, cert, key, server)
+    }
+    return http.ListenAndServe(addr, server)
+}
@@ -0,0 +1,196 @@
+/*
+Command cardscan monitors smart card readers like pcsc_scan: it prints
+readers being attached and detached and cards being inserted, removed,
+mute or in use by applications, with timestamps, ATR analysis and the
+card names found for the ATR.
+
+Usage:
+
+    cardscan [ -json ] [ -once ] [ -atr-list <file> ]... [ -q ]
+
+Cards are identified with smartcard_list.txt of pcsc-tools, if installed,
+and the files given with -atr-list. With -json each event is printed as a
+JSON object on a line; -once prints the current state and exits.
+
+Example:
+
+    $ cardscan -once -json | jq -r 'select(.event == "inserted") | .atr'
+*/
+package main
+
+import (
+    "encoding/json"
+    "flag"
+    "fmt"
+    "os"
+    "path/filepath"
+    "strings"
+    "time"
+    "github.com/sf1/go-card/smartcard"
+    "github.com/sf1/go-card/smartcard/atr"
+    "github.com/sf1/go-card/smartcard/monitor"
+    "github.com/sf1/go-card/smartcard/pcsc"
+)
+
+// ATR list files of pcsc-tools
+var defaultLists = []string{
+    "/usr/share/pcsc/smartcard_list.txt",
+    "/usr/local/share/pcsc/smartcard_list.txt",
+}
+
+// List files given with -atr-list.
+type listsFlag []string
+
+func (l *listsFlag) String() string {
+    return strings.Join(*l, ",")
+}
+
+func (l *listsFlag) Set(s string) error {
+    *l = append(*l, s)
+    return nil
+}
+
+// Analysis of an ATR.
+type atrInfo struct {
+    Protocols []int `json:"protocols"`
+    Historical string `json:"historical"`
+    TCKValid bool `json:"tckValid"`
+    Description []string `json:"description"`
+}
+
+// Event as printed with -json.
+type jsonEvent struct {
+    Time time.Time `json:"time"`
+    Event string `json:"event"`
+    Reader string `json:"reader"`
+    State []string `json:"state"`
+    ATR string `json:"atr,omitempty"`
+    ATRInfo *atrInfo `json:"atrInfo,omitempty"`
+    ATRError string `json:"atrError,omitempty"`
+    Cards []string `json:"cards,omitempty"`
+}
+
+// Names of reader state flags
+var stateNames = []struct {
+    flag uint32
+    name string
+}{
+    {pcsc.SCARD_STATE_EMPTY, "empty"},
+    {pcsc.SCARD_STATE_PRESENT, "present"},
+    {pcsc.SCARD_STATE_MUTE, "mute"},
+    {pcsc.SCARD_STATE_INUSE, "inuse"},
+    {pcsc.SCARD_STATE_EXCLUSIVE, "exclusive"},
+    {pcsc.SCARD_STATE_UNAVAILABLE, "unavailable"},
+}
+
+// Return names of state flags.
+func stateFlags(state uint32) []string {
+    names := []string{}
+    for _, s := range stateNames {
+        if state & s.flag != 0 { names = append(names, s.name) }
+    }
+    return names
+}
+
+// Event descriptions of the text output
+var eventText = map[string]string{
+    monitor.EVENT_ATTACHED: "reader attached",
+    monitor.EVENT_DETACHED: "reader detached",
+    monitor.EVENT_INSERTED: "card inserted",
+    monitor.EVENT_REMOVED: "card removed",
+    monitor.EVENT_MUTE: "card mute (no valid ATR)",
+    monitor.EVENT_IN_USE: "card in use",
+    monitor.EVENT_NOT_IN_USE: "card no longer in use",
+}
+
+type printer struct {
+    json bool
+    quiet bool
+    list *atr.List
+    enc *json.Encoder
+}
+
+// Print event.
+func (p *printer) print(e *monitor.Event) error {
+    je := &jsonEvent{Time: e.Time, Event: e.Type, Reader: e.Reader,
+        State: stateFlags(e.State)}
+    if len(e.ATR) > 0 && e.Type == monitor.EVENT_INSERTED {
+        je.ATR = fmt.Sprintf("%X", []byte(e.ATR))
+        if a, err := atr.Parse(e.ATR); err == nil {
+            je.ATRInfo = &atrInfo{
+                Protocols: a.Protocols(),
+                Historical: fmt.Sprintf("%X", a.Historical),
+                TCKValid: a.TCKValid(),
+                Description: a.Describe(),
+            }
+        } else {
+            je.ATRError = err.Error()
+        }
+        je.Cards = p.list.Identify(e.ATR)
+    }
+    if p.json { return p.enc.Encode(je) }
+    fmt.Printf("%s  %s: %s [%s]\n", e.Time.Format("2006-01-02 15:04:05.000"),
+        e.Reader, eventText[e.Type], strings.Join(je.State, ", "))
+    if je.ATR == "" { return nil }
+    fmt.Printf("    ATR: % X\n", []byte(e.ATR))
+    if je.ATRError != "" {
+        fmt.Printf("    %s\n", je.ATRError)
+    } else if !p.quiet {
+        for _, line := range je.ATRInfo.Description {
+            fmt.Printf("      %s\n", line)
+        }
+    }
+    for _, name := range je.Cards {
+        fmt.Printf("    card: %s\n", name)
+    }
+    return nil
+}
+
+// Load ATR lists: the default ones that exist and the given ones.
+func loadLists(extra []string) (*atr.List, error) {
+    var paths []string
+    for _, path := range defaultLists {
+        if _, err := os.Stat(path); err == nil { paths = append(paths, path) }
+    }
+    if home, err := os.UserHomeDir(); err == nil {
+        path := filepath.Join(home, ".cache", "smartcard_list.txt")
+        if _, err := os.Stat(path); err == nil { paths = append(paths, path) }
+    }
+    return atr.LoadList(append(paths, extra...)...)
+}
+
+func main() {
+    p := &printer{enc: json.NewEncoder(os.Stdout)}
+    var once bool
+    var lists listsFlag
+    flag.BoolVar(&p.json, "json", false, "print events as JSON lines")
+    flag.BoolVar(&p.quiet, "q", false, "do not print ATR analysis")
+    flag.BoolVar(&once, "once", false, "print current state and exit")
+    flag.Var(&lists, "atr-list", "ATR list file (smartcard_list.txt format)")
+    flag.Parse()
+    err := run(p, once, lists)
+    if err != nil {
+        fmt.Fprintf(os.Stderr, "cardscan: %s\n", err)
+        os.Exit(1)
+    }
+}
+
+func run(p *printer, once bool, lists []string) error {
+    var err error
+    p.list, err = loadLists(lists)
+    if err != nil { return err }
+    backend, err := smartcard.DefaultBackend()
+    if err != nil { return err }
+    m, err := monitor.New(backend)
+    if err != nil { return err }
+    defer m.Close()
+    if !p.json && !once { fmt.Println("Waiting for events, ^C to stop") }
+    for {
+        events, err := m.Next(time.Second)
+        if err != nil { return err }
+        for i := range events {
+            if err := p.print(&events[i]); err != nil { return err }
+        }
+        if once { return nil }
+    }
+}
@@ -1,13 +1,23 @@
 package SW
 
 const (
-    AUTH_FAILED         uint16 = 0x63c0
-    WRONG_LENGTH        uint16 = 0x6700
-    RECORD_NOT_FOUND    uint16 = 0x6a83
-    UNSUPPORTED_INS     uint16 = 0x6d00
-    UNSUPPORTED_CLA     uint16 = 0x6e00
-    EXCEPTION           uint16 = 0x6f00
-    SUCCESS             uint16 = 0x9000
-    NOT_AUTHORIZED      uint16 = 0x91ae
-    INSUFFICIENT_MEMORY uint16 = 0x9210
+    FILE_INVALIDATED              uint16 = 0x6283
+    MORE_DATA                     uint16 = 0x6310
+    AUTH_FAILED                   uint16 = 0x63c0
+    WRONG_LENGTH                  uint16 = 0x6700
+    SECURITY_STATUS_NOT_SATISFIED uint16 = 0x6982
+    AUTH_METHOD_BLOCKED           uint16 = 0x6983
+    CONDITIONS_NOT_SATISFIED      uint16 = 0x6985
+    WRONG_DATA                    uint16 = 0x6a80
+    FUNCTION_NOT_SUPPORTED        uint16 = 0x6a81
+    FILE_NOT_FOUND                uint16 = 0x6a82
+    RECORD_NOT_FOUND              uint16 = 0x6a83
+    INCORRECT_P1P2                uint16 = 0x6a86
+    REFERENCED_DATA_NOT_FOUND     uint16 = 0x6a88
+    UNSUPPORTED_INS               uint16 = 0x6d00
+    UNSUPPORTED_CLA               uint16 = 0x6e00
+    EXCEPTION                     uint16 = 0x6f00
+    SUCCESS                       uint16 = 0x9000
+    NOT_AUTHORIZED                uint16 = 0x91ae
+    INSUFFICIENT_MEMORY           uint16 = 0x9210
 )
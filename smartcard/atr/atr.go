@@ -0,0 +1,404 @@
+/*
+Package atr analyses answers to reset (ISO 7816-3) and identifies cards by
+their ATR, with the PC/SC part 3 scheme of contactless readers and lists
+in the format of the pcsc-tools smartcard_list.txt.
+
+Example:
+
+    a, err := atr.Parse(card.ATR())
+    // handle error, if any
+    for _, line := range a.Describe() {
+        fmt.Println(line)
+    }
+    list, err := atr.LoadList("/usr/share/pcsc/smartcard_list.txt")
+    // handle error, if any
+    names := list.Identify(card.ATR())
+*/
+package atr
+
+import (
+    "bufio"
+    "fmt"
+    "io"
+    "os"
+    "regexp"
+    "strings"
+)
+
+const (
+    // Initial characters (TS)
+    CONVENTION_DIRECT = 0x3b
+    CONVENTION_INVERSE = 0x3f
+    // Interface bytes of a level
+    TA = 0
+    TB = 1
+    TC = 2
+    TD = 3
+)
+
+// Interface bytes TAi, TBi, TCi and TDi of a level.
+type Interface struct {
+    Bytes [4]byte
+    Present [4]bool
+}
+
+// Return interface byte (TA etc.) and whether it is present.
+func (i Interface) Get(index int) (byte, bool) {
+    return i.Bytes[index], i.Present[index]
+}
+
+// Parsed ATR.
+type ATR struct {
+    Raw []byte
+    TS byte
+    T0 byte
+    // Interface bytes of levels 1, 2, ...
+    Interfaces []Interface
+    Historical []byte
+    TCK byte
+    HasTCK bool
+}
+
+// Parse ATR.
+func Parse(b []byte) (*ATR, error) {
+    if len(b) < 2 { return nil, fmt.Errorf("atr: too short") }
+    a := &ATR{Raw: b, TS: b[0], T0: b[1]}
+    if a.TS != CONVENTION_DIRECT && a.TS != CONVENTION_INVERSE {
+        return nil, fmt.Errorf("atr: invalid TS %02X", a.TS)
+    }
+    pos := 2
+    y := a.T0 >> 4
+    for {
+        var i Interface
+        for index := TA; index <= TD; index++ {
+            if y & (1 << uint(index)) == 0 { continue }
+            if pos >= len(b) { return nil, fmt.Errorf("atr: truncated") }
+            i.Bytes[index], i.Present[index] = b[pos], true
+            pos++
+        }
+        a.Interfaces = append(a.Interfaces, i)
+        td, ok := i.Get(TD)
+        if !ok { break }
+        // TCK is present unless only T=0 is indicated
+        if td & 0x0f != 0 { a.HasTCK = true }
+        y = td >> 4
+    }
+    k := int(a.T0 & 0x0f)
+    if pos + k > len(b) {
+        return nil, fmt.Errorf("atr: truncated historical bytes")
+    }
+    a.Historical = b[pos:pos+k]
+    pos += k
+    if a.HasTCK {
+        if pos >= len(b) { return nil, fmt.Errorf("atr: missing TCK") }
+        a.TCK = b[pos]
+        pos++
+    }
+    if pos != len(b) {
+        return nil, fmt.Errorf("atr: %d extra bytes", len(b) - pos)
+    }
+    return a, nil
+}
+
+// Check the TCK, if present (exclusive or of T0 to TCK is 0).
+func (a *ATR) TCKValid() bool {
+    if !a.HasTCK { return true }
+    var x byte
+    for _, c := range a.Raw[1:] {
+        x ^= c
+    }
+    return x == 0
+}
+
+// Return indicated protocols (0 for T=0 etc.). Without TD1 only T=0 is
+// indicated.
+func (a *ATR) Protocols() []int {
+    var protocols []int
+    seen := map[int]bool{}
+    for _, i := range a.Interfaces {
+        td, ok := i.Get(TD)
+        if !ok { break }
+        t := int(td & 0x0f)
+        if !seen[t] {
+            seen[t] = true
+            protocols = append(protocols, t)
+        }
+    }
+    if len(protocols) == 0 { return []int{0} }
+    return protocols
+}
+
+// Clock rate conversion factors Fi and maximum frequencies (MHz) indexed
+// by the high nibble of TA1, 0 for RFU (ISO 7816-3 table 7).
+var (
+    fiTable = [16]int{372, 372, 558, 744, 1116, 1488, 1860, 0, 0, 512,
+        768, 1024, 1536, 2048, 0, 0}
+    fmaxTable = [16]float64{4, 5, 6, 8, 12, 16, 20, 0, 0, 5, 7.5, 10, 15,
+        20, 0, 0}
+    diTable = [16]int{0, 1, 2, 4, 8, 16, 32, 64, 12, 20, 0, 0, 0, 0, 0, 0}
+)
+
+// Return clock rate conversion factor Fi, maximum frequency in MHz and
+// baud rate adjustment factor Di from TA1 (defaults 372, 5 and 1). Zero
+// values denote RFU codings.
+func (a *ATR) FiDi() (int, float64, int) {
+    if ta1, ok := a.Interfaces[0].Get(TA); ok {
+        return fiTable[ta1 >> 4], fmaxTable[ta1 >> 4], diTable[ta1 & 0x0f]
+    }
+    return 372, 5, 1
+}
+
+// Names of contactless cards by PC/SC part 3 card name (NN)
+var storageCardNames = map[uint16]string{
+    0x0001: "MIFARE Classic 1K",
+    0x0002: "MIFARE Classic 4K",
+    0x0003: "MIFARE Ultralight",
+    0x0026: "MIFARE Mini",
+    0x003a: "MIFARE Ultralight C",
+}
+
+// Return standard and card name of contactless storage cards announced
+// by the reader with the PC/SC part 3 scheme (RID A0 00 00 03 06).
+func (a *ATR) StorageCard() (byte, uint16, bool) {
+    h := a.Historical
+    if len(h) < 15 || h[0] != 0x80 || h[1] != 0x4f || h[2] < 0x0c ||
+        string(h[3:8]) != "\xa0\x00\x00\x03\x06" {
+        return 0, 0, false
+    }
+    return h[8], uint16(h[9]) << 8 | uint16(h[10]), true
+}
+
+// Compact-TLV data object of the historical bytes (ISO 7816-4 8.1.1).
+type Object struct {
+    Tag byte
+    Value []byte
+}
+
+// Return category indicator, compact-TLV objects and status indicator
+// of the historical bytes.
+func (a *ATR) HistoricalObjects() (byte, []Object, []byte, error) {
+    h := a.Historical
+    if len(h) == 0 { return 0, nil, nil, nil }
+    if _, _, ok := a.StorageCard(); ok {
+        // Not compact-TLV despite the category indicator
+        return h[0], nil, nil, nil
+    }
+    category, data := h[0], h[1:]
+    var status []byte
+    switch category {
+        case 0x00:
+            // Status indicator in the last 3 bytes
+            if len(data) < 3 {
+                return category, nil, nil, fmt.Errorf("atr: missing status")
+            }
+            data, status = data[:len(data)-3], data[len(data)-3:]
+        case 0x80:
+        default:
+            return category, nil, nil, nil
+    }
+    var objects []Object
+    for len(data) > 0 {
+        tag, n := data[0] >> 4, int(data[0] & 0x0f)
+        if 1 + n > len(data) {
+            return category, objects, status,
+                fmt.Errorf("atr: truncated compact-TLV")
+        }
+        if category == 0x80 && tag == 0x8 && 1 + n == len(data) {
+            // Status indicator as last object
+            status = data[1:]
+        } else {
+            objects = append(objects, Object{tag, data[1:1+n]})
+        }
+        data = data[1+n:]
+    }
+    return category, objects, status, nil
+}
+
+// Names of compact-TLV objects
+var objectNames = map[byte]string{
+    0x1: "country code",
+    0x2: "issuer identification number",
+    0x3: "card service data",
+    0x4: "initial access data",
+    0x5: "card issuer's data",
+    0x6: "pre-issuing data",
+    0x7: "card capabilities",
+    0x8: "status indicator",
+    0xf: "application identifier",
+}
+
+// Return human readable analysis, one item per line.
+func (a *ATR) Describe() []string {
+    var lines []string
+    add := func(format string, args ...interface{}) {
+        lines = append(lines, fmt.Sprintf(format, args...))
+    }
+    if a.TS == CONVENTION_DIRECT {
+        add("TS = %02X direct convention", a.TS)
+    } else {
+        add("TS = %02X inverse convention", a.TS)
+    }
+    add("T0 = %02X, %d historical bytes", a.T0, len(a.Historical))
+    for n, i := range a.Interfaces {
+        for index, name := range []string{"TA", "TB", "TC", "TD"} {
+            b, ok := i.Get(index)
+            if !ok { continue }
+            desc := ""
+            switch {
+                case n == 0 && index == TA:
+                    fi, fmax, di := a.FiDi()
+                    desc = fmt.Sprintf("Fi = %d, Di = %d, max %g MHz",
+                        fi, di, fmax)
+                case n == 0 && index == TC:
+                    desc = fmt.Sprintf("extra guard time %d", b)
+                case index == TD:
+                    desc = fmt.Sprintf("T=%d", b & 0x0f)
+                case n == 1 && index == TA:
+                    desc = fmt.Sprintf("specific mode T=%d", b & 0x0f)
+                case n >= 2 && index == TA && a.protocol(n) == 1:
+                    desc = fmt.Sprintf("IFSC %d", b)
+                case n >= 2 && index == TB && a.protocol(n) == 1:
+                    desc = fmt.Sprintf("BWI %d, CWI %d", b >> 4, b & 0x0f)
+                case n >= 2 && index == TC && a.protocol(n) == 1:
+                    if b & 1 != 0 {
+                        desc = "CRC"
+                    } else {
+                        desc = "LRC"
+                    }
+            }
+            if desc != "" { desc = ", " + desc }
+            add("%s%d = %02X%s", name, n + 1, b, desc)
+        }
+    }
+    protocols := make([]string, len(a.Protocols()))
+    for i, t := range a.Protocols() {
+        protocols[i] = fmt.Sprintf("T=%d", t)
+    }
+    add("protocols %s", strings.Join(protocols, ", "))
+    if len(a.Historical) > 0 {
+        add("historical bytes %X%s", a.Historical, printable(a.Historical))
+    }
+    category, objects, status, err := a.HistoricalObjects()
+    if len(a.Historical) > 0 && (category == 0x00 || category == 0x80) {
+        add("  category indicator %02X", category)
+    }
+    for _, o := range objects {
+        name := objectNames[o.Tag]
+        if name == "" { name = "RFU" }
+        add("  %X%X %s: %X%s", o.Tag, len(o.Value), name, o.Value,
+            printable(o.Value))
+    }
+    if status != nil { add("  status %X", status) }
+    if err != nil { add("  %s", err) }
+    if standard, name, ok := a.StorageCard(); ok {
+        card := storageCardNames[name]
+        if card == "" { card = "unknown" }
+        add("contactless storage card, standard %02X, name %04X (%s)",
+            standard, name, card)
+    }
+    if a.HasTCK {
+        if a.TCKValid() {
+            add("TCK = %02X (correct checksum)", a.TCK)
+        } else {
+            add("TCK = %02X (wrong checksum)", a.TCK)
+        }
+    }
+    return lines
+}
+
+// Return protocol indicated by TD of the level before level n (0-based).
+func (a *ATR) protocol(n int) int {
+    td, _ := a.Interfaces[n-1].Get(TD)
+    return int(td & 0x0f)
+}
+
+// Return value as quoted text if it is printable ASCII.
+func printable(value []byte) string {
+    for _, b := range value {
+        if b < 0x20 || b > 0x7e { return "" }
+    }
+    return fmt.Sprintf(" %q", value)
+}
+
+// Return names of ATR from the built-in knowledge of contactless storage
+// cards.
+func Identify(b []byte) []string {
+    a, err := Parse(b)
+    if err != nil { return nil }
+    if _, name, ok := a.StorageCard(); ok && storageCardNames[name] != "" {
+        return []string{storageCardNames[name]}
+    }
+    return nil
+}
+
+type entry struct {
+    pattern *regexp.Regexp
+    names []string
+}
+
+// List of ATR patterns with card names.
+type List struct {
+    entries []entry
+}
+
+// Parse list in the format of smartcard_list.txt: an ATR (hex bytes
+// separated by spaces, optionally with regular expressions such as "..")
+// on a line, followed by lines with names indented by a tab. Lines
+// starting with # are comments.
+func ParseList(r io.Reader) (*List, error) {
+    l := &List{}
+    scanner := bufio.NewScanner(r)
+    n := 0
+    for scanner.Scan() {
+        n++
+        line := scanner.Text()
+        switch {
+            case strings.TrimSpace(line) == "" || strings.HasPrefix(line, "#"):
+            case strings.HasPrefix(line, "\t"):
+                if len(l.entries) == 0 {
+                    return nil, fmt.Errorf("atr: line %d: name without ATR",
+                        n)
+                }
+                e := &l.entries[len(l.entries)-1]
+                e.names = append(e.names, strings.TrimSpace(line))
+            default:
+                pattern, err := regexp.Compile("^(?i:" +
+                    strings.TrimSpace(line) + ")$")
+                if err != nil {
+                    return nil, fmt.Errorf("atr: line %d: %s", n, err)
+                }
+                l.entries = append(l.entries, entry{pattern: pattern})
+        }
+    }
+    if err := scanner.Err(); err != nil { return nil, err }
+    return l, nil
+}
+
+// Load and merge list files.
+func LoadList(paths ...string) (*List, error) {
+    l := &List{}
+    for _, path := range paths {
+        file, err := os.Open(path)
+        if err != nil { return nil, err }
+        list, err := ParseList(file)
+        file.Close()
+        if err != nil { return nil, fmt.Errorf("%s: %s", path, err) }
+        l.entries = append(l.entries, list.entries...)
+    }
+    return l, nil
+}
+
+// Return names of ATR in the list, falling back to Identify.
+func (l *List) Identify(b []byte) []string {
+    var s []string
+    for _, c := range b {
+        s = append(s, fmt.Sprintf("%02X", c))
+    }
+    text := strings.Join(s, " ")
+    var names []string
+    for _, e := range l.entries {
+        if e.pattern.MatchString(text) { names = append(names, e.names...) }
+    }
+    if names == nil { return Identify(b) }
+    return names
+}
@@ -0,0 +1,95 @@
+package atr
+
+import (
+    "bytes"
+    "reflect"
+    "strings"
+    "testing"
+    "github.com/sf1/go-card/smartcard/mock"
+)
+
+// MIFARE Classic 1K on a PC/SC part 3 contactless reader
+var mifareATR = mock.Hex("3b 8f 80 01 80 4f 0c a0 00 00 03 06 03 00 01 " +
+    "00 00 00 00 6a")
+
+func TestParse(t *testing.T) {
+    a, err := Parse(mock.Hex("3b 9f 96 80 1f c7 80 31 e0 73 fe 21 1b 63 " +
+        "3a 20 4e 83 00 90 00 31"))
+    if err != nil { t.Fatal(err) }
+    if len(a.Interfaces) != 3 || !a.HasTCK || a.TCK != 0x31 {
+        t.Errorf("unexpected ATR %+v", a)
+    }
+    if ta1, _ := a.Interfaces[0].Get(TA); ta1 != 0x96 {
+        t.Errorf("unexpected TA1 %02X", ta1)
+    }
+    if fi, fmax, di := a.FiDi(); fi != 512 || fmax != 5 || di != 32 {
+        t.Errorf("unexpected Fi %d, f %g, Di %d", fi, fmax, di)
+    }
+    if p := a.Protocols(); !reflect.DeepEqual(p, []int{0, 15}) {
+        t.Errorf("unexpected protocols %v", p)
+    }
+    if !bytes.Equal(a.Historical, mock.Hex("80 31 e0 73 fe 21 1b 63 3a 20 " +
+        "4e 83 00 90 00")) {
+        t.Errorf("unexpected historical bytes %X", a.Historical)
+    }
+    category, objects, status, err := a.HistoricalObjects()
+    if err != nil || category != 0x80 || len(objects) != 3 ||
+        objects[1].Tag != 0x7 || !bytes.Equal(status, mock.Hex("00 90 00")) {
+        t.Errorf("unexpected objects %02X %v %X, %v", category, objects,
+            status, err)
+    }
+    description := strings.Join(a.Describe(), "\n")
+    for _, s := range []string{"TA1 = 96, Fi = 512, Di = 32, max 5 MHz",
+        "protocols T=0, T=15", "73 card capabilities: FE211B",
+        "status 009000"} {
+        if !strings.Contains(description, s) {
+            t.Errorf("description %q lacks %q", description, s)
+        }
+    }
+    for _, b := range []string{"3b", "3a 00", "3b 10", "3b 02 01",
+        "3b 80 01", "3b 00 00"} {
+        if _, err := Parse(mock.Hex(b)); err == nil {
+            t.Errorf("%s: expected error", b)
+        }
+    }
+}
+
+func TestTCK(t *testing.T) {
+    a, err := Parse(mifareATR)
+    if err != nil { t.Fatal(err) }
+    if !a.TCKValid() { t.Error("TCK not valid") }
+    b := append([]byte{}, mifareATR...)
+    b[len(b)-1] ^= 1
+    if a, err = Parse(b); err != nil || a.TCKValid() {
+        t.Errorf("wrong TCK accepted, %v", err)
+    }
+    if a, _ = Parse(mock.Hex("3b 80 80 01 01")); !a.TCKValid() {
+        t.Error("TCK not valid")
+    }
+}
+
+func TestIdentify(t *testing.T) {
+    if names := Identify(mifareATR); !reflect.DeepEqual(names,
+        []string{"MIFARE Classic 1K"}) {
+        t.Errorf("unexpected names %v", names)
+    }
+    list, err := ParseList(strings.NewReader("# comment\n\n" +
+        "3B 8F 80 01 80 4F 0C A0 00 00 03 06 03 00 01 00 00 00 00 6A\n" +
+        "\tMIFARE card of the canteen\n" +
+        "3B 80 80 01 .. \n\tVirtual card\n\tsecond name\n"))
+    if err != nil { t.Fatal(err) }
+    if names := list.Identify(mock.Hex("3b 80 80 01 01")); !reflect.DeepEqual(
+        names, []string{"Virtual card", "second name"}) {
+        t.Errorf("unexpected names %v", names)
+    }
+    if names := list.Identify(mifareATR); len(names) != 1 ||
+        names[0] != "MIFARE card of the canteen" {
+        t.Errorf("unexpected names %v", names)
+    }
+    if names := list.Identify(mock.Hex("3b 00")); names != nil {
+        t.Errorf("unexpected names %v", names)
+    }
+    if _, err := ParseList(strings.NewReader("\tname\n")); err == nil {
+        t.Error("name without ATR accepted")
+    }
+}
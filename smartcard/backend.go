@@ -0,0 +1,312 @@
+package smartcard
+
+import (
+    "time"
+    "github.com/sf1/go-card/smartcard/pcsc"
+)
+
+const (
+    // Share modes
+    SHARE_EXCLUSIVE = pcsc.SCARD_SHARE_EXCLUSIVE
+    SHARE_SHARED = pcsc.SCARD_SHARE_SHARED
+    SHARE_DIRECT = pcsc.SCARD_SHARE_DIRECT
+    // Protocols
+    PROTOCOL_T0 = pcsc.SCARD_PROTOCOL_T0
+    PROTOCOL_T1 = pcsc.SCARD_PROTOCOL_T1
+    PROTOCOL_ANY = pcsc.SCARD_PROTOCOL_ANY
+    // Card dispositions
+    LEAVE_CARD = pcsc.SCARD_LEAVE_CARD
+    RESET_CARD = pcsc.SCARD_RESET_CARD
+    UNPOWER_CARD = pcsc.SCARD_UNPOWER_CARD
+    EJECT_CARD = pcsc.SCARD_EJECT_CARD
+    // Timeout
+    INFINITE = pcsc.SCARD_INFINITE
+)
+
+// State of a reader for Backend.GetStatusChange.
+type ReaderState struct {
+    // Reader name
+    Reader string
+    // State known to the caller (pcsc.SCARD_STATE_*)
+    CurrentState uint32
+    // Actual state, set by GetStatusChange
+    EventState uint32
+    // ATR of the inserted card, set by GetStatusChange
+    ATR []byte
+}
+
+// Status of a connected card.
+type CardStatus struct {
+    Reader string
+    // Card state (pcsc.SCARD_PRESENT etc.)
+    State uint32
+    Protocol uint32
+    ATR ATR
+}
+
+// PC/SC style access to readers and cards underlying Context, Reader and
+// Card. The platform implementation (pcsc-lite or WinSCard) is returned by
+// DefaultBackend; mocks, remote readers and virtual cards can be used
+// through EstablishContextWithBackend. Handles are opaque to callers.
+type Backend interface {
+    EstablishContext(scope uint32) (uintptr, error)
+    ReleaseContext(ctx uintptr) error
+    ListReaders(ctx uintptr) ([]string, error)
+    // Wait until the state of one of the readers differs from its
+    // CurrentState and update EventState (with pcsc.SCARD_STATE_CHANGED)
+    // and ATR. Returns immediately for pcsc.SCARD_STATE_UNAWARE and
+    // pcsc.Error(pcsc.SCARD_E_TIMEOUT) after timeout milliseconds, unless
+    // timeout is INFINITE.
+    GetStatusChange(ctx uintptr, timeout uint32, states []ReaderState) error
+    // Connect to card and return card handle and active protocol.
+    Connect(ctx uintptr, reader string, shareMode, protocols uint32) (
+        uintptr, uint32, error)
+    Disconnect(card uintptr, disposition uint32) error
+    Status(card uintptr) (CardStatus, error)
+    // Transmit command and return response.
+    Transmit(card uintptr, protocol uint32, command []byte) ([]byte, error)
+    // Send control command to the reader driver and return response.
+    Control(card uintptr, code uint32, data []byte) ([]byte, error)
+    GetAttrib(card uintptr, attr uint32) ([]byte, error)
+    BeginTransaction(card uintptr) error
+    EndTransaction(card uintptr, disposition uint32) error
+}
+
+// A smart card context is required to access readers and cards.
+type Context struct {
+    backend Backend
+    ctxID uintptr
+    observer Observer
+}
+
+var newBackend = DefaultBackend
+
+// Set function creating the backend of EstablishContext, e.g. a client of
+// a remote card server. Pass nil to restore DefaultBackend.
+func SetDefaultBackend(fn func() (Backend, error)) {
+    if fn == nil { fn = DefaultBackend }
+    newBackend = fn
+}
+
+// Establish smart card context with the platform backend, or the one set
+// with SetDefaultBackend. This should be the first function to be called.
+func EstablishContext(scope ...uint32) (*Context, error) {
+    backend, err := newBackend()
+    if err != nil { return nil, err }
+    return EstablishContextWithBackend(backend, scope...)
+}
+
+// Establish smart card context with backend.
+func EstablishContextWithBackend(backend Backend, scope ...uint32) (
+    *Context, error) {
+    scp := uint32(SCOPE_SYSTEM)
+    if len(scope) > 0 {
+        scp = scope[0]
+    }
+    ctxID, err := backend.EstablishContext(scp)
+    if err != nil { return nil, err }
+    return &Context{backend: backend, ctxID: ctxID}, nil
+}
+
+// Return backend of the context.
+func (ctx *Context) Backend() Backend {
+    return ctx.backend
+}
+
+// Release resources associated with smart card context.
+func (ctx *Context) Release() error {
+    return ctx.backend.ReleaseContext(ctx.ctxID)
+}
+
+// List all smart card readers.
+func (ctx *Context) ListReaders() ([]*Reader, error) {
+    names, err := ctx.backend.ListReaders(ctx.ctxID)
+    if err != nil { return nil, err }
+    readers := make([]*Reader, len(names))
+    for i, name := range names {
+        readers[i] = &Reader{context: ctx, name: name}
+    }
+    return readers, nil
+}
+
+// List smart card readers with inserted cards.
+func (ctx *Context) ListReadersWithCard() ([]*Reader, error) {
+    names, err := ctx.backend.ListReaders(ctx.ctxID)
+    if err != nil { return nil, err }
+    if len(names) == 0 { return []*Reader{}, nil }
+    states := make([]ReaderState, len(names))
+    for i, name := range names {
+        states[i].Reader = name
+    }
+    err = ctx.backend.GetStatusChange(ctx.ctxID, 0, states)
+    if err != nil { return nil, err }
+    readers := make([]*Reader, 0, len(states))
+    for _, state := range states {
+        if cardPresent(state.EventState) {
+            readers = append(readers, &Reader{context: ctx,
+                name: state.Reader})
+        }
+    }
+    return readers, nil
+}
+
+func cardPresent(state uint32) bool {
+    return state & pcsc.SCARD_STATE_PRESENT != 0 &&
+        state & pcsc.SCARD_STATE_MUTE == 0
+}
+
+// Block until a smart card is inserted into any reader.
+// Returns immediately if card already present.
+func (ctx *Context) WaitForCardPresent() (*Reader, error) {
+    for {
+        readers, err := ctx.ListReadersWithCard()
+        if err != nil { return nil, err }
+        if len(readers) > 0 {
+            return readers[0], nil
+        }
+        time.Sleep(250*time.Millisecond)
+    }
+}
+
+// Smart card reader.
+// Note that physical card readers with slots for multiple cards are
+// represented by one Reader instance per slot.
+type Reader struct {
+    context *Context
+    name string
+}
+
+// Return name of card reader.
+func (r *Reader) Name() string {
+    return r.name
+}
+
+// Check if card is present.
+func (r *Reader) IsCardPresent() bool {
+    states := []ReaderState{{Reader: r.name}}
+    err := r.context.backend.GetStatusChange(r.context.ctxID, 0, states)
+    if err != nil {
+        return false
+    }
+    return cardPresent(states[0].EventState)
+}
+
+// Wait until card removed
+func (r *Reader) WaitUntilCardRemoved() {
+    for r.IsCardPresent() {
+        time.Sleep(250*time.Millisecond)
+    }
+}
+
+// Connect to card in shared mode with protocol T=0 or T=1.
+func (r *Reader) Connect() (*Card, error) {
+    return r.ConnectMode(SHARE_SHARED, PROTOCOL_ANY)
+}
+
+// Connect to card with share mode and preferred protocols.
+func (r *Reader) ConnectMode(shareMode, protocols uint32) (*Card, error) {
+    start := time.Now()
+    card, err := r.connect(shareMode, protocols)
+    if o := r.context.observer; o != nil {
+        e := &Event{Kind: EVENT_CONNECT, Reader: r.name,
+            Duration: time.Since(start), Err: err}
+        if card != nil { e.ATR, e.Protocol = card.atr, card.protocol }
+        o.Observe(e)
+    }
+    return card, err
+}
+
+func (r *Reader) connect(shareMode, protocols uint32) (*Card, error) {
+    backend := r.context.backend
+    cardID, protocol, err := backend.Connect(r.context.ctxID, r.name,
+        shareMode, protocols)
+    if err != nil { return nil, err }
+    status, err := backend.Status(cardID)
+    if err != nil {
+        backend.Disconnect(cardID, LEAVE_CARD)
+        return nil, err
+    }
+    return &Card{
+        context: r.context,
+        reader: r.name,
+        cardID: cardID,
+        protocol: protocol,
+        atr: status.ATR,
+    }, nil
+}
+
+// Smart card.
+type Card struct {
+    context *Context
+    reader string
+    cardID uintptr
+    protocol uint32
+    atr ATR
+}
+
+// Return card ATR (answer to reset).
+func (c *Card) ATR() ATR {
+    return c.atr
+}
+
+// Return active protocol (PROTOCOL_T0 or PROTOCOL_T1).
+func (c *Card) Protocol() uint32 {
+    return c.protocol
+}
+
+// Return current status of the card.
+func (c *Card) Status() (CardStatus, error) {
+    return c.context.backend.Status(c.cardID)
+}
+
+// Trasmit bytes to card and return response.
+func (c *Card) Transmit(command []byte) ([]byte, error) {
+    o := c.context.observer
+    if o == nil {
+        return c.context.backend.Transmit(c.cardID, c.protocol, command)
+    }
+    start := time.Now()
+    response, err := c.context.backend.Transmit(c.cardID, c.protocol,
+        command)
+    o.Observe(&Event{Kind: EVENT_TRANSMIT, Reader: c.reader,
+        Command: command, Response: response, Duration: time.Since(start),
+        Err: err})
+    return response, err
+}
+
+// Send control command to the reader and return response. Control codes
+// are platform specific (SCARD_CTL_CODE).
+func (c *Card) Control(code uint32, data []byte) ([]byte, error) {
+    return c.context.backend.Control(c.cardID, code, data)
+}
+
+// Return reader or card attribute, e.g. pcsc.SCARD_ATTR_ATR_STRING.
+func (c *Card) GetAttrib(attr uint32) ([]byte, error) {
+    return c.context.backend.GetAttrib(c.cardID, attr)
+}
+
+// Start exclusive access to the card.
+func (c *Card) BeginTransaction() error {
+    return c.context.backend.BeginTransaction(c.cardID)
+}
+
+// End exclusive access to the card with disposition (LEAVE_CARD etc.).
+func (c *Card) EndTransaction(disposition uint32) error {
+    return c.context.backend.EndTransaction(c.cardID, disposition)
+}
+
+// Disconnect from card, resetting it.
+func (c *Card) Disconnect() error {
+    return c.DisconnectMode(RESET_CARD)
+}
+
+// Disconnect from card with disposition (LEAVE_CARD etc.).
+func (c *Card) DisconnectMode(disposition uint32) error {
+    start := time.Now()
+    err := c.context.backend.Disconnect(c.cardID, disposition)
+    if o := c.context.observer; o != nil {
+        o.Observe(&Event{Kind: EVENT_DISCONNECT, Reader: c.reader,
+            Disposition: disposition, Duration: time.Since(start), Err: err})
+    }
+    return err
+}
@@ -0,0 +1,154 @@
+package smartcard
+
+import (
+    "bytes"
+    "fmt"
+    "testing"
+    "github.com/sf1/go-card/smartcard/pcsc"
+)
+
+// Backend with two readers, a card in the second one.
+type testBackend struct {
+    contexts int
+    calls []string
+}
+
+var testReaders = []string{"Empty Reader 00", "Test Reader 01"}
+var testATR = []byte{0x3b, 0x80, 0x80, 0x01, 0x01}
+
+func (b *testBackend) call(format string, args ...interface{}) {
+    b.calls = append(b.calls, fmt.Sprintf(format, args...))
+}
+
+func (b *testBackend) EstablishContext(scope uint32) (uintptr, error) {
+    b.contexts++
+    return uintptr(b.contexts), nil
+}
+
+func (b *testBackend) ReleaseContext(ctx uintptr) error {
+    b.contexts--
+    return nil
+}
+
+func (b *testBackend) ListReaders(ctx uintptr) ([]string, error) {
+    return testReaders, nil
+}
+
+func (b *testBackend) GetStatusChange(ctx uintptr, timeout uint32,
+    states []ReaderState) error {
+    for i := range states {
+        switch states[i].Reader {
+            case testReaders[0]:
+                states[i].EventState = pcsc.SCARD_STATE_EMPTY
+            case testReaders[1]:
+                states[i].EventState = pcsc.SCARD_STATE_PRESENT
+                states[i].ATR = testATR
+            default:
+                states[i].EventState = pcsc.SCARD_STATE_UNKNOWN
+        }
+    }
+    return nil
+}
+
+func (b *testBackend) Connect(ctx uintptr, reader string, shareMode,
+    protocols uint32) (uintptr, uint32, error) {
+    if reader != testReaders[1] {
+        return 0, 0, pcsc.Error(pcsc.SCARD_E_NO_SMARTCARD)
+    }
+    b.call("connect %d %d", shareMode, protocols)
+    return 7, PROTOCOL_T1, nil
+}
+
+func (b *testBackend) Disconnect(card uintptr, disposition uint32) error {
+    b.call("disconnect %d", disposition)
+    return nil
+}
+
+func (b *testBackend) Status(card uintptr) (CardStatus, error) {
+    return CardStatus{testReaders[1], pcsc.SCARD_SPECIFIC, PROTOCOL_T1,
+        testATR}, nil
+}
+
+func (b *testBackend) Transmit(card uintptr, protocol uint32,
+    command []byte) ([]byte, error) {
+    b.call("transmit %d %X", protocol, command)
+    return []byte{0x90, 0x00}, nil
+}
+
+func (b *testBackend) Control(card uintptr, code uint32,
+    data []byte) ([]byte, error) {
+    b.call("control %X %X", code, data)
+    return []byte{0x01}, nil
+}
+
+func (b *testBackend) GetAttrib(card uintptr, attr uint32) ([]byte, error) {
+    if attr != pcsc.SCARD_ATTR_ATR_STRING {
+        return nil, pcsc.Error(pcsc.SCARD_E_UNSUPPORTED_FEATURE)
+    }
+    return testATR, nil
+}
+
+func (b *testBackend) BeginTransaction(card uintptr) error {
+    b.call("begin")
+    return nil
+}
+
+func (b *testBackend) EndTransaction(card uintptr, disposition uint32) error {
+    b.call("end %d", disposition)
+    return nil
+}
+
+func TestBackend(t *testing.T) {
+    backend := &testBackend{}
+    ctx, err := EstablishContextWithBackend(backend)
+    if err != nil { t.Fatal(err) }
+    if ctx.Backend() != backend { t.Error("unexpected backend") }
+    readers, err := ctx.ListReaders()
+    if err != nil || len(readers) != 2 {
+        t.Fatalf("unexpected readers %v, %v", readers, err)
+    }
+    if readers[0].IsCardPresent() || !readers[1].IsCardPresent() {
+        t.Error("unexpected card presence")
+    }
+    if _, err := readers[0].Connect(); err == nil {
+        t.Error("connected to empty reader")
+    }
+    withCard, err := ctx.ListReadersWithCard()
+    if err != nil || len(withCard) != 1 || withCard[0].Name() != testReaders[1] {
+        t.Fatalf("unexpected readers with card %v, %v", withCard, err)
+    }
+    reader, err := ctx.WaitForCardPresent()
+    if err != nil { t.Fatal(err) }
+    card, err := reader.Connect()
+    if err != nil { t.Fatal(err) }
+    if !bytes.Equal(card.ATR(), testATR) || card.Protocol() != PROTOCOL_T1 {
+        t.Errorf("unexpected ATR %s, protocol %d", card.ATR(), card.Protocol())
+    }
+    if err := card.BeginTransaction(); err != nil { t.Fatal(err) }
+    rsp, err := card.TransmitAPDU(SelectCommand(0xa0, 0x00))
+    if err != nil || rsp.SW() != 0x9000 {
+        t.Errorf("unexpected response %s, %v", rsp, err)
+    }
+    if _, err := card.Control(0x42000d48, []byte{0x01}); err != nil {
+        t.Error(err)
+    }
+    if err := card.EndTransaction(LEAVE_CARD); err != nil { t.Fatal(err) }
+    atr, err := card.GetAttrib(pcsc.SCARD_ATTR_ATR_STRING)
+    if err != nil || !bytes.Equal(atr, testATR) {
+        t.Errorf("unexpected ATR attribute %X, %v", atr, err)
+    }
+    if _, err := card.GetAttrib(0); err != pcsc.Error(
+        pcsc.SCARD_E_UNSUPPORTED_FEATURE) {
+        t.Errorf("expected unsupported feature, got %v", err)
+    }
+    if err := card.Disconnect(); err != nil { t.Fatal(err) }
+    expected := []string{"connect 2 3", "begin",
+        "transmit 2 00A4040002A000", "control 42000D48 01", "end 0",
+        "disconnect 1"}
+    if fmt.Sprint(backend.calls) != fmt.Sprint(expected) {
+        t.Errorf("unexpected calls %q", backend.calls)
+    }
+    if err := ctx.Release(); err != nil || backend.contexts != 0 {
+        t.Errorf("context not released: %v", err)
+    }
+}
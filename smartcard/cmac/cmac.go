@@ -0,0 +1,131 @@
+/*
+Package cmac implements the CMAC message authentication code (NIST SP 800-38B,
+RFC 4493) for 64-bit and 128-bit block ciphers.
+
+CMAC is used by several smart card protocols, e.g. GlobalPlatform SCP03,
+MIFARE DESFire and ICAO/BSI secure messaging with AES.
+*/
+package cmac
+
+import (
+    "crypto/cipher"
+    "fmt"
+    "hash"
+)
+
+type digest struct {
+    block cipher.Block
+    k1, k2 []byte
+    iv []byte
+    x []byte
+    buf []byte
+}
+
+// Create CMAC hash based on block cipher.
+// The block size must be 8 or 16 bytes.
+func New(block cipher.Block) (hash.Hash, error) {
+    var rb byte
+    switch block.BlockSize() {
+        case 8:
+            rb = 0x1b
+        case 16:
+            rb = 0x87
+        default:
+            return nil, fmt.Errorf("unsupported block size: %d",
+                block.BlockSize())
+    }
+    size := block.BlockSize()
+    l := make([]byte, size)
+    block.Encrypt(l, l)
+    d := &digest{block: block}
+    d.k1 = shift(l, rb)
+    d.k2 = shift(d.k1, rb)
+    d.Reset()
+    return d, nil
+}
+
+// Create CMAC hash with initial chaining value iv instead of zero, as used
+// by MIFARE DESFire EV1 secure messaging.
+func NewWithIV(block cipher.Block, iv []byte) (hash.Hash, error) {
+    if len(iv) != block.BlockSize() {
+        return nil, fmt.Errorf("invalid IV length: %d", len(iv))
+    }
+    h, err := New(block)
+    if err != nil { return nil, err }
+    d := h.(*digest)
+    d.iv = append([]byte{}, iv...)
+    d.Reset()
+    return d, nil
+}
+
+// Compute CMAC of msg with block cipher.
+func Sum(block cipher.Block, msg []byte) ([]byte, error) {
+    h, err := New(block)
+    if err != nil { return nil, err }
+    h.Write(msg)
+    return h.Sum(nil), nil
+}
+
+func shift(in []byte, rb byte) []byte {
+    out := make([]byte, len(in))
+    var carry byte
+    for i := len(in) - 1; i >= 0; i-- {
+        out[i] = in[i] << 1 | carry
+        carry = in[i] >> 7
+    }
+    if carry != 0 {
+        out[len(out)-1] ^= rb
+    }
+    return out
+}
+
+func (d *digest) Size() int {
+    return d.block.BlockSize()
+}
+
+func (d *digest) BlockSize() int {
+    return d.block.BlockSize()
+}
+
+func (d *digest) Reset() {
+    d.x = make([]byte, d.block.BlockSize())
+    copy(d.x, d.iv)
+    d.buf = d.buf[:0]
+}
+
+func (d *digest) Write(p []byte) (int, error) {
+    size := d.block.BlockSize()
+    n := len(p)
+    d.buf = append(d.buf, p...)
+    // Keep the last (possibly complete) block for finalization.
+    for len(d.buf) > size {
+        for i := 0; i < size; i++ {
+            d.x[i] ^= d.buf[i]
+        }
+        d.block.Encrypt(d.x, d.x)
+        d.buf = d.buf[size:]
+    }
+    return n, nil
+}
+
+func (d *digest) Sum(in []byte) []byte {
+    size := d.block.BlockSize()
+    last := make([]byte, size)
+    if len(d.buf) == size {
+        for i := 0; i < size; i++ {
+            last[i] = d.buf[i] ^ d.k1[i]
+        }
+    } else {
+        copy(last, d.buf)
+        last[len(d.buf)] = 0x80
+        for i := 0; i < size; i++ {
+            last[i] ^= d.k2[i]
+        }
+    }
+    mac := make([]byte, size)
+    for i := 0; i < size; i++ {
+        mac[i] = d.x[i] ^ last[i]
+    }
+    d.block.Encrypt(mac, mac)
+    return append(in, mac...)
+}
@@ -0,0 +1,95 @@
+package cmac
+
+import (
+    "bytes"
+    "crypto/aes"
+    "crypto/des"
+    "encoding/hex"
+    "testing"
+)
+
+func unhex(s string) []byte {
+    b, err := hex.DecodeString(s)
+    if err != nil { panic(err) }
+    return b
+}
+
+// RFC 4493, section 4.
+func TestAES128(t *testing.T) {
+    block, _ := aes.NewCipher(unhex("2b7e151628aed2a6abf7158809cf4f3c"))
+    msg := unhex("6bc1bee22e409f96e93d7e117393172a" +
+        "ae2d8a571e03ac9c9eb76fac45af8e51" +
+        "30c81c46a35ce411e5fbc1191a0a52ef" +
+        "f69f2445df4f9b17ad2b417be66c3710")
+    vectors := []struct {
+        length int
+        mac string
+    }{
+        {0, "bb1d6929e95937287fa37d129b756746"},
+        {16, "070a16b46b4d4144f79bdd9dd04a287c"},
+        {40, "dfa66747de9ae63030ca32611497c827"},
+        {64, "51f0bebf7e3b9d92fc49741779363cfe"},
+    }
+    for _, v := range vectors {
+        mac, err := Sum(block, msg[:v.length])
+        if err != nil { t.Error(err); return }
+        if !bytes.Equal(mac, unhex(v.mac)) {
+            t.Errorf("len %d: got %x, want %s", v.length, mac, v.mac)
+        }
+    }
+}
+
+func TestIncrementalWrite(t *testing.T) {
+    block, _ := aes.NewCipher(unhex("2b7e151628aed2a6abf7158809cf4f3c"))
+    msg := unhex("6bc1bee22e409f96e93d7e117393172a" +
+        "ae2d8a571e03ac9c9eb76fac45af8e51" +
+        "30c81c46a35ce411")
+    h, _ := New(block)
+    for _, b := range msg {
+        h.Write([]byte{b})
+    }
+    if !bytes.Equal(h.Sum(nil), unhex("dfa66747de9ae63030ca32611497c827")) {
+        t.Errorf("incremental mac mismatch: %x", h.Sum(nil))
+    }
+}
+
+// NIST SP 800-38B, example D.4 (three key TDEA).
+func TestTDEA(t *testing.T) {
+    block, _ := des.NewTripleDESCipher(unhex(
+        "8aa83bf8cbda10620bc1bf19fbb6cd58bc313d4a371ca8b5"))
+    vectors := []struct {
+        msg string
+        mac string
+    }{
+        {"", "b7a688e122ffaf95"},
+        {"6bc1bee22e409f96", "8e8f293136283797"},
+    }
+    for _, v := range vectors {
+        mac, err := Sum(block, unhex(v.msg))
+        if err != nil { t.Error(err); return }
+        if !bytes.Equal(mac, unhex(v.mac)) {
+            t.Errorf("msg %q: got %x, want %s", v.msg, mac, v.mac)
+        }
+    }
+}
+
+// A chaining value is equivalent to XORing it into the first block.
+func TestIV(t *testing.T) {
+    block, _ := aes.NewCipher(unhex("2b7e151628aed2a6abf7158809cf4f3c"))
+    iv := unhex("000102030405060708090a0b0c0d0e0f")
+    msg := unhex("6bc1bee22e409f96e93d7e117393172a" + "ae2d8a57")
+    h, err := NewWithIV(block, iv)
+    if err != nil { t.Fatal(err) }
+    h.Write(msg)
+    xored := append([]byte{}, msg...)
+    for i := range iv {
+        xored[i] ^= iv[i]
+    }
+    want, _ := Sum(block, xored)
+    if !bytes.Equal(h.Sum(nil), want) {
+        t.Errorf("got %x, want %x", h.Sum(nil), want)
+    }
+    if _, err := NewWithIV(block, iv[:8]); err == nil {
+        t.Errorf("short IV accepted")
+    }
+}
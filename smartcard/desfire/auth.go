@@ -0,0 +1,364 @@
+package desfire
+
+import (
+    "bytes"
+    "crypto/aes"
+    "crypto/cipher"
+    "crypto/des"
+    "crypto/rand"
+    "fmt"
+    "github.com/sf1/go-card/smartcard/cmac"
+)
+
+// Key type.
+type KeyType byte
+
+const (
+    KEY_DES KeyType = iota
+    KEY_2K3DES
+    KEY_3K3DES
+    KEY_AES
+)
+
+func (t KeyType) String() string {
+    switch t {
+        case KEY_DES:
+            return "DES"
+        case KEY_2K3DES:
+            return "2K3DES"
+        case KEY_3K3DES:
+            return "3K3DES"
+        case KEY_AES:
+            return "AES"
+    }
+    return fmt.Sprintf("KeyType(%d)", byte(t))
+}
+
+// Key type flag of CreateApplication and GetKeySettings.
+func (t KeyType) flag() byte {
+    switch t {
+        case KEY_3K3DES:
+            return 0x40
+        case KEY_AES:
+            return 0x80
+    }
+    return 0x00
+}
+
+func keyTypeFromFlag(b byte) KeyType {
+    switch b & 0xc0 {
+        case 0x40:
+            return KEY_3K3DES
+        case 0x80:
+            return KEY_AES
+    }
+    return KEY_2K3DES
+}
+
+// Key with version. DES keys are held as 16 bytes with identical halves;
+// the version of DES and 3DES keys is stored in the parity bits of the
+// first eight key bytes.
+type Key struct {
+    Type KeyType
+    Value []byte
+    Version byte
+}
+
+// Create DES key from 8 bytes.
+func DESKey(value []byte) Key {
+    v := make([]byte, 16)
+    copy(v, value)
+    copy(v[8:], value)
+    return Key{Type: KEY_DES, Value: v}
+}
+
+// Create two-key 3DES key from 16 bytes.
+func TDES2Key(value []byte) Key {
+    return Key{Type: KEY_2K3DES, Value: append([]byte{}, value...)}
+}
+
+// Create three-key 3DES key from 24 bytes.
+func TDES3Key(value []byte) Key {
+    return Key{Type: KEY_3K3DES, Value: append([]byte{}, value...)}
+}
+
+// Create AES-128 key from 16 bytes.
+func AESKey(value []byte) Key {
+    return Key{Type: KEY_AES, Value: append([]byte{}, value...)}
+}
+
+// Return all-zero default key of key type, as set on new cards and
+// applications.
+func DefaultKey(t KeyType) Key {
+    if t == KEY_3K3DES {
+        return Key{Type: t, Value: make([]byte, 24)}
+    }
+    return Key{Type: t, Value: make([]byte, 16)}
+}
+
+// Return key with version.
+func (k Key) WithVersion(version byte) Key {
+    k.Version = version
+    return k
+}
+
+func (k Key) check() error {
+    size := 16
+    if k.Type == KEY_3K3DES { size = 24 }
+    if len(k.Value) != size {
+        return fmt.Errorf("invalid %s key length: %d", k.Type, len(k.Value))
+    }
+    return nil
+}
+
+// Return key bytes as stored on the card, i.e. with the version in the
+// parity bits of DES and 3DES keys.
+func (k Key) bytes() []byte {
+    v := append([]byte{}, k.Value...)
+    if k.Type == KEY_AES { return v }
+    for i := 0; i < 8; i++ {
+        v[i] = v[i] &^ 1 | (k.Version >> uint(7 - i)) & 1
+        if k.Type == KEY_DES { v[i+8] = v[i] }
+    }
+    return v
+}
+
+// Return block cipher for key.
+func (k Key) cipher() (cipher.Block, error) {
+    if err := k.check(); err != nil { return nil, err }
+    return newCipher(k.Type, k.Value)
+}
+
+func newCipher(t KeyType, key []byte) (cipher.Block, error) {
+    switch t {
+        case KEY_DES:
+            return des.NewCipher(key[:8])
+        case KEY_2K3DES:
+            return des.NewTripleDESCipher(append(append([]byte{}, key...),
+                key[:8]...))
+        case KEY_3K3DES:
+            return des.NewTripleDESCipher(key)
+        case KEY_AES:
+            return aes.NewCipher(key)
+    }
+    return nil, fmt.Errorf("unsupported key type %s", t)
+}
+
+// Authenticate with key number of the selected application or the PICC,
+// using AuthenticateISO for DES and 3DES keys and AuthenticateAES for AES
+// keys (EV1 secure messaging).
+func (c *Card) Authenticate(keyNo int, key Key) error {
+    c.session = nil
+    block, err := key.cipher()
+    if err != nil { return err }
+    cmd := byte(CMD_AUTHENTICATE_ISO)
+    if key.Type == KEY_AES { cmd = CMD_AUTHENTICATE_AES }
+    n := 8
+    if key.Type == KEY_3K3DES || key.Type == KEY_AES { n = 16 }
+    bs := block.BlockSize()
+    ekRndB, status, err := c.exchange(cmd, []byte{byte(keyNo)})
+    if err != nil { return err }
+    if status != ADDITIONAL_FRAME || len(ekRndB) != n {
+        return fmt.Errorf("unexpected authentication response")
+    }
+    rndB := decryptCBC(block, make([]byte, bs), ekRndB)
+    rndA := make([]byte, n)
+    if _, err := rand.Read(rndA); err != nil { return err }
+    token := encryptCBC(block, ekRndB[n-bs:],
+        append(append([]byte{}, rndA...), rotate(rndB)...))
+    ekRndA, status, err := c.exchange(CMD_ADDITIONAL_FRAME, token)
+    if err != nil { return err }
+    if status != OPERATION_OK || len(ekRndA) != n {
+        return fmt.Errorf("unexpected authentication response")
+    }
+    if !bytes.Equal(decryptCBC(block, token[len(token)-bs:], ekRndA),
+        rotate(rndA)) {
+        return fmt.Errorf("card authentication failed")
+    }
+    t, sk := ev1SessionKey(key, rndA, rndB)
+    enc, err := newCipher(t, sk)
+    if err != nil { return err }
+    c.session = &session{keyNo: byte(keyNo), key: key, enc: enc, mac: enc,
+        iv: make([]byte, bs)}
+    return nil
+}
+
+// Return EV1 session key type and value. A 2K3DES key with identical
+// halves is a DES key.
+func ev1SessionKey(key Key, rndA, rndB []byte) (KeyType, []byte) {
+    switch key.Type {
+        case KEY_DES:
+            return KEY_DES, cat(rndA[0:4], rndB[0:4])
+        case KEY_2K3DES:
+            k := key.bytes()
+            for i := range k {
+                k[i] &^= 1
+            }
+            if bytes.Equal(k[:8], k[8:]) {
+                return KEY_DES, cat(rndA[0:4], rndB[0:4])
+            }
+            return KEY_2K3DES, cat(rndA[0:4], rndB[0:4], rndA[4:8], rndB[4:8])
+        case KEY_3K3DES:
+            return KEY_3K3DES, cat(rndA[0:4], rndB[0:4], rndA[6:10],
+                rndB[6:10], rndA[12:16], rndB[12:16])
+    }
+    return KEY_AES, cat(rndA[0:4], rndB[0:4], rndA[12:16], rndB[12:16])
+}
+
+// Authenticate with AES key and start an EV2 secure messaging session
+// (AuthenticateEV2First).
+func (c *Card) AuthenticateEV2First(keyNo int, key Key) error {
+    c.session = nil
+    rndA, rndB, rsp, err := c.authenticateEV2(CMD_AUTHENTICATE_EV2_FIRST,
+        []byte{byte(keyNo), 0x00}, key, 32)
+    if err != nil { return err }
+    s, err := newEV2Session(key, rndA, rndB)
+    if err != nil { return err }
+    s.keyNo = byte(keyNo)
+    s.ti = rsp[0:4]
+    c.session = s
+    return nil
+}
+
+// Authenticate with AES key within an EV2 session, keeping transaction
+// identifier and command counter (AuthenticateEV2NonFirst).
+func (c *Card) AuthenticateEV2NonFirst(keyNo int, key Key) error {
+    old := c.session
+    if old == nil || !old.ev2 {
+        return fmt.Errorf("AuthenticateEV2NonFirst requires EV2 session")
+    }
+    c.session = nil
+    rndA, rndB, _, err := c.authenticateEV2(CMD_AUTHENTICATE_EV2_NON_FIRST,
+        []byte{byte(keyNo)}, key, 16)
+    if err != nil { return err }
+    s, err := newEV2Session(key, rndA, rndB)
+    if err != nil { return err }
+    s.keyNo = byte(keyNo)
+    s.ti = old.ti
+    s.ctr = old.ctr
+    c.session = s
+    return nil
+}
+
+// Run EV2 authentication handshake and return RndA, RndB and the
+// deciphered final card response (TI||RndA'||PDcap2||PCDcap2 for
+// EV2First, RndA' for EV2NonFirst).
+func (c *Card) authenticateEV2(cmd byte, data []byte, key Key,
+    rspLen int) ([]byte, []byte, []byte, error) {
+    if key.Type != KEY_AES {
+        return nil, nil, nil, fmt.Errorf("EV2 authentication requires AES key")
+    }
+    block, err := key.cipher()
+    if err != nil { return nil, nil, nil, err }
+    iv := make([]byte, 16)
+    ekRndB, status, err := c.exchange(cmd, data)
+    if err != nil { return nil, nil, nil, err }
+    if status != ADDITIONAL_FRAME || len(ekRndB) != 16 {
+        return nil, nil, nil, fmt.Errorf("unexpected authentication response")
+    }
+    rndB := decryptCBC(block, iv, ekRndB)
+    rndA := make([]byte, 16)
+    if _, err := rand.Read(rndA); err != nil { return nil, nil, nil, err }
+    token := encryptCBC(block, iv, cat(rndA, rotate(rndB)))
+    ek, status, err := c.exchange(CMD_ADDITIONAL_FRAME, token)
+    if err != nil { return nil, nil, nil, err }
+    if status != OPERATION_OK || len(ek) != rspLen {
+        return nil, nil, nil, fmt.Errorf("unexpected authentication response")
+    }
+    rsp := decryptCBC(block, iv, ek)
+    rndA2 := rsp
+    if rspLen == 32 { rndA2 = rsp[4:20] }
+    if !bytes.Equal(rndA2, rotate(rndA)) {
+        return nil, nil, nil, fmt.Errorf("card authentication failed")
+    }
+    return rndA, rndB, rsp, nil
+}
+
+// Derive EV2 session keys from session vectors SV1 and SV2.
+func newEV2Session(key Key, rndA, rndB []byte) (*session, error) {
+    block, err := key.cipher()
+    if err != nil { return nil, err }
+    sv := func(label []byte) []byte {
+        v := cat(label, rndA[0:2])
+        for i := 0; i < 6; i++ {
+            v = append(v, rndA[2+i] ^ rndB[i])
+        }
+        return cat(v, rndB[6:16], rndA[8:16])
+    }
+    encKey, err := cmac.Sum(block,
+        sv([]byte{0xa5, 0x5a, 0x00, 0x01, 0x00, 0x80}))
+    if err != nil { return nil, err }
+    macKey, err := cmac.Sum(block,
+        sv([]byte{0x5a, 0xa5, 0x00, 0x01, 0x00, 0x80}))
+    if err != nil { return nil, err }
+    s := &session{ev2: true, key: key}
+    if s.enc, err = aes.NewCipher(encKey); err != nil { return nil, err }
+    if s.mac, err = aes.NewCipher(macKey); err != nil { return nil, err }
+    return s, nil
+}
+
+// Change key of the selected application or the PICC master key. The old
+// key is required unless the authenticated key itself is changed, which
+// ends the authentication.
+func (c *Card) ChangeKey(keyNo int, newKey, oldKey Key) error {
+    s := c.session
+    if s == nil {
+        return fmt.Errorf("ChangeKey requires authentication")
+    }
+    if err := newKey.check(); err != nil { return err }
+    keyByte := byte(keyNo)
+    if c.aid == 0 && keyNo == 0 { keyByte |= newKey.Type.flag() }
+    same := byte(keyNo) & 0x0f == s.keyNo
+    newBytes := newKey.bytes()
+    cryptogram := newBytes
+    if !same {
+        if err := oldKey.check(); err != nil { return err }
+        old := oldKey.bytes()
+        if len(old) != len(newBytes) {
+            return fmt.Errorf("old and new key lengths differ")
+        }
+        cryptogram = make([]byte, len(newBytes))
+        for i := range cryptogram {
+            cryptogram[i] = newBytes[i] ^ old[i]
+        }
+    }
+    if newKey.Type == KEY_AES {
+        cryptogram = append(cryptogram, newKey.Version)
+    }
+    var payload []byte
+    var err error
+    if s.ev2 {
+        if !same { cryptogram = cat(cryptogram, crc(newBytes)) }
+        payload, err = s.wrap(CMD_CHANGE_KEY, []byte{keyByte}, cryptogram,
+            COMM_FULL)
+        if err != nil { return err }
+    } else {
+        cryptogram = cat(cryptogram, crc([]byte{CMD_CHANGE_KEY, keyByte},
+            cryptogram))
+        if !same { cryptogram = cat(cryptogram, crc(newBytes)) }
+        payload = cat([]byte{keyByte}, s.encipher(cryptogram))
+    }
+    rsp, err := c.transceive(CMD_CHANGE_KEY, payload)
+    if err != nil || same {
+        c.session = nil
+        return err
+    }
+    if _, err := s.unwrap(rsp, COMM_MAC); err != nil {
+        c.session = nil
+        return err
+    }
+    return nil
+}
+
+// Rotate left by one byte.
+func rotate(b []byte) []byte {
+    return append(append([]byte{}, b[1:]...), b[0])
+}
+
+func cat(parts ...[]byte) []byte {
+    var out []byte
+    for _, p := range parts {
+        out = append(out, p...)
+    }
+    return out
+}
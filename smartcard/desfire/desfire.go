@@ -0,0 +1,458 @@
+/*
+Package desfire implements the MIFARE DESFire EV1/EV2/EV3 command set.
+Native commands are wrapped in ISO 7816-4 APDUs (CLA 0x90, INS = command
+code) and sent through a smartcard.Transmitter, so any PC/SC reader can be
+used. Authentication with DES, 2K3DES, 3K3DES (AuthenticateISO) and AES
+(AuthenticateAES, AuthenticateEV2First, AuthenticateEV2NonFirst) is
+supported, followed by plain, MACed or fully enciphered communication.
+The legacy D40 secure messaging (native Authenticate 0x0A) is not
+supported.
+
+Example:
+
+    d := desfire.New(card)
+    err := d.SelectApplication(0x123456)
+    // handle error, if any
+    err = d.Authenticate(0, desfire.AESKey(key))
+    // handle error, if any
+    data, err := d.ReadData(1, 0, 0, desfire.COMM_FULL)
+*/
+package desfire
+
+import (
+    "encoding/binary"
+    "fmt"
+    "github.com/sf1/go-card/smartcard"
+)
+
+const (
+    // ISO 7816 wrapping class byte
+    CLA_WRAPPED = 0x90
+    // Native commands
+    CMD_AUTHENTICATE_ISO = 0x1a
+    CMD_AUTHENTICATE_AES = 0xaa
+    CMD_AUTHENTICATE_EV2_FIRST = 0x71
+    CMD_AUTHENTICATE_EV2_NON_FIRST = 0x77
+    CMD_CHANGE_KEY_SETTINGS = 0x54
+    CMD_GET_KEY_SETTINGS = 0x45
+    CMD_CHANGE_KEY = 0xc4
+    CMD_GET_KEY_VERSION = 0x64
+    CMD_CREATE_APPLICATION = 0xca
+    CMD_DELETE_APPLICATION = 0xda
+    CMD_GET_APPLICATION_IDS = 0x6a
+    CMD_FREE_MEMORY = 0x6e
+    CMD_SELECT_APPLICATION = 0x5a
+    CMD_FORMAT_PICC = 0xfc
+    CMD_GET_VERSION = 0x60
+    CMD_GET_CARD_UID = 0x51
+    CMD_GET_FILE_IDS = 0x6f
+    CMD_GET_FILE_SETTINGS = 0xf5
+    CMD_CREATE_STD_DATA_FILE = 0xcd
+    CMD_CREATE_BACKUP_DATA_FILE = 0xcb
+    CMD_CREATE_VALUE_FILE = 0xcc
+    CMD_CREATE_LINEAR_RECORD_FILE = 0xc1
+    CMD_CREATE_CYCLIC_RECORD_FILE = 0xc0
+    CMD_DELETE_FILE = 0xdf
+    CMD_READ_DATA = 0xbd
+    CMD_WRITE_DATA = 0x3d
+    CMD_GET_VALUE = 0x6c
+    CMD_CREDIT = 0x0c
+    CMD_DEBIT = 0xdc
+    CMD_LIMITED_CREDIT = 0x1c
+    CMD_WRITE_RECORD = 0x3b
+    CMD_READ_RECORDS = 0xbb
+    CMD_CLEAR_RECORD_FILE = 0xeb
+    CMD_COMMIT_TRANSACTION = 0xc7
+    CMD_ABORT_TRANSACTION = 0xa7
+    CMD_ADDITIONAL_FRAME = 0xaf
+    // Maximum data bytes per wrapped command frame
+    FRAME_SIZE = 55
+)
+
+// DESFire status code, returned in SW2 with SW1 0x91.
+type Status byte
+
+const (
+    OPERATION_OK Status = 0x00
+    NO_CHANGES Status = 0x0c
+    OUT_OF_EEPROM_ERROR Status = 0x0e
+    ILLEGAL_COMMAND_CODE Status = 0x1c
+    INTEGRITY_ERROR Status = 0x1e
+    NO_SUCH_KEY Status = 0x40
+    LENGTH_ERROR Status = 0x7e
+    PERMISSION_DENIED Status = 0x9d
+    PARAMETER_ERROR Status = 0x9e
+    APPLICATION_NOT_FOUND Status = 0xa0
+    APPL_INTEGRITY_ERROR Status = 0xa1
+    AUTHENTICATION_ERROR Status = 0xae
+    ADDITIONAL_FRAME Status = 0xaf
+    BOUNDARY_ERROR Status = 0xbe
+    PICC_INTEGRITY_ERROR Status = 0xc1
+    COMMAND_ABORTED Status = 0xca
+    PICC_DISABLED_ERROR Status = 0xcd
+    COUNT_ERROR Status = 0xce
+    DUPLICATE_ERROR Status = 0xde
+    EEPROM_ERROR Status = 0xee
+    FILE_NOT_FOUND Status = 0xf0
+    FILE_INTEGRITY_ERROR Status = 0xf1
+)
+
+var statusNames = map[Status]string{
+    OPERATION_OK: "OPERATION_OK",
+    NO_CHANGES: "NO_CHANGES",
+    OUT_OF_EEPROM_ERROR: "OUT_OF_EEPROM_ERROR",
+    ILLEGAL_COMMAND_CODE: "ILLEGAL_COMMAND_CODE",
+    INTEGRITY_ERROR: "INTEGRITY_ERROR",
+    NO_SUCH_KEY: "NO_SUCH_KEY",
+    LENGTH_ERROR: "LENGTH_ERROR",
+    PERMISSION_DENIED: "PERMISSION_DENIED",
+    PARAMETER_ERROR: "PARAMETER_ERROR",
+    APPLICATION_NOT_FOUND: "APPLICATION_NOT_FOUND",
+    APPL_INTEGRITY_ERROR: "APPL_INTEGRITY_ERROR",
+    AUTHENTICATION_ERROR: "AUTHENTICATION_ERROR",
+    ADDITIONAL_FRAME: "ADDITIONAL_FRAME",
+    BOUNDARY_ERROR: "BOUNDARY_ERROR",
+    PICC_INTEGRITY_ERROR: "PICC_INTEGRITY_ERROR",
+    COMMAND_ABORTED: "COMMAND_ABORTED",
+    PICC_DISABLED_ERROR: "PICC_DISABLED_ERROR",
+    COUNT_ERROR: "COUNT_ERROR",
+    DUPLICATE_ERROR: "DUPLICATE_ERROR",
+    EEPROM_ERROR: "EEPROM_ERROR",
+    FILE_NOT_FOUND: "FILE_NOT_FOUND",
+    FILE_INTEGRITY_ERROR: "FILE_INTEGRITY_ERROR",
+}
+
+func (s Status) Error() string {
+    if name, ok := statusNames[s]; ok {
+        return fmt.Sprintf("DESFire status %02X (%s)", byte(s), name)
+    }
+    return fmt.Sprintf("DESFire status %02X", byte(s))
+}
+
+// Communication mode of a file or command.
+type CommMode byte
+
+const (
+    COMM_PLAIN CommMode = 0x00
+    COMM_MAC CommMode = 0x01
+    COMM_FULL CommMode = 0x03
+)
+
+// DESFire card.
+type Card struct {
+    card smartcard.Transmitter
+    aid uint32
+    session *session
+}
+
+// Create DESFire card from transmitter, e.g. a *smartcard.Card.
+func New(card smartcard.Transmitter) *Card {
+    return &Card{card: card}
+}
+
+// Return underlying transmitter.
+func (c *Card) Transmitter() smartcard.Transmitter {
+    return c.card
+}
+
+// Return whether a key is authenticated.
+func (c *Card) Authenticated() bool {
+    return c.session != nil
+}
+
+// Return number of the authenticated key, or -1.
+func (c *Card) AuthenticatedKey() int {
+    if c.session == nil { return -1 }
+    return int(c.session.keyNo)
+}
+
+// Send a single wrapped command frame. Returns the response data and
+// status, which is either OPERATION_OK or ADDITIONAL_FRAME.
+func (c *Card) exchange(ins byte, data []byte) ([]byte, Status, error) {
+    apdu := smartcard.Command2(CLA_WRAPPED, ins, 0x00, 0x00, 0x00)
+    if len(data) > 0 {
+        apdu = smartcard.Command4(CLA_WRAPPED, ins, 0x00, 0x00, data, 0x00)
+    }
+    rsp, err := c.card.TransmitAPDU(apdu)
+    if err != nil { return nil, 0, err }
+    if rsp.SW1() != 0x91 {
+        return nil, 0, smartcard.SWError(rsp.SW())
+    }
+    status := Status(rsp.SW2())
+    if status != ADDITIONAL_FRAME && status != OPERATION_OK {
+        return nil, status, status
+    }
+    return rsp.Data(), status, nil
+}
+
+// Send native command, splitting data into several frames and collecting
+// additional response frames.
+func (c *Card) transceive(cmd byte, data []byte) ([]byte, error) {
+    ins := cmd
+    var rspData []byte
+    for {
+        frame := data
+        if len(frame) > FRAME_SIZE { frame = frame[:FRAME_SIZE] }
+        data = data[len(frame):]
+        rsp, status, err := c.exchange(ins, frame)
+        if err != nil { return nil, err }
+        if len(data) > 0 {
+            if status != ADDITIONAL_FRAME {
+                return nil, fmt.Errorf("card did not accept more data")
+            }
+        } else {
+            rspData = append(rspData, rsp...)
+            if status == OPERATION_OK {
+                return rspData, nil
+            }
+        }
+        ins = CMD_ADDITIONAL_FRAME
+    }
+}
+
+// Send command with secure messaging for the current session. The header
+// is sent in plain, data according to cmdMode; the response is verified
+// and deciphered according to rspMode.
+func (c *Card) command(cmd byte, header, data []byte,
+    cmdMode, rspMode CommMode) ([]byte, error) {
+    if c.session == nil {
+        return c.transceive(cmd, append(append([]byte{}, header...),
+            data...))
+    }
+    payload, err := c.session.wrap(cmd, header, data, cmdMode)
+    if err != nil { return nil, err }
+    rsp, err := c.transceive(cmd, payload)
+    if err != nil {
+        // An error status ends the authentication
+        if _, ok := err.(Status); ok { c.session = nil }
+        return nil, err
+    }
+    rsp, err = c.session.unwrap(rsp, rspMode)
+    if err != nil {
+        c.session = nil
+        return nil, err
+    }
+    return rsp, nil
+}
+
+// Version information returned by GetVersion.
+type Version struct {
+    HardwareVendor, HardwareType, HardwareSubtype byte
+    HardwareMajor, HardwareMinor byte
+    HardwareStorageSize byte
+    HardwareProtocol byte
+    SoftwareVendor, SoftwareType, SoftwareSubtype byte
+    SoftwareMajor, SoftwareMinor byte
+    SoftwareStorageSize byte
+    SoftwareProtocol byte
+    UID []byte
+    BatchNumber []byte
+    ProductionWeek, ProductionYear byte
+}
+
+// Return product generation derived from the software major version,
+// e.g. "EV1".
+func (v *Version) Generation() string {
+    switch v.SoftwareMajor {
+        case 0x00:
+            return "D40"
+        case 0x01:
+            return "EV1"
+        case 0x12:
+            return "EV2"
+        case 0x33:
+            return "EV3"
+    }
+    return fmt.Sprintf("unknown (%02X)", v.SoftwareMajor)
+}
+
+// Return storage size in bytes. Storage size bytes encode 2^(n>>1) bytes.
+func (v *Version) StorageSize() int {
+    return 1 << (v.HardwareStorageSize >> 1)
+}
+
+// Return version information (GetVersion).
+func (c *Card) GetVersion() (*Version, error) {
+    data, err := c.command(CMD_GET_VERSION, nil, nil, COMM_MAC, COMM_MAC)
+    if err != nil { return nil, err }
+    if len(data) < 28 {
+        return nil, fmt.Errorf("invalid version length: %d", len(data))
+    }
+    return &Version{
+        HardwareVendor: data[0], HardwareType: data[1],
+        HardwareSubtype: data[2], HardwareMajor: data[3],
+        HardwareMinor: data[4], HardwareStorageSize: data[5],
+        HardwareProtocol: data[6],
+        SoftwareVendor: data[7], SoftwareType: data[8],
+        SoftwareSubtype: data[9], SoftwareMajor: data[10],
+        SoftwareMinor: data[11], SoftwareStorageSize: data[12],
+        SoftwareProtocol: data[13],
+        UID: data[14:21], BatchNumber: data[21:26],
+        ProductionWeek: data[26], ProductionYear: data[27],
+    }, nil
+}
+
+// Return the real UID of a card with random ID enabled (GetCardUID).
+// Requires authentication.
+func (c *Card) GetCardUID() ([]byte, error) {
+    if c.session == nil {
+        return nil, fmt.Errorf("GetCardUID requires authentication")
+    }
+    return c.command(CMD_GET_CARD_UID, nil, nil, COMM_MAC, COMM_FULL)
+}
+
+// Return free memory on the card in bytes.
+func (c *Card) FreeMemory() (int, error) {
+    data, err := c.command(CMD_FREE_MEMORY, nil, nil, COMM_MAC, COMM_MAC)
+    if err != nil { return 0, err }
+    if len(data) != 3 {
+        return 0, fmt.Errorf("invalid free memory length: %d", len(data))
+    }
+    return int(uint24(data)), nil
+}
+
+// Delete all applications and files (FormatPICC). Requires authentication
+// with the PICC master key.
+func (c *Card) FormatPICC() error {
+    _, err := c.command(CMD_FORMAT_PICC, nil, nil, COMM_MAC, COMM_MAC)
+    return err
+}
+
+// Return identifiers of all applications on the card.
+func (c *Card) GetApplicationIDs() ([]uint32, error) {
+    data, err := c.command(CMD_GET_APPLICATION_IDS, nil, nil, COMM_MAC,
+        COMM_MAC)
+    if err != nil { return nil, err }
+    if len(data) % 3 != 0 {
+        return nil, fmt.Errorf("invalid application ID list length: %d",
+            len(data))
+    }
+    aids := make([]uint32, 0, len(data) / 3)
+    for i := 0; i < len(data); i += 3 {
+        aids = append(aids, uint24(data[i:]))
+    }
+    return aids, nil
+}
+
+// Select application by identifier; 0 selects the PICC level. Selecting an
+// application ends the current authentication.
+func (c *Card) SelectApplication(aid uint32) error {
+    c.session = nil
+    _, err := c.transceive(CMD_SELECT_APPLICATION, put24(nil, aid))
+    if err != nil { return err }
+    c.aid = aid
+    return nil
+}
+
+// Create application with key settings, number of keys and key type
+// (CreateApplication). Requires PICC level.
+func (c *Card) CreateApplication(aid uint32, settings KeySettings,
+    numKeys int, keyType KeyType) error {
+    if numKeys < 1 || numKeys > 14 {
+        return fmt.Errorf("invalid number of keys: %d", numKeys)
+    }
+    header := put24(nil, aid)
+    header = append(header, byte(settings), byte(numKeys) | keyType.flag())
+    _, err := c.command(CMD_CREATE_APPLICATION, header, nil, COMM_MAC,
+        COMM_MAC)
+    return err
+}
+
+// Delete application (DeleteApplication).
+func (c *Card) DeleteApplication(aid uint32) error {
+    _, err := c.command(CMD_DELETE_APPLICATION, put24(nil, aid), nil,
+        COMM_MAC, COMM_MAC)
+    return err
+}
+
+// Key settings byte of an application or the PICC.
+type KeySettings byte
+
+const (
+    // Master key can be changed
+    KS_ALLOW_CHANGE_MK KeySettings = 0x01
+    // Directory lists without master key authentication
+    KS_FREE_LISTING KeySettings = 0x02
+    // Create/delete without master key authentication
+    KS_FREE_CREATE_DELETE KeySettings = 0x04
+    // Key settings can be changed
+    KS_CONFIGURATION_CHANGEABLE KeySettings = 0x08
+    // Default: all flags set, change key access with master key
+    KS_DEFAULT KeySettings = 0x0f
+)
+
+// Return key settings for the given change key access rights (bits 4-7:
+// 0x0 master key, 0x1-0xD that key, 0xE the key to be changed, 0xF keys
+// frozen) and flags.
+func NewKeySettings(changeKey byte, flags KeySettings) KeySettings {
+    return KeySettings(changeKey << 4) | flags & 0x0f
+}
+
+// Return change key access rights (bits 4-7).
+func (ks KeySettings) ChangeKey() byte {
+    return byte(ks) >> 4
+}
+
+// Return key settings and maximum number of keys of the selected
+// application (GetKeySettings).
+func (c *Card) GetKeySettings() (KeySettings, int, KeyType, error) {
+    data, err := c.command(CMD_GET_KEY_SETTINGS, nil, nil, COMM_MAC,
+        COMM_MAC)
+    if err != nil { return 0, 0, 0, err }
+    if len(data) != 2 {
+        return 0, 0, 0, fmt.Errorf("invalid key settings length: %d",
+            len(data))
+    }
+    return KeySettings(data[0]), int(data[1] & 0x0f),
+        keyTypeFromFlag(data[1]), nil
+}
+
+// Change key settings of the selected application (ChangeKeySettings).
+// Requires authentication with the master key.
+func (c *Card) ChangeKeySettings(settings KeySettings) error {
+    if c.session == nil {
+        return fmt.Errorf("ChangeKeySettings requires authentication")
+    }
+    _, err := c.command(CMD_CHANGE_KEY_SETTINGS, nil,
+        []byte{byte(settings)}, COMM_FULL, COMM_MAC)
+    return err
+}
+
+// Return version of key (GetKeyVersion).
+func (c *Card) GetKeyVersion(keyNo int) (byte, error) {
+    data, err := c.command(CMD_GET_KEY_VERSION, []byte{byte(keyNo)}, nil,
+        COMM_MAC, COMM_MAC)
+    if err != nil { return 0, err }
+    if len(data) != 1 {
+        return 0, fmt.Errorf("invalid key version length: %d", len(data))
+    }
+    return data[0], nil
+}
+
+// Commit transaction on backup, value and record files.
+func (c *Card) CommitTransaction() error {
+    _, err := c.command(CMD_COMMIT_TRANSACTION, nil, nil, COMM_MAC,
+        COMM_MAC)
+    return err
+}
+
+// Abort transaction on backup, value and record files.
+func (c *Card) AbortTransaction() error {
+    _, err := c.command(CMD_ABORT_TRANSACTION, nil, nil, COMM_MAC,
+        COMM_MAC)
+    return err
+}
+
+func uint24(b []byte) uint32 {
+    return uint32(b[0]) | uint32(b[1]) << 8 | uint32(b[2]) << 16
+}
+
+func put24(b []byte, v uint32) []byte {
+    return append(b, byte(v), byte(v >> 8), byte(v >> 16))
+}
+
+func put32(b []byte, v uint32) []byte {
+    var buf [4]byte
+    binary.LittleEndian.PutUint32(buf[:], v)
+    return append(b, buf[:]...)
+}
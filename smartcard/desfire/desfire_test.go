@@ -0,0 +1,326 @@
+package desfire
+
+import (
+    "bytes"
+    "crypto/aes"
+    "crypto/cipher"
+    "fmt"
+    "testing"
+    "github.com/sf1/go-card/smartcard"
+    "github.com/sf1/go-card/smartcard/mock"
+)
+
+var keyNoAccess = AccessRights{Read: 1, Write: 1, ReadWrite: 1, Change: 0}
+
+func TestCRC(t *testing.T) {
+    if v := crc([]byte("123456789")); !bytes.Equal(v,
+        []byte{0xd9, 0xc6, 0x0b, 0x34}) {
+        t.Errorf("unexpected CRC %X", v)
+    }
+}
+
+func TestKeyVersion(t *testing.T) {
+    k := TDES2Key(bytes.Repeat([]byte{0xff}, 16)).WithVersion(0xa5)
+    b := k.bytes()
+    if !bytes.Equal(b[:8], []byte{0xff, 0xfe, 0xff, 0xfe, 0xfe, 0xff, 0xfe,
+        0xff}) || !bytes.Equal(b[8:], k.Value[8:]) {
+        t.Errorf("unexpected key bytes %X", b)
+    }
+    d := DESKey([]byte{1, 2, 3, 4, 5, 6, 7, 8}).bytes()
+    if !bytes.Equal(d[:8], d[8:]) || d[0] != 0 || d[7] != 8 {
+        t.Errorf("unexpected DES key bytes %X", d)
+    }
+}
+
+func TestStatus(t *testing.T) {
+    if s := AUTHENTICATION_ERROR.Error(); s !=
+        "DESFire status AE (AUTHENTICATION_ERROR)" {
+        t.Errorf("unexpected message %q", s)
+    }
+    if s := Status(0x42).Error(); s != "DESFire status 42" {
+        t.Errorf("unexpected message %q", s)
+    }
+}
+
+func TestPlain(t *testing.T) {
+    sim := newSimCard()
+    d := New(sim)
+    v, err := d.GetVersion()
+    if err != nil { t.Fatal(err) }
+    if v.Generation() != "EV2" || v.StorageSize() != 8192 ||
+        !bytes.Equal(v.UID, sim.uid) {
+        t.Errorf("unexpected version %+v", v)
+    }
+    for _, aid := range []uint32{0x223344, 0x112233} {
+        if err := d.CreateApplication(aid, KS_DEFAULT, 2, KEY_AES); err != nil {
+            t.Fatal(err)
+        }
+    }
+    aids, err := d.GetApplicationIDs()
+    if err != nil { t.Fatal(err) }
+    if fmt.Sprint(aids) != fmt.Sprint([]uint32{0x112233, 0x223344}) {
+        t.Errorf("unexpected AIDs %X", aids)
+    }
+    if err := d.SelectApplication(0x445566); err != APPLICATION_NOT_FOUND {
+        t.Errorf("unexpected error %v", err)
+    }
+    if err := d.SelectApplication(0x112233); err != nil { t.Fatal(err) }
+    settings, n, kt, err := d.GetKeySettings()
+    if err != nil { t.Fatal(err) }
+    if settings != KS_DEFAULT || n != 2 || kt != KEY_AES {
+        t.Errorf("unexpected key settings %02X %d %s", settings, n, kt)
+    }
+    free := AccessRights{ACCESS_FREE, ACCESS_FREE, ACCESS_FREE, 0}
+    if err := d.CreateStdDataFile(1, COMM_PLAIN, free, 128); err != nil {
+        t.Fatal(err)
+    }
+    data := bytes.Repeat([]byte("0123456789"), 10)
+    if err := d.WriteData(1, 8, data, COMM_PLAIN); err != nil {
+        t.Fatal(err)
+    }
+    read, err := d.ReadData(1, 0, 0, COMM_PLAIN)
+    if err != nil { t.Fatal(err) }
+    if len(read) != 128 || !bytes.Equal(read[8:108], data) {
+        t.Errorf("unexpected data %X", read)
+    }
+    ids, err := d.GetFileIDs()
+    if err != nil { t.Fatal(err) }
+    fs, err := d.GetFileSettings(1)
+    if err != nil { t.Fatal(err) }
+    if !bytes.Equal(ids, []byte{1}) || fs.Type != FILE_STANDARD_DATA ||
+        fs.Size != 128 || fs.Access != free {
+        t.Errorf("unexpected files %X %+v", ids, fs)
+    }
+    if _, err := d.ReadData(2, 0, 0, COMM_PLAIN); err != FILE_NOT_FOUND {
+        t.Errorf("unexpected error %v", err)
+    }
+    if _, err := d.GetCardUID(); err == nil {
+        t.Errorf("GetCardUID without authentication")
+    }
+}
+
+// Create files in all communication modes and exercise them with an
+// authenticated key 1.
+func fileOps(t *testing.T, d *Card, sim *simCard) {
+    modes := []CommMode{COMM_PLAIN, COMM_MAC, COMM_FULL}
+    for i, mode := range modes {
+        fileNo := 3 * i
+        if err := d.CreateStdDataFile(fileNo, mode, keyNoAccess,
+            150); err != nil {
+            t.Fatalf("mode %d: %s", mode, err)
+        }
+        data := bytes.Repeat([]byte{byte(i), 0x5a, 0xa5}, 40)
+        if err := d.WriteData(fileNo, 10, data, mode); err != nil {
+            t.Fatalf("mode %d: %s", mode, err)
+        }
+        read, err := d.ReadData(fileNo, 10, len(data), mode)
+        if err != nil { t.Fatalf("mode %d: %s", mode, err) }
+        if !bytes.Equal(read, data) {
+            t.Errorf("mode %d: unexpected data %X", mode, read)
+        }
+        read, err = d.ReadData(fileNo, 0, 0, mode)
+        if err != nil { t.Fatalf("mode %d: %s", mode, err) }
+        if len(read) != 150 || !bytes.Equal(read[10:130], data) {
+            t.Errorf("mode %d: unexpected file %X", mode, read)
+        }
+        // Value file
+        if err := d.CreateValueFile(fileNo + 1, mode, keyNoAccess, 0, 1000,
+            100, true); err != nil {
+            t.Fatalf("mode %d: %s", mode, err)
+        }
+        if err := d.Credit(fileNo + 1, 50, mode); err != nil {
+            t.Fatalf("mode %d: %s", mode, err)
+        }
+        if err := d.Debit(fileNo + 1, 30, mode); err != nil {
+            t.Fatalf("mode %d: %s", mode, err)
+        }
+        value, err := d.GetValue(fileNo + 1, mode)
+        if err != nil { t.Fatalf("mode %d: %s", mode, err) }
+        if value != 100 {
+            t.Errorf("mode %d: uncommitted value %d", mode, value)
+        }
+        if err := d.CommitTransaction(); err != nil { t.Fatal(err) }
+        value, err = d.GetValue(fileNo + 1, mode)
+        if err != nil { t.Fatalf("mode %d: %s", mode, err) }
+        if value != 120 {
+            t.Errorf("mode %d: unexpected value %d", mode, value)
+        }
+        // Cyclic record file with two usable records
+        if err := d.CreateCyclicRecordFile(fileNo + 2, mode, keyNoAccess,
+            16, 3); err != nil {
+            t.Fatalf("mode %d: %s", mode, err)
+        }
+        for r := 0; r < 3; r++ {
+            rec := bytes.Repeat([]byte{byte(r)}, 16)
+            if err := d.WriteRecord(fileNo + 2, 0, rec, mode); err != nil {
+                t.Fatalf("mode %d: %s", mode, err)
+            }
+            if err := d.CommitTransaction(); err != nil { t.Fatal(err) }
+        }
+        records, err := d.ReadRecords(fileNo + 2, 0, 0, mode)
+        if err != nil { t.Fatalf("mode %d: %s", mode, err) }
+        if !bytes.Equal(records, append(bytes.Repeat([]byte{1}, 16),
+            bytes.Repeat([]byte{2}, 16)...)) {
+            t.Errorf("mode %d: unexpected records %X", mode, records)
+        }
+        fs, err := d.GetFileSettings(fileNo + 2)
+        if err != nil { t.Fatal(err) }
+        if fs.Type != FILE_CYCLIC_RECORD || fs.CommMode != mode ||
+            fs.RecordSize != 16 || fs.CurrentRecords != 2 {
+            t.Errorf("mode %d: unexpected file settings %+v", mode, fs)
+        }
+    }
+    uid, err := d.GetCardUID()
+    if err != nil { t.Fatal(err) }
+    if !bytes.Equal(uid, sim.uid) {
+        t.Errorf("unexpected UID %X", uid)
+    }
+    if err := d.Debit(1, 500, COMM_PLAIN); err != BOUNDARY_ERROR {
+        t.Errorf("unexpected error %v", err)
+    }
+    if d.Authenticated() {
+        t.Errorf("authentication not reset after error")
+    }
+}
+
+func TestEV1(t *testing.T) {
+    keys := []Key{
+        DESKey([]byte{1, 2, 3, 4, 5, 6, 7, 8}),
+        TDES2Key(bytes.Repeat([]byte{1, 2, 3, 4, 5, 6, 7, 8, 9}, 2)[:16]),
+        TDES3Key(bytes.Repeat([]byte{0x11, 0x22, 0x33}, 8)),
+        AESKey(bytes.Repeat([]byte{0x42}, 16)),
+    }
+    for i, key := range keys {
+        sim := newSimCard()
+        aid := uint32(0x100000 + i)
+        sim.addApp(aid, DefaultKey(key.Type), key)
+        d := New(sim)
+        if err := d.SelectApplication(aid); err != nil { t.Fatal(err) }
+        if err := d.Authenticate(0, DefaultKey(key.Type)); err != nil {
+            t.Fatalf("%s: %s", key.Type, err)
+        }
+        // Change key 0 to the key itself, as in personalization
+        if err := d.ChangeKey(0, key.WithVersion(3), Key{}); err != nil {
+            t.Fatalf("%s: %s", key.Type, err)
+        }
+        if d.Authenticated() {
+            t.Errorf("%s: authentication not reset by ChangeKey", key.Type)
+        }
+        if err := d.Authenticate(0, key.WithVersion(3)); err != nil {
+            t.Fatalf("%s: %s", key.Type, err)
+        }
+        // Change key 1 with the master key
+        newKey := key
+        newKey.Value = append([]byte{}, key.Value...)
+        newKey.Value[0] ^= 0xf0
+        newKey.Value[8] ^= 0xf0
+        if err := d.ChangeKey(1, newKey.WithVersion(7), key); err != nil {
+            t.Fatalf("%s: %s", key.Type, err)
+        }
+        version, err := d.GetKeyVersion(1)
+        if err != nil { t.Fatalf("%s: %s", key.Type, err) }
+        if version != 7 {
+            t.Errorf("%s: unexpected key version %d", key.Type, version)
+        }
+        if err := d.Authenticate(1, key); err != AUTHENTICATION_ERROR {
+            t.Errorf("%s: unexpected error %v", key.Type, err)
+        }
+        if err := d.Authenticate(1, newKey); err != nil {
+            t.Fatalf("%s: %s", key.Type, err)
+        }
+        fileOps(t, d, sim)
+    }
+}
+
+func TestEV2(t *testing.T) {
+    master := AESKey(bytes.Repeat([]byte{0x01}, 16))
+    key := AESKey(bytes.Repeat([]byte{0x02}, 16))
+    sim := newSimCard()
+    sim.addApp(0x0a0b0c, master, key)
+    d := New(sim)
+    if err := d.AuthenticateEV2NonFirst(0, master); err == nil {
+        t.Errorf("EV2NonFirst without session")
+    }
+    if err := d.SelectApplication(0x0a0b0c); err != nil { t.Fatal(err) }
+    if err := d.AuthenticateEV2First(0, master); err != nil { t.Fatal(err) }
+    if err := d.ChangeKeySettings(NewKeySettings(0x0e,
+        KS_DEFAULT)); err != nil {
+        t.Fatal(err)
+    }
+    if err := d.AuthenticateEV2NonFirst(1, key); err != nil { t.Fatal(err) }
+    if d.session.ctr != 1 || !bytes.Equal(d.session.ti, sim.session.ti) {
+        t.Errorf("transaction state not kept")
+    }
+    // Key 1 may change itself now
+    newKey := AESKey(bytes.Repeat([]byte{0x03}, 16)).WithVersion(1)
+    if err := d.ChangeKey(1, newKey, Key{}); err != nil { t.Fatal(err) }
+    if err := d.AuthenticateEV2First(0, master); err != nil { t.Fatal(err) }
+    settings, _, _, err := d.GetKeySettings()
+    if err != nil { t.Fatal(err) }
+    if settings.ChangeKey() != 0x0e {
+        t.Errorf("unexpected key settings %02X", settings)
+    }
+    if err := d.ChangeKey(1, key, newKey); err != nil { t.Fatal(err) }
+    if err := d.AuthenticateEV2First(1, key); err != nil { t.Fatal(err) }
+    fileOps(t, d, sim)
+}
+
+// Transmitter flipping a bit in the response data of one command.
+type tamper struct {
+    smartcard.Transmitter
+    ins byte
+}
+
+func (t *tamper) TransmitAPDU(cmd smartcard.CommandAPDU) (
+    smartcard.ResponseAPDU, error) {
+    rsp, err := t.Transmitter.TransmitAPDU(cmd)
+    if err == nil && cmd[1] == t.ins && len(rsp) > 2 {
+        rsp[0] ^= 0x01
+    }
+    return rsp, err
+}
+
+func TestTamper(t *testing.T) {
+    for _, ev2 := range []bool{false, true} {
+        sim := newSimCard()
+        sim.addApp(1, DefaultKey(KEY_AES))
+        d := New(&tamper{sim, CMD_GET_KEY_SETTINGS})
+        if err := d.SelectApplication(1); err != nil { t.Fatal(err) }
+        auth := d.Authenticate
+        if ev2 { auth = d.AuthenticateEV2First }
+        if err := auth(0, DefaultKey(KEY_AES)); err != nil { t.Fatal(err) }
+        if _, _, _, err := d.GetKeySettings(); err == nil ||
+            err.Error() != "response MAC mismatch" {
+            t.Errorf("EV2 %v: unexpected error %v", ev2, err)
+        }
+        if d.Authenticated() {
+            t.Errorf("EV2 %v: authentication not reset", ev2)
+        }
+    }
+}
+
+// Session keys of the AuthenticateEV2First example of NXP AN12196.
+func TestEV2SessionKeyVector(t *testing.T) {
+    rndA := mock.Hex("b0 4d 07 87 c9 3e e0 cc 8c ac c8 e8 6f 16 c6 fe")
+    rndB := mock.Hex("fa 65 9a d0 dc a7 38 dd 65 dc 7d c3 86 12 ad 81")
+    ss, err := newEV2Session(DefaultKey(KEY_AES), rndA, rndB)
+    if err != nil { t.Fatal(err) }
+    for _, v := range []struct {
+        name string
+        block cipher.Block
+        key string
+    }{
+        {"SesAuthENCKey", ss.enc, "63 dc 07 28 62 89 a7 a6 c0 33 4c a3 " +
+            "1c 31 4a 04"},
+        {"SesAuthMACKey", ss.mac, "77 4f 26 74 3e ce 6a f5 03 3b 6a e8 " +
+            "52 29 46 f6"},
+    } {
+        expected, _ := aes.NewCipher(mock.Hex(v.key))
+        a, b := make([]byte, 16), make([]byte, 16)
+        v.block.Encrypt(a, a)
+        expected.Encrypt(b, b)
+        if !bytes.Equal(a, b) {
+            t.Errorf("unexpected %s", v.name)
+        }
+    }
+}
@@ -0,0 +1,249 @@
+package desfire
+
+import (
+    "encoding/binary"
+    "fmt"
+)
+
+// File type.
+type FileType byte
+
+const (
+    FILE_STANDARD_DATA FileType = 0x00
+    FILE_BACKUP_DATA FileType = 0x01
+    FILE_VALUE FileType = 0x02
+    FILE_LINEAR_RECORD FileType = 0x03
+    FILE_CYCLIC_RECORD FileType = 0x04
+)
+
+const (
+    // Access condition: free access
+    ACCESS_FREE = 0x0e
+    // Access condition: access denied
+    ACCESS_DENY = 0x0f
+)
+
+// File access rights. Each condition is a key number 0x0-0xD, ACCESS_FREE
+// or ACCESS_DENY.
+type AccessRights struct {
+    Read, Write, ReadWrite, Change byte
+}
+
+// Encode access rights as two bytes, little-endian.
+func (a AccessRights) Bytes() []byte {
+    v := uint16(a.Read & 0x0f) << 12 | uint16(a.Write & 0x0f) << 8 |
+        uint16(a.ReadWrite & 0x0f) << 4 | uint16(a.Change & 0x0f)
+    return []byte{byte(v), byte(v >> 8)}
+}
+
+func parseAccessRights(b []byte) AccessRights {
+    v := binary.LittleEndian.Uint16(b)
+    return AccessRights{Read: byte(v >> 12) & 0x0f,
+        Write: byte(v >> 8) & 0x0f, ReadWrite: byte(v >> 4) & 0x0f,
+        Change: byte(v) & 0x0f}
+}
+
+// File settings returned by GetFileSettings. Only the fields of the file
+// type are set.
+type FileSettings struct {
+    Type FileType
+    CommMode CommMode
+    Access AccessRights
+    // Data files
+    Size int
+    // Value files
+    LowerLimit, UpperLimit int32
+    LimitedCreditValue int32
+    LimitedCredit bool
+    // Record files
+    RecordSize, MaxRecords, CurrentRecords int
+}
+
+// Return identifiers of files in the selected application.
+func (c *Card) GetFileIDs() ([]byte, error) {
+    return c.command(CMD_GET_FILE_IDS, nil, nil, COMM_MAC, COMM_MAC)
+}
+
+// Return settings of file.
+func (c *Card) GetFileSettings(fileNo int) (*FileSettings, error) {
+    data, err := c.command(CMD_GET_FILE_SETTINGS, []byte{byte(fileNo)}, nil,
+        COMM_MAC, COMM_MAC)
+    if err != nil { return nil, err }
+    if len(data) < 7 {
+        return nil, fmt.Errorf("invalid file settings length: %d", len(data))
+    }
+    fs := &FileSettings{Type: FileType(data[0]),
+        CommMode: CommMode(data[1] & 0x03),
+        Access: parseAccessRights(data[2:4])}
+    rest := data[4:]
+    switch fs.Type {
+        case FILE_STANDARD_DATA, FILE_BACKUP_DATA:
+            fs.Size = int(uint24(rest))
+        case FILE_VALUE:
+            if len(rest) < 13 {
+                return nil, fmt.Errorf("invalid value file settings")
+            }
+            fs.LowerLimit = int32(binary.LittleEndian.Uint32(rest[0:]))
+            fs.UpperLimit = int32(binary.LittleEndian.Uint32(rest[4:]))
+            fs.LimitedCreditValue = int32(binary.LittleEndian.Uint32(
+                rest[8:]))
+            fs.LimitedCredit = rest[12] & 0x01 != 0
+        case FILE_LINEAR_RECORD, FILE_CYCLIC_RECORD:
+            if len(rest) < 9 {
+                return nil, fmt.Errorf("invalid record file settings")
+            }
+            fs.RecordSize = int(uint24(rest[0:]))
+            fs.MaxRecords = int(uint24(rest[3:]))
+            fs.CurrentRecords = int(uint24(rest[6:]))
+        default:
+            return nil, fmt.Errorf("unknown file type %02X", byte(fs.Type))
+    }
+    return fs, nil
+}
+
+func (c *Card) createFile(cmd byte, fileNo int, mode CommMode,
+    access AccessRights, params []byte) error {
+    header := append([]byte{byte(fileNo), byte(mode)}, access.Bytes()...)
+    _, err := c.command(cmd, append(header, params...), nil, COMM_MAC,
+        COMM_MAC)
+    return err
+}
+
+// Create standard data file of size bytes.
+func (c *Card) CreateStdDataFile(fileNo int, mode CommMode,
+    access AccessRights, size int) error {
+    return c.createFile(CMD_CREATE_STD_DATA_FILE, fileNo, mode, access,
+        put24(nil, uint32(size)))
+}
+
+// Create backup data file of size bytes. Writes take effect with
+// CommitTransaction.
+func (c *Card) CreateBackupDataFile(fileNo int, mode CommMode,
+    access AccessRights, size int) error {
+    return c.createFile(CMD_CREATE_BACKUP_DATA_FILE, fileNo, mode, access,
+        put24(nil, uint32(size)))
+}
+
+// Create value file with limits, initial value and whether limited credit
+// is enabled.
+func (c *Card) CreateValueFile(fileNo int, mode CommMode,
+    access AccessRights, lower, upper, value int32,
+    limitedCredit bool) error {
+    params := put32(nil, uint32(lower))
+    params = put32(params, uint32(upper))
+    params = put32(params, uint32(value))
+    var flags byte
+    if limitedCredit { flags = 0x01 }
+    return c.createFile(CMD_CREATE_VALUE_FILE, fileNo, mode, access,
+        append(params, flags))
+}
+
+// Create linear record file.
+func (c *Card) CreateLinearRecordFile(fileNo int, mode CommMode,
+    access AccessRights, recordSize, maxRecords int) error {
+    return c.createFile(CMD_CREATE_LINEAR_RECORD_FILE, fileNo, mode, access,
+        put24(put24(nil, uint32(recordSize)), uint32(maxRecords)))
+}
+
+// Create cyclic record file. One record is reserved for the rotation, so
+// maxRecords must be at least 2.
+func (c *Card) CreateCyclicRecordFile(fileNo int, mode CommMode,
+    access AccessRights, recordSize, maxRecords int) error {
+    return c.createFile(CMD_CREATE_CYCLIC_RECORD_FILE, fileNo, mode, access,
+        put24(put24(nil, uint32(recordSize)), uint32(maxRecords)))
+}
+
+// Delete file.
+func (c *Card) DeleteFile(fileNo int) error {
+    _, err := c.command(CMD_DELETE_FILE, []byte{byte(fileNo)}, nil,
+        COMM_MAC, COMM_MAC)
+    return err
+}
+
+// Response mode of commands that only return a status.
+func statusMode(mode CommMode) CommMode {
+    if mode == COMM_FULL { return COMM_MAC }
+    return mode
+}
+
+// Read length bytes at offset from data file with communication mode of
+// the file. Length 0 reads up to the end of the file.
+func (c *Card) ReadData(fileNo, offset, length int,
+    mode CommMode) ([]byte, error) {
+    header := put24([]byte{byte(fileNo)}, uint32(offset))
+    header = put24(header, uint32(length))
+    return c.command(CMD_READ_DATA, header, nil, mode, mode)
+}
+
+// Write data at offset to data file with communication mode of the file.
+func (c *Card) WriteData(fileNo, offset int, data []byte,
+    mode CommMode) error {
+    header := put24([]byte{byte(fileNo)}, uint32(offset))
+    header = put24(header, uint32(len(data)))
+    _, err := c.command(CMD_WRITE_DATA, header, data, mode, statusMode(mode))
+    return err
+}
+
+// Return value of value file.
+func (c *Card) GetValue(fileNo int, mode CommMode) (int32, error) {
+    data, err := c.command(CMD_GET_VALUE, []byte{byte(fileNo)}, nil, mode,
+        mode)
+    if err != nil { return 0, err }
+    if len(data) != 4 {
+        return 0, fmt.Errorf("invalid value length: %d", len(data))
+    }
+    return int32(binary.LittleEndian.Uint32(data)), nil
+}
+
+func (c *Card) changeValue(cmd byte, fileNo int, amount int32,
+    mode CommMode) error {
+    if amount < 0 {
+        return fmt.Errorf("negative amount: %d", amount)
+    }
+    _, err := c.command(cmd, []byte{byte(fileNo)}, put32(nil,
+        uint32(amount)), mode, statusMode(mode))
+    return err
+}
+
+// Increase value of value file. Takes effect with CommitTransaction.
+func (c *Card) Credit(fileNo int, amount int32, mode CommMode) error {
+    return c.changeValue(CMD_CREDIT, fileNo, amount, mode)
+}
+
+// Decrease value of value file. Takes effect with CommitTransaction.
+func (c *Card) Debit(fileNo int, amount int32, mode CommMode) error {
+    return c.changeValue(CMD_DEBIT, fileNo, amount, mode)
+}
+
+// Increase value of value file by at most the amount debited in the last
+// transaction, without full write access.
+func (c *Card) LimitedCredit(fileNo int, amount int32, mode CommMode) error {
+    return c.changeValue(CMD_LIMITED_CREDIT, fileNo, amount, mode)
+}
+
+// Write data at offset within a new record of record file. Takes effect
+// with CommitTransaction.
+func (c *Card) WriteRecord(fileNo, offset int, data []byte,
+    mode CommMode) error {
+    header := put24([]byte{byte(fileNo)}, uint32(offset))
+    header = put24(header, uint32(len(data)))
+    _, err := c.command(CMD_WRITE_RECORD, header, data, mode,
+        statusMode(mode))
+    return err
+}
+
+// Read count records of record file, starting offset records back from
+// the newest record. Count 0 reads all records.
+func (c *Card) ReadRecords(fileNo, offset, count int,
+    mode CommMode) ([]byte, error) {
+    header := put24([]byte{byte(fileNo)}, uint32(offset))
+    header = put24(header, uint32(count))
+    return c.command(CMD_READ_RECORDS, header, nil, mode, mode)
+}
+
+// Clear all records of record file. Takes effect with CommitTransaction.
+func (c *Card) ClearRecordFile(fileNo int) error {
+    _, err := c.command(CMD_CLEAR_RECORD_FILE, []byte{byte(fileNo)}, nil,
+        COMM_MAC, COMM_MAC)
+    return err
+}
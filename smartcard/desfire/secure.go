@@ -0,0 +1,189 @@
+package desfire
+
+import (
+    "bytes"
+    "crypto/cipher"
+    "encoding/binary"
+    "fmt"
+    "hash/crc32"
+    "github.com/sf1/go-card/smartcard/cmac"
+)
+
+// Secure messaging session established by authentication.
+//
+// EV1: a single session key enciphers and MACs; the CBC/CMAC chaining value
+// iv is carried over from one command and response to the next. A CMAC is
+// computed over every command and verified on every response.
+//
+// EV2: separate session keys for enciphering and MACing; IVs are derived
+// from the transaction identifier ti and the command counter ctr, which is
+// incremented with every command/response pair.
+type session struct {
+    ev2 bool
+    keyNo byte
+    key Key
+    enc, mac cipher.Block
+    iv []byte
+    ti []byte
+    ctr uint16
+}
+
+// Return command payload for header and data in communication mode.
+func (s *session) wrap(cmd byte, header, data []byte,
+    mode CommMode) ([]byte, error) {
+    if s.ev2 { return s.wrapEV2(cmd, header, data, mode) }
+    out := append([]byte{}, header...)
+    if mode == COMM_FULL && len(data) > 0 {
+        plain := cat(data, crc([]byte{cmd}, header, data))
+        return append(out, s.encipher(plain)...), nil
+    }
+    mac, err := s.cmac(cat([]byte{cmd}, header, data))
+    if err != nil { return nil, err }
+    out = append(out, data...)
+    if mode == COMM_MAC && len(data) > 0 {
+        out = append(out, mac[:8]...)
+    }
+    return out, nil
+}
+
+// Verify and decipher response data in communication mode.
+func (s *session) unwrap(rsp []byte, mode CommMode) ([]byte, error) {
+    if s.ev2 { return s.unwrapEV2(rsp, mode) }
+    if mode == COMM_FULL && len(rsp) > 0 {
+        bs := s.enc.BlockSize()
+        if len(rsp) % bs != 0 {
+            return nil, fmt.Errorf("invalid enciphered response length")
+        }
+        plain := decryptCBC(s.enc, s.iv, rsp)
+        s.iv = append([]byte{}, rsp[len(rsp)-bs:]...)
+        // Data is followed by CRC32 over data||status and zero padding
+        for n := len(plain) - 4; n >= 0 && n > len(plain) - 4 - bs; n-- {
+            if !zero(plain[n+4:]) { break }
+            if bytes.Equal(plain[n:n+4], crc(plain[:n], []byte{0x00})) {
+                return plain[:n], nil
+            }
+        }
+        return nil, fmt.Errorf("response CRC mismatch")
+    }
+    if len(rsp) < 8 {
+        return nil, fmt.Errorf("response MAC missing")
+    }
+    data := rsp[:len(rsp)-8]
+    mac, err := s.cmac(cat(data, []byte{0x00}))
+    if err != nil { return nil, err }
+    if !bytes.Equal(mac[:8], rsp[len(rsp)-8:]) {
+        return nil, fmt.Errorf("response MAC mismatch")
+    }
+    return data, nil
+}
+
+// EV1: encipher data padded with zeros, chaining the IV.
+func (s *session) encipher(data []byte) []byte {
+    bs := s.enc.BlockSize()
+    plain := append([]byte{}, data...)
+    for len(plain) % bs != 0 {
+        plain = append(plain, 0x00)
+    }
+    out := encryptCBC(s.enc, s.iv, plain)
+    s.iv = append([]byte{}, out[len(out)-bs:]...)
+    return out
+}
+
+// EV1: compute CMAC with chaining value and update it.
+func (s *session) cmac(msg []byte) ([]byte, error) {
+    h, err := cmac.NewWithIV(s.mac, s.iv)
+    if err != nil { return nil, err }
+    h.Write(msg)
+    s.iv = h.Sum(nil)
+    return s.iv, nil
+}
+
+func (s *session) wrapEV2(cmd byte, header, data []byte,
+    mode CommMode) ([]byte, error) {
+    out := cat(header, data)
+    if mode == COMM_PLAIN { return out, nil }
+    if mode == COMM_FULL && len(data) > 0 {
+        plain := append(append([]byte{}, data...), 0x80)
+        for len(plain) % 16 != 0 {
+            plain = append(plain, 0x00)
+        }
+        out = cat(header, encryptCBC(s.enc, s.ivEV2(0xa5, 0x5a, s.ctr),
+            plain))
+    }
+    mac, err := s.macEV2(cmd, s.ctr, out)
+    if err != nil { return nil, err }
+    return append(out, mac...), nil
+}
+
+func (s *session) unwrapEV2(rsp []byte, mode CommMode) ([]byte, error) {
+    s.ctr++
+    if mode == COMM_PLAIN { return rsp, nil }
+    if len(rsp) < 8 {
+        return nil, fmt.Errorf("response MAC missing")
+    }
+    data := rsp[:len(rsp)-8]
+    mac, err := s.macEV2(0x00, s.ctr, data)
+    if err != nil { return nil, err }
+    if !bytes.Equal(mac, rsp[len(rsp)-8:]) {
+        return nil, fmt.Errorf("response MAC mismatch")
+    }
+    if mode != COMM_FULL || len(data) == 0 { return data, nil }
+    if len(data) % 16 != 0 {
+        return nil, fmt.Errorf("invalid enciphered response length")
+    }
+    plain := decryptCBC(s.enc, s.ivEV2(0x5a, 0xa5, s.ctr), data)
+    n := bytes.LastIndexByte(plain, 0x80)
+    if n < 0 || n < len(plain) - 16 || !zero(plain[n+1:]) {
+        return nil, fmt.Errorf("invalid response padding")
+    }
+    return plain[:n], nil
+}
+
+// EV2: IV = E(SesAuthENCKey, label||TI||CmdCtr||zeros).
+func (s *session) ivEV2(l1, l2 byte, ctr uint16) []byte {
+    iv := make([]byte, 16)
+    iv[0], iv[1] = l1, l2
+    copy(iv[2:], s.ti)
+    binary.LittleEndian.PutUint16(iv[6:], ctr)
+    s.enc.Encrypt(iv, iv)
+    return iv
+}
+
+// EV2: MAC over code||CmdCtr||TI||data, truncated to the odd bytes of the
+// CMAC.
+func (s *session) macEV2(code byte, ctr uint16, data []byte) ([]byte,
+    error) {
+    msg := []byte{code, byte(ctr), byte(ctr >> 8)}
+    full, err := cmac.Sum(s.mac, cat(msg, s.ti, data))
+    if err != nil { return nil, err }
+    mac := make([]byte, 8)
+    for i := range mac {
+        mac[i] = full[2*i+1]
+    }
+    return mac, nil
+}
+
+// DESFire CRC32 (IEEE polynomial without final inversion), little-endian.
+func crc(parts ...[]byte) []byte {
+    v := ^crc32.ChecksumIEEE(cat(parts...))
+    return []byte{byte(v), byte(v >> 8), byte(v >> 16), byte(v >> 24)}
+}
+
+func zero(b []byte) bool {
+    for _, v := range b {
+        if v != 0 { return false }
+    }
+    return true
+}
+
+func encryptCBC(block cipher.Block, iv, data []byte) []byte {
+    out := make([]byte, len(data))
+    cipher.NewCBCEncrypter(block, iv).CryptBlocks(out, data)
+    return out
+}
+
+func decryptCBC(block cipher.Block, iv, data []byte) []byte {
+    out := make([]byte, len(data))
+    cipher.NewCBCDecrypter(block, iv).CryptBlocks(out, data)
+    return out
+}
@@ -0,0 +1,735 @@
+package desfire
+
+import (
+    "bytes"
+    "crypto/rand"
+    "encoding/binary"
+    "sort"
+    "github.com/sf1/go-card/smartcard"
+    "github.com/sf1/go-card/smartcard/mock"
+)
+
+// Maximum response data per frame of the simulated card.
+const simFrameSize = 59
+
+type simFile struct {
+    settings FileSettings
+    data, shadowData []byte
+    value, shadowValue int32
+    records, shadowRecords [][]byte
+    newRecord bool
+    debited int32
+    dirty bool
+}
+
+type simApp struct {
+    settings KeySettings
+    keyType KeyType
+    keys []Key
+    files map[byte]*simFile
+}
+
+// Simulated DESFire EV2 card for tests: a mock card with a rule per
+// native command working on the card state. Secure messaging is implemented
+// from the card's point of view.
+type simCard struct {
+    *mock.Card
+    uid []byte
+    apps map[uint32]*simApp
+    selected uint32
+    session *session
+    // Authentication in progress
+    authCmd byte
+    authKeyNo byte
+    authKey Key
+    authIV []byte
+    rndB []byte
+    // Chained command and pending response frames
+    pendingCmd byte
+    pendingFn simCommand
+    pending []byte
+    output []byte
+    // Commands received, for assertions
+    commands []byte
+}
+
+func newSimCard() *simCard {
+    s := &simCard{uid: []byte{0x04, 0x52, 0x6a, 0x9a, 0x3e, 0x5c, 0x80},
+        apps: map[uint32]*simApp{}}
+    s.apps[0] = &simApp{settings: KS_DEFAULT, keyType: KEY_DES,
+        keys: []Key{DefaultKey(KEY_DES)}, files: map[byte]*simFile{}}
+    s.Card = mock.NewCard(mock.Hex("3b 81 80 01 80 80")).
+        RuleFunc("90 af 00 00 *", s.additionalFrame).
+        RuleFunc("90 5a 00 00 *", s.rule(s.selectApplication)).
+        RuleFunc("90 1a 00 00 *", s.rule(s.authenticate1)).
+        RuleFunc("90 aa 00 00 *", s.rule(s.authenticate1)).
+        RuleFunc("90 71 00 00 *", s.rule(s.authenticate1)).
+        RuleFunc("90 77 00 00 *", s.rule(s.authenticate1)).
+        RuleFunc("90 54 00 00 *", s.rule(s.changeKeySettings)).
+        RuleFunc("90 c4 00 00 *", s.rule(s.changeKey)).
+        RuleFunc("90 ?? 00 00 *", s.rule(s.process))
+    return s
+}
+
+// Native command returning response data or a Status error.
+type simCommand func(ins byte, data []byte) ([]byte, error)
+
+func (s *simCard) app() *simApp {
+    return s.apps[s.selected]
+}
+
+func simRsp(data []byte, sw uint16) (smartcard.ResponseAPDU, error) {
+    return smartcard.ResponseAPDU(append(append([]byte{}, data...),
+        byte(sw >> 8), byte(sw))), nil
+}
+
+// Start command and answer with fn once all its frames arrived.
+func (s *simCard) rule(fn simCommand) mock.HandlerFunc {
+    return func(cmd smartcard.CommandAPDU) (smartcard.ResponseAPDU, error) {
+        ins, data := cmd[1], cmd.Data()
+        s.commands = append(s.commands, ins)
+        s.output, s.pending, s.authCmd = nil, nil, 0
+        return s.collect(ins, fn, data)
+    }
+}
+
+// Answer ADDITIONAL_FRAME: second authentication step, next command frame
+// or next response frame.
+func (s *simCard) additionalFrame(cmd smartcard.CommandAPDU) (
+    smartcard.ResponseAPDU, error) {
+    if s.authCmd != 0 {
+        return s.authenticate2(cmd.Data())
+    }
+    if s.output != nil {
+        return s.frame()
+    }
+    if s.pending == nil {
+        return s.respond(nil, ILLEGAL_COMMAND_CODE)
+    }
+    data := append(s.pending, cmd.Data()...)
+    s.pending = nil
+    return s.collect(s.pendingCmd, s.pendingFn, data)
+}
+
+func (s *simCard) collect(ins byte, fn simCommand, data []byte) (
+    smartcard.ResponseAPDU, error) {
+    if n := s.expectedLength(ins, data); len(data) < n {
+        s.pendingCmd, s.pendingFn = ins, fn
+        s.pending = append([]byte{}, data...)
+        return simRsp(nil, 0x91af)
+    }
+    return s.respond(fn(ins, data))
+}
+
+func (s *simCard) respond(rsp []byte, err error) (smartcard.ResponseAPDU,
+    error) {
+    if err == ADDITIONAL_FRAME {
+        // Authentication challenge
+        return simRsp(rsp, 0x91af)
+    }
+    if err != nil {
+        s.session = nil
+        if st, ok := err.(Status); ok {
+            return simRsp(nil, 0x9100 | uint16(st))
+        }
+        return simRsp(nil, 0x9100 | uint16(INTEGRITY_ERROR))
+    }
+    s.output = rsp
+    return s.frame()
+}
+
+func (s *simCard) frame() (smartcard.ResponseAPDU, error) {
+    out := s.output
+    if len(out) > simFrameSize {
+        s.output = out[simFrameSize:]
+        return simRsp(out[:simFrameSize], 0x91af)
+    }
+    s.output = nil
+    return simRsp(out, 0x9100)
+}
+
+// Return mode of file in the current session.
+func (s *simCard) fileMode(f *simFile) CommMode {
+    if s.session == nil { return COMM_PLAIN }
+    return f.settings.CommMode
+}
+
+// Return total command length of WriteData/WriteRecord, which may arrive
+// in several frames.
+func (s *simCard) expectedLength(ins byte, data []byte) int {
+    if ins != CMD_WRITE_DATA && ins != CMD_WRITE_RECORD || len(data) < 7 {
+        return 0
+    }
+    f := s.app().files[data[0]]
+    if f == nil { return 0 }
+    n := int(uint24(data[4:]))
+    switch s.fileMode(f) {
+        case COMM_MAC:
+            return 7 + n + 8
+        case COMM_FULL:
+            if s.session.ev2 {
+                return 7 + (n + 16) / 16 * 16 + 8
+            }
+            bs := s.session.enc.BlockSize()
+            return 7 + (n + 4 + bs - 1) / bs * bs
+    }
+    return 7 + n
+}
+
+// Verify and decipher command payload; returns header and data.
+func (s *simCard) unwrapCommand(cmd byte, payload []byte, headerLen,
+    dataLen int, mode CommMode) ([]byte, []byte, error) {
+    if len(payload) < headerLen { return nil, nil, LENGTH_ERROR }
+    header, rest := payload[:headerLen], payload[headerLen:]
+    ss := s.session
+    if ss == nil {
+        return header, rest, nil
+    }
+    if ss.ev2 {
+        if mode == COMM_PLAIN { return header, rest, nil }
+        if len(rest) < 8 { return nil, nil, LENGTH_ERROR }
+        body := rest[:len(rest)-8]
+        mac, _ := ss.macEV2(cmd, ss.ctr, cat(header, body))
+        if !bytes.Equal(mac, rest[len(rest)-8:]) {
+            return nil, nil, INTEGRITY_ERROR
+        }
+        if mode != COMM_FULL || len(body) == 0 { return header, body, nil }
+        if len(body) % 16 != 0 { return nil, nil, LENGTH_ERROR }
+        plain := decryptCBC(ss.enc, ss.ivEV2(0xa5, 0x5a, ss.ctr), body)
+        n := bytes.LastIndexByte(plain, 0x80)
+        if n < 0 || !zero(plain[n+1:]) { return nil, nil, INTEGRITY_ERROR }
+        return header, plain[:n], nil
+    }
+    if mode == COMM_FULL && dataLen > 0 {
+        bs := ss.enc.BlockSize()
+        if len(rest) == 0 || len(rest) % bs != 0 {
+            return nil, nil, LENGTH_ERROR
+        }
+        plain := decryptCBC(ss.enc, ss.iv, rest)
+        ss.iv = append([]byte{}, rest[len(rest)-bs:]...)
+        if len(plain) < dataLen + 4 { return nil, nil, LENGTH_ERROR }
+        data := plain[:dataLen]
+        if !bytes.Equal(plain[dataLen:dataLen+4], crc([]byte{cmd}, header,
+            data)) {
+            return nil, nil, INTEGRITY_ERROR
+        }
+        return header, data, nil
+    }
+    if len(rest) < dataLen { return nil, nil, LENGTH_ERROR }
+    data := rest[:dataLen]
+    mac, _ := ss.cmac(cat([]byte{cmd}, header, data))
+    if mode == COMM_MAC && dataLen > 0 &&
+        !bytes.Equal(rest[dataLen:], mac[:8]) {
+        return nil, nil, INTEGRITY_ERROR
+    }
+    return header, data, nil
+}
+
+// Protect response data in mode.
+func (s *simCard) wrapResponse(data []byte, mode CommMode) []byte {
+    ss := s.session
+    if ss == nil { return data }
+    if ss.ev2 {
+        ss.ctr++
+        if mode == COMM_PLAIN { return data }
+        if mode == COMM_FULL && len(data) > 0 {
+            plain := append(append([]byte{}, data...), 0x80)
+            for len(plain) % 16 != 0 {
+                plain = append(plain, 0x00)
+            }
+            data = encryptCBC(ss.enc, ss.ivEV2(0x5a, 0xa5, ss.ctr), plain)
+        }
+        mac, _ := ss.macEV2(0x00, ss.ctr, data)
+        return cat(data, mac)
+    }
+    if mode == COMM_FULL && len(data) > 0 {
+        return ss.encipher(cat(data, crc(data, []byte{0x00})))
+    }
+    mac, _ := ss.cmac(cat(data, []byte{0x00}))
+    return cat(data, mac[:8])
+}
+
+// Check that the access condition is free or the authenticated key.
+func (s *simCard) allowed(conds ...byte) bool {
+    for _, c := range conds {
+        if c == ACCESS_FREE { return true }
+        if s.session != nil && c == s.session.keyNo { return true }
+    }
+    return false
+}
+
+func (s *simCard) masterAuthenticated() bool {
+    return s.session != nil && s.session.keyNo == 0
+}
+
+func (s *simCard) selectApplication(ins byte, data []byte) ([]byte, error) {
+    if len(data) != 3 { return nil, LENGTH_ERROR }
+    aid := uint24(data)
+    if s.apps[aid] == nil { return nil, APPLICATION_NOT_FOUND }
+    s.abort()
+    s.selected, s.session = aid, nil
+    return nil, nil
+}
+
+func (s *simCard) changeKeySettings(ins byte, data []byte) ([]byte, error) {
+    if !s.masterAuthenticated() { return nil, AUTHENTICATION_ERROR }
+    _, d, err := s.unwrapCommand(ins, data, 0, 1, COMM_FULL)
+    if err != nil { return nil, err }
+    if len(d) != 1 { return nil, LENGTH_ERROR }
+    s.app().settings = KeySettings(d[0])
+    return s.wrapResponse(nil, COMM_MAC), nil
+}
+
+// File and management commands.
+func (s *simCard) process(ins byte, data []byte) ([]byte, error) {
+    app := s.app()
+    // Header length of management commands
+    mgmt := map[byte]int{CMD_GET_VERSION: 0, CMD_GET_APPLICATION_IDS: 0,
+        CMD_FREE_MEMORY: 0, CMD_FORMAT_PICC: 0, CMD_GET_KEY_SETTINGS: 0,
+        CMD_GET_KEY_VERSION: 1, CMD_CREATE_APPLICATION: 5,
+        CMD_DELETE_APPLICATION: 3, CMD_GET_FILE_IDS: 0,
+        CMD_GET_FILE_SETTINGS: 1, CMD_CREATE_STD_DATA_FILE: 7,
+        CMD_CREATE_BACKUP_DATA_FILE: 7, CMD_CREATE_VALUE_FILE: 17,
+        CMD_CREATE_LINEAR_RECORD_FILE: 10, CMD_CREATE_CYCLIC_RECORD_FILE: 10,
+        CMD_DELETE_FILE: 1, CMD_COMMIT_TRANSACTION: 0,
+        CMD_ABORT_TRANSACTION: 0, CMD_CLEAR_RECORD_FILE: 1,
+        CMD_GET_CARD_UID: 0}
+    if hl, ok := mgmt[ins]; ok {
+        header, _, err := s.unwrapCommand(ins, data, hl, 0, COMM_MAC)
+        if err != nil { return nil, err }
+        rsp, mode, err := s.management(ins, header)
+        if err != nil { return nil, err }
+        return s.wrapResponse(rsp, mode), nil
+    }
+    if len(data) < 1 { return nil, LENGTH_ERROR }
+    f := app.files[data[0]]
+    if f == nil { return nil, FILE_NOT_FOUND }
+    mode := s.fileMode(f)
+    a := f.settings.Access
+    switch ins {
+        case CMD_READ_DATA, CMD_READ_RECORDS:
+            header, _, err := s.unwrapCommand(ins, data, 7, 0, mode)
+            if err != nil { return nil, err }
+            if !s.allowed(a.Read, a.ReadWrite) { return nil, PERMISSION_DENIED }
+            offset, length := int(uint24(header[1:])), int(uint24(header[4:]))
+            var out []byte
+            if ins == CMD_READ_DATA {
+                if f.settings.Type > FILE_BACKUP_DATA {
+                    return nil, PARAMETER_ERROR
+                }
+                if length == 0 { length = len(f.data) - offset }
+                if offset + length > len(f.data) { return nil, BOUNDARY_ERROR }
+                out = f.data[offset:offset+length]
+            } else {
+                if f.settings.Type < FILE_LINEAR_RECORD {
+                    return nil, PARAMETER_ERROR
+                }
+                end := len(f.records) - offset
+                if length == 0 { length = end }
+                if end <= 0 || length > end { return nil, BOUNDARY_ERROR }
+                for _, r := range f.records[end-length:end] {
+                    out = append(out, r...)
+                }
+            }
+            return s.wrapResponse(out, mode), nil
+        case CMD_WRITE_DATA, CMD_WRITE_RECORD:
+            if len(data) < 7 { return nil, LENGTH_ERROR }
+            n := int(uint24(data[4:]))
+            header, d, err := s.unwrapCommand(ins, data, 7, n, mode)
+            if err != nil { return nil, err }
+            if !s.allowed(a.Write, a.ReadWrite) {
+                return nil, PERMISSION_DENIED
+            }
+            offset := int(uint24(header[1:]))
+            if ins == CMD_WRITE_DATA {
+                if f.settings.Type > FILE_BACKUP_DATA {
+                    return nil, PARAMETER_ERROR
+                }
+                if offset + n > f.settings.Size { return nil, BOUNDARY_ERROR }
+                if f.settings.Type == FILE_STANDARD_DATA {
+                    copy(f.data[offset:], d)
+                } else {
+                    s.shadow(f)
+                    copy(f.shadowData[offset:], d)
+                }
+            } else {
+                if f.settings.Type < FILE_LINEAR_RECORD {
+                    return nil, PARAMETER_ERROR
+                }
+                if offset + n > f.settings.RecordSize {
+                    return nil, BOUNDARY_ERROR
+                }
+                s.shadow(f)
+                if !f.newRecord {
+                    max := f.settings.MaxRecords
+                    if f.settings.Type == FILE_CYCLIC_RECORD {
+                        max--
+                        if len(f.shadowRecords) == max {
+                            f.shadowRecords = f.shadowRecords[1:]
+                        }
+                    }
+                    if len(f.shadowRecords) >= max {
+                        return nil, BOUNDARY_ERROR
+                    }
+                    f.shadowRecords = append(f.shadowRecords,
+                        make([]byte, f.settings.RecordSize))
+                    f.newRecord = true
+                }
+                copy(f.shadowRecords[len(f.shadowRecords)-1][offset:], d)
+            }
+            return s.wrapResponse(nil, statusMode(mode)), nil
+        case CMD_GET_VALUE:
+            if _, _, err := s.unwrapCommand(ins, data, 1, 0, mode); err != nil {
+                return nil, err
+            }
+            if !s.allowed(a.Read, a.Write, a.ReadWrite) {
+                return nil, PERMISSION_DENIED
+            }
+            return s.wrapResponse(put32(nil, uint32(f.value)), mode), nil
+        case CMD_CREDIT, CMD_DEBIT, CMD_LIMITED_CREDIT:
+            _, d, err := s.unwrapCommand(ins, data, 1, 4, mode)
+            if err != nil { return nil, err }
+            if len(d) != 4 { return nil, LENGTH_ERROR }
+            amount := int32(binary.LittleEndian.Uint32(d))
+            s.shadow(f)
+            switch ins {
+                case CMD_CREDIT:
+                    if !s.allowed(a.ReadWrite) { return nil, PERMISSION_DENIED }
+                    f.shadowValue += amount
+                case CMD_DEBIT:
+                    if !s.allowed(a.Read, a.Write, a.ReadWrite) {
+                        return nil, PERMISSION_DENIED
+                    }
+                    f.shadowValue -= amount
+                    f.debited = amount
+                case CMD_LIMITED_CREDIT:
+                    if !s.allowed(a.Write, a.ReadWrite) {
+                        return nil, PERMISSION_DENIED
+                    }
+                    if !f.settings.LimitedCredit || amount > f.debited {
+                        return nil, BOUNDARY_ERROR
+                    }
+                    f.shadowValue += amount
+            }
+            if f.shadowValue < f.settings.LowerLimit ||
+                f.shadowValue > f.settings.UpperLimit {
+                return nil, BOUNDARY_ERROR
+            }
+            return s.wrapResponse(nil, statusMode(mode)), nil
+    }
+    return nil, ILLEGAL_COMMAND_CODE
+}
+
+func (s *simCard) management(ins byte, header []byte) ([]byte, CommMode,
+    error) {
+    app := s.app()
+    switch ins {
+        case CMD_GET_VERSION:
+            v := []byte{0x04, 0x01, 0x01, 0x12, 0x00, 0x1a, 0x05,
+                0x04, 0x01, 0x01, 0x12, 0x00, 0x1a, 0x05}
+            v = append(v, s.uid...)
+            v = append(v, 0xba, 0x34, 0x56, 0x78, 0x90, 0x21, 0x19)
+            return v, COMM_MAC, nil
+        case CMD_GET_CARD_UID:
+            if s.session == nil { return nil, 0, AUTHENTICATION_ERROR }
+            return s.uid, COMM_FULL, nil
+        case CMD_FREE_MEMORY:
+            return put24(nil, 7936), COMM_MAC, nil
+        case CMD_FORMAT_PICC:
+            if s.selected != 0 || !s.masterAuthenticated() {
+                return nil, 0, AUTHENTICATION_ERROR
+            }
+            for aid := range s.apps {
+                if aid != 0 { delete(s.apps, aid) }
+            }
+            return nil, COMM_MAC, nil
+        case CMD_GET_APPLICATION_IDS:
+            if s.selected != 0 { return nil, 0, ILLEGAL_COMMAND_CODE }
+            var aids []int
+            for aid := range s.apps {
+                if aid != 0 { aids = append(aids, int(aid)) }
+            }
+            sort.Ints(aids)
+            var out []byte
+            for _, aid := range aids {
+                out = put24(out, uint32(aid))
+            }
+            return out, COMM_MAC, nil
+        case CMD_CREATE_APPLICATION:
+            if s.selected != 0 { return nil, 0, PERMISSION_DENIED }
+            if app.settings & KS_FREE_CREATE_DELETE == 0 &&
+                !s.masterAuthenticated() {
+                return nil, 0, AUTHENTICATION_ERROR
+            }
+            aid := uint24(header)
+            if s.apps[aid] != nil { return nil, 0, DUPLICATE_ERROR }
+            t := keyTypeFromFlag(header[4])
+            n := int(header[4] & 0x0f)
+            keys := make([]Key, n)
+            for i := range keys {
+                keys[i] = DefaultKey(t)
+            }
+            s.apps[aid] = &simApp{settings: KeySettings(header[3]),
+                keyType: t, keys: keys, files: map[byte]*simFile{}}
+            return nil, COMM_MAC, nil
+        case CMD_DELETE_APPLICATION:
+            aid := uint24(header)
+            if s.apps[aid] == nil || aid == 0 {
+                return nil, 0, APPLICATION_NOT_FOUND
+            }
+            delete(s.apps, aid)
+            return nil, COMM_MAC, nil
+        case CMD_GET_KEY_SETTINGS:
+            return []byte{byte(app.settings),
+                byte(len(app.keys)) | app.keyType.flag()}, COMM_MAC, nil
+        case CMD_GET_KEY_VERSION:
+            if int(header[0]) >= len(app.keys) { return nil, 0, NO_SUCH_KEY }
+            return []byte{app.keys[header[0]].Version}, COMM_MAC, nil
+        case CMD_GET_FILE_IDS:
+            var ids []byte
+            for i := 0; i < 32; i++ {
+                if app.files[byte(i)] != nil { ids = append(ids, byte(i)) }
+            }
+            return ids, COMM_MAC, nil
+        case CMD_GET_FILE_SETTINGS:
+            f := app.files[header[0]]
+            if f == nil { return nil, 0, FILE_NOT_FOUND }
+            fs := f.settings
+            out := append([]byte{byte(fs.Type), byte(fs.CommMode)},
+                fs.Access.Bytes()...)
+            switch fs.Type {
+                case FILE_STANDARD_DATA, FILE_BACKUP_DATA:
+                    out = put24(out, uint32(fs.Size))
+                case FILE_VALUE:
+                    out = put32(out, uint32(fs.LowerLimit))
+                    out = put32(out, uint32(fs.UpperLimit))
+                    out = put32(out, uint32(f.debited))
+                    var flag byte
+                    if fs.LimitedCredit { flag = 1 }
+                    out = append(out, flag)
+                default:
+                    out = put24(out, uint32(fs.RecordSize))
+                    out = put24(out, uint32(fs.MaxRecords))
+                    out = put24(out, uint32(len(f.records)))
+            }
+            return out, COMM_MAC, nil
+        case CMD_CREATE_STD_DATA_FILE, CMD_CREATE_BACKUP_DATA_FILE,
+            CMD_CREATE_VALUE_FILE, CMD_CREATE_LINEAR_RECORD_FILE,
+            CMD_CREATE_CYCLIC_RECORD_FILE:
+            if s.selected == 0 { return nil, 0, PERMISSION_DENIED }
+            if app.files[header[0]] != nil { return nil, 0, DUPLICATE_ERROR }
+            f := &simFile{settings: FileSettings{
+                CommMode: CommMode(header[1]),
+                Access: parseAccessRights(header[2:4])}}
+            p := header[4:]
+            switch ins {
+                case CMD_CREATE_STD_DATA_FILE, CMD_CREATE_BACKUP_DATA_FILE:
+                    f.settings.Type = FILE_STANDARD_DATA
+                    if ins == CMD_CREATE_BACKUP_DATA_FILE {
+                        f.settings.Type = FILE_BACKUP_DATA
+                    }
+                    f.settings.Size = int(uint24(p))
+                    f.data = make([]byte, f.settings.Size)
+                case CMD_CREATE_VALUE_FILE:
+                    f.settings.Type = FILE_VALUE
+                    f.settings.LowerLimit = int32(
+                        binary.LittleEndian.Uint32(p))
+                    f.settings.UpperLimit = int32(
+                        binary.LittleEndian.Uint32(p[4:]))
+                    f.value = int32(binary.LittleEndian.Uint32(p[8:]))
+                    f.settings.LimitedCredit = p[12] & 1 != 0
+                default:
+                    f.settings.Type = FILE_LINEAR_RECORD
+                    if ins == CMD_CREATE_CYCLIC_RECORD_FILE {
+                        f.settings.Type = FILE_CYCLIC_RECORD
+                    }
+                    f.settings.RecordSize = int(uint24(p))
+                    f.settings.MaxRecords = int(uint24(p[3:]))
+            }
+            app.files[header[0]] = f
+            return nil, COMM_MAC, nil
+        case CMD_DELETE_FILE:
+            if app.files[header[0]] == nil { return nil, 0, FILE_NOT_FOUND }
+            delete(app.files, header[0])
+            return nil, COMM_MAC, nil
+        case CMD_CLEAR_RECORD_FILE:
+            f := app.files[header[0]]
+            if f == nil { return nil, 0, FILE_NOT_FOUND }
+            s.shadow(f)
+            f.shadowRecords = nil
+            return nil, COMM_MAC, nil
+        case CMD_COMMIT_TRANSACTION:
+            for _, f := range app.files {
+                if !f.dirty { continue }
+                f.data, f.value, f.records = f.shadowData, f.shadowValue,
+                    f.shadowRecords
+                f.dirty, f.newRecord = false, false
+            }
+            return nil, COMM_MAC, nil
+        case CMD_ABORT_TRANSACTION:
+            s.abort()
+            return nil, COMM_MAC, nil
+    }
+    return nil, 0, ILLEGAL_COMMAND_CODE
+}
+
+// Start transaction on file, copying the committed state.
+func (s *simCard) shadow(f *simFile) {
+    if f.dirty { return }
+    f.shadowData = append([]byte{}, f.data...)
+    f.shadowValue = f.value
+    f.shadowRecords = append([][]byte{}, f.records...)
+    f.dirty = true
+}
+
+func (s *simCard) abort() {
+    for _, f := range s.app().files {
+        f.dirty, f.newRecord = false, false
+    }
+}
+
+func (s *simCard) authenticate1(ins byte, data []byte) ([]byte, error) {
+    app := s.app()
+    if len(data) < 1 { return nil, LENGTH_ERROR }
+    keyNo := data[0] & 0x0f
+    if int(keyNo) >= len(app.keys) { return nil, NO_SUCH_KEY }
+    key := app.keys[keyNo]
+    aes := key.Type == KEY_AES
+    if aes != (ins != CMD_AUTHENTICATE_ISO) {
+        return nil, AUTHENTICATION_ERROR
+    }
+    if ins == CMD_AUTHENTICATE_EV2_NON_FIRST &&
+        (s.session == nil || !s.session.ev2) {
+        return nil, AUTHENTICATION_ERROR
+    }
+    if ins != CMD_AUTHENTICATE_EV2_NON_FIRST { s.session = nil }
+    block, _ := key.cipher()
+    n := 8
+    if key.Type == KEY_3K3DES || aes { n = 16 }
+    s.rndB = make([]byte, n)
+    rand.Read(s.rndB)
+    ek := encryptCBC(block, make([]byte, block.BlockSize()), s.rndB)
+    s.authCmd, s.authKeyNo, s.authKey = ins, keyNo, key
+    s.authIV = ek[n-block.BlockSize():]
+    if ins == CMD_AUTHENTICATE_EV2_FIRST ||
+        ins == CMD_AUTHENTICATE_EV2_NON_FIRST {
+        s.authIV = make([]byte, 16)
+    }
+    return ek, ADDITIONAL_FRAME
+}
+
+func (s *simCard) authenticate2(token []byte) (smartcard.ResponseAPDU,
+    error) {
+    ins, key := s.authCmd, s.authKey
+    s.authCmd = 0
+    fail := func() (smartcard.ResponseAPDU, error) {
+        s.session = nil
+        return simRsp(nil, 0x9100 | uint16(AUTHENTICATION_ERROR))
+    }
+    block, _ := key.cipher()
+    n, bs := len(s.rndB), block.BlockSize()
+    if len(token) != 2 * n { return fail() }
+    plain := decryptCBC(block, s.authIV, token)
+    rndA := plain[:n]
+    if !bytes.Equal(plain[n:], rotate(s.rndB)) { return fail() }
+    ev2 := ins == CMD_AUTHENTICATE_EV2_FIRST ||
+        ins == CMD_AUTHENTICATE_EV2_NON_FIRST
+    if !ev2 {
+        out := encryptCBC(block, token[len(token)-bs:], rotate(rndA))
+        kt, sk := ev1SessionKey(key, rndA, s.rndB)
+        enc, _ := newCipher(kt, sk)
+        s.session = &session{keyNo: s.authKeyNo, key: key, enc: enc,
+            mac: enc, iv: make([]byte, bs)}
+        return simRsp(out, 0x9100)
+    }
+    ss, _ := newEV2Session(key, rndA, s.rndB)
+    ss.keyNo = s.authKeyNo
+    var out []byte
+    if ins == CMD_AUTHENTICATE_EV2_FIRST {
+        ss.ti = make([]byte, 4)
+        rand.Read(ss.ti)
+        out = encryptCBC(block, s.authIV, cat(ss.ti, rotate(rndA),
+            make([]byte, 12)))
+    } else {
+        ss.ti, ss.ctr = s.session.ti, s.session.ctr
+        out = encryptCBC(block, s.authIV, rotate(rndA))
+    }
+    s.session = ss
+    return simRsp(out, 0x9100)
+}
+
+func (s *simCard) changeKey(ins byte, data []byte) ([]byte, error) {
+    app := s.app()
+    ss := s.session
+    if ss == nil || len(data) < 2 { return nil, AUTHENTICATION_ERROR }
+    keyNo := data[0] & 0x0f
+    if int(keyNo) >= len(app.keys) { return nil, NO_SUCH_KEY }
+    keyType := app.keyType
+    if s.selected == 0 && keyNo == 0 { keyType = keyTypeFromFlag(data[0]) }
+    size := 16
+    if keyType == KEY_3K3DES { size = 24 }
+    if keyType == KEY_AES { size = 17 }
+    same := keyNo == ss.keyNo
+    var cryptogram, newCRC []byte
+    if ss.ev2 {
+        _, plain, err := s.unwrapCommand(CMD_CHANGE_KEY, data, 1, 0,
+            COMM_FULL)
+        if err != nil { return nil, err }
+        if !same {
+            if len(plain) != size + 4 { return nil, LENGTH_ERROR }
+            newCRC = plain[size:]
+        } else if len(plain) != size {
+            return nil, LENGTH_ERROR
+        }
+        cryptogram = plain[:size]
+    } else {
+        bs := ss.enc.BlockSize()
+        enc := data[1:]
+        if len(enc) % bs != 0 { return nil, LENGTH_ERROR }
+        plain := decryptCBC(ss.enc, ss.iv, enc)
+        ss.iv = append([]byte{}, enc[len(enc)-bs:]...)
+        if len(plain) < size + 4 { return nil, LENGTH_ERROR }
+        cryptogram = plain[:size]
+        if !bytes.Equal(plain[size:size+4], crc([]byte{CMD_CHANGE_KEY,
+            data[0]}, cryptogram)) {
+            return nil, INTEGRITY_ERROR
+        }
+        if !same { newCRC = plain[size+4:size+8] }
+    }
+    value := append([]byte{}, cryptogram...)
+    var version byte
+    if keyType == KEY_AES {
+        value, version = value[:16], value[16]
+    }
+    if !same {
+        old := app.keys[keyNo].bytes()
+        if len(old) != len(value) { return nil, LENGTH_ERROR }
+        for i := range value {
+            value[i] ^= old[i]
+        }
+        if !bytes.Equal(newCRC, crc(value)) { return nil, INTEGRITY_ERROR }
+    }
+    if keyType != KEY_AES {
+        for i := 0; i < 8; i++ {
+            version = version << 1 | value[i] & 1
+        }
+    }
+    if keyType == KEY_2K3DES && bytes.Equal(value[:8], value[8:]) {
+        keyType = KEY_DES
+    }
+    app.keys[keyNo] = Key{Type: keyType, Value: value, Version: version}
+    if s.selected == 0 && keyNo == 0 { app.keyType = keyType }
+    if same {
+        s.session = nil
+        return nil, nil
+    }
+    return s.wrapResponse(nil, COMM_MAC), nil
+}
+
+// Create application with keys for tests, bypassing the command set.
+func (s *simCard) addApp(aid uint32, keys ...Key) *simApp {
+    app := &simApp{settings: KS_DEFAULT, keyType: keys[0].Type, keys: keys,
+        files: map[byte]*simFile{}}
+    s.apps[aid] = app
+    return app
+}
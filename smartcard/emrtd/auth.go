@@ -0,0 +1,187 @@
+package emrtd
+
+import (
+    "bytes"
+    "crypto"
+    "crypto/rsa"
+    "encoding/asn1"
+    "fmt"
+    "math/big"
+    "github.com/sf1/go-card/smartcard"
+    "github.com/sf1/go-card/smartcard/tlv"
+)
+
+// ECDSA signature algorithms of ActiveAuthenticationInfo.
+var ecdsaHashes = map[string]crypto.Hash{
+    "0.4.0.127.0.7.1.1.4.1.1": crypto.SHA1,
+    "0.4.0.127.0.7.1.1.4.1.2": crypto.SHA224,
+    "0.4.0.127.0.7.1.1.4.1.3": crypto.SHA256,
+    "0.4.0.127.0.7.1.1.4.1.4": crypto.SHA384,
+    "0.4.0.127.0.7.1.1.4.1.5": crypto.SHA512,
+    "1.2.840.10045.4.1": crypto.SHA1,
+    "1.2.840.10045.4.3.1": crypto.SHA224,
+    "1.2.840.10045.4.3.2": crypto.SHA256,
+    "1.2.840.10045.4.3.3": crypto.SHA384,
+    "1.2.840.10045.4.3.4": crypto.SHA512,
+}
+
+// ISO/IEC 9796-2 trailer hash identifiers (ISO/IEC 10118-3).
+var iso9796Hashes = map[byte]crypto.Hash{
+    0x33: crypto.SHA1,
+    0x34: crypto.SHA256,
+    0x35: crypto.SHA512,
+    0x36: crypto.SHA384,
+    0x38: crypto.SHA224,
+}
+
+// Verify ISO/IEC 9796-2 digital signature scheme 1 signature with partial
+// message recovery, where m2 is the non-recoverable message part.
+func verifyISO9796(key *rsa.PublicKey, sig, m2 []byte) error {
+    k := key.Size()
+    s := new(big.Int).SetBytes(sig)
+    if s.Cmp(key.N) >= 0 { return fmt.Errorf("invalid signature") }
+    m := new(big.Int).Exp(s, big.NewInt(int64(key.E)), key.N)
+    f := make([]byte, k)
+    m.FillBytes(f)
+    hash, trailer := crypto.SHA1, 1
+    if f[k-1] == 0xcc {
+        var ok bool
+        if hash, ok = iso9796Hashes[f[k-2]]; !ok || !hash.Available() {
+            return fmt.Errorf("unsupported hash identifier %02X", f[k-2])
+        }
+        trailer = 2
+    } else if f[k-1] != 0xbc {
+        return fmt.Errorf("invalid signature trailer")
+    }
+    if f[0] & 0xc0 != 0x40 || f[0] & 0x20 == 0 {
+        return fmt.Errorf("invalid signature header")
+    }
+    hlen := hash.Size()
+    if k < 1 + hlen + trailer {
+        return fmt.Errorf("invalid signature length")
+    }
+    m1 := f[1:k-hlen-trailer]
+    h := hash.New()
+    h.Write(m1)
+    h.Write(m2)
+    if !bytes.Equal(h.Sum(nil), f[k-hlen-trailer:k-trailer]) {
+        return fmt.Errorf("signature verification failed")
+    }
+    return nil
+}
+
+// Perform Active Authentication with the public key of DG15 to prove
+// that the chip is genuine (ICAO 9303-11, 6.1). ECDSA keys require the
+// signature algorithm of DG14.
+func (p *Passport) ActiveAuthentication() error {
+    key, err := p.DG15()
+    if err != nil { return fmt.Errorf("reading DG15: %s", err) }
+    challenge, err := p.random(8)
+    if err != nil { return err }
+    sig, err := p.transmit(smartcard.Command4(0x00, INS_INTERNAL_AUTHENTICATE,
+        0x00, 0x00, challenge, 0x00))
+    if err != nil { return fmt.Errorf("INTERNAL AUTHENTICATE: %s", err) }
+    switch k := key.(type) {
+        case *rsa.PublicKey:
+            if err := verifyISO9796(k, sig, challenge); err != nil {
+                return fmt.Errorf("Active Authentication failed: %s", err)
+            }
+            return nil
+        case *ECPublicKey:
+            infos, err := p.DG14()
+            if err != nil { return fmt.Errorf("reading DG14: %s", err) }
+            if infos.ActiveAuthentication == nil {
+                return fmt.Errorf("ActiveAuthenticationInfo missing in DG14")
+            }
+            oid := infos.ActiveAuthentication.SignatureAlgorithm
+            hash, ok := ecdsaHashes[oid.String()]
+            if !ok || !hash.Available() {
+                return fmt.Errorf("unsupported signature algorithm %s", oid)
+            }
+            h := hash.New()
+            h.Write(challenge)
+            r, s, err := parseECDSASignature(sig, k.Curve)
+            if err != nil { return err }
+            if !k.Curve.verifyECDSA(k.X, k.Y, h.Sum(nil), r, s) {
+                return fmt.Errorf("Active Authentication failed")
+            }
+            return nil
+    }
+    return fmt.Errorf("unsupported Active Authentication key %T", key)
+}
+
+// Parse ECDSA signature, plain (r || s) or DER encoded.
+func parseECDSASignature(sig []byte, c *Curve) (*big.Int, *big.Int, error) {
+    size := (c.N.BitLen() + 7) / 8
+    if len(sig) == 2 * size {
+        return new(big.Int).SetBytes(sig[:size]),
+            new(big.Int).SetBytes(sig[size:]), nil
+    }
+    var rs struct{ R, S *big.Int }
+    if _, err := asn1.Unmarshal(sig, &rs); err != nil {
+        return nil, nil, fmt.Errorf("invalid ECDSA signature")
+    }
+    return rs.R, rs.S, nil
+}
+
+// Perform Chip Authentication with the ECDH key of DG14 (ICAO 9303-11,
+// 6.2) and restart secure messaging with the new session keys. This
+// proves that the chip is genuine and strengthens the session keys
+// established by BAC.
+func (p *Passport) ChipAuthentication() error {
+    if p.sm == nil { return fmt.Errorf("secure messaging required") }
+    infos, err := p.DG14()
+    if err != nil { return fmt.Errorf("reading DG14: %s", err) }
+    var pk *ChipAuthenticationPublicKeyInfo
+    for i := range infos.ChipAuthenticationPublicKeys {
+        if infos.ChipAuthenticationPublicKeys[i].PublicKey != nil {
+            pk = &infos.ChipAuthenticationPublicKeys[i]
+            break
+        }
+    }
+    if pk == nil { return fmt.Errorf("no ECDH chip authentication key") }
+    // Without ChipAuthenticationInfo, 3DES is implied
+    protocol := append(append(asn1.ObjectIdentifier{}, OID_CA_ECDH...), 1)
+    for _, info := range infos.ChipAuthentication {
+        if !oidUnder(info.Protocol, OID_CA_ECDH) { continue }
+        if _, err := info.Cipher(); err != nil { continue }
+        if pk.KeyID < 0 || info.KeyID < 0 || info.KeyID == pk.KeyID {
+            protocol = info.Protocol
+            break
+        }
+    }
+    c, _ := protocolCipher(protocol)
+    curve := pk.PublicKey.Curve
+    d, x, y, err := curve.generateKey(p.randReader(), curve.Gx, curve.Gy)
+    if err != nil { return err }
+    ephemeral := curve.Marshal(x, y)
+    var keyRef []byte
+    if pk.KeyID >= 0 {
+        keyRef = tlv.Encode(0x84, big.NewInt(int64(pk.KeyID)).Bytes())
+    }
+    if c == CIPHER_3DES {
+        // MSE:Set KAT
+        data := append(tlv.Encode(0x91, ephemeral), keyRef...)
+        if _, err := p.transmit(smartcard.Command3(0x00, INS_MSE, 0x41, 0xa6,
+            data)); err != nil {
+            return fmt.Errorf("Chip Authentication failed: %s", err)
+        }
+    } else {
+        data := append(tlv.Encode(0x80, oidBytes(protocol)), keyRef...)
+        if _, err := p.transmit(smartcard.Command3(0x00, INS_MSE, 0x41, 0xa4,
+            data)); err != nil {
+            return fmt.Errorf("Chip Authentication MSE:Set AT: %s", err)
+        }
+        if _, err := p.generalAuthenticate(tlv.Encode(0x80, ephemeral), 0,
+            true); err != nil {
+            return fmt.Errorf("Chip Authentication failed: %s", err)
+        }
+    }
+    kx, _ := curve.ScalarMult(pk.PublicKey.X, pk.PublicKey.Y, d)
+    if kx == nil { return fmt.Errorf("Chip Authentication: invalid key") }
+    k := make([]byte, curve.ByteSize())
+    kx.FillBytes(k)
+    p.sm, err = NewSecureMessaging(p.card, c, KDF(k, KDF_ENC, c),
+        KDF(k, KDF_MAC, c), make([]byte, c.BlockSize()))
+    return err
+}
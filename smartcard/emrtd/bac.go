@@ -0,0 +1,130 @@
+package emrtd
+
+import (
+    "bytes"
+    "crypto/sha1"
+    "fmt"
+    "github.com/sf1/go-card/smartcard"
+)
+
+// Password types of PACE.
+const (
+    PASSWORD_MRZ = 0x01
+    PASSWORD_CAN = 0x02
+    PASSWORD_PIN = 0x03
+    PASSWORD_PUK = 0x04
+)
+
+// Access control password: MRZ information, card access number, or the
+// eID PIN or PUK.
+type Password struct {
+    Type byte
+    MRZ *MRZInfo
+    CAN string
+    // PIN or PUK
+    PIN string
+}
+
+// Create password from MRZ information.
+func MRZPassword(info *MRZInfo) Password {
+    return Password{Type: PASSWORD_MRZ, MRZ: info}
+}
+
+// Create password from card access number.
+func CANPassword(can string) Password {
+    return Password{Type: PASSWORD_CAN, CAN: can}
+}
+
+// Create password from eID PIN.
+func PINPassword(pin string) Password {
+    return Password{Type: PASSWORD_PIN, PIN: pin}
+}
+
+// Create password from eID PUK.
+func PUKPassword(puk string) Password {
+    return Password{Type: PASSWORD_PUK, PIN: puk}
+}
+
+// Return PACE password bytes: SHA-1 of the MRZ information, the CAN, PIN
+// or PUK.
+func (pw Password) bytes() ([]byte, error) {
+    switch pw.Type {
+        case PASSWORD_CAN:
+            if pw.CAN == "" { return nil, fmt.Errorf("empty CAN") }
+            return []byte(pw.CAN), nil
+        case PASSWORD_PIN, PASSWORD_PUK:
+            if pw.PIN == "" { return nil, fmt.Errorf("empty PIN") }
+            return []byte(pw.PIN), nil
+    }
+    if pw.MRZ == nil { return nil, fmt.Errorf("MRZ information missing") }
+    if err := pw.MRZ.check(); err != nil { return nil, err }
+    h := sha1.Sum([]byte(pw.MRZ.String()))
+    return h[:], nil
+}
+
+// Perform access control and select the eMRTD application: PACE if the
+// document supports it (EF.CardAccess present), BAC otherwise.
+func (p *Passport) Authenticate(pw Password) error {
+    info, err := p.CardAccess()
+    if err == nil && len(info.PACE) > 0 {
+        if err := p.PACE(pw); err != nil { return err }
+        return p.SelectApplication()
+    }
+    if pw.Type != PASSWORD_MRZ {
+        return fmt.Errorf("document does not support PACE")
+    }
+    if err := p.SelectApplication(); err != nil { return err }
+    return p.BAC(pw.MRZ)
+}
+
+// Perform Basic Access Control with MRZ information and start secure
+// messaging. The eMRTD application must be selected.
+func (p *Passport) BAC(info *MRZInfo) error {
+    if err := info.check(); err != nil { return err }
+    p.sm = nil
+    seed := info.KeySeed()
+    kenc := KDF(seed, KDF_ENC, CIPHER_3DES)
+    kmac := KDF(seed, KDF_MAC, CIPHER_3DES)
+    block, err := newBlock(CIPHER_3DES, kenc)
+    if err != nil { return err }
+    rndIC, err := p.transmit(smartcard.Command2(0x00, INS_GET_CHALLENGE,
+        0x00, 0x00, 0x08))
+    if err != nil { return fmt.Errorf("GET CHALLENGE: %s", err) }
+    if len(rndIC) != 8 {
+        return fmt.Errorf("invalid challenge length: %d", len(rndIC))
+    }
+    rndIFD, err := p.random(8)
+    if err != nil { return err }
+    kIFD, err := p.random(16)
+    if err != nil { return err }
+    zero := make([]byte, 8)
+    s := append(append(append([]byte{}, rndIFD...), rndIC...), kIFD...)
+    eIFD := encryptCBC(block, zero, s)
+    mIFD, err := mac(CIPHER_3DES, kmac, pad(eIFD, 8))
+    if err != nil { return err }
+    rsp, err := p.transmit(smartcard.Command4(0x00,
+        INS_EXTERNAL_AUTHENTICATE, 0x00, 0x00, append(eIFD, mIFD...), 0x28))
+    if err != nil { return fmt.Errorf("BAC failed: %s", err) }
+    if len(rsp) != 40 {
+        return fmt.Errorf("invalid BAC response length: %d", len(rsp))
+    }
+    mIC, err := mac(CIPHER_3DES, kmac, pad(rsp[:32], 8))
+    if err != nil { return err }
+    if !bytes.Equal(mIC, rsp[32:]) {
+        return fmt.Errorf("BAC response MAC mismatch")
+    }
+    r, err := decryptCBC(block, zero, rsp[:32])
+    if err != nil { return err }
+    if !bytes.Equal(r[0:8], rndIC) || !bytes.Equal(r[8:16], rndIFD) {
+        return fmt.Errorf("BAC chip authentication failed")
+    }
+    seed = make([]byte, 16)
+    for i := range seed {
+        seed[i] = kIFD[i] ^ r[16+i]
+    }
+    ssc := append(append([]byte{}, rndIC[4:8]...), rndIFD[4:8]...)
+    p.sm, err = NewSecureMessaging(p.card, CIPHER_3DES,
+        KDF(seed, KDF_ENC, CIPHER_3DES), KDF(seed, KDF_MAC, CIPHER_3DES),
+        ssc)
+    return err
+}
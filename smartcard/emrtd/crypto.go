@@ -0,0 +1,163 @@
+package emrtd
+
+import (
+    "crypto/aes"
+    "crypto/cipher"
+    "crypto/des"
+    "crypto/sha1"
+    "crypto/sha256"
+    "encoding/binary"
+    "fmt"
+    "github.com/sf1/go-card/smartcard/cmac"
+)
+
+// KDF counter values (ICAO 9303-11, 9.7.1).
+const (
+    KDF_ENC = 1
+    KDF_MAC = 2
+    KDF_PI = 3
+)
+
+// Symmetric algorithm of secure messaging and PACE.
+type Cipher int
+
+const (
+    CIPHER_3DES Cipher = iota
+    CIPHER_AES128
+    CIPHER_AES192
+    CIPHER_AES256
+)
+
+func (c Cipher) String() string {
+    switch c {
+        case CIPHER_3DES:
+            return "3DES"
+        case CIPHER_AES128:
+            return "AES-128"
+        case CIPHER_AES192:
+            return "AES-192"
+        case CIPHER_AES256:
+            return "AES-256"
+    }
+    return fmt.Sprintf("Cipher(%d)", int(c))
+}
+
+// Return block size in bytes.
+func (c Cipher) BlockSize() int {
+    if c == CIPHER_3DES { return 8 }
+    return 16
+}
+
+// Derive key from shared secret and counter (ICAO 9303-11, 9.7.1).
+func KDF(secret []byte, counter uint32, c Cipher) []byte {
+    var ctr [4]byte
+    binary.BigEndian.PutUint32(ctr[:], counter)
+    data := append(append([]byte{}, secret...), ctr[:]...)
+    switch c {
+        case CIPHER_3DES:
+            h := sha1.Sum(data)
+            return adjustParity(h[:16])
+        case CIPHER_AES128:
+            h := sha1.Sum(data)
+            return h[:16]
+        case CIPHER_AES192:
+            h := sha256.Sum256(data)
+            return h[:24]
+    }
+    h := sha256.Sum256(data)
+    return h[:]
+}
+
+// Set odd parity on each key byte.
+func adjustParity(key []byte) []byte {
+    out := make([]byte, len(key))
+    for i, b := range key {
+        b &^= 1
+        ones := 0
+        for v := b; v != 0; v >>= 1 {
+            ones += int(v & 1)
+        }
+        if ones % 2 == 0 { b |= 1 }
+        out[i] = b
+    }
+    return out
+}
+
+// Block cipher of a session key: two-key 3DES or AES.
+func newBlock(c Cipher, key []byte) (cipher.Block, error) {
+    if c == CIPHER_3DES {
+        if len(key) != 16 {
+            return nil, fmt.Errorf("invalid 3DES key length: %d", len(key))
+        }
+        return des.NewTripleDESCipher(append(append([]byte{}, key...),
+            key[:8]...))
+    }
+    return aes.NewCipher(key)
+}
+
+// Pad with ISO/IEC 9797-1 method 2.
+func pad(data []byte, size int) []byte {
+    out := append(append([]byte{}, data...), 0x80)
+    for len(out) % size != 0 {
+        out = append(out, 0x00)
+    }
+    return out
+}
+
+// Remove ISO/IEC 9797-1 method 2 padding.
+func unpad(data []byte) ([]byte, error) {
+    for i := len(data) - 1; i >= 0; i-- {
+        switch data[i] {
+            case 0x80:
+                return data[:i], nil
+            case 0x00:
+                continue
+        }
+        break
+    }
+    return nil, fmt.Errorf("invalid padding")
+}
+
+// Compute 8-byte MAC of padded data: ISO/IEC 9797-1 MAC algorithm 3 with
+// DES for 3DES keys, CMAC truncated to 8 bytes for AES keys.
+func mac(c Cipher, key, data []byte) ([]byte, error) {
+    if c != CIPHER_3DES {
+        block, err := aes.NewCipher(key)
+        if err != nil { return nil, err }
+        m, err := cmac.Sum(block, data)
+        if err != nil { return nil, err }
+        return m[:8], nil
+    }
+    if len(key) != 16 || len(data) % 8 != 0 {
+        return nil, fmt.Errorf("invalid retail MAC input")
+    }
+    ka, err := des.NewCipher(key[:8])
+    if err != nil { return nil, err }
+    kb, err := des.NewCipher(key[8:16])
+    if err != nil { return nil, err }
+    h := make([]byte, 8)
+    for i := 0; i < len(data); i += 8 {
+        for j := 0; j < 8; j++ {
+            h[j] ^= data[i+j]
+        }
+        ka.Encrypt(h, h)
+    }
+    kb.Decrypt(h, h)
+    ka.Encrypt(h, h)
+    return h, nil
+}
+
+func encryptCBC(block cipher.Block, iv, data []byte) []byte {
+    out := make([]byte, len(data))
+    cipher.NewCBCEncrypter(block, iv).CryptBlocks(out, data)
+    return out
+}
+
+func decryptCBC(block cipher.Block, iv, data []byte) ([]byte, error) {
+    if len(data) % block.BlockSize() != 0 {
+        return nil, fmt.Errorf("invalid ciphertext length: %d", len(data))
+    }
+    out := make([]byte, len(data))
+    cipher.NewCBCDecrypter(block, iv).CryptBlocks(out, data)
+    return out, nil
+}
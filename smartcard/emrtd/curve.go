@@ -0,0 +1,264 @@
+package emrtd
+
+import (
+    "crypto/elliptic"
+    "encoding/asn1"
+    "fmt"
+    "io"
+    "math/big"
+)
+
+// Elliptic curve y^2 = x^3 + ax + b over GF(p) with base point (Gx, Gy)
+// of order N. PACE generic mapping needs arbitrary generators and the
+// Brainpool curves have a != -3, so points are computed here in affine
+// coordinates rather than with crypto/elliptic. The arithmetic is not
+// constant time.
+type Curve struct {
+    Name string
+    P, A, B *big.Int
+    Gx, Gy *big.Int
+    N *big.Int
+}
+
+func hexInt(s string) *big.Int {
+    v, ok := new(big.Int).SetString(s, 16)
+    if !ok { panic("invalid curve parameter " + s) }
+    return v
+}
+
+func nistCurve(name string, c elliptic.Curve) *Curve {
+    p := c.Params()
+    return &Curve{Name: name, P: p.P, A: new(big.Int).Sub(p.P, big.NewInt(3)),
+        B: p.B, Gx: p.Gx, Gy: p.Gy, N: p.N}
+}
+
+var (
+    BrainpoolP256r1 = &Curve{Name: "brainpoolP256r1",
+        P: hexInt("A9FB57DBA1EEA9BC3E660A909D838D726E3BF623D52620282013481D1F6E5377"),
+        A: hexInt("7D5A0975FC2C3057EEF67530417AFFE7FB8055C126DC5C6CE94A4B44F330B5D9"),
+        B: hexInt("26DC5C6CE94A4B44F330B5D9BBD77CBF958416295CF7E1CE6BCCDC18FF8C07B6"),
+        Gx: hexInt("8BD2AEB9CB7E57CB2C4B482FFC81B7AFB9DE27E1E3BD23C23A4453BD9ACE3262"),
+        Gy: hexInt("547EF835C3DAC4FD97F8461A14611DC9C27745132DED8E545C1D54C72F046997"),
+        N: hexInt("A9FB57DBA1EEA9BC3E660A909D838D718C397AA3B561A6F7901E0E82974856A7"),
+    }
+    BrainpoolP384r1 = &Curve{Name: "brainpoolP384r1",
+        P: hexInt("8CB91E82A3386D280F5D6F7E50E641DF152F7109ED5456B412B1DA197FB71123ACD3A729901D1A71874700133107EC53"),
+        A: hexInt("7BC382C63D8C150C3C72080ACE05AFA0C2BEA28E4FB22787139165EFBA91F90F8AA5814A503AD4EB04A8C7DD22CE2826"),
+        B: hexInt("04A8C7DD22CE28268B39B55416F0447C2FB77DE107DCD2A62E880EA53EEB62D57CB4390295DBC9943AB78696FA504C11"),
+        Gx: hexInt("1D1C64F068CF45FFA2A63A81B7C13F6B8847A3E77EF14FE3DB7FCAFE0CBD10E8E826E03436D646AAEF87B2E247D4AF1E"),
+        Gy: hexInt("8ABE1D7520F9C2A45CB1EB8E95CFD55262B70B29FEEC5864E19C054FF99129280E4646217791811142820341263C5315"),
+        N: hexInt("8CB91E82A3386D280F5D6F7E50E641DF152F7109ED5456B31F166E6CAC0425A7CF3AB6AF6B7FC3103B883202E9046565"),
+    }
+    P224 = nistCurve("secp224r1", elliptic.P224())
+    P256 = nistCurve("secp256r1", elliptic.P256())
+    P384 = nistCurve("secp384r1", elliptic.P384())
+    P521 = nistCurve("secp521r1", elliptic.P521())
+)
+
+// Curves by standardized domain parameter identifier (BSI TR-03110-3,
+// table 4).
+var Curves = map[int]*Curve{
+    10: P224,
+    12: P256,
+    13: BrainpoolP256r1,
+    15: P384,
+    16: BrainpoolP384r1,
+    18: P521,
+}
+
+var curveOIDs = map[string]*Curve{
+    "1.3.132.0.33": P224,
+    "1.2.840.10045.3.1.7": P256,
+    "1.3.132.0.34": P384,
+    "1.3.132.0.35": P521,
+    "1.3.36.3.3.2.8.1.1.7": BrainpoolP256r1,
+    "1.3.36.3.3.2.8.1.1.11": BrainpoolP384r1,
+}
+
+func (c *Curve) String() string {
+    return c.Name
+}
+
+// Return field element size in bytes.
+func (c *Curve) ByteSize() int {
+    return (c.P.BitLen() + 7) / 8
+}
+
+// Check whether (x, y) lies on the curve.
+func (c *Curve) IsOnCurve(x, y *big.Int) bool {
+    if x == nil || y == nil || x.Sign() < 0 || x.Cmp(c.P) >= 0 ||
+        y.Sign() < 0 || y.Cmp(c.P) >= 0 {
+        return false
+    }
+    lhs := new(big.Int).Mul(y, y)
+    rhs := new(big.Int).Mul(x, x)
+    rhs.Add(rhs, c.A)
+    rhs.Mul(rhs, x)
+    rhs.Add(rhs, c.B)
+    return lhs.Sub(lhs, rhs).Mod(lhs, c.P).Sign() == 0
+}
+
+// Add points; nil coordinates denote the point at infinity.
+func (c *Curve) Add(x1, y1, x2, y2 *big.Int) (*big.Int, *big.Int) {
+    if x1 == nil { return x2, y2 }
+    if x2 == nil { return x1, y1 }
+    var l *big.Int
+    if x1.Cmp(x2) == 0 {
+        if new(big.Int).Add(y1, y2).Mod(new(big.Int).Add(y1, y2),
+            c.P).Sign() == 0 {
+            return nil, nil
+        }
+        // l = (3x^2 + a) / 2y
+        num := new(big.Int).Mul(x1, x1)
+        num.Mul(num, big.NewInt(3)).Add(num, c.A)
+        den := new(big.Int).Lsh(y1, 1)
+        l = num.Mul(num, den.ModInverse(den.Mod(den, c.P), c.P))
+    } else {
+        // l = (y2 - y1) / (x2 - x1)
+        num := new(big.Int).Sub(y2, y1)
+        den := new(big.Int).Sub(x2, x1)
+        l = num.Mul(num, den.ModInverse(den.Mod(den, c.P), c.P))
+    }
+    l.Mod(l, c.P)
+    x3 := new(big.Int).Mul(l, l)
+    x3.Sub(x3, x1).Sub(x3, x2).Mod(x3, c.P)
+    y3 := new(big.Int).Sub(x1, x3)
+    y3.Mul(y3, l).Sub(y3, y1).Mod(y3, c.P)
+    return x3, y3
+}
+
+// Multiply point by scalar k.
+func (c *Curve) ScalarMult(x, y, k *big.Int) (*big.Int, *big.Int) {
+    var rx, ry *big.Int
+    for i := k.BitLen() - 1; i >= 0; i-- {
+        rx, ry = c.Add(rx, ry, rx, ry)
+        if k.Bit(i) == 1 {
+            rx, ry = c.Add(rx, ry, x, y)
+        }
+    }
+    return rx, ry
+}
+
+// Encode point uncompressed (04 || X || Y).
+func (c *Curve) Marshal(x, y *big.Int) []byte {
+    size := c.ByteSize()
+    out := make([]byte, 1 + 2 * size)
+    out[0] = 0x04
+    x.FillBytes(out[1:1+size])
+    y.FillBytes(out[1+size:])
+    return out
+}
+
+// Decode uncompressed point and check that it lies on the curve.
+func (c *Curve) Unmarshal(data []byte) (*big.Int, *big.Int, error) {
+    size := c.ByteSize()
+    if len(data) != 1 + 2 * size || data[0] != 0x04 {
+        return nil, nil, fmt.Errorf("invalid point encoding")
+    }
+    x := new(big.Int).SetBytes(data[1:1+size])
+    y := new(big.Int).SetBytes(data[1+size:])
+    if !c.IsOnCurve(x, y) {
+        return nil, nil, fmt.Errorf("point not on curve %s", c)
+    }
+    return x, y, nil
+}
+
+// Generate private key d in [1, N-1] and public point d*G' for generator
+// (gx, gy).
+func (c *Curve) generateKey(r io.Reader, gx, gy *big.Int) (*big.Int,
+    *big.Int, *big.Int, error) {
+    b := make([]byte, (c.N.BitLen() + 7) / 8 + 8)
+    if _, err := io.ReadFull(r, b); err != nil { return nil, nil, nil, err }
+    d := new(big.Int).SetBytes(b)
+    d.Mod(d, new(big.Int).Sub(c.N, big.NewInt(1))).Add(d, big.NewInt(1))
+    x, y := c.ScalarMult(gx, gy, d)
+    return d, x, y, nil
+}
+
+// Verify ECDSA signature (r, s) over hash with public key (x, y).
+func (c *Curve) verifyECDSA(x, y *big.Int, hash []byte, r, s *big.Int) bool {
+    if r.Sign() <= 0 || s.Sign() <= 0 || r.Cmp(c.N) >= 0 || s.Cmp(c.N) >= 0 {
+        return false
+    }
+    e := new(big.Int).SetBytes(hash)
+    if excess := len(hash) * 8 - c.N.BitLen(); excess > 0 {
+        e.Rsh(e, uint(excess))
+    }
+    w := new(big.Int).ModInverse(s, c.N)
+    u1 := new(big.Int).Mul(e, w)
+    u1.Mod(u1, c.N)
+    u2 := new(big.Int).Mul(r, w)
+    u2.Mod(u2, c.N)
+    x1, y1 := c.ScalarMult(c.Gx, c.Gy, u1)
+    x2, y2 := c.ScalarMult(x, y, u2)
+    vx, _ := c.Add(x1, y1, x2, y2)
+    if vx == nil { return false }
+    return vx.Mod(vx, c.N).Cmp(r) == 0
+}
+
+// Elliptic curve public key.
+type ECPublicKey struct {
+    Curve *Curve
+    X, Y *big.Int
+}
+
+// Return uncompressed encoding of the public point.
+func (k *ECPublicKey) Bytes() []byte {
+    return k.Curve.Marshal(k.X, k.Y)
+}
+
+type ecFieldID struct {
+    Type asn1.ObjectIdentifier
+    Prime *big.Int
+}
+
+type ecCurve struct {
+    A, B []byte
+    Seed asn1.BitString `asn1:"optional"`
+}
+
+type ecParameters struct {
+    Version int
+    FieldID ecFieldID
+    Curve ecCurve
+    Base []byte
+    Order *big.Int
+    Cofactor int `asn1:"optional"`
+}
+
+// Parse EC domain parameters, either a named curve OID or explicit
+// ECParameters (RFC 3279), as found in DG14 and DG15.
+func parseCurve(params asn1.RawValue) (*Curve, error) {
+    if params.Tag == asn1.TagOID {
+        var oid asn1.ObjectIdentifier
+        if _, err := asn1.Unmarshal(params.FullBytes, &oid); err != nil {
+            return nil, err
+        }
+        if c, ok := curveOIDs[oid.String()]; ok { return c, nil }
+        return nil, fmt.Errorf("unsupported curve %s", oid)
+    }
+    var ep ecParameters
+    if _, err := asn1.Unmarshal(params.FullBytes, &ep); err != nil {
+        return nil, fmt.Errorf("invalid EC parameters: %s", err)
+    }
+    c := &Curve{Name: "explicit", P: ep.FieldID.Prime,
+        A: new(big.Int).SetBytes(ep.Curve.A),
+        B: new(big.Int).SetBytes(ep.Curve.B), N: ep.Order}
+    if c.P == nil || c.N == nil {
+        return nil, fmt.Errorf("invalid EC parameters")
+    }
+    var err error
+    if c.Gx, c.Gy, err = c.Unmarshal(ep.Base); err != nil { return nil, err }
+    return namedCurve(c), nil
+}
+
+// Return known curve with the same parameters as c, or c itself.
+func namedCurve(c *Curve) *Curve {
+    for _, known := range curveOIDs {
+        if known.P.Cmp(c.P) == 0 && known.A.Cmp(c.A) == 0 &&
+            known.B.Cmp(c.B) == 0 && known.Gx.Cmp(c.Gx) == 0 {
+            return known
+        }
+    }
+    return c
+}
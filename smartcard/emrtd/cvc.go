@@ -0,0 +1,409 @@
+package emrtd
+
+import (
+    "bytes"
+    "crypto"
+    "crypto/ecdsa"
+    "crypto/rand"
+    "encoding/asn1"
+    "fmt"
+    "io"
+    "math/big"
+    "time"
+    "github.com/sf1/go-card/smartcard/tlv"
+)
+
+// Terminal roles of certificate holder authorization templates.
+var (
+    OID_ROLE_IS = asn1.ObjectIdentifier{0, 4, 0, 127, 0, 7, 3, 1, 2, 1}
+    OID_ROLE_AT = asn1.ObjectIdentifier{0, 4, 0, 127, 0, 7, 3, 1, 2, 2}
+    OID_ROLE_ST = asn1.ObjectIdentifier{0, 4, 0, 127, 0, 7, 3, 1, 2, 3}
+)
+
+// Certificate roles, encoded in the two most significant bits of the
+// relative authorization.
+const (
+    CV_TERMINAL = 0
+    CV_DV_FOREIGN = 1
+    CV_DV_DOMESTIC = 2
+    CV_CVCA = 3
+)
+
+// Access rights of authentication terminals (BSI TR-03110-4, C.4.2), as
+// bit numbers of the relative authorization. Reading data group n is
+// AT_READ_DG1 + n - 1.
+const (
+    AT_AGE_VERIFICATION = 0
+    AT_COMMUNITY_ID_VERIFICATION = 1
+    AT_RESTRICTED_IDENTIFICATION = 2
+    AT_PRIVILEGED_TERMINAL = 3
+    AT_CAN_ALLOWED = 4
+    AT_PIN_MANAGEMENT = 5
+    AT_INSTALL_CERTIFICATE = 6
+    AT_INSTALL_QUALIFIED_CERTIFICATE = 7
+    AT_READ_DG1 = 8
+)
+
+// Certificate holder authorization template: terminal type and relative
+// authorization.
+type CHAT struct {
+    Role asn1.ObjectIdentifier
+    Rights []byte
+}
+
+// Create authentication terminal CHAT with the certificate role and the
+// given AT_* access rights.
+func NewATCHAT(role int, rights ...int) *CHAT {
+    chat := &CHAT{Role: OID_ROLE_AT, Rights: make([]byte, 5)}
+    chat.Rights[0] = byte(role) << 6
+    for _, bit := range rights {
+        chat.Rights[4-bit/8] |= 1 << uint(bit % 8)
+    }
+    return chat
+}
+
+// Return certificate role (CV_* constant).
+func (c *CHAT) CertificateRole() int {
+    if len(c.Rights) == 0 { return CV_TERMINAL }
+    return int(c.Rights[0] >> 6)
+}
+
+// Check whether access right bit is granted.
+func (c *CHAT) Allows(bit int) bool {
+    i := len(c.Rights) - 1 - bit / 8
+    return i >= 0 && c.Rights[i] & (1 << uint(bit % 8)) != 0
+}
+
+// Return encoding as data object 7F4C.
+func (c *CHAT) Bytes() []byte {
+    return tlv.Encode(0x7f4c, append(tlv.Encode(0x06, oidBytes(c.Role)),
+        tlv.Encode(0x53, c.Rights)...))
+}
+
+func parseCHAT(data []byte) (*CHAT, error) {
+    objs, err := tlv.Parse(data)
+    if err != nil { return nil, err }
+    role, err := parseOIDValue(objs.Value(0x06))
+    if err != nil { return nil, err }
+    return &CHAT{Role: role, Rights: objs.Value(0x53)}, nil
+}
+
+// Parse object identifier from the contents of its DER encoding.
+func parseOIDValue(v []byte) (asn1.ObjectIdentifier, error) {
+    var oid asn1.ObjectIdentifier
+    if _, err := asn1.Unmarshal(tlv.Encode(0x06, v), &oid); err != nil {
+        return nil, fmt.Errorf("invalid object identifier")
+    }
+    return oid, nil
+}
+
+// Public key of a CV certificate.
+type CVPublicKey struct {
+    // Terminal Authentication protocol, e.g. OID_TA_ECDSA_SHA_256
+    Algorithm asn1.ObjectIdentifier
+    // Domain parameters: included in CVCA certificates, inherited from
+    // the issuer by VerifyCVChain otherwise
+    Curve *Curve
+    // Uncompressed public point
+    Point []byte
+}
+
+func parseCVPublicKey(data []byte) (*CVPublicKey, error) {
+    objs, err := tlv.Parse(data)
+    if err != nil { return nil, err }
+    key := &CVPublicKey{Point: objs.Value(0x86)}
+    if key.Algorithm, err = parseOIDValue(objs.Value(0x06)); err != nil {
+        return nil, err
+    }
+    if key.Point == nil { return nil, fmt.Errorf("public point missing") }
+    if objs.Value(0x81) != nil {
+        c := &Curve{Name: "explicit",
+            P: new(big.Int).SetBytes(objs.Value(0x81)),
+            A: new(big.Int).SetBytes(objs.Value(0x82)),
+            B: new(big.Int).SetBytes(objs.Value(0x83)),
+            N: new(big.Int).SetBytes(objs.Value(0x85))}
+        if c.Gx, c.Gy, err = c.Unmarshal(objs.Value(0x84)); err != nil {
+            return nil, fmt.Errorf("invalid base point: %s", err)
+        }
+        key.Curve = namedCurve(c)
+    }
+    return key, nil
+}
+
+// Return encoding as data object 7F49, with domain parameters if params
+// is set.
+func (k *CVPublicKey) encode(params bool) []byte {
+    data := tlv.Encode(0x06, oidBytes(k.Algorithm))
+    if params && k.Curve != nil {
+        c := k.Curve
+        size := c.ByteSize()
+        field := func(v *big.Int) []byte {
+            b := make([]byte, size)
+            return v.FillBytes(b)
+        }
+        data = append(data, tlv.Encode(0x81, field(c.P))...)
+        data = append(data, tlv.Encode(0x82, field(c.A))...)
+        data = append(data, tlv.Encode(0x83, field(c.B))...)
+        data = append(data, tlv.Encode(0x84, c.Marshal(c.Gx, c.Gy))...)
+        data = append(data, tlv.Encode(0x85, c.N.Bytes())...)
+    }
+    data = append(data, tlv.Encode(0x86, k.Point)...)
+    if params && k.Curve != nil {
+        data = append(data, tlv.Encode(0x87, []byte{0x01})...)
+    }
+    return tlv.Encode(0x7f49, data)
+}
+
+// Return public key; the domain parameters must be known.
+func (k *CVPublicKey) ECPublicKey() (*ECPublicKey, error) {
+    if k.Curve == nil { return nil, fmt.Errorf("domain parameters unknown") }
+    x, y, err := k.Curve.Unmarshal(k.Point)
+    if err != nil { return nil, err }
+    return &ECPublicKey{Curve: k.Curve, X: x, Y: y}, nil
+}
+
+// Card verifiable certificate (BSI TR-03110-3, appendix C).
+type CVCertificate struct {
+    // Encoding as data object 7F21
+    Raw []byte
+    // Certificate body (data object 7F4E), which is signed
+    Body []byte
+    // Plain ECDSA signature of the issuer
+    Signature []byte
+    Profile int
+    // Certification authority and certificate holder references
+    CAR, CHR string
+    PublicKey *CVPublicKey
+    CHAT *CHAT
+    EffectiveDate time.Time
+    ExpirationDate time.Time
+    // Certificate extensions (contents of data object 65), if any
+    Extensions []byte
+}
+
+// Decode date of six unpacked BCD digits YYMMDD.
+func parseCVDate(v []byte) (time.Time, error) {
+    if len(v) != 6 { return time.Time{}, fmt.Errorf("invalid date") }
+    d := make([]int, 3)
+    for i := range d {
+        if v[2*i] > 9 || v[2*i+1] > 9 {
+            return time.Time{}, fmt.Errorf("invalid date")
+        }
+        d[i] = int(v[2*i]) * 10 + int(v[2*i+1])
+    }
+    return time.Date(2000 + d[0], time.Month(d[1]), d[2], 0, 0, 0, 0,
+        time.UTC), nil
+}
+
+func encodeCVDate(t time.Time) []byte {
+    y, m, d := t.Date()
+    y %= 100
+    return []byte{byte(y / 10), byte(y % 10), byte(m / 10), byte(m % 10),
+        byte(d / 10), byte(d % 10)}
+}
+
+// Parse CV certificate.
+func ParseCVCertificate(data []byte) (*CVCertificate, error) {
+    obj, rest, err := tlv.ParseOne(data)
+    if err != nil { return nil, err }
+    if obj.Tag != 0x7f21 {
+        return nil, fmt.Errorf("invalid CV certificate tag %s", obj.Tag)
+    }
+    cert := &CVCertificate{Raw: data[:len(data)-len(rest)]}
+    body, rest, err := tlv.ParseOne(obj.Value)
+    if err != nil { return nil, err }
+    if body.Tag != 0x7f4e {
+        return nil, fmt.Errorf("invalid certificate body tag %s", body.Tag)
+    }
+    cert.Body = obj.Value[:len(obj.Value)-len(rest)]
+    sig, _, err := tlv.ParseOne(rest)
+    if err != nil || sig.Tag != 0x5f37 {
+        return nil, fmt.Errorf("certificate signature missing")
+    }
+    cert.Signature = sig.Value
+    fields, err := body.Children()
+    if err != nil { return nil, err }
+    for _, f := range fields {
+        switch f.Tag {
+            case 0x5f29:
+                if len(f.Value) != 1 {
+                    return nil, fmt.Errorf("invalid profile identifier")
+                }
+                cert.Profile = int(f.Value[0])
+            case 0x42:
+                cert.CAR = string(f.Value)
+            case 0x5f20:
+                cert.CHR = string(f.Value)
+            case 0x7f49:
+                if cert.PublicKey, err = parseCVPublicKey(f.Value); err != nil {
+                    return nil, fmt.Errorf("invalid public key: %s", err)
+                }
+            case 0x7f4c:
+                if cert.CHAT, err = parseCHAT(f.Value); err != nil {
+                    return nil, fmt.Errorf("invalid CHAT: %s", err)
+                }
+            case 0x5f25:
+                if cert.EffectiveDate, err = parseCVDate(f.Value); err != nil {
+                    return nil, err
+                }
+            case 0x5f24:
+                if cert.ExpirationDate, err = parseCVDate(f.Value); err != nil {
+                    return nil, err
+                }
+            case 0x65:
+                cert.Extensions = f.Value
+        }
+    }
+    if cert.CAR == "" || cert.CHR == "" || cert.PublicKey == nil ||
+        cert.CHAT == nil || cert.ExpirationDate.IsZero() {
+        return nil, fmt.Errorf("incomplete CV certificate")
+    }
+    return cert, nil
+}
+
+// Parse concatenated CV certificates, e.g. a certificate chain.
+func ParseCVCertificates(data []byte) ([]*CVCertificate, error) {
+    var certs []*CVCertificate
+    for len(data) > 0 {
+        cert, err := ParseCVCertificate(data)
+        if err != nil { return nil, err }
+        certs = append(certs, cert)
+        data = data[len(cert.Raw):]
+    }
+    return certs, nil
+}
+
+func (c *CVCertificate) String() string {
+    return c.CHR
+}
+
+// Check whether the certificate is valid at t. Certificates are valid up
+// to the end of their expiration date.
+func (c *CVCertificate) ValidAt(t time.Time) bool {
+    return !t.Before(c.EffectiveDate) &&
+        t.Before(c.ExpirationDate.AddDate(0, 0, 1))
+}
+
+// Check signature of the certificate with the key of issuer, whose domain
+// parameters must be known.
+func (c *CVCertificate) CheckSignatureFrom(issuer *CVCertificate) error {
+    if c.CAR != issuer.CHR {
+        return fmt.Errorf("%s not issued by %s", c.CHR, issuer.CHR)
+    }
+    key, err := issuer.PublicKey.ECPublicKey()
+    if err != nil { return fmt.Errorf("key of %s: %s", issuer.CHR, err) }
+    hash, err := taHash(issuer.PublicKey.Algorithm)
+    if err != nil { return err }
+    r, s, err := parseECDSASignature(c.Signature, key.Curve)
+    if err != nil { return err }
+    h := hash.New()
+    h.Write(c.Body)
+    if !key.Curve.verifyECDSA(key.X, key.Y, h.Sum(nil), r, s) {
+        return fmt.Errorf("signature of %s invalid", c.CHR)
+    }
+    return nil
+}
+
+// Verify chain of CV certificates, i.e. optional CVCA link certificates,
+// a DV certificate and a terminal certificate, against trusted CVCA
+// certificates. Domain parameters missing in a certificate are set to
+// those of its issuer. With non-zero now all certificates of the chain
+// must be valid at that time.
+func VerifyCVChain(trusted, chain []*CVCertificate, now time.Time) error {
+    known := map[string]*CVCertificate{}
+    for _, cert := range trusted {
+        known[cert.CHR] = cert
+    }
+    for _, cert := range chain {
+        issuer, ok := known[cert.CAR]
+        if !ok {
+            return fmt.Errorf("issuer %s of %s unknown", cert.CAR, cert.CHR)
+        }
+        role, issuerRole := cert.CHAT.CertificateRole(),
+            issuer.CHAT.CertificateRole()
+        if !cert.CHAT.Role.Equal(issuer.CHAT.Role) ||
+            (role == CV_TERMINAL) != (issuerRole == CV_DV_DOMESTIC ||
+            issuerRole == CV_DV_FOREIGN) ||
+            (role != CV_TERMINAL && issuerRole != CV_CVCA) {
+            return fmt.Errorf("%s may not issue %s", issuer.CHR, cert.CHR)
+        }
+        if err := cert.CheckSignatureFrom(issuer); err != nil { return err }
+        if !now.IsZero() && !cert.ValidAt(now) {
+            return fmt.Errorf("%s not valid at %s", cert.CHR,
+                now.Format("2006-01-02"))
+        }
+        if cert.PublicKey.Curve == nil {
+            cert.PublicKey.Curve = issuer.PublicKey.Curve
+        }
+        known[cert.CHR] = cert
+    }
+    if len(chain) == 0 ||
+        chain[len(chain)-1].CHAT.CertificateRole() != CV_TERMINAL {
+        return fmt.Errorf("chain does not end with a terminal certificate")
+    }
+    return nil
+}
+
+// Sign hash of data with an ECDSA key and return the plain signature
+// r || s (BSI TR-03111). The public key of signer must be an
+// *ecdsa.PublicKey or *ECPublicKey.
+func signPlain(r io.Reader, signer crypto.Signer, hash crypto.Hash,
+    data []byte) ([]byte, error) {
+    var n *big.Int
+    switch pub := signer.Public().(type) {
+        case *ecdsa.PublicKey:
+            n = pub.Curve.Params().N
+        case *ECPublicKey:
+            n = pub.Curve.N
+        default:
+            return nil, fmt.Errorf("unsupported key type %T", pub)
+    }
+    h := hash.New()
+    h.Write(data)
+    der, err := signer.Sign(r, h.Sum(nil), hash)
+    if err != nil { return nil, err }
+    var rs struct{ R, S *big.Int }
+    if _, err := asn1.Unmarshal(der, &rs); err != nil {
+        return nil, fmt.Errorf("invalid ECDSA signature")
+    }
+    size := (n.BitLen() + 7) / 8
+    sig := make([]byte, 2 * size)
+    rs.R.FillBytes(sig[:size])
+    rs.S.FillBytes(sig[size:])
+    return sig, nil
+}
+
+// Create CV certificate from template, signed with the key of issuer, or
+// self-signed if issuer is nil. The template provides CHR, CHAT, public
+// key, dates and extensions; CVCA certificates include the domain
+// parameters of the public key. This is mainly useful for test PKIs.
+func CreateCVCertificate(template, issuer *CVCertificate,
+    key crypto.Signer) (*CVCertificate, error) {
+    alg, car := template.PublicKey.Algorithm, template.CHR
+    if issuer != nil {
+        alg, car = issuer.PublicKey.Algorithm, issuer.CHR
+    }
+    hash, err := taHash(alg)
+    if err != nil { return nil, err }
+    cvca := template.CHAT.CertificateRole() == CV_CVCA
+    body := bytes.Join([][]byte{
+        tlv.Encode(0x5f29, []byte{byte(template.Profile)}),
+        tlv.Encode(0x42, []byte(car)),
+        template.PublicKey.encode(cvca),
+        tlv.Encode(0x5f20, []byte(template.CHR)),
+        template.CHAT.Bytes(),
+        tlv.Encode(0x5f25, encodeCVDate(template.EffectiveDate)),
+        tlv.Encode(0x5f24, encodeCVDate(template.ExpirationDate)),
+    }, nil)
+    if template.Extensions != nil {
+        body = append(body, tlv.Encode(0x65, template.Extensions)...)
+    }
+    body = tlv.Encode(0x7f4e, body)
+    sig, err := signPlain(rand.Reader, key, hash, body)
+    if err != nil { return nil, err }
+    cert, err := ParseCVCertificate(tlv.Encode(0x7f21, append(body,
+        tlv.Encode(0x5f37, sig)...)))
+    if err != nil { return nil, err }
+    if !cvca { cert.PublicKey.Curve = template.PublicKey.Curve }
+    return cert, nil
+}
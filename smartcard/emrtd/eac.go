@@ -0,0 +1,264 @@
+package emrtd
+
+import (
+    "bytes"
+    "crypto"
+    "encoding/asn1"
+    "fmt"
+    "math/big"
+    "github.com/sf1/go-card/smartcard"
+    "github.com/sf1/go-card/smartcard/tlv"
+)
+
+// Auxiliary data object identifiers (BSI TR-03110-3, A.6.5).
+var (
+    OID_AUX_AGE_VERIFICATION = asn1.ObjectIdentifier{0, 4, 0, 127, 0, 7, 3,
+        1, 4, 1}
+    OID_AUX_DOCUMENT_VALIDITY = asn1.ObjectIdentifier{0, 4, 0, 127, 0, 7, 3,
+        1, 4, 2}
+    OID_AUX_COMMUNITY_ID = asn1.ObjectIdentifier{0, 4, 0, 127, 0, 7, 3, 1,
+        4, 3}
+)
+
+// Auxiliary data sent in Terminal Authentication and verified by the chip
+// afterwards with VerifyAuxiliaryData, e.g. the required date of birth
+// (YYYYMMDD) for age verification.
+type AuxiliaryData struct {
+    OID asn1.ObjectIdentifier
+    Data []byte
+}
+
+func encodeAuxiliaryData(aux []AuxiliaryData) []byte {
+    if len(aux) == 0 { return nil }
+    var data []byte
+    for _, a := range aux {
+        data = append(data, tlv.Encode(0x73, append(tlv.Encode(0x06,
+            oidBytes(a.OID)), tlv.Encode(0x53, a.Data)...))...)
+    }
+    return tlv.Encode(0x67, data)
+}
+
+// Ephemeral Chip Authentication key pair of the terminal.
+type ephemeralKey struct {
+    curve *Curve
+    d, x, y *big.Int
+}
+
+// Return Chip Authentication domain parameters from EF.CardAccess.
+func (p *Passport) chipAuthenticationCurve() (*Curve, error) {
+    infos, err := p.CardAccess()
+    if err != nil { return nil, fmt.Errorf("reading EF.CardAccess: %s", err) }
+    for _, dp := range infos.ChipAuthenticationDomainParameters {
+        if oidUnder(dp.Protocol, OID_CA) { return dp.Curve, nil }
+    }
+    return nil, fmt.Errorf("no Chip Authentication domain parameters in " +
+        "EF.CardAccess")
+}
+
+// Perform Terminal Authentication version 2 (BSI TR-03110-2, 3.3) after
+// PACE. chain holds the CV certificates up to the terminal certificate,
+// starting with one issued by a CVCA the chip trusts (see PACEWithCHAT);
+// earlier certificates are skipped. key is the private key of the
+// terminal certificate. The ephemeral key for ChipAuthenticationV2 is
+// generated here.
+func (p *Passport) TerminalAuthentication(chain []*CVCertificate,
+    key crypto.Signer, aux []AuxiliaryData) error {
+    if p.sm == nil || p.idPICC == nil { return fmt.Errorf("PACE required") }
+    if len(chain) == 0 { return fmt.Errorf("certificate chain empty") }
+    terminal := chain[len(chain)-1]
+    if terminal.CHAT.CertificateRole() != CV_TERMINAL {
+        return fmt.Errorf("%s is not a terminal certificate", terminal)
+    }
+    hash, err := taHash(terminal.PublicKey.Algorithm)
+    if err != nil { return err }
+    start := -1
+    if len(p.cars) == 0 { start = 0 }
+    for i := 0; i < len(chain) && start < 0; i++ {
+        for _, car := range p.cars {
+            if chain[i].CAR == car { start = i }
+        }
+    }
+    if start < 0 {
+        return fmt.Errorf("no certificate issued by trusted CVCA %v", p.cars)
+    }
+    for _, cert := range chain[start:] {
+        // MSE:Set DST, PSO:Verify Certificate
+        if _, err := p.transmit(smartcard.Command3(0x00, INS_MSE, 0x81, 0xb6,
+            tlv.Encode(0x83, []byte(cert.CAR)))); err != nil {
+            return fmt.Errorf("TA MSE:Set DST %s: %s", cert.CAR, err)
+        }
+        data := append(append([]byte{}, cert.Body...), tlv.Encode(0x5f37,
+            cert.Signature)...)
+        if err := p.transmitChained(INS_PSO, 0x00, 0xbe, data); err != nil {
+            return fmt.Errorf("TA verify certificate %s: %s", cert, err)
+        }
+    }
+    curve, err := p.chipAuthenticationCurve()
+    if err != nil { return err }
+    d, x, y, err := curve.generateKey(p.randReader(), curve.Gx, curve.Gy)
+    if err != nil { return err }
+    comp := curve.Marshal(x, y)[1:1+curve.ByteSize()]
+    auxData := encodeAuxiliaryData(aux)
+    // MSE:Set AT
+    at := tlv.Encode(0x80, oidBytes(terminal.PublicKey.Algorithm))
+    at = append(at, tlv.Encode(0x83, []byte(terminal.CHR))...)
+    at = append(at, auxData...)
+    at = append(at, tlv.Encode(0x91, comp)...)
+    if _, err := p.transmit(smartcard.Command3(0x00, INS_MSE, 0x81, 0xa4,
+        at)); err != nil {
+        return fmt.Errorf("TA MSE:Set AT: %s", err)
+    }
+    challenge, err := p.transmit(smartcard.Command2(0x00, INS_GET_CHALLENGE,
+        0x00, 0x00, 8))
+    if err != nil { return fmt.Errorf("TA GET CHALLENGE: %s", err) }
+    signed := bytes.Join([][]byte{p.idPICC, challenge, comp, auxData}, nil)
+    sig, err := signPlain(p.randReader(), key, hash, signed)
+    if err != nil { return err }
+    if _, err := p.transmit(smartcard.Command3(0x00,
+        INS_EXTERNAL_AUTHENTICATE, 0x00, 0x00, sig)); err != nil {
+        return fmt.Errorf("Terminal Authentication failed: %s", err)
+    }
+    p.caKey = &ephemeralKey{curve: curve, d: d, x: x, y: y}
+    return nil
+}
+
+// Verify auxiliary data sent in Terminal Authentication, e.g. whether the
+// holder was born before the date of OID_AUX_AGE_VERIFICATION. Returns
+// false if the chip rejects it.
+func (p *Passport) VerifyAuxiliaryData(oid asn1.ObjectIdentifier) (bool,
+    error) {
+    _, err := p.transmit(smartcard.Command3(0x80, INS_VERIFY, 0x80, 0x00,
+        tlv.Encode(0x06, oidBytes(oid))))
+    if err == smartcard.SWError(0x6300) { return false, nil }
+    if err != nil { return false, err }
+    return true, nil
+}
+
+// Perform Chip Authentication version 2 (BSI TR-03110-2, 3.4) with the
+// ephemeral key of Terminal Authentication and restart secure messaging.
+// The static key of the chip is read from EF.CardSecurity, whose
+// signature proves the chip genuine (see CardSecurity.Verify).
+func (p *Passport) ChipAuthenticationV2() error {
+    if p.caKey == nil { return fmt.Errorf("Terminal Authentication required") }
+    cs, err := p.CardSecurity()
+    if err != nil { return fmt.Errorf("reading EF.CardSecurity: %s", err) }
+    infos := cs.ChipAuthentication
+    if len(infos) == 0 {
+        access, err := p.CardAccess()
+        if err != nil { return err }
+        infos = access.ChipAuthentication
+    }
+    var info *ChipAuthenticationInfo
+    var pk *ChipAuthenticationPublicKeyInfo
+    for i := range infos {
+        if !oidUnder(infos[i].Protocol, OID_CA_ECDH) { continue }
+        if _, err := infos[i].Cipher(); err != nil { continue }
+        for j := range cs.ChipAuthenticationPublicKeys {
+            k := &cs.ChipAuthenticationPublicKeys[j]
+            if k.PublicKey == nil || k.PublicKey.Curve != p.caKey.curve {
+                continue
+            }
+            if infos[i].KeyID < 0 || k.KeyID == infos[i].KeyID {
+                info, pk = &infos[i], k
+                break
+            }
+        }
+        if info != nil { break }
+    }
+    if info == nil {
+        return fmt.Errorf("no Chip Authentication key on curve %s",
+            p.caKey.curve)
+    }
+    c, _ := info.Cipher()
+    curve := p.caKey.curve
+    // MSE:Set AT
+    data := tlv.Encode(0x80, oidBytes(info.Protocol))
+    if pk.KeyID >= 0 {
+        data = append(data, tlv.Encode(0x84,
+            big.NewInt(int64(pk.KeyID)).Bytes())...)
+    }
+    if _, err := p.transmit(smartcard.Command3(0x00, INS_MSE, 0x41, 0xa4,
+        data)); err != nil {
+        return fmt.Errorf("Chip Authentication MSE:Set AT: %s", err)
+    }
+    ephemeral := curve.Marshal(p.caKey.x, p.caKey.y)
+    objs, err := p.generalAuthenticateData(tlv.Encode(0x80, ephemeral), true)
+    if err != nil { return fmt.Errorf("Chip Authentication failed: %s", err) }
+    nonce, token := objs.Value(0x81), objs.Value(0x82)
+    if nonce == nil || token == nil {
+        return fmt.Errorf("Chip Authentication: nonce or token missing")
+    }
+    kx, _ := curve.ScalarMult(pk.PublicKey.X, pk.PublicKey.Y, p.caKey.d)
+    if kx == nil { return fmt.Errorf("Chip Authentication: invalid key") }
+    k := make([]byte, curve.ByteSize())
+    kx.FillBytes(k)
+    secret := append(k, nonce...)
+    ksEnc, ksMac := KDF(secret, KDF_ENC, c), KDF(secret, KDF_MAC, c)
+    expected, err := paceToken(c, ksMac, info.Protocol, ephemeral)
+    if err != nil { return err }
+    if !bytes.Equal(token, expected) {
+        return fmt.Errorf("Chip Authentication token mismatch")
+    }
+    p.caKey = nil
+    p.sm, err = NewSecureMessaging(p.card, c, ksEnc, ksMac,
+        make([]byte, c.BlockSize()))
+    return err
+}
+
+// Perform Restricted Identification (BSI TR-03110-2, 3.5) with chip key
+// keyID and the public key of a sector, returning the sector specific
+// identifier of the document. Requires Terminal Authentication with the
+// Restricted Identification right and Chip Authentication.
+func (p *Passport) RestrictedIdentification(keyID int,
+    sector *ECPublicKey) ([]byte, error) {
+    cs, err := p.CardSecurity()
+    if err != nil { return nil, fmt.Errorf("reading EF.CardSecurity: %s", err) }
+    var info *RestrictedIdentificationInfo
+    for i := range cs.RestrictedIdentification {
+        ri := &cs.RestrictedIdentification[i]
+        if ri.KeyID == keyID && oidUnder(ri.Protocol, OID_RI_ECDH) {
+            info = ri
+            break
+        }
+    }
+    if info == nil {
+        return nil, fmt.Errorf("no Restricted Identification key %d", keyID)
+    }
+    data := append(tlv.Encode(0x80, oidBytes(info.Protocol)), tlv.Encode(0x84,
+        big.NewInt(int64(keyID)).Bytes())...)
+    if _, err := p.transmit(smartcard.Command3(0x00, INS_MSE, 0x41, 0xa4,
+        data)); err != nil {
+        return nil, fmt.Errorf("Restricted Identification MSE:Set AT: %s", err)
+    }
+    key := append(tlv.Encode(0x06, oidBytes(info.Protocol)), tlv.Encode(0x86,
+        sector.Bytes())...)
+    id, err := p.generalAuthenticate(tlv.Encode(0xa0, key), 0x81, true)
+    if err != nil {
+        return nil, fmt.Errorf("Restricted Identification failed: %s", err)
+    }
+    return id, nil
+}
+
+// Select German eID application, which holds the data groups of the eID
+// function.
+func (p *Passport) SelectEID() error {
+    return p.selectApplication(AID_EID, "eID")
+}
+
+// Perform Extended Access Control version 2 as an authentication
+// terminal: PACE with pw requesting the rights of the terminal
+// certificate (the last of chain), Terminal Authentication and Chip
+// Authentication version 2. A wrong or blocked PIN is reported as
+// *PINError.
+func (p *Passport) EAC(pw Password, chain []*CVCertificate, key crypto.Signer,
+    aux []AuxiliaryData) error {
+    if len(chain) == 0 { return fmt.Errorf("certificate chain empty") }
+    if _, err := p.PACEWithCHAT(pw, chain[len(chain)-1].CHAT); err != nil {
+        if _, ok := err.(*PINError); ok { return err }
+        return fmt.Errorf("PACE: %s", err)
+    }
+    if err := p.TerminalAuthentication(chain, key, aux); err != nil {
+        return err
+    }
+    return p.ChipAuthenticationV2()
+}
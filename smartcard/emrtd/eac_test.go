@@ -0,0 +1,189 @@
+package emrtd
+
+import (
+    "bytes"
+    "crypto/x509"
+    "strings"
+    "testing"
+    "github.com/sf1/go-card/smartcard"
+)
+
+func TestCHAT(t *testing.T) {
+    chat := NewATCHAT(CV_DV_FOREIGN, AT_READ_DG1 + 3,
+        AT_RESTRICTED_IDENTIFICATION)
+    if !bytes.Equal(chat.Rights, []byte{0x40, 0x00, 0x00, 0x08, 0x04}) {
+        t.Errorf("unexpected rights %X", chat.Rights)
+    }
+    if chat.CertificateRole() != CV_DV_FOREIGN ||
+        !chat.Allows(AT_RESTRICTED_IDENTIFICATION) ||
+        chat.Allows(AT_AGE_VERIFICATION) || chat.Allows(AT_READ_DG1 + 4) {
+        t.Error("unexpected access rights")
+    }
+    parsed, err := parseCHAT(chat.Bytes()[3:])
+    if err != nil { t.Fatal(err) }
+    if !parsed.Role.Equal(OID_ROLE_AT) ||
+        !bytes.Equal(parsed.Rights, chat.Rights) {
+        t.Errorf("unexpected CHAT %v", parsed)
+    }
+}
+
+func TestCVCertificates(t *testing.T) {
+    chain, _ := simTerminal(t, "UTTERM00001", AT_READ_DG1)
+    terminal := chain[2]
+    cert, err := ParseCVCertificate(terminal.Raw)
+    if err != nil { t.Fatal(err) }
+    if cert.CAR != "UTDVCA00001" || cert.CHR != "UTTERM00001" ||
+        cert.Profile != 0 || cert.PublicKey.Curve != nil ||
+        !cert.PublicKey.Algorithm.Equal(OID_TA_ECDSA_SHA_256) ||
+        !cert.EffectiveDate.Equal(simDate("2025-06-01")) ||
+        !cert.ExpirationDate.Equal(simDate("2025-06-30")) {
+        t.Errorf("unexpected certificate %+v", cert)
+    }
+    // Domain parameters are included in CVCA certificates only
+    if simCV.cvca.PublicKey.Curve != BrainpoolP256r1 {
+        t.Errorf("unexpected CVCA curve %v", simCV.cvca.PublicKey.Curve)
+    }
+    raw := append(append([]byte{}, simCV.link.Raw...), simCV.dv.Raw...)
+    certs, err := ParseCVCertificates(append(raw, cert.Raw...))
+    if err != nil { t.Fatal(err) }
+    if len(certs) != 3 || certs[1].CHR != "UTDVCA00001" {
+        t.Fatalf("unexpected certificates %v", certs)
+    }
+    // The link certificate needs command chaining in PSO:Verify Certificate
+    if len(certs[0].Raw) <= MAX_READ { t.Errorf("link certificate too short") }
+    trusted := []*CVCertificate{simCV.cvca}
+    now := simDate("2025-06-15")
+    if err := VerifyCVChain(trusted, certs, now); err != nil { t.Fatal(err) }
+    if certs[2].PublicKey.Curve != BrainpoolP256r1 {
+        t.Error("domain parameters not inherited")
+    }
+    if err := VerifyCVChain(trusted, certs, simDate("2025-07-01")); err == nil ||
+        !strings.Contains(err.Error(), "not valid") {
+        t.Errorf("expected expired certificate, got %v", err)
+    }
+    if err := VerifyCVChain(trusted, certs[1:], now); err == nil {
+        t.Error("chain without link certificate accepted")
+    }
+    if err := VerifyCVChain(trusted, certs[:2], now); err == nil {
+        t.Error("chain without terminal certificate accepted")
+    }
+    // Modified signature
+    bad, _ := ParseCVCertificate(cert.Raw)
+    bad.Signature = append([]byte{}, bad.Signature...)
+    bad.Signature[5] ^= 1
+    if err := VerifyCVChain(trusted, []*CVCertificate{certs[0], certs[1],
+        bad}, now); err == nil {
+        t.Error("invalid signature accepted")
+    }
+    // Terminal certificates cannot issue certificates
+    key := newSimSigner(t, "UTTERM00002", BrainpoolP256r1)
+    sub := simCVCert(t, "UTTERM00002", NewATCHAT(CV_TERMINAL), key, certs[2],
+        key, "2025-06-01", "2025-06-30")
+    if err := VerifyCVChain(trusted, append(certs, sub), now); err == nil {
+        t.Error("certificate issued by terminal accepted")
+    }
+    if _, err := ParseCVCertificate(cert.Raw[:40]); err == nil {
+        t.Error("truncated certificate accepted")
+    }
+}
+
+func newEACPassport(t *testing.T) *simPassport {
+    return newSimPassport(t, simOptions{
+        pace: protocol(OID_PACE_ECDH_GM, 2), paceParam: 13,
+        ca: protocol(OID_CA_ECDH, 2), caCurve: BrainpoolP256r1, eac: true})
+}
+
+func TestEAC(t *testing.T) {
+    sim := newEACPassport(t)
+    chain, key := simTerminal(t, "UTTERM00001", AT_READ_DG1,
+        AT_READ_DG1 + 3, AT_AGE_VERIFICATION, AT_RESTRICTED_IDENTIFICATION)
+    p := New(sim)
+    cars, err := p.PACEWithCHAT(PINPassword("123456"), chain[2].CHAT)
+    if err != nil { t.Fatal(err) }
+    if len(cars) != 1 || cars[0] != "UTCVCA00001" {
+        t.Fatalf("unexpected CVCA references %v", cars)
+    }
+    if err := p.ChipAuthenticationV2(); err == nil {
+        t.Error("Chip Authentication without Terminal Authentication")
+    }
+    aux := []AuxiliaryData{{OID_AUX_AGE_VERIFICATION, []byte("20070615")}}
+    if err := p.TerminalAuthentication(chain, key, aux); err != nil {
+        t.Fatal(err)
+    }
+    if err := p.ChipAuthenticationV2(); err != nil { t.Fatal(err) }
+    cs, err := p.CardSecurity()
+    if err != nil { t.Fatal(err) }
+    if _, _, err := cs.Verify([]*x509.Certificate{sim.csca}); err != nil {
+        t.Error(err)
+    }
+    if len(cs.ChipAuthenticationPublicKeys) != 1 ||
+        len(cs.ChipAuthenticationDomainParameters) != 1 ||
+        len(cs.RestrictedIdentification) != 1 {
+        t.Errorf("unexpected security infos %+v", cs.SecurityInfos)
+    }
+    ok, err := p.VerifyAuxiliaryData(OID_AUX_AGE_VERIFICATION)
+    if err != nil || !ok { t.Errorf("age verification failed: %v", err) }
+    sector := newSimSigner(t, "sector", BrainpoolP256r1).key
+    id, err := p.RestrictedIdentification(1, &sector)
+    if err != nil { t.Fatal(err) }
+    if !bytes.Equal(id, sim.sectorID(sector.X, sector.Y)) {
+        t.Errorf("unexpected sector identifier %X", id)
+    }
+    if _, err := p.RestrictedIdentification(2, &sector); err == nil {
+        t.Error("unknown RI key accepted")
+    }
+    if err := p.SelectEID(); err != nil { t.Fatal(err) }
+    dg4, err := p.DataGroup(4)
+    if err != nil { t.Fatal(err) }
+    if !bytes.Contains(dg4, []byte("ERIKA")) { t.Errorf("unexpected DG4 %X", dg4) }
+    if _, err := p.DataGroup(5); err != smartcard.SWError(0x6982) {
+        t.Errorf("expected DG5 access denied, got %v", err)
+    }
+}
+
+func TestEACErrors(t *testing.T) {
+    sim := newEACPassport(t)
+    chain, key := simTerminal(t, "UTTERM00003", AT_READ_DG1,
+        AT_AGE_VERIFICATION)
+    // Wrong PIN until blocked
+    for _, retries := range []int{2, 1, 0, 0} {
+        _, err := New(sim).PACEWithCHAT(PINPassword("000000"), chain[2].CHAT)
+        if e, ok := err.(*PINError); !ok || e.Retries != retries {
+            t.Fatalf("expected PINError with %d retries, got %v", retries, err)
+        }
+    }
+    // Age verification fails, RI not allowed
+    sim = newEACPassport(t)
+    p := New(sim)
+    aux := []AuxiliaryData{{OID_AUX_AGE_VERIFICATION, []byte("19700101")}}
+    if err := p.EAC(PINPassword("123456"), chain, key, aux); err != nil {
+        t.Fatal(err)
+    }
+    if ok, err := p.VerifyAuxiliaryData(OID_AUX_AGE_VERIFICATION); ok ||
+        err != nil {
+        t.Errorf("age verification succeeded: %v", err)
+    }
+    sector := newSimSigner(t, "sector", BrainpoolP256r1).key
+    if _, err := p.RestrictedIdentification(1, &sector); err == nil {
+        t.Error("RI without access right succeeded")
+    }
+    // Chain not issued by the trusted CVCA
+    p = New(newEACPassport(t))
+    if _, err := p.PACEWithCHAT(CANPassword(simCAN),
+        chain[2].CHAT); err != nil {
+        t.Fatal(err)
+    }
+    if err := p.TerminalAuthentication(chain[1:], key, nil); err == nil {
+        t.Error("untrusted certificate chain accepted")
+    }
+    // Wrong terminal key
+    p = New(newEACPassport(t))
+    other := newSimSigner(t, "other", BrainpoolP256r1)
+    if err := p.EAC(CANPassword(simCAN), chain, other, nil); err == nil ||
+        !strings.Contains(err.Error(), "Terminal Authentication failed") {
+        t.Errorf("expected TA failure, got %v", err)
+    }
+    if _, err := p.CardSecurity(); err == nil {
+        t.Error("EF.CardSecurity readable without TA")
+    }
+}
@@ -0,0 +1,233 @@
+/*
+Package emrtd implements a reader for electronic machine readable travel
+documents (ePassports, eID cards) according to ICAO Doc 9303 parts 10 and
+11: access control with BAC or PACE (generic mapping, ECDH), secure
+messaging with 3DES or AES, reading of the LDS files, Passive
+Authentication of the data groups against EF.SOD, Active Authentication
+and Chip Authentication (ECDH).
+
+Extended Access Control version 2 (BSI TR-03110) is supported for
+identity cards such as the German eID: PACE with PIN, PUK or CAN
+requesting a CHAT, Terminal Authentication with card verifiable
+certificates, Chip Authentication version 2 and Restricted
+Identification:
+
+    chain, err := emrtd.ParseCVCertificates(dvAndTerminalCertificates)
+    // handle error, if any
+    err = p.EAC(emrtd.PINPassword(pin), chain, terminalKey, nil)
+    // handle error, if any
+    err = p.SelectEID()
+
+Example:
+
+    p := emrtd.New(card)
+    err := p.Authenticate(emrtd.MRZPassword(&emrtd.MRZInfo{
+        DocumentNumber: "L898902C", DateOfBirth: "690806",
+        DateOfExpiry: "940623"}))
+    // handle error, if any
+    mrz, err := p.DG1()
+    // handle error, if any
+    result, err := p.PassiveAuthentication(cscaCertificates)
+
+Elliptic curve protocols support the NIST and Brainpool curves listed in
+Curves as well as explicit domain parameters; DH variants are not
+supported.
+*/
+package emrtd
+
+import (
+    "crypto/rand"
+    "fmt"
+    "io"
+    "github.com/sf1/go-card/smartcard"
+    "github.com/sf1/go-card/smartcard/SW"
+    "github.com/sf1/go-card/smartcard/tlv"
+)
+
+// eMRTD LDS1 application identifier.
+var AID = []byte{0xa0, 0x00, 0x00, 0x02, 0x47, 0x10, 0x01}
+
+// German eID application identifier (BSI TR-03127).
+var AID_EID = []byte{0xe8, 0x07, 0x04, 0x00, 0x7f, 0x00, 0x07, 0x03, 0x02}
+
+const (
+    // Instructions
+    INS_SELECT = 0xa4
+    INS_READ_BINARY = 0xb0
+    INS_READ_BINARY_ODD = 0xb1
+    INS_GET_CHALLENGE = 0x84
+    INS_EXTERNAL_AUTHENTICATE = 0x82
+    INS_INTERNAL_AUTHENTICATE = 0x88
+    INS_MSE = 0x22
+    INS_GENERAL_AUTHENTICATE = 0x86
+    INS_PSO = 0x2a
+    INS_VERIFY = 0x20
+    // Elementary files
+    FID_CARD_ACCESS = 0x011c
+    // EF.CardSecurity of the master file; EF.SOD within the application
+    FID_CARD_SECURITY = 0x011d
+    FID_COM = 0x011e
+    FID_SOD = 0x011d
+    FID_DG1 = 0x0101
+    FID_DG2 = 0x0102
+    FID_DG11 = 0x010b
+    FID_DG14 = 0x010e
+    FID_DG15 = 0x010f
+    // Maximum bytes per READ BINARY and per command of a chain, leaving
+    // room for secure messaging
+    MAX_READ = 0xdf
+)
+
+// Return file identifier of data group n (1-16).
+func DataGroupFID(n int) uint16 {
+    return 0x0100 + uint16(n)
+}
+
+// Electronic travel document.
+type Passport struct {
+    card smartcard.Transmitter
+    sm *SecureMessaging
+    files map[uint16][]byte
+    // CVCA references and compressed ephemeral key of the chip from PACE
+    cars []string
+    idPICC []byte
+    // Ephemeral Chip Authentication key committed to in TA
+    caKey *ephemeralKey
+    // Source of randomness for the authentication protocols, crypto/rand
+    // if nil. Tests set it to replay recorded traces.
+    Rand io.Reader
+}
+
+// Create travel document from transmitter, e.g. a *smartcard.Card.
+func New(card smartcard.Transmitter) *Passport {
+    return &Passport{card: card, files: map[uint16][]byte{}}
+}
+
+// Return transmitter for commands: the secure messaging channel once
+// established, the underlying transmitter otherwise.
+func (p *Passport) Transmitter() smartcard.Transmitter {
+    if p.sm != nil { return p.sm }
+    return p.card
+}
+
+// Return secure messaging channel, or nil.
+func (p *Passport) SecureMessaging() *SecureMessaging {
+    return p.sm
+}
+
+func (p *Passport) randReader() io.Reader {
+    if p.Rand == nil { return rand.Reader }
+    return p.Rand
+}
+
+func (p *Passport) random(n int) ([]byte, error) {
+    b := make([]byte, n)
+    if _, err := io.ReadFull(p.randReader(), b); err != nil { return nil, err }
+    return b, nil
+}
+
+func (p *Passport) transmit(cmd smartcard.CommandAPDU) ([]byte, error) {
+    rsp, err := p.Transmitter().TransmitAPDU(cmd)
+    if err != nil { return nil, err }
+    if rsp.SW() != SW.SUCCESS {
+        return nil, smartcard.SWError(rsp.SW())
+    }
+    return rsp.Data(), nil
+}
+
+// Send command data with command chaining, in parts that fit a short
+// protected command APDU.
+func (p *Passport) transmitChained(ins, p1, p2 byte, data []byte) error {
+    for len(data) > MAX_READ {
+        if _, err := p.transmit(smartcard.Command3(0x10, ins, p1, p2,
+            data[:MAX_READ])); err != nil {
+            return err
+        }
+        data = data[MAX_READ:]
+    }
+    _, err := p.transmit(smartcard.Command3(0x00, ins, p1, p2, data))
+    return err
+}
+
+// Select eMRTD application.
+func (p *Passport) SelectApplication() error {
+    return p.selectApplication(AID, "eMRTD")
+}
+
+// Select application by AID. Cached files belong to the previously
+// selected application (or the master file) and are dropped.
+func (p *Passport) selectApplication(aid []byte, name string) error {
+    _, err := p.transmit(smartcard.Command3(0x00, INS_SELECT, 0x04, 0x0c,
+        aid))
+    if err != nil {
+        return fmt.Errorf("selecting %s application: %s", name, err)
+    }
+    p.files = map[uint16][]byte{}
+    return nil
+}
+
+func (p *Passport) selectFile(fid uint16) error {
+    _, err := p.transmit(smartcard.Command3(0x00, INS_SELECT, 0x02, 0x0c,
+        []byte{byte(fid >> 8), byte(fid)}))
+    return err
+}
+
+// Read n bytes at offset of the selected file. Offsets beyond 32767 are
+// read with the odd READ BINARY instruction.
+func (p *Passport) readBinary(offset, n int) ([]byte, error) {
+    if offset <= 0x7fff {
+        return p.transmit(smartcard.Command2(0x00, INS_READ_BINARY,
+            byte(offset >> 8), byte(offset), byte(n)))
+    }
+    // Response data object 53 adds up to 4 bytes
+    if n > MAX_READ - 4 { n = MAX_READ - 4 }
+    odo := tlv.Encode(0x54, []byte{byte(offset >> 16), byte(offset >> 8),
+        byte(offset)})
+    data, err := p.transmit(smartcard.Command4(0x00, INS_READ_BINARY_ODD,
+        0x00, 0x00, odo, byte(n + 4)))
+    if err != nil { return nil, err }
+    obj, _, err := tlv.ParseOne(data)
+    if err != nil { return nil, err }
+    if obj.Tag != 0x53 {
+        return nil, fmt.Errorf("unexpected data object %s", obj.Tag)
+    }
+    return obj.Value, nil
+}
+
+// Read complete elementary file, whose length is taken from its outer
+// TLV header. Files are cached. If the file cannot be selected or read,
+// e.g. because it is absent or access is denied, the status word is
+// returned as smartcard.SWError.
+func (p *Passport) ReadFile(fid uint16) ([]byte, error) {
+    if data, ok := p.files[fid]; ok { return data, nil }
+    if err := p.selectFile(fid); err != nil { return nil, err }
+    data, err := p.readBinary(0, 4)
+    if err != nil { return nil, err }
+    _, rest, err := tlv.ParseTag(data)
+    if err != nil { return nil, err }
+    length, rest, err := tlv.ParseLength(rest)
+    if err != nil { return nil, err }
+    total := len(data) - len(rest) + length
+    data = append([]byte{}, data...)
+    for len(data) < total {
+        n := total - len(data)
+        if n > MAX_READ { n = MAX_READ }
+        chunk, err := p.readBinary(len(data), n)
+        if err != nil {
+            return nil, fmt.Errorf("reading file %04X at %d: %s", fid,
+                len(data), err)
+        }
+        if len(chunk) == 0 {
+            return nil, fmt.Errorf("reading file %04X: unexpected end", fid)
+        }
+        data = append(data, chunk...)
+    }
+    data = data[:total]
+    p.files[fid] = data
+    return data, nil
+}
+
+// Read data group n.
+func (p *Passport) DataGroup(n int) ([]byte, error) {
+    return p.ReadFile(DataGroupFID(n))
+}
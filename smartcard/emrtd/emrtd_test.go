@@ -0,0 +1,385 @@
+package emrtd
+
+import (
+    "bytes"
+    "crypto/elliptic"
+    "crypto/x509"
+    "encoding/hex"
+    "math/big"
+    "strings"
+    "testing"
+    "github.com/sf1/go-card/smartcard"
+    "github.com/sf1/go-card/smartcard/mock"
+)
+
+func fromHex(t *testing.T, s string) []byte {
+    b, err := hex.DecodeString(s)
+    if err != nil { t.Fatal(err) }
+    return b
+}
+
+func TestCheckDigit(t *testing.T) {
+    tests := map[string]byte{
+        "L898902C<": '3',
+        "690806": '1',
+        "940623": '6',
+        "D23145890": '7',
+        "ZE184226B<<<<<": '1',
+    }
+    for s, digit := range tests {
+        if d := CheckDigit(s); d != digit {
+            t.Errorf("%s: expected %c, got %c", s, digit, d)
+        }
+    }
+}
+
+func TestParseMRZ(t *testing.T) {
+    m, err := ParseMRZ(simMRZ)
+    if err != nil { t.Fatal(err) }
+    if m.Format != "TD3" || m.DocumentCode != "P" || m.IssuingState != "UTO" ||
+        m.Surname != "ERIKSSON" || m.GivenNames != "ANNA MARIA" ||
+        m.DocumentNumber != "L898902C" || m.DateOfBirth != "740812" ||
+        m.Sex != "F" || m.DateOfExpiry != "120415" ||
+        m.OptionalData != "ZE184226B" {
+        t.Errorf("unexpected TD3 MRZ %+v", m)
+    }
+    td1 := "I<UTOD231458907<<<<<<<<<<<<<<<\n" +
+        "7408122F1204159UTO<<<<<<<<<<<6\n" +
+        "ERIKSSON<<ANNA<MARIA<<<<<<<<<<"
+    if m, err = ParseMRZ(td1); err != nil { t.Fatal(err) }
+    if m.Format != "TD1" || m.DocumentNumber != "D23145890" ||
+        m.Nationality != "UTO" || m.Surname != "ERIKSSON" {
+        t.Errorf("unexpected TD1 MRZ %+v", m)
+    }
+    if *m.Info() != (MRZInfo{"D23145890", "740812", "120415"}) {
+        t.Errorf("unexpected MRZ information %+v", m.Info())
+    }
+    bad := strings.Replace(simMRZ, "L898902C<3", "L898902C<4", 1)
+    if _, err := ParseMRZ(bad); err == nil {
+        t.Error("check digit error not detected")
+    }
+    if _, err := ParseMRZ("P<UTO"); err == nil {
+        t.Error("invalid length not detected")
+    }
+}
+
+// ICAO Doc 9303-11, appendix D.2.
+func TestBACKeys(t *testing.T) {
+    info := &MRZInfo{DocumentNumber: "L898902C", DateOfBirth: "690806",
+        DateOfExpiry: "940623"}
+    if s := info.String(); s != "L898902C<369080619406236" {
+        t.Errorf("unexpected MRZ information %s", s)
+    }
+    seed := info.KeySeed()
+    if !bytes.Equal(seed, fromHex(t, "239AB9CB282DAF66231DC5A4DF6BFBAE")) {
+        t.Errorf("unexpected key seed %X", seed)
+    }
+    if k := KDF(seed, KDF_ENC, CIPHER_3DES); !bytes.Equal(k,
+        fromHex(t, "AB94FDECF2674FDFB9B391F85D7F76F2")) {
+        t.Errorf("unexpected Kenc %X", k)
+    }
+    if k := KDF(seed, KDF_MAC, CIPHER_3DES); !bytes.Equal(k,
+        fromHex(t, "7962D9ECE03D1ACD4C76089DCE131543")) {
+        t.Errorf("unexpected Kmac %X", k)
+    }
+}
+
+// ICAO Doc 9303-11, appendix G.1: PACE with ECDH generic mapping,
+// brainpoolP256r1 and AES-128.
+func TestPACEVectors(t *testing.T) {
+    info := &MRZInfo{DocumentNumber: "T22000129", DateOfBirth: "640812",
+        DateOfExpiry: "101031"}
+    secret, err := MRZPassword(info).bytes()
+    if err != nil { t.Fatal(err) }
+    if k := KDF(secret, KDF_PI, CIPHER_AES128); !bytes.Equal(k,
+        fromHex(t, "89DED1B26624EC1E634C1989302849DD")) {
+        t.Errorf("unexpected K_pi %X", k)
+    }
+    const (
+        nonce = "95A3A016522EE98D01E76CB6B98B42C3"
+        pcdMapping = "7ACF3EFC982EC45565A4B155129EFBC74650DCBFA6362D896F" +
+            "C70262E0C2CC5E544552DCB6725218799115B55C9BAA6D9F6BC3A9618E70" +
+            "C25AF71777A9C4922D"
+        piccMapping = "824FBA91C9CBE26BEF53A0EBE7342A3BF178CEA9F45DE0B70A" +
+            "A601651FBA3F5730D8C879AAA9C9F73991E61B58F4D52EB87A0A0C709A49" +
+            "DC63719363CCD13C54"
+        pcdKey = "2DB7A64C0355044EC9DF190514C625CBA2CEA48754887122F3A5EF" +
+            "0D5EDD301C3556F3B3B186DF10B857B58F6A7EB80F20BA5DC7BE1D43D9BF" +
+            "850149FBB36462"
+        piccKey = "9E880F842905B8B3181F7AF7CAA9F0EFB743847F44A306D2D28C1D" +
+            "9EC65DF6DB7764B22277A2EDDC3C265A9F018F9CB852E111B768B326904B" +
+            "59A0193776F094"
+    )
+    card := mock.NewCard(nil).
+        Expect("00A4020C02011C", "9000").
+        Expect("00B0000004", "311430129000").
+        Expect("00B0000412", "060A04007F0007020204020202010202010D9000").
+        Expect("0022C1A412800A04007F00070202040202830101" + "84010D",
+            "9000").
+        Expect("10860000027C0000", "7C1280" + "10" + nonce + "9000").
+        Expect("10860000457C438141" + "04" + pcdMapping + "00",
+            "7C438241" + "04" + piccMapping + "9000").
+        Expect("10860000457C438341" + "04" + pcdKey + "00",
+            "7C438441" + "04" + piccKey + "9000").
+        Expect("008600000C7C0A8508C2B0BD78D94BA86600",
+            "7C0A86083ABB9674BCE93C089000")
+    // Terminal's private keys of the mapping and the key agreement, as
+    // read by generateKey (d = r mod (N-1) + 1)
+    var rnd []byte
+    for _, d := range []string{
+        "7F4EF07B9EA82FD78AD689B38D0BC78CF21F249D953BC46F4C6E19259C010F99",
+        "A73FB703AC1436A18E0CFA5ABB3F7BEC7A070E7A6788486BEE230C4A22762595",
+    } {
+        r := new(big.Int).Sub(new(big.Int).SetBytes(fromHex(t, d)),
+            big.NewInt(1))
+        rnd = append(rnd, r.FillBytes(make([]byte, 40))...)
+    }
+    p := New(card)
+    p.Rand = bytes.NewReader(rnd)
+    if err := p.PACE(MRZPassword(info)); err != nil { t.Fatal(err) }
+    card.AssertExpectations(t)
+    if !bytes.Equal(p.sm.kmac, fromHex(t, "FE251C7858B356B24514B3BD5F4297D1")) {
+        t.Errorf("unexpected KS_mac %X", p.sm.kmac)
+    }
+    enc, _ := newBlock(CIPHER_AES128,
+        fromHex(t, "F5F0E35C0D7161EE6724EE513A0D9A7F"))
+    a, b := make([]byte, 16), make([]byte, 16)
+    enc.Encrypt(a, a)
+    p.sm.enc.Encrypt(b, b)
+    if !bytes.Equal(a, b) { t.Error("unexpected KS_enc") }
+}
+
+func TestCurves(t *testing.T) {
+    for id, c := range Curves {
+        if !c.IsOnCurve(c.Gx, c.Gy) {
+            t.Errorf("%d %s: generator not on curve", id, c)
+        }
+        if x, _ := c.ScalarMult(c.Gx, c.Gy, c.N); x != nil {
+            t.Errorf("%d %s: N*G is not infinity", id, c)
+        }
+        // (N-1)*G = -G
+        n1 := new(big.Int).Sub(c.N, big.NewInt(1))
+        x, y := c.ScalarMult(c.Gx, c.Gy, n1)
+        if x.Cmp(c.Gx) != 0 || new(big.Int).Add(y, c.Gy).Cmp(c.P) != 0 {
+            t.Errorf("%d %s: (N-1)*G != -G", id, c)
+        }
+        if _, _, err := c.Unmarshal(c.Marshal(c.Gx, c.Gy)[1:]); err == nil {
+            t.Errorf("%d %s: invalid encoding accepted", id, c)
+        }
+    }
+    // Compare with crypto/elliptic for a NIST curve
+    k := big.NewInt(0x123456789)
+    x, y := P256.ScalarMult(P256.Gx, P256.Gy, k)
+    ex, ey := elliptic.P256().ScalarBaseMult(k.Bytes())
+    if x.Cmp(ex) != 0 || y.Cmp(ey) != 0 {
+        t.Error("scalar multiplication differs from crypto/elliptic")
+    }
+}
+
+func TestSecureMessagingErrors(t *testing.T) {
+    sim := newSimPassport(t, simOptions{})
+    p := New(sim)
+    if err := p.Authenticate(MRZPassword(simInfo)); err != nil { t.Fatal(err) }
+    // Status words of errors are passed through
+    _, err := p.ReadFile(0x0199)
+    if err != smartcard.SWError(0x6a82) {
+        t.Errorf("expected file not found, got %v", err)
+    }
+    // Tampered response
+    p.files = map[uint16][]byte{}
+    card := &tamperCard{card: sim}
+    p.sm.card = card
+    if _, err := p.COM(); err == nil || !strings.Contains(err.Error(),
+        "MAC") {
+        t.Errorf("expected MAC error, got %v", err)
+    }
+}
+
+// Flips a bit in the cryptogram of the first protected response.
+type tamperCard struct {
+    card smartcard.Transmitter
+    n int
+}
+
+func (c *tamperCard) TransmitAPDU(cmd smartcard.CommandAPDU) (
+    smartcard.ResponseAPDU, error) {
+    rsp, err := c.card.TransmitAPDU(cmd)
+    if err != nil { return nil, err }
+    c.n++
+    if c.n == 2 && len(rsp) > 8 { rsp[4] ^= 0x01 }
+    return rsp, nil
+}
+
+func TestBAC(t *testing.T) {
+    sim := newSimPassport(t, simOptions{imageSize: 40000})
+    p := New(sim)
+    wrong := *simInfo
+    wrong.DateOfBirth = "740813"
+    if err := p.Authenticate(MRZPassword(&wrong)); err == nil {
+        t.Fatal("BAC with wrong MRZ succeeded")
+    }
+    if err := p.Authenticate(CANPassword(simCAN)); err == nil {
+        t.Fatal("CAN accepted without PACE")
+    }
+    if err := p.Authenticate(MRZPassword(simInfo)); err != nil { t.Fatal(err) }
+    if p.SecureMessaging().Cipher() != CIPHER_3DES {
+        t.Errorf("unexpected cipher %s", p.SecureMessaging().Cipher())
+    }
+    mrz, err := p.DG1()
+    if err != nil { t.Fatal(err) }
+    if mrz.DocumentNumber != simInfo.DocumentNumber {
+        t.Errorf("unexpected document number %s", mrz.DocumentNumber)
+    }
+    // DG2 is larger than 32767 bytes and needs READ BINARY with odd INS
+    images, err := p.FaceImages()
+    if err != nil { t.Fatal(err) }
+    if len(images) != 1 || images[0].MIMEType != "image/jpeg" ||
+        images[0].Width != 480 || images[0].Height != 640 ||
+        len(images[0].Data) != 40000 || images[0].Data[39999] != byte(39999 % 256) {
+        t.Errorf("unexpected face images")
+    }
+    details, err := p.DG11()
+    if err != nil { t.Fatal(err) }
+    if details.DateOfBirth != "19740812" || details.PlaceOfBirth != "ZENITH,UTO" {
+        t.Errorf("unexpected personal details %+v", details)
+    }
+}
+
+func TestPACE(t *testing.T) {
+    tests := []struct {
+        cipher int
+        param int
+        pw Password
+    }{
+        {2, 13, MRZPassword(simInfo)},
+        {1, 12, CANPassword(simCAN)},
+        {4, 16, MRZPassword(simInfo)},
+        {3, 15, CANPassword(simCAN)},
+    }
+    for _, test := range tests {
+        sim := newSimPassport(t, simOptions{
+            pace: protocol(OID_PACE_ECDH_GM, test.cipher),
+            paceParam: test.param})
+        p := New(sim)
+        if err := p.Authenticate(test.pw); err != nil {
+            t.Errorf("%d/%d: %s", test.cipher, test.param, err)
+            continue
+        }
+        c, _ := protocolCipher(protocol(OID_PACE_ECDH_GM, test.cipher))
+        if p.SecureMessaging().Cipher() != c {
+            t.Errorf("unexpected cipher %s", p.SecureMessaging().Cipher())
+        }
+        if _, err := p.DG1(); err != nil { t.Error(err) }
+        // Wrong password
+        p = New(sim)
+        wrong := test.pw
+        wrong.CAN = "654321"
+        wrong.MRZ = &MRZInfo{"L898902C", "740812", "120416"}
+        if err := p.Authenticate(wrong); err == nil {
+            t.Errorf("%d/%d: PACE with wrong password succeeded",
+                test.cipher, test.param)
+        }
+    }
+}
+
+func TestPassiveAuthentication(t *testing.T) {
+    sim := newSimPassport(t, simOptions{aa: "rsa", imageSize: 1000})
+    p := New(sim)
+    if err := p.Authenticate(MRZPassword(simInfo)); err != nil { t.Fatal(err) }
+    result, err := p.PassiveAuthentication([]*x509.Certificate{sim.csca})
+    if err != nil { t.Fatal(err) }
+    if result.CSCA != sim.csca || result.Signer.SerialNumber.Int64() != 2 {
+        t.Error("unexpected certificates")
+    }
+    if !intsEqual(result.Verified, []int{1, 2, 11, 15}) ||
+        !intsEqual(result.Unreadable, []int{3}) {
+        t.Errorf("unexpected result %v %v", result.Verified, result.Unreadable)
+    }
+    // Without trust anchors only the signature is checked
+    if result, err = p.PassiveAuthentication(nil); err != nil ||
+        result.CSCA != nil {
+        t.Errorf("unexpected result %v", err)
+    }
+    // Untrusted CSCA
+    if _, err := p.PassiveAuthentication([]*x509.Certificate{
+        sim.dsc}); err == nil {
+        t.Error("untrusted document signer accepted")
+    }
+    // Modified data group
+    p = New(sim)
+    sim.files[FID_DG11] = append([]byte{}, sim.files[FID_DG11]...)
+    sim.files[FID_DG11][10] ^= 1
+    if err := p.Authenticate(MRZPassword(simInfo)); err != nil { t.Fatal(err) }
+    if _, err := p.PassiveAuthentication(nil); err == nil ||
+        !strings.Contains(err.Error(), "DG11") {
+        t.Errorf("expected DG11 mismatch, got %v", err)
+    }
+    // Modified security object
+    sod, err := p.ReadFile(FID_SOD)
+    if err != nil { t.Fatal(err) }
+    sod[100] ^= 1
+    if _, err := p.PassiveAuthentication(nil); err == nil {
+        t.Error("modified EF.SOD accepted")
+    }
+}
+
+func intsEqual(a, b []int) bool {
+    if len(a) != len(b) { return false }
+    for i := range a {
+        if a[i] != b[i] { return false }
+    }
+    return true
+}
+
+func TestActiveAuthentication(t *testing.T) {
+    for _, aa := range []string{"rsa", "ec"} {
+        sim := newSimPassport(t, simOptions{aa: aa})
+        p := New(sim)
+        if err := p.Authenticate(MRZPassword(simInfo)); err != nil {
+            t.Fatal(err)
+        }
+        if err := p.ActiveAuthentication(); err != nil {
+            t.Errorf("%s: %s", aa, err)
+        }
+        // Signature with another key
+        if aa == "rsa" {
+            key := *simRSAKey
+            key.D = new(big.Int).Add(key.D, big.NewInt(2))
+            sim.aaRSA = &key
+        } else {
+            sim.aaKey = new(big.Int).Add(sim.aaKey, big.NewInt(1))
+        }
+        if err := p.ActiveAuthentication(); err == nil {
+            t.Errorf("%s: invalid signature accepted", aa)
+        }
+    }
+}
+
+func TestChipAuthentication(t *testing.T) {
+    tests := []struct {
+        cipher int
+        curve *Curve
+    }{
+        {1, BrainpoolP256r1},
+        {2, P256},
+        {4, BrainpoolP384r1},
+    }
+    for _, test := range tests {
+        sim := newSimPassport(t, simOptions{
+            ca: protocol(OID_CA_ECDH, test.cipher), caCurve: test.curve})
+        p := New(sim)
+        if err := p.Authenticate(MRZPassword(simInfo)); err != nil {
+            t.Fatal(err)
+        }
+        if err := p.ChipAuthentication(); err != nil {
+            t.Errorf("%d %s: %s", test.cipher, test.curve, err)
+            continue
+        }
+        c, _ := protocolCipher(protocol(OID_CA_ECDH, test.cipher))
+        if p.SecureMessaging().Cipher() != c {
+            t.Errorf("unexpected cipher %s", p.SecureMessaging().Cipher())
+        }
+        p.files = map[uint16][]byte{}
+        if _, err := p.DG1(); err != nil { t.Error(err) }
+    }
+}
@@ -0,0 +1,178 @@
+package emrtd
+
+import (
+    "crypto"
+    "crypto/x509"
+    "encoding/asn1"
+    "encoding/binary"
+    "fmt"
+    "github.com/sf1/go-card/smartcard/tlv"
+)
+
+// Return value of the outer data object of a file, checking its tag.
+func fileContent(data []byte, tag tlv.Tag, name string) (tlv.List, error) {
+    obj, _, err := tlv.ParseOne(data)
+    if err != nil { return nil, fmt.Errorf("invalid %s: %s", name, err) }
+    if obj.Tag != tag {
+        return nil, fmt.Errorf("invalid %s tag %s", name, obj.Tag)
+    }
+    children, err := tlv.Parse(obj.Value)
+    if err != nil { return nil, fmt.Errorf("invalid %s: %s", name, err) }
+    return children, nil
+}
+
+// Contents of EF.COM.
+type COM struct {
+    // LDS version, e.g. "0107"
+    LDSVersion string
+    // Unicode version, e.g. "040000"
+    UnicodeVersion string
+    // Tags of the data groups present (61 = DG1, 75 = DG2, ...)
+    Tags []byte
+}
+
+// Read and parse EF.COM.
+func (p *Passport) COM() (*COM, error) {
+    data, err := p.ReadFile(FID_COM)
+    if err != nil { return nil, err }
+    children, err := fileContent(data, 0x60, "EF.COM")
+    if err != nil { return nil, err }
+    return &COM{LDSVersion: string(children.Value(0x5f01)),
+        UnicodeVersion: string(children.Value(0x5f36)),
+        Tags: children.Value(0x5c)}, nil
+}
+
+// Read DG1 and parse the machine readable zone.
+func (p *Passport) DG1() (*MRZ, error) {
+    data, err := p.DataGroup(1)
+    if err != nil { return nil, err }
+    children, err := fileContent(data, 0x61, "DG1")
+    if err != nil { return nil, err }
+    mrz, ok := children.Find(0x5f1f)
+    if !ok { return nil, fmt.Errorf("MRZ missing in DG1") }
+    return ParseMRZ(string(mrz.Value))
+}
+
+// Facial image of DG2.
+type FaceImage struct {
+    // image/jpeg or image/jp2
+    MIMEType string
+    Width, Height int
+    Data []byte
+}
+
+// Extract facial images from an ISO/IEC 19794-5 facial record.
+func parseFaceRecord(data []byte) ([]FaceImage, error) {
+    const (
+        HEADER_SIZE = 14
+        INFO_SIZE = 20
+        IMAGE_INFO_SIZE = 12
+    )
+    if len(data) < HEADER_SIZE || string(data[:4]) != "FAC\x00" {
+        return nil, fmt.Errorf("invalid facial record header")
+    }
+    count := int(binary.BigEndian.Uint16(data[12:14]))
+    data = data[HEADER_SIZE:]
+    var images []FaceImage
+    for i := 0; i < count; i++ {
+        if len(data) < INFO_SIZE {
+            return nil, fmt.Errorf("truncated facial record")
+        }
+        length := int(binary.BigEndian.Uint32(data))
+        points := int(binary.BigEndian.Uint16(data[4:6]))
+        start := INFO_SIZE + 8 * points
+        if length < start + IMAGE_INFO_SIZE || length > len(data) {
+            return nil, fmt.Errorf("invalid facial record length")
+        }
+        info := data[start:start+IMAGE_INFO_SIZE]
+        image := FaceImage{MIMEType: "image/jpeg",
+            Width: int(binary.BigEndian.Uint16(info[2:4])),
+            Height: int(binary.BigEndian.Uint16(info[4:6])),
+            Data: data[start+IMAGE_INFO_SIZE:length]}
+        if info[1] == 0x01 { image.MIMEType = "image/jp2" }
+        images = append(images, image)
+        data = data[length:]
+    }
+    return images, nil
+}
+
+// Read DG2 and extract the facial images.
+func (p *Passport) FaceImages() ([]FaceImage, error) {
+    data, err := p.DataGroup(2)
+    if err != nil { return nil, err }
+    children, err := fileContent(data, 0x75, "DG2")
+    if err != nil { return nil, err }
+    group, ok := children.Find(0x7f61)
+    if !ok { return nil, fmt.Errorf("biometric group missing in DG2") }
+    templates, err := group.Children()
+    if err != nil { return nil, err }
+    var images []FaceImage
+    for _, t := range templates.FindAll(0x7f60) {
+        bit, err := t.Children()
+        if err != nil { return nil, err }
+        record, ok := bit.Find(0x5f2e)
+        if !ok { record, ok = bit.Find(0x7f2e) }
+        if !ok { return nil, fmt.Errorf("biometric data missing in DG2") }
+        faces, err := parseFaceRecord(record.Value)
+        if err != nil { return nil, err }
+        images = append(images, faces...)
+    }
+    return images, nil
+}
+
+// Additional personal details of DG11. Fields absent from the data group
+// are empty.
+type PersonalDetails struct {
+    FullName string
+    PersonalNumber string
+    // Full date of birth, YYYYMMDD
+    DateOfBirth string
+    PlaceOfBirth string
+    Address string
+    Telephone string
+    Profession string
+    Title string
+}
+
+// Read and parse DG11.
+func (p *Passport) DG11() (*PersonalDetails, error) {
+    data, err := p.DataGroup(11)
+    if err != nil { return nil, err }
+    children, err := fileContent(data, 0x6b, "DG11")
+    if err != nil { return nil, err }
+    return &PersonalDetails{
+        FullName: string(children.Value(0x5f0e)),
+        PersonalNumber: string(children.Value(0x5f10)),
+        DateOfBirth: string(children.Value(0x5f2b)),
+        PlaceOfBirth: string(children.Value(0x5f11)),
+        Address: string(children.Value(0x5f42)),
+        Telephone: string(children.Value(0x5f12)),
+        Profession: string(children.Value(0x5f13)),
+        Title: string(children.Value(0x5f14)),
+    }, nil
+}
+
+// Parse public key from SubjectPublicKeyInfo: *rsa.PublicKey or
+// *ECPublicKey. Elliptic curve keys are parsed here since they commonly
+// use explicit domain parameters, which crypto/x509 does not support.
+func parsePublicKey(der []byte) (crypto.PublicKey, error) {
+    var spki subjectPublicKeyInfo
+    if _, err := asn1.Unmarshal(der, &spki); err != nil {
+        return nil, fmt.Errorf("invalid public key: %s", err)
+    }
+    if spki.Algorithm.Algorithm.Equal(OID_EC_PUBLIC_KEY) {
+        return parseECPublicKey(&spki)
+    }
+    return x509.ParsePKIXPublicKey(der)
+}
+
+// Read DG15 and return the Active Authentication public key:
+// *rsa.PublicKey or *ECPublicKey.
+func (p *Passport) DG15() (crypto.PublicKey, error) {
+    data, err := p.DataGroup(15)
+    if err != nil { return nil, err }
+    obj, _, err := tlv.ParseOne(data)
+    if err != nil { return nil, err }
+    if obj.Tag != 0x6f { return nil, fmt.Errorf("invalid DG15 tag %s", obj.Tag) }
+    return parsePublicKey(obj.Value)
+}
@@ -0,0 +1,190 @@
+package emrtd
+
+import (
+    "crypto/sha1"
+    "fmt"
+    "strings"
+)
+
+// Compute MRZ check digit (weights 7, 3, 1; A-Z count 10-35, '<' 0).
+func CheckDigit(s string) byte {
+    weights := []int{7, 3, 1}
+    sum := 0
+    for i, c := range s {
+        v := 0
+        switch {
+            case c >= '0' && c <= '9':
+                v = int(c - '0')
+            case c >= 'A' && c <= 'Z':
+                v = int(c - 'A') + 10
+        }
+        sum += v * weights[i % 3]
+    }
+    return byte('0' + sum % 10)
+}
+
+// Document number, date of birth and date of expiry, from which the BAC
+// and PACE MRZ keys are derived. Dates have the form YYMMDD.
+type MRZInfo struct {
+    DocumentNumber string
+    DateOfBirth string
+    DateOfExpiry string
+}
+
+// Return MRZ information string (document number, date of birth and date
+// of expiry, each followed by its check digit).
+func (m *MRZInfo) String() string {
+    number := strings.ToUpper(m.DocumentNumber)
+    for len(number) < 9 {
+        number += "<"
+    }
+    s := ""
+    for _, field := range []string{number, m.DateOfBirth, m.DateOfExpiry} {
+        s += field + string(CheckDigit(field))
+    }
+    return s
+}
+
+func (m *MRZInfo) check() error {
+    if m.DocumentNumber == "" || len(m.DateOfBirth) != 6 ||
+        len(m.DateOfExpiry) != 6 {
+        return fmt.Errorf("incomplete MRZ information")
+    }
+    return nil
+}
+
+// Return BAC key seed, the first 16 bytes of SHA-1 over the MRZ
+// information.
+func (m *MRZInfo) KeySeed() []byte {
+    h := sha1.Sum([]byte(m.String()))
+    return h[:16]
+}
+
+// Machine readable zone as stored in DG1.
+type MRZ struct {
+    // TD1, TD2 or TD3
+    Format string
+    DocumentCode string
+    IssuingState string
+    Surname string
+    GivenNames string
+    DocumentNumber string
+    Nationality string
+    DateOfBirth string
+    Sex string
+    DateOfExpiry string
+    OptionalData string
+    OptionalData2 string
+    // Raw MRZ without line breaks
+    Raw string
+}
+
+// Return MRZ information for access control.
+func (m *MRZ) Info() *MRZInfo {
+    return &MRZInfo{DocumentNumber: m.DocumentNumber,
+        DateOfBirth: m.DateOfBirth, DateOfExpiry: m.DateOfExpiry}
+}
+
+func mrzField(s string) string {
+    return strings.TrimRight(s, "<")
+}
+
+func mrzName(s string) (string, string) {
+    parts := strings.SplitN(mrzField(s), "<<", 2)
+    surname := strings.Replace(parts[0], "<", " ", -1)
+    given := ""
+    if len(parts) > 1 {
+        given = strings.Replace(mrzField(parts[1]), "<", " ", -1)
+    }
+    return surname, given
+}
+
+func checkField(name, value string, digit byte) error {
+    if CheckDigit(value) != digit {
+        return fmt.Errorf("MRZ check digit mismatch for %s", name)
+    }
+    return nil
+}
+
+// Parse machine readable zone of 90 (TD1), 72 (TD2) or 88 (TD3)
+// characters. Line breaks are ignored. Check digits of document number,
+// dates and the composite check digit are verified.
+func ParseMRZ(s string) (*MRZ, error) {
+    s = strings.Replace(strings.Replace(s, "\n", "", -1), "\r", "", -1)
+    m := &MRZ{Raw: s}
+    var err error
+    switch len(s) {
+        case 90:
+            l1, l2, l3 := s[0:30], s[30:60], s[60:90]
+            m.Format = "TD1"
+            m.DocumentCode = mrzField(l1[0:2])
+            m.IssuingState = mrzField(l1[2:5])
+            number, digit, optional := l1[5:14], l1[14], l1[15:30]
+            if digit == '<' {
+                // Long document number continues in the optional data
+                end := strings.IndexByte(optional, '<')
+                if end < 1 { end = len(optional) }
+                number += optional[:end-1]
+                digit = optional[end-1]
+                optional = optional[end:]
+            }
+            m.DocumentNumber = mrzField(number)
+            m.OptionalData = mrzField(optional)
+            m.DateOfBirth = l2[0:6]
+            m.Sex = l2[7:8]
+            m.DateOfExpiry = l2[8:14]
+            m.Nationality = mrzField(l2[15:18])
+            m.OptionalData2 = mrzField(l2[18:29])
+            m.Surname, m.GivenNames = mrzName(l3)
+            if err = checkField("document number", number, digit); err != nil {
+                return nil, err
+            }
+            if err = checkField("date of birth", l2[0:6], l2[6]); err != nil {
+                return nil, err
+            }
+            if err = checkField("date of expiry", l2[8:14], l2[14]); err != nil {
+                return nil, err
+            }
+            err = checkField("composite", l1[5:30] + l2[0:7] + l2[8:15] +
+                l2[18:29], l2[29])
+        case 72, 88:
+            n := len(s) / 2
+            l1, l2 := s[:n], s[n:]
+            m.Format = "TD3"
+            if n == 36 { m.Format = "TD2" }
+            m.DocumentCode = mrzField(l1[0:2])
+            m.IssuingState = mrzField(l1[2:5])
+            m.Surname, m.GivenNames = mrzName(l1[5:])
+            m.DocumentNumber = mrzField(l2[0:9])
+            m.Nationality = mrzField(l2[10:13])
+            m.DateOfBirth = l2[13:19]
+            m.Sex = l2[20:21]
+            m.DateOfExpiry = l2[21:27]
+            if err = checkField("document number", l2[0:9], l2[9]); err != nil {
+                return nil, err
+            }
+            if err = checkField("date of birth", l2[13:19], l2[19]); err != nil {
+                return nil, err
+            }
+            if err = checkField("date of expiry", l2[21:27], l2[27]); err != nil {
+                return nil, err
+            }
+            if n == 44 {
+                m.OptionalData = mrzField(l2[28:42])
+                if l2[42] != '<' || mrzField(l2[28:42]) != "" {
+                    err = checkField("optional data", l2[28:42], l2[42])
+                    if err != nil { return nil, err }
+                }
+                err = checkField("composite", l2[0:10] + l2[13:20] +
+                    l2[21:43], l2[43])
+            } else {
+                m.OptionalData = mrzField(l2[28:35])
+                err = checkField("composite", l2[0:10] + l2[13:20] +
+                    l2[21:35], l2[35])
+            }
+        default:
+            return nil, fmt.Errorf("invalid MRZ length: %d", len(s))
+    }
+    if err != nil { return nil, err }
+    return m, nil
+}
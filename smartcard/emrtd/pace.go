@@ -0,0 +1,204 @@
+package emrtd
+
+import (
+    "bytes"
+    "encoding/asn1"
+    "fmt"
+    "math/big"
+    "github.com/sf1/go-card/smartcard"
+    "github.com/sf1/go-card/smartcard/SW"
+    "github.com/sf1/go-card/smartcard/tlv"
+)
+
+// Return content bytes of the DER encoding of oid.
+func oidBytes(oid asn1.ObjectIdentifier) []byte {
+    der, _ := asn1.Marshal(oid)
+    return der[2:]
+}
+
+// Error returned by PACE with PIN or PUK if the password is wrong or
+// blocked.
+type PINError struct {
+    // Remaining attempts, 0 if blocked, -1 if unknown
+    Retries int
+}
+
+func (e *PINError) Error() string {
+    switch {
+        case e.Retries == 0:
+            return "password blocked"
+        case e.Retries < 0:
+            return "wrong password"
+    }
+    return fmt.Sprintf("wrong password, %d tries left", e.Retries)
+}
+
+// Send GENERAL AUTHENTICATE with dynamic authentication data containing
+// data object do and return the response data objects. All but the last
+// command of a protocol are sent with command chaining.
+func (p *Passport) generalAuthenticateData(do []byte, last bool) (tlv.List,
+    error) {
+    var cla byte = 0x10
+    if last { cla = 0x00 }
+    data, err := p.transmit(smartcard.Command4(cla, INS_GENERAL_AUTHENTICATE,
+        0x00, 0x00, tlv.Encode(0x7c, do), 0x00))
+    if err != nil { return nil, err }
+    if len(data) == 0 { return nil, nil }
+    obj, _, err := tlv.ParseOne(data)
+    if err != nil { return nil, err }
+    if obj.Tag != 0x7c {
+        return nil, fmt.Errorf("invalid dynamic authentication data")
+    }
+    return tlv.Parse(obj.Value)
+}
+
+// Send GENERAL AUTHENTICATE and return the value of response data object
+// rspTag.
+func (p *Passport) generalAuthenticate(do []byte, rspTag tlv.Tag,
+    last bool) ([]byte, error) {
+    children, err := p.generalAuthenticateData(do, last)
+    if err != nil || rspTag == 0 { return nil, err }
+    value, ok := children.Find(rspTag)
+    if !ok { return nil, fmt.Errorf("data object %s missing", rspTag) }
+    return value.Value, nil
+}
+
+// Compute PACE authentication token over the other party's ephemeral
+// public key.
+func paceToken(c Cipher, kmac []byte, oid asn1.ObjectIdentifier,
+    key []byte) ([]byte, error) {
+    der, _ := asn1.Marshal(oid)
+    data := tlv.Encode(0x7f49, append(der, tlv.Encode(0x86, key)...))
+    if c == CIPHER_3DES { data = pad(data, 8) }
+    return mac(c, kmac, data)
+}
+
+// Return PACE protocol and domain parameters to use from EF.CardAccess.
+func selectPACE(infos *SecurityInfos) (*PACEInfo, *Curve, error) {
+    for i := range infos.PACE {
+        info := &infos.PACE[i]
+        if !oidUnder(info.Protocol, OID_PACE_ECDH_GM) { continue }
+        if _, err := info.Cipher(); err != nil { continue }
+        if c, ok := Curves[info.ParameterID]; ok { return info, c, nil }
+        for _, dp := range infos.PACEDomainParameters {
+            if dp.ParameterID == info.ParameterID ||
+                len(infos.PACEDomainParameters) == 1 {
+                return info, dp.Curve, nil
+            }
+        }
+    }
+    return nil, nil, fmt.Errorf("no supported PACE protocol (ECDH generic " +
+        "mapping required)")
+}
+
+// Perform PACE with generic mapping over elliptic curves (ICAO 9303-11,
+// 4.4) and start secure messaging. PACE runs in the master file, the
+// eMRTD application is selected afterwards.
+func (p *Passport) PACE(pw Password) error {
+    _, err := p.PACEWithCHAT(pw, nil)
+    return err
+}
+
+// Perform PACE requesting the access rights of chat for a subsequent
+// Terminal Authentication (BSI TR-03110-3, B.1). Returns the references of
+// the CVCA keys trusted by the chip, most recent first. A wrong or blocked
+// PIN or PUK is reported as *PINError.
+func (p *Passport) PACEWithCHAT(pw Password, chat *CHAT) ([]string, error) {
+    infos, err := p.CardAccess()
+    if err != nil { return nil, fmt.Errorf("reading EF.CardAccess: %s", err) }
+    info, curve, err := selectPACE(infos)
+    if err != nil { return nil, err }
+    c, _ := info.Cipher()
+    secret, err := pw.bytes()
+    if err != nil { return nil, err }
+    p.sm, p.cars, p.idPICC, p.caKey = nil, nil, nil, nil
+    // MSE:Set AT
+    at := tlv.Encode(0x80, oidBytes(info.Protocol))
+    at = append(at, tlv.Encode(0x83, []byte{pw.Type})...)
+    if info.ParameterID >= 0 {
+        at = append(at, tlv.Encode(0x84, []byte{byte(info.ParameterID)})...)
+    }
+    if chat != nil { at = append(at, chat.Bytes()...) }
+    pin := pw.Type == PASSWORD_PIN || pw.Type == PASSWORD_PUK
+    mse, err := p.card.TransmitAPDU(smartcard.Command3(0x00, INS_MSE, 0xc1,
+        0xa4, at))
+    if err != nil { return nil, fmt.Errorf("PACE MSE:Set AT: %s", err) }
+    // A PIN whose retry counter was decreased is announced with 63Cx
+    retries := -1
+    switch sw := mse.SW(); {
+        case sw == SW.SUCCESS:
+        case pin && sw & 0xfff0 == SW.AUTH_FAILED:
+            retries = int(sw & 0x0f)
+        case pin && sw == SW.AUTH_METHOD_BLOCKED:
+            return nil, &PINError{Retries: 0}
+        default:
+            return nil, fmt.Errorf("PACE MSE:Set AT: %s", smartcard.SWError(sw))
+    }
+    // Encrypted nonce
+    z, err := p.generalAuthenticate(nil, 0x80, false)
+    if err != nil { return nil, fmt.Errorf("PACE nonce: %s", err) }
+    block, err := newBlock(c, KDF(secret, KDF_PI, c))
+    if err != nil { return nil, err }
+    s, err := decryptCBC(block, make([]byte, c.BlockSize()), z)
+    if err != nil { return nil, fmt.Errorf("PACE nonce: %s", err) }
+    // Generic mapping: G' = s*G + H
+    d, x, y, err := curve.generateKey(p.randReader(), curve.Gx, curve.Gy)
+    if err != nil { return nil, err }
+    rsp, err := p.generalAuthenticate(tlv.Encode(0x81, curve.Marshal(x, y)),
+        0x82, false)
+    if err != nil { return nil, fmt.Errorf("PACE mapping: %s", err) }
+    hx, hy, err := curve.Unmarshal(rsp)
+    if err != nil { return nil, fmt.Errorf("PACE mapping: %s", err) }
+    hx, hy = curve.ScalarMult(hx, hy, d)
+    sx, sy := curve.ScalarMult(curve.Gx, curve.Gy, new(big.Int).SetBytes(s))
+    gx, gy := curve.Add(sx, sy, hx, hy)
+    if gx == nil { return nil, fmt.Errorf("PACE mapping: invalid generator") }
+    // Key agreement with ephemeral keys on the mapped generator
+    d, x, y, err = curve.generateKey(p.randReader(), gx, gy)
+    if err != nil { return nil, err }
+    pcdKey := curve.Marshal(x, y)
+    piccKey, err := p.generalAuthenticate(tlv.Encode(0x83, pcdKey), 0x84,
+        false)
+    if err != nil { return nil, fmt.Errorf("PACE key agreement: %s", err) }
+    if bytes.Equal(piccKey, pcdKey) {
+        return nil, fmt.Errorf("PACE key agreement: identical ephemeral keys")
+    }
+    ex, ey, err := curve.Unmarshal(piccKey)
+    if err != nil { return nil, fmt.Errorf("PACE key agreement: %s", err) }
+    kx, _ := curve.ScalarMult(ex, ey, d)
+    if kx == nil { return nil, fmt.Errorf("PACE key agreement: invalid key") }
+    k := make([]byte, curve.ByteSize())
+    kx.FillBytes(k)
+    ksEnc, ksMac := KDF(k, KDF_ENC, c), KDF(k, KDF_MAC, c)
+    // Mutual authentication
+    token, err := paceToken(c, ksMac, info.Protocol, piccKey)
+    if err != nil { return nil, err }
+    objs, err := p.generalAuthenticateData(tlv.Encode(0x85, token), true)
+    if e, ok := err.(smartcard.SWError); ok && pin &&
+        (uint16(e) == 0x6300 || uint16(e) & 0xfff0 == SW.AUTH_FAILED) {
+        switch {
+            case uint16(e) != 0x6300:
+                retries = int(e & 0x0f)
+            case retries > 0:
+                retries--
+        }
+        return nil, &PINError{Retries: retries}
+    }
+    if err != nil { return nil, fmt.Errorf("PACE authentication failed: %s", err) }
+    expected, err := paceToken(c, ksMac, info.Protocol, pcdKey)
+    if err != nil { return nil, err }
+    if !bytes.Equal(objs.Value(0x86), expected) {
+        return nil, fmt.Errorf("PACE authentication token mismatch")
+    }
+    p.sm, err = NewSecureMessaging(p.card, c, ksEnc, ksMac,
+        make([]byte, c.BlockSize()))
+    if err != nil { return nil, err }
+    for _, tag := range []tlv.Tag{0x87, 0x88} {
+        if car := objs.Value(tag); car != nil {
+            p.cars = append(p.cars, string(car))
+        }
+    }
+    // Compressed ephemeral key: the x coordinate
+    p.idPICC = piccKey[1:1+curve.ByteSize()]
+    return p.cars, nil
+}
@@ -0,0 +1,377 @@
+package emrtd
+
+import (
+    "crypto"
+    "crypto/x509"
+    "encoding/asn1"
+    "fmt"
+    "github.com/sf1/go-card/smartcard/tlv"
+)
+
+// Protocol object identifiers (BSI TR-03110-3, ICAO 9303-11).
+var (
+    OID_PACE = asn1.ObjectIdentifier{0, 4, 0, 127, 0, 7, 2, 2, 4}
+    OID_PACE_ECDH_GM = asn1.ObjectIdentifier{0, 4, 0, 127, 0, 7, 2, 2, 4, 2}
+    OID_CA = asn1.ObjectIdentifier{0, 4, 0, 127, 0, 7, 2, 2, 3}
+    OID_CA_ECDH = asn1.ObjectIdentifier{0, 4, 0, 127, 0, 7, 2, 2, 3, 2}
+    OID_PK = asn1.ObjectIdentifier{0, 4, 0, 127, 0, 7, 2, 2, 1}
+    OID_PK_ECDH = asn1.ObjectIdentifier{0, 4, 0, 127, 0, 7, 2, 2, 1, 2}
+    OID_TA = asn1.ObjectIdentifier{0, 4, 0, 127, 0, 7, 2, 2, 2}
+    OID_TA_ECDSA = asn1.ObjectIdentifier{0, 4, 0, 127, 0, 7, 2, 2, 2, 2}
+    OID_TA_ECDSA_SHA_1 = asn1.ObjectIdentifier{0, 4, 0, 127, 0, 7, 2, 2, 2, 2, 1}
+    OID_TA_ECDSA_SHA_224 = asn1.ObjectIdentifier{0, 4, 0, 127, 0, 7, 2, 2, 2, 2, 2}
+    OID_TA_ECDSA_SHA_256 = asn1.ObjectIdentifier{0, 4, 0, 127, 0, 7, 2, 2, 2, 2, 3}
+    OID_TA_ECDSA_SHA_384 = asn1.ObjectIdentifier{0, 4, 0, 127, 0, 7, 2, 2, 2, 2, 4}
+    OID_TA_ECDSA_SHA_512 = asn1.ObjectIdentifier{0, 4, 0, 127, 0, 7, 2, 2, 2, 2, 5}
+    OID_RI = asn1.ObjectIdentifier{0, 4, 0, 127, 0, 7, 2, 2, 5}
+    OID_RI_ECDH = asn1.ObjectIdentifier{0, 4, 0, 127, 0, 7, 2, 2, 5, 2}
+    OID_RI_ECDH_SHA_256 = asn1.ObjectIdentifier{0, 4, 0, 127, 0, 7, 2, 2, 5, 2, 3}
+    OID_AA = asn1.ObjectIdentifier{2, 23, 136, 1, 1, 5}
+    OID_ECDSA_PLAIN = asn1.ObjectIdentifier{0, 4, 0, 127, 0, 7, 1, 1, 4, 1}
+    OID_EC_PUBLIC_KEY = asn1.ObjectIdentifier{1, 2, 840, 10045, 2, 1}
+    OID_STANDARDIZED_DOMAIN_PARAMETERS = asn1.ObjectIdentifier{0, 4, 0, 127, 0,
+        7, 1, 2}
+)
+
+// PACE protocol supported by the chip.
+type PACEInfo struct {
+    Protocol asn1.ObjectIdentifier
+    Version int
+    // Standardized domain parameters (see Curves), or -1
+    ParameterID int
+}
+
+// Return cipher of the protocol.
+func (i PACEInfo) Cipher() (Cipher, error) {
+    return protocolCipher(i.Protocol)
+}
+
+// Proprietary PACE domain parameters.
+type PACEDomainParameterInfo struct {
+    Protocol asn1.ObjectIdentifier
+    Curve *Curve
+    ParameterID int
+}
+
+// Chip Authentication protocol supported by the chip.
+type ChipAuthenticationInfo struct {
+    Protocol asn1.ObjectIdentifier
+    Version int
+    KeyID int
+}
+
+// Return cipher of the protocol.
+func (i ChipAuthenticationInfo) Cipher() (Cipher, error) {
+    return protocolCipher(i.Protocol)
+}
+
+// Domain parameters of Chip Authentication version 2, from which the
+// terminal's ephemeral key is generated in Terminal Authentication.
+type ChipAuthenticationDomainParameterInfo struct {
+    Protocol asn1.ObjectIdentifier
+    Curve *Curve
+    // Key identifier, or -1
+    KeyID int
+}
+
+// Static Chip Authentication key of the chip.
+type ChipAuthenticationPublicKeyInfo struct {
+    Protocol asn1.ObjectIdentifier
+    // *ECPublicKey for ECDH, nil for unsupported key types
+    PublicKey *ECPublicKey
+    // Key identifier, or -1
+    KeyID int
+}
+
+// Restricted Identification key of the chip.
+type RestrictedIdentificationInfo struct {
+    Protocol asn1.ObjectIdentifier
+    Version int
+    KeyID int
+    // Key usable only by terminals with the Restricted Identification right
+    AuthorizedOnly bool
+}
+
+// Active Authentication parameters of the chip.
+type ActiveAuthenticationInfo struct {
+    Version int
+    SignatureAlgorithm asn1.ObjectIdentifier
+}
+
+// Security infos of EF.CardAccess, EF.CardSecurity or DG14. Entries of
+// unknown or unsupported protocols are ignored.
+type SecurityInfos struct {
+    PACE []PACEInfo
+    PACEDomainParameters []PACEDomainParameterInfo
+    ChipAuthentication []ChipAuthenticationInfo
+    ChipAuthenticationDomainParameters []ChipAuthenticationDomainParameterInfo
+    ChipAuthenticationPublicKeys []ChipAuthenticationPublicKeyInfo
+    RestrictedIdentification []RestrictedIdentificationInfo
+    ActiveAuthentication *ActiveAuthenticationInfo
+}
+
+type securityInfo struct {
+    Protocol asn1.ObjectIdentifier
+    Required asn1.RawValue
+    Optional asn1.RawValue `asn1:"optional"`
+}
+
+type subjectPublicKeyInfo struct {
+    Algorithm struct {
+        Algorithm asn1.ObjectIdentifier
+        Parameters asn1.RawValue `asn1:"optional"`
+    }
+    PublicKey asn1.BitString
+}
+
+type algorithmIdentifier struct {
+    Algorithm asn1.ObjectIdentifier
+    Parameters asn1.RawValue `asn1:"optional"`
+}
+
+type restrictedIdentificationParameters struct {
+    Version int
+    KeyID int
+    AuthorizedOnly bool
+}
+
+// Return cipher from the last arc of a PACE or CA protocol identifier.
+func protocolCipher(oid asn1.ObjectIdentifier) (Cipher, error) {
+    if len(oid) == 11 {
+        switch oid[10] {
+            case 1:
+                return CIPHER_3DES, nil
+            case 2:
+                return CIPHER_AES128, nil
+            case 3:
+                return CIPHER_AES192, nil
+            case 4:
+                return CIPHER_AES256, nil
+        }
+    }
+    return 0, fmt.Errorf("unsupported protocol %s", oid)
+}
+
+// Return hash function from the last arc of a TA or RI protocol
+// identifier.
+func protocolHash(oid asn1.ObjectIdentifier) (crypto.Hash, error) {
+    hashes := []crypto.Hash{crypto.SHA1, crypto.SHA224, crypto.SHA256,
+        crypto.SHA384, crypto.SHA512}
+    if len(oid) == 11 && oid[10] >= 1 && oid[10] <= len(hashes) {
+        if h := hashes[oid[10]-1]; h.Available() { return h, nil }
+    }
+    return 0, fmt.Errorf("unsupported protocol %s", oid)
+}
+
+// Return hash function of a Terminal Authentication protocol.
+func taHash(oid asn1.ObjectIdentifier) (crypto.Hash, error) {
+    if !oidUnder(oid, OID_TA_ECDSA) {
+        return 0, fmt.Errorf("unsupported signature algorithm %s", oid)
+    }
+    return protocolHash(oid)
+}
+
+// Check whether oid is below prefix.
+func oidUnder(oid, prefix asn1.ObjectIdentifier) bool {
+    return len(oid) > len(prefix) && oid[:len(prefix)].Equal(prefix)
+}
+
+func asn1Int(raw asn1.RawValue, def int) (int, error) {
+    if raw.FullBytes == nil { return def, nil }
+    var v int
+    if _, err := asn1.Unmarshal(raw.FullBytes, &v); err != nil { return 0, err }
+    return v, nil
+}
+
+// Parse elliptic curve public key from SubjectPublicKeyInfo.
+func parseECPublicKey(spki *subjectPublicKeyInfo) (*ECPublicKey, error) {
+    curve, err := parseCurve(spki.Algorithm.Parameters)
+    if err != nil { return nil, err }
+    x, y, err := curve.Unmarshal(spki.PublicKey.RightAlign())
+    if err != nil { return nil, err }
+    return &ECPublicKey{Curve: curve, X: x, Y: y}, nil
+}
+
+// Parse domain parameters of PACE or Chip Authentication: standardized
+// domain parameters (see Curves) or explicit EC parameters.
+func parseDomainParameters(alg *algorithmIdentifier) (*Curve, error) {
+    if alg.Algorithm.Equal(OID_STANDARDIZED_DOMAIN_PARAMETERS) {
+        id, err := asn1Int(alg.Parameters, -1)
+        if err != nil { return nil, err }
+        if c, ok := Curves[id]; ok { return c, nil }
+        return nil, fmt.Errorf("unsupported domain parameters %d", id)
+    }
+    if !alg.Algorithm.Equal(OID_EC_PUBLIC_KEY) {
+        return nil, fmt.Errorf("unsupported domain parameters %s",
+            alg.Algorithm)
+    }
+    return parseCurve(alg.Parameters)
+}
+
+// Parse SecurityInfos (DER SET OF SecurityInfo).
+func ParseSecurityInfos(data []byte) (*SecurityInfos, error) {
+    var raw []asn1.RawValue
+    if _, err := asn1.UnmarshalWithParams(data, &raw, "set"); err != nil {
+        return nil, fmt.Errorf("invalid SecurityInfos: %s", err)
+    }
+    infos := &SecurityInfos{}
+    for _, r := range raw {
+        var si securityInfo
+        if _, err := asn1.Unmarshal(r.FullBytes, &si); err != nil {
+            return nil, fmt.Errorf("invalid SecurityInfo: %s", err)
+        }
+        var err error
+        switch {
+            case oidUnder(si.Protocol, OID_PACE) && len(si.Protocol) == 11:
+                info := PACEInfo{Protocol: si.Protocol}
+                if info.Version, err = asn1Int(si.Required, 0); err != nil {
+                    break
+                }
+                info.ParameterID, err = asn1Int(si.Optional, -1)
+                infos.PACE = append(infos.PACE, info)
+            case oidUnder(si.Protocol, OID_PACE):
+                info := PACEDomainParameterInfo{Protocol: si.Protocol}
+                var alg algorithmIdentifier
+                if _, err = asn1.Unmarshal(si.Required.FullBytes,
+                    &alg); err != nil {
+                    break
+                }
+                if info.ParameterID, err = asn1Int(si.Optional,
+                    -1); err != nil {
+                    break
+                }
+                // Only ECDH domain parameters are supported
+                if info.Curve, err = parseDomainParameters(&alg); err != nil {
+                    err = nil
+                    break
+                }
+                infos.PACEDomainParameters = append(
+                    infos.PACEDomainParameters, info)
+            case oidUnder(si.Protocol, OID_CA) && len(si.Protocol) == 11:
+                info := ChipAuthenticationInfo{Protocol: si.Protocol}
+                if info.Version, err = asn1Int(si.Required, 0); err != nil {
+                    break
+                }
+                info.KeyID, err = asn1Int(si.Optional, -1)
+                infos.ChipAuthentication = append(infos.ChipAuthentication,
+                    info)
+            case oidUnder(si.Protocol, OID_CA):
+                info := ChipAuthenticationDomainParameterInfo{
+                    Protocol: si.Protocol}
+                var alg algorithmIdentifier
+                if _, err = asn1.Unmarshal(si.Required.FullBytes,
+                    &alg); err != nil {
+                    break
+                }
+                if info.KeyID, err = asn1Int(si.Optional, -1); err != nil {
+                    break
+                }
+                if info.Curve, err = parseDomainParameters(&alg); err != nil {
+                    err = nil
+                    break
+                }
+                infos.ChipAuthenticationDomainParameters = append(
+                    infos.ChipAuthenticationDomainParameters, info)
+            case oidUnder(si.Protocol, OID_PK):
+                info := ChipAuthenticationPublicKeyInfo{Protocol: si.Protocol}
+                var spki subjectPublicKeyInfo
+                if _, err = asn1.Unmarshal(si.Required.FullBytes,
+                    &spki); err != nil {
+                    break
+                }
+                if info.KeyID, err = asn1Int(si.Optional, -1); err != nil {
+                    break
+                }
+                if si.Protocol.Equal(OID_PK_ECDH) {
+                    if info.PublicKey, err = parseECPublicKey(
+                        &spki); err != nil {
+                        break
+                    }
+                }
+                infos.ChipAuthenticationPublicKeys = append(
+                    infos.ChipAuthenticationPublicKeys, info)
+            case oidUnder(si.Protocol, OID_RI) && len(si.Protocol) == 11:
+                // Restricted Identification domain parameters are ignored
+                var params restrictedIdentificationParameters
+                if _, err = asn1.Unmarshal(si.Required.FullBytes,
+                    &params); err != nil {
+                    break
+                }
+                infos.RestrictedIdentification = append(
+                    infos.RestrictedIdentification,
+                    RestrictedIdentificationInfo{Protocol: si.Protocol,
+                        Version: params.Version, KeyID: params.KeyID,
+                        AuthorizedOnly: params.AuthorizedOnly})
+            case si.Protocol.Equal(OID_AA):
+                info := &ActiveAuthenticationInfo{}
+                if info.Version, err = asn1Int(si.Required, 0); err != nil {
+                    break
+                }
+                if si.Optional.FullBytes != nil {
+                    _, err = asn1.Unmarshal(si.Optional.FullBytes,
+                        &info.SignatureAlgorithm)
+                }
+                infos.ActiveAuthentication = info
+        }
+        if err != nil {
+            return nil, fmt.Errorf("invalid SecurityInfo %s: %s", si.Protocol,
+                err)
+        }
+    }
+    return infos, nil
+}
+
+// Read and parse EF.CardAccess, which lists the PACE protocols of the
+// chip. It is read from the master file, before any access control.
+func (p *Passport) CardAccess() (*SecurityInfos, error) {
+    data, err := p.ReadFile(FID_CARD_ACCESS)
+    if err != nil { return nil, err }
+    return ParseSecurityInfos(data)
+}
+
+// Read and parse DG14, the security infos for Chip Authentication and
+// Active Authentication.
+func (p *Passport) DG14() (*SecurityInfos, error) {
+    data, err := p.DataGroup(14)
+    if err != nil { return nil, err }
+    obj, _, err := tlv.ParseOne(data)
+    if err != nil { return nil, err }
+    if obj.Tag != 0x6e { return nil, fmt.Errorf("invalid DG14 tag %s", obj.Tag) }
+    return ParseSecurityInfos(obj.Value)
+}
+
+var oidSecurityObject = asn1.ObjectIdentifier{0, 4, 0, 127, 0, 7, 3, 2, 1}
+
+// EF.CardSecurity: security infos of the chip, including the static
+// Chip Authentication keys, signed by the document signer.
+type CardSecurity struct {
+    *SecurityInfos
+    signedContent
+}
+
+// Parse EF.CardSecurity.
+func ParseCardSecurity(data []byte) (*CardSecurity, error) {
+    sc, err := parseSignedContent(data, oidSecurityObject)
+    if err != nil { return nil, fmt.Errorf("invalid EF.CardSecurity: %s", err) }
+    infos, err := ParseSecurityInfos(sc.content)
+    if err != nil { return nil, err }
+    return &CardSecurity{SecurityInfos: infos, signedContent: *sc}, nil
+}
+
+// Verify signature of EF.CardSecurity like that of EF.SOD (see
+// SOD.Verify).
+func (c *CardSecurity) Verify(cscas []*x509.Certificate) (dsc,
+    csca *x509.Certificate, err error) {
+    dsc, csca, err = c.verify(cscas)
+    if err != nil { return nil, nil, fmt.Errorf("EF.CardSecurity: %s", err) }
+    return dsc, csca, nil
+}
+
+// Read and parse EF.CardSecurity, which is readable after Terminal
+// Authentication. Like EF.CardAccess it is read from the master file,
+// i.e. before selecting an application.
+func (p *Passport) CardSecurity() (*CardSecurity, error) {
+    data, err := p.ReadFile(FID_CARD_SECURITY)
+    if err != nil { return nil, err }
+    return ParseCardSecurity(data)
+}
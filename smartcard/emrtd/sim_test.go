@@ -0,0 +1,1098 @@
+package emrtd
+
+import (
+    "bytes"
+    "crypto"
+    "crypto/ecdsa"
+    "crypto/elliptic"
+    "crypto/rand"
+    "crypto/rsa"
+    "crypto/sha1"
+    "crypto/sha256"
+    "crypto/x509"
+    "crypto/x509/pkix"
+    "encoding/asn1"
+    "fmt"
+    "io"
+    "math/big"
+    "testing"
+    "time"
+    "github.com/sf1/go-card/smartcard"
+    "github.com/sf1/go-card/smartcard/mock"
+    "github.com/sf1/go-card/smartcard/tlv"
+)
+
+// Deterministic source of randomness.
+type detRand struct {
+    state [32]byte
+    buf []byte
+}
+
+func newDetRand(seed string) *detRand {
+    return &detRand{state: sha256.Sum256([]byte(seed))}
+}
+
+func (r *detRand) Read(p []byte) (int, error) {
+    for i := range p {
+        if len(r.buf) == 0 {
+            r.state = sha256.Sum256(r.state[:])
+            r.buf = r.state[:]
+        }
+        p[i] = r.buf[0]
+        r.buf = r.buf[1:]
+    }
+    return len(p), nil
+}
+
+const simMRZ = "P<UTOERIKSSON<<ANNA<MARIA<<<<<<<<<<<<<<<<<<<" +
+    "L898902C<3UTO7408122F1204159ZE184226B<<<<<16"
+
+var simInfo = &MRZInfo{DocumentNumber: "L898902C", DateOfBirth: "740812",
+    DateOfExpiry: "120415"}
+
+const simCAN = "123456"
+
+// Return protocol identifier below prefix.
+func protocol(prefix asn1.ObjectIdentifier, n int) asn1.ObjectIdentifier {
+    return append(append(asn1.ObjectIdentifier{}, prefix...), n)
+}
+
+// Options of the simulated document.
+type simOptions struct {
+    // PACE protocol and parameter ID; no EF.CardAccess if nil
+    pace asn1.ObjectIdentifier
+    paceParam int
+    // Chip Authentication protocol; no CA if nil
+    ca asn1.ObjectIdentifier
+    caCurve *Curve
+    // Active Authentication key: "rsa", "ec" or none
+    aa string
+    // Size of the facial image
+    imageSize int
+    // Extended Access Control: PIN, Terminal Authentication, Chip
+    // Authentication version 2 with the CA key, Restricted Identification
+    // and the eID application
+    eac bool
+}
+
+// Simulated eMRTD chip with BAC, PACE, secure messaging, Active and Chip
+// Authentication and EAC: a mock card with a rule per instruction working
+// on the chip state.
+type simPassport struct {
+    *mock.Card
+    t *testing.T
+    rand io.Reader
+    cardAccess []byte
+    files map[uint16][]byte
+    // Files requiring terminal authentication
+    denied map[uint16]bool
+    app bool
+    selected []byte
+    sm, next *SecureMessaging
+    rndIC []byte
+    pace *simPACE
+    aaRSA *rsa.PrivateKey
+    aaCurve *Curve
+    aaKey *big.Int
+    caProtocol asn1.ObjectIdentifier
+    caCurve *Curve
+    caKey *big.Int
+    caCipher *Cipher
+    // CSCA certificate and DSC key, for resigning EF.SOD
+    csca *x509.Certificate
+    dsc *x509.Certificate
+    dscKey *ecdsa.PrivateKey
+    // EAC
+    pin string
+    pinRetries int
+    cardSecurity []byte
+    eid bool
+    eidFiles map[uint16][]byte
+    cvca *CVCertificate
+    // Imported certificates by CHR
+    certs map[string]*CVCertificate
+    dst *CVCertificate
+    chained []byte
+    chat *CHAT
+    idPICC []byte
+    ta *simTA
+    // Effective access rights after TA
+    rights *CHAT
+    riKey *big.Int
+    riPending bool
+}
+
+// Terminal Authentication state.
+type simTA struct {
+    cert *CVCertificate
+    comp []byte
+    aux []byte
+    done bool
+}
+
+type simPACE struct {
+    protocol asn1.ObjectIdentifier
+    cipher Cipher
+    curve *Curve
+    password []byte
+    nonce []byte
+    key *big.Int
+    gx, gy *big.Int
+    kenc, kmac []byte
+    pcdKey, piccKey []byte
+    pin bool
+    chat *CHAT
+}
+
+var (
+    simRSAKey *rsa.PrivateKey
+    simPKI struct {
+        csca *x509.Certificate
+        dsc *x509.Certificate
+        dscKey *ecdsa.PrivateKey
+    }
+)
+
+func simKeys(t *testing.T) {
+    if simRSAKey != nil { return }
+    var err error
+    if simRSAKey, err = rsa.GenerateKey(rand.Reader, 1024); err != nil {
+        t.Fatal(err)
+    }
+    cscaKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+    if err != nil { t.Fatal(err) }
+    template := &x509.Certificate{SerialNumber: big.NewInt(1),
+        Subject: pkix.Name{Country: []string{"UT"}, CommonName: "CSCA Utopia"},
+        NotBefore: time.Now().Add(-time.Hour),
+        NotAfter: time.Now().Add(time.Hour),
+        IsCA: true, BasicConstraintsValid: true,
+        KeyUsage: x509.KeyUsageCertSign}
+    der, err := x509.CreateCertificate(rand.Reader, template, template,
+        &cscaKey.PublicKey, cscaKey)
+    if err != nil { t.Fatal(err) }
+    if simPKI.csca, err = x509.ParseCertificate(der); err != nil { t.Fatal(err) }
+    if simPKI.dscKey, err = ecdsa.GenerateKey(elliptic.P256(),
+        rand.Reader); err != nil {
+        t.Fatal(err)
+    }
+    template = &x509.Certificate{SerialNumber: big.NewInt(2),
+        Subject: pkix.Name{Country: []string{"UT"}, CommonName: "DS Utopia"},
+        NotBefore: time.Now().Add(-time.Hour),
+        NotAfter: time.Now().Add(time.Hour),
+        KeyUsage: x509.KeyUsageDigitalSignature}
+    der, err = x509.CreateCertificate(rand.Reader, template, simPKI.csca,
+        &simPKI.dscKey.PublicKey, cscaKey)
+    if err != nil { t.Fatal(err) }
+    if simPKI.dsc, err = x509.ParseCertificate(der); err != nil { t.Fatal(err) }
+}
+
+func mustMarshal(t *testing.T, v interface{}, params string) []byte {
+    der, err := asn1.MarshalWithParams(v, params)
+    if err != nil { t.Fatal(err) }
+    return der
+}
+
+func rawDER(der []byte) asn1.RawValue {
+    return asn1.RawValue{FullBytes: der}
+}
+
+// Encode SubjectPublicKeyInfo of an EC key, with named or explicit domain
+// parameters.
+func simECKeyInfo(t *testing.T, c *Curve, x, y *big.Int,
+    explicit bool) subjectPublicKeyInfo {
+    var spki subjectPublicKeyInfo
+    spki.Algorithm.Algorithm = OID_EC_PUBLIC_KEY
+    if explicit {
+        size := c.ByteSize()
+        a, b := make([]byte, size), make([]byte, size)
+        c.A.FillBytes(a)
+        c.B.FillBytes(b)
+        params := ecParameters{Version: 1,
+            FieldID: ecFieldID{Type: asn1.ObjectIdentifier{1, 2, 840, 10045,
+                1, 1}, Prime: c.P},
+            Curve: ecCurve{A: a, B: b}, Base: c.Marshal(c.Gx, c.Gy),
+            Order: c.N, Cofactor: 1}
+        spki.Algorithm.Parameters = rawDER(mustMarshal(t, params, ""))
+    } else {
+        for oid, known := range curveOIDs {
+            if known == c {
+                id, _ := parseOID(oid)
+                spki.Algorithm.Parameters = rawDER(mustMarshal(t, id, ""))
+            }
+        }
+    }
+    point := c.Marshal(x, y)
+    spki.PublicKey = asn1.BitString{Bytes: point, BitLength: 8 * len(point)}
+    return spki
+}
+
+func parseOID(s string) (asn1.ObjectIdentifier, error) {
+    var oid asn1.ObjectIdentifier
+    var v int
+    for _, part := range bytes.Split([]byte(s), []byte(".")) {
+        if _, err := fmt.Sscan(string(part), &v); err != nil { return nil, err }
+        oid = append(oid, v)
+    }
+    return oid, nil
+}
+
+func simInt(t *testing.T, v int) asn1.RawValue {
+    return rawDER(mustMarshal(t, v, ""))
+}
+
+// Build ISO/IEC 19794-5 facial record with one image.
+func simFaceRecord(image []byte, width, height int) []byte {
+    block := make([]byte, 20 + 12)
+    be32(block, uint32(len(block) + len(image)))
+    info := block[20:]
+    info[0] = 0x01
+    info[2], info[3] = byte(width >> 8), byte(width)
+    info[4], info[5] = byte(height >> 8), byte(height)
+    block = append(block, image...)
+    header := []byte("FAC\x00010\x00\x00\x00\x00\x00\x00\x01")
+    be32(header[8:], uint32(len(header) + len(block)))
+    return append(header, block...)
+}
+
+func be32(b []byte, v uint32) {
+    b[0], b[1], b[2], b[3] = byte(v >> 24), byte(v >> 16), byte(v >> 8), byte(v)
+}
+
+// Create simulated document with the given options.
+func newSimPassport(t *testing.T, opts simOptions) *simPassport {
+    simKeys(t)
+    s := &simPassport{t: t, rand: newDetRand("chip"),
+        files: map[uint16][]byte{}, denied: map[uint16]bool{},
+        csca: simPKI.csca, dsc: simPKI.dsc, dscKey: simPKI.dscKey}
+    var access []securityInfo
+    if opts.pace != nil {
+        access = append(access, securityInfo{Protocol: opts.pace,
+            Required: simInt(t, 2), Optional: simInt(t, opts.paceParam)})
+    }
+    s.files[FID_COM] = tlv.Encode(0x60, bytes.Join([][]byte{
+        tlv.Encode(0x5f01, []byte("0107")),
+        tlv.Encode(0x5f36, []byte("040000")),
+        tlv.Encode(0x5c, []byte{0x61, 0x75, 0x63, 0x6b})}, nil))
+    s.files[FID_DG1] = tlv.Encode(0x61, tlv.Encode(0x5f1f, []byte(simMRZ)))
+    image := make([]byte, opts.imageSize)
+    copy(image, []byte{0xff, 0xd8, 0xff, 0xe0})
+    for i := 4; i < len(image); i++ {
+        image[i] = byte(i)
+    }
+    bit := tlv.Encode(0x7f60, append(tlv.Encode(0xa1, []byte{0x87, 0x02,
+        0x01, 0x01}), tlv.Encode(0x5f2e, simFaceRecord(image, 480,
+        640))...))
+    s.files[FID_DG2] = tlv.Encode(0x75, tlv.Encode(0x7f61, append(
+        []byte{0x02, 0x01, 0x01}, bit...)))
+    s.files[DataGroupFID(3)] = tlv.Encode(0x63, []byte{0x00})
+    s.denied[DataGroupFID(3)] = true
+    s.files[FID_DG11] = tlv.Encode(0x6b, bytes.Join([][]byte{
+        tlv.Encode(0x5c, []byte{0x5f, 0x0e, 0x5f, 0x2b, 0x5f, 0x11}),
+        tlv.Encode(0x5f0e, []byte("ERIKSSON<<ANNA<MARIA")),
+        tlv.Encode(0x5f2b, []byte("19740812")),
+        tlv.Encode(0x5f11, []byte("ZENITH,UTO"))}, nil))
+    var dg14 []securityInfo
+    switch opts.aa {
+        case "rsa":
+            s.aaRSA = simRSAKey
+            der, err := x509.MarshalPKIXPublicKey(&simRSAKey.PublicKey)
+            if err != nil { t.Fatal(err) }
+            s.files[FID_DG15] = tlv.Encode(0x6f, der)
+        case "ec":
+            s.aaCurve = BrainpoolP256r1
+            var x, y *big.Int
+            var err error
+            s.aaKey, x, y, err = s.aaCurve.generateKey(s.rand, s.aaCurve.Gx,
+                s.aaCurve.Gy)
+            if err != nil { t.Fatal(err) }
+            spki := simECKeyInfo(t, s.aaCurve, x, y, true)
+            s.files[FID_DG15] = tlv.Encode(0x6f, mustMarshal(t, spki, ""))
+            dg14 = append(dg14, securityInfo{Protocol: OID_AA,
+                Required: simInt(t, 1), Optional: rawDER(mustMarshal(t,
+                append(append(asn1.ObjectIdentifier{}, OID_ECDSA_PLAIN...), 3),
+                ""))})
+    }
+    if opts.ca != nil {
+        s.caProtocol = opts.ca
+        s.caCurve = opts.caCurve
+        var x, y *big.Int
+        var err error
+        s.caKey, x, y, err = s.caCurve.generateKey(s.rand, s.caCurve.Gx,
+            s.caCurve.Gy)
+        if err != nil { t.Fatal(err) }
+        spki := simECKeyInfo(t, s.caCurve, x, y, false)
+        dg14 = append(dg14,
+            securityInfo{Protocol: OID_PK_ECDH,
+                Required: rawDER(mustMarshal(t, spki, "")),
+                Optional: simInt(t, 1)},
+            securityInfo{Protocol: opts.ca, Required: simInt(t, 1),
+                Optional: simInt(t, 1)})
+    }
+    if dg14 != nil {
+        s.files[FID_DG14] = tlv.Encode(0x6e, mustMarshal(t, dg14, "set"))
+    }
+    if opts.eac {
+        access = s.setupEAC(access, dg14)
+    }
+    if access != nil {
+        s.cardAccess = mustMarshal(t, access, "set")
+    }
+    s.signSOD()
+    s.Card = mock.NewCard(mock.Hex("3b 80 80 01 01")).
+        RuleFunc("?? a4 *", s.rule(s.selectFile)).
+        RuleFunc("?? b0 *", s.rule(s.readBinary)).
+        RuleFunc("?? b1 *", s.rule(s.readBinaryOdd)).
+        RuleFunc("?? 84 *", s.rule(s.getChallenge)).
+        RuleFunc("?? 82 *", s.rule(s.externalAuthenticate)).
+        RuleFunc("?? 2a *", s.rule(s.pso)).
+        RuleFunc("?? 20 *", s.rule(s.verify)).
+        RuleFunc("?? 22 *", s.rule(s.mse)).
+        RuleFunc("?? 86 *", s.rule(s.generalAuthenticate)).
+        RuleFunc("?? 88 *", s.rule(s.internalAuthenticate))
+    return s
+}
+
+// Add EAC security infos to those of EF.CardAccess and create
+// EF.CardSecurity with the CA key of DG14, an RI key and the eID
+// application.
+func (s *simPassport) setupEAC(access, dg14 []securityInfo) []securityInfo {
+    t := s.t
+    simCVKeys(t)
+    s.pin, s.pinRetries = "123456", 3
+    s.cvca = simCV.cvca
+    s.certs = map[string]*CVCertificate{s.cvca.CHR: s.cvca}
+    param := -1
+    for id, c := range Curves {
+        if c == s.caCurve { param = id }
+    }
+    domain := algorithmIdentifier{Algorithm: OID_STANDARDIZED_DOMAIN_PARAMETERS,
+        Parameters: simInt(t, param)}
+    access = append(access,
+        securityInfo{Protocol: OID_TA, Required: simInt(t, 2)},
+        securityInfo{Protocol: s.caProtocol, Required: simInt(t, 2),
+            Optional: simInt(t, 1)},
+        securityInfo{Protocol: OID_CA_ECDH,
+            Required: rawDER(mustMarshal(t, domain, "")),
+            Optional: simInt(t, 1)})
+    var err error
+    if s.riKey, _, _, err = s.caCurve.generateKey(s.rand, s.caCurve.Gx,
+        s.caCurve.Gy); err != nil {
+        t.Fatal(err)
+    }
+    infos := append([]securityInfo{}, access...)
+    for _, info := range dg14 {
+        if info.Protocol.Equal(OID_PK_ECDH) { infos = append(infos, info) }
+    }
+    infos = append(infos, securityInfo{Protocol: OID_RI_ECDH_SHA_256,
+            Required: rawDER(mustMarshal(t,
+                restrictedIdentificationParameters{1, 1, false}, ""))})
+    s.cardSecurity = s.signContent(oidSecurityObject,
+        mustMarshal(t, infos, "set"))
+    s.eidFiles = map[uint16][]byte{
+        DataGroupFID(1): tlv.Encode(0x61, tlv.Encode(0x13, []byte("ID"))),
+        DataGroupFID(4): tlv.Encode(0x64, tlv.Encode(0x0c, []byte("ERIKA"))),
+        DataGroupFID(5): tlv.Encode(0x65, tlv.Encode(0x0c,
+            []byte("MUSTERMANN"))),
+    }
+    return access
+}
+
+// Create EF.SOD over the current data groups.
+func (s *simPassport) signSOD() {
+    lds := ldsSecurityObject{HashAlgorithm: pkix.AlgorithmIdentifier{
+        Algorithm: asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 1}}}
+    for n := 1; n <= 16; n++ {
+        if data, ok := s.files[DataGroupFID(n)]; ok {
+            h := sha256.Sum256(data)
+            lds.Hashes = append(lds.Hashes, dataGroupHash{n, h[:]})
+        }
+    }
+    s.files[FID_SOD] = tlv.Encode(0x77, s.signContent(oidLDSSecurityObject,
+        mustMarshal(s.t, lds, "")))
+}
+
+// Return ContentInfo with content signed by the document signer.
+func (s *simPassport) signContent(contentType asn1.ObjectIdentifier,
+    content []byte) []byte {
+    t := s.t
+    digest := sha256.Sum256(content)
+    attrs := []attribute{
+        {Type: oidContentType, Values: []asn1.RawValue{
+            rawDER(mustMarshal(t, contentType, ""))}},
+        {Type: oidMessageDigest, Values: []asn1.RawValue{
+            rawDER(mustMarshal(t, digest[:], ""))}},
+    }
+    signed := mustMarshal(t, attrs, "set")
+    h := sha256.Sum256(signed)
+    sig, err := ecdsa.SignASN1(rand.Reader, s.dscKey, h[:])
+    if err != nil { t.Fatal(err) }
+    sha256ID := pkix.AlgorithmIdentifier{Algorithm: asn1.ObjectIdentifier{2,
+        16, 840, 1, 101, 3, 4, 2, 1}}
+    si := signerInfo{Version: 1,
+        SID: rawDER(mustMarshal(t, issuerAndSerialNumber{
+            Issuer: rawDER(s.dsc.RawIssuer),
+            SerialNumber: s.dsc.SerialNumber}, "")),
+        DigestAlgorithm: sha256ID,
+        SignedAttrs: rawDER(append([]byte{0xa0}, signed[1:]...)),
+        SignatureAlgorithm: pkix.AlgorithmIdentifier{
+            Algorithm: asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 3, 2}},
+        Signature: sig}
+    sd := signedData{Version: 3,
+        DigestAlgorithms: rawDER(mustMarshal(t,
+            []pkix.AlgorithmIdentifier{sha256ID}, "set")),
+        EncapContentInfo: encapContentInfo{
+            EContentType: contentType, EContent: content},
+        Certificates: asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0,
+            IsCompound: true, Bytes: s.dsc.Raw},
+        SignerInfos: []signerInfo{si}}
+    ci := contentInfo{ContentType: oidSignedData,
+        Content: asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0,
+            IsCompound: true, Bytes: mustMarshal(t, sd, "")}}
+    return mustMarshal(t, ci, "")
+}
+
+// Verify and decipher protected command.
+func simUnprotect(sm *SecureMessaging, cmd []byte) ([]byte, error) {
+    sm.increment()
+    if len(cmd) < 6 || cmd[0] & 0x0c != 0x0c || int(cmd[4]) + 6 != len(cmd) {
+        return nil, fmt.Errorf("invalid protected command")
+    }
+    bs := sm.cipher.BlockSize()
+    var macInput, cryptogram, le, cc []byte
+    data := cmd[5:len(cmd)-1]
+    for len(data) > 0 {
+        obj, rest, err := tlv.ParseOne(data)
+        if err != nil { return nil, err }
+        raw := data[:len(data)-len(rest)]
+        data = rest
+        switch obj.Tag {
+            case TAG_SM_CRYPTOGRAM:
+                cryptogram = obj.Value[1:]
+                macInput = append(macInput, raw...)
+            case TAG_SM_CRYPTOGRAM_ODD:
+                cryptogram = obj.Value
+                macInput = append(macInput, raw...)
+            case TAG_SM_LE:
+                le = obj.Value
+                macInput = append(macInput, raw...)
+            case TAG_SM_MAC:
+                cc = obj.Value
+        }
+    }
+    expected, err := sm.mac(append(pad(cmd[:4], bs), macInput...))
+    if err != nil { return nil, err }
+    if !bytes.Equal(cc, expected) { return nil, fmt.Errorf("MAC mismatch") }
+    out := []byte{cmd[0] &^ 0x0c, cmd[1], cmd[2], cmd[3]}
+    if cryptogram != nil {
+        plain, err := decryptCBC(sm.enc, sm.iv(), cryptogram)
+        if err != nil { return nil, err }
+        if plain, err = unpad(plain); err != nil { return nil, err }
+        out = append(append(out, byte(len(plain))), plain...)
+    }
+    return append(out, le...), nil
+}
+
+// Protect response.
+func simProtect(sm *SecureMessaging, data []byte, sw uint16) []byte {
+    sm.increment()
+    var do []byte
+    if len(data) > 0 {
+        enc := encryptCBC(sm.enc, sm.iv(), pad(data, sm.cipher.BlockSize()))
+        do = tlv.Encode(TAG_SM_CRYPTOGRAM, append([]byte{0x01}, enc...))
+    }
+    do = append(do, TAG_SM_STATUS, 0x02, byte(sw >> 8), byte(sw))
+    cc, _ := sm.mac(do)
+    do = append(do, tlv.Encode(TAG_SM_MAC, cc)...)
+    return append(do, 0x90, 0x00)
+}
+
+// Instruction working on the unprotected command with data and Le (256
+// for 0).
+type simInstruction func(cmd smartcard.CommandAPDU, data []byte,
+    n int) ([]byte, uint16)
+
+// Unprotect command, call fn and protect its response.
+func (s *simPassport) rule(fn simInstruction) mock.HandlerFunc {
+    return func(cmd smartcard.CommandAPDU) (smartcard.ResponseAPDU, error) {
+        sm := s.sm
+        plain := []byte(cmd)
+        if sm != nil {
+            var err error
+            if plain, err = simUnprotect(sm, cmd); err != nil {
+                s.sm = nil
+                return smartcard.ResponseAPDU{0x69, 0x88}, nil
+            }
+        } else if cmd[0] & 0x0c != 0 {
+            return smartcard.ResponseAPDU{0x68, 0x82}, nil
+        }
+        c := smartcard.CommandAPDU(plain)
+        le, _ := c.Le()
+        n := int(le)
+        if n == 0 { n = 256 }
+        data, sw := fn(c, c.Data(), n)
+        if len(data) > 256 {
+            s.t.Errorf("response too long: %d", len(data))
+        }
+        var rsp []byte
+        if sm != nil {
+            rsp = simProtect(sm, data, sw)
+            if len(rsp) > 258 {
+                s.t.Errorf("protected response too long: %d", len(rsp))
+            }
+        } else {
+            rsp = append(data, byte(sw >> 8), byte(sw))
+        }
+        if s.next != nil {
+            s.sm, s.next = s.next, nil
+        }
+        return smartcard.ResponseAPDU(rsp), nil
+    }
+}
+
+func (s *simPassport) random(n int) []byte {
+    b := make([]byte, n)
+    io.ReadFull(s.rand, b)
+    return b
+}
+
+func (s *simPassport) selectFile(cmd smartcard.CommandAPDU, data []byte,
+    n int) ([]byte, uint16) {
+    s.selected = nil
+    switch cmd[2] {
+        case 0x04:
+            switch {
+                case bytes.Equal(data, AID):
+                    s.app, s.eid = true, false
+                case s.eidFiles != nil && bytes.Equal(data, AID_EID):
+                    s.app, s.eid = true, true
+                default:
+                    return nil, 0x6a82
+            }
+            return nil, 0x9000
+        case 0x02:
+            if len(data) != 2 { return nil, 0x6a80 }
+            fid := uint16(data[0]) << 8 | uint16(data[1])
+            switch {
+                case s.app:
+                case fid == FID_CARD_ACCESS && s.cardAccess != nil:
+                    s.selected = s.cardAccess
+                    return nil, 0x9000
+                case fid == FID_CARD_SECURITY && s.cardSecurity != nil:
+                    if s.rights == nil { return nil, 0x6982 }
+                    s.selected = s.cardSecurity
+                    return nil, 0x9000
+            }
+            if s.eid {
+                file, ok := s.eidFiles[fid]
+                if !ok { return nil, 0x6a82 }
+                if s.rights == nil ||
+                    !s.rights.Allows(AT_READ_DG1 + int(fid & 0xff) - 1) {
+                    return nil, 0x6982
+                }
+                s.selected = file
+                return nil, 0x9000
+            }
+            file, ok := s.files[fid]
+            if !s.app || !ok { return nil, 0x6a82 }
+            if s.sm == nil || s.denied[fid] { return nil, 0x6982 }
+            s.selected = file
+            return nil, 0x9000
+    }
+    return nil, 0x6a86
+}
+
+func (s *simPassport) readBinary(cmd smartcard.CommandAPDU, data []byte,
+    n int) ([]byte, uint16) {
+    return s.read(int(cmd[2]) << 8 | int(cmd[3]), n)
+}
+
+func (s *simPassport) readBinaryOdd(cmd smartcard.CommandAPDU, data []byte,
+    n int) ([]byte, uint16) {
+    obj, _, err := tlv.ParseOne(data)
+    if err != nil || obj.Tag != 0x54 { return nil, 0x6a80 }
+    offset := 0
+    for _, b := range obj.Value {
+        offset = offset << 8 | int(b)
+    }
+    chunk, sw := s.read(offset, n - 4)
+    if sw != 0x9000 { return nil, sw }
+    return tlv.Encode(0x53, chunk), sw
+}
+
+func (s *simPassport) getChallenge(cmd smartcard.CommandAPDU, data []byte,
+    n int) ([]byte, uint16) {
+    s.rndIC = s.random(8)
+    return s.rndIC, 0x9000
+}
+
+// BAC or Terminal Authentication.
+func (s *simPassport) externalAuthenticate(cmd smartcard.CommandAPDU,
+    data []byte, n int) ([]byte, uint16) {
+    if s.ta != nil && !s.ta.done {
+        return nil, s.terminalAuthentication(data)
+    }
+    return s.bac(data)
+}
+
+func (s *simPassport) pso(cmd smartcard.CommandAPDU, data []byte,
+    n int) ([]byte, uint16) {
+    return nil, s.verifyCertificate(cmd[0], cmd[2], cmd[3], data)
+}
+
+func (s *simPassport) verify(cmd smartcard.CommandAPDU, data []byte,
+    n int) ([]byte, uint16) {
+    if cmd[0] != 0x80 || cmd[2] != 0x80 { return nil, 0x6a86 }
+    return nil, s.verifyAuxiliaryData(data)
+}
+
+// PACE, Chip Authentication or Restricted Identification step.
+func (s *simPassport) generalAuthenticate(cmd smartcard.CommandAPDU,
+    data []byte, n int) ([]byte, uint16) {
+    obj, _, err := tlv.ParseOne(data)
+    if err != nil || obj.Tag != 0x7c { return nil, 0x6a80 }
+    switch {
+        case s.pace != nil:
+            return s.paceStep(obj.Value)
+        case s.riPending:
+            return s.restrictedIdentification(obj.Value)
+        case s.caCipher != nil && s.ta != nil && s.ta.done:
+            return s.chipAuthenticationV2(obj.Value)
+        case s.caCipher != nil:
+            return s.chipAuthentication(obj.Value)
+    }
+    return nil, 0x6985
+}
+
+func (s *simPassport) internalAuthenticate(cmd smartcard.CommandAPDU,
+    data []byte, n int) ([]byte, uint16) {
+    return s.activeAuthentication(data)
+}
+
+func (s *simPassport) read(offset, n int) ([]byte, uint16) {
+    if s.selected == nil { return nil, 0x6986 }
+    if offset > len(s.selected) { return nil, 0x6b00 }
+    end := offset + n
+    if end > len(s.selected) { end = len(s.selected) }
+    return append([]byte{}, s.selected[offset:end]...), 0x9000
+}
+
+// Chip side of BAC.
+func (s *simPassport) bac(data []byte) ([]byte, uint16) {
+    seed := simInfo.KeySeed()
+    kenc := KDF(seed, KDF_ENC, CIPHER_3DES)
+    kmac := KDF(seed, KDF_MAC, CIPHER_3DES)
+    if s.rndIC == nil || len(data) != 40 { return nil, 0x6700 }
+    m, _ := mac(CIPHER_3DES, kmac, pad(data[:32], 8))
+    if !bytes.Equal(m, data[32:]) { return nil, 0x6300 }
+    block, _ := newBlock(CIPHER_3DES, kenc)
+    zero := make([]byte, 8)
+    plain, _ := decryptCBC(block, zero, data[:32])
+    if !bytes.Equal(plain[8:16], s.rndIC) { return nil, 0x6300 }
+    kIC := s.random(16)
+    r := append(append(append([]byte{}, s.rndIC...), plain[:8]...), kIC...)
+    enc := encryptCBC(block, zero, r)
+    m, _ = mac(CIPHER_3DES, kmac, pad(enc, 8))
+    keySeed := make([]byte, 16)
+    for i := range keySeed {
+        keySeed[i] = plain[16+i] ^ kIC[i]
+    }
+    ssc := append(append([]byte{}, s.rndIC[4:]...), plain[4:8]...)
+    s.next, _ = NewSecureMessaging(nil, CIPHER_3DES,
+        KDF(keySeed, KDF_ENC, CIPHER_3DES),
+        KDF(keySeed, KDF_MAC, CIPHER_3DES), ssc)
+    s.rndIC = nil
+    return append(enc, m...), 0x9000
+}
+
+func (s *simPassport) mse(cmd smartcard.CommandAPDU, data []byte,
+    n int) ([]byte, uint16) {
+    p1, p2 := cmd[2], cmd[3]
+    objs, err := tlv.Parse(data)
+    if err != nil { return nil, 0x6a80 }
+    switch {
+        case p1 == 0xc1 && p2 == 0xa4:
+            // PACE
+            infos, err := ParseSecurityInfos(s.cardAccess)
+            if err != nil || len(infos.PACE) == 0 { return nil, 0x6a80 }
+            info := infos.PACE[0]
+            if !bytes.Equal(objs.Value(0x80), oidBytes(info.Protocol)) {
+                return nil, 0x6a80
+            }
+            pace := &simPACE{protocol: info.Protocol,
+                curve: Curves[info.ParameterID]}
+            pace.cipher, _ = info.Cipher()
+            switch pw := objs.Value(0x83); {
+                case bytes.Equal(pw, []byte{PASSWORD_MRZ}):
+                    h := sha1.Sum([]byte(simInfo.String()))
+                    pace.password = h[:]
+                case bytes.Equal(pw, []byte{PASSWORD_CAN}):
+                    pace.password = []byte(simCAN)
+                case bytes.Equal(pw, []byte{PASSWORD_PIN}) && s.pin != "":
+                    if s.pinRetries == 0 { return nil, 0x6983 }
+                    pace.password, pace.pin = []byte(s.pin), true
+                default:
+                    return nil, 0x6a80
+            }
+            if chat := objs.Value(0x7f4c); chat != nil {
+                if pace.chat, err = parseCHAT(chat); err != nil {
+                    return nil, 0x6a80
+                }
+            }
+            s.pace = pace
+            s.sm, s.chat, s.ta, s.rights = nil, nil, nil, nil
+            if pace.pin && s.pinRetries < 3 {
+                return nil, 0x63c0 | uint16(s.pinRetries)
+            }
+            return nil, 0x9000
+        case p1 == 0x81 && p2 == 0xb6:
+            // Key for PSO:Verify Certificate
+            if s.dst = s.certs[string(objs.Value(0x83))]; s.dst == nil {
+                return nil, 0x6a88
+            }
+            return nil, 0x9000
+        case p1 == 0x81 && p2 == 0xa4:
+            // Terminal Authentication
+            if s.chat == nil { return nil, 0x6985 }
+            cert := s.certs[string(objs.Value(0x83))]
+            if cert == nil || cert.CHAT.CertificateRole() != CV_TERMINAL {
+                return nil, 0x6a88
+            }
+            s.ta = &simTA{cert: cert, comp: objs.Value(0x91)}
+            if aux, ok := objs.Find(0x67); ok { s.ta.aux = aux.Bytes() }
+            return nil, 0x9000
+        case p1 == 0x41 && p2 == 0xa4 && s.riKey != nil &&
+            bytes.Equal(objs.Value(0x80), oidBytes(OID_RI_ECDH_SHA_256)):
+            s.riPending = true
+            return nil, 0x9000
+        case p1 == 0x41 && p2 == 0xa6:
+            // Chip Authentication with 3DES
+            if s.caProtocol == nil { return nil, 0x6a80 }
+            return s.chipAuthentication(data)
+        case p1 == 0x41 && p2 == 0xa4:
+            if s.caProtocol == nil ||
+                !bytes.Equal(objs.Value(0x80), oidBytes(s.caProtocol)) {
+                return nil, 0x6a80
+            }
+            c, _ := protocolCipher(s.caProtocol)
+            s.caCipher = &c
+            return nil, 0x9000
+    }
+    return nil, 0x6a86
+}
+
+func (s *simPassport) paceStep(data []byte) ([]byte, uint16) {
+    p := s.pace
+    c := p.curve
+    if len(data) == 0 {
+        p.nonce = s.random(16)
+        block, _ := newBlock(p.cipher, KDF(p.password, KDF_PI, p.cipher))
+        z := encryptCBC(block, make([]byte, p.cipher.BlockSize()), p.nonce)
+        return tlv.Encode(0x7c, tlv.Encode(0x80, z)), 0x9000
+    }
+    obj, _, err := tlv.ParseOne(data)
+    if err != nil { return nil, 0x6a80 }
+    switch obj.Tag {
+        case 0x81:
+            mx, my, err := c.Unmarshal(obj.Value)
+            if err != nil { return nil, 0x6a80 }
+            var x, y *big.Int
+            p.key, x, y, _ = c.generateKey(s.rand, c.Gx, c.Gy)
+            hx, hy := c.ScalarMult(mx, my, p.key)
+            sx, sy := c.ScalarMult(c.Gx, c.Gy, new(big.Int).SetBytes(p.nonce))
+            p.gx, p.gy = c.Add(sx, sy, hx, hy)
+            return tlv.Encode(0x7c, tlv.Encode(0x82, c.Marshal(x, y))), 0x9000
+        case 0x83:
+            ex, ey, err := c.Unmarshal(obj.Value)
+            if err != nil { return nil, 0x6a80 }
+            var x, y *big.Int
+            p.key, x, y, _ = c.generateKey(s.rand, p.gx, p.gy)
+            p.pcdKey, p.piccKey = obj.Value, c.Marshal(x, y)
+            kx, _ := c.ScalarMult(ex, ey, p.key)
+            k := make([]byte, c.ByteSize())
+            kx.FillBytes(k)
+            p.kenc = KDF(k, KDF_ENC, p.cipher)
+            p.kmac = KDF(k, KDF_MAC, p.cipher)
+            return tlv.Encode(0x7c, tlv.Encode(0x84, p.piccKey)), 0x9000
+        case 0x85:
+            s.pace = nil
+            expected, _ := paceToken(p.cipher, p.kmac, p.protocol, p.piccKey)
+            if !bytes.Equal(obj.Value, expected) {
+                if !p.pin { return nil, 0x6300 }
+                s.pinRetries--
+                return nil, 0x63c0 | uint16(s.pinRetries)
+            }
+            if p.pin { s.pinRetries = 3 }
+            token, _ := paceToken(p.cipher, p.kmac, p.protocol, p.pcdKey)
+            s.next, _ = NewSecureMessaging(nil, p.cipher, p.kenc, p.kmac,
+                make([]byte, p.cipher.BlockSize()))
+            s.chat, s.idPICC = p.chat, p.piccKey[1:1+c.ByteSize()]
+            rsp := tlv.Encode(0x86, token)
+            if p.chat != nil {
+                rsp = append(rsp, tlv.Encode(0x87, []byte(s.cvca.CHR))...)
+            }
+            return tlv.Encode(0x7c, rsp), 0x9000
+    }
+    return nil, 0x6a80
+}
+
+func (s *simPassport) chipAuthentication(data []byte) ([]byte, uint16) {
+    objs, err := tlv.Parse(data)
+    if err != nil { return nil, 0x6a80 }
+    key := objs.Value(0x91)
+    if key == nil { key = objs.Value(0x80) }
+    x, y, err := s.caCurve.Unmarshal(key)
+    if err != nil { return nil, 0x6a80 }
+    c, _ := protocolCipher(s.caProtocol)
+    kx, _ := s.caCurve.ScalarMult(x, y, s.caKey)
+    k := make([]byte, s.caCurve.ByteSize())
+    kx.FillBytes(k)
+    s.next, _ = NewSecureMessaging(nil, c, KDF(k, KDF_ENC, c),
+        KDF(k, KDF_MAC, c), make([]byte, c.BlockSize()))
+    if s.caCipher != nil {
+        s.caCipher = nil
+        return []byte{0x7c, 0x00}, 0x9000
+    }
+    return nil, 0x9000
+}
+
+// Sign challenge with ISO/IEC 9796-2 scheme 1 (RSA) or plain ECDSA.
+func (s *simPassport) activeAuthentication(challenge []byte) ([]byte,
+    uint16) {
+    if s.sm == nil { return nil, 0x6982 }
+    if s.aaRSA != nil {
+        k := s.aaRSA.Size()
+        m1 := s.random(k - 2 - sha1.Size)
+        h := sha1.New()
+        h.Write(m1)
+        h.Write(challenge)
+        f := append(append(append([]byte{0x6a}, m1...), h.Sum(nil)...), 0xbc)
+        sig := new(big.Int).Exp(new(big.Int).SetBytes(f), s.aaRSA.D,
+            s.aaRSA.N)
+        out := make([]byte, k)
+        sig.FillBytes(out)
+        return out, 0x9000
+    }
+    if s.aaCurve != nil {
+        c := s.aaCurve
+        h := sha256.Sum256(challenge)
+        k, x, _, _ := c.generateKey(s.rand, c.Gx, c.Gy)
+        r := new(big.Int).Mod(x, c.N)
+        e := new(big.Int).SetBytes(h[:])
+        sig := new(big.Int).Mul(r, s.aaKey)
+        sig.Add(sig, e).Mul(sig, new(big.Int).ModInverse(k, c.N)).Mod(sig, c.N)
+        size := c.ByteSize()
+        out := make([]byte, 2 * size)
+        r.FillBytes(out[:size])
+        sig.FillBytes(out[size:])
+        return out, 0x9000
+    }
+    return nil, 0x6d00
+}
+
+// Deterministic ECDSA key for CV certificates and Terminal
+// Authentication. Nonces are derived from key and digest, so that
+// certificates and recorded traces are reproducible.
+type simSigner struct {
+    key ECPublicKey
+    d *big.Int
+}
+
+func newSimSigner(t *testing.T, seed string, c *Curve) *simSigner {
+    d, x, y, err := c.generateKey(newDetRand(seed), c.Gx, c.Gy)
+    if err != nil { t.Fatal(err) }
+    return &simSigner{key: ECPublicKey{Curve: c, X: x, Y: y}, d: d}
+}
+
+func (k *simSigner) Public() crypto.PublicKey {
+    return &k.key
+}
+
+func (k *simSigner) Sign(_ io.Reader, digest []byte,
+    opts crypto.SignerOpts) ([]byte, error) {
+    c := k.key.Curve
+    e := new(big.Int).SetBytes(digest)
+    if excess := len(digest) * 8 - c.N.BitLen(); excess > 0 {
+        e.Rsh(e, uint(excess))
+    }
+    nonce, x, _, err := c.generateKey(newDetRand(fmt.Sprintf("%x%x", k.d,
+        digest)), c.Gx, c.Gy)
+    if err != nil { return nil, err }
+    r := new(big.Int).Mod(x, c.N)
+    s := new(big.Int).Mul(r, k.d)
+    s.Add(s, e).Mul(s, new(big.Int).ModInverse(nonce, c.N)).Mod(s, c.N)
+    return asn1.Marshal(struct{ R, S *big.Int }{r, s})
+}
+
+func simDate(s string) time.Time {
+    t, err := time.Parse("2006-01-02", s)
+    if err != nil { panic(err) }
+    return t
+}
+
+// CV certificate PKI on brainpoolP256r1: CVCA trusted by the chip, link
+// certificate to a new CVCA key and a DV certificate issued with it.
+var simCV struct {
+    cvca, link, dv *CVCertificate
+    linkKey, dvKey *simSigner
+}
+
+func simCVCert(t *testing.T, chr string, chat *CHAT, key *simSigner,
+    issuer *CVCertificate, issuerKey *simSigner, from,
+    until string) *CVCertificate {
+    template := &CVCertificate{CHR: chr, CHAT: chat,
+        PublicKey: &CVPublicKey{Algorithm: OID_TA_ECDSA_SHA_256,
+            Curve: key.key.Curve, Point: key.key.Bytes()},
+        EffectiveDate: simDate(from), ExpirationDate: simDate(until)}
+    cert, err := CreateCVCertificate(template, issuer, issuerKey)
+    if err != nil { t.Fatal(err) }
+    return cert
+}
+
+func simCVKeys(t *testing.T) {
+    if simCV.cvca != nil { return }
+    c := BrainpoolP256r1
+    all := []int{AT_AGE_VERIFICATION, AT_RESTRICTED_IDENTIFICATION}
+    for n := 1; n <= 22; n++ {
+        all = append(all, AT_READ_DG1 + n - 1)
+    }
+    cvcaKey := newSimSigner(t, "cvca", c)
+    simCV.linkKey = newSimSigner(t, "cvca2", c)
+    simCV.dvKey = newSimSigner(t, "dv", c)
+    simCV.cvca = simCVCert(t, "UTCVCA00001", NewATCHAT(CV_CVCA, all...),
+        cvcaKey, nil, cvcaKey, "2024-01-01", "2034-12-31")
+    simCV.link = simCVCert(t, "UTCVCA00002", NewATCHAT(CV_CVCA, all...),
+        simCV.linkKey, simCV.cvca, cvcaKey, "2025-01-01", "2035-12-31")
+    simCV.dv = simCVCert(t, "UTDVCA00001", NewATCHAT(CV_DV_DOMESTIC, all...),
+        simCV.dvKey, simCV.link, simCV.linkKey, "2025-01-01", "2027-12-31")
+}
+
+// Return terminal certificate chain with the given access rights, and the
+// terminal key.
+func simTerminal(t *testing.T, chr string, rights ...int) ([]*CVCertificate,
+    *simSigner) {
+    simCVKeys(t)
+    key := newSimSigner(t, chr, BrainpoolP256r1)
+    cert := simCVCert(t, chr, NewATCHAT(CV_TERMINAL, rights...), key,
+        simCV.dv, simCV.dvKey, "2025-06-01", "2025-06-30")
+    return []*CVCertificate{simCV.link, simCV.dv, cert}, key
+}
+
+// Chip side of PSO:Verify Certificate: import a certificate signed with
+// the key set by MSE:Set DST. Chained commands are collected first.
+func (s *simPassport) verifyCertificate(cla, p1, p2 byte,
+    data []byte) uint16 {
+    if p1 != 0x00 || p2 != 0xbe { return 0x6a86 }
+    s.chained = append(s.chained, data...)
+    if cla & 0x10 != 0 { return 0x9000 }
+    data, s.chained = s.chained, nil
+    if s.chat == nil || s.dst == nil { return 0x6985 }
+    cert, err := ParseCVCertificate(tlv.Encode(0x7f21, data))
+    if err != nil || cert.CAR != s.dst.CHR { return 0x6a80 }
+    if cert.CheckSignatureFrom(s.dst) != nil { return 0x6300 }
+    if cert.PublicKey.Curve == nil {
+        cert.PublicKey.Curve = s.dst.PublicKey.Curve
+    }
+    s.certs[cert.CHR] = cert
+    return 0x9000
+}
+
+// Chip side of EXTERNAL AUTHENTICATE in Terminal Authentication. The
+// effective rights are those of the terminal, its DV and the PACE CHAT.
+func (s *simPassport) terminalAuthentication(sig []byte) uint16 {
+    ta := s.ta
+    if s.rndIC == nil { return 0x6985 }
+    key, err := ta.cert.PublicKey.ECPublicKey()
+    if err != nil { return 0x6985 }
+    hash, _ := taHash(ta.cert.PublicKey.Algorithm)
+    h := hash.New()
+    for _, b := range [][]byte{s.idPICC, s.rndIC, ta.comp, ta.aux} {
+        h.Write(b)
+    }
+    s.rndIC = nil
+    r, ss, err := parseECDSASignature(sig, key.Curve)
+    if err != nil || !key.Curve.verifyECDSA(key.X, key.Y, h.Sum(nil), r,
+        ss) {
+        s.ta = nil
+        return 0x6300
+    }
+    ta.done = true
+    rights := append([]byte{}, s.chat.Rights...)
+    for _, chat := range []*CHAT{ta.cert.CHAT, s.certs[ta.cert.CAR].CHAT} {
+        for i := range rights {
+            rights[i] &= chat.Rights[i]
+        }
+    }
+    s.rights = &CHAT{Role: s.chat.Role, Rights: rights}
+    return 0x9000
+}
+
+func (s *simPassport) chipAuthenticationV2(data []byte) ([]byte, uint16) {
+    objs, err := tlv.Parse(data)
+    if err != nil { return nil, 0x6a80 }
+    key := objs.Value(0x80)
+    c := s.caCurve
+    x, y, err := c.Unmarshal(key)
+    if err != nil || !bytes.Equal(key[1:1+c.ByteSize()], s.ta.comp) {
+        return nil, 0x6a80
+    }
+    cipher := *s.caCipher
+    s.caCipher = nil
+    kx, _ := c.ScalarMult(x, y, s.caKey)
+    k := make([]byte, c.ByteSize())
+    kx.FillBytes(k)
+    nonce := s.random(8)
+    secret := append(k, nonce...)
+    kenc, kmac := KDF(secret, KDF_ENC, cipher), KDF(secret, KDF_MAC, cipher)
+    token, _ := paceToken(cipher, kmac, s.caProtocol, key)
+    s.next, _ = NewSecureMessaging(nil, cipher, kenc, kmac,
+        make([]byte, cipher.BlockSize()))
+    return tlv.Encode(0x7c, append(tlv.Encode(0x81, nonce),
+        tlv.Encode(0x82, token)...)), 0x9000
+}
+
+// Return sector specific identifier for the public key of a sector.
+func (s *simPassport) sectorID(x, y *big.Int) []byte {
+    kx, _ := s.caCurve.ScalarMult(x, y, s.riKey)
+    k := make([]byte, s.caCurve.ByteSize())
+    kx.FillBytes(k)
+    h := sha256.Sum256(k)
+    return h[:]
+}
+
+func (s *simPassport) restrictedIdentification(data []byte) ([]byte,
+    uint16) {
+    s.riPending = false
+    if s.rights == nil || !s.rights.Allows(AT_RESTRICTED_IDENTIFICATION) {
+        return nil, 0x6982
+    }
+    obj, _, err := tlv.ParseOne(data)
+    if err != nil || obj.Tag != 0xa0 { return nil, 0x6a80 }
+    objs, err := obj.Children()
+    if err != nil { return nil, 0x6a80 }
+    x, y, err := s.caCurve.Unmarshal(objs.Value(0x86))
+    if err != nil { return nil, 0x6a80 }
+    return tlv.Encode(0x7c, tlv.Encode(0x81, s.sectorID(x, y))), 0x9000
+}
+
+// Verify age against the date of birth sent in Terminal Authentication.
+func (s *simPassport) verifyAuxiliaryData(data []byte) uint16 {
+    if s.rights == nil { return 0x6982 }
+    obj, _, err := tlv.ParseOne(data)
+    if err != nil || obj.Tag != 0x06 { return 0x6a80 }
+    if !bytes.Equal(obj.Value, oidBytes(OID_AUX_AGE_VERIFICATION)) {
+        return 0x6a88
+    }
+    if !s.rights.Allows(AT_AGE_VERIFICATION) { return 0x6982 }
+    aux, _, err := tlv.ParseOne(s.ta.aux)
+    if err != nil { return 0x6a88 }
+    templates, _ := aux.Children()
+    for _, template := range templates {
+        objs, err := template.Children()
+        if err != nil || !bytes.Equal(objs.Value(0x06), obj.Value) {
+            continue
+        }
+        if "19740812" <= string(objs.Value(0x53)) { return 0x9000 }
+        return 0x6300
+    }
+    return 0x6a88
+}
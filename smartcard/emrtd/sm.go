@@ -0,0 +1,174 @@
+package emrtd
+
+import (
+    "bytes"
+    "crypto/cipher"
+    "fmt"
+    "github.com/sf1/go-card/smartcard"
+    "github.com/sf1/go-card/smartcard/SW"
+    "github.com/sf1/go-card/smartcard/tlv"
+)
+
+const (
+    // Secure messaging data objects
+    TAG_SM_CRYPTOGRAM_ODD = 0x85
+    TAG_SM_CRYPTOGRAM = 0x87
+    TAG_SM_LE = 0x97
+    TAG_SM_STATUS = 0x99
+    TAG_SM_MAC = 0x8e
+)
+
+// Secure messaging channel (ICAO 9303-11, 9.8). Commands are protected
+// and responses verified and deciphered transparently, so the channel can
+// be used in place of the underlying transmitter.
+type SecureMessaging struct {
+    card smartcard.Transmitter
+    cipher Cipher
+    enc cipher.Block
+    kmac []byte
+    ssc []byte
+}
+
+// Create secure messaging channel with session keys and initial send
+// sequence counter (8 bytes for 3DES, 16 bytes for AES).
+func NewSecureMessaging(card smartcard.Transmitter, c Cipher, ksEnc,
+    ksMac, ssc []byte) (*SecureMessaging, error) {
+    enc, err := newBlock(c, ksEnc)
+    if err != nil { return nil, err }
+    if len(ssc) != c.BlockSize() {
+        return nil, fmt.Errorf("invalid SSC length: %d", len(ssc))
+    }
+    return &SecureMessaging{card: card, cipher: c, enc: enc,
+        kmac: append([]byte{}, ksMac...), ssc: append([]byte{}, ssc...)}, nil
+}
+
+// Return underlying transmitter.
+func (sm *SecureMessaging) Transmitter() smartcard.Transmitter {
+    return sm.card
+}
+
+// Return cipher of the channel.
+func (sm *SecureMessaging) Cipher() Cipher {
+    return sm.cipher
+}
+
+func (sm *SecureMessaging) increment() {
+    for i := len(sm.ssc) - 1; i >= 0; i-- {
+        sm.ssc[i]++
+        if sm.ssc[i] != 0 { break }
+    }
+}
+
+// Return encryption IV: zero for 3DES, E(KSenc, SSC) for AES.
+func (sm *SecureMessaging) iv() []byte {
+    iv := make([]byte, sm.cipher.BlockSize())
+    if sm.cipher != CIPHER_3DES {
+        sm.enc.Encrypt(iv, sm.ssc)
+    }
+    return iv
+}
+
+func (sm *SecureMessaging) mac(data []byte) ([]byte, error) {
+    bs := sm.cipher.BlockSize()
+    return mac(sm.cipher, sm.kmac, pad(append(append([]byte{}, sm.ssc...),
+        data...), bs))
+}
+
+// Protect command APDU.
+func (sm *SecureMessaging) protect(cmd smartcard.CommandAPDU) (
+    smartcard.CommandAPDU, error) {
+    if len(cmd) < 4 {
+        return nil, fmt.Errorf("invalid command APDU")
+    }
+    sm.increment()
+    bs := sm.cipher.BlockSize()
+    header := []byte{cmd[0] | 0x0c, cmd[1], cmd[2], cmd[3]}
+    var do []byte
+    if data := cmd.Data(); len(data) > 0 {
+        enc := encryptCBC(sm.enc, sm.iv(), pad(data, bs))
+        if cmd[1] & 0x01 == 0 {
+            do = tlv.Encode(TAG_SM_CRYPTOGRAM, append([]byte{0x01}, enc...))
+        } else {
+            do = tlv.Encode(TAG_SM_CRYPTOGRAM_ODD, enc)
+        }
+    }
+    if le, ok := cmd.Le(); ok {
+        do = append(do, TAG_SM_LE, 0x01, le)
+    }
+    cc, err := sm.mac(append(pad(header, bs), do...))
+    if err != nil { return nil, err }
+    do = append(do, tlv.Encode(TAG_SM_MAC, cc)...)
+    if len(do) > 255 {
+        return nil, fmt.Errorf("protected command too long")
+    }
+    out := append(header, byte(len(do)))
+    out = append(out, do...)
+    return smartcard.CommandAPDU(append(out, 0x00)), nil
+}
+
+// Verify and decipher response APDU.
+func (sm *SecureMessaging) unprotect(rsp smartcard.ResponseAPDU) (
+    smartcard.ResponseAPDU, error) {
+    sm.increment()
+    data := rsp.Data()
+    if len(data) == 0 {
+        if rsp.SW() == SW.SUCCESS || rsp.SW1() == 0x61 {
+            return nil, fmt.Errorf("unprotected response %04X", rsp.SW())
+        }
+        // Errors such as 6987/6988 are returned in plain
+        return rsp, nil
+    }
+    var macInput, cryptogram, status, cc []byte
+    odd := false
+    for len(data) > 0 {
+        obj, rest, err := tlv.ParseOne(data)
+        if err != nil { return nil, err }
+        raw := data[:len(data)-len(rest)]
+        data = rest
+        switch obj.Tag {
+            case TAG_SM_CRYPTOGRAM, TAG_SM_CRYPTOGRAM_ODD:
+                cryptogram = obj.Value
+                odd = obj.Tag == TAG_SM_CRYPTOGRAM_ODD
+                macInput = append(macInput, raw...)
+            case TAG_SM_STATUS:
+                status = obj.Value
+                macInput = append(macInput, raw...)
+            case TAG_SM_MAC:
+                cc = obj.Value
+            default:
+                return nil, fmt.Errorf("unexpected data object %s in response",
+                    obj.Tag)
+        }
+    }
+    if cc == nil || len(status) != 2 {
+        return nil, fmt.Errorf("incomplete secure messaging response")
+    }
+    expected, err := sm.mac(macInput)
+    if err != nil { return nil, err }
+    if !bytes.Equal(cc, expected) {
+        return nil, fmt.Errorf("secure messaging MAC mismatch")
+    }
+    var plain []byte
+    if cryptogram != nil {
+        if !odd {
+            if len(cryptogram) < 1 || cryptogram[0] != 0x01 {
+                return nil, fmt.Errorf("invalid padding indicator")
+            }
+            cryptogram = cryptogram[1:]
+        }
+        dec, err := decryptCBC(sm.enc, sm.iv(), cryptogram)
+        if err != nil { return nil, err }
+        if plain, err = unpad(dec); err != nil { return nil, err }
+    }
+    return smartcard.ResponseAPDU(append(plain, status...)), nil
+}
+
+// Transmit command with secure messaging.
+func (sm *SecureMessaging) TransmitAPDU(cmd smartcard.CommandAPDU) (
+    smartcard.ResponseAPDU, error) {
+    protected, err := sm.protect(cmd)
+    if err != nil { return nil, err }
+    rsp, err := sm.card.TransmitAPDU(protected)
+    if err != nil { return nil, err }
+    return sm.unprotect(rsp)
+}
@@ -0,0 +1,365 @@
+package emrtd
+
+import (
+    "bytes"
+    "crypto"
+    "crypto/ecdsa"
+    "crypto/rsa"
+    _ "crypto/sha1"
+    _ "crypto/sha256"
+    _ "crypto/sha512"
+    "crypto/x509"
+    "crypto/x509/pkix"
+    "encoding/asn1"
+    "fmt"
+    "math/big"
+    "sort"
+    "github.com/sf1/go-card/smartcard"
+    "github.com/sf1/go-card/smartcard/SW"
+    "github.com/sf1/go-card/smartcard/tlv"
+)
+
+var (
+    oidSignedData = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 2}
+    oidLDSSecurityObject = asn1.ObjectIdentifier{2, 23, 136, 1, 1, 1}
+    oidContentType = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 3}
+    oidMessageDigest = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 4}
+    oidRSAPSS = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 10}
+)
+
+// Hash algorithms by object identifier.
+var hashOIDs = map[string]crypto.Hash{
+    "1.3.14.3.2.26": crypto.SHA1,
+    "2.16.840.1.101.3.4.2.4": crypto.SHA224,
+    "2.16.840.1.101.3.4.2.1": crypto.SHA256,
+    "2.16.840.1.101.3.4.2.2": crypto.SHA384,
+    "2.16.840.1.101.3.4.2.3": crypto.SHA512,
+}
+
+func hashFromOID(oid asn1.ObjectIdentifier) (crypto.Hash, error) {
+    h, ok := hashOIDs[oid.String()]
+    if !ok || !h.Available() {
+        return 0, fmt.Errorf("unsupported hash algorithm %s", oid)
+    }
+    return h, nil
+}
+
+type contentInfo struct {
+    ContentType asn1.ObjectIdentifier
+    Content asn1.RawValue `asn1:"tag:0"`
+}
+
+type encapContentInfo struct {
+    EContentType asn1.ObjectIdentifier
+    EContent []byte `asn1:"explicit,tag:0"`
+}
+
+type signedData struct {
+    Version int
+    DigestAlgorithms asn1.RawValue
+    EncapContentInfo encapContentInfo
+    Certificates asn1.RawValue `asn1:"optional,tag:0"`
+    CRLs asn1.RawValue `asn1:"optional,tag:1"`
+    SignerInfos []signerInfo `asn1:"set"`
+}
+
+type issuerAndSerialNumber struct {
+    Issuer asn1.RawValue
+    SerialNumber *big.Int
+}
+
+type signerInfo struct {
+    Version int
+    SID asn1.RawValue
+    DigestAlgorithm pkix.AlgorithmIdentifier
+    SignedAttrs asn1.RawValue `asn1:"optional,tag:0"`
+    SignatureAlgorithm pkix.AlgorithmIdentifier
+    Signature []byte
+    UnsignedAttrs asn1.RawValue `asn1:"optional,tag:1"`
+}
+
+type attribute struct {
+    Type asn1.ObjectIdentifier
+    Values []asn1.RawValue `asn1:"set"`
+}
+
+type dataGroupHash struct {
+    Number int
+    Hash []byte
+}
+
+type ldsSecurityObject struct {
+    Version int
+    HashAlgorithm pkix.AlgorithmIdentifier
+    Hashes []dataGroupHash
+    LDSVersionInfo asn1.RawValue `asn1:"optional"`
+}
+
+type pssParameters struct {
+    Hash pkix.AlgorithmIdentifier `asn1:"optional,explicit,tag:0"`
+    MGF pkix.AlgorithmIdentifier `asn1:"optional,explicit,tag:1"`
+    SaltLength int `asn1:"optional,explicit,tag:2,default:20"`
+}
+
+// Content of CMS signed data with its signer.
+type signedContent struct {
+    // Certificates included in the signed data, normally the document
+    // signer certificate
+    Certificates []*x509.Certificate
+    contentType asn1.ObjectIdentifier
+    content []byte
+    signer signerInfo
+}
+
+// Parse CMS ContentInfo with signed data of the given content type and a
+// single signer.
+func parseSignedContent(data []byte,
+    contentType asn1.ObjectIdentifier) (*signedContent, error) {
+    var ci contentInfo
+    if _, err := asn1.Unmarshal(data, &ci); err != nil { return nil, err }
+    if !ci.ContentType.Equal(oidSignedData) {
+        return nil, fmt.Errorf("unexpected content type %s", ci.ContentType)
+    }
+    var sd signedData
+    if _, err := asn1.Unmarshal(ci.Content.Bytes, &sd); err != nil {
+        return nil, fmt.Errorf("invalid signed data: %s", err)
+    }
+    if !sd.EncapContentInfo.EContentType.Equal(contentType) {
+        return nil, fmt.Errorf("unexpected content type %s",
+            sd.EncapContentInfo.EContentType)
+    }
+    if len(sd.SignerInfos) != 1 {
+        return nil, fmt.Errorf("expected one signer, found %d",
+            len(sd.SignerInfos))
+    }
+    sc := &signedContent{contentType: contentType,
+        content: sd.EncapContentInfo.EContent, signer: sd.SignerInfos[0]}
+    if len(sd.Certificates.Bytes) > 0 {
+        var err error
+        sc.Certificates, err = x509.ParseCertificates(sd.Certificates.Bytes)
+        if err != nil { return nil, err }
+    }
+    return sc, nil
+}
+
+// Document security object (EF.SOD): data group hashes signed by the
+// document signer.
+type SOD struct {
+    // Hash algorithm of the data group hashes
+    HashAlgorithm crypto.Hash
+    // Data group hashes by data group number
+    Hashes map[int][]byte
+    signedContent
+}
+
+// Parse EF.SOD.
+func ParseSOD(data []byte) (*SOD, error) {
+    obj, _, err := tlv.ParseOne(data)
+    if err != nil { return nil, err }
+    if obj.Tag != 0x77 { return nil, fmt.Errorf("invalid EF.SOD tag %s", obj.Tag) }
+    sc, err := parseSignedContent(obj.Value, oidLDSSecurityObject)
+    if err != nil { return nil, fmt.Errorf("invalid EF.SOD: %s", err) }
+    var lds ldsSecurityObject
+    if _, err := asn1.Unmarshal(sc.content, &lds); err != nil {
+        return nil, fmt.Errorf("invalid LDS security object: %s", err)
+    }
+    sod := &SOD{Hashes: map[int][]byte{}, signedContent: *sc}
+    if sod.HashAlgorithm, err = hashFromOID(
+        lds.HashAlgorithm.Algorithm); err != nil {
+        return nil, err
+    }
+    for _, h := range lds.Hashes {
+        sod.Hashes[h.Number] = h.Hash
+    }
+    return sod, nil
+}
+
+// Return certificate identified by the signer info.
+func (s *signedContent) signerCertificate() (*x509.Certificate, error) {
+    sid := s.signer.SID
+    for _, cert := range s.Certificates {
+        if sid.Class == asn1.ClassContextSpecific && sid.Tag == 0 {
+            if bytes.Equal(cert.SubjectKeyId, sid.Bytes) { return cert, nil }
+            continue
+        }
+        var ias issuerAndSerialNumber
+        if _, err := asn1.Unmarshal(sid.FullBytes, &ias); err != nil {
+            return nil, fmt.Errorf("invalid signer identifier: %s", err)
+        }
+        if bytes.Equal(cert.RawIssuer, ias.Issuer.FullBytes) &&
+            cert.SerialNumber.Cmp(ias.SerialNumber) == 0 {
+            return cert, nil
+        }
+    }
+    return nil, fmt.Errorf("document signer certificate not found")
+}
+
+// Verify signature of data by key with the signature algorithm of the
+// signer info.
+func verifySignature(key crypto.PublicKey, alg pkix.AlgorithmIdentifier,
+    hash crypto.Hash, data, sig []byte) error {
+    h := hash.New()
+    h.Write(data)
+    digest := h.Sum(nil)
+    switch k := key.(type) {
+        case *rsa.PublicKey:
+            if !alg.Algorithm.Equal(oidRSAPSS) {
+                return rsa.VerifyPKCS1v15(k, hash, digest, sig)
+            }
+            var params pssParameters
+            if _, err := asn1.Unmarshal(alg.Parameters.FullBytes,
+                &params); err != nil {
+                return fmt.Errorf("invalid PSS parameters: %s", err)
+            }
+            pssHash := crypto.SHA1
+            if params.Hash.Algorithm != nil {
+                var err error
+                pssHash, err = hashFromOID(params.Hash.Algorithm)
+                if err != nil { return err }
+            }
+            if pssHash != hash {
+                h = pssHash.New()
+                h.Write(data)
+                digest = h.Sum(nil)
+            }
+            return rsa.VerifyPSS(k, pssHash, digest, sig,
+                &rsa.PSSOptions{SaltLength: params.SaltLength})
+        case *ecdsa.PublicKey:
+            if !ecdsa.VerifyASN1(k, digest, sig) {
+                return fmt.Errorf("ECDSA signature verification failed")
+            }
+            return nil
+    }
+    return fmt.Errorf("unsupported signer key type %T", key)
+}
+
+// Verify signature of the security object and return the document signer
+// certificate. If cscas is not empty, the document signer certificate must
+// be issued by one of the country signing CAs, which is returned as well.
+// Certificate validity periods are not checked: documents remain valid
+// after their document signer certificate expired.
+func (s *SOD) Verify(cscas []*x509.Certificate) (dsc,
+    csca *x509.Certificate, err error) {
+    dsc, csca, err = s.verify(cscas)
+    if err != nil { return nil, nil, fmt.Errorf("EF.SOD: %s", err) }
+    return dsc, csca, nil
+}
+
+func (s *signedContent) verify(cscas []*x509.Certificate) (dsc,
+    csca *x509.Certificate, err error) {
+    if dsc, err = s.signerCertificate(); err != nil { return nil, nil, err }
+    hash, err := hashFromOID(s.signer.DigestAlgorithm.Algorithm)
+    if err != nil { return nil, nil, err }
+    signed := s.content
+    if len(s.signer.SignedAttrs.FullBytes) > 0 {
+        if err := s.checkSignedAttributes(hash); err != nil {
+            return nil, nil, err
+        }
+        // Signature covers the DER SET OF encoding of the attributes
+        signed = append([]byte{0x31}, s.signer.SignedAttrs.FullBytes[1:]...)
+    }
+    if err := verifySignature(dsc.PublicKey, s.signer.SignatureAlgorithm,
+        hash, signed, s.signer.Signature); err != nil {
+        return nil, nil, fmt.Errorf("signature invalid: %s", err)
+    }
+    if len(cscas) == 0 { return dsc, nil, nil }
+    for _, ca := range cscas {
+        if !bytes.Equal(dsc.RawIssuer, ca.RawSubject) { continue }
+        if dsc.CheckSignatureFrom(ca) == nil { return dsc, ca, nil }
+    }
+    return nil, nil, fmt.Errorf("document signer certificate not issued " +
+        "by a trusted CSCA")
+}
+
+func (s *signedContent) checkSignedAttributes(hash crypto.Hash) error {
+    data := s.signer.SignedAttrs.Bytes
+    var digest []byte
+    for len(data) > 0 {
+        var attr attribute
+        rest, err := asn1.Unmarshal(data, &attr)
+        if err != nil { return fmt.Errorf("invalid signed attribute: %s", err) }
+        data = rest
+        if len(attr.Values) != 1 { continue }
+        switch {
+            case attr.Type.Equal(oidContentType):
+                var ct asn1.ObjectIdentifier
+                if _, err := asn1.Unmarshal(attr.Values[0].FullBytes,
+                    &ct); err != nil || !ct.Equal(s.contentType) {
+                    return fmt.Errorf("content type attribute mismatch")
+                }
+            case attr.Type.Equal(oidMessageDigest):
+                if _, err := asn1.Unmarshal(attr.Values[0].FullBytes,
+                    &digest); err != nil {
+                    return fmt.Errorf("invalid message digest attribute")
+                }
+        }
+    }
+    h := hash.New()
+    h.Write(s.content)
+    if digest == nil || !bytes.Equal(digest, h.Sum(nil)) {
+        return fmt.Errorf("message digest attribute mismatch")
+    }
+    return nil
+}
+
+// Check hash of data group n against the security object.
+func (s *SOD) CheckDataGroup(n int, data []byte) error {
+    expected, ok := s.Hashes[n]
+    if !ok { return fmt.Errorf("no hash for DG%d in EF.SOD", n) }
+    h := s.HashAlgorithm.New()
+    h.Write(data)
+    if !bytes.Equal(h.Sum(nil), expected) {
+        return fmt.Errorf("DG%d hash mismatch", n)
+    }
+    return nil
+}
+
+// Read and parse EF.SOD.
+func (p *Passport) SOD() (*SOD, error) {
+    data, err := p.ReadFile(FID_SOD)
+    if err != nil { return nil, err }
+    return ParseSOD(data)
+}
+
+// Result of Passive Authentication.
+type PassiveAuthenticationResult struct {
+    // Document signer certificate
+    Signer *x509.Certificate
+    // Issuing country signing CA, nil if no CSCAs were given
+    CSCA *x509.Certificate
+    // Data groups whose hash was verified
+    Verified []int
+    // Data groups listed in EF.SOD which could not be read due to missing
+    // access rights (e.g. DG3 and DG4, which require EAC)
+    Unreadable []int
+}
+
+// Perform Passive Authentication: verify EF.SOD and the hashes of all
+// data groups it lists. With empty cscas the trust chain is not checked.
+func (p *Passport) PassiveAuthentication(cscas []*x509.Certificate) (
+    *PassiveAuthenticationResult, error) {
+    sod, err := p.SOD()
+    if err != nil { return nil, fmt.Errorf("reading EF.SOD: %s", err) }
+    result := &PassiveAuthenticationResult{}
+    if result.Signer, result.CSCA, err = sod.Verify(cscas); err != nil {
+        return nil, err
+    }
+    var groups []int
+    for n := range sod.Hashes {
+        groups = append(groups, n)
+    }
+    sort.Ints(groups)
+    for _, n := range groups {
+        data, err := p.DataGroup(n)
+        if e, ok := err.(smartcard.SWError); ok &&
+            (uint16(e) == SW.SECURITY_STATUS_NOT_SATISFIED ||
+            uint16(e) == SW.FILE_NOT_FOUND) {
+            result.Unreadable = append(result.Unreadable, n)
+            continue
+        }
+        if err != nil { return nil, err }
+        if err := sod.CheckDataGroup(n, data); err != nil { return nil, err }
+        result.Verified = append(result.Verified, n)
+    }
+    return result, nil
+}
@@ -0,0 +1,96 @@
+package emrtd
+
+import (
+    "bytes"
+    "encoding/hex"
+    "flag"
+    "io/ioutil"
+    "testing"
+    "github.com/sf1/go-card/smartcard"
+    "github.com/sf1/go-card/smartcard/mock"
+)
+
+var update = flag.Bool("update", false, "rewrite recorded traces")
+
+func TestBACTrace(t *testing.T) {
+    trace, err := mock.LoadTrace("testdata/bac.trace")
+    if err != nil { t.Fatal(err) }
+    p := New(trace)
+    rnd, _ := hex.DecodeString("781723860C06C226" +
+        "0B795240CB7049B01C19B33E32804F0B")
+    p.Rand = bytes.NewReader(rnd)
+    info := &MRZInfo{DocumentNumber: "L898902C", DateOfBirth: "690806",
+        DateOfExpiry: "940623"}
+    if err := p.BAC(info); err != nil { t.Fatal(err) }
+    com, err := p.COM()
+    if err != nil { t.Fatal(err) }
+    if com.LDSVersion != "0106" || com.UnicodeVersion != "040000" ||
+        !bytes.Equal(com.Tags, []byte{0x61, 0x75}) {
+        t.Errorf("unexpected EF.COM %+v", com)
+    }
+    trace.AssertExpectations(t)
+}
+
+// Trace of PACE (ECDH generic mapping, AES-128, brainpoolP256r1) with
+// MRZ password, recorded from the simulator with fixed randomness.
+func TestPACETrace(t *testing.T) {
+    const name = "pace.trace"
+    if *update {
+        var buf bytes.Buffer
+        p := New(mock.NewRecorder(newSimPassport(t, simOptions{
+            pace: protocol(OID_PACE_ECDH_GM, 2), paceParam: 13}), &buf))
+        p.Rand = newDetRand("terminal")
+        if err := p.Authenticate(MRZPassword(simInfo)); err != nil {
+            t.Fatal(err)
+        }
+        if _, err := p.DG1(); err != nil { t.Fatal(err) }
+        header := "# PACE ECDH-GM AES-128 brainpoolP256r1, MRZ password, " +
+            "read DG1 (simulator)\n"
+        err := ioutil.WriteFile("testdata/" + name, append([]byte(header),
+            buf.Bytes()...), 0644)
+        if err != nil { t.Fatal(err) }
+    }
+    trace, err := mock.LoadTrace("testdata/" + name)
+    if err != nil { t.Fatal(err) }
+    p := New(trace)
+    p.Rand = newDetRand("terminal")
+    if err := p.Authenticate(MRZPassword(simInfo)); err != nil { t.Fatal(err) }
+    mrz, err := p.DG1()
+    if err != nil { t.Fatal(err) }
+    if mrz.Raw != simMRZ { t.Errorf("unexpected MRZ %s", mrz.Raw) }
+    trace.AssertExpectations(t)
+}
+
+// Trace of EAC with PIN: PACE with CHAT, Terminal Authentication with a
+// link certificate (command chaining), Chip Authentication version 2 and
+// reading DG4 of the eID application, recorded from the simulator.
+func TestEACTrace(t *testing.T) {
+    const name = "eac.trace"
+    chain, key := simTerminal(t, "UTTERM00001", AT_READ_DG1 + 3)
+    eac := func(card smartcard.Transmitter) []byte {
+        p := New(card)
+        p.Rand = newDetRand("terminal")
+        if err := p.EAC(PINPassword("123456"), chain, key, nil); err != nil {
+            t.Fatal(err)
+        }
+        if err := p.SelectEID(); err != nil { t.Fatal(err) }
+        dg4, err := p.DataGroup(4)
+        if err != nil { t.Fatal(err) }
+        return dg4
+    }
+    if *update {
+        var buf bytes.Buffer
+        eac(mock.NewRecorder(newEACPassport(t), &buf))
+        header := "# EAC with PIN, brainpoolP256r1, AES-128: PACE, TA, CA " +
+            "v2, read eID DG4 (simulator)\n"
+        err := ioutil.WriteFile("testdata/" + name, append([]byte(header),
+            buf.Bytes()...), 0644)
+        if err != nil { t.Fatal(err) }
+    }
+    trace, err := mock.LoadTrace("testdata/" + name)
+    if err != nil { t.Fatal(err) }
+    if dg4 := eac(trace); !bytes.Contains(dg4, []byte("ERIKA")) {
+        t.Errorf("unexpected DG4 %X", dg4)
+    }
+    trace.AssertExpectations(t)
+}
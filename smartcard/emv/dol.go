@@ -0,0 +1,138 @@
+package emv
+
+import (
+    "crypto/rand"
+    "encoding/binary"
+    "fmt"
+    "time"
+    "github.com/sf1/go-card/smartcard/tlv"
+)
+
+// Data Object List entry.
+type DOLEntry struct {
+    Tag tlv.Tag
+    Length int
+}
+
+// Parse Data Object List (tag and length pairs, e.g. PDOL or CDOL1).
+func ParseDOL(dol []byte) ([]DOLEntry, error) {
+    var entries []DOLEntry
+    for len(dol) > 0 {
+        var entry DOLEntry
+        var err error
+        entry.Tag, dol, err = tlv.ParseTag(dol)
+        if err != nil { return nil, err }
+        entry.Length, dol, err = tlv.ParseLength(dol)
+        if err != nil { return nil, err }
+        entries = append(entries, entry)
+    }
+    return entries, nil
+}
+
+// Data elements by tag, used as source for DOL-related data.
+type Data map[tlv.Tag][]byte
+
+// Build DOL-related data (EMV Book 3, 5.4). Missing data elements are
+// zero filled, values are truncated or padded according to their format.
+func BuildDOL(dol []byte, data Data) ([]byte, error) {
+    entries, err := ParseDOL(dol)
+    if err != nil { return nil, err }
+    var out []byte
+    for _, e := range entries {
+        value, ok := data[e.Tag]
+        if !ok || e.Tag.Constructed() {
+            out = append(out, make([]byte, e.Length)...)
+            continue
+        }
+        out = append(out, fitValue(value, e.Length, Lookup(e.Tag).Format)...)
+    }
+    return out, nil
+}
+
+func fitValue(value []byte, length int, format Format) []byte {
+    out := make([]byte, length)
+    switch {
+        case len(value) >= length && format == FORMAT_N:
+            // numeric: rightmost bytes
+            copy(out, value[len(value)-length:])
+        case len(value) >= length:
+            copy(out, value[:length])
+        case format == FORMAT_N:
+            copy(out[length-len(value):], value)
+        case format == FORMAT_CN:
+            copy(out, value)
+            for i := len(value); i < length; i++ {
+                out[i] = 0xff
+            }
+        default:
+            copy(out, value)
+    }
+    return out
+}
+
+// Split DOL-related data back into data elements.
+func ParseDOLData(dol, data []byte) (Data, error) {
+    entries, err := ParseDOL(dol)
+    if err != nil { return nil, err }
+    result := make(Data)
+    for _, e := range entries {
+        if len(data) < e.Length {
+            return nil, fmt.Errorf("DOL data too short for tag %s", e.Tag)
+        }
+        result[e.Tag], data = data[:e.Length], data[e.Length:]
+    }
+    return result, nil
+}
+
+// Encode n as numeric (BCD) value of size bytes.
+func BCD(n uint64, size int) []byte {
+    out := make([]byte, size)
+    for i := size - 1; i >= 0; i-- {
+        out[i] = byte(n % 10) | byte(n / 10 % 10) << 4
+        n /= 100
+    }
+    return out
+}
+
+// Return terminal data for a zero amount purchase in the US, today, with
+// a random unpredictable number. Callers may override any element.
+func DefaultTerminalData() Data {
+    now := time.Now()
+    un := make([]byte, 4)
+    rand.Read(un)
+    tvr := make([]byte, 5)
+    return Data{
+        0x9f02: BCD(0, 6), // Amount, Authorised
+        0x9f03: BCD(0, 6), // Amount, Other
+        0x9f1a: BCD(840, 2), // Terminal Country Code
+        0x95: tvr, // Terminal Verification Results
+        0x5f2a: BCD(840, 2), // Transaction Currency Code
+        0x9a: BCD(uint64(now.Year() % 100 * 10000 + int(now.Month()) * 100 +
+            now.Day()), 3), // Transaction Date
+        0x9f21: BCD(uint64(now.Hour() * 10000 + now.Minute() * 100 +
+            now.Second()), 3), // Transaction Time
+        0x9c: {0x00}, // Transaction Type: purchase
+        0x9f37: un, // Unpredictable Number
+        0x9f35: {0x22}, // Terminal Type: attended, offline with online
+        0x9f33: {0xe0, 0xf0, 0xc8}, // Terminal Capabilities
+        0x9f40: {0x60, 0x00, 0xf0, 0xa0, 0x01}, // Additional Capabilities
+        0x9f66: {0x36, 0x00, 0x40, 0x00}, // Terminal Transaction Qualifiers
+        0x9f7a: {0x00}, // VLP Terminal Support Indicator
+    }
+}
+
+// Return value of n-format data element as integer.
+func DecodeBCD(data []byte) uint64 {
+    var n uint64
+    for _, b := range data {
+        n = n * 100 + uint64(b >> 4) * 10 + uint64(b & 0x0f)
+    }
+    return n
+}
+
+func uint16Value(data []byte) uint16 {
+    if len(data) < 2 {
+        return 0
+    }
+    return binary.BigEndian.Uint16(data)
+}
@@ -0,0 +1,375 @@
+/*
+Package emv implements the card side of EMV contact transactions as specified
+in EMV Books 1 and 3: application selection via the Payment System
+Environment or a list of AIDs, GET PROCESSING OPTIONS, reading of application
+data and transaction logs, and offline data authentication (SDA, DDA and CDA)
+as specified in EMV Book 2.
+
+Example:
+
+    c := emv.New(card)
+    candidates, err := c.BuildCandidateList(emv.DefaultAIDs)
+    // handle error, if any
+    fci, err := c.SelectApplication(candidates[0].AID)
+    // handle error, if any
+    po, err := c.GetProcessingOptions(fci.PDOL, emv.DefaultTerminalData())
+    // handle error, if any
+    records, err := c.ReadApplicationData(po.AFL)
+*/
+package emv
+
+import (
+    "bytes"
+    "fmt"
+    "sort"
+    "github.com/sf1/go-card/smartcard"
+    "github.com/sf1/go-card/smartcard/SW"
+    "github.com/sf1/go-card/smartcard/tlv"
+)
+
+// Payment System Environment directory name.
+var PSE = []byte("1PAY.SYS.DDF01")
+
+const (
+    // Instructions
+    INS_SELECT = 0xa4
+    INS_READ_RECORD = 0xb2
+    INS_GET_PROCESSING_OPTIONS = 0xa8
+    INS_GET_DATA = 0xca
+    // Tags
+    TAG_FCI = 0x6f
+    TAG_DF_NAME = 0x84
+    TAG_FCI_PROPRIETARY = 0xa5
+    TAG_SFI = 0x88
+    TAG_LANGUAGE = 0x5f2d
+    TAG_ISSUER_CODE_TABLE_INDEX = 0x9f11
+    TAG_FCI_ISSUER_DISCRETIONARY = 0xbf0c
+    TAG_APPLICATION_TEMPLATE = 0x61
+    TAG_AID = 0x4f
+    TAG_APPLICATION_LABEL = 0x50
+    TAG_PREFERRED_NAME = 0x9f12
+    TAG_PRIORITY = 0x87
+    TAG_PDOL = 0x9f38
+    TAG_RECORD_TEMPLATE = 0x70
+    TAG_RESPONSE_FORMAT_1 = 0x80
+    TAG_RESPONSE_FORMAT_2 = 0x77
+    TAG_AIP = 0x82
+    TAG_AFL = 0x94
+    TAG_COMMAND_TEMPLATE = 0x83
+    TAG_ATC = 0x9f36
+    TAG_LAST_ONLINE_ATC = 0x9f13
+    TAG_PIN_TRY_COUNTER = 0x9f17
+    TAG_LOG_ENTRY = 0x9f4d
+    TAG_LOG_FORMAT = 0x9f4f
+)
+
+// EMV card.
+type Card struct {
+    card smartcard.Transmitter
+}
+
+// Create EMV card from transmitter, e.g. a *smartcard.Card.
+func New(card smartcard.Transmitter) *Card {
+    return &Card{card: card}
+}
+
+// Return underlying transmitter.
+func (c *Card) Transmitter() smartcard.Transmitter {
+    return c.card
+}
+
+// Application supported by the terminal.
+type TerminalAID struct {
+    AID []byte
+    // Application Selection Indicator: allow card AIDs that extend AID
+    PartialMatch bool
+}
+
+// AIDs of common payment schemes, all allowing partial matches.
+var DefaultAIDs = []TerminalAID{
+    {[]byte{0xa0, 0x00, 0x00, 0x00, 0x03}, true}, // Visa
+    {[]byte{0xa0, 0x00, 0x00, 0x00, 0x04}, true}, // Mastercard
+    {[]byte{0xa0, 0x00, 0x00, 0x00, 0x25}, true}, // American Express
+    {[]byte{0xa0, 0x00, 0x00, 0x01, 0x52}, true}, // Discover
+    {[]byte{0xa0, 0x00, 0x00, 0x00, 0x65}, true}, // JCB
+    {[]byte{0xa0, 0x00, 0x00, 0x03, 0x33}, true}, // UnionPay
+}
+
+// Check if card AID matches terminal AID.
+func (t TerminalAID) Matches(aid []byte) bool {
+    if len(aid) < len(t.AID) || !bytes.Equal(aid[:len(t.AID)], t.AID) {
+        return false
+    }
+    return len(aid) == len(t.AID) || t.PartialMatch
+}
+
+// Application found during application selection.
+type Application struct {
+    AID []byte
+    Label string
+    PreferredName string
+    // 1 (highest) to 15, 0 if not given
+    Priority int
+    // Cardholder confirmation required before selection
+    ConfirmationRequired bool
+    Language string
+    IssuerCodeTableIndex int
+}
+
+func parseApplication(list tlv.List) Application {
+    app := Application{
+        AID: list.Value(TAG_AID),
+        Label: string(list.Value(TAG_APPLICATION_LABEL)),
+        PreferredName: string(list.Value(TAG_PREFERRED_NAME)),
+        Language: string(list.Value(TAG_LANGUAGE)),
+    }
+    if app.AID == nil {
+        app.AID = list.Value(TAG_DF_NAME)
+    }
+    if p := list.Value(TAG_PRIORITY); len(p) == 1 {
+        app.Priority = int(p[0] & 0x0f)
+        app.ConfirmationRequired = p[0] & 0x80 != 0
+    }
+    if i := list.Value(TAG_ISSUER_CODE_TABLE_INDEX); len(i) == 1 {
+        app.IssuerCodeTableIndex = int(i[0])
+    }
+    return app
+}
+
+// File Control Information returned by SELECT.
+type FCI struct {
+    DFName []byte
+    // SFI of the directory elementary file (PSE only)
+    SFI int
+    Application
+    PDOL []byte
+    // FCI Issuer Discretionary Data (BF0C)
+    IssuerDiscretionary tlv.List
+    // Complete FCI template contents
+    Data tlv.List
+}
+
+// Log entry (SFI and number of records) if present.
+func (f *FCI) LogEntry() (sfi, records int, ok bool) {
+    entry := f.IssuerDiscretionary.Value(TAG_LOG_ENTRY)
+    if len(entry) != 2 {
+        return 0, 0, false
+    }
+    return int(entry[0]), int(entry[1]), true
+}
+
+func parseFCI(data []byte) (*FCI, error) {
+    list, err := tlv.Parse(data)
+    if err != nil { return nil, err }
+    fci, ok := list.Find(TAG_FCI)
+    if !ok {
+        return nil, fmt.Errorf("FCI template missing")
+    }
+    list, err = fci.Children()
+    if err != nil { return nil, err }
+    result := &FCI{DFName: list.Value(TAG_DF_NAME), Data: list}
+    prop, err := tlv.Parse(list.Value(TAG_FCI_PROPRIETARY))
+    if err != nil { return nil, err }
+    prop = append(tlv.List{tlv.New(TAG_DF_NAME, result.DFName)}, prop...)
+    result.Application = parseApplication(prop)
+    result.PDOL = prop.Value(TAG_PDOL)
+    if sfi := prop.Value(TAG_SFI); len(sfi) == 1 {
+        result.SFI = int(sfi[0])
+    }
+    if bf0c, ok := prop.Find(TAG_FCI_ISSUER_DISCRETIONARY); ok {
+        result.IssuerDiscretionary, err = bf0c.Children()
+        if err != nil { return nil, err }
+    }
+    return result, nil
+}
+
+// Send SELECT by name. next selects the next occurrence (P2 02).
+func (c *Card) selectName(name []byte, next bool) (*FCI, uint16, error) {
+    p2 := byte(0x00)
+    if next {
+        p2 = 0x02
+    }
+    rsp, err := smartcard.TransmitAndGetResponse(c.card, smartcard.Command4(
+        0x00, INS_SELECT, 0x04, p2, name, 0x00))
+    if err != nil { return nil, 0, err }
+    if rsp.SW() != SW.SUCCESS && rsp.SW() != SW.FILE_INVALIDATED {
+        return nil, rsp.SW(), nil
+    }
+    fci, err := parseFCI(rsp.Data())
+    return fci, rsp.SW(), err
+}
+
+// Select application by AID and return its FCI.
+func (c *Card) SelectApplication(aid []byte) (*FCI, error) {
+    fci, sw, err := c.selectName(aid, false)
+    if err != nil { return nil, err }
+    switch sw {
+        case SW.SUCCESS:
+            return fci, nil
+        case SW.FILE_INVALIDATED:
+            return nil, fmt.Errorf("application %X is blocked", aid)
+    }
+    return nil, fmt.Errorf("can't select application %X: %s", aid,
+        smartcard.SWError(sw))
+}
+
+// Read record from short file identifier.
+func (c *Card) ReadRecord(sfi, record int) ([]byte, error) {
+    rsp, err := smartcard.TransmitAndGetResponse(c.card, smartcard.Command2(
+        0x00, INS_READ_RECORD, byte(record), byte(sfi << 3 | 0x04), 0x00))
+    if err != nil { return nil, err }
+    if rsp.SW() != SW.SUCCESS {
+        return nil, smartcard.SWError(rsp.SW())
+    }
+    return rsp.Data(), nil
+}
+
+// Select the PSE and read the applications listed in its directory.
+func (c *Card) ReadPSE() ([]Application, error) {
+    fci, sw, err := c.selectName(PSE, false)
+    if err != nil { return nil, err }
+    if sw != SW.SUCCESS {
+        return nil, fmt.Errorf("can't select PSE: %s", smartcard.SWError(sw))
+    }
+    if fci.SFI < 1 || fci.SFI > 10 {
+        return nil, fmt.Errorf("invalid directory SFI %d", fci.SFI)
+    }
+    var apps []Application
+    for record := 1; ; record++ {
+        data, err := c.ReadRecord(fci.SFI, record)
+        if err == smartcard.SWError(SW.RECORD_NOT_FOUND) {
+            break
+        }
+        if err != nil { return nil, err }
+        list, err := tlv.Parse(data)
+        if err != nil { return nil, err }
+        template, ok := list.Find(TAG_RECORD_TEMPLATE)
+        if !ok {
+            return nil, fmt.Errorf("directory record %d: template missing",
+                record)
+        }
+        entries, err := template.Children()
+        if err != nil { return nil, err }
+        for _, entry := range entries.FindAll(TAG_APPLICATION_TEMPLATE) {
+            fields, err := entry.Children()
+            if err != nil { return nil, err }
+            apps = append(apps, parseApplication(fields))
+        }
+    }
+    return apps, nil
+}
+
+// Build the candidate list (EMV Book 1, 12.3). The PSE is tried first;
+// if it is not present or lists no matching application, each terminal
+// AID is selected in turn. The result is sorted by priority.
+func (c *Card) BuildCandidateList(supported []TerminalAID) (
+    []Application, error) {
+    var candidates []Application
+    apps, err := c.ReadPSE()
+    if err == nil {
+        for _, app := range apps {
+            for _, t := range supported {
+                if t.Matches(app.AID) {
+                    candidates = append(candidates, app)
+                    break
+                }
+            }
+        }
+    }
+    if len(candidates) == 0 {
+        candidates, err = c.selectAIDs(supported)
+        if err != nil { return nil, err }
+    }
+    sortCandidates(candidates)
+    return candidates, nil
+}
+
+// List of AIDs method (EMV Book 1, 12.3.3). Each AID is selected with
+// first and then next occurrence until the card reports no further match.
+func (c *Card) selectAIDs(supported []TerminalAID) ([]Application, error) {
+    var candidates []Application
+    for _, t := range supported {
+        var previous []byte
+        for next := false; ; next = true {
+            fci, sw, err := c.selectName(t.AID, next)
+            if err != nil { return nil, err }
+            if sw == SW.FUNCTION_NOT_SUPPORTED {
+                return nil, fmt.Errorf("card blocked or SELECT not supported")
+            }
+            if sw != SW.SUCCESS && sw != SW.FILE_INVALIDATED {
+                break
+            }
+            // guard against cards ignoring the next occurrence option
+            if next && bytes.Equal(fci.DFName, previous) {
+                break
+            }
+            previous = fci.DFName
+            // blocked applications are not added
+            if sw == SW.SUCCESS && t.Matches(fci.DFName) {
+                candidates = append(candidates, fci.Application)
+            }
+        }
+    }
+    return candidates, nil
+}
+
+func sortCandidates(apps []Application) {
+    sort.SliceStable(apps, func(i, j int) bool {
+        pi, pj := apps[i].Priority, apps[j].Priority
+        if pi == 0 {
+            pi = 16
+        }
+        if pj == 0 {
+            pj = 16
+        }
+        return pi < pj
+    })
+}
+
+// Send GET DATA for primitive data object (ATC, PIN try counter, log
+// format, ...).
+func (c *Card) GetData(tag tlv.Tag) ([]byte, error) {
+    rsp, err := smartcard.TransmitAndGetResponse(c.card, smartcard.Command2(
+        0x80, INS_GET_DATA, byte(tag >> 8), byte(tag), 0x00))
+    if err != nil { return nil, err }
+    if rsp.SW() != SW.SUCCESS {
+        return nil, smartcard.SWError(rsp.SW())
+    }
+    list, err := tlv.Parse(rsp.Data())
+    if err != nil { return nil, err }
+    obj, ok := list.Find(tag)
+    if !ok {
+        return nil, fmt.Errorf("GET DATA response lacks tag %s", tag)
+    }
+    return obj.Value, nil
+}
+
+// Read Application Transaction Counter.
+func (c *Card) ATC() (int, error) {
+    return c.getCounter(TAG_ATC)
+}
+
+// Read ATC of the last online transaction.
+func (c *Card) LastOnlineATC() (int, error) {
+    return c.getCounter(TAG_LAST_ONLINE_ATC)
+}
+
+// Read number of remaining PIN tries.
+func (c *Card) PINTryCounter() (int, error) {
+    return c.getCounter(TAG_PIN_TRY_COUNTER)
+}
+
+// Read log format (a DOL describing transaction log records).
+func (c *Card) LogFormat() ([]byte, error) {
+    return c.GetData(TAG_LOG_FORMAT)
+}
+
+func (c *Card) getCounter(tag tlv.Tag) (int, error) {
+    data, err := c.GetData(tag)
+    if err != nil { return 0, err }
+    value := 0
+    for _, b := range data {
+        value = value << 8 | int(b)
+    }
+    return value, nil
+}
@@ -0,0 +1,141 @@
+package emv
+
+import (
+    "bytes"
+    "strings"
+    "testing"
+    "github.com/sf1/go-card/smartcard/mock"
+    "github.com/sf1/go-card/smartcard/tlv"
+)
+
+func TestPSETransaction(t *testing.T) {
+    trace, err := mock.LoadTrace("testdata/pse.trace")
+    if err != nil { t.Fatal(err) }
+    card := New(trace)
+    candidates, err := card.BuildCandidateList(DefaultAIDs)
+    if err != nil { t.Fatal(err) }
+    if len(candidates) != 2 || candidates[0].Label != "VISA DEBIT" ||
+        candidates[1].Label != "V PAY" {
+        t.Fatalf("unexpected candidates: %+v", candidates)
+    }
+    fci, err := card.SelectApplication(candidates[0].AID)
+    if err != nil { t.Fatal(err) }
+    if fci.PreferredName != "Visa Debit" || fci.IssuerCodeTableIndex != 1 {
+        t.Errorf("unexpected FCI: %+v", fci)
+    }
+    sfi, records, ok := fci.LogEntry()
+    if !ok || sfi != 11 || records != 5 {
+        t.Errorf("unexpected log entry: %d %d %t", sfi, records, ok)
+    }
+    terminal := Data{
+        0x9f66: {0x36, 0x00, 0x40, 0x00},
+        0x9f02: BCD(1234, 6),
+        0x9f37: {0x01, 0x02, 0x03, 0x04},
+        0x5f2a: BCD(978, 2),
+    }
+    po, err := card.GetProcessingOptions(fci.PDOL, terminal)
+    if err != nil { t.Fatal(err) }
+    if !po.Supports(AIP_CDA) || po.Supports(AIP_SDA) || len(po.AFL) != 3 {
+        t.Errorf("unexpected processing options: %+v", po)
+    }
+    app, err := card.ReadApplicationData(po.AFL)
+    if err != nil { t.Fatal(err) }
+    if len(app.Records) != 6 {
+        t.Errorf("expected 6 records, got %d", len(app.Records))
+    }
+    if pan := FormatValue(0x5a, app.Data.Value(0x5a)); pan !=
+        "4761739001010010" {
+        t.Errorf("unexpected PAN %s", pan)
+    }
+    // template contents of SFI 2 record 1 and SFI 3 record 1
+    expected := append(app.Records[1].Data[2:], app.Records[4].Data[2:]...)
+    if !bytes.Equal(app.OfflineAuthData, expected) {
+        t.Errorf("unexpected offline authentication data %X",
+            app.OfflineAuthData)
+    }
+    atc, err := card.ATC()
+    if err != nil { t.Fatal(err) }
+    if atc != 0x42 {
+        t.Errorf("unexpected ATC %d", atc)
+    }
+    tries, err := card.PINTryCounter()
+    if err != nil { t.Fatal(err) }
+    if tries != 3 {
+        t.Errorf("unexpected PIN try counter %d", tries)
+    }
+    format, err := card.LogFormat()
+    if err != nil { t.Fatal(err) }
+    log, err := card.TransactionLog(sfi, records, format)
+    if err != nil { t.Fatal(err) }
+    if len(log) != 2 || DecodeBCD(log[0][0x9f02]) != 2500 ||
+        DecodeBCD(log[1][0x9a]) != 210314 {
+        t.Errorf("unexpected transaction log: %v", log)
+    }
+    trace.AssertExpectations(t)
+}
+
+func TestListOfAIDs(t *testing.T) {
+    trace, err := mock.LoadTrace("testdata/aids.trace")
+    if err != nil { t.Fatal(err) }
+    candidates, err := New(trace).BuildCandidateList(DefaultAIDs)
+    if err != nil { t.Fatal(err) }
+    // Maestro is blocked, DEBIT (priority 1, confirmation) sorts first
+    if len(candidates) != 2 || candidates[0].Label != "DEBIT" ||
+        !candidates[0].ConfirmationRequired ||
+        candidates[1].Label != "MASTERCARD" {
+        t.Errorf("unexpected candidates: %+v", candidates)
+    }
+    trace.AssertExpectations(t)
+}
+
+func TestBuildDOL(t *testing.T) {
+    dol := []byte{0x9f, 0x02, 0x06, 0x5a, 0x0a, 0x50, 0x04, 0x9f, 0x37,
+        0x02, 0xdf, 0x01, 0x02}
+    data := Data{
+        0x9f02: {0x12, 0x34},
+        0x5a: {0x47, 0x61, 0x73, 0x90, 0x01, 0x01, 0x00, 0x10},
+        0x50: []byte("VISA DEBIT"),
+        0x9f37: {0x01, 0x02, 0x03, 0x04},
+    }
+    out, err := BuildDOL(dol, data)
+    if err != nil { t.Fatal(err) }
+    expected := []byte{
+        0x00, 0x00, 0x00, 0x00, 0x12, 0x34, // n: left padded
+        0x47, 0x61, 0x73, 0x90, 0x01, 0x01, 0x00, 0x10, 0xff, 0xff, // cn
+        'V', 'I', 'S', 'A', // an: leftmost bytes
+        0x01, 0x02, // b: leftmost bytes
+        0x00, 0x00, // unknown
+    }
+    if !bytes.Equal(out, expected) {
+        t.Errorf("expected %X, got %X", expected, out)
+    }
+    parsed, err := ParseDOLData(dol, out)
+    if err != nil { t.Fatal(err) }
+    if !bytes.Equal(parsed[0x9f37], []byte{0x01, 0x02}) {
+        t.Errorf("unexpected parsed data %v", parsed)
+    }
+}
+
+func TestParseAFL(t *testing.T) {
+    if _, err := ParseAFL([]byte{0x08, 0x02, 0x01, 0x00}); err == nil {
+        t.Error("invalid record range accepted")
+    }
+    if _, err := ParseAFL([]byte{0x08, 0x01, 0x01}); err == nil {
+        t.Error("truncated AFL accepted")
+    }
+}
+
+func TestDump(t *testing.T) {
+    list, err := tlv.Parse([]byte{0x70, 0x09, 0x5f, 0x20, 0x03, 'D', 'O',
+        'E', 0x9c, 0x01, 0x00})
+    if err != nil { t.Fatal(err) }
+    expected := "70 READ RECORD Response Message Template\n" +
+        "  5F20 Cardholder Name: \"DOE\"\n" +
+        "  9C Transaction Type: 00\n"
+    if out := Dump(list); out != expected {
+        t.Errorf("unexpected dump:\n%s", out)
+    }
+    if !strings.HasPrefix(Lookup(0xdf01).Name, "Unknown") {
+        t.Error("unknown tag found in dictionary")
+    }
+}
@@ -0,0 +1,472 @@
+package emv
+
+import (
+    "bytes"
+    "crypto/rsa"
+    "crypto/sha1"
+    "fmt"
+    "math/big"
+    "strings"
+    "time"
+    "github.com/sf1/go-card/smartcard"
+    "github.com/sf1/go-card/smartcard/SW"
+    "github.com/sf1/go-card/smartcard/tlv"
+)
+
+const (
+    // Instructions
+    INS_INTERNAL_AUTHENTICATE = 0x88
+    INS_GENERATE_AC = 0xae
+    // GENERATE AC reference control parameter
+    AC_AAC = 0x00
+    AC_TC = 0x40
+    AC_ARQC = 0x80
+    AC_CDA = 0x10
+    // Tags
+    TAG_CA_KEY_INDEX = 0x8f
+    TAG_ISSUER_CERTIFICATE = 0x90
+    TAG_ISSUER_REMAINDER = 0x92
+    TAG_ISSUER_EXPONENT = 0x9f32
+    TAG_SSAD = 0x93
+    TAG_DATA_AUTHENTICATION_CODE = 0x9f45
+    TAG_ICC_CERTIFICATE = 0x9f46
+    TAG_ICC_EXPONENT = 0x9f47
+    TAG_ICC_REMAINDER = 0x9f48
+    TAG_DDOL = 0x9f49
+    TAG_SDA_TAG_LIST = 0x9f4a
+    TAG_SDAD = 0x9f4b
+    TAG_ICC_DYNAMIC_NUMBER = 0x9f4c
+    TAG_PAN = 0x5a
+    TAG_CID = 0x9f27
+    TAG_APPLICATION_CRYPTOGRAM = 0x9f26
+    TAG_ISSUER_APPLICATION_DATA = 0x9f10
+    TAG_UNPREDICTABLE_NUMBER = 0x9f37
+    // Hash algorithm indicator
+    HASH_SHA1 = 0x01
+)
+
+// Default DDOL used if the card doesn't supply one.
+var DefaultDDOL = []byte{0x9f, 0x37, 0x04}
+
+// Certification Authority public key.
+type CAPublicKey struct {
+    // Registered application provider identifier (first 5 bytes of AID)
+    RID []byte
+    Index byte
+    Modulus []byte
+    Exponent []byte
+}
+
+// Return RSA public key.
+func (k *CAPublicKey) PublicKey() *rsa.PublicKey {
+    return newPublicKey(k.Modulus, k.Exponent)
+}
+
+// Set of CA public keys.
+type CAKeys []CAPublicKey
+
+// Find CA public key by RID and index.
+func (keys CAKeys) Find(rid []byte, index byte) (*CAPublicKey, bool) {
+    for i := range keys {
+        if bytes.Equal(keys[i].RID, rid) && keys[i].Index == index {
+            return &keys[i], true
+        }
+    }
+    return nil, false
+}
+
+func newPublicKey(modulus, exponent []byte) *rsa.PublicKey {
+    return &rsa.PublicKey{
+        N: new(big.Int).SetBytes(modulus),
+        E: int(new(big.Int).SetBytes(exponent).Int64()),
+    }
+}
+
+// Recover data signed with the EMV signature scheme (ISO 9796-2 with
+// message recovery, EMV Book 2 Annex A2.1) and check header, trailer,
+// format and hash. extra is hashed after the recovered data.
+func recoverSigned(key *rsa.PublicKey, signature []byte, format byte,
+    extra ...[]byte) ([]byte, error) {
+    size := (key.N.BitLen() + 7) / 8
+    if len(signature) != size {
+        return nil, fmt.Errorf("signature length %d doesn't match key " +
+            "length %d", len(signature), size)
+    }
+    s := new(big.Int).SetBytes(signature)
+    if s.Cmp(key.N) >= 0 {
+        return nil, fmt.Errorf("signature out of range")
+    }
+    m := new(big.Int).Exp(s, big.NewInt(int64(key.E)), key.N).Bytes()
+    recovered := make([]byte, size)
+    copy(recovered[size-len(m):], m)
+    if recovered[0] != 0x6a || recovered[size-1] != 0xbc {
+        return nil, fmt.Errorf("invalid recovered data header or trailer")
+    }
+    if recovered[1] != format {
+        return nil, fmt.Errorf("unexpected format %02X, expected %02X",
+            recovered[1], format)
+    }
+    body := recovered[1:size-21]
+    hash := recovered[size-21:size-1]
+    h := sha1.New()
+    h.Write(body)
+    for _, e := range extra {
+        h.Write(e)
+    }
+    if !bytes.Equal(h.Sum(nil), hash) {
+        return nil, fmt.Errorf("hash mismatch")
+    }
+    return body, nil
+}
+
+// Public key recovered from an issuer or ICC public key certificate.
+type PublicKeyCertificate struct {
+    // Issuer identifier (issuer certificates) or PAN (ICC certificates),
+    // cn format
+    ID []byte
+    // Expiry month (first day, UTC); the certificate is valid until the
+    // end of that month
+    Expiry time.Time
+    Serial []byte
+    PublicKey *rsa.PublicKey
+}
+
+// Recover certificate contents (EMV Book 2, 5.3 and 6.4).
+func recoverCertificate(key *rsa.PublicKey, cert, remainder,
+    exponent []byte, format byte, idLength int, static []byte,
+    now time.Time) (*PublicKeyCertificate, error) {
+    body, err := recoverSigned(key, cert, format, remainder, exponent,
+        static)
+    if err != nil { return nil, err }
+    // format, ID, expiry (2), serial (3), hash alg, key alg, key length,
+    // exponent length, key
+    header := 1 + idLength + 2 + 3 + 4
+    if len(body) < header {
+        return nil, fmt.Errorf("certificate too short")
+    }
+    fields := body[1+idLength:header]
+    result := &PublicKeyCertificate{
+        ID: body[1:1+idLength],
+        Serial: fields[2:5],
+    }
+    if fields[5] != HASH_SHA1 || fields[6] != 0x01 {
+        return nil, fmt.Errorf("unsupported algorithm %02X/%02X", fields[5],
+            fields[6])
+    }
+    month, year := int(DecodeBCD(fields[:1])), int(DecodeBCD(fields[1:2]))
+    if month < 1 || month > 12 {
+        return nil, fmt.Errorf("invalid expiry date %X", fields[:2])
+    }
+    // Valid through the expiry month
+    result.Expiry = time.Date(2000 + year, time.Month(month), 1, 0, 0, 0, 0,
+        time.UTC)
+    if !now.Before(result.Expiry.AddDate(0, 1, 0)) {
+        return nil, fmt.Errorf("certificate expired %02d/%02d", month, year)
+    }
+    keyLength, exponentLength := int(fields[7]), int(fields[8])
+    if exponentLength != len(exponent) {
+        return nil, fmt.Errorf("exponent length mismatch")
+    }
+    modulus := append([]byte{}, body[header:]...)
+    if keyLength <= len(modulus) {
+        for _, b := range modulus[keyLength:] {
+            if b != 0xbb {
+                return nil, fmt.Errorf("invalid public key padding")
+            }
+        }
+        modulus = modulus[:keyLength]
+        if len(remainder) != 0 {
+            return nil, fmt.Errorf("unexpected public key remainder")
+        }
+    } else {
+        modulus = append(modulus, remainder...)
+        if len(modulus) != keyLength {
+            return nil, fmt.Errorf("public key remainder length mismatch")
+        }
+    }
+    result.PublicKey = newPublicKey(modulus, exponent)
+    return result, nil
+}
+
+// Check if cn formatted identifier matches the leftmost PAN digits.
+func matchPAN(id, pan []byte) bool {
+    digits := FormatValue(TAG_PAN, id)
+    return len(digits) >= 3 &&
+        strings.HasPrefix(FormatValue(TAG_PAN, pan), digits)
+}
+
+// Recover issuer public key (EMV Book 2, 5.3) from the issuer public key
+// certificate, remainder and exponent in data using the CA key.
+func RecoverIssuerKey(ca *CAPublicKey, data tlv.List, now time.Time) (
+    *PublicKeyCertificate, error) {
+    cert, ok := data.Find(TAG_ISSUER_CERTIFICATE)
+    if !ok {
+        return nil, fmt.Errorf("issuer public key certificate missing")
+    }
+    result, err := recoverCertificate(ca.PublicKey(), cert.Value,
+        data.Value(TAG_ISSUER_REMAINDER), data.Value(TAG_ISSUER_EXPONENT),
+        0x02, 4, nil, now)
+    if err != nil {
+        return nil, fmt.Errorf("issuer public key certificate: %s", err)
+    }
+    if !matchPAN(result.ID, data.Value(TAG_PAN)) {
+        return nil, fmt.Errorf("issuer identifier %X doesn't match PAN",
+            result.ID)
+    }
+    return result, nil
+}
+
+// Recover ICC public key (EMV Book 2, 6.4) using the issuer public key.
+// static is the static data to be authenticated.
+func RecoverICCKey(issuer *rsa.PublicKey, data tlv.List, static []byte,
+    now time.Time) (*PublicKeyCertificate, error) {
+    cert, ok := data.Find(TAG_ICC_CERTIFICATE)
+    if !ok {
+        return nil, fmt.Errorf("ICC public key certificate missing")
+    }
+    result, err := recoverCertificate(issuer, cert.Value,
+        data.Value(TAG_ICC_REMAINDER), data.Value(TAG_ICC_EXPONENT),
+        0x04, 10, static, now)
+    if err != nil {
+        return nil, fmt.Errorf("ICC public key certificate: %s", err)
+    }
+    if FormatValue(TAG_PAN, result.ID) != FormatValue(TAG_PAN,
+        data.Value(TAG_PAN)) {
+        return nil, fmt.Errorf("ICC certificate PAN doesn't match PAN")
+    }
+    return result, nil
+}
+
+// Return static data to be authenticated: the offline authentication
+// records followed by the values listed in the SDA tag list (EMV Book 3,
+// 10.3). Only the AIP may be listed.
+func (a *ApplicationData) StaticData(po *ProcessingOptions) ([]byte,
+    error) {
+    static := append([]byte{}, a.OfflineAuthData...)
+    tags := a.Data.Value(TAG_SDA_TAG_LIST)
+    for len(tags) > 0 {
+        tag, rest, err := tlv.ParseTag(tags)
+        if err != nil { return nil, err }
+        if tag != TAG_AIP {
+            return nil, fmt.Errorf("SDA tag list contains %s", tag)
+        }
+        static = append(static, po.Data.Value(TAG_AIP)...)
+        tags = rest
+    }
+    return static, nil
+}
+
+// Verify Signed Static Application Data (SDA, EMV Book 2, 5.4) and return
+// the Data Authentication Code.
+func VerifySDA(issuer *rsa.PublicKey, data tlv.List, static []byte) (
+    []byte, error) {
+    ssad, ok := data.Find(TAG_SSAD)
+    if !ok {
+        return nil, fmt.Errorf("signed static application data missing")
+    }
+    body, err := recoverSigned(issuer, ssad.Value, 0x03, static)
+    if err != nil {
+        return nil, fmt.Errorf("signed static application data: %s", err)
+    }
+    if body[1] != HASH_SHA1 {
+        return nil, fmt.Errorf("unsupported hash algorithm %02X", body[1])
+    }
+    return body[2:4], nil
+}
+
+// Send INTERNAL AUTHENTICATE with DDOL related data and return the Signed
+// Dynamic Application Data.
+func (c *Card) InternalAuthenticate(ddolData []byte) ([]byte, error) {
+    rsp, err := smartcard.TransmitAndGetResponse(c.card, smartcard.Command4(
+        0x00, INS_INTERNAL_AUTHENTICATE, 0x00, 0x00, ddolData, 0x00))
+    if err != nil { return nil, err }
+    if rsp.SW() != SW.SUCCESS {
+        return nil, smartcard.SWError(rsp.SW())
+    }
+    obj, _, err := tlv.ParseOne(rsp.Data())
+    if err != nil { return nil, err }
+    switch obj.Tag {
+        case TAG_RESPONSE_FORMAT_1:
+            return obj.Value, nil
+        case TAG_RESPONSE_FORMAT_2:
+            children, err := obj.Children()
+            if err != nil { return nil, err }
+            if sdad := children.Value(TAG_SDAD); sdad != nil {
+                return sdad, nil
+            }
+    }
+    return nil, fmt.Errorf("invalid INTERNAL AUTHENTICATE response")
+}
+
+// Verify Signed Dynamic Application Data from INTERNAL AUTHENTICATE (DDA,
+// EMV Book 2, 6.5) and return the ICC Dynamic Number.
+func VerifyDDA(icc *rsa.PublicKey, sdad, ddolData []byte) ([]byte, error) {
+    dynamic, err := recoverDynamicData(icc, sdad, ddolData)
+    if err != nil { return nil, err }
+    if len(dynamic) < 1 || len(dynamic) < 1 + int(dynamic[0]) {
+        return nil, fmt.Errorf("invalid ICC dynamic data")
+    }
+    return dynamic[1:1+dynamic[0]], nil
+}
+
+func recoverDynamicData(icc *rsa.PublicKey, sdad, terminal []byte) (
+    []byte, error) {
+    body, err := recoverSigned(icc, sdad, 0x05, terminal)
+    if err != nil {
+        return nil, fmt.Errorf("signed dynamic application data: %s", err)
+    }
+    if body[1] != HASH_SHA1 {
+        return nil, fmt.Errorf("unsupported hash algorithm %02X", body[1])
+    }
+    length := int(body[2])
+    if 3 + length > len(body) {
+        return nil, fmt.Errorf("invalid ICC dynamic data length")
+    }
+    return body[3:3+length], nil
+}
+
+// Response to GENERATE AC.
+type GenerateACResponse struct {
+    // Cryptogram Information Data
+    CID byte
+    ATC uint16
+    // Application Cryptogram (not present when CDA is used)
+    Cryptogram []byte
+    IssuerApplicationData []byte
+    // Signed Dynamic Application Data (CDA only)
+    SDAD []byte
+    Data tlv.List
+}
+
+// Send GENERATE AC. control is one of AC_AAC, AC_TC or AC_ARQC, optionally
+// combined with AC_CDA; cdolData is the CDOL1 or CDOL2 related data.
+func (c *Card) GenerateAC(control byte, cdolData []byte) (
+    *GenerateACResponse, error) {
+    rsp, err := smartcard.TransmitAndGetResponse(c.card, smartcard.Command4(
+        0x80, INS_GENERATE_AC, control, 0x00, cdolData, 0x00))
+    if err != nil { return nil, err }
+    if rsp.SW() != SW.SUCCESS {
+        return nil, smartcard.SWError(rsp.SW())
+    }
+    obj, _, err := tlv.ParseOne(rsp.Data())
+    if err != nil { return nil, err }
+    result := &GenerateACResponse{}
+    switch obj.Tag {
+        case TAG_RESPONSE_FORMAT_1:
+            // CID, ATC, AC, optional IAD
+            if len(obj.Value) < 11 {
+                return nil, fmt.Errorf("GENERATE AC response too short")
+            }
+            result.Data = tlv.List{
+                tlv.New(TAG_CID, obj.Value[:1]),
+                tlv.New(TAG_ATC, obj.Value[1:3]),
+                tlv.New(TAG_APPLICATION_CRYPTOGRAM, obj.Value[3:11]),
+            }
+            if len(obj.Value) > 11 {
+                result.Data = append(result.Data, tlv.New(
+                    TAG_ISSUER_APPLICATION_DATA, obj.Value[11:]))
+            }
+        case TAG_RESPONSE_FORMAT_2:
+            result.Data, err = obj.Children()
+            if err != nil { return nil, err }
+        default:
+            return nil, fmt.Errorf("unexpected GENERATE AC response " +
+                "template %s", obj.Tag)
+    }
+    if cid := result.Data.Value(TAG_CID); len(cid) == 1 {
+        result.CID = cid[0]
+    }
+    result.ATC = uint16Value(result.Data.Value(TAG_ATC))
+    result.Cryptogram = result.Data.Value(TAG_APPLICATION_CRYPTOGRAM)
+    result.IssuerApplicationData = result.Data.Value(
+        TAG_ISSUER_APPLICATION_DATA)
+    result.SDAD = result.Data.Value(TAG_SDAD)
+    return result, nil
+}
+
+// Result of combined DDA/application cryptogram generation.
+type CDAResult struct {
+    ICCDynamicNumber []byte
+    CID byte
+    Cryptogram []byte
+}
+
+// Verify the signature of a GENERATE AC response with CDA (EMV Book 2,
+// 6.6). un is the Unpredictable Number sent in the CDOL data; pdolData
+// and cdolData are the data sent with GET PROCESSING OPTIONS and GENERATE
+// AC (for the second GENERATE AC cdolData is CDOL1 data followed by CDOL2
+// data).
+func VerifyCDA(icc *rsa.PublicKey, rsp *GenerateACResponse, un, pdolData,
+    cdolData []byte) (*CDAResult, error) {
+    if rsp.SDAD == nil {
+        return nil, fmt.Errorf("signed dynamic application data missing")
+    }
+    dynamic, err := recoverDynamicData(icc, rsp.SDAD, un)
+    if err != nil { return nil, err }
+    if len(dynamic) < 1 || len(dynamic) < 1 + int(dynamic[0]) + 29 {
+        return nil, fmt.Errorf("invalid ICC dynamic data")
+    }
+    n := int(dynamic[0])
+    result := &CDAResult{
+        ICCDynamicNumber: dynamic[1:1+n],
+        CID: dynamic[1+n],
+        Cryptogram: dynamic[2+n:10+n],
+    }
+    if result.CID != rsp.CID {
+        return nil, fmt.Errorf("CID mismatch")
+    }
+    // Transaction Data Hash Code: PDOL data, CDOL data and the response
+    // data objects except the SDAD, in the order received
+    h := sha1.New()
+    h.Write(pdolData)
+    h.Write(cdolData)
+    for _, obj := range rsp.Data {
+        if obj.Tag != TAG_SDAD {
+            h.Write(obj.Bytes())
+        }
+    }
+    if !bytes.Equal(h.Sum(nil), dynamic[10+n:30+n]) {
+        return nil, fmt.Errorf("transaction data hash code mismatch")
+    }
+    return result, nil
+}
+
+// Certificate chain of an application.
+type Chain struct {
+    CA *CAPublicKey
+    Issuer *PublicKeyCertificate
+    // nil for SDA-only cards
+    ICC *PublicKeyCertificate
+    // Static data to be authenticated
+    StaticData []byte
+}
+
+// Recover and verify the certificate chain of the selected application.
+// aid is the application's AID, po and app the results of
+// GetProcessingOptions and ReadApplicationData.
+func VerifyChain(keys CAKeys, aid []byte, po *ProcessingOptions,
+    app *ApplicationData, now time.Time) (*Chain, error) {
+    if len(aid) < 5 {
+        return nil, fmt.Errorf("invalid AID %X", aid)
+    }
+    index := app.Data.Value(TAG_CA_KEY_INDEX)
+    if len(index) != 1 {
+        return nil, fmt.Errorf("CA public key index missing")
+    }
+    ca, ok := keys.Find(aid[:5], index[0])
+    if !ok {
+        return nil, fmt.Errorf("CA public key %X/%02X not found", aid[:5],
+            index[0])
+    }
+    static, err := app.StaticData(po)
+    if err != nil { return nil, err }
+    chain := &Chain{CA: ca, StaticData: static}
+    chain.Issuer, err = RecoverIssuerKey(ca, app.Data, now)
+    if err != nil { return nil, err }
+    if _, ok := app.Data.Find(TAG_ICC_CERTIFICATE); ok {
+        chain.ICC, err = RecoverICCKey(chain.Issuer.PublicKey, app.Data,
+            static, now)
+        if err != nil { return nil, err }
+    }
+    return chain, nil
+}
@@ -0,0 +1,235 @@
+package emv
+
+import (
+    "bytes"
+    "crypto/rand"
+    "crypto/rsa"
+    "crypto/sha1"
+    "fmt"
+    "math/big"
+    "testing"
+    "time"
+    "github.com/sf1/go-card/smartcard"
+    "github.com/sf1/go-card/smartcard/tlv"
+)
+
+var testRID = []byte{0xa0, 0x00, 0x00, 0x00, 0x03}
+
+func generateKey(t *testing.T, bits int) *rsa.PrivateKey {
+    key, err := rsa.GenerateKey(rand.Reader, bits)
+    if err != nil { t.Fatal(err) }
+    return key
+}
+
+func exponent(key *rsa.PrivateKey) []byte {
+    return big.NewInt(int64(key.E)).Bytes()
+}
+
+// Sign with the EMV signature scheme: 6A || body || hash || BC.
+func emvSign(key *rsa.PrivateKey, body []byte, extra ...[]byte) []byte {
+    h := sha1.New()
+    h.Write(body)
+    for _, e := range extra {
+        h.Write(e)
+    }
+    m := append(append(append([]byte{0x6a}, body...), h.Sum(nil)...), 0xbc)
+    s := new(big.Int).Exp(new(big.Int).SetBytes(m), key.D, key.N).Bytes()
+    out := make([]byte, len(m))
+    copy(out[len(out)-len(s):], s)
+    return out
+}
+
+func padBB(data []byte, size int) []byte {
+    out := append([]byte{}, data...)
+    for len(out) < size {
+        out = append(out, 0xbb)
+    }
+    return out
+}
+
+// Test card personalisation with CA, issuer and ICC keys.
+type testPKI struct {
+    ca, issuer, icc *rsa.PrivateKey
+    keys CAKeys
+    po *ProcessingOptions
+    app *ApplicationData
+}
+
+var pan = []byte{0x47, 0x61, 0x73, 0x90, 0x01, 0x01, 0x00, 0x10}
+
+func newTestPKI(t *testing.T, expiry []byte) *testPKI {
+    p := &testPKI{
+        ca: generateKey(t, 1152),
+        issuer: generateKey(t, 1024),
+        icc: generateKey(t, 640),
+    }
+    p.keys = CAKeys{{RID: testRID, Index: 0x09,
+        Modulus: p.ca.N.Bytes(), Exponent: exponent(p.ca)}}
+    nCA, nI := len(p.ca.N.Bytes()), len(p.issuer.N.Bytes())
+    issuerModulus := p.issuer.N.Bytes()
+    body := []byte{0x02, 0x47, 0x61, 0x73, 0xff}
+    body = append(body, expiry...)
+    body = append(body, 0x00, 0x00, 0x01, HASH_SHA1, 0x01, byte(nI),
+        byte(len(exponent(p.issuer))))
+    body = append(body, issuerModulus[:nCA-36]...)
+    remainder := issuerModulus[nCA-36:]
+    issuerCert := emvSign(p.ca, body, remainder, exponent(p.issuer))
+
+    record := tlv.List{
+        tlv.New(TAG_PAN, pan),
+        tlv.New(0x5f24, []byte{0x30, 0x12, 0x31}),
+    }.Bytes()
+    p.po = &ProcessingOptions{
+        AIP: AIP_SDA | AIP_DDA | AIP_CDA,
+        Data: tlv.List{tlv.New(TAG_AIP, []byte{0x61, 0x00})},
+    }
+    static := append(append([]byte{}, record...), 0x61, 0x00)
+
+    iccModulus := p.icc.N.Bytes()
+    body = append([]byte{0x04}, pan...)
+    body = append(body, 0xff, 0xff)
+    body = append(body, expiry...)
+    body = append(body, 0x00, 0x00, 0x02, HASH_SHA1, 0x01,
+        byte(len(iccModulus)), byte(len(exponent(p.icc))))
+    body = append(body, padBB(iccModulus, nI-42)...)
+    iccCert := emvSign(p.issuer, body, exponent(p.icc), static)
+
+    body = padBB([]byte{0x03, HASH_SHA1, 0xda, 0xc1}, nI-22)
+    ssad := emvSign(p.issuer, body, static)
+
+    p.app = &ApplicationData{
+        Data: append(tlv.List{
+            tlv.New(TAG_CA_KEY_INDEX, []byte{0x09}),
+            tlv.New(TAG_ISSUER_CERTIFICATE, issuerCert),
+            tlv.New(TAG_ISSUER_REMAINDER, remainder),
+            tlv.New(TAG_ISSUER_EXPONENT, exponent(p.issuer)),
+            tlv.New(TAG_ICC_CERTIFICATE, iccCert),
+            tlv.New(TAG_ICC_EXPONENT, exponent(p.icc)),
+            tlv.New(TAG_SSAD, ssad),
+            tlv.New(TAG_SDA_TAG_LIST, []byte{0x82}),
+        }, tlv.List{tlv.New(TAG_PAN, pan)}...),
+        OfflineAuthData: record,
+    }
+    return p
+}
+
+// Card answering INTERNAL AUTHENTICATE and GENERATE AC with CDA.
+type odaCard struct {
+    icc *rsa.PrivateKey
+    pdolData []byte
+}
+
+func (c *odaCard) TransmitAPDU(cmd smartcard.CommandAPDU) (
+    smartcard.ResponseAPDU, error) {
+    data := cmd.Data()
+    size := len(c.icc.N.Bytes())
+    dynamicNumber := []byte{0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08}
+    switch cmd[1] {
+        case INS_INTERNAL_AUTHENTICATE:
+            dynamic := append([]byte{byte(len(dynamicNumber))},
+                dynamicNumber...)
+            body := append([]byte{0x05, HASH_SHA1, byte(len(dynamic))},
+                dynamic...)
+            sdad := emvSign(c.icc, padBB(body, size-22), data)
+            return append(tlv.Encode(TAG_RESPONSE_FORMAT_1, sdad), 0x90,
+                0x00), nil
+        case INS_GENERATE_AC:
+            // CDOL1 data ends with the unpredictable number
+            un := data[len(data)-4:]
+            cid := []byte{0x80}
+            objects := tlv.List{
+                tlv.New(TAG_CID, cid),
+                tlv.New(TAG_ATC, []byte{0x00, 0x43}),
+                tlv.New(TAG_ISSUER_APPLICATION_DATA, []byte{0x06, 0x01}),
+            }
+            h := sha1.New()
+            h.Write(c.pdolData)
+            h.Write(data)
+            h.Write(objects.Bytes())
+            dynamic := append([]byte{byte(len(dynamicNumber))},
+                dynamicNumber...)
+            dynamic = append(dynamic, cid...)
+            dynamic = append(dynamic, 0xa1, 0xa2, 0xa3, 0xa4, 0xa5, 0xa6,
+                0xa7, 0xa8)
+            dynamic = append(dynamic, h.Sum(nil)...)
+            body := append([]byte{0x05, HASH_SHA1, byte(len(dynamic))},
+                dynamic...)
+            sdad := emvSign(c.icc, padBB(body, size-22), un)
+            objects = append(objects[:2], tlv.New(TAG_SDAD, sdad),
+                objects[2])
+            return append(tlv.NewConstructed(TAG_RESPONSE_FORMAT_2,
+                objects...).Bytes(), 0x90, 0x00), nil
+    }
+    return nil, fmt.Errorf("unexpected command %X", []byte(cmd))
+}
+
+func TestOfflineDataAuthentication(t *testing.T) {
+    p := newTestPKI(t, []byte{0x12, 0x30})
+    now := time.Date(2026, 10, 1, 0, 0, 0, 0, time.UTC)
+    chain, err := VerifyChain(p.keys, append(testRID, 0x10, 0x10), p.po,
+        p.app, now)
+    if err != nil { t.Fatal(err) }
+    if chain.Issuer.PublicKey.N.Cmp(p.issuer.N) != 0 {
+        t.Error("issuer public key mismatch")
+    }
+    if chain.ICC == nil || chain.ICC.PublicKey.N.Cmp(p.icc.N) != 0 {
+        t.Fatal("ICC public key mismatch")
+    }
+    dac, err := VerifySDA(chain.Issuer.PublicKey, p.app.Data,
+        chain.StaticData)
+    if err != nil { t.Fatal(err) }
+    if !bytes.Equal(dac, []byte{0xda, 0xc1}) {
+        t.Errorf("unexpected data authentication code %X", dac)
+    }
+
+    card := New(&odaCard{icc: p.icc, pdolData: []byte{0x11, 0x22}})
+    ddolData, err := BuildDOL(DefaultDDOL, Data{
+        TAG_UNPREDICTABLE_NUMBER: {0xde, 0xad, 0xbe, 0xef}})
+    if err != nil { t.Fatal(err) }
+    sdad, err := card.InternalAuthenticate(ddolData)
+    if err != nil { t.Fatal(err) }
+    number, err := VerifyDDA(chain.ICC.PublicKey, sdad, ddolData)
+    if err != nil { t.Fatal(err) }
+    if len(number) != 8 {
+        t.Errorf("unexpected ICC dynamic number %X", number)
+    }
+    if _, err := VerifyDDA(chain.ICC.PublicKey, sdad, []byte{0, 0, 0, 0});
+        err == nil {
+        t.Error("DDA signature over other data accepted")
+    }
+
+    cdolData := []byte{0x00, 0x00, 0x00, 0x00, 0x10, 0x00, 0xde, 0xad,
+        0xbe, 0xef}
+    rsp, err := card.GenerateAC(AC_ARQC | AC_CDA, cdolData)
+    if err != nil { t.Fatal(err) }
+    result, err := VerifyCDA(chain.ICC.PublicKey, rsp, cdolData[6:],
+        []byte{0x11, 0x22}, cdolData)
+    if err != nil { t.Fatal(err) }
+    if result.CID != 0x80 || result.Cryptogram[0] != 0xa1 {
+        t.Errorf("unexpected CDA result %+v", result)
+    }
+    if _, err := VerifyCDA(chain.ICC.PublicKey, rsp, cdolData[6:], nil,
+        cdolData); err == nil {
+        t.Error("CDA with wrong transaction data accepted")
+    }
+}
+
+func TestChainErrors(t *testing.T) {
+    p := newTestPKI(t, []byte{0x12, 0x25})
+    aid := append(testRID, 0x10, 0x10)
+    now := time.Date(2025, 12, 31, 0, 0, 0, 0, time.UTC)
+    if _, err := VerifyChain(p.keys, aid, p.po, p.app, now); err != nil {
+        t.Errorf("certificate valid in expiry month rejected: %s", err)
+    }
+    if _, err := VerifyChain(p.keys, aid, p.po, p.app, now.AddDate(0, 0, 1));
+        err == nil {
+        t.Error("expired certificate accepted")
+    }
+    if _, err := VerifyChain(nil, aid, p.po, p.app, now); err == nil {
+        t.Error("missing CA key accepted")
+    }
+    p.app.OfflineAuthData[len(p.app.OfflineAuthData)-1] ^= 0x01
+    if _, err := VerifyChain(p.keys, aid, p.po, p.app, now); err == nil {
+        t.Error("modified static data accepted")
+    }
+}
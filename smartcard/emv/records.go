@@ -0,0 +1,182 @@
+package emv
+
+import (
+    "fmt"
+    "github.com/sf1/go-card/smartcard"
+    "github.com/sf1/go-card/smartcard/SW"
+    "github.com/sf1/go-card/smartcard/tlv"
+)
+
+// Application Interchange Profile bits (byte 1).
+const (
+    AIP_SDA = 0x4000
+    AIP_DDA = 0x2000
+    AIP_CARDHOLDER_VERIFICATION = 0x1000
+    AIP_TERMINAL_RISK_MANAGEMENT = 0x0800
+    AIP_ISSUER_AUTHENTICATION = 0x0400
+    AIP_CDA = 0x0100
+)
+
+// Application File Locator entry.
+type AFLEntry struct {
+    SFI int
+    FirstRecord int
+    LastRecord int
+    // Number of records, starting with FirstRecord, included in offline
+    // data authentication
+    OfflineRecords int
+}
+
+// Parse Application File Locator.
+func ParseAFL(afl []byte) ([]AFLEntry, error) {
+    if len(afl) % 4 != 0 {
+        return nil, fmt.Errorf("invalid AFL length: %d", len(afl))
+    }
+    var entries []AFLEntry
+    for i := 0; i < len(afl); i += 4 {
+        e := AFLEntry{
+            SFI: int(afl[i] >> 3),
+            FirstRecord: int(afl[i+1]),
+            LastRecord: int(afl[i+2]),
+            OfflineRecords: int(afl[i+3]),
+        }
+        if e.SFI < 1 || e.SFI > 30 || e.FirstRecord == 0 ||
+            e.LastRecord < e.FirstRecord ||
+            e.OfflineRecords > e.LastRecord - e.FirstRecord + 1 {
+            return nil, fmt.Errorf("invalid AFL entry %X", afl[i:i+4])
+        }
+        entries = append(entries, e)
+    }
+    return entries, nil
+}
+
+// Response to GET PROCESSING OPTIONS.
+type ProcessingOptions struct {
+    AIP uint16
+    AFL []AFLEntry
+    // All data objects returned (format 2) or AIP and AFL (format 1)
+    Data tlv.List
+}
+
+// Check AIP bit.
+func (p *ProcessingOptions) Supports(aip uint16) bool {
+    return p.AIP & aip != 0
+}
+
+// Initiate application processing. pdol is the PDOL from the FCI (may be
+// empty), data supplies the terminal data elements it references.
+func (c *Card) GetProcessingOptions(pdol []byte, data Data) (
+    *ProcessingOptions, error) {
+    value, err := BuildDOL(pdol, data)
+    if err != nil { return nil, err }
+    rsp, err := smartcard.TransmitAndGetResponse(c.card, smartcard.Command4(
+        0x80, INS_GET_PROCESSING_OPTIONS, 0x00, 0x00,
+        tlv.Encode(TAG_COMMAND_TEMPLATE, value), 0x00))
+    if err != nil { return nil, err }
+    if rsp.SW() == SW.CONDITIONS_NOT_SATISFIED {
+        return nil, fmt.Errorf("conditions of use not satisfied")
+    }
+    if rsp.SW() != SW.SUCCESS {
+        return nil, smartcard.SWError(rsp.SW())
+    }
+    obj, _, err := tlv.ParseOne(rsp.Data())
+    if err != nil { return nil, err }
+    var list tlv.List
+    switch obj.Tag {
+        case TAG_RESPONSE_FORMAT_1:
+            if len(obj.Value) < 2 {
+                return nil, fmt.Errorf("GPO response too short")
+            }
+            list = tlv.List{tlv.New(TAG_AIP, obj.Value[:2]),
+                tlv.New(TAG_AFL, obj.Value[2:])}
+        case TAG_RESPONSE_FORMAT_2:
+            list, err = obj.Children()
+            if err != nil { return nil, err }
+        default:
+            return nil, fmt.Errorf("unexpected GPO response template %s",
+                obj.Tag)
+    }
+    afl, err := ParseAFL(list.Value(TAG_AFL))
+    if err != nil { return nil, err }
+    return &ProcessingOptions{
+        AIP: uint16Value(list.Value(TAG_AIP)),
+        AFL: afl,
+        Data: list,
+    }, nil
+}
+
+// Record read from the card.
+type Record struct {
+    SFI int
+    Number int
+    Data []byte
+}
+
+// Application data read according to the AFL.
+type ApplicationData struct {
+    Records []Record
+    // Data objects of all records (contents of the 70 templates)
+    Data tlv.List
+    // Concatenated records for offline data authentication
+    // (EMV Book 3, 10.3)
+    OfflineAuthData []byte
+}
+
+// Read all records listed in the AFL.
+func (c *Card) ReadApplicationData(afl []AFLEntry) (*ApplicationData,
+    error) {
+    result := &ApplicationData{}
+    for _, e := range afl {
+        for n := e.FirstRecord; n <= e.LastRecord; n++ {
+            data, err := c.ReadRecord(e.SFI, n)
+            if err != nil {
+                return nil, fmt.Errorf("SFI %d record %d: %s", e.SFI, n, err)
+            }
+            obj, rest, err := tlv.ParseOne(data)
+            if err != nil { return nil, err }
+            if e.SFI <= 10 && (obj.Tag != TAG_RECORD_TEMPLATE ||
+                len(rest) != 0) {
+                return nil, fmt.Errorf("SFI %d record %d: invalid template",
+                    e.SFI, n)
+            }
+            result.Records = append(result.Records, Record{e.SFI, n, data})
+            if obj.Tag == TAG_RECORD_TEMPLATE {
+                children, err := obj.Children()
+                if err != nil { return nil, err }
+                result.Data = append(result.Data, children...)
+            }
+            if n - e.FirstRecord < e.OfflineRecords {
+                // SFI 1-10: template contents only, else whole record
+                if e.SFI <= 10 {
+                    result.OfflineAuthData = append(result.OfflineAuthData,
+                        obj.Value...)
+                } else {
+                    result.OfflineAuthData = append(result.OfflineAuthData,
+                        data...)
+                }
+            }
+        }
+    }
+    return result, nil
+}
+
+// Read transaction log (EMV Book 3, Annex D). sfi and records come from
+// the Log Entry in the FCI, format from LogFormat(). Records are returned
+// most recent first; each entry maps the tags of the log format to values.
+func (c *Card) TransactionLog(sfi, records int, format []byte) ([]Data,
+    error) {
+    var log []Data
+    for n := 1; n <= records; n++ {
+        data, err := c.ReadRecord(sfi, n)
+        if err == smartcard.SWError(SW.RECORD_NOT_FOUND) {
+            break
+        }
+        if err != nil { return nil, err }
+        entry, err := ParseDOLData(format, data)
+        if err != nil {
+            return nil, fmt.Errorf("log record %d: %s", n, err)
+        }
+        log = append(log, entry)
+    }
+    return log, nil
+}
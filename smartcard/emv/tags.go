@@ -0,0 +1,199 @@
+package emv
+
+import (
+    "bytes"
+    "fmt"
+    "strings"
+    "github.com/sf1/go-card/smartcard/tlv"
+)
+
+// Data element format (EMV Book 3, 4.3).
+type Format int
+
+const (
+    // Binary
+    FORMAT_B Format = iota
+    // Numeric, BCD right justified with leading zeros
+    FORMAT_N
+    // Compressed numeric, BCD left justified padded with F
+    FORMAT_CN
+    // Alphanumeric
+    FORMAT_AN
+    // Alphanumeric special
+    FORMAT_ANS
+)
+
+// Data element description.
+type TagInfo struct {
+    Name string
+    Format Format
+}
+
+// Dictionary of EMV data elements (EMV Book 3, Annex A and Book 4).
+var Tags = map[tlv.Tag]TagInfo{
+    0x42: {"Issuer Identification Number", FORMAT_N},
+    0x4f: {"Application Identifier (AID)", FORMAT_B},
+    0x50: {"Application Label", FORMAT_ANS},
+    0x57: {"Track 2 Equivalent Data", FORMAT_B},
+    0x5a: {"Application PAN", FORMAT_CN},
+    0x61: {"Application Template", FORMAT_B},
+    0x6f: {"File Control Information (FCI) Template", FORMAT_B},
+    0x70: {"READ RECORD Response Message Template", FORMAT_B},
+    0x71: {"Issuer Script Template 1", FORMAT_B},
+    0x72: {"Issuer Script Template 2", FORMAT_B},
+    0x73: {"Directory Discretionary Template", FORMAT_B},
+    0x77: {"Response Message Template Format 2", FORMAT_B},
+    0x80: {"Response Message Template Format 1", FORMAT_B},
+    0x82: {"Application Interchange Profile", FORMAT_B},
+    0x83: {"Command Template", FORMAT_B},
+    0x84: {"Dedicated File (DF) Name", FORMAT_B},
+    0x86: {"Issuer Script Command", FORMAT_B},
+    0x87: {"Application Priority Indicator", FORMAT_B},
+    0x88: {"Short File Identifier (SFI)", FORMAT_B},
+    0x89: {"Authorisation Code", FORMAT_AN},
+    0x8a: {"Authorisation Response Code", FORMAT_AN},
+    0x8c: {"CDOL1", FORMAT_B},
+    0x8d: {"CDOL2", FORMAT_B},
+    0x8e: {"Cardholder Verification Method (CVM) List", FORMAT_B},
+    0x8f: {"Certification Authority Public Key Index", FORMAT_B},
+    0x90: {"Issuer Public Key Certificate", FORMAT_B},
+    0x91: {"Issuer Authentication Data", FORMAT_B},
+    0x92: {"Issuer Public Key Remainder", FORMAT_B},
+    0x93: {"Signed Static Application Data", FORMAT_B},
+    0x94: {"Application File Locator (AFL)", FORMAT_B},
+    0x95: {"Terminal Verification Results", FORMAT_B},
+    0x97: {"TDOL", FORMAT_B},
+    0x98: {"TC Hash Value", FORMAT_B},
+    0x99: {"Transaction PIN Data", FORMAT_B},
+    0x9a: {"Transaction Date", FORMAT_N},
+    0x9b: {"Transaction Status Information", FORMAT_B},
+    0x9c: {"Transaction Type", FORMAT_N},
+    0x9d: {"Directory Definition File (DDF) Name", FORMAT_B},
+    0xa5: {"FCI Proprietary Template", FORMAT_B},
+    0x5f20: {"Cardholder Name", FORMAT_ANS},
+    0x5f24: {"Application Expiration Date", FORMAT_N},
+    0x5f25: {"Application Effective Date", FORMAT_N},
+    0x5f28: {"Issuer Country Code", FORMAT_N},
+    0x5f2a: {"Transaction Currency Code", FORMAT_N},
+    0x5f2d: {"Language Preference", FORMAT_AN},
+    0x5f30: {"Service Code", FORMAT_N},
+    0x5f34: {"Application PAN Sequence Number", FORMAT_N},
+    0x5f36: {"Transaction Currency Exponent", FORMAT_N},
+    0x5f50: {"Issuer URL", FORMAT_ANS},
+    0x5f53: {"International Bank Account Number (IBAN)", FORMAT_B},
+    0x5f54: {"Bank Identifier Code (BIC)", FORMAT_B},
+    0x5f55: {"Issuer Country Code (alpha2)", FORMAT_AN},
+    0x5f56: {"Issuer Country Code (alpha3)", FORMAT_AN},
+    0x9f01: {"Acquirer Identifier", FORMAT_N},
+    0x9f02: {"Amount, Authorised (Numeric)", FORMAT_N},
+    0x9f03: {"Amount, Other (Numeric)", FORMAT_N},
+    0x9f05: {"Application Discretionary Data", FORMAT_B},
+    0x9f06: {"Application Identifier (AID) - terminal", FORMAT_B},
+    0x9f07: {"Application Usage Control", FORMAT_B},
+    0x9f08: {"Application Version Number", FORMAT_B},
+    0x9f09: {"Application Version Number - terminal", FORMAT_B},
+    0x9f0b: {"Cardholder Name Extended", FORMAT_ANS},
+    0x9f0d: {"Issuer Action Code - Default", FORMAT_B},
+    0x9f0e: {"Issuer Action Code - Denial", FORMAT_B},
+    0x9f0f: {"Issuer Action Code - Online", FORMAT_B},
+    0x9f10: {"Issuer Application Data", FORMAT_B},
+    0x9f11: {"Issuer Code Table Index", FORMAT_N},
+    0x9f12: {"Application Preferred Name", FORMAT_ANS},
+    0x9f13: {"Last Online ATC Register", FORMAT_B},
+    0x9f14: {"Lower Consecutive Offline Limit", FORMAT_B},
+    0x9f17: {"PIN Try Counter", FORMAT_B},
+    0x9f1a: {"Terminal Country Code", FORMAT_N},
+    0x9f1f: {"Track 1 Discretionary Data", FORMAT_ANS},
+    0x9f20: {"Track 2 Discretionary Data", FORMAT_CN},
+    0x9f21: {"Transaction Time", FORMAT_N},
+    0x9f23: {"Upper Consecutive Offline Limit", FORMAT_B},
+    0x9f26: {"Application Cryptogram", FORMAT_B},
+    0x9f27: {"Cryptogram Information Data", FORMAT_B},
+    0x9f2d: {"ICC PIN Encipherment Public Key Certificate", FORMAT_B},
+    0x9f2e: {"ICC PIN Encipherment Public Key Exponent", FORMAT_B},
+    0x9f2f: {"ICC PIN Encipherment Public Key Remainder", FORMAT_B},
+    0x9f32: {"Issuer Public Key Exponent", FORMAT_B},
+    0x9f33: {"Terminal Capabilities", FORMAT_B},
+    0x9f34: {"Cardholder Verification Method (CVM) Results", FORMAT_B},
+    0x9f35: {"Terminal Type", FORMAT_N},
+    0x9f36: {"Application Transaction Counter (ATC)", FORMAT_B},
+    0x9f37: {"Unpredictable Number", FORMAT_B},
+    0x9f38: {"Processing Options Data Object List (PDOL)", FORMAT_B},
+    0x9f39: {"Point-of-Service (POS) Entry Mode", FORMAT_N},
+    0x9f3b: {"Application Reference Currency", FORMAT_N},
+    0x9f3c: {"Transaction Reference Currency Code", FORMAT_N},
+    0x9f40: {"Additional Terminal Capabilities", FORMAT_B},
+    0x9f41: {"Transaction Sequence Counter", FORMAT_N},
+    0x9f42: {"Application Currency Code", FORMAT_N},
+    0x9f43: {"Application Reference Currency Exponent", FORMAT_N},
+    0x9f44: {"Application Currency Exponent", FORMAT_N},
+    0x9f45: {"Data Authentication Code", FORMAT_B},
+    0x9f46: {"ICC Public Key Certificate", FORMAT_B},
+    0x9f47: {"ICC Public Key Exponent", FORMAT_B},
+    0x9f48: {"ICC Public Key Remainder", FORMAT_B},
+    0x9f49: {"Dynamic Data Authentication Data Object List (DDOL)", FORMAT_B},
+    0x9f4a: {"Static Data Authentication Tag List", FORMAT_B},
+    0x9f4b: {"Signed Dynamic Application Data", FORMAT_B},
+    0x9f4c: {"ICC Dynamic Number", FORMAT_B},
+    0x9f4d: {"Log Entry", FORMAT_B},
+    0x9f4e: {"Merchant Name and Location", FORMAT_ANS},
+    0x9f4f: {"Log Format", FORMAT_B},
+    0x9f66: {"Terminal Transaction Qualifiers (TTQ)", FORMAT_B},
+    0x9f6e: {"Form Factor Indicator", FORMAT_B},
+    0x9f7a: {"VLP Terminal Support Indicator", FORMAT_B},
+    0xbf0c: {"FCI Issuer Discretionary Data", FORMAT_B},
+}
+
+// Look up data element, returning a binary format entry for unknown tags.
+func Lookup(tag tlv.Tag) TagInfo {
+    if info, ok := Tags[tag]; ok {
+        return info
+    }
+    return TagInfo{Name: "Unknown", Format: FORMAT_B}
+}
+
+// Format value of data element for display.
+func FormatValue(tag tlv.Tag, value []byte) string {
+    switch Lookup(tag).Format {
+        case FORMAT_N:
+            return fmt.Sprintf("%X", value)
+        case FORMAT_CN:
+            return strings.TrimRight(fmt.Sprintf("%X", value), "F")
+        case FORMAT_AN, FORMAT_ANS:
+            printable := true
+            for _, b := range value {
+                if b < 0x20 || b > 0x7e {
+                    printable = false
+                    break
+                }
+            }
+            if printable {
+                return fmt.Sprintf("%q", value)
+            }
+    }
+    return fmt.Sprintf("%X", value)
+}
+
+// Return indented, annotated representation of data objects.
+func Dump(list tlv.List) string {
+    var buffer bytes.Buffer
+    dump(&buffer, list, 0)
+    return buffer.String()
+}
+
+func dump(buffer *bytes.Buffer, list tlv.List, depth int) {
+    indent := strings.Repeat("  ", depth)
+    for _, obj := range list {
+        name := Lookup(obj.Tag).Name
+        if obj.Tag.Constructed() {
+            children, err := obj.Children()
+            if err == nil {
+                fmt.Fprintf(buffer, "%s%s %s\n", indent, obj.Tag, name)
+                dump(buffer, children, depth + 1)
+                continue
+            }
+        }
+        fmt.Fprintf(buffer, "%s%s %s: %s\n", indent, obj.Tag, name,
+            FormatValue(obj.Tag, obj.Value))
+    }
+}
@@ -0,0 +1,273 @@
+package fido
+
+import (
+    "bytes"
+    "encoding/binary"
+    "fmt"
+    "math"
+    "sort"
+)
+
+// Minimal CBOR (RFC 8949) support for CTAP2. Integers decode to int64,
+// byte strings to []byte, text strings to string, arrays to []interface{}
+// and maps to map[interface{}]interface{}. Maps are encoded in CTAP2
+// canonical form (keys sorted by encoded length, then bytewise).
+
+const (
+    cborUint = 0
+    cborNegint = 1
+    cborBytes = 2
+    cborText = 3
+    cborArray = 4
+    cborMap = 5
+    cborTag = 6
+    cborSimple = 7
+)
+
+func cborHeader(major byte, n uint64) []byte {
+    switch {
+        case n < 24:
+            return []byte{major << 5 | byte(n)}
+        case n <= math.MaxUint8:
+            return []byte{major << 5 | 24, byte(n)}
+        case n <= math.MaxUint16:
+            out := []byte{major << 5 | 25, 0, 0}
+            binary.BigEndian.PutUint16(out[1:], uint16(n))
+            return out
+        case n <= math.MaxUint32:
+            out := []byte{major << 5 | 26, 0, 0, 0, 0}
+            binary.BigEndian.PutUint32(out[1:], uint32(n))
+            return out
+    }
+    out := []byte{major << 5 | 27, 0, 0, 0, 0, 0, 0, 0, 0}
+    binary.BigEndian.PutUint64(out[1:], n)
+    return out
+}
+
+func cborInt(n int64) []byte {
+    if n < 0 {
+        return cborHeader(cborNegint, uint64(-1 - n))
+    }
+    return cborHeader(cborUint, uint64(n))
+}
+
+// Encode value as CBOR.
+func cborEncode(v interface{}) ([]byte, error) {
+    switch v := v.(type) {
+        case nil:
+            return []byte{0xf6}, nil
+        case bool:
+            if v {
+                return []byte{0xf5}, nil
+            }
+            return []byte{0xf4}, nil
+        case int:
+            return cborInt(int64(v)), nil
+        case int64:
+            return cborInt(v), nil
+        case uint32:
+            return cborHeader(cborUint, uint64(v)), nil
+        case uint64:
+            return cborHeader(cborUint, v), nil
+        case []byte:
+            return append(cborHeader(cborBytes, uint64(len(v))), v...), nil
+        case string:
+            return append(cborHeader(cborText, uint64(len(v))), v...), nil
+        case []interface{}:
+            out := cborHeader(cborArray, uint64(len(v)))
+            for _, item := range v {
+                b, err := cborEncode(item)
+                if err != nil { return nil, err }
+                out = append(out, b...)
+            }
+            return out, nil
+        case map[interface{}]interface{}:
+            return cborEncodeMap(len(v), func(add func(k, v interface{})) {
+                for key, value := range v {
+                    add(key, value)
+                }
+            })
+        case map[string]interface{}:
+            return cborEncodeMap(len(v), func(add func(k, v interface{})) {
+                for key, value := range v {
+                    add(key, value)
+                }
+            })
+        case map[int]interface{}:
+            return cborEncodeMap(len(v), func(add func(k, v interface{})) {
+                for key, value := range v {
+                    add(key, value)
+                }
+            })
+    }
+    return nil, fmt.Errorf("cbor: unsupported type %T", v)
+}
+
+func cborEncodeMap(n int, each func(func(k, v interface{}))) ([]byte,
+    error) {
+    type entry struct {
+        key, value []byte
+    }
+    var entries []entry
+    var err error
+    each(func(k, v interface{}) {
+        if err != nil {
+            return
+        }
+        var e entry
+        e.key, err = cborEncode(k)
+        if err != nil {
+            return
+        }
+        e.value, err = cborEncode(v)
+        entries = append(entries, e)
+    })
+    if err != nil { return nil, err }
+    sort.Slice(entries, func(i, j int) bool {
+        a, b := entries[i].key, entries[j].key
+        if len(a) != len(b) {
+            return len(a) < len(b)
+        }
+        return bytes.Compare(a, b) < 0
+    })
+    out := cborHeader(cborMap, uint64(n))
+    for _, e := range entries {
+        out = append(append(out, e.key...), e.value...)
+    }
+    return out, nil
+}
+
+// Decode one CBOR data item, returning the remaining bytes.
+func cborDecode(data []byte) (interface{}, []byte, error) {
+    return cborDecodeDepth(data, 0)
+}
+
+func cborDecodeDepth(data []byte, depth int) (interface{}, []byte, error) {
+    if depth > 16 {
+        return nil, nil, fmt.Errorf("cbor: nesting too deep")
+    }
+    if len(data) == 0 {
+        return nil, nil, fmt.Errorf("cbor: unexpected end of data")
+    }
+    major, info := data[0] >> 5, data[0] & 0x1f
+    data = data[1:]
+    var n uint64
+    switch {
+        case info < 24:
+            n = uint64(info)
+        case info <= 27:
+            size := 1 << (info - 24)
+            if len(data) < size {
+                return nil, nil, fmt.Errorf("cbor: unexpected end of data")
+            }
+            for _, b := range data[:size] {
+                n = n << 8 | uint64(b)
+            }
+            data = data[size:]
+        default:
+            return nil, nil, fmt.Errorf("cbor: unsupported additional " +
+                "information %d", info)
+    }
+    switch major {
+        case cborUint:
+            if n > math.MaxInt64 {
+                return nil, nil, fmt.Errorf("cbor: integer overflow")
+            }
+            return int64(n), data, nil
+        case cborNegint:
+            if n > math.MaxInt64 {
+                return nil, nil, fmt.Errorf("cbor: integer overflow")
+            }
+            return -1 - int64(n), data, nil
+        case cborBytes, cborText:
+            if uint64(len(data)) < n {
+                return nil, nil, fmt.Errorf("cbor: unexpected end of data")
+            }
+            value := data[:n]
+            if major == cborText {
+                return string(value), data[n:], nil
+            }
+            return append([]byte{}, value...), data[n:], nil
+        case cborArray:
+            if n > uint64(len(data)) {
+                return nil, nil, fmt.Errorf("cbor: invalid array length")
+            }
+            array := make([]interface{}, 0, n)
+            for i := uint64(0); i < n; i++ {
+                var item interface{}
+                var err error
+                item, data, err = cborDecodeDepth(data, depth + 1)
+                if err != nil { return nil, nil, err }
+                array = append(array, item)
+            }
+            return array, data, nil
+        case cborMap:
+            if n > uint64(len(data)) {
+                return nil, nil, fmt.Errorf("cbor: invalid map length")
+            }
+            m := make(map[interface{}]interface{}, n)
+            for i := uint64(0); i < n; i++ {
+                var key, value interface{}
+                var err error
+                key, data, err = cborDecodeDepth(data, depth + 1)
+                if err != nil { return nil, nil, err }
+                switch key.(type) {
+                    case int64, string:
+                    default:
+                        return nil, nil, fmt.Errorf("cbor: unsupported " +
+                            "map key type %T", key)
+                }
+                value, data, err = cborDecodeDepth(data, depth + 1)
+                if err != nil { return nil, nil, err }
+                m[key] = value
+            }
+            return m, data, nil
+        case cborTag:
+            // ignore tags, return tagged item
+            return cborDecodeDepth(data, depth + 1)
+        case cborSimple:
+            switch info {
+                case 20:
+                    return false, data, nil
+                case 21:
+                    return true, data, nil
+                case 22, 23:
+                    return nil, data, nil
+            }
+    }
+    return nil, nil, fmt.Errorf("cbor: unsupported item %02X", major << 5 |
+        info)
+}
+
+// Typed accessors for decoded maps.
+
+func cborMapOf(v interface{}) map[interface{}]interface{} {
+    m, _ := v.(map[interface{}]interface{})
+    return m
+}
+
+func cborIntOf(v interface{}) int {
+    n, _ := v.(int64)
+    return int(n)
+}
+
+func cborBytesOf(v interface{}) []byte {
+    b, _ := v.([]byte)
+    return b
+}
+
+func cborStringOf(v interface{}) string {
+    s, _ := v.(string)
+    return s
+}
+
+func cborStringsOf(v interface{}) []string {
+    array, _ := v.([]interface{})
+    var out []string
+    for _, item := range array {
+        if s, ok := item.(string); ok {
+            out = append(out, s)
+        }
+    }
+    return out
+}
@@ -0,0 +1,81 @@
+package fido
+
+import (
+    "bytes"
+    "encoding/hex"
+    "reflect"
+    "testing"
+)
+
+// Test vectors from RFC 8949, Appendix A.
+var cborVectors = []struct {
+    value interface{}
+    encoded string
+}{
+    {int64(0), "00"},
+    {int64(23), "17"},
+    {int64(24), "1818"},
+    {int64(100), "1864"},
+    {int64(1000), "1903e8"},
+    {int64(1000000), "1a000f4240"},
+    {int64(1000000000000), "1b000000e8d4a51000"},
+    {int64(-1), "20"},
+    {int64(-100), "3863"},
+    {int64(-1000), "3903e7"},
+    {false, "f4"},
+    {true, "f5"},
+    {nil, "f6"},
+    {[]byte{}, "40"},
+    {[]byte{1, 2, 3, 4}, "4401020304"},
+    {"", "60"},
+    {"a", "6161"},
+    {"IETF", "6449455446"},
+    {"ü", "62c3bc"},
+    {[]interface{}{}, "80"},
+    {[]interface{}{int64(1), []interface{}{int64(2), int64(3)},
+        []interface{}{int64(4), int64(5)}}, "8301820203820405"},
+    {map[interface{}]interface{}{}, "a0"},
+    {map[interface{}]interface{}{int64(1): int64(2), int64(3): int64(4)},
+        "a201020304"},
+    {map[interface{}]interface{}{"a": int64(1),
+        "b": []interface{}{int64(2), int64(3)}}, "a26161016162820203"},
+}
+
+func TestCBOR(t *testing.T) {
+    for _, v := range cborVectors {
+        expected, _ := hex.DecodeString(v.encoded)
+        encoded, err := cborEncode(v.value)
+        if err != nil { t.Fatal(err) }
+        if !bytes.Equal(encoded, expected) {
+            t.Errorf("%v: expected %X, got %X", v.value, expected, encoded)
+        }
+        decoded, rest, err := cborDecode(expected)
+        if err != nil { t.Fatal(err) }
+        if len(rest) != 0 || !reflect.DeepEqual(decoded, v.value) {
+            t.Errorf("%s: decoded %#v", v.encoded, decoded)
+        }
+    }
+}
+
+func TestCBORCanonicalMap(t *testing.T) {
+    // CTAP2 canonical order: shorter encoded keys first
+    encoded, err := cborEncode(map[interface{}]interface{}{
+        "alg": int64(-7), "type": "public-key", int64(-1): int64(1),
+        int64(3): int64(-7),
+    })
+    if err != nil { t.Fatal(err) }
+    expected, _ := hex.DecodeString("a403262001" +
+        "63616c6726" + "64747970656a7075626c69632d6b6579")
+    if !bytes.Equal(encoded, expected) {
+        t.Errorf("expected %X, got %X", expected, encoded)
+    }
+}
+
+func TestCBORErrors(t *testing.T) {
+    for _, s := range []string{"", "18", "62c3", "8201", "a1", "fb"} {
+        data, _ := hex.DecodeString(s)
+        if _, _, err := cborDecode(data); err == nil {
+            t.Errorf("%s: decoded invalid CBOR", s)
+        }
+    }
+}
@@ -0,0 +1,502 @@
+package fido
+
+import (
+    "bytes"
+    "crypto"
+    "crypto/ecdsa"
+    "crypto/ed25519"
+    "crypto/elliptic"
+    "crypto/sha256"
+    "encoding/binary"
+    "fmt"
+    "math/big"
+    "github.com/sf1/go-card/smartcard"
+    "github.com/sf1/go-card/smartcard/SW"
+)
+
+const (
+    // CTAP2 commands
+    CTAP_MAKE_CREDENTIAL = 0x01
+    CTAP_GET_ASSERTION = 0x02
+    CTAP_GET_INFO = 0x04
+    CTAP_GET_NEXT_ASSERTION = 0x08
+    // COSE algorithms
+    COSE_ES256 = -7
+    COSE_EDDSA = -8
+    // Authenticator data flags
+    FLAG_USER_PRESENT = 0x01
+    FLAG_USER_VERIFIED = 0x04
+    FLAG_ATTESTED_CREDENTIAL_DATA = 0x40
+    FLAG_EXTENSION_DATA = 0x80
+)
+
+// CTAP2 status code returned by the authenticator.
+type CTAPError byte
+
+var ctapErrors = map[CTAPError]string{
+    0x01: "invalid command",
+    0x02: "invalid parameter",
+    0x03: "invalid length",
+    0x11: "CBOR unexpected type",
+    0x12: "invalid CBOR",
+    0x14: "missing parameter",
+    0x19: "credential excluded",
+    0x21: "processing",
+    0x22: "invalid credential",
+    0x26: "unsupported algorithm",
+    0x27: "operation denied",
+    0x28: "key store full",
+    0x2b: "unsupported option",
+    0x2d: "keepalive cancel",
+    0x2e: "no credentials",
+    0x2f: "user action timeout",
+    0x30: "not allowed",
+    0x31: "PIN invalid",
+    0x32: "PIN blocked",
+    0x33: "PIN auth invalid",
+    0x34: "PIN auth blocked",
+    0x35: "PIN not set",
+    0x36: "PUAT required",
+    0x37: "PIN policy violation",
+    0x3b: "request too large",
+    0x3c: "action timeout",
+    0x3d: "user presence required",
+    0x3e: "UV blocked",
+    0x3f: "integrity failure",
+    0x40: "invalid subcommand",
+    0x41: "UV invalid",
+    0x42: "unauthorized permission",
+}
+
+func (e CTAPError) Error() string {
+    if msg, ok := ctapErrors[e]; ok {
+        return fmt.Sprintf("CTAP2 error %02X: %s", byte(e), msg)
+    }
+    return fmt.Sprintf("CTAP2 error %02X", byte(e))
+}
+
+// Send CTAP2 command with CBOR parameters (nil for none) and return the
+// decoded CBOR response (nil if empty).
+func (c *Card) ctap(command byte, params interface{}) (
+    map[interface{}]interface{}, error) {
+    data := []byte{command}
+    if params != nil {
+        encoded, err := cborEncode(params)
+        if err != nil { return nil, err }
+        data = append(data, encoded...)
+    }
+    // P1 0x80: client supports NFCCTAP_GETRESPONSE
+    rsp, err := smartcard.TransmitChained(c.card, 0x80, INS_NFCCTAP_MSG,
+        0x80, 0x00, data, true)
+    if err != nil { return nil, err }
+    for rsp.SW() == SW_STATUS_UPDATE {
+        if c.status != nil && len(rsp.Data()) > 0 {
+            c.status(rsp.Data()[0])
+        }
+        rsp, err = smartcard.TransmitAndGetResponse(c.card,
+            smartcard.Command2(0x80, INS_NFCCTAP_GETRESPONSE, 0x00, 0x00,
+            0x00))
+        if err != nil { return nil, err }
+    }
+    if rsp.SW() != SW.SUCCESS {
+        return nil, smartcard.SWError(rsp.SW())
+    }
+    data = rsp.Data()
+    if len(data) == 0 {
+        return nil, fmt.Errorf("empty CTAP2 response")
+    }
+    if data[0] != 0x00 {
+        return nil, CTAPError(data[0])
+    }
+    if len(data) == 1 {
+        return nil, nil
+    }
+    v, rest, err := cborDecode(data[1:])
+    if err != nil { return nil, err }
+    if len(rest) != 0 {
+        return nil, fmt.Errorf("trailing data after CTAP2 response")
+    }
+    m := cborMapOf(v)
+    if m == nil {
+        return nil, fmt.Errorf("CTAP2 response is not a map")
+    }
+    return m, nil
+}
+
+// Public key credential algorithm.
+type CredentialParameter struct {
+    Type string
+    Algorithm int
+}
+
+func (p CredentialParameter) cbor() map[string]interface{} {
+    return map[string]interface{}{"type": p.Type, "alg": p.Algorithm}
+}
+
+// Authenticator information (authenticatorGetInfo).
+type Info struct {
+    Versions []string
+    Extensions []string
+    AAGUID []byte
+    Options map[string]bool
+    MaxMsgSize int
+    PINUVAuthProtocols []int
+    MaxCredentialCountInList int
+    MaxCredentialIDLength int
+    Transports []string
+    Algorithms []CredentialParameter
+}
+
+// Send authenticatorGetInfo.
+func (c *Card) GetInfo() (*Info, error) {
+    m, err := c.ctap(CTAP_GET_INFO, nil)
+    if err != nil { return nil, err }
+    info := &Info{
+        Versions: cborStringsOf(m[int64(1)]),
+        Extensions: cborStringsOf(m[int64(2)]),
+        AAGUID: cborBytesOf(m[int64(3)]),
+        Options: make(map[string]bool),
+        MaxMsgSize: cborIntOf(m[int64(5)]),
+        MaxCredentialCountInList: cborIntOf(m[int64(7)]),
+        MaxCredentialIDLength: cborIntOf(m[int64(8)]),
+        Transports: cborStringsOf(m[int64(9)]),
+    }
+    for k, v := range cborMapOf(m[int64(4)]) {
+        key, ok1 := k.(string)
+        value, ok2 := v.(bool)
+        if ok1 && ok2 {
+            info.Options[key] = value
+        }
+    }
+    protocols, _ := m[int64(6)].([]interface{})
+    for _, p := range protocols {
+        info.PINUVAuthProtocols = append(info.PINUVAuthProtocols,
+            cborIntOf(p))
+    }
+    algorithms, _ := m[int64(10)].([]interface{})
+    for _, a := range algorithms {
+        am := cborMapOf(a)
+        info.Algorithms = append(info.Algorithms, CredentialParameter{
+            Type: cborStringOf(am["type"]),
+            Algorithm: cborIntOf(am["alg"]),
+        })
+    }
+    return info, nil
+}
+
+// Relying party.
+type RelyingParty struct {
+    ID string
+    Name string
+}
+
+// User account.
+type User struct {
+    ID []byte
+    Name string
+    DisplayName string
+}
+
+func (u User) cbor() map[string]interface{} {
+    m := map[string]interface{}{"id": u.ID}
+    if u.Name != "" {
+        m["name"] = u.Name
+    }
+    if u.DisplayName != "" {
+        m["displayName"] = u.DisplayName
+    }
+    return m
+}
+
+// Public key credential descriptor.
+type CredentialDescriptor struct {
+    Type string
+    ID []byte
+}
+
+func descriptors(list []CredentialDescriptor) []interface{} {
+    out := make([]interface{}, len(list))
+    for i, d := range list {
+        t := d.Type
+        if t == "" {
+            t = "public-key"
+        }
+        out[i] = map[string]interface{}{"type": t, "id": d.ID}
+    }
+    return out
+}
+
+// Parameters of authenticatorMakeCredential.
+type MakeCredentialRequest struct {
+    ClientDataHash []byte
+    RP RelyingParty
+    User User
+    // Defaults to ES256
+    Parameters []CredentialParameter
+    ExcludeList []CredentialDescriptor
+    Extensions map[string]interface{}
+    ResidentKey bool
+    UserVerification bool
+    PINUVAuthParam []byte
+    PINUVAuthProtocol int
+}
+
+// Authenticator data (WebAuthn, 6.1).
+type AuthenticatorData struct {
+    Raw []byte
+    RPIDHash []byte
+    Flags byte
+    SignCount uint32
+    // Attested credential data (FLAG_ATTESTED_CREDENTIAL_DATA)
+    AAGUID []byte
+    CredentialID []byte
+    // COSE encoded public key and its decoded form
+    RawPublicKey []byte
+    PublicKey crypto.PublicKey
+    // CBOR encoded extension outputs (FLAG_EXTENSION_DATA)
+    Extensions []byte
+}
+
+// Parse authenticator data.
+func ParseAuthenticatorData(data []byte) (*AuthenticatorData, error) {
+    if len(data) < 37 {
+        return nil, fmt.Errorf("authenticator data too short")
+    }
+    a := &AuthenticatorData{
+        Raw: data,
+        RPIDHash: data[:32],
+        Flags: data[32],
+        SignCount: binary.BigEndian.Uint32(data[33:37]),
+    }
+    rest := data[37:]
+    if a.Flags & FLAG_ATTESTED_CREDENTIAL_DATA != 0 {
+        if len(rest) < 18 {
+            return nil, fmt.Errorf("attested credential data too short")
+        }
+        a.AAGUID = rest[:16]
+        n := int(binary.BigEndian.Uint16(rest[16:18]))
+        rest = rest[18:]
+        if len(rest) < n {
+            return nil, fmt.Errorf("credential ID too short")
+        }
+        a.CredentialID, rest = rest[:n], rest[n:]
+        key, tail, err := cborDecode(rest)
+        if err != nil { return nil, err }
+        a.RawPublicKey = rest[:len(rest)-len(tail)]
+        a.PublicKey, err = parseCOSEKey(cborMapOf(key))
+        if err != nil { return nil, err }
+        rest = tail
+    }
+    if a.Flags & FLAG_EXTENSION_DATA != 0 {
+        a.Extensions, rest = rest, nil
+    }
+    if len(rest) != 0 {
+        return nil, fmt.Errorf("trailing data after authenticator data")
+    }
+    return a, nil
+}
+
+// Decode COSE_Key (RFC 8152) with EC2 P-256 or OKP Ed25519 key.
+func parseCOSEKey(m map[interface{}]interface{}) (crypto.PublicKey, error) {
+    if m == nil {
+        return nil, fmt.Errorf("invalid COSE key")
+    }
+    kty, alg := cborIntOf(m[int64(1)]), cborIntOf(m[int64(3)])
+    crv := cborIntOf(m[int64(-1)])
+    x := cborBytesOf(m[int64(-2)])
+    switch {
+        case kty == 2 && crv == 1:
+            y := cborBytesOf(m[int64(-3)])
+            pub := &ecdsa.PublicKey{Curve: elliptic.P256(),
+                X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+            if len(x) != 32 || len(y) != 32 ||
+                !pub.Curve.IsOnCurve(pub.X, pub.Y) {
+                return nil, fmt.Errorf("invalid P-256 COSE key")
+            }
+            return pub, nil
+        case kty == 1 && crv == 6:
+            if len(x) != ed25519.PublicKeySize {
+                return nil, fmt.Errorf("invalid Ed25519 COSE key")
+            }
+            return ed25519.PublicKey(x), nil
+    }
+    return nil, fmt.Errorf("unsupported COSE key type %d, algorithm %d, " +
+        "curve %d", kty, alg, crv)
+}
+
+// Attestation object returned by authenticatorMakeCredential.
+type Attestation struct {
+    Format string
+    AuthData *AuthenticatorData
+    // Attestation statement (format specific)
+    Statement map[interface{}]interface{}
+}
+
+// Send authenticatorMakeCredential.
+func (c *Card) MakeCredential(req *MakeCredentialRequest) (*Attestation,
+    error) {
+    params := req.Parameters
+    if len(params) == 0 {
+        params = []CredentialParameter{{"public-key", COSE_ES256}}
+    }
+    algs := make([]interface{}, len(params))
+    for i, p := range params {
+        algs[i] = p.cbor()
+    }
+    rp := map[string]interface{}{"id": req.RP.ID}
+    if req.RP.Name != "" {
+        rp["name"] = req.RP.Name
+    }
+    m := map[int]interface{}{
+        1: req.ClientDataHash,
+        2: rp,
+        3: req.User.cbor(),
+        4: algs,
+    }
+    if len(req.ExcludeList) > 0 {
+        m[5] = descriptors(req.ExcludeList)
+    }
+    if len(req.Extensions) > 0 {
+        m[6] = req.Extensions
+    }
+    options := map[string]interface{}{}
+    if req.ResidentKey {
+        options["rk"] = true
+    }
+    if req.UserVerification {
+        options["uv"] = true
+    }
+    if len(options) > 0 {
+        m[7] = options
+    }
+    if req.PINUVAuthParam != nil {
+        m[8] = req.PINUVAuthParam
+        m[9] = req.PINUVAuthProtocol
+    }
+    rsp, err := c.ctap(CTAP_MAKE_CREDENTIAL, m)
+    if err != nil { return nil, err }
+    authData, err := ParseAuthenticatorData(cborBytesOf(rsp[int64(2)]))
+    if err != nil { return nil, err }
+    if authData.PublicKey == nil {
+        return nil, fmt.Errorf("attested credential data missing")
+    }
+    return &Attestation{
+        Format: cborStringOf(rsp[int64(1)]),
+        AuthData: authData,
+        Statement: cborMapOf(rsp[int64(3)]),
+    }, nil
+}
+
+// Parameters of authenticatorGetAssertion.
+type GetAssertionRequest struct {
+    RPID string
+    ClientDataHash []byte
+    AllowList []CredentialDescriptor
+    Extensions map[string]interface{}
+    // Don't require user presence (silent authentication)
+    NoUserPresence bool
+    UserVerification bool
+    PINUVAuthParam []byte
+    PINUVAuthProtocol int
+}
+
+// Assertion returned by authenticatorGetAssertion.
+type Assertion struct {
+    Credential CredentialDescriptor
+    AuthData *AuthenticatorData
+    Signature []byte
+    // Present for resident credentials
+    User *User
+    NumberOfCredentials int
+}
+
+// Verify assertion signature with credential public key.
+func (a *Assertion) Verify(pub crypto.PublicKey, clientDataHash []byte) error {
+    data := append(append([]byte{}, a.AuthData.Raw...), clientDataHash...)
+    switch k := pub.(type) {
+        case *ecdsa.PublicKey:
+            digest := sha256.Sum256(data)
+            if ecdsa.VerifyASN1(k, digest[:], a.Signature) {
+                return nil
+            }
+        case ed25519.PublicKey:
+            if ed25519.Verify(k, data, a.Signature) {
+                return nil
+            }
+        default:
+            return fmt.Errorf("unsupported public key type %T", pub)
+    }
+    return fmt.Errorf("invalid assertion signature")
+}
+
+// Send authenticatorGetAssertion. If NumberOfCredentials is greater than
+// one, further assertions are returned by GetNextAssertion.
+func (c *Card) GetAssertion(req *GetAssertionRequest) (*Assertion, error) {
+    m := map[int]interface{}{
+        1: req.RPID,
+        2: req.ClientDataHash,
+    }
+    if len(req.AllowList) > 0 {
+        m[3] = descriptors(req.AllowList)
+    }
+    if len(req.Extensions) > 0 {
+        m[4] = req.Extensions
+    }
+    options := map[string]interface{}{}
+    if req.NoUserPresence {
+        options["up"] = false
+    }
+    if req.UserVerification {
+        options["uv"] = true
+    }
+    if len(options) > 0 {
+        m[5] = options
+    }
+    if req.PINUVAuthParam != nil {
+        m[6] = req.PINUVAuthParam
+        m[7] = req.PINUVAuthProtocol
+    }
+    rsp, err := c.ctap(CTAP_GET_ASSERTION, m)
+    if err != nil { return nil, err }
+    return parseAssertion(rsp)
+}
+
+// Send authenticatorGetNextAssertion.
+func (c *Card) GetNextAssertion() (*Assertion, error) {
+    rsp, err := c.ctap(CTAP_GET_NEXT_ASSERTION, nil)
+    if err != nil { return nil, err }
+    return parseAssertion(rsp)
+}
+
+func parseAssertion(m map[interface{}]interface{}) (*Assertion, error) {
+    authData, err := ParseAuthenticatorData(cborBytesOf(m[int64(2)]))
+    if err != nil { return nil, err }
+    a := &Assertion{
+        AuthData: authData,
+        Signature: cborBytesOf(m[int64(3)]),
+        NumberOfCredentials: cborIntOf(m[int64(5)]),
+    }
+    if cred := cborMapOf(m[int64(1)]); cred != nil {
+        a.Credential = CredentialDescriptor{
+            Type: cborStringOf(cred["type"]),
+            ID: cborBytesOf(cred["id"]),
+        }
+    }
+    if user := cborMapOf(m[int64(4)]); user != nil {
+        a.User = &User{
+            ID: cborBytesOf(user["id"]),
+            Name: cborStringOf(user["name"]),
+            DisplayName: cborStringOf(user["displayName"]),
+        }
+    }
+    if len(a.Signature) == 0 {
+        return nil, fmt.Errorf("assertion signature missing")
+    }
+    return a, nil
+}
+
+// Check if authenticator data belongs to relying party ID.
+func (a *AuthenticatorData) MatchesRP(rpID string) bool {
+    h := sha256.Sum256([]byte(rpID))
+    return bytes.Equal(a.RPIDHash, h[:])
+}
@@ -0,0 +1,239 @@
+/*
+Package fido implements a client for FIDO security keys accessed through
+ISO 7816 APDUs, as done by NFC readers: U2F (FIDO U2F NFC protocol) and
+CTAP2 (authenticatorGetInfo, authenticatorMakeCredential and
+authenticatorGetAssertion).
+
+Example:
+
+    key, err := fido.Select(card)
+    // handle error, if any
+    info, err := key.GetInfo()
+    // handle error, if any
+    attestation, err := key.MakeCredential(&fido.MakeCredentialRequest{
+        ClientDataHash: clientDataHash,
+        RP: fido.RelyingParty{ID: "example.com"},
+        User: fido.User{ID: []byte{1}, Name: "user"},
+    })
+*/
+package fido
+
+import (
+    "crypto/ecdsa"
+    "crypto/elliptic"
+    "crypto/sha256"
+    "crypto/x509"
+    "encoding/asn1"
+    "encoding/binary"
+    "errors"
+    "fmt"
+    "github.com/sf1/go-card/smartcard"
+    "github.com/sf1/go-card/smartcard/SW"
+)
+
+// FIDO application identifier.
+var AID = []byte{0xa0, 0x00, 0x00, 0x06, 0x47, 0x2f, 0x00, 0x01}
+
+const (
+    // U2F instructions
+    INS_U2F_REGISTER = 0x01
+    INS_U2F_AUTHENTICATE = 0x02
+    INS_U2F_VERSION = 0x03
+    // CTAP instructions
+    INS_NFCCTAP_MSG = 0x10
+    INS_NFCCTAP_GETRESPONSE = 0x11
+    // U2F authenticate control byte
+    U2F_CHECK_ONLY = 0x07
+    U2F_ENFORCE_USER_PRESENCE = 0x03
+    U2F_DONT_ENFORCE_USER_PRESENCE = 0x08
+    // Status word for CTAP status updates (processing, user presence
+    // needed)
+    SW_STATUS_UPDATE = 0x9100
+)
+
+var (
+    // U2F: test of user presence required (touch the key and retry)
+    ErrUserPresenceRequired = errors.New("user presence required")
+    // U2F: key handle not issued by this authenticator
+    ErrInvalidKeyHandle = errors.New("invalid key handle")
+)
+
+// FIDO authenticator.
+type Card struct {
+    card smartcard.Transmitter
+    version string
+    status func(byte)
+}
+
+// Select FIDO application. The version string returned by SELECT
+// ("U2F_V2" or "FIDO_2_0") is available through Version().
+func Select(card smartcard.Transmitter) (*Card, error) {
+    rsp, err := smartcard.TransmitAndGetResponse(card, smartcard.Command4(
+        0x00, 0xa4, 0x04, 0x00, AID, 0x00))
+    if err != nil { return nil, err }
+    if rsp.SW() != SW.SUCCESS {
+        return nil, fmt.Errorf("can't select FIDO application: %s",
+            smartcard.SWError(rsp.SW()))
+    }
+    return &Card{card: card, version: string(rsp.Data())}, nil
+}
+
+// Return underlying transmitter.
+func (c *Card) Transmitter() smartcard.Transmitter {
+    return c.card
+}
+
+// Return version string returned by SELECT.
+func (c *Card) Version() string {
+    return c.version
+}
+
+// Check if the authenticator supports CTAP2.
+func (c *Card) SupportsCTAP2() bool {
+    return c.version == "FIDO_2_0"
+}
+
+// Set function called with CTAP status updates while the authenticator
+// is processing a request (1: processing, 2: user presence needed).
+func (c *Card) OnStatus(f func(status byte)) {
+    c.status = f
+}
+
+func (c *Card) u2f(ins, p1 byte, data []byte) ([]byte, error) {
+    var cmd smartcard.CommandAPDU
+    if data == nil {
+        cmd = smartcard.Command2(0x00, ins, p1, 0x00, 0x00)
+    } else {
+        cmd = smartcard.Command4(0x00, ins, p1, 0x00, data, 0x00)
+    }
+    rsp, err := smartcard.TransmitAndGetResponse(c.card, cmd)
+    if err != nil { return nil, err }
+    switch rsp.SW() {
+        case SW.SUCCESS:
+            return rsp.Data(), nil
+        case SW.CONDITIONS_NOT_SATISFIED:
+            return nil, ErrUserPresenceRequired
+        case SW.WRONG_DATA:
+            return nil, ErrInvalidKeyHandle
+    }
+    return nil, smartcard.SWError(rsp.SW())
+}
+
+// Return U2F protocol version ("U2F_V2").
+func (c *Card) U2FVersion() (string, error) {
+    data, err := c.u2f(INS_U2F_VERSION, 0x00, nil)
+    return string(data), err
+}
+
+// Application parameter for an origin or AppID.
+func AppParam(appID string) []byte {
+    h := sha256.Sum256([]byte(appID))
+    return h[:]
+}
+
+// U2F registration response.
+type RegisterResponse struct {
+    // Uncompressed P-256 point
+    RawPublicKey []byte
+    PublicKey *ecdsa.PublicKey
+    KeyHandle []byte
+    Certificate *x509.Certificate
+    Signature []byte
+}
+
+// Verify attestation signature with the attestation certificate.
+func (r *RegisterResponse) Verify(challenge, application []byte) error {
+    data := []byte{0x00}
+    data = append(data, application...)
+    data = append(data, challenge...)
+    data = append(data, r.KeyHandle...)
+    data = append(data, r.RawPublicKey...)
+    return r.Certificate.CheckSignature(x509.ECDSAWithSHA256, data,
+        r.Signature)
+}
+
+// Register new key pair for application parameter (32 bytes) using
+// challenge parameter (32 bytes). Returns ErrUserPresenceRequired until
+// the user touches the key.
+func (c *Card) Register(challenge, application []byte) (*RegisterResponse,
+    error) {
+    if len(challenge) != 32 || len(application) != 32 {
+        return nil, fmt.Errorf("challenge and application must be 32 bytes")
+    }
+    data, err := c.u2f(INS_U2F_REGISTER, 0x00,
+        append(append([]byte{}, challenge...), application...))
+    if err != nil { return nil, err }
+    if len(data) < 67 || data[0] != 0x05 {
+        return nil, fmt.Errorf("invalid registration response")
+    }
+    r := &RegisterResponse{RawPublicKey: data[1:66]}
+    x, y := elliptic.Unmarshal(elliptic.P256(), r.RawPublicKey)
+    if x == nil {
+        return nil, fmt.Errorf("invalid user public key")
+    }
+    r.PublicKey = &ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}
+    n := int(data[66])
+    data = data[67:]
+    if len(data) < n {
+        return nil, fmt.Errorf("invalid registration response")
+    }
+    r.KeyHandle, data = data[:n], data[n:]
+    var raw asn1.RawValue
+    rest, err := asn1.Unmarshal(data, &raw)
+    if err != nil {
+        return nil, fmt.Errorf("invalid attestation certificate: %s", err)
+    }
+    r.Certificate, err = x509.ParseCertificate(data[:len(data)-len(rest)])
+    if err != nil { return nil, err }
+    r.Signature = rest
+    return r, nil
+}
+
+// U2F authentication response.
+type AuthenticateResponse struct {
+    UserPresence byte
+    Counter uint32
+    Signature []byte
+}
+
+// Verify authentication signature with the registered public key.
+func (r *AuthenticateResponse) Verify(pub *ecdsa.PublicKey, challenge,
+    application []byte) error {
+    data := append([]byte{}, application...)
+    data = append(data, r.UserPresence, 0, 0, 0, 0)
+    binary.BigEndian.PutUint32(data[len(data)-4:], r.Counter)
+    data = append(data, challenge...)
+    digest := sha256.Sum256(data)
+    if !ecdsa.VerifyASN1(pub, digest[:], r.Signature) {
+        return fmt.Errorf("invalid authentication signature")
+    }
+    return nil
+}
+
+// Authenticate with key handle. control is one of U2F_CHECK_ONLY,
+// U2F_ENFORCE_USER_PRESENCE and U2F_DONT_ENFORCE_USER_PRESENCE. With
+// U2F_CHECK_ONLY, ErrUserPresenceRequired means the key handle is valid.
+func (c *Card) Authenticate(control byte, challenge, application,
+    keyHandle []byte) (*AuthenticateResponse, error) {
+    if len(challenge) != 32 || len(application) != 32 ||
+        len(keyHandle) > 255 {
+        return nil, fmt.Errorf("invalid authentication parameters")
+    }
+    data := append([]byte{}, challenge...)
+    data = append(data, application...)
+    data = append(data, byte(len(keyHandle)))
+    data = append(data, keyHandle...)
+    if len(data) > 255 {
+        return nil, fmt.Errorf("key handle too long for short APDU")
+    }
+    rsp, err := c.u2f(INS_U2F_AUTHENTICATE, control, data)
+    if err != nil { return nil, err }
+    if len(rsp) < 6 {
+        return nil, fmt.Errorf("invalid authentication response")
+    }
+    return &AuthenticateResponse{
+        UserPresence: rsp[0],
+        Counter: binary.BigEndian.Uint32(rsp[1:5]),
+        Signature: rsp[5:],
+    }, nil
+}
@@ -0,0 +1,161 @@
+package fido
+
+import (
+    "bytes"
+    "crypto/ecdsa"
+    "crypto/sha256"
+    "fmt"
+    "testing"
+    "github.com/sf1/go-card/smartcard/mock"
+)
+
+func TestU2F(t *testing.T) {
+    sim := newSimKey(false)
+    key, err := Select(sim)
+    if err != nil { t.Fatal(err) }
+    if key.Version() != "U2F_V2" || key.SupportsCTAP2() {
+        t.Errorf("unexpected version %q", key.Version())
+    }
+    version, err := key.U2FVersion()
+    if err != nil { t.Fatal(err) }
+    if version != "U2F_V2" {
+        t.Errorf("unexpected U2F version %q", version)
+    }
+    challenge := sha256.Sum256([]byte("challenge"))
+    app := AppParam("https://example.com")
+    _, err = key.Register(challenge[:], app)
+    if err != ErrUserPresenceRequired {
+        t.Fatalf("expected user presence error, got %v", err)
+    }
+    reg, err := key.Register(challenge[:], app)
+    if err != nil { t.Fatal(err) }
+    if err := reg.Verify(challenge[:], app); err != nil {
+        t.Errorf("attestation signature: %s", err)
+    }
+    _, err = key.Authenticate(U2F_CHECK_ONLY, challenge[:], app,
+        reg.KeyHandle)
+    if err != ErrUserPresenceRequired {
+        t.Errorf("check-only with valid key handle: %v", err)
+    }
+    _, err = key.Authenticate(U2F_CHECK_ONLY, challenge[:], app,
+        []byte{1, 2, 3})
+    if err != ErrInvalidKeyHandle {
+        t.Errorf("check-only with invalid key handle: %v", err)
+    }
+    auth, err := key.Authenticate(U2F_ENFORCE_USER_PRESENCE, challenge[:],
+        app, reg.KeyHandle)
+    if err != nil { t.Fatal(err) }
+    if auth.UserPresence != 0x01 || auth.Counter != 1 {
+        t.Errorf("unexpected authentication response %+v", auth)
+    }
+    if err := auth.Verify(reg.PublicKey, challenge[:], app); err != nil {
+        t.Error(err)
+    }
+    if err := auth.Verify(reg.PublicKey, app, app); err == nil {
+        t.Error("signature over wrong challenge accepted")
+    }
+}
+
+func TestCTAP2(t *testing.T) {
+    sim := newSimKey(true)
+    key, err := Select(sim)
+    if err != nil { t.Fatal(err) }
+    if !key.SupportsCTAP2() {
+        t.Fatal("CTAP2 not detected")
+    }
+    var updates []byte
+    key.OnStatus(func(status byte) {
+        updates = append(updates, status)
+    })
+    info, err := key.GetInfo()
+    if err != nil { t.Fatal(err) }
+    // first request answered with a status update
+    if !bytes.Equal(updates, []byte{0x02}) {
+        t.Errorf("unexpected status updates %X", updates)
+    }
+    if len(info.Versions) != 2 || info.Versions[1] != "FIDO_2_0" ||
+        !info.Options["rk"] || info.Options["clientPin"] ||
+        info.MaxMsgSize != 1200 || len(info.Algorithms) != 1 ||
+        info.Algorithms[0].Algorithm != COSE_ES256 {
+        t.Errorf("unexpected info %+v", info)
+    }
+    clientDataHash := sha256.Sum256([]byte("client data"))
+    att, err := key.MakeCredential(&MakeCredentialRequest{
+        ClientDataHash: clientDataHash[:],
+        RP: RelyingParty{ID: "example.com", Name: "Example"},
+        User: User{ID: []byte{1, 2, 3}, Name: "user"},
+    })
+    if err != nil { t.Fatal(err) }
+    if att.Format != "packed" || !att.AuthData.MatchesRP("example.com") ||
+        len(att.AuthData.CredentialID) != 64 {
+        t.Errorf("unexpected attestation %+v", att)
+    }
+    pub, ok := att.AuthData.PublicKey.(*ecdsa.PublicKey)
+    if !ok {
+        t.Fatalf("unexpected public key type %T", att.AuthData.PublicKey)
+    }
+    // second credential for the same RP
+    _, err = key.MakeCredential(&MakeCredentialRequest{
+        ClientDataHash: clientDataHash[:],
+        RP: RelyingParty{ID: "example.com"},
+        User: User{ID: []byte{4}},
+    })
+    if err != nil { t.Fatal(err) }
+    found := false
+    assertion, err := key.GetAssertion(&GetAssertionRequest{
+        RPID: "example.com",
+        ClientDataHash: clientDataHash[:],
+    })
+    for i := 0; err == nil; i++ {
+        if assertion.NumberOfCredentials != 2 && i == 0 {
+            t.Errorf("expected 2 credentials, got %d",
+                assertion.NumberOfCredentials)
+        }
+        if bytes.Equal(assertion.Credential.ID, att.AuthData.CredentialID) {
+            found = true
+            if err := assertion.Verify(pub, clientDataHash[:]); err != nil {
+                t.Error(err)
+            }
+        }
+        assertion, err = key.GetNextAssertion()
+    }
+    if err != CTAPError(0x2e) {
+        t.Errorf("expected no credentials error, got %v", err)
+    }
+    if !found {
+        t.Error("credential not returned")
+    }
+    _, err = key.GetAssertion(&GetAssertionRequest{
+        RPID: "other.example",
+        ClientDataHash: clientDataHash[:],
+    })
+    if err == nil || err.Error() != "CTAP2 error 2E: no credentials" {
+        t.Errorf("unexpected error %v", err)
+    }
+}
+
+// authenticatorGetInfo response of the CTAP 2.0 specification (5.4)
+func TestGetInfoVector(t *testing.T) {
+    card := mock.NewCard(nil).
+        Expect("00 a4 04 00 08 a0 00 00 06 47 2f 00 01 00",
+            "46 49 44 4f 5f 32 5f 30 90 00").
+        Expect("80 10 80 00 01 04 00", "00 a6 01 82 66 55 32 46 5f 56 32 " +
+            "68 46 49 44 4f 5f 32 5f 30 02 82 63 75 76 6d 6b 68 6d 61 63 " +
+            "2d 73 65 63 72 65 74 03 50 f8 a0 11 f3 8c 0a 4d 15 80 06 17 " +
+            "11 1f 9e dc 7d 04 a4 62 72 6b f5 62 75 70 f5 64 70 6c 61 74 " +
+            "f4 69 63 6c 69 65 6e 74 50 69 6e f4 05 19 04 b0 06 81 01 90 00")
+    key, err := Select(card)
+    if err != nil { t.Fatal(err) }
+    info, err := key.GetInfo()
+    if err != nil { t.Fatal(err) }
+    card.AssertExpectations(t)
+    if s := fmt.Sprint(info.Versions, info.Extensions, info.Options,
+        info.MaxMsgSize, info.PINUVAuthProtocols); s != "[U2F_V2 FIDO_2_0] " +
+        "[uvm hmac-secret] map[clientPin:false plat:false rk:true up:true] " +
+        "1200 [1]" {
+        t.Errorf("unexpected info %s", s)
+    }
+    if !bytes.Equal(info.AAGUID, mock.Hex("f8a011f38c0a4d15800617111f9edc7d")) {
+        t.Errorf("unexpected AAGUID %X", info.AAGUID)
+    }
+}
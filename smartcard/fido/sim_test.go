@@ -0,0 +1,321 @@
+package fido
+
+import (
+    "bytes"
+    "crypto/ecdsa"
+    "crypto/elliptic"
+    "crypto/rand"
+    "crypto/sha256"
+    "crypto/x509"
+    "crypto/x509/pkix"
+    "encoding/binary"
+    "fmt"
+    "math/big"
+    "time"
+    "github.com/sf1/go-card/smartcard"
+    "github.com/sf1/go-card/smartcard/mock"
+)
+
+// Simulated FIDO authenticator for tests: a mock card with a rule per
+// instruction working on the authenticator state.
+type simKey struct {
+    *mock.Card
+    ctap2 bool
+    attestationKey *ecdsa.PrivateKey
+    attestationCert []byte
+    // key handle or credential ID -> key
+    keys map[string]*ecdsa.PrivateKey
+    rpIDHashes map[string][]byte
+    counter uint32
+    // number of requests to answer with a user presence error / status
+    // update before proceeding
+    touchAfter int
+    chained []byte
+    pending []byte
+    deferred []byte
+    assertions [][]byte
+}
+
+func newSimKey(ctap2 bool) *simKey {
+    key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+    if err != nil { panic(err) }
+    template := &x509.Certificate{
+        SerialNumber: big.NewInt(1),
+        Subject: pkix.Name{CommonName: "Simulated Attestation"},
+        NotBefore: time.Now().Add(-time.Hour),
+        NotAfter: time.Now().Add(time.Hour),
+    }
+    cert, err := x509.CreateCertificate(rand.Reader, template, template,
+        &key.PublicKey, key)
+    if err != nil { panic(err) }
+    s := &simKey{
+        ctap2: ctap2,
+        attestationKey: key,
+        attestationCert: cert,
+        keys: make(map[string]*ecdsa.PrivateKey),
+        rpIDHashes: make(map[string][]byte),
+        touchAfter: 1,
+    }
+    s.Card = mock.NewCard(mock.Hex("3b 80 80 01 01")).
+        RuleFunc("90 *", s.chain).
+        RuleFunc("00 a4 04 00 *", s.rule(s.selectApplication)).
+        RuleFunc("00 c0 00 00 *", s.rule(s.getResponse)).
+        RuleFunc("00 03 00 00 *", s.rule(s.version)).
+        RuleFunc("00 01 *", s.rule(s.register)).
+        RuleFunc("00 02 *", s.rule(s.authenticate))
+    if ctap2 {
+        s.Card.
+            RuleFunc("80 10 *", s.rule(s.ctapMessage)).
+            RuleFunc("80 11 00 00 *", s.rule(s.ctapGetResponse))
+    }
+    return s
+}
+
+func sw(code uint16) smartcard.ResponseAPDU {
+    return smartcard.ResponseAPDU{byte(code >> 8), byte(code)}
+}
+
+// Return response data, at most 256 bytes at a time (T=0 style).
+func (s *simKey) respond(data []byte) smartcard.ResponseAPDU {
+    if len(data) <= 256 {
+        s.pending = nil
+        return append(append([]byte{}, data...), 0x90, 0x00)
+    }
+    s.pending = data[256:]
+    n := len(s.pending)
+    if n > 255 {
+        n = 0
+    }
+    return append(append([]byte{}, data[:256]...), 0x61, byte(n))
+}
+
+func (s *simKey) sign(key *ecdsa.PrivateKey, data []byte) []byte {
+    digest := sha256.Sum256(data)
+    sig, err := ecdsa.SignASN1(rand.Reader, key, digest[:])
+    if err != nil { panic(err) }
+    return sig
+}
+
+func (s *simKey) newKey() ([]byte, *ecdsa.PrivateKey) {
+    key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+    if err != nil { panic(err) }
+    handle := make([]byte, 64)
+    rand.Read(handle)
+    s.keys[string(handle)] = key
+    return handle, key
+}
+
+// Collect data of chained command.
+func (s *simKey) chain(cmd smartcard.CommandAPDU) (smartcard.ResponseAPDU,
+    error) {
+    if !cmd.IsValid() {
+        return nil, fmt.Errorf("invalid APDU %X", []byte(cmd))
+    }
+    s.chained = append(s.chained, cmd.Data()...)
+    return sw(0x9000), nil
+}
+
+// Return rule calling fn with the data of the command and the preceding
+// chained commands.
+func (s *simKey) rule(fn func(cmd smartcard.CommandAPDU,
+    data []byte) smartcard.ResponseAPDU) mock.HandlerFunc {
+    return func(cmd smartcard.CommandAPDU) (smartcard.ResponseAPDU, error) {
+        if !cmd.IsValid() {
+            return nil, fmt.Errorf("invalid APDU %X", []byte(cmd))
+        }
+        data := append(s.chained, cmd.Data()...)
+        s.chained = nil
+        return fn(cmd, data), nil
+    }
+}
+
+func (s *simKey) selectApplication(cmd smartcard.CommandAPDU,
+    data []byte) smartcard.ResponseAPDU {
+    if !bytes.Equal(data, AID) {
+        return sw(0x6a82)
+    }
+    if s.ctap2 {
+        return s.respond([]byte("FIDO_2_0"))
+    }
+    return s.respond([]byte("U2F_V2"))
+}
+
+func (s *simKey) getResponse(cmd smartcard.CommandAPDU,
+    data []byte) smartcard.ResponseAPDU {
+    return s.respond(s.pending)
+}
+
+func (s *simKey) version(cmd smartcard.CommandAPDU,
+    data []byte) smartcard.ResponseAPDU {
+    return s.respond([]byte("U2F_V2"))
+}
+
+func (s *simKey) ctapMessage(cmd smartcard.CommandAPDU,
+    data []byte) smartcard.ResponseAPDU {
+    rsp := s.ctap(data)
+    if s.touchAfter > 0 && cmd[2] & 0x80 != 0 {
+        s.touchAfter--
+        s.deferred = rsp
+        return smartcard.ResponseAPDU{0x02, 0x91, 0x00}
+    }
+    return s.respond(rsp)
+}
+
+func (s *simKey) ctapGetResponse(cmd smartcard.CommandAPDU,
+    data []byte) smartcard.ResponseAPDU {
+    if s.deferred == nil {
+        return sw(0x6985)
+    }
+    rsp := s.deferred
+    s.deferred = nil
+    return s.respond(rsp)
+}
+
+func (s *simKey) register(cmd smartcard.CommandAPDU,
+    data []byte) smartcard.ResponseAPDU {
+    if s.touchAfter > 0 {
+        s.touchAfter--
+        return sw(0x6985)
+    }
+    if len(data) != 64 {
+        return sw(0x6700)
+    }
+    challenge, application := data[:32], data[32:]
+    handle, key := s.newKey()
+    pub := elliptic.Marshal(elliptic.P256(), key.X, key.Y)
+    signed := append([]byte{0x00}, application...)
+    signed = append(signed, challenge...)
+    signed = append(signed, handle...)
+    signed = append(signed, pub...)
+    rsp := append([]byte{0x05}, pub...)
+    rsp = append(rsp, byte(len(handle)))
+    rsp = append(rsp, handle...)
+    rsp = append(rsp, s.attestationCert...)
+    rsp = append(rsp, s.sign(s.attestationKey, signed)...)
+    return s.respond(rsp)
+}
+
+func (s *simKey) authenticate(cmd smartcard.CommandAPDU,
+    data []byte) smartcard.ResponseAPDU {
+    control := cmd[2]
+    if len(data) < 65 || len(data) != 65 + int(data[64]) {
+        return sw(0x6700)
+    }
+    challenge, application := data[:32], data[32:64]
+    key, ok := s.keys[string(data[65:])]
+    if !ok {
+        return sw(0x6a80)
+    }
+    if control == U2F_CHECK_ONLY {
+        return sw(0x6985)
+    }
+    s.counter++
+    rsp := append([]byte{}, application...)
+    rsp = append(rsp, 0x01, 0, 0, 0, 0)
+    binary.BigEndian.PutUint32(rsp[len(rsp)-4:], s.counter)
+    rsp = append(rsp, challenge...)
+    return s.respond(append(rsp[32:37], s.sign(key, rsp)...))
+}
+
+func ctapResponse(m map[int]interface{}) []byte {
+    encoded, err := cborEncode(m)
+    if err != nil { panic(err) }
+    return append([]byte{0x00}, encoded...)
+}
+
+func (s *simKey) authData(rpIDHash []byte, flags byte, extra []byte) []byte {
+    s.counter++
+    data := append([]byte{}, rpIDHash...)
+    data = append(data, flags, 0, 0, 0, 0)
+    binary.BigEndian.PutUint32(data[33:], s.counter)
+    return append(data, extra...)
+}
+
+func (s *simKey) ctap(data []byte) []byte {
+    if len(data) == 0 {
+        return []byte{0x01}
+    }
+    var params map[interface{}]interface{}
+    if len(data) > 1 {
+        v, _, err := cborDecode(data[1:])
+        if err != nil {
+            return []byte{0x12}
+        }
+        params = cborMapOf(v)
+    }
+    switch data[0] {
+        case CTAP_GET_INFO:
+            return ctapResponse(map[int]interface{}{
+                1: []interface{}{"U2F_V2", "FIDO_2_0"},
+                3: bytes.Repeat([]byte{0xaa}, 16),
+                4: map[string]interface{}{"rk": true, "up": true,
+                    "clientPin": false},
+                5: 1200,
+                6: []interface{}{1},
+                9: []interface{}{"nfc", "usb"},
+                10: []interface{}{map[string]interface{}{"type": "public-key",
+                    "alg": COSE_ES256}},
+            })
+        case CTAP_MAKE_CREDENTIAL:
+            clientDataHash := cborBytesOf(params[int64(1)])
+            rp := cborMapOf(params[int64(2)])
+            if clientDataHash == nil || rp == nil {
+                return []byte{0x14}
+            }
+            rpIDHash := sha256.Sum256([]byte(cborStringOf(rp["id"])))
+            handle, key := s.newKey()
+            s.rpIDHashes[string(handle)] = rpIDHash[:]
+            coseKey, _ := cborEncode(map[int]interface{}{
+                1: 2, 3: COSE_ES256, -1: 1,
+                -2: leftPad(key.X.Bytes()), -3: leftPad(key.Y.Bytes()),
+            })
+            attested := bytes.Repeat([]byte{0xaa}, 16)
+            attested = append(attested, byte(len(handle) >> 8),
+                byte(len(handle)))
+            attested = append(attested, handle...)
+            attested = append(attested, coseKey...)
+            authData := s.authData(rpIDHash[:], FLAG_USER_PRESENT |
+                FLAG_ATTESTED_CREDENTIAL_DATA, attested)
+            sig := s.sign(s.attestationKey, append(append([]byte{},
+                authData...), clientDataHash...))
+            return ctapResponse(map[int]interface{}{
+                1: "packed",
+                2: authData,
+                3: map[string]interface{}{"alg": COSE_ES256, "sig": sig,
+                    "x5c": []interface{}{s.attestationCert}},
+            })
+        case CTAP_GET_ASSERTION:
+            rpIDHash := sha256.Sum256([]byte(cborStringOf(params[int64(1)])))
+            clientDataHash := cborBytesOf(params[int64(2)])
+            s.assertions = nil
+            for handle, hash := range s.rpIDHashes {
+                if !bytes.Equal(hash, rpIDHash[:]) {
+                    continue
+                }
+                authData := s.authData(rpIDHash[:], FLAG_USER_PRESENT, nil)
+                sig := s.sign(s.keys[handle], append(append([]byte{},
+                    authData...), clientDataHash...))
+                s.assertions = append(s.assertions, ctapResponse(
+                    map[int]interface{}{
+                        1: map[string]interface{}{"type": "public-key",
+                            "id": []byte(handle)},
+                        2: authData,
+                        3: sig,
+                        5: len(s.rpIDHashes),
+                    }))
+            }
+            fallthrough
+        case CTAP_GET_NEXT_ASSERTION:
+            if len(s.assertions) == 0 {
+                return []byte{0x2e}
+            }
+            rsp := s.assertions[0]
+            s.assertions = s.assertions[1:]
+            return rsp
+    }
+    return []byte{0x01}
+}
+
+func leftPad(b []byte) []byte {
+    return append(make([]byte, 32-len(b)), b...)
+}
@@ -0,0 +1,136 @@
+package globalplatform
+
+import (
+    "archive/zip"
+    "bytes"
+    "fmt"
+    "io"
+    "io/ioutil"
+    "os"
+    "path"
+    "strings"
+)
+
+// CAP file components in load order (Java Card VM Specification, 6.3).
+var capComponents = []string{
+    "Header", "Directory", "Import", "Applet", "Class", "Method",
+    "StaticField", "Export", "ConstantPool", "RefLocation", "Descriptor",
+}
+
+// Java Card CAP file.
+type CAPFile struct {
+    PackageAID []byte
+    PackageName string
+    MajorVersion byte
+    MinorVersion byte
+    // AIDs of the applets defined by the package
+    Applets [][]byte
+    components map[string][]byte
+}
+
+// Open and parse CAP file.
+func OpenCAPFile(name string) (*CAPFile, error) {
+    file, err := os.Open(name)
+    if err != nil { return nil, err }
+    defer file.Close()
+    info, err := file.Stat()
+    if err != nil { return nil, err }
+    return ParseCAPFile(file, info.Size())
+}
+
+// Parse CAP file (a ZIP archive containing the CAP components).
+func ParseCAPFile(r io.ReaderAt, size int64) (*CAPFile, error) {
+    archive, err := zip.NewReader(r, size)
+    if err != nil { return nil, err }
+    c := &CAPFile{components: make(map[string][]byte)}
+    for _, f := range archive.File {
+        if !strings.HasSuffix(f.Name, ".cap") {
+            continue
+        }
+        dir, base := path.Split(f.Name)
+        if !strings.HasSuffix(dir, "javacard/") {
+            continue
+        }
+        component := strings.TrimSuffix(base, ".cap")
+        rc, err := f.Open()
+        if err != nil { return nil, err }
+        data, err := ioutil.ReadAll(rc)
+        rc.Close()
+        if err != nil { return nil, err }
+        if _, ok := c.components[component]; ok {
+            return nil, fmt.Errorf("duplicate CAP component: %s", component)
+        }
+        c.components[component] = data
+        if component == "Header" {
+            c.PackageName = strings.Replace(
+                strings.TrimSuffix(dir, "/javacard/"), "/", ".", -1)
+        }
+    }
+    for _, required := range []string{"Header", "Directory", "Class",
+        "Method", "ConstantPool"} {
+        if _, ok := c.components[required]; !ok {
+            return nil, fmt.Errorf("missing CAP component: %s", required)
+        }
+    }
+    err = c.parseHeader(c.components["Header"])
+    if err != nil { return nil, err }
+    if applet, ok := c.components["Applet"]; ok {
+        err = c.parseApplet(applet)
+        if err != nil { return nil, err }
+    }
+    return c, nil
+}
+
+func (c *CAPFile) parseHeader(data []byte) error {
+    // tag(1) size(2) magic(4) minor(1) major(1) flags(1) package_info
+    if len(data) < 13 || data[0] != 0x01 {
+        return fmt.Errorf("invalid CAP header component")
+    }
+    if !bytes.Equal(data[3:7], []byte{0xde, 0xca, 0xff, 0xed}) {
+        return fmt.Errorf("invalid CAP file magic")
+    }
+    c.MinorVersion = data[10]
+    c.MajorVersion = data[11]
+    n := int(data[12])
+    if n < 5 || n > 16 || len(data) < 13 + n {
+        return fmt.Errorf("invalid package AID in CAP header")
+    }
+    c.PackageAID = data[13:13+n]
+    return nil
+}
+
+func (c *CAPFile) parseApplet(data []byte) error {
+    // tag(1) size(2) count(1) { aid_length(1) aid install_method_offset(2) }
+    if len(data) < 4 || data[0] != 0x03 {
+        return fmt.Errorf("invalid CAP applet component")
+    }
+    count := int(data[3])
+    data = data[4:]
+    for i := 0; i < count; i++ {
+        if len(data) < 1 || len(data) < int(data[0]) + 3 {
+            return fmt.Errorf("invalid CAP applet component")
+        }
+        n := int(data[0])
+        c.Applets = append(c.Applets, data[1:1+n])
+        data = data[3+n:]
+    }
+    return nil
+}
+
+// Return load file data block, i.e. the concatenated CAP components.
+// The optional Descriptor component is only included if requested.
+func (c *CAPFile) LoadFileDataBlock(includeDescriptor bool) []byte {
+    var buffer bytes.Buffer
+    for _, name := range capComponents {
+        if name == "Descriptor" && !includeDescriptor {
+            continue
+        }
+        buffer.Write(c.components[name])
+    }
+    return buffer.Bytes()
+}
+
+// Return size of the code loaded onto the card.
+func (c *CAPFile) CodeSize(includeDescriptor bool) int {
+    return len(c.LoadFileDataBlock(includeDescriptor))
+}
@@ -0,0 +1,81 @@
+/*
+Package globalplatform implements GlobalPlatform secure channels and card
+management on top of smartcard.Card.
+
+Example:
+
+    session, err := globalplatform.OpenSecureChannel(card, &globalplatform.Config{
+        Keys: globalplatform.DefaultKeys(),
+        SecurityLevel: globalplatform.SEC_C_MAC,
+    })
+    // handle error, if any
+    response, err := session.TransmitAPDU(command)
+*/
+package globalplatform
+
+import (
+    "crypto/cipher"
+    "crypto/des"
+    "fmt"
+)
+
+const (
+    // Class bytes
+    CLA_GP = 0x80
+    CLA_SECURE = 0x84
+    // Instructions
+    INS_INITIALIZE_UPDATE = 0x50
+    INS_EXTERNAL_AUTHENTICATE = 0x82
+    INS_DELETE = 0xe4
+    INS_INSTALL = 0xe6
+    INS_LOAD = 0xe8
+    INS_SET_STATUS = 0xf0
+    INS_GET_STATUS = 0xf2
+    INS_PUT_KEY = 0xd8
+    INS_GET_DATA = 0xca
+)
+
+// Append ISO 9797-1 padding method 2 ('80 00 ..').
+func pad(data []byte, blockSize int) []byte {
+    padded := make([]byte, len(data), len(data) + blockSize)
+    copy(padded, data)
+    padded = append(padded, 0x80)
+    for len(padded) % blockSize != 0 {
+        padded = append(padded, 0x00)
+    }
+    return padded
+}
+
+// Remove ISO 9797-1 padding method 2.
+func unpad(data []byte) ([]byte, error) {
+    for i := len(data) - 1; i >= 0; i-- {
+        switch data[i] {
+            case 0x00:
+                continue
+            case 0x80:
+                return data[:i], nil
+        }
+        break
+    }
+    return nil, fmt.Errorf("invalid padding")
+}
+
+// Create 3DES cipher from a 16 or 24 byte key.
+func tripleDES(key []byte) (cipher.Block, error) {
+    switch len(key) {
+        case 16:
+            k := make([]byte, 24)
+            copy(k, key)
+            copy(k[16:], key[:8])
+            return des.NewTripleDESCipher(k)
+        case 24:
+            return des.NewTripleDESCipher(key)
+    }
+    return nil, fmt.Errorf("invalid 3DES key length: %d", len(key))
+}
+
+func xor(dst, a, b []byte) {
+    for i := range dst {
+        dst[i] = a[i] ^ b[i]
+    }
+}
@@ -0,0 +1,96 @@
+package globalplatform
+
+import (
+    "crypto/aes"
+    "crypto/cipher"
+    "fmt"
+)
+
+// Key diversification method applied to the static keys before the
+// secure channel is opened.
+type Diversification int
+
+const (
+    DIVERSIFY_NONE Diversification = iota
+    DIVERSIFY_VISA2
+    DIVERSIFY_EMV_CPS
+)
+
+// Static secure channel keys.
+type KeySet struct {
+    ENC []byte
+    MAC []byte
+    DEK []byte
+}
+
+// Return the well-known GlobalPlatform test keys (40..4F).
+func DefaultKeys() KeySet {
+    key := make([]byte, 16)
+    for i := range key {
+        key[i] = 0x40 + byte(i)
+    }
+    return KeySet{ENC: key, MAC: key, DEK: key}
+}
+
+// Create key set that uses the same key for ENC, MAC and DEK.
+func SingleKey(key []byte) KeySet {
+    return KeySet{ENC: key, MAC: key, DEK: key}
+}
+
+// Diversify master keys using the key diversification data (first ten
+// bytes of the INITIALIZE UPDATE response). SCP02 keys are diversified
+// with 3DES, SCP03 keys with AES.
+func (keys KeySet) Diversify(method Diversification, kdd []byte,
+    scp byte) (KeySet, error) {
+    if method == DIVERSIFY_NONE {
+        return keys, nil
+    }
+    if len(kdd) != 10 {
+        return KeySet{}, fmt.Errorf("invalid diversification data length: %d",
+            len(kdd))
+    }
+    var err error
+    var result KeySet
+    result.ENC, err = diversifyKey(keys.ENC, method, kdd, 0x01, scp)
+    if err != nil { return KeySet{}, err }
+    result.MAC, err = diversifyKey(keys.MAC, method, kdd, 0x02, scp)
+    if err != nil { return KeySet{}, err }
+    result.DEK, err = diversifyKey(keys.DEK, method, kdd, 0x03, scp)
+    if err != nil { return KeySet{}, err }
+    return result, nil
+}
+
+func diversifyKey(master []byte, method Diversification, kdd []byte,
+    constant byte, scp byte) ([]byte, error) {
+    var data []byte
+    switch method {
+        case DIVERSIFY_VISA2:
+            data = append(data, kdd[0:2]...)
+            data = append(data, kdd[4:8]...)
+            data = append(data, 0xf0, constant)
+            data = append(data, kdd[0:2]...)
+            data = append(data, kdd[4:8]...)
+            data = append(data, 0x0f, constant)
+        case DIVERSIFY_EMV_CPS:
+            data = append(data, kdd[4:10]...)
+            data = append(data, 0xf0, constant)
+            data = append(data, kdd[4:10]...)
+            data = append(data, 0x0f, constant)
+        default:
+            return nil, fmt.Errorf("unknown diversification method: %d", method)
+    }
+    var block cipher.Block
+    var err error
+    if scp == 0x03 {
+        block, err = aes.NewCipher(master)
+    } else {
+        block, err = tripleDES(master)
+    }
+    if err != nil { return nil, err }
+    size := block.BlockSize()
+    key := make([]byte, len(data))
+    for i := 0; i < len(data); i += size {
+        block.Encrypt(key[i:i+size], data[i:i+size])
+    }
+    return key, nil
+}
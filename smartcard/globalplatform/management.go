@@ -0,0 +1,286 @@
+package globalplatform
+
+import (
+    "crypto/aes"
+    "crypto/des"
+    "crypto/sha1"
+    "fmt"
+    "github.com/sf1/go-card/smartcard"
+    "github.com/sf1/go-card/smartcard/SW"
+    "github.com/sf1/go-card/smartcard/tlv"
+)
+
+const (
+    // INSTALL command variants (P1)
+    INSTALL_FOR_LOAD = 0x02
+    INSTALL_FOR_INSTALL = 0x04
+    INSTALL_FOR_MAKE_SELECTABLE = 0x08
+    INSTALL_FOR_PERSONALIZATION = 0x20
+    // Default LOAD block size, leaves room for secure channel overhead
+    DEFAULT_LOAD_BLOCK_SIZE = 0xd0
+)
+
+// Options for loading executable load files.
+type LoadOptions struct {
+    // Security domain the load file is associated with, ISD if nil
+    SecurityDomain []byte
+    // Include the CAP Descriptor component
+    IncludeDescriptor bool
+    // Include load file data block hash (SHA-1) in INSTALL [for load]
+    IncludeHash bool
+    // Load parameters (e.g. C6/C7/C8 memory quotas)
+    Parameters []byte
+    // LOAD block size, DEFAULT_LOAD_BLOCK_SIZE if 0
+    BlockSize int
+    // Called after each LOAD block
+    Progress func(loaded, total int)
+}
+
+// Options for installing applications.
+type InstallOptions struct {
+    // Module (applet class) AID in the load file
+    Module []byte
+    // Application instance AID, defaults to the module AID
+    Instance []byte
+    Privileges Privileges
+    // Application specific install parameters (wrapped in tag C9)
+    Parameters []byte
+    // Additional system parameters (e.g. EF/C7/C8 tags)
+    SystemParameters []byte
+}
+
+func lv(data []byte) []byte {
+    return append([]byte{byte(len(data))}, data...)
+}
+
+func (s *Session) check(cmd smartcard.CommandAPDU, what string) (
+    smartcard.ResponseAPDU, error) {
+    rsp, err := s.TransmitAPDU(cmd)
+    if err != nil { return nil, err }
+    if rsp.SW() != SW.SUCCESS {
+        return nil, fmt.Errorf("%s failed: %s", what, smartcard.SWError(rsp.SW()))
+    }
+    return rsp, nil
+}
+
+// Load CAP file with INSTALL [for load] followed by LOAD commands.
+func (s *Session) LoadCAPFile(capFile *CAPFile, opts *LoadOptions) error {
+    if opts == nil {
+        opts = &LoadOptions{}
+    }
+    block := capFile.LoadFileDataBlock(opts.IncludeDescriptor)
+    err := s.InstallForLoad(capFile.PackageAID, block, opts)
+    if err != nil { return err }
+    return s.Load(block, opts)
+}
+
+// Issue INSTALL [for load] for the load file data block.
+func (s *Session) InstallForLoad(loadFile []byte, block []byte,
+    opts *LoadOptions) error {
+    if opts == nil {
+        opts = &LoadOptions{}
+    }
+    var data []byte
+    data = append(data, lv(loadFile)...)
+    data = append(data, lv(opts.SecurityDomain)...)
+    if opts.IncludeHash {
+        hash := sha1.Sum(block)
+        data = append(data, lv(hash[:])...)
+    } else {
+        data = append(data, 0x00)
+    }
+    data = append(data, lv(opts.Parameters)...)
+    data = append(data, 0x00) // no load token
+    cmd := smartcard.Command4(CLA_GP, INS_INSTALL, INSTALL_FOR_LOAD, 0x00,
+        data, 0x00)
+    _, err := s.check(cmd, "install for load")
+    return err
+}
+
+// Transfer load file data block with LOAD commands.
+func (s *Session) Load(block []byte, opts *LoadOptions) error {
+    if opts == nil {
+        opts = &LoadOptions{}
+    }
+    size := opts.BlockSize
+    if size == 0 {
+        size = DEFAULT_LOAD_BLOCK_SIZE
+    }
+    data := tlv.Encode(0xc4, block)
+    total := len(data)
+    for number := 0; len(data) > 0; number++ {
+        if number > 0xff {
+            return fmt.Errorf("load file too large for block size %d", size)
+        }
+        n := size
+        p1 := byte(0x00)
+        if len(data) <= n {
+            n = len(data)
+            p1 = 0x80
+        }
+        cmd := smartcard.Command4(CLA_GP, INS_LOAD, p1, byte(number),
+            data[:n], 0x00)
+        _, err := s.check(cmd, fmt.Sprintf("load block %d", number))
+        if err != nil { return err }
+        data = data[n:]
+        if opts.Progress != nil {
+            opts.Progress(total - len(data), total)
+        }
+    }
+    return nil
+}
+
+// Install application from load file and make it selectable.
+func (s *Session) InstallAndMakeSelectable(loadFile []byte,
+    opts *InstallOptions) error {
+    return s.install(INSTALL_FOR_INSTALL | INSTALL_FOR_MAKE_SELECTABLE,
+        loadFile, opts)
+}
+
+// Install application from load file without making it selectable.
+func (s *Session) Install(loadFile []byte, opts *InstallOptions) error {
+    return s.install(INSTALL_FOR_INSTALL, loadFile, opts)
+}
+
+func (s *Session) install(p1 byte, loadFile []byte,
+    opts *InstallOptions) error {
+    if opts == nil || opts.Module == nil {
+        return fmt.Errorf("module AID required")
+    }
+    instance := opts.Instance
+    if instance == nil {
+        instance = opts.Module
+    }
+    params := tlv.Encode(0xc9, opts.Parameters)
+    params = append(params, opts.SystemParameters...)
+    privileges := opts.Privileges.Bytes()
+    if opts.Privileges & 0xffff == 0 {
+        privileges = privileges[:1]
+    }
+    var data []byte
+    data = append(data, lv(loadFile)...)
+    data = append(data, lv(opts.Module)...)
+    data = append(data, lv(instance)...)
+    data = append(data, lv(privileges)...)
+    data = append(data, lv(params)...)
+    data = append(data, 0x00) // no install token
+    cmd := smartcard.Command4(CLA_GP, INS_INSTALL, p1, 0x00, data, 0x00)
+    _, err := s.check(cmd, "install")
+    return err
+}
+
+// Make installed application selectable.
+func (s *Session) MakeSelectable(aid []byte, privileges Privileges) error {
+    var data []byte
+    data = append(data, 0x00, 0x00)
+    data = append(data, lv(aid)...)
+    data = append(data, lv(privileges.Bytes()[:1])...)
+    data = append(data, 0x00, 0x00)
+    cmd := smartcard.Command4(CLA_GP, INS_INSTALL,
+        INSTALL_FOR_MAKE_SELECTABLE, 0x00, data, 0x00)
+    _, err := s.check(cmd, "make selectable")
+    return err
+}
+
+// Delete application, security domain or load file. If related is true,
+// a load file is deleted together with all applications installed from it.
+func (s *Session) Delete(aid []byte, related bool) error {
+    p2 := byte(0x00)
+    if related {
+        p2 = 0x80
+    }
+    cmd := smartcard.Command4(CLA_GP, INS_DELETE, 0x00, p2,
+        tlv.Encode(0x4f, aid), 0x00)
+    _, err := s.check(cmd, "delete")
+    return err
+}
+
+// Set life cycle state of the card (ENTRY_ISD) or of an application or
+// security domain (ENTRY_APPLICATION).
+func (s *Session) SetStatus(kind EntryKind, aid []byte, state byte) error {
+    cmd := smartcard.Command3(CLA_GP, INS_SET_STATUS, byte(kind), state, aid)
+    _, err := s.check(cmd, "set status")
+    return err
+}
+
+// Put key set (ENC, MAC, DEK) with key version number newVersion. If
+// replaceVersion is not zero, the existing key set with that version is
+// replaced. Keys are DES keys for SCP02 and AES keys for SCP03.
+func (s *Session) PutKeys(keys KeySet, newVersion,
+    replaceVersion byte) error {
+    data := []byte{newVersion}
+    for _, key := range [][]byte{keys.ENC, keys.MAC, keys.DEK} {
+        block, err := s.keyBlock(key)
+        if err != nil { return err }
+        data = append(data, block...)
+    }
+    cmd := smartcard.Command4(CLA_GP, INS_PUT_KEY, replaceVersion, 0x81,
+        data, 0x00)
+    rsp, err := s.check(cmd, "put key")
+    if err != nil { return err }
+    // The response holds the key version number and the check values.
+    expected := []byte{newVersion}
+    for _, key := range [][]byte{keys.ENC, keys.MAC, keys.DEK} {
+        expected = append(expected, keyCheckValue(key, s.info.Protocol)...)
+    }
+    if len(rsp.Data()) > 0 && !equal(rsp.Data(), expected) {
+        return fmt.Errorf("key check value mismatch")
+    }
+    return nil
+}
+
+func (s *Session) keyBlock(key []byte) ([]byte, error) {
+    encrypted, err := s.channel.encryptKey(key)
+    if err != nil { return nil, err }
+    var block []byte
+    if s.info.Protocol == 0x03 {
+        block = append(block, 0x88, byte(len(encrypted) + 1),
+            byte(len(key)))
+    } else {
+        block = append(block, 0x80, byte(len(encrypted)))
+    }
+    block = append(block, encrypted...)
+    block = append(block, lv(keyCheckValue(key, s.info.Protocol))...)
+    return block, nil
+}
+
+// Key check value: first three bytes of the encryption of 00..00 (DES)
+// or 01..01 (AES).
+func keyCheckValue(key []byte, protocol byte) []byte {
+    if protocol == 0x03 {
+        block, err := aes.NewCipher(key)
+        if err != nil { return nil }
+        out := make([]byte, 16)
+        for i := range out {
+            out[i] = 0x01
+        }
+        block.Encrypt(out, out)
+        return out[:3]
+    }
+    block, err := tripleDES(key)
+    if err != nil {
+        block, err = des.NewCipher(key)
+        if err != nil { return nil }
+    }
+    out := make([]byte, 8)
+    block.Encrypt(out, out)
+    return out[:3]
+}
+
+// Return card data (tag 66) from the selected security domain.
+func (s *Session) GetCardData() (tlv.List, error) {
+    return s.getData(0x0066)
+}
+
+// Return key information template (tag E0).
+func (s *Session) GetKeyInformation() (tlv.List, error) {
+    return s.getData(0x00e0)
+}
+
+func (s *Session) getData(tag uint16) (tlv.List, error) {
+    cmd := smartcard.Command2(CLA_GP, INS_GET_DATA, byte(tag >> 8),
+        byte(tag), 0x00)
+    rsp, err := s.check(cmd, "get data")
+    if err != nil { return nil, err }
+    return tlv.Parse(rsp.Data())
+}
@@ -0,0 +1,131 @@
+package globalplatform
+
+import (
+    "archive/zip"
+    "bytes"
+    "encoding/hex"
+    "testing"
+)
+
+func openTestSession(t *testing.T, script []exchange) (*Session, *testCard) {
+    card := &testCard{
+        protocol: 0x03,
+        param: SCP03_PSEUDO_RANDOM,
+        keys: DefaultKeys(),
+        kdd: unhex("00000000000000000000"),
+        counter: unhex("000001"),
+        challenge: unhex("0102030405060708"),
+        script: script,
+    }
+    session, err := OpenSecureChannel(card, &Config{
+        Keys: DefaultKeys(),
+        SecurityLevel: SEC_C_MAC,
+    })
+    if err != nil { t.Fatal(err) }
+    return session, card
+}
+
+func testCAPFile(t *testing.T) []byte {
+    var buffer bytes.Buffer
+    w := zip.NewWriter(&buffer)
+    components := map[string]string{
+        // package AID A0000000620101, version 1.0
+        "Header": "01000fdecaffed010204000107a0000000620101",
+        "Directory": "02001f00",
+        "Class": "060003000000",
+        "Method": "0700020000",
+        "ConstantPool": "05000100",
+        // one applet A000000062010101
+        "Applet": "03000d0108a0000000620101010010",
+    }
+    for _, name := range []string{"Header", "Directory", "Applet", "Class",
+        "Method", "ConstantPool"} {
+        f, err := w.Create("com/example/test/javacard/" + name + ".cap")
+        if err != nil { t.Fatal(err) }
+        f.Write(unhex(components[name]))
+    }
+    w.Close()
+    return buffer.Bytes()
+}
+
+func TestCAPFile(t *testing.T) {
+    data := testCAPFile(t)
+    capFile, err := ParseCAPFile(bytes.NewReader(data), int64(len(data)))
+    if err != nil { t.Fatal(err) }
+    if !bytes.Equal(capFile.PackageAID, unhex("a0000000620101")) {
+        t.Errorf("unexpected package AID %X", capFile.PackageAID)
+    }
+    if capFile.PackageName != "com.example.test" {
+        t.Errorf("unexpected package name %s", capFile.PackageName)
+    }
+    if capFile.MajorVersion != 1 || capFile.MinorVersion != 0 {
+        t.Errorf("unexpected version %d.%d", capFile.MajorVersion,
+            capFile.MinorVersion)
+    }
+    if len(capFile.Applets) != 1 ||
+        !bytes.Equal(capFile.Applets[0], unhex("a000000062010101")) {
+        t.Errorf("unexpected applets %X", capFile.Applets)
+    }
+    expected := unhex("01000fdecaffed010204000107a0000000620101" +
+        "02001f00" + "03000d0108a0000000620101010010" + "060003000000" +
+        "0700020000" + "05000100")
+    if !bytes.Equal(capFile.LoadFileDataBlock(false), expected) {
+        t.Errorf("unexpected load file data block %X",
+            capFile.LoadFileDataBlock(false))
+    }
+}
+
+func TestGetStatus(t *testing.T) {
+    session, card := openTestSession(t, []exchange{
+        {"80f24002024f0000", "e3114f08a0000000030000009f700107c50100" +
+            "e3124f07a00000006201019f700107c503000000" + "6310"},
+        {"80f24003024f0000", "e3134f08a0000000620101019f700107c50100c4" +
+            "00" + "9000"},
+        {"80f22002024f0000", "6a86"},
+        {"80f22000024f0000", "07a00000006201010100" + "9000"},
+    })
+    entries, err := session.GetStatus(ENTRY_APPLICATION)
+    if err != nil { t.Fatal(err) }
+    if len(entries) != 3 {
+        t.Fatalf("expected 3 entries, got %d", len(entries))
+    }
+    if entries[0].LifeCycleString() != "SELECTABLE" {
+        t.Errorf("unexpected life cycle %s", entries[0].LifeCycleString())
+    }
+    entries, err = session.GetStatus(ENTRY_LOAD_FILE)
+    if err != nil { t.Fatal(err) }
+    if len(entries) != 1 || entries[0].LifeCycleString() != "LOADED" {
+        t.Errorf("unexpected load files %v", entries)
+    }
+    if len(card.script) != 0 {
+        t.Errorf("%d commands not sent", len(card.script))
+    }
+}
+
+func TestLoadAndInstall(t *testing.T) {
+    data := testCAPFile(t)
+    capFile, err := ParseCAPFile(bytes.NewReader(data), int64(len(data)))
+    if err != nil { t.Fatal(err) }
+    block := capFile.LoadFileDataBlock(false)
+    loadData := append([]byte{0xc4, byte(len(block))}, block...)
+    session, card := openTestSession(t, []exchange{
+        {"80e602000c07a00000006201010000000000", "009000"},
+        {"80e80000" + "20" + hex.EncodeToString(loadData[:32]) + "00", "9000"},
+        {"80e88001" + hex.EncodeToString([]byte{byte(len(loadData) - 32)}) +
+            hex.EncodeToString(loadData[32:]) + "00", "9000"},
+        {"80e60c002007a000000062010108a00000006201010108a000000062010101" +
+            "0100" + "02c900" + "00" + "00", "9000"},
+        {"80e40080094f07a000000062010100", "009000"},
+    })
+    err = session.LoadCAPFile(capFile, &LoadOptions{BlockSize: 32})
+    if err != nil { t.Fatal(err) }
+    err = session.InstallAndMakeSelectable(capFile.PackageAID, &InstallOptions{
+        Module: capFile.Applets[0],
+    })
+    if err != nil { t.Fatal(err) }
+    err = session.Delete(capFile.PackageAID, true)
+    if err != nil { t.Fatal(err) }
+    if len(card.script) != 0 {
+        t.Errorf("%d commands not sent", len(card.script))
+    }
+}
@@ -0,0 +1,281 @@
+package globalplatform
+
+import (
+    "fmt"
+    "strings"
+    "github.com/sf1/go-card/smartcard"
+    "github.com/sf1/go-card/smartcard/SW"
+    "github.com/sf1/go-card/smartcard/tlv"
+)
+
+// Kind of GlobalPlatform registry entry (P1 of GET STATUS).
+type EntryKind byte
+
+const (
+    ENTRY_ISD EntryKind = 0x80
+    ENTRY_APPLICATION EntryKind = 0x40
+    ENTRY_LOAD_FILE EntryKind = 0x20
+    ENTRY_LOAD_FILE_AND_MODULES EntryKind = 0x10
+)
+
+// Return string form of entry kind.
+func (k EntryKind) String() string {
+    switch k {
+        case ENTRY_ISD:
+            return "ISD"
+        case ENTRY_APPLICATION:
+            return "APP"
+        case ENTRY_LOAD_FILE, ENTRY_LOAD_FILE_AND_MODULES:
+            return "PKG"
+    }
+    return fmt.Sprintf("%02X", byte(k))
+}
+
+const (
+    // Card life cycle states
+    LC_OP_READY = 0x01
+    LC_INITIALIZED = 0x07
+    LC_SECURED = 0x0f
+    LC_CARD_LOCKED = 0x7f
+    LC_TERMINATED = 0xff
+    // Application and security domain life cycle states
+    LC_LOADED = 0x01
+    LC_INSTALLED = 0x03
+    LC_SELECTABLE = 0x07
+    LC_PERSONALIZED = 0x0f
+    LC_LOCKED = 0x83
+)
+
+// Application privileges (GP Card Specification 2.2, section 6.6.1).
+type Privileges uint32
+
+const (
+    PRIV_SECURITY_DOMAIN Privileges = 0x800000
+    PRIV_DAP_VERIFICATION Privileges = 0x400000 | PRIV_SECURITY_DOMAIN
+    PRIV_DELEGATED_MANAGEMENT Privileges = 0x200000 | PRIV_SECURITY_DOMAIN
+    PRIV_CARD_LOCK Privileges = 0x100000
+    PRIV_CARD_TERMINATE Privileges = 0x080000
+    PRIV_CARD_RESET Privileges = 0x040000
+    PRIV_CVM_MANAGEMENT Privileges = 0x020000
+    PRIV_MANDATED_DAP_VERIFICATION Privileges = 0x010000 |
+        PRIV_DAP_VERIFICATION
+    PRIV_TRUSTED_PATH Privileges = 0x008000
+    PRIV_AUTHORIZED_MANAGEMENT Privileges = 0x004000
+    PRIV_TOKEN_VERIFICATION Privileges = 0x002000
+    PRIV_GLOBAL_DELETE Privileges = 0x001000
+    PRIV_GLOBAL_LOCK Privileges = 0x000800
+    PRIV_GLOBAL_REGISTRY Privileges = 0x000400
+    PRIV_FINAL_APPLICATION Privileges = 0x000200
+    PRIV_GLOBAL_SERVICE Privileges = 0x000100
+    PRIV_RECEIPT_GENERATION Privileges = 0x000080
+    PRIV_CIPHERED_LOAD_FILE_DATA_BLOCK Privileges = 0x000040
+    PRIV_CONTACTLESS_ACTIVATION Privileges = 0x000020
+    PRIV_CONTACTLESS_SELF_ACTIVATION Privileges = 0x000010
+)
+
+var privilegeNames = []struct {
+    bit Privileges
+    name string
+}{
+    {0x800000, "SecurityDomain"},
+    {0x400000, "DAPVerification"},
+    {0x200000, "DelegatedManagement"},
+    {0x100000, "CardLock"},
+    {0x080000, "CardTerminate"},
+    {0x040000, "CardReset"},
+    {0x020000, "CVMManagement"},
+    {0x010000, "MandatedDAPVerification"},
+    {0x008000, "TrustedPath"},
+    {0x004000, "AuthorizedManagement"},
+    {0x002000, "TokenVerification"},
+    {0x001000, "GlobalDelete"},
+    {0x000800, "GlobalLock"},
+    {0x000400, "GlobalRegistry"},
+    {0x000200, "FinalApplication"},
+    {0x000100, "GlobalService"},
+    {0x000080, "ReceiptGeneration"},
+    {0x000040, "CipheredLoadFileDataBlock"},
+    {0x000020, "ContactlessActivation"},
+    {0x000010, "ContactlessSelfActivation"},
+}
+
+// Return privileges encoded as three bytes.
+func (p Privileges) Bytes() []byte {
+    return []byte{byte(p >> 16), byte(p >> 8), byte(p)}
+}
+
+// Return string form of privileges.
+func (p Privileges) String() string {
+    names := make([]string, 0)
+    for _, n := range privilegeNames {
+        if p & n.bit != 0 {
+            names = append(names, n.name)
+        }
+    }
+    return strings.Join(names, ",")
+}
+
+// Entry of the GlobalPlatform registry as returned by GET STATUS.
+type RegistryEntry struct {
+    Kind EntryKind
+    AID []byte
+    LifeCycle byte
+    Privileges Privileges
+    // Executable load file of an application
+    LoadFile []byte
+    // Executable load file version
+    Version []byte
+    // Executable modules of a load file
+    Modules [][]byte
+    // Associated security domain
+    SecurityDomain []byte
+}
+
+// Return string form of life cycle state.
+func (e *RegistryEntry) LifeCycleString() string {
+    if e.Kind == ENTRY_ISD {
+        switch e.LifeCycle {
+            case LC_OP_READY:
+                return "OP_READY"
+            case LC_INITIALIZED:
+                return "INITIALIZED"
+            case LC_SECURED:
+                return "SECURED"
+            case LC_CARD_LOCKED:
+                return "CARD_LOCKED"
+            case LC_TERMINATED:
+                return "TERMINATED"
+        }
+    } else if e.Kind == ENTRY_APPLICATION {
+        switch {
+            case e.LifeCycle & LC_LOCKED == LC_LOCKED:
+                return "LOCKED"
+            case e.LifeCycle == LC_INSTALLED:
+                return "INSTALLED"
+            case e.LifeCycle == LC_SELECTABLE:
+                return "SELECTABLE"
+            case e.LifeCycle == LC_PERSONALIZED &&
+                e.Privileges & PRIV_SECURITY_DOMAIN != 0:
+                return "PERSONALIZED"
+        }
+    } else if e.LifeCycle == LC_LOADED {
+        return "LOADED"
+    }
+    return fmt.Sprintf("%02X", e.LifeCycle)
+}
+
+// Return string form of entry.
+func (e *RegistryEntry) String() string {
+    s := fmt.Sprintf("%s: %X, %s", e.Kind, e.AID, e.LifeCycleString())
+    if e.Privileges != 0 {
+        s += fmt.Sprintf(", %s", e.Privileges)
+    }
+    for _, m := range e.Modules {
+        s += fmt.Sprintf("\n  Module: %X", m)
+    }
+    return s
+}
+
+// Query the card registry with GET STATUS. If the card doesn't support the
+// GlobalPlatform 2.2 TLV format, the legacy format is used.
+func (s *Session) GetStatus(kind EntryKind) ([]*RegistryEntry, error) {
+    entries, err := s.getStatus(kind, true)
+    if err == smartcard.SWError(SW.INCORRECT_P1P2) {
+        return s.getStatus(kind, false)
+    }
+    return entries, err
+}
+
+func (s *Session) getStatus(kind EntryKind, useTLV bool) (
+    []*RegistryEntry, error) {
+    var entries []*RegistryEntry
+    p2 := byte(0x00)
+    if useTLV {
+        p2 = 0x02
+    }
+    for {
+        cmd := smartcard.Command4(CLA_GP, INS_GET_STATUS, byte(kind), p2,
+            []byte{0x4f, 0x00}, 0x00)
+        rsp, err := s.TransmitAPDU(cmd)
+        if err != nil { return nil, err }
+        if rsp.SW() == SW.REFERENCED_DATA_NOT_FOUND {
+            // referenced data not found, i.e. no entries
+            return entries, nil
+        }
+        if rsp.SW() != SW.SUCCESS && rsp.SW() != SW.MORE_DATA {
+            return nil, smartcard.SWError(rsp.SW())
+        }
+        var parsed []*RegistryEntry
+        if useTLV {
+            parsed, err = parseStatusTLV(kind, rsp.Data())
+        } else {
+            parsed, err = parseStatusLegacy(kind, rsp.Data())
+        }
+        if err != nil { return nil, err }
+        entries = append(entries, parsed...)
+        if rsp.SW() == SW.SUCCESS {
+            return entries, nil
+        }
+        // more data available
+        p2 |= 0x01
+    }
+}
+
+func parseStatusTLV(kind EntryKind, data []byte) ([]*RegistryEntry, error) {
+    list, err := tlv.Parse(data)
+    if err != nil { return nil, err }
+    var entries []*RegistryEntry
+    for _, t := range list.FindAll(0xe3) {
+        fields, err := t.Children()
+        if err != nil { return nil, err }
+        e := &RegistryEntry{Kind: kind, AID: fields.Value(0x4f)}
+        if lc := fields.Value(0x9f70); len(lc) > 0 {
+            e.LifeCycle = lc[0]
+        }
+        for _, b := range fields.Value(0xc5) {
+            e.Privileges = e.Privileges << 8 | Privileges(b)
+        }
+        if len(fields.Value(0xc5)) == 1 {
+            e.Privileges <<= 16
+        }
+        e.LoadFile = fields.Value(0xc4)
+        e.Version = fields.Value(0xce)
+        e.SecurityDomain = fields.Value(0xcc)
+        for _, m := range fields.FindAll(0x84) {
+            e.Modules = append(e.Modules, m.Value)
+        }
+        entries = append(entries, e)
+    }
+    return entries, nil
+}
+
+func parseStatusLegacy(kind EntryKind, data []byte) ([]*RegistryEntry,
+    error) {
+    var entries []*RegistryEntry
+    for len(data) > 0 {
+        n := int(data[0])
+        if len(data) < n + 3 {
+            return nil, fmt.Errorf("invalid GET STATUS response")
+        }
+        e := &RegistryEntry{Kind: kind, AID: data[1:1+n]}
+        e.LifeCycle = data[1+n]
+        e.Privileges = Privileges(data[2+n]) << 16
+        data = data[3+n:]
+        if kind == ENTRY_LOAD_FILE_AND_MODULES {
+            if len(data) < 1 {
+                return nil, fmt.Errorf("invalid GET STATUS response")
+            }
+            count := int(data[0])
+            data = data[1:]
+            for i := 0; i < count; i++ {
+                if len(data) < 1 || len(data) < int(data[0]) + 1 {
+                    return nil, fmt.Errorf("invalid GET STATUS response")
+                }
+                e.Modules = append(e.Modules, data[1:1+data[0]])
+                data = data[1+data[0]:]
+            }
+        }
+        entries = append(entries, e)
+    }
+    return entries, nil
+}
@@ -0,0 +1,246 @@
+package globalplatform
+
+import (
+    "crypto/rand"
+    "fmt"
+    "github.com/sf1/go-card/smartcard"
+    "github.com/sf1/go-card/smartcard/SW"
+)
+
+const (
+    // Security levels (P1 of EXTERNAL AUTHENTICATE)
+    SEC_NONE = 0x00
+    SEC_C_MAC = 0x01
+    SEC_C_DECRYPTION = 0x02
+    SEC_R_MAC = 0x10
+    SEC_R_ENCRYPTION = 0x20
+    // SCP02 "i" parameter options
+    SCP02_I_15 = 0x15
+    SCP02_I_55 = 0x55
+    // SCP03 "i" parameter options
+    SCP03_S16 = 0x01
+    SCP03_PSEUDO_RANDOM = 0x10
+    SCP03_R_MAC = 0x20
+    SCP03_R_ENCRYPTION = 0x40
+)
+
+// Secure channel configuration.
+type Config struct {
+    // Static keys (or master keys if Diversification is set)
+    Keys KeySet
+    // Key version number, 0 selects the first available key set
+    KeyVersion byte
+    // Combination of SEC_* flags
+    SecurityLevel byte
+    Diversification Diversification
+    // Expected protocol (2 or 3), 0 accepts what the card reports
+    Protocol byte
+    // SCP02 "i" parameter, defaults to SCP02_I_55
+    SCP02Param byte
+    // Use 16 byte challenges and cryptograms (SCP03 S16 mode)
+    S16 bool
+    // Fixed host challenge, random if nil
+    HostChallenge []byte
+}
+
+// Session information from INITIALIZE UPDATE.
+type SessionInfo struct {
+    DiversificationData []byte
+    KeyVersion byte
+    Protocol byte
+    Param byte
+    SequenceCounter []byte
+    CardChallenge []byte
+    HostChallenge []byte
+}
+
+type channel interface {
+    cardCryptogram() []byte
+    hostCryptogram() []byte
+    wrap(cmd smartcard.CommandAPDU) (smartcard.CommandAPDU, error)
+    unwrap(rsp smartcard.ResponseAPDU) (smartcard.ResponseAPDU, error)
+    encryptKey(key []byte) ([]byte, error)
+    setSecurityLevel(level byte)
+}
+
+// Authenticated secure channel session.
+// All commands transmitted via the session are protected according to the
+// security level of the session.
+type Session struct {
+    card smartcard.Transmitter
+    channel channel
+    info SessionInfo
+    level byte
+}
+
+// Open secure channel by performing INITIALIZE UPDATE and EXTERNAL
+// AUTHENTICATE. The applet to authenticate against (usually the Issuer
+// Security Domain) must already be selected.
+func OpenSecureChannel(card smartcard.Transmitter, cfg *Config) (
+    *Session, error) {
+    err := checkSecurityLevel(cfg.SecurityLevel)
+    if err != nil { return nil, err }
+    hostChallenge := cfg.HostChallenge
+    if hostChallenge == nil {
+        hostChallenge = make([]byte, 8)
+        if cfg.S16 {
+            hostChallenge = make([]byte, 16)
+        }
+        _, err = rand.Read(hostChallenge)
+        if err != nil { return nil, err }
+    }
+    cmd := smartcard.Command4(CLA_GP, INS_INITIALIZE_UPDATE, cfg.KeyVersion,
+        0x00, hostChallenge, 0x00)
+    rsp, err := card.TransmitAPDU(cmd)
+    if err != nil { return nil, err }
+    if rsp.SW() != SW.SUCCESS {
+        return nil, fmt.Errorf("initialize update failed: %s",
+            smartcard.SWError(rsp.SW()))
+    }
+    info, err := parseInitializeUpdate(rsp.Data(), len(hostChallenge))
+    if err != nil { return nil, err }
+    info.HostChallenge = hostChallenge
+    if cfg.Protocol != 0 && cfg.Protocol != info.Protocol {
+        return nil, fmt.Errorf("card uses SCP%02x, SCP%02x requested",
+            info.Protocol, cfg.Protocol)
+    }
+    keys, err := cfg.Keys.Diversify(cfg.Diversification,
+        info.DiversificationData, info.Protocol)
+    if err != nil { return nil, err }
+    var ch channel
+    switch info.Protocol {
+        case 0x02:
+            param := cfg.SCP02Param
+            if param == 0 {
+                param = SCP02_I_55
+            }
+            info.Param = param
+            ch, err = newSCP02(keys, info, cfg.SecurityLevel)
+        case 0x03:
+            ch, err = newSCP03(keys, info, cfg.SecurityLevel)
+        default:
+            err = fmt.Errorf("unsupported protocol: SCP%02x", info.Protocol)
+    }
+    if err != nil { return nil, err }
+    if !equal(ch.cardCryptogram(), info.cardCryptogram) {
+        return nil, fmt.Errorf("card cryptogram mismatch")
+    }
+    cmd = smartcard.Command3(CLA_GP, INS_EXTERNAL_AUTHENTICATE,
+        cfg.SecurityLevel, 0x00, ch.hostCryptogram())
+    ch.setSecurityLevel(SEC_C_MAC)
+    wrapped, err := ch.wrap(cmd)
+    if err != nil { return nil, err }
+    rsp, err = card.TransmitAPDU(wrapped)
+    if err != nil { return nil, err }
+    if rsp.SW() != SW.SUCCESS {
+        return nil, fmt.Errorf("external authenticate failed: %s",
+            smartcard.SWError(rsp.SW()))
+    }
+    ch.setSecurityLevel(cfg.SecurityLevel)
+    return &Session{
+        card: card,
+        channel: ch,
+        info: info.SessionInfo,
+        level: cfg.SecurityLevel,
+    }, nil
+}
+
+// Return session information.
+func (s *Session) Info() SessionInfo {
+    return s.info
+}
+
+// Return security level of session.
+func (s *Session) SecurityLevel() byte {
+    return s.level
+}
+
+// Protect command, transmit it and verify/decrypt the response.
+func (s *Session) TransmitAPDU(cmd smartcard.CommandAPDU) (
+    smartcard.ResponseAPDU, error) {
+    wrapped, err := s.channel.wrap(cmd)
+    if err != nil { return nil, err }
+    rsp, err := s.card.TransmitAPDU(wrapped)
+    if err != nil { return nil, err }
+    return s.channel.unwrap(rsp)
+}
+
+func checkSecurityLevel(level byte) error {
+    if level &^ (SEC_C_MAC | SEC_C_DECRYPTION | SEC_R_MAC |
+        SEC_R_ENCRYPTION) != 0 {
+        return fmt.Errorf("invalid security level: %02x", level)
+    }
+    if level & SEC_C_DECRYPTION != 0 && level & SEC_C_MAC == 0 {
+        return fmt.Errorf("C-DECRYPTION requires C-MAC")
+    }
+    if level & SEC_R_ENCRYPTION != 0 && level & SEC_R_MAC == 0 {
+        return fmt.Errorf("R-ENCRYPTION requires R-MAC")
+    }
+    if level & SEC_R_ENCRYPTION != 0 && level & SEC_C_DECRYPTION == 0 {
+        return fmt.Errorf("R-ENCRYPTION requires C-DECRYPTION")
+    }
+    return nil
+}
+
+type initUpdateResponse struct {
+    SessionInfo
+    cardCryptogram []byte
+}
+
+func parseInitializeUpdate(data []byte, challengeLen int) (
+    *initUpdateResponse, error) {
+    if len(data) < 12 {
+        return nil, fmt.Errorf("invalid initialize update response")
+    }
+    r := &initUpdateResponse{}
+    r.DiversificationData = data[0:10]
+    r.KeyVersion = data[10]
+    r.Protocol = data[11]
+    switch r.Protocol {
+        case 0x02:
+            if len(data) != 28 {
+                return nil, fmt.Errorf(
+                    "invalid SCP02 initialize update response length: %d",
+                    len(data))
+            }
+            r.SequenceCounter = data[12:14]
+            r.CardChallenge = data[14:20]
+            r.cardCryptogram = data[20:28]
+        case 0x03:
+            if len(data) < 13 {
+                return nil, fmt.Errorf("invalid initialize update response")
+            }
+            r.Param = data[12]
+            size := 8
+            if r.Param & SCP03_S16 != 0 {
+                size = 16
+            }
+            if size != challengeLen {
+                return nil, fmt.Errorf(
+                    "host challenge length doesn't match S%d mode", size)
+            }
+            rest := data[13:]
+            if len(rest) != 2*size && len(rest) != 2*size + 3 {
+                return nil, fmt.Errorf(
+                    "invalid SCP03 initialize update response length: %d",
+                    len(data))
+            }
+            r.CardChallenge = rest[:size]
+            r.cardCryptogram = rest[size:2*size]
+            if len(rest) > 2*size {
+                r.SequenceCounter = rest[2*size:]
+            }
+    }
+    return r, nil
+}
+
+func equal(a, b []byte) bool {
+    if len(a) != len(b) {
+        return false
+    }
+    var diff byte
+    for i := range a {
+        diff |= a[i] ^ b[i]
+    }
+    return diff == 0
+}
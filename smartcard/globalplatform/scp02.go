@@ -0,0 +1,173 @@
+package globalplatform
+
+import (
+    "crypto/cipher"
+    "crypto/des"
+    "fmt"
+    "github.com/sf1/go-card/smartcard"
+)
+
+// SCP02 session (GlobalPlatform Card Specification 2.2, Appendix E).
+type scp02 struct {
+    senc []byte
+    cmac []byte
+    dek []byte
+    param byte
+    level byte
+    hostChallenge []byte
+    cardChallenge []byte
+    counter []byte
+    lastMAC []byte
+}
+
+func newSCP02(keys KeySet, info *initUpdateResponse, level byte) (
+    channel, error) {
+    if info.Param &^ (SCP02_I_55 | 0x02) != 0 {
+        return nil, fmt.Errorf("unsupported SCP02 parameter i=%02x",
+            info.Param)
+    }
+    if level & (SEC_R_MAC | SEC_R_ENCRYPTION) != 0 {
+        return nil, fmt.Errorf("R-MAC is not supported with SCP02")
+    }
+    var err error
+    s := &scp02{
+        param: info.Param,
+        hostChallenge: info.HostChallenge,
+        cardChallenge: info.CardChallenge,
+        counter: info.SequenceCounter,
+    }
+    s.senc, err = s.deriveKey(keys.ENC, 0x0182)
+    if err != nil { return nil, err }
+    s.cmac, err = s.deriveKey(keys.MAC, 0x0101)
+    if err != nil { return nil, err }
+    s.dek, err = s.deriveKey(keys.DEK, 0x0181)
+    if err != nil { return nil, err }
+    return s, nil
+}
+
+func (s *scp02) deriveKey(key []byte, constant uint16) ([]byte, error) {
+    block, err := tripleDES(key)
+    if err != nil { return nil, err }
+    data := make([]byte, 16)
+    data[0] = byte(constant >> 8)
+    data[1] = byte(constant)
+    copy(data[2:4], s.counter)
+    out := make([]byte, 16)
+    cipher.NewCBCEncrypter(block, make([]byte, 8)).CryptBlocks(out, data)
+    return out, nil
+}
+
+// Full triple DES MAC (ISO 9797-1 algorithm 1) with zero ICV.
+func fullTripleDESMAC(key, data []byte) []byte {
+    block, _ := tripleDES(key)
+    padded := pad(data, 8)
+    out := make([]byte, len(padded))
+    cipher.NewCBCEncrypter(block, make([]byte, 8)).CryptBlocks(out, padded)
+    return out[len(out)-8:]
+}
+
+// Retail MAC (ISO 9797-1 algorithm 3 with DES).
+func retailMAC(key, icv, data []byte) []byte {
+    single, _ := des.NewCipher(key[:8])
+    triple, _ := tripleDES(key)
+    padded := pad(data, 8)
+    x := make([]byte, 8)
+    copy(x, icv)
+    last := len(padded) - 8
+    for i := 0; i < last; i += 8 {
+        xor(x, x, padded[i:i+8])
+        single.Encrypt(x, x)
+    }
+    xor(x, x, padded[last:])
+    triple.Encrypt(x, x)
+    return x
+}
+
+func (s *scp02) cardCryptogram() []byte {
+    data := append([]byte{}, s.hostChallenge...)
+    data = append(data, s.counter...)
+    data = append(data, s.cardChallenge...)
+    return fullTripleDESMAC(s.senc, data)
+}
+
+func (s *scp02) hostCryptogram() []byte {
+    data := append([]byte{}, s.counter...)
+    data = append(data, s.cardChallenge...)
+    data = append(data, s.hostChallenge...)
+    return fullTripleDESMAC(s.senc, data)
+}
+
+func (s *scp02) setSecurityLevel(level byte) {
+    s.level = level
+}
+
+func (s *scp02) wrap(cmd smartcard.CommandAPDU) (smartcard.CommandAPDU,
+    error) {
+    if !cmd.IsValid() {
+        return nil, fmt.Errorf("invalid command APDU")
+    }
+    if s.level & SEC_C_MAC == 0 {
+        return cmd, nil
+    }
+    data := cmd.Data()
+    le, hasLe := cmd.Le()
+    if len(data) + 8 > 255 {
+        return nil, fmt.Errorf("command data too long for secure channel")
+    }
+    icv := make([]byte, 8)
+    if s.lastMAC != nil {
+        copy(icv, s.lastMAC)
+        if s.param & 0x10 != 0 {
+            block, _ := des.NewCipher(s.cmac[:8])
+            block.Encrypt(icv, icv)
+        }
+    }
+    cla := cmd[0] | 0x04
+    var macInput []byte
+    if s.param & 0x02 != 0 {
+        // C-MAC on unmodified APDU
+        macInput = append([]byte{cmd[0], cmd[1], cmd[2], cmd[3],
+            byte(len(data))}, data...)
+    } else {
+        macInput = append([]byte{cla, cmd[1], cmd[2], cmd[3],
+            byte(len(data) + 8)}, data...)
+    }
+    mac := retailMAC(s.cmac, icv, macInput)
+    s.lastMAC = mac
+    if s.level & SEC_C_DECRYPTION != 0 && len(data) > 0 {
+        block, _ := tripleDES(s.senc)
+        padded := pad(data, 8)
+        encrypted := make([]byte, len(padded))
+        cipher.NewCBCEncrypter(block, make([]byte, 8)).CryptBlocks(
+            encrypted, padded)
+        data = encrypted
+        if len(data) + 8 > 255 {
+            return nil, fmt.Errorf("command data too long for secure channel")
+        }
+    }
+    wrapped := smartcard.Command3(cla, cmd[1], cmd[2], cmd[3],
+        append(data, mac...))
+    if hasLe {
+        wrapped = append(wrapped, le)
+    }
+    return wrapped, nil
+}
+
+func (s *scp02) unwrap(rsp smartcard.ResponseAPDU) (smartcard.ResponseAPDU,
+    error) {
+    return rsp, nil
+}
+
+// Encrypt key data with the session DEK (3DES ECB).
+func (s *scp02) encryptKey(key []byte) ([]byte, error) {
+    if len(key) % 8 != 0 {
+        return nil, fmt.Errorf("invalid key length: %d", len(key))
+    }
+    block, err := tripleDES(s.dek)
+    if err != nil { return nil, err }
+    out := make([]byte, len(key))
+    for i := 0; i < len(key); i += 8 {
+        block.Encrypt(out[i:i+8], key[i:i+8])
+    }
+    return out, nil
+}
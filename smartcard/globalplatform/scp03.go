@@ -0,0 +1,205 @@
+package globalplatform
+
+import (
+    "crypto/aes"
+    "crypto/cipher"
+    "fmt"
+    "github.com/sf1/go-card/smartcard"
+    "github.com/sf1/go-card/smartcard/cmac"
+)
+
+const (
+    // SCP03 derivation constants
+    _DERIVE_CARD_CRYPTOGRAM = 0x00
+    _DERIVE_HOST_CRYPTOGRAM = 0x01
+    _DERIVE_CARD_CHALLENGE = 0x02
+    _DERIVE_S_ENC = 0x04
+    _DERIVE_S_MAC = 0x06
+    _DERIVE_S_RMAC = 0x07
+)
+
+// SCP03 session (GlobalPlatform Card Specification 2.2, Amendment D).
+type scp03 struct {
+    senc []byte
+    smac []byte
+    srmac []byte
+    dek []byte
+    param byte
+    level byte
+    size int
+    context []byte
+    chaining []byte
+    counter []byte
+}
+
+func newSCP03(keys KeySet, info *initUpdateResponse, level byte) (
+    channel, error) {
+    if level & SEC_R_MAC != 0 && info.Param & SCP03_R_MAC == 0 {
+        return nil, fmt.Errorf("card doesn't support R-MAC")
+    }
+    if level & SEC_R_ENCRYPTION != 0 && info.Param & SCP03_R_ENCRYPTION == 0 {
+        return nil, fmt.Errorf("card doesn't support R-ENCRYPTION")
+    }
+    var err error
+    s := &scp03{
+        param: info.Param,
+        size: len(info.CardChallenge),
+        dek: keys.DEK,
+        chaining: make([]byte, 16),
+        counter: make([]byte, 16),
+    }
+    s.context = append(s.context, info.HostChallenge...)
+    s.context = append(s.context, info.CardChallenge...)
+    s.senc, err = kdf(keys.ENC, _DERIVE_S_ENC, s.context, len(keys.ENC)*8)
+    if err != nil { return nil, err }
+    s.smac, err = kdf(keys.MAC, _DERIVE_S_MAC, s.context, len(keys.MAC)*8)
+    if err != nil { return nil, err }
+    s.srmac, err = kdf(keys.MAC, _DERIVE_S_RMAC, s.context, len(keys.MAC)*8)
+    if err != nil { return nil, err }
+    return s, nil
+}
+
+// NIST SP 800-108 KDF in counter mode with AES-CMAC as PRF, as specified
+// by SCP03.
+func kdf(key []byte, constant byte, context []byte, bits int) ([]byte,
+    error) {
+    block, err := aes.NewCipher(key)
+    if err != nil { return nil, err }
+    out := make([]byte, 0, bits/8 + 16)
+    for i := 1; len(out) < bits/8; i++ {
+        data := make([]byte, 16, 16 + len(context))
+        data[11] = constant
+        data[12] = 0x00
+        data[13] = byte(bits >> 8)
+        data[14] = byte(bits)
+        data[15] = byte(i)
+        data = append(data, context...)
+        mac, err := cmac.Sum(block, data)
+        if err != nil { return nil, err }
+        out = append(out, mac...)
+    }
+    return out[:bits/8], nil
+}
+
+func (s *scp03) cardCryptogram() []byte {
+    c, _ := kdf(s.smac, _DERIVE_CARD_CRYPTOGRAM, s.context, s.size*8)
+    return c
+}
+
+func (s *scp03) hostCryptogram() []byte {
+    c, _ := kdf(s.smac, _DERIVE_HOST_CRYPTOGRAM, s.context, s.size*8)
+    return c
+}
+
+func (s *scp03) setSecurityLevel(level byte) {
+    s.level = level
+}
+
+func (s *scp03) incrementCounter() {
+    for i := len(s.counter) - 1; i >= 0; i-- {
+        s.counter[i]++
+        if s.counter[i] != 0 {
+            break
+        }
+    }
+}
+
+func (s *scp03) icv(response bool) []byte {
+    block, _ := aes.NewCipher(s.senc)
+    icv := make([]byte, 16)
+    copy(icv, s.counter)
+    if response {
+        icv[0] = 0x80
+    }
+    block.Encrypt(icv, icv)
+    return icv
+}
+
+func (s *scp03) wrap(cmd smartcard.CommandAPDU) (smartcard.CommandAPDU,
+    error) {
+    if !cmd.IsValid() {
+        return nil, fmt.Errorf("invalid command APDU")
+    }
+    if s.level & SEC_C_MAC == 0 {
+        return cmd, nil
+    }
+    data := cmd.Data()
+    le, hasLe := cmd.Le()
+    if s.level & SEC_C_DECRYPTION != 0 {
+        s.incrementCounter()
+        if len(data) > 0 {
+            block, _ := aes.NewCipher(s.senc)
+            padded := pad(data, 16)
+            encrypted := make([]byte, len(padded))
+            cipher.NewCBCEncrypter(block, s.icv(false)).CryptBlocks(
+                encrypted, padded)
+            data = encrypted
+        }
+    }
+    if len(data) + s.size > 255 {
+        return nil, fmt.Errorf("command data too long for secure channel")
+    }
+    cla := cmd[0] | 0x04
+    block, err := aes.NewCipher(s.smac)
+    if err != nil { return nil, err }
+    macInput := append([]byte{}, s.chaining...)
+    macInput = append(macInput, cla, cmd[1], cmd[2], cmd[3],
+        byte(len(data) + s.size))
+    macInput = append(macInput, data...)
+    mac, err := cmac.Sum(block, macInput)
+    if err != nil { return nil, err }
+    s.chaining = mac
+    wrapped := smartcard.Command3(cla, cmd[1], cmd[2], cmd[3],
+        append(data, mac[:s.size]...))
+    if hasLe {
+        wrapped = append(wrapped, le)
+    }
+    return wrapped, nil
+}
+
+func (s *scp03) unwrap(rsp smartcard.ResponseAPDU) (smartcard.ResponseAPDU,
+    error) {
+    if s.level & SEC_R_MAC == 0 || len(rsp) == 2 {
+        return rsp, nil
+    }
+    if len(rsp) < 2 + s.size {
+        return nil, fmt.Errorf("response too short for R-MAC")
+    }
+    data := rsp[:len(rsp)-2-s.size]
+    rmac := rsp[len(rsp)-2-s.size:len(rsp)-2]
+    block, err := aes.NewCipher(s.srmac)
+    if err != nil { return nil, err }
+    macInput := append([]byte{}, s.chaining...)
+    macInput = append(macInput, data...)
+    macInput = append(macInput, rsp.SW1(), rsp.SW2())
+    mac, err := cmac.Sum(block, macInput)
+    if err != nil { return nil, err }
+    if !equal(mac[:s.size], rmac) {
+        return nil, fmt.Errorf("R-MAC verification failed")
+    }
+    if s.level & SEC_R_ENCRYPTION != 0 && len(data) > 0 {
+        if len(data) % 16 != 0 {
+            return nil, fmt.Errorf("invalid encrypted response length")
+        }
+        block, _ := aes.NewCipher(s.senc)
+        decrypted := make([]byte, len(data))
+        cipher.NewCBCDecrypter(block, s.icv(true)).CryptBlocks(
+            decrypted, data)
+        data, err = unpad(decrypted)
+        if err != nil { return nil, err }
+    }
+    return smartcard.ResponseAPDU(append(append([]byte{}, data...),
+        rsp.SW1(), rsp.SW2())), nil
+}
+
+// Encrypt key data with the static DEK (AES CBC, zero ICV).
+func (s *scp03) encryptKey(key []byte) ([]byte, error) {
+    if len(key) % 16 != 0 {
+        return nil, fmt.Errorf("invalid key length: %d", len(key))
+    }
+    block, err := aes.NewCipher(s.dek)
+    if err != nil { return nil, err }
+    out := make([]byte, len(key))
+    cipher.NewCBCEncrypter(block, make([]byte, 16)).CryptBlocks(out, key)
+    return out, nil
+}
@@ -0,0 +1,392 @@
+package globalplatform
+
+import (
+    "bytes"
+    "crypto/aes"
+    "crypto/cipher"
+    "encoding/hex"
+    "fmt"
+    "testing"
+    "github.com/sf1/go-card/smartcard"
+    "github.com/sf1/go-card/smartcard/cmac"
+    "github.com/sf1/go-card/smartcard/mock"
+)
+
+func unhex(s string) []byte {
+    b, err := hex.DecodeString(s)
+    if err != nil { panic(err) }
+    return b
+}
+
+type exchange struct {
+    command string
+    response string
+}
+
+// Card side of a secure channel, mirroring the host computations.
+type testCard struct {
+    protocol byte
+    param byte
+    keys KeySet
+    kdd []byte
+    counter []byte
+    challenge []byte
+    mirror channel
+    level byte
+    script []exchange
+}
+
+func (c *testCard) TransmitAPDU(cmd smartcard.CommandAPDU) (
+    smartcard.ResponseAPDU, error) {
+    switch {
+        case cmd[1] == INS_INITIALIZE_UPDATE:
+            return c.initializeUpdate(cmd)
+        case cmd[1] == INS_EXTERNAL_AUTHENTICATE:
+            plain := smartcard.Command3(CLA_GP, INS_EXTERNAL_AUTHENTICATE,
+                cmd[2], 0x00, c.mirror.hostCryptogram())
+            c.mirror.setSecurityLevel(SEC_C_MAC)
+            expected, _ := c.mirror.wrap(plain)
+            if !bytes.Equal(expected, cmd) {
+                return smartcard.ResponseAPDU{0x63, 0x00}, nil
+            }
+            c.level = cmd[2]
+            c.mirror.setSecurityLevel(c.level)
+            return smartcard.ResponseAPDU{0x90, 0x00}, nil
+    }
+    if len(c.script) == 0 {
+        return nil, fmt.Errorf("unexpected command %s", cmd)
+    }
+    next := c.script[0]
+    c.script = c.script[1:]
+    expected, _ := c.mirror.wrap(unhex(next.command))
+    if !bytes.Equal(expected, cmd) {
+        return nil, fmt.Errorf("command mismatch: got %s, want %s",
+            cmd, smartcard.CommandAPDU(expected))
+    }
+    return c.protectResponse(unhex(next.response)), nil
+}
+
+func (c *testCard) initializeUpdate(cmd smartcard.CommandAPDU) (
+    smartcard.ResponseAPDU, error) {
+    info := &initUpdateResponse{}
+    info.DiversificationData = c.kdd
+    info.Protocol = c.protocol
+    info.Param = c.param
+    info.SequenceCounter = c.counter
+    info.CardChallenge = c.challenge
+    info.HostChallenge = cmd.Data()
+    var err error
+    if c.protocol == 0x02 {
+        c.mirror, err = newSCP02(c.keys, info, 0)
+    } else {
+        c.mirror, err = newSCP03(c.keys, info, 0)
+    }
+    if err != nil { return nil, err }
+    rsp := append([]byte{}, c.kdd...)
+    rsp = append(rsp, 0x01, c.protocol)
+    if c.protocol == 0x02 {
+        rsp = append(rsp, c.counter...)
+        rsp = append(rsp, c.challenge...)
+        rsp = append(rsp, c.mirror.cardCryptogram()...)
+    } else {
+        rsp = append(rsp, c.param)
+        rsp = append(rsp, c.challenge...)
+        rsp = append(rsp, c.mirror.cardCryptogram()...)
+        rsp = append(rsp, c.counter...)
+    }
+    return append(rsp, 0x90, 0x00), nil
+}
+
+// Apply SCP03 R-ENCRYPTION and R-MAC to a plain response.
+func (c *testCard) protectResponse(plain []byte) smartcard.ResponseAPDU {
+    if c.level & SEC_R_MAC == 0 || len(plain) == 2 {
+        return plain
+    }
+    s := c.mirror.(*scp03)
+    data := plain[:len(plain)-2]
+    if c.level & SEC_R_ENCRYPTION != 0 && len(data) > 0 {
+        block, _ := aes.NewCipher(s.senc)
+        padded := pad(data, 16)
+        encrypted := make([]byte, len(padded))
+        cipher.NewCBCEncrypter(block, s.icv(true)).CryptBlocks(
+            encrypted, padded)
+        data = encrypted
+    }
+    block, _ := aes.NewCipher(s.srmac)
+    macInput := append(append([]byte{}, s.chaining...), data...)
+    macInput = append(macInput, plain[len(plain)-2:]...)
+    mac, _ := cmac.Sum(block, macInput)
+    rsp := append(append([]byte{}, data...), mac[:s.size]...)
+    return append(rsp, plain[len(plain)-2:]...)
+}
+
+func TestPadding(t *testing.T) {
+    if !bytes.Equal(pad([]byte{1, 2, 3}, 8), unhex("0102038000000000")) {
+        t.Errorf("unexpected padding: %x", pad([]byte{1, 2, 3}, 8))
+    }
+    if len(pad(make([]byte, 8), 8)) != 16 {
+        t.Errorf("full block must be padded")
+    }
+    data, err := unpad(unhex("0102038000000000"))
+    if err != nil || !bytes.Equal(data, []byte{1, 2, 3}) {
+        t.Errorf("unexpected unpadding: %x, %v", data, err)
+    }
+    _, err = unpad(unhex("0102030000000000"))
+    if err == nil {
+        t.Errorf("missing padding not detected")
+    }
+}
+
+func TestDiversification(t *testing.T) {
+    kdd := unhex("00010203040506070809")
+    master := DefaultKeys()
+    block, _ := tripleDES(master.ENC)
+    expected := make([]byte, 16)
+    block.Encrypt(expected[:8], unhex("000104050607f001"))
+    block.Encrypt(expected[8:], unhex("0001040506070f01"))
+    keys, err := master.Diversify(DIVERSIFY_VISA2, kdd, 0x02)
+    if err != nil { t.Error(err); return }
+    if !bytes.Equal(keys.ENC, expected) {
+        t.Errorf("unexpected VISA2 key: %x", keys.ENC)
+    }
+    block.Encrypt(expected[:8], unhex("040506070809f002"))
+    block.Encrypt(expected[8:], unhex("0405060708090f02"))
+    keys, err = master.Diversify(DIVERSIFY_EMV_CPS, kdd, 0x02)
+    if err != nil { t.Error(err); return }
+    if !bytes.Equal(keys.MAC, expected) {
+        t.Errorf("unexpected EMV CPS key: %x", keys.MAC)
+    }
+    _, err = master.Diversify(DIVERSIFY_VISA2, kdd[:9], 0x02)
+    if err == nil {
+        t.Errorf("short diversification data accepted")
+    }
+}
+
+func TestSCP02(t *testing.T) {
+    for _, param := range []byte{SCP02_I_15, SCP02_I_55} {
+        for _, level := range []byte{SEC_C_MAC,
+            SEC_C_MAC | SEC_C_DECRYPTION} {
+            card := &testCard{
+                protocol: 0x02,
+                param: param,
+                keys: DefaultKeys(),
+                kdd: unhex("0000715045126200ff01"),
+                counter: unhex("002a"),
+                challenge: unhex("b1c2d3e4f5a6"),
+                script: []exchange{
+                    {"80f28000024f0000", "08a0000000030000000f9e9000"},
+                    {"80ca006600", "6a88"},
+                },
+            }
+            session, err := OpenSecureChannel(card, &Config{
+                Keys: DefaultKeys(),
+                SecurityLevel: level,
+                SCP02Param: param,
+                HostChallenge: unhex("1122334455667788"),
+            })
+            if err != nil { t.Error(err); return }
+            if session.Info().Protocol != 0x02 {
+                t.Errorf("unexpected protocol %02x", session.Info().Protocol)
+            }
+            for _, e := range card.script {
+                rsp, err := session.TransmitAPDU(unhex(e.command))
+                if err != nil {
+                    t.Errorf("i=%02x level=%02x: %s", param, level, err)
+                    break
+                }
+                if !bytes.Equal(rsp, unhex(e.response)) {
+                    t.Errorf("got %s, want %s", rsp, e.response)
+                }
+            }
+        }
+    }
+}
+
+func TestSCP03(t *testing.T) {
+    keys := KeySet{
+        ENC: unhex("404142434445464748494a4b4c4d4e4f"),
+        MAC: unhex("505152535455565758595a5b5c5d5e5f"),
+        DEK: unhex("606162636465666768696a6b6c6d6e6f"),
+    }
+    levels := []byte{
+        SEC_C_MAC,
+        SEC_C_MAC | SEC_C_DECRYPTION,
+        SEC_C_MAC | SEC_R_MAC,
+        SEC_C_MAC | SEC_C_DECRYPTION | SEC_R_MAC | SEC_R_ENCRYPTION,
+    }
+    for _, s16 := range []bool{false, true} {
+        for _, level := range levels {
+            param := byte(SCP03_PSEUDO_RANDOM | SCP03_R_MAC |
+                SCP03_R_ENCRYPTION)
+            challenge := unhex("0102030405060708")
+            host := unhex("a1a2a3a4a5a6a7a8")
+            if s16 {
+                param |= SCP03_S16
+                challenge = append(challenge, challenge...)
+                host = append(host, host...)
+            }
+            card := &testCard{
+                protocol: 0x03,
+                param: param,
+                keys: keys,
+                kdd: unhex("00000000000000000000"),
+                counter: unhex("000001"),
+                challenge: challenge,
+                script: []exchange{
+                    {"80f28000024f0000", "08a0000000030000000f9e9000"},
+                    {"80f24000024f00", "6a88"},
+                    {"80f21000024f0000",
+                        "07a00000000353500100010ca00000000353504141414141419000"},
+                },
+            }
+            session, err := OpenSecureChannel(card, &Config{
+                Keys: keys,
+                SecurityLevel: level,
+                S16: s16,
+                HostChallenge: host,
+            })
+            if err != nil { t.Errorf("S16=%t level=%02x: %s", s16, level,
+                err); continue }
+            for _, e := range card.script {
+                rsp, err := session.TransmitAPDU(unhex(e.command))
+                if err != nil { t.Error(err); break }
+                if !bytes.Equal(rsp, unhex(e.response)) {
+                    t.Errorf("S16=%t level=%02x: got %s, want %s", s16,
+                        level, rsp, e.response)
+                }
+            }
+        }
+    }
+}
+
+func TestWrongKeys(t *testing.T) {
+    card := &testCard{
+        protocol: 0x03,
+        param: 0x00,
+        keys: DefaultKeys(),
+        kdd: unhex("00000000000000000000"),
+        challenge: unhex("0102030405060708"),
+    }
+    wrong := SingleKey(unhex("000102030405060708090a0b0c0d0e0f"))
+    _, err := OpenSecureChannel(card, &Config{
+        Keys: wrong,
+        SecurityLevel: SEC_C_MAC,
+    })
+    if err == nil {
+        t.Errorf("wrong keys accepted")
+    }
+}
+
+func TestSecurityLevel(t *testing.T) {
+    valid := []byte{0x00, 0x01, 0x03, 0x11, 0x13, 0x33}
+    for _, level := range valid {
+        if err := checkSecurityLevel(level); err != nil {
+            t.Errorf("level %02x: %s", level, err)
+        }
+    }
+    // C-DEC without C-MAC, R-ENC without R-MAC or C-DEC, unknown bits
+    invalid := []byte{0x02, 0x21, 0x23, 0x31, 0x04, 0x80}
+    for _, level := range invalid {
+        if err := checkSecurityLevel(level); err == nil {
+            t.Errorf("level %02x accepted", level)
+        }
+    }
+}
+
+func expectHex(t *testing.T, what string, got []byte, want string) {
+    t.Helper()
+    if !bytes.Equal(got, mock.Hex(want)) {
+        t.Errorf("%s: got %x, want %s", what, got, want)
+    }
+}
+
+// SCP02 values of the keycard-go test suite, recorded from a JavaCard with
+// the default keys (github.com/status-im/keycard-go globalplatform). S-MAC
+// and DEK of the first session, which the suite doesn't list, were
+// computed with OpenSSL.
+func TestSCP02Vectors(t *testing.T) {
+    keys := DefaultKeys()
+    info := &initUpdateResponse{}
+    info.SequenceCounter = unhex("0065")
+    ch, err := newSCP02(keys, info, 0)
+    if err != nil { t.Fatal(err) }
+    s := ch.(*scp02)
+    expectHex(t, "S-ENC", s.senc, "85e72aaf47874218a202bf5ef891dd21")
+    expectHex(t, "S-MAC", s.cmac, "309cf99e164f3a97f3e5017ff540a79f")
+    expectHex(t, "DEK", s.dek, "93d08f8025242c4d775d69b9f16c939b")
+    // Host cryptogram
+    s = &scp02{
+        senc: unhex("8d289afe0ab9c45b1c76deea182966f4"),
+        counter: unhex("000f"),
+        cardChallenge: unhex("3fd65d4d6e45"),
+        hostChallenge: unhex("cf307b6719bf224d"),
+    }
+    expectHex(t, "host cryptogram", s.hostCryptogram(), "7702ac6ce46a47f0")
+    // C-MAC with ICV encryption
+    s = &scp02{
+        cmac: unhex("2983ba77d709c2daa1e6000abccac951"),
+        param: SCP02_I_55,
+        level: SEC_C_MAC,
+    }
+    cmd, err := s.wrap(mock.Hex("80 82 01 00 08 1d 4d e9 2e af 7a 2c 9f"))
+    if err != nil { t.Fatal(err) }
+    expectHex(t, "EXTERNAL AUTHENTICATE", cmd,
+        "84 82 01 00 10 1d 4d e9 2e af 7a 2c 9f 8f 9b 0d f6 81 c1 d3 ec")
+    cmd, err = s.wrap(mock.Hex("80 f2 80 02 02 4f 00 00"))
+    if err != nil { t.Fatal(err) }
+    expectHex(t, "GET STATUS", cmd,
+        "84 f2 80 02 0a 4f 00 30 f1 49 20 9e 17 b3 97 00")
+    // Session with the card's INITIALIZE UPDATE response; the card
+    // cryptogram is the card's, the host cryptogram and MAC were computed
+    // with OpenSSL.
+    card := mock.NewCard(nil).
+        Expect("80 50 00 00 08 f0 46 7f 90 8e 5c a2 3f 00",
+            "00 00 02 65 01 83 03 95 36 62 20 02 00 0d e9 c6 2b a1 c4 c8 " +
+            "e5 5f cb 91 b6 65 4c e4 90 00").
+        Expect("84 82 01 00 10 3c e0 60 48 3a ac e9 27 " +
+            "a3 cd a9 54 b0 e8 88 39", "90 00")
+    _, err = OpenSecureChannel(card, &Config{
+        Keys: keys,
+        SecurityLevel: SEC_C_MAC,
+        HostChallenge: unhex("f0467f908e5ca23f"),
+    })
+    if err != nil { t.Fatal(err) }
+    card.AssertExpectations(t)
+}
+
+// SCP03 values computed with OpenSSL's AES-CMAC following the KDF of
+// Amendment D, independently of this package.
+func TestSCP03Vectors(t *testing.T) {
+    keys := KeySet{
+        ENC: unhex("404142434445464748494a4b4c4d4e4f"),
+        MAC: unhex("505152535455565758595a5b5c5d5e5f"),
+        DEK: unhex("606162636465666768696a6b6c6d6e6f"),
+    }
+    info := &initUpdateResponse{}
+    info.HostChallenge = unhex("a1a2a3a4a5a6a7a8")
+    info.CardChallenge = unhex("0102030405060708")
+    ch, err := newSCP03(keys, info, 0)
+    if err != nil { t.Fatal(err) }
+    s := ch.(*scp03)
+    expectHex(t, "S-ENC", s.senc, "0af8f2aa88697ad645a1cbd7cd85c6da")
+    expectHex(t, "S-MAC", s.smac, "5501b8127b137b4199a622aff6d849b1")
+    expectHex(t, "S-RMAC", s.srmac, "eecf2db27f1b3133bb6154c740bdcdc9")
+    expectHex(t, "card cryptogram", s.cardCryptogram(), "221b844130499cb9")
+    expectHex(t, "host cryptogram", s.hostCryptogram(), "05a70f43b75942d6")
+    card := mock.NewCard(nil).
+        Expect("80 50 00 00 08 a1 a2 a3 a4 a5 a6 a7 a8 00",
+            "00 00 00 00 00 00 00 00 00 00 30 03 00 " +
+            "01 02 03 04 05 06 07 08 22 1b 84 41 30 49 9c b9 90 00").
+        Expect("84 82 01 00 10 05 a7 0f 43 b7 59 42 d6 " +
+            "d1 1d 18 55 11 1e 20 76", "90 00").
+        Expect("84 f2 80 02 0a 4f 00 c3 86 23 32 6d 58 0d e0 00", "6a 88")
+    session, err := OpenSecureChannel(card, &Config{
+        Keys: keys,
+        SecurityLevel: SEC_C_MAC,
+        HostChallenge: info.HostChallenge,
+    })
+    if err != nil { t.Fatal(err) }
+    _, err = session.TransmitAPDU(mock.Hex("80 f2 80 02 02 4f 00 00"))
+    if err != nil { t.Fatal(err) }
+    card.AssertExpectations(t)
+}
@@ -0,0 +1,696 @@
+/*
+Package httpapi exposes a smartcard.Context to non-Go programs as a
+JSON-RPC 2.0 API, served over HTTP (POST /rpc, one request per call) and
+WebSocket (GET /ws, any number of requests and event notifications).
+Clients authenticate with a token, sent as "Authorization: Bearer <token>"
+or, where headers cannot be set such as browser WebSockets, as the "token"
+query parameter. Servers behind an authenticating proxy can be created
+without token with NewUnauthenticatedServer.
+
+Methods:
+
+    listReaders                               -> [{"name", "card"}]
+    connect {"reader", "share", "protocol"}   -> {"session", "atr", "protocol"}
+    transmit {"session", "apdu", "getResponse"} -> {"response", "sw"}
+    beginTransaction {"session"}              -> {}
+    endTransaction {"session", "disposition"} -> {}
+    release {"session", "disposition"}        -> {}
+    subscribe (WebSocket only)                -> {}
+
+APDUs and ATRs are hex strings. Share mode is "shared" (default),
+"exclusive" or "direct", protocol "any" (default), "T=0" or "T=1" and
+disposition "leave", "reset" (default), "unpower" or "eject". Without a
+reader name connect uses the only reader with a card.
+
+A session is a card connection named by an unguessable handle. Sessions
+opened over a WebSocket are released when it closes, others after
+IdleTimeout without use. Calls on one session are serialized; a client
+needing several commands without interference from other clients wraps
+them in beginTransaction and endTransaction, which blocks while another
+session holds a transaction on the card.
+
+After subscribe, reader and card events are sent as notifications:
+
+    {"jsonrpc": "2.0", "method": "event", "params": {"type": "inserted",
+        "reader": "Virtual Reader 00", "time": "2019-01-02T15:04:05Z"}}
+
+with type "attached", "detached", "inserted" or "removed". PC/SC errors
+have code -32000 and the error name (e.g. "SCARD_W_REMOVED_CARD") as data.
+
+Example:
+
+    ctx, err := smartcard.EstablishContext()
+    // handle error, if any
+    server := httpapi.NewServer(ctx, token)
+    defer server.Close()
+    err = http.ListenAndServe("127.0.0.1:7480", server)
+*/
+package httpapi
+
+import (
+    "crypto/rand"
+    "crypto/subtle"
+    "encoding/hex"
+    "encoding/json"
+    "fmt"
+    "io"
+    "io/ioutil"
+    "net/http"
+    "strings"
+    "sync"
+    "time"
+    "github.com/sf1/go-card/smartcard"
+    "github.com/sf1/go-card/smartcard/metrics"
+    "github.com/sf1/go-card/smartcard/pcsc"
+)
+
+// JSON-RPC error codes
+const (
+    RPC_PARSE_ERROR = -32700
+    RPC_INVALID_REQUEST = -32600
+    RPC_METHOD_NOT_FOUND = -32601
+    RPC_INVALID_PARAMS = -32602
+    RPC_CARD_ERROR = -32000
+)
+
+// Default time after which unused sessions are released.
+const DEFAULT_IDLE_TIMEOUT = 5*time.Minute
+
+// JSON-RPC error.
+type Error struct {
+    Code int `json:"code"`
+    Message string `json:"message"`
+    Data interface{} `json:"data,omitempty"`
+}
+
+func (e *Error) Error() string {
+    return e.Message
+}
+
+// Return JSON-RPC error for err.
+func rpcError(err error) *Error {
+    if e, ok := err.(*Error); ok { return e }
+    return &Error{Code: RPC_CARD_ERROR, Message: err.Error(),
+        Data: metrics.ErrorCode(err)}
+}
+
+func invalidParams(format string, args ...interface{}) *Error {
+    return &Error{Code: RPC_INVALID_PARAMS,
+        Message: fmt.Sprintf(format, args...)}
+}
+
+type request struct {
+    Version string `json:"jsonrpc"`
+    ID json.RawMessage `json:"id"`
+    Method string `json:"method"`
+    Params json.RawMessage `json:"params"`
+}
+
+type response struct {
+    Version string `json:"jsonrpc"`
+    ID json.RawMessage `json:"id"`
+    Result interface{} `json:"result,omitempty"`
+    Error *Error `json:"error,omitempty"`
+}
+
+type notification struct {
+    Version string `json:"jsonrpc"`
+    Method string `json:"method"`
+    Params interface{} `json:"params"`
+}
+
+// Reader or card event.
+type Event struct {
+    Type string `json:"type"`
+    Reader string `json:"reader"`
+    Time time.Time `json:"time"`
+}
+
+// Card connection of a client.
+type session struct {
+    card *smartcard.Card
+    // WebSocket the session was opened on, nil for HTTP
+    owner *wsConn
+    // Serializes calls
+    mutex sync.Mutex
+    // Protected by the server mutex
+    calls int
+    used time.Time
+}
+
+// API server. Implements http.Handler.
+type Server struct {
+    ctx *smartcard.Context
+    token string
+    auth bool
+    // Sessions unused for longer are released (DEFAULT_IDLE_TIMEOUT if 0)
+    IdleTimeout time.Duration
+    mutex sync.Mutex
+    sessions map[string]*session
+    subscribers map[*wsConn]bool
+    conns map[*wsConn]bool
+    watching bool
+    stop chan struct{}
+    closed bool
+}
+
+// Create server for ctx accepting clients presenting token. An empty
+// token is presented by no client.
+func NewServer(ctx *smartcard.Context, token string) *Server {
+    return newServer(ctx, token, true)
+}
+
+// Create server for ctx accepting all clients, e.g. behind a proxy
+// authenticating them.
+func NewUnauthenticatedServer(ctx *smartcard.Context) *Server {
+    return newServer(ctx, "", false)
+}
+
+func newServer(ctx *smartcard.Context, token string, auth bool) *Server {
+    s := &Server{
+        ctx: ctx,
+        token: token,
+        auth: auth,
+        sessions: map[string]*session{},
+        subscribers: map[*wsConn]bool{},
+        conns: map[*wsConn]bool{},
+        stop: make(chan struct{}),
+    }
+    go s.expire()
+    return s
+}
+
+// Release all sessions and close WebSocket connections. The context is
+// left to the caller.
+func (s *Server) Close() error {
+    s.mutex.Lock()
+    if s.closed {
+        s.mutex.Unlock()
+        return nil
+    }
+    s.closed = true
+    close(s.stop)
+    conns := s.conns
+    s.conns = map[*wsConn]bool{}
+    s.mutex.Unlock()
+    for c := range conns {
+        c.Close()
+    }
+    s.releaseAll(func(*session) bool { return true })
+    return nil
+}
+
+// Check token of request.
+func (s *Server) authorized(r *http.Request) bool {
+    if !s.auth { return true }
+    if s.token == "" { return false }
+    token := r.URL.Query().Get("token")
+    if auth := r.Header.Get("Authorization"); auth != "" {
+        if !strings.HasPrefix(auth, "Bearer ") { return false }
+        token = strings.TrimPrefix(auth, "Bearer ")
+    }
+    return subtle.ConstantTimeCompare([]byte(token), []byte(s.token)) == 1
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+    if !s.authorized(r) {
+        w.Header().Set("WWW-Authenticate", "Bearer")
+        http.Error(w, "unauthorized", http.StatusUnauthorized)
+        return
+    }
+    switch r.URL.Path {
+        case "/rpc":
+            if r.Method != "POST" {
+                w.Header().Set("Allow", "POST")
+                http.Error(w, "method not allowed",
+                    http.StatusMethodNotAllowed)
+                return
+            }
+            body, err := ioutil.ReadAll(io.LimitReader(r.Body, wsMaxMessage))
+            if err != nil {
+                http.Error(w, err.Error(), http.StatusBadRequest)
+                return
+            }
+            rsp := s.handle(nil, body)
+            if rsp == nil {
+                w.WriteHeader(http.StatusNoContent)
+                return
+            }
+            w.Header().Set("Content-Type", "application/json")
+            w.Write(rsp)
+        case "/ws":
+            c, err := wsUpgrade(w, r)
+            if err != nil { return }
+            s.serveWS(c)
+        default:
+            http.NotFound(w, r)
+    }
+}
+
+// Serve WebSocket connection until closed, then release its sessions.
+func (s *Server) serveWS(c *wsConn) {
+    s.mutex.Lock()
+    if s.closed {
+        s.mutex.Unlock()
+        c.Close()
+        return
+    }
+    s.conns[c] = true
+    s.mutex.Unlock()
+    var wg sync.WaitGroup
+    for {
+        message, err := c.ReadMessage()
+        if err != nil { break }
+        // Requests are handled concurrently, so that a blocking
+        // beginTransaction does not hold up other sessions
+        wg.Add(1)
+        go func() {
+            defer wg.Done()
+            if rsp := s.handle(c, message); rsp != nil {
+                c.WriteText(rsp)
+            }
+        }()
+    }
+    c.Close()
+    s.mutex.Lock()
+    delete(s.conns, c)
+    delete(s.subscribers, c)
+    s.mutex.Unlock()
+    owned := func(ss *session) bool { return ss.owner == c }
+    s.releaseAll(owned)
+    // Release what pending requests connected meanwhile
+    wg.Wait()
+    s.releaseAll(owned)
+}
+
+// Handle JSON-RPC message and return encoded response, or nil for
+// notifications.
+func (s *Server) handle(c *wsConn, message []byte) []byte {
+    req := &request{}
+    rsp := &response{Version: "2.0", ID: json.RawMessage("null")}
+    if err := json.Unmarshal(message, req); err != nil {
+        rsp.Error = &Error{Code: RPC_PARSE_ERROR, Message: err.Error()}
+    } else if req.Version != "2.0" || req.Method == "" {
+        rsp.Error = &Error{Code: RPC_INVALID_REQUEST,
+            Message: "invalid request"}
+    } else {
+        result, err := s.call(c, req.Method, req.Params)
+        if req.ID == nil { return nil }
+        rsp.ID = req.ID
+        if err != nil {
+            rsp.Error = rpcError(err)
+        } else {
+            rsp.Result = result
+        }
+    }
+    data, _ := json.Marshal(rsp)
+    return data
+}
+
+// Decode params into v.
+func decodeParams(params json.RawMessage, v interface{}) error {
+    if len(params) == 0 { return nil }
+    if err := json.Unmarshal(params, v); err != nil {
+        return invalidParams("invalid params: %s", err)
+    }
+    return nil
+}
+
+type sessionParams struct {
+    Session string `json:"session"`
+    Disposition string `json:"disposition"`
+}
+
+type connectParams struct {
+    Reader string `json:"reader"`
+    Share string `json:"share"`
+    Protocol string `json:"protocol"`
+}
+
+type transmitParams struct {
+    Session string `json:"session"`
+    APDU string `json:"apdu"`
+    GetResponse bool `json:"getResponse"`
+}
+
+type readerInfo struct {
+    Name string `json:"name"`
+    Card bool `json:"card"`
+}
+
+type connectResult struct {
+    Session string `json:"session"`
+    ATR string `json:"atr"`
+    Protocol string `json:"protocol"`
+}
+
+type transmitResult struct {
+    Response string `json:"response"`
+    SW string `json:"sw"`
+}
+
+// Call method with params on behalf of WebSocket c (nil for HTTP).
+func (s *Server) call(c *wsConn, method string,
+    params json.RawMessage) (interface{}, error) {
+    switch method {
+        case "listReaders":
+            return s.listReaders()
+        case "connect":
+            p := &connectParams{}
+            if err := decodeParams(params, p); err != nil { return nil, err }
+            return s.connect(c, p)
+        case "transmit":
+            p := &transmitParams{}
+            if err := decodeParams(params, p); err != nil { return nil, err }
+            return s.transmit(p)
+        case "beginTransaction", "endTransaction", "release":
+            p := &sessionParams{}
+            if err := decodeParams(params, p); err != nil { return nil, err }
+            if err := s.sessionCall(method, p); err != nil { return nil, err }
+            return struct{}{}, nil
+        case "subscribe":
+            if c == nil {
+                return nil, &Error{Code: RPC_INVALID_REQUEST,
+                    Message: "subscribe requires a WebSocket"}
+            }
+            s.subscribe(c)
+            return struct{}{}, nil
+    }
+    return nil, &Error{Code: RPC_METHOD_NOT_FOUND,
+        Message: fmt.Sprintf("method %q not found", method)}
+}
+
+// Call transaction or release method on session.
+func (s *Server) sessionCall(method string, p *sessionParams) error {
+    if method == "endTransaction" && p.Disposition == "" {
+        p.Disposition = "leave"
+    }
+    disposition, err := parseDisposition(p.Disposition)
+    if err != nil { return err }
+    switch method {
+        case "beginTransaction":
+            return s.withSession(p.Session, func(card *smartcard.Card) error {
+                return card.BeginTransaction()
+            })
+        case "endTransaction":
+            return s.withSession(p.Session, func(card *smartcard.Card) error {
+                return card.EndTransaction(disposition)
+            })
+    }
+    return s.release(p.Session, disposition)
+}
+
+func (s *Server) listReaders() ([]readerInfo, error) {
+    readers, err := s.ctx.ListReaders()
+    if err != nil { return nil, err }
+    withCard, err := s.ctx.ListReadersWithCard()
+    if err != nil { return nil, err }
+    present := map[string]bool{}
+    for _, r := range withCard {
+        present[r.Name()] = true
+    }
+    infos := make([]readerInfo, len(readers))
+    for i, r := range readers {
+        infos[i] = readerInfo{r.Name(), present[r.Name()]}
+    }
+    return infos, nil
+}
+
+// Return share mode for name.
+func parseShareMode(name string) (uint32, error) {
+    switch strings.ToLower(name) {
+        case "", "shared":
+            return smartcard.SHARE_SHARED, nil
+        case "exclusive":
+            return smartcard.SHARE_EXCLUSIVE, nil
+        case "direct":
+            return smartcard.SHARE_DIRECT, nil
+    }
+    return 0, invalidParams("invalid share mode %q", name)
+}
+
+// Return protocols for name.
+func parseProtocol(name string) (uint32, error) {
+    switch strings.ToUpper(name) {
+        case "", "ANY":
+            return smartcard.PROTOCOL_ANY, nil
+        case "T=0", "T0":
+            return smartcard.PROTOCOL_T0, nil
+        case "T=1", "T1":
+            return smartcard.PROTOCOL_T1, nil
+    }
+    return 0, invalidParams("invalid protocol %q", name)
+}
+
+// Return disposition for name.
+func parseDisposition(name string) (uint32, error) {
+    switch strings.ToLower(name) {
+        case "", "reset":
+            return smartcard.RESET_CARD, nil
+        case "leave":
+            return smartcard.LEAVE_CARD, nil
+        case "unpower":
+            return smartcard.UNPOWER_CARD, nil
+        case "eject":
+            return smartcard.EJECT_CARD, nil
+    }
+    return 0, invalidParams("invalid disposition %q", name)
+}
+
+// Return name of protocol.
+func protocolName(protocol uint32) string {
+    switch protocol {
+        case smartcard.PROTOCOL_T0:
+            return "T=0"
+        case smartcard.PROTOCOL_T1:
+            return "T=1"
+    }
+    return ""
+}
+
+// Return reader named name, or the only reader with a card if name is
+// empty.
+func (s *Server) reader(name string) (*smartcard.Reader, error) {
+    if name == "" {
+        readers, err := s.ctx.ListReadersWithCard()
+        if err != nil { return nil, err }
+        if len(readers) != 1 {
+            return nil, invalidParams("%d readers with card, name required",
+                len(readers))
+        }
+        return readers[0], nil
+    }
+    readers, err := s.ctx.ListReaders()
+    if err != nil { return nil, err }
+    for _, r := range readers {
+        if r.Name() == name { return r, nil }
+    }
+    return nil, pcsc.Error(pcsc.SCARD_E_UNKNOWN_READER)
+}
+
+// Return random session handle.
+func newHandle() (string, error) {
+    b := make([]byte, 16)
+    if _, err := rand.Read(b); err != nil { return "", err }
+    return hex.EncodeToString(b), nil
+}
+
+func (s *Server) connect(c *wsConn, p *connectParams) (*connectResult,
+    error) {
+    shareMode, err := parseShareMode(p.Share)
+    if err != nil { return nil, err }
+    protocols, err := parseProtocol(p.Protocol)
+    if err != nil { return nil, err }
+    reader, err := s.reader(p.Reader)
+    if err != nil { return nil, err }
+    handle, err := newHandle()
+    if err != nil { return nil, err }
+    card, err := reader.ConnectMode(shareMode, protocols)
+    if err != nil { return nil, err }
+    s.mutex.Lock()
+    if s.closed {
+        s.mutex.Unlock()
+        card.Disconnect()
+        return nil, fmt.Errorf("httpapi: server closed")
+    }
+    s.sessions[handle] = &session{card: card, owner: c, used: time.Now()}
+    s.mutex.Unlock()
+    return &connectResult{
+        Session: handle,
+        ATR: hex.EncodeToString(card.ATR()),
+        Protocol: protocolName(card.Protocol()),
+    }, nil
+}
+
+// Call fn with card of session handle, serialized with other calls on
+// the session.
+func (s *Server) withSession(handle string,
+    fn func(*smartcard.Card) error) error {
+    s.mutex.Lock()
+    ss, ok := s.sessions[handle]
+    if ok { ss.calls++ }
+    s.mutex.Unlock()
+    if !ok { return pcsc.Error(pcsc.SCARD_E_INVALID_HANDLE) }
+    defer func() {
+        s.mutex.Lock()
+        ss.calls--
+        ss.used = time.Now()
+        s.mutex.Unlock()
+    }()
+    ss.mutex.Lock()
+    defer ss.mutex.Unlock()
+    return fn(ss.card)
+}
+
+func (s *Server) transmit(p *transmitParams) (*transmitResult, error) {
+    apdu, err := hex.DecodeString(strings.Replace(p.APDU, " ", "", -1))
+    if err != nil { return nil, invalidParams("invalid APDU: %s", err) }
+    cmd := smartcard.CommandAPDU(apdu)
+    if !cmd.IsValid() { return nil, invalidParams("invalid APDU") }
+    var rsp smartcard.ResponseAPDU
+    err = s.withSession(p.Session, func(card *smartcard.Card) error {
+        var err error
+        if p.GetResponse {
+            rsp, err = smartcard.TransmitAndGetResponse(card, cmd)
+        } else {
+            rsp, err = card.TransmitAPDU(cmd)
+        }
+        return err
+    })
+    if err != nil { return nil, err }
+    return &transmitResult{
+        Response: hex.EncodeToString(rsp.Data()),
+        SW: fmt.Sprintf("%04x", rsp.SW()),
+    }, nil
+}
+
+// Disconnect card of session with disposition and forget the session.
+func (s *Server) release(handle string, disposition uint32) error {
+    s.mutex.Lock()
+    ss, ok := s.sessions[handle]
+    delete(s.sessions, handle)
+    s.mutex.Unlock()
+    if !ok { return pcsc.Error(pcsc.SCARD_E_INVALID_HANDLE) }
+    // Not serialized, so that blocked calls of the session fail
+    return ss.card.DisconnectMode(disposition)
+}
+
+// Release sessions matching filter, resetting their cards.
+func (s *Server) releaseAll(filter func(*session) bool) {
+    s.mutex.Lock()
+    var handles []string
+    for handle, ss := range s.sessions {
+        if filter(ss) { handles = append(handles, handle) }
+    }
+    s.mutex.Unlock()
+    for _, handle := range handles {
+        s.release(handle, smartcard.RESET_CARD)
+    }
+}
+
+// Return idle timeout.
+func (s *Server) idleTimeout() time.Duration {
+    if s.IdleTimeout == 0 { return DEFAULT_IDLE_TIMEOUT }
+    return s.IdleTimeout
+}
+
+// Release HTTP sessions idle for longer than the idle timeout until the
+// server is closed.
+func (s *Server) expire() {
+    for {
+        select {
+            case <-s.stop:
+                return
+            case <-time.After(s.idleTimeout() / 4):
+        }
+        s.expireSessions(time.Now())
+    }
+}
+
+// Release HTTP sessions without calls since now minus the idle timeout.
+func (s *Server) expireSessions(now time.Time) {
+    deadline := now.Add(-s.idleTimeout())
+    s.releaseAll(func(ss *session) bool {
+        return ss.owner == nil && ss.calls == 0 && ss.used.Before(deadline)
+    })
+}
+
+// Send events to WebSocket c, starting the reader watch if needed.
+func (s *Server) subscribe(c *wsConn) {
+    s.mutex.Lock()
+    defer s.mutex.Unlock()
+    s.subscribers[c] = true
+    if !s.watching {
+        s.watching = true
+        go s.watch()
+    }
+}
+
+// Send event to subscribers.
+func (s *Server) publish(e *Event) {
+    data, _ := json.Marshal(&notification{"2.0", "event", e})
+    s.mutex.Lock()
+    subscribers := make([]*wsConn, 0, len(s.subscribers))
+    for c := range s.subscribers {
+        subscribers = append(subscribers, c)
+    }
+    s.mutex.Unlock()
+    for _, c := range subscribers {
+        c.WriteText(data)
+    }
+}
+
+// Poll readers every 250 ms and publish changes until the server is
+// closed.
+func (s *Server) watch() {
+    var readers, cards map[string]bool
+    for {
+        current, err := s.readerStates()
+        if err == nil {
+            present := map[string]bool{}
+            for name, card := range current {
+                if card { present[name] = true }
+            }
+            if readers != nil {
+                s.publishChanges(readers, current, "attached", "detached")
+                s.publishChanges(cards, present, "inserted", "removed")
+            }
+            readers, cards = current, present
+        }
+        select {
+            case <-s.stop:
+                return
+            case <-time.After(250*time.Millisecond):
+        }
+    }
+}
+
+// Return readers and whether they have a card.
+func (s *Server) readerStates() (map[string]bool, error) {
+    infos, err := s.listReaders()
+    if err == pcsc.Error(pcsc.SCARD_E_NO_READERS_AVAILABLE) {
+        return map[string]bool{}, nil
+    }
+    if err != nil { return nil, err }
+    states := map[string]bool{}
+    for _, info := range infos {
+        states[info.Name] = info.Card
+    }
+    return states, nil
+}
+
+// Publish added and removed keys of a set.
+func (s *Server) publishChanges(before, after map[string]bool, added,
+    removed string) {
+    now := time.Now()
+    for name := range before {
+        if _, ok := after[name]; !ok {
+            s.publish(&Event{removed, name, now})
+        }
+    }
+    for name := range after {
+        if _, ok := before[name]; !ok {
+            s.publish(&Event{added, name, now})
+        }
+    }
+}
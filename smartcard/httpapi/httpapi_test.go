@@ -0,0 +1,353 @@
+package httpapi
+
+import (
+    "bufio"
+    "bytes"
+    "encoding/binary"
+    "encoding/json"
+    "fmt"
+    "io"
+    "net"
+    "net/http"
+    "net/http/httptest"
+    "strings"
+    "testing"
+    "time"
+    "github.com/sf1/go-card/smartcard"
+    "github.com/sf1/go-card/smartcard/mock"
+)
+
+const testToken = "secret"
+
+var testATR = mock.Hex("3b 80 80 01 01")
+
+// Start API server on mock backend.
+func start(t *testing.T) (*mock.Backend, *Server, *httptest.Server) {
+    t.Helper()
+    backend := mock.NewBackend()
+    ctx, err := smartcard.EstablishContextWithBackend(backend)
+    if err != nil { t.Fatal(err) }
+    server := NewServer(ctx, testToken)
+    return backend, server, httptest.NewServer(server)
+}
+
+// Call method over HTTP and decode result into result.
+func call(t *testing.T, url, method string, params, result interface{}) *Error {
+    t.Helper()
+    body, _ := json.Marshal(map[string]interface{}{"jsonrpc": "2.0",
+        "id": 1, "method": method, "params": params})
+    req, _ := http.NewRequest("POST", url + "/rpc", bytes.NewReader(body))
+    req.Header.Set("Authorization", "Bearer " + testToken)
+    rsp, err := http.DefaultClient.Do(req)
+    if err != nil { t.Fatal(err) }
+    defer rsp.Body.Close()
+    var r struct {
+        Result json.RawMessage
+        Error *Error
+    }
+    if err := json.NewDecoder(rsp.Body).Decode(&r); err != nil {
+        t.Fatal(err)
+    }
+    if r.Error == nil && result != nil {
+        if err := json.Unmarshal(r.Result, result); err != nil {
+            t.Fatal(err)
+        }
+    }
+    return r.Error
+}
+
+func TestAuthentication(t *testing.T) {
+    _, server, ts := start(t)
+    defer ts.Close()
+    defer server.Close()
+    for _, auth := range []string{"", "Bearer wrong", "Basic secret"} {
+        req, _ := http.NewRequest("POST", ts.URL + "/rpc",
+            strings.NewReader("{}"))
+        if auth != "" { req.Header.Set("Authorization", auth) }
+        rsp, err := http.DefaultClient.Do(req)
+        if err != nil { t.Fatal(err) }
+        rsp.Body.Close()
+        if rsp.StatusCode != http.StatusUnauthorized {
+            t.Errorf("%q: expected 401, got %d", auth, rsp.StatusCode)
+        }
+    }
+    rsp, err := http.Get(ts.URL + "/rpc?token=" + testToken)
+    if err != nil { t.Fatal(err) }
+    rsp.Body.Close()
+    if rsp.StatusCode != http.StatusMethodNotAllowed {
+        t.Errorf("expected 405, got %d", rsp.StatusCode)
+    }
+    // An empty token doesn't disable authentication
+    for _, s := range []*Server{NewServer(server.ctx, ""),
+        NewUnauthenticatedServer(server.ctx)} {
+        rec := httptest.NewRecorder()
+        s.ServeHTTP(rec, httptest.NewRequest("GET", "/rpc?token=", nil))
+        s.Close()
+        expected := http.StatusMethodNotAllowed
+        if s.auth { expected = http.StatusUnauthorized }
+        if rec.Code != expected {
+            t.Errorf("expected %d, got %d", expected, rec.Code)
+        }
+    }
+}
+
+func TestHTTP(t *testing.T) {
+    backend, server, ts := start(t)
+    defer ts.Close()
+    reader := backend.AddReader("Virtual Reader 00")
+    backend.AddReader("Virtual Reader 01")
+    var readers []readerInfo
+    if err := call(t, ts.URL, "listReaders", nil, &readers); err != nil {
+        t.Fatal(err)
+    }
+    if len(readers) != 2 || readers[0].Card {
+        t.Errorf("unexpected readers %v", readers)
+    }
+    if err := call(t, ts.URL, "connect", nil, nil); err == nil ||
+        err.Code != RPC_INVALID_PARAMS {
+        t.Errorf("expected invalid params, got %v", err)
+    }
+    reader.Insert(mock.NewCard(testATR).
+        Rule("00 84 00 00 08", "61 08").
+        Rule("00 c0 00 00 08", "01 02 03 04 05 06 07 08 90 00").
+        Rule("00 84 00 00 02", "01 02 90 00"))
+    var session connectResult
+    if err := call(t, ts.URL, "connect", map[string]string{
+        "share": "exclusive", "protocol": "T=1"}, &session); err != nil {
+        t.Fatal(err)
+    }
+    if session.ATR != "3b80800101" || session.Protocol != "T=1" {
+        t.Errorf("unexpected session %+v", session)
+    }
+    if err := call(t, ts.URL, "connect", map[string]string{
+        "reader": reader.Name()}, nil); err == nil ||
+        err.Data != "SCARD_E_SHARING_VIOLATION" {
+        t.Errorf("expected sharing violation, got %v", err)
+    }
+    var res transmitResult
+    if err := call(t, ts.URL, "transmit", map[string]interface{}{
+        "session": session.Session, "apdu": "00 84 00 00 08",
+        "getResponse": true}, &res); err != nil {
+        t.Fatal(err)
+    }
+    if res.Response != "0102030405060708" || res.SW != "9000" {
+        t.Errorf("unexpected response %+v", res)
+    }
+    if err := call(t, ts.URL, "transmit", map[string]interface{}{
+        "session": session.Session, "apdu": "0084"}, nil); err == nil ||
+        err.Code != RPC_INVALID_PARAMS {
+        t.Errorf("expected invalid params, got %v", err)
+    }
+    if err := call(t, ts.URL, "release", map[string]string{
+        "session": session.Session, "disposition": "leave"},
+        nil); err != nil {
+        t.Fatal(err)
+    }
+    if err := call(t, ts.URL, "transmit", map[string]interface{}{
+        "session": session.Session, "apdu": "0084000002"}, nil); err == nil ||
+        err.Data != "SCARD_E_INVALID_HANDLE" {
+        t.Errorf("expected invalid handle, got %v", err)
+    }
+    if err := call(t, ts.URL, "frobnicate", nil, nil); err == nil ||
+        err.Code != RPC_METHOD_NOT_FOUND {
+        t.Errorf("expected method not found, got %v", err)
+    }
+    // Idle sessions are released
+    if err := call(t, ts.URL, "connect", nil, &session); err != nil {
+        t.Fatal(err)
+    }
+    server.expireSessions(time.Now())
+    if _, cards := backend.Open(); cards != 1 {
+        t.Errorf("%d cards open", cards)
+    }
+    server.expireSessions(time.Now().Add(DEFAULT_IDLE_TIMEOUT + time.Second))
+    if _, cards := backend.Open(); cards != 0 {
+        t.Errorf("%d cards open after expiry", cards)
+    }
+    server.Close()
+}
+
+// Minimal WebSocket client.
+type wsClient struct {
+    conn net.Conn
+    r *bufio.Reader
+    next int
+}
+
+func dial(t *testing.T, url string) *wsClient {
+    t.Helper()
+    conn, err := net.Dial("tcp", strings.TrimPrefix(url, "http://"))
+    if err != nil { t.Fatal(err) }
+    key := "dGhlIHNhbXBsZSBub25jZQ=="
+    fmt.Fprintf(conn, "GET /ws?token=%s HTTP/1.1\r\nHost: test\r\n" +
+        "Upgrade: websocket\r\nConnection: Upgrade\r\n" +
+        "Sec-WebSocket-Key: %s\r\nSec-WebSocket-Version: 13\r\n\r\n",
+        testToken, key)
+    r := bufio.NewReader(conn)
+    rsp, err := http.ReadResponse(r, nil)
+    if err != nil { t.Fatal(err) }
+    if rsp.StatusCode != http.StatusSwitchingProtocols ||
+        rsp.Header.Get("Sec-WebSocket-Accept") !=
+        "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+        t.Fatalf("unexpected handshake response %v", rsp)
+    }
+    return &wsClient{conn: conn, r: r}
+}
+
+// Send masked frame.
+func (c *wsClient) send(t *testing.T, opcode byte, fin bool, payload []byte) {
+    t.Helper()
+    b0 := opcode
+    if fin { b0 |= 0x80 }
+    frame := []byte{b0}
+    if len(payload) < 126 {
+        frame = append(frame, 0x80 | byte(len(payload)))
+    } else {
+        frame = append(frame, 0x80 | 126, byte(len(payload) >> 8),
+            byte(len(payload)))
+    }
+    mask := []byte{0x12, 0x34, 0x56, 0x78}
+    frame = append(frame, mask...)
+    for i, b := range payload {
+        frame = append(frame, b ^ mask[i % 4])
+    }
+    if _, err := c.conn.Write(frame); err != nil { t.Fatal(err) }
+}
+
+// Receive frame.
+func (c *wsClient) receive(t *testing.T) (byte, []byte) {
+    t.Helper()
+    c.conn.SetReadDeadline(time.Now().Add(5*time.Second))
+    var header [2]byte
+    if _, err := io.ReadFull(c.r, header[:]); err != nil { t.Fatal(err) }
+    length := int(header[1] & 0x7f)
+    if length == 126 {
+        var ext [2]byte
+        io.ReadFull(c.r, ext[:])
+        length = int(binary.BigEndian.Uint16(ext[:]))
+    }
+    payload := make([]byte, length)
+    if _, err := io.ReadFull(c.r, payload); err != nil { t.Fatal(err) }
+    return header[0] & 0x0f, payload
+}
+
+// Send request and return response, collecting notifications received
+// meanwhile.
+func (c *wsClient) call(t *testing.T, method string, params interface{},
+    events *[]Event) map[string]interface{} {
+    t.Helper()
+    c.next++
+    data, _ := json.Marshal(map[string]interface{}{"jsonrpc": "2.0",
+        "id": c.next, "method": method, "params": params})
+    c.send(t, WS_TEXT, true, data)
+    for {
+        msg := c.message(t)
+        if msg["id"] == float64(c.next) { return msg }
+        *events = append(*events, event(msg))
+    }
+}
+
+// Receive message and decode it.
+func (c *wsClient) message(t *testing.T) map[string]interface{} {
+    t.Helper()
+    opcode, payload := c.receive(t)
+    if opcode != WS_TEXT { t.Fatalf("unexpected opcode %d", opcode) }
+    msg := map[string]interface{}{}
+    if err := json.Unmarshal(payload, &msg); err != nil { t.Fatal(err) }
+    return msg
+}
+
+// Return event of notification.
+func event(msg map[string]interface{}) Event {
+    params, _ := msg["params"].(map[string]interface{})
+    typ, _ := params["type"].(string)
+    reader, _ := params["reader"].(string)
+    return Event{Type: typ, Reader: reader}
+}
+
+func TestWebSocket(t *testing.T) {
+    backend, server, ts := start(t)
+    defer ts.Close()
+    defer server.Close()
+    reader := backend.AddReader("Virtual Reader 00")
+    c := dial(t, ts.URL)
+    var events []Event
+    if rsp := c.call(t, "subscribe", nil, &events); rsp["error"] != nil {
+        t.Fatal(rsp["error"])
+    }
+    // Ping between fragments of a request
+    c.send(t, WS_TEXT, false, []byte(`{"jsonrpc": "2.0", "id": 100, `))
+    c.send(t, WS_PING, true, []byte("ping"))
+    c.send(t, WS_CONTINUATION, true, []byte(`"method": "listReaders"}`))
+    if opcode, payload := c.receive(t); opcode != WS_PONG ||
+        string(payload) != "ping" {
+        t.Errorf("unexpected frame %d %q", opcode, payload)
+    }
+    if msg := c.message(t); msg["id"] != float64(100) ||
+        msg["result"] == nil {
+        t.Errorf("unexpected response %v", msg)
+    }
+    time.Sleep(300*time.Millisecond)
+    reader.Insert(mock.NewCard(testATR).Rule("00 84 00 00 02",
+        "01 02 90 00"))
+    backend.AddReader("Virtual Reader 01")
+    for len(events) < 2 {
+        events = append(events, event(c.message(t)))
+    }
+    expected := map[Event]bool{{Type: "inserted", Reader: reader.Name()}: true,
+        {Type: "attached", Reader: "Virtual Reader 01"}: true}
+    for _, e := range events {
+        if !expected[e] { t.Errorf("unexpected event %v", e) }
+    }
+    rsp := c.call(t, "connect", map[string]string{"reader": reader.Name()},
+        &events)
+    result, _ := rsp["result"].(map[string]interface{})
+    session, _ := result["session"].(string)
+    if session == "" { t.Fatalf("unexpected response %v", rsp) }
+    // Transaction of the session blocks transmits of other clients
+    var other connectResult
+    if err := call(t, ts.URL, "connect", map[string]string{
+        "reader": reader.Name()}, &other); err != nil {
+        t.Fatal(err)
+    }
+    rsp = c.call(t, "beginTransaction", map[string]string{
+        "session": session}, &events)
+    if rsp["error"] != nil { t.Fatal(rsp["error"]) }
+    done := make(chan *Error)
+    go func() {
+        done <- call(t, ts.URL, "transmit", map[string]string{
+            "session": other.Session, "apdu": "0084000002"}, nil)
+    }()
+    select {
+        case <-done:
+            t.Fatal("transmit not blocked by transaction")
+        case <-time.After(50*time.Millisecond):
+    }
+    rsp = c.call(t, "transmit", map[string]string{"session": session,
+        "apdu": "0084000002"}, &events)
+    if result, _ := rsp["result"].(map[string]interface{}); result == nil ||
+        result["response"] != "0102" {
+        t.Errorf("unexpected response %v", rsp)
+    }
+    rsp = c.call(t, "endTransaction", map[string]string{"session": session},
+        &events)
+    if rsp["error"] != nil { t.Fatal(rsp["error"]) }
+    if err := <-done; err != nil { t.Error(err) }
+    // Closing the WebSocket releases its session, not the HTTP one
+    c.send(t, WS_CLOSE, true, []byte{0x03, 0xe8})
+    if opcode, _ := c.receive(t); opcode != WS_CLOSE {
+        t.Errorf("expected close, got %d", opcode)
+    }
+    c.conn.Close()
+    for i := 0; i < 100; i++ {
+        if _, cards := backend.Open(); cards == 1 { break }
+        time.Sleep(10*time.Millisecond)
+    }
+    if _, cards := backend.Open(); cards != 1 {
+        t.Errorf("%d cards open", cards)
+    }
+    server.Close()
+    if _, cards := backend.Open(); cards != 0 {
+        t.Errorf("%d cards open after close", cards)
+    }
+}
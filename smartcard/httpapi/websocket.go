@@ -0,0 +1,216 @@
+package httpapi
+
+import (
+    "bufio"
+    "crypto/sha1"
+    "encoding/base64"
+    "encoding/binary"
+    "fmt"
+    "io"
+    "net"
+    "net/http"
+    "strings"
+    "sync"
+)
+
+// WebSocket opcodes (RFC 6455)
+const (
+    WS_CONTINUATION = 0x0
+    WS_TEXT = 0x1
+    WS_BINARY = 0x2
+    WS_CLOSE = 0x8
+    WS_PING = 0x9
+    WS_PONG = 0xa
+)
+
+const (
+    wsGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+    // Maximum size of a received message
+    wsMaxMessage = 1 << 20
+)
+
+// Server side of a WebSocket connection. Only what the API needs is
+// implemented: text messages, fragmentation, ping and close.
+type wsConn struct {
+    conn net.Conn
+    r *bufio.Reader
+    writeMutex sync.Mutex
+    closed bool
+}
+
+// Return Sec-WebSocket-Accept value for key.
+func wsAccept(key string) string {
+    h := sha1.Sum([]byte(key + wsGUID))
+    return base64.StdEncoding.EncodeToString(h[:])
+}
+
+// Check if comma separated header contains token.
+func headerContains(h http.Header, name, token string) bool {
+    for _, v := range h[name] {
+        for _, t := range strings.Split(v, ",") {
+            if strings.EqualFold(strings.TrimSpace(t), token) {
+                return true
+            }
+        }
+    }
+    return false
+}
+
+// Upgrade HTTP request to WebSocket connection. On failure an error
+// response has been written.
+func wsUpgrade(w http.ResponseWriter, r *http.Request) (*wsConn, error) {
+    key := r.Header.Get("Sec-WebSocket-Key")
+    if r.Method != "GET" || key == "" ||
+        !headerContains(r.Header, "Connection", "upgrade") ||
+        !headerContains(r.Header, "Upgrade", "websocket") {
+        http.Error(w, "WebSocket upgrade required", http.StatusBadRequest)
+        return nil, fmt.Errorf("httpapi: not a WebSocket request")
+    }
+    if r.Header.Get("Sec-WebSocket-Version") != "13" {
+        w.Header().Set("Sec-WebSocket-Version", "13")
+        http.Error(w, "unsupported WebSocket version",
+            http.StatusUpgradeRequired)
+        return nil, fmt.Errorf("httpapi: unsupported WebSocket version")
+    }
+    hj, ok := w.(http.Hijacker)
+    if !ok {
+        http.Error(w, "WebSocket not supported", http.StatusInternalServerError)
+        return nil, fmt.Errorf("httpapi: connection cannot be hijacked")
+    }
+    conn, rw, err := hj.Hijack()
+    if err != nil { return nil, err }
+    _, err = fmt.Fprintf(rw, "HTTP/1.1 101 Switching Protocols\r\n" +
+        "Upgrade: websocket\r\nConnection: Upgrade\r\n" +
+        "Sec-WebSocket-Accept: %s\r\n\r\n", wsAccept(key))
+    if err == nil { err = rw.Flush() }
+    if err != nil {
+        conn.Close()
+        return nil, err
+    }
+    return &wsConn{conn: conn, r: rw.Reader}, nil
+}
+
+// Read frame and return FIN flag, opcode and unmasked payload.
+func (c *wsConn) readFrame() (bool, byte, []byte, error) {
+    var header [2]byte
+    if _, err := io.ReadFull(c.r, header[:]); err != nil {
+        return false, 0, nil, err
+    }
+    fin, opcode := header[0] & 0x80 != 0, header[0] & 0x0f
+    if header[0] & 0x70 != 0 {
+        return false, 0, nil, fmt.Errorf("httpapi: unsupported extension")
+    }
+    if header[1] & 0x80 == 0 {
+        return false, 0, nil, fmt.Errorf("httpapi: unmasked client frame")
+    }
+    length := uint64(header[1] & 0x7f)
+    switch length {
+        case 126:
+            var ext [2]byte
+            if _, err := io.ReadFull(c.r, ext[:]); err != nil {
+                return false, 0, nil, err
+            }
+            length = uint64(binary.BigEndian.Uint16(ext[:]))
+        case 127:
+            var ext [8]byte
+            if _, err := io.ReadFull(c.r, ext[:]); err != nil {
+                return false, 0, nil, err
+            }
+            length = binary.BigEndian.Uint64(ext[:])
+    }
+    if opcode >= WS_CLOSE && (length > 125 || !fin) {
+        return false, 0, nil, fmt.Errorf("httpapi: invalid control frame")
+    }
+    if length > wsMaxMessage {
+        return false, 0, nil, fmt.Errorf("httpapi: message too large")
+    }
+    var mask [4]byte
+    if _, err := io.ReadFull(c.r, mask[:]); err != nil {
+        return false, 0, nil, err
+    }
+    payload := make([]byte, length)
+    if _, err := io.ReadFull(c.r, payload); err != nil {
+        return false, 0, nil, err
+    }
+    for i := range payload {
+        payload[i] ^= mask[i % 4]
+    }
+    return fin, opcode, payload, nil
+}
+
+// Read next text or binary message, answering pings. Returns io.EOF when
+// the peer closes the connection.
+func (c *wsConn) ReadMessage() ([]byte, error) {
+    var message []byte
+    started := false
+    for {
+        fin, opcode, payload, err := c.readFrame()
+        if err != nil { return nil, err }
+        switch opcode {
+            case WS_CLOSE:
+                // Echo status code, if any
+                if len(payload) > 2 { payload = payload[:2] }
+                c.writeFrame(WS_CLOSE, payload)
+                c.Close()
+                return nil, io.EOF
+            case WS_PING:
+                if err := c.writeFrame(WS_PONG, payload); err != nil {
+                    return nil, err
+                }
+                continue
+            case WS_PONG:
+                continue
+            case WS_TEXT, WS_BINARY:
+                if started {
+                    return nil, fmt.Errorf("httpapi: unfinished message")
+                }
+                started = true
+            case WS_CONTINUATION:
+                if !started {
+                    return nil, fmt.Errorf("httpapi: unexpected continuation")
+                }
+            default:
+                return nil, fmt.Errorf("httpapi: unknown opcode %d", opcode)
+        }
+        if len(message) + len(payload) > wsMaxMessage {
+            return nil, fmt.Errorf("httpapi: message too large")
+        }
+        message = append(message, payload...)
+        if fin { return message, nil }
+    }
+}
+
+// Write unfragmented frame. Safe for concurrent use.
+func (c *wsConn) writeFrame(opcode byte, payload []byte) error {
+    c.writeMutex.Lock()
+    defer c.writeMutex.Unlock()
+    if c.closed { return fmt.Errorf("httpapi: connection closed") }
+    frame := make([]byte, 0, len(payload) + 10)
+    frame = append(frame, 0x80 | opcode)
+    switch n := len(payload); {
+        case n <= 125:
+            frame = append(frame, byte(n))
+        case n <= 0xffff:
+            frame = append(frame, 126, byte(n >> 8), byte(n))
+        default:
+            frame = append(frame, 127, 0, 0, 0, 0, byte(n >> 24),
+                byte(n >> 16), byte(n >> 8), byte(n))
+    }
+    frame = append(frame, payload...)
+    _, err := c.conn.Write(frame)
+    if opcode == WS_CLOSE { c.closed = true }
+    return err
+}
+
+// Send text message.
+func (c *wsConn) WriteText(message []byte) error {
+    return c.writeFrame(WS_TEXT, message)
+}
+
+// Close connection without closing handshake.
+func (c *wsConn) Close() error {
+    c.writeMutex.Lock()
+    c.closed = true
+    c.writeMutex.Unlock()
+    return c.conn.Close()
+}
@@ -0,0 +1,211 @@
+package smartcard
+
+import (
+    "crypto"
+    "crypto/ecdsa"
+    "crypto/ed25519"
+    "crypto/rsa"
+    "fmt"
+    "io"
+    "github.com/sf1/go-card/smartcard/SW"
+)
+
+// RSA padding performed by the card.
+const (
+    // The card performs the raw RSA private key operation on input of the
+    // modulus length; padding is added and removed by PrivateKey (e.g. PIV)
+    RSA_PADDING_NONE = iota
+    // The card pads a DigestInfo for signing and removes PKCS#1 v1.5
+    // padding after decryption (e.g. OpenPGP). PSS and OAEP are unsupported
+    RSA_PADDING_PKCS1
+)
+
+// Private key primitives supplied by a card applet. PrivateKey turns them
+// into a crypto.Signer and crypto.Decrypter.
+type CardKey interface {
+    // Return public key: *rsa.PublicKey, *ecdsa.PublicKey or
+    // ed25519.PublicKey.
+    Public() crypto.PublicKey
+    // Compute signature on the card. For RSA input is the encoded message
+    // or, with RSA_PADDING_PKCS1, the DigestInfo; for ECDSA the hash
+    // truncated to the length of the curve order; for Ed25519 the message.
+    // ECDSA signatures may be returned raw (r||s) or ASN.1 DER encoded.
+    SignRaw(input []byte) ([]byte, error)
+    // Decrypt RSA ciphertext, left padded to the modulus length, on the
+    // card. Returns the encoded message or, with RSA_PADDING_PKCS1, the
+    // plaintext.
+    DecryptRaw(ciphertext []byte) ([]byte, error)
+    // Verify PIN protecting the key.
+    VerifyPIN(pin string) error
+}
+
+// PIN handling for private key operations.
+type KeyAuth struct {
+    // PIN verified before each operation, if set
+    PIN string
+    // Called to obtain the PIN if the card requires verification
+    PINPrompt func() (string, error)
+}
+
+// Run card operation, verifying the PIN with verify before it if PIN is
+// set, and prompting for the PIN and retrying if the card reports the
+// security status not satisfied.
+func (a KeyAuth) Run(verify func(pin string) error,
+    op func() ([]byte, error)) ([]byte, error) {
+    if a.PIN != "" {
+        err := verify(a.PIN)
+        if err != nil { return nil, err }
+    }
+    result, err := op()
+    if err == nil || a.PINPrompt == nil {
+        return result, err
+    }
+    if err != SWError(SW.SECURITY_STATUS_NOT_SATISFIED) {
+        return nil, err
+    }
+    pin, err := a.PINPrompt()
+    if err != nil { return nil, err }
+    err = verify(pin)
+    if err != nil { return nil, err }
+    return op()
+}
+
+// Card-resident private key implementing crypto.Signer and, for RSA keys,
+// crypto.Decrypter, e.g. for crypto/tls client certificates or
+// x509.CreateCertificate.
+type PrivateKey struct {
+    key CardKey
+    padding int
+    auth KeyAuth
+}
+
+// Create private key from card primitives. padding is the RSA padding
+// performed by the card (RSA_PADDING_NONE or RSA_PADDING_PKCS1).
+func NewPrivateKey(key CardKey, padding int, auth KeyAuth) (*PrivateKey,
+    error) {
+    switch key.Public().(type) {
+        case *rsa.PublicKey, *ecdsa.PublicKey, ed25519.PublicKey:
+        default:
+            return nil, fmt.Errorf("unsupported public key type %T",
+                key.Public())
+    }
+    if padding != RSA_PADDING_NONE && padding != RSA_PADDING_PKCS1 {
+        return nil, fmt.Errorf("invalid RSA padding %d", padding)
+    }
+    return &PrivateKey{key: key, padding: padding, auth: auth}, nil
+}
+
+// Return public key.
+func (k *PrivateKey) Public() crypto.PublicKey {
+    return k.key.Public()
+}
+
+// Sign digest with PKCS#1 v1.5 or, if opts is *rsa.PSSOptions, PSS (RSA),
+// ECDSA or, for Ed25519 with opts.HashFunc() == 0, the message. ECDSA
+// signatures are returned ASN.1 DER encoded.
+func (k *PrivateKey) Sign(random io.Reader, digest []byte,
+    opts crypto.SignerOpts) ([]byte, error) {
+    var input []byte
+    var err error
+    switch pub := k.key.Public().(type) {
+        case *rsa.PublicKey:
+            input, err = k.rsaInput(pub, random, digest, opts)
+            if err != nil { return nil, err }
+        case *ecdsa.PublicKey:
+            size := (pub.Curve.Params().BitSize + 7) / 8
+            input = digest
+            if len(input) > size {
+                input = input[:size]
+            }
+        case ed25519.PublicKey:
+            if opts.HashFunc() != 0 {
+                return nil, fmt.Errorf("Ed25519 signs messages, not digests")
+            }
+            input = digest
+    }
+    sig, err := k.auth.Run(k.key.VerifyPIN, func() ([]byte, error) {
+        return k.key.SignRaw(input)
+    })
+    if err != nil { return nil, err }
+    if pub, ok := k.key.Public().(*ecdsa.PublicKey); ok {
+        return ecdsaSignature(sig, (pub.Curve.Params().N.BitLen() + 7) / 8)
+    }
+    return sig, nil
+}
+
+// Return input of the card's RSA signature operation.
+func (k *PrivateKey) rsaInput(pub *rsa.PublicKey, random io.Reader,
+    digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+    h := opts.HashFunc()
+    pss, isPSS := opts.(*rsa.PSSOptions)
+    if k.padding == RSA_PADDING_PKCS1 {
+        if isPSS { return nil, fmt.Errorf("PSS not supported by the card") }
+        if h == 0 { return digest, nil }
+        prefix, ok := digestInfoPrefixes[h]
+        if !ok { return nil, fmt.Errorf("unsupported hash function: %v", h) }
+        if len(digest) != h.Size() {
+            return nil, fmt.Errorf("invalid digest length: %d", len(digest))
+        }
+        return append(append([]byte{}, prefix...), digest...), nil
+    }
+    if isPSS {
+        saltLen := pss.SaltLength
+        switch saltLen {
+            case rsa.PSSSaltLengthEqualsHash:
+                saltLen = h.Size()
+            case rsa.PSSSaltLengthAuto:
+                saltLen = -1
+        }
+        return pssEncode(h, digest, saltLen, pub.N.BitLen(),
+            randReader(random))
+    }
+    return pkcs1v15Encode(h, digest, (pub.N.BitLen() + 7) / 8)
+}
+
+// Decrypt RSA ciphertext with PKCS#1 v1.5 (opts nil or
+// *rsa.PKCS1v15DecryptOptions) or OAEP (*rsa.OAEPOptions) padding. With
+// PKCS1v15DecryptOptions.SessionKeyLen set, invalid padding yields a random
+// key of that length instead of an error (RSA_PADDING_NONE only).
+func (k *PrivateKey) Decrypt(random io.Reader, ciphertext []byte,
+    opts crypto.DecrypterOpts) ([]byte, error) {
+    pub, ok := k.key.Public().(*rsa.PublicKey)
+    if !ok { return nil, fmt.Errorf("decryption requires an RSA key") }
+    size := (pub.N.BitLen() + 7) / 8
+    if len(ciphertext) > size {
+        return nil, fmt.Errorf("ciphertext too long")
+    }
+    switch opts.(type) {
+        case nil, *rsa.PKCS1v15DecryptOptions:
+        case *rsa.OAEPOptions:
+            if k.padding == RSA_PADDING_PKCS1 {
+                return nil, fmt.Errorf("OAEP not supported by the card")
+            }
+        default:
+            return nil, fmt.Errorf("unsupported decrypter options %T", opts)
+    }
+    c := make([]byte, size)
+    copy(c[size-len(ciphertext):], ciphertext)
+    em, err := k.auth.Run(k.key.VerifyPIN, func() ([]byte, error) {
+        return k.key.DecryptRaw(c)
+    })
+    if err != nil { return nil, err }
+    if k.padding == RSA_PADDING_PKCS1 { return em, nil }
+    if len(em) < size {
+        em = append(make([]byte, size - len(em)), em...)
+    }
+    switch o := opts.(type) {
+        case *rsa.OAEPOptions:
+            return oaepDecode(o.Hash, o.Label, em)
+        case *rsa.PKCS1v15DecryptOptions:
+            msg, err := pkcs1v15Decode(em)
+            if o.SessionKeyLen > 0 &&
+                (err != nil || len(msg) != o.SessionKeyLen) {
+                key := make([]byte, o.SessionKeyLen)
+                _, err := io.ReadFull(randReader(random), key)
+                if err != nil { return nil, err }
+                return key, nil
+            }
+            return msg, err
+    }
+    return pkcs1v15Decode(em)
+}
@@ -0,0 +1,252 @@
+package smartcard
+
+import (
+    "bytes"
+    "crypto"
+    "crypto/ecdsa"
+    "crypto/ed25519"
+    "crypto/elliptic"
+    "crypto/rand"
+    "crypto/rsa"
+    "crypto/sha256"
+    "crypto/x509"
+    "crypto/x509/pkix"
+    "encoding/asn1"
+    "math/big"
+    "testing"
+    "time"
+    "github.com/sf1/go-card/smartcard/SW"
+)
+
+var testRSA *rsa.PrivateKey
+
+func testRSAKey(t *testing.T) *rsa.PrivateKey {
+    if testRSA == nil {
+        var err error
+        testRSA, err = rsa.GenerateKey(rand.Reader, 2048)
+        if err != nil { t.Fatal(err) }
+    }
+    return testRSA
+}
+
+// Software card key with PIN "1234", which must be verified before each
+// operation.
+type softKey struct {
+    priv crypto.Signer
+    padding int
+    rawECDSA bool
+    verified bool
+    verifications int
+}
+
+func (k *softKey) Public() crypto.PublicKey {
+    return k.priv.Public()
+}
+
+func (k *softKey) VerifyPIN(pin string) error {
+    k.verifications++
+    if pin != "1234" { return SWError(SW.AUTH_FAILED | 2) }
+    k.verified = true
+    return nil
+}
+
+func (k *softKey) use() error {
+    if !k.verified { return SWError(SW.SECURITY_STATUS_NOT_SATISFIED) }
+    k.verified = false
+    return nil
+}
+
+func (k *softKey) SignRaw(input []byte) ([]byte, error) {
+    if err := k.use(); err != nil { return nil, err }
+    switch priv := k.priv.(type) {
+        case *rsa.PrivateKey:
+            if k.padding == RSA_PADDING_PKCS1 {
+                return rsa.SignPKCS1v15(nil, priv, 0, input)
+            }
+            return rawRSA(priv, input), nil
+        case *ecdsa.PrivateKey:
+            r, s, err := ecdsa.Sign(rand.Reader, priv, input)
+            if err != nil { return nil, err }
+            if !k.rawECDSA {
+                return asn1.Marshal(struct{ R, S *big.Int }{r, s})
+            }
+            size := (priv.Curve.Params().BitSize + 7) / 8
+            sig := make([]byte, 2*size)
+            r.FillBytes(sig[:size])
+            s.FillBytes(sig[size:])
+            return sig, nil
+    }
+    return k.priv.Sign(nil, input, crypto.Hash(0))
+}
+
+func (k *softKey) DecryptRaw(ciphertext []byte) ([]byte, error) {
+    if err := k.use(); err != nil { return nil, err }
+    priv := k.priv.(*rsa.PrivateKey)
+    if k.padding == RSA_PADDING_PKCS1 {
+        return rsa.DecryptPKCS1v15(nil, priv, ciphertext)
+    }
+    return rawRSA(priv, ciphertext), nil
+}
+
+func rawRSA(priv *rsa.PrivateKey, input []byte) []byte {
+    m := new(big.Int).Exp(new(big.Int).SetBytes(input), priv.D, priv.N)
+    return m.Bytes()
+}
+
+func TestRSASign(t *testing.T) {
+    priv := testRSAKey(t)
+    digest := sha256.Sum256([]byte("message"))
+    for _, padding := range []int{RSA_PADDING_NONE, RSA_PADDING_PKCS1} {
+        key, err := NewPrivateKey(&softKey{priv: priv, padding: padding},
+            padding, KeyAuth{PIN: "1234"})
+        if err != nil { t.Fatal(err) }
+        sig, err := key.Sign(nil, digest[:], crypto.SHA256)
+        if err != nil { t.Fatal(err) }
+        err = rsa.VerifyPKCS1v15(&priv.PublicKey, crypto.SHA256, digest[:], sig)
+        if err != nil { t.Errorf("padding %d: %s", padding, err) }
+        pss := &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash,
+            Hash: crypto.SHA256}
+        sig, err = key.Sign(nil, digest[:], pss)
+        if padding == RSA_PADDING_PKCS1 {
+            if err == nil { t.Error("PSS accepted with card padding") }
+            continue
+        }
+        if err != nil { t.Fatal(err) }
+        if err := rsa.VerifyPSS(&priv.PublicKey, crypto.SHA256, digest[:],
+            sig, pss); err != nil {
+            t.Error(err)
+        }
+        if _, err := key.Sign(nil, digest[:16], crypto.SHA256); err == nil {
+            t.Error("short digest accepted")
+        }
+    }
+}
+
+func TestRSADecrypt(t *testing.T) {
+    priv := testRSAKey(t)
+    msg := []byte("secret")
+    for _, padding := range []int{RSA_PADDING_NONE, RSA_PADDING_PKCS1} {
+        key, err := NewPrivateKey(&softKey{priv: priv, padding: padding},
+            padding, KeyAuth{PIN: "1234"})
+        if err != nil { t.Fatal(err) }
+        c, err := rsa.EncryptPKCS1v15(rand.Reader, &priv.PublicKey, msg)
+        if err != nil { t.Fatal(err) }
+        plain, err := key.Decrypt(nil, c, nil)
+        if err != nil || !bytes.Equal(plain, msg) {
+            t.Errorf("padding %d: PKCS#1 v1.5 decryption failed: %v", padding,
+                err)
+        }
+        label := []byte("label")
+        c, err = rsa.EncryptOAEP(sha256.New(), rand.Reader, &priv.PublicKey,
+            msg, label)
+        if err != nil { t.Fatal(err) }
+        opts := &rsa.OAEPOptions{Hash: crypto.SHA256, Label: label}
+        plain, err = key.Decrypt(nil, c, opts)
+        if padding == RSA_PADDING_PKCS1 {
+            if err == nil { t.Error("OAEP accepted with card padding") }
+            continue
+        }
+        if err != nil || !bytes.Equal(plain, msg) {
+            t.Errorf("OAEP decryption failed: %v", err)
+        }
+        // Invalid padding yields a random session key
+        session := &rsa.PKCS1v15DecryptOptions{SessionKeyLen: 16}
+        plain, err = key.Decrypt(nil, c, session)
+        if err != nil || len(plain) != 16 {
+            t.Errorf("expected random session key, got %X, %v", plain, err)
+        }
+    }
+}
+
+func TestECDSASign(t *testing.T) {
+    priv, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+    if err != nil { t.Fatal(err) }
+    digest := sha256.Sum256([]byte("message"))
+    for _, raw := range []bool{false, true} {
+        key, err := NewPrivateKey(&softKey{priv: priv, rawECDSA: raw},
+            RSA_PADDING_NONE, KeyAuth{PIN: "1234"})
+        if err != nil { t.Fatal(err) }
+        sig, err := key.Sign(nil, digest[:], crypto.SHA256)
+        if err != nil { t.Fatal(err) }
+        if !ecdsa.VerifyASN1(&priv.PublicKey, digest[:], sig) {
+            t.Errorf("invalid signature (raw %v)", raw)
+        }
+    }
+    key, _ := NewPrivateKey(&softKey{priv: priv}, RSA_PADDING_NONE,
+        KeyAuth{PIN: "1234"})
+    if _, err := key.Decrypt(nil, digest[:], nil); err == nil {
+        t.Error("ECDSA decryption accepted")
+    }
+}
+
+func TestEd25519Sign(t *testing.T) {
+    pub, priv, err := ed25519.GenerateKey(rand.Reader)
+    if err != nil { t.Fatal(err) }
+    key, err := NewPrivateKey(&softKey{priv: priv}, RSA_PADDING_NONE,
+        KeyAuth{PIN: "1234"})
+    if err != nil { t.Fatal(err) }
+    msg := []byte("message")
+    sig, err := key.Sign(nil, msg, crypto.Hash(0))
+    if err != nil { t.Fatal(err) }
+    if !ed25519.Verify(pub, msg, sig) { t.Error("invalid signature") }
+    if _, err := key.Sign(nil, msg, crypto.SHA256); err == nil {
+        t.Error("Ed25519 digest signature accepted")
+    }
+}
+
+func TestKeyAuth(t *testing.T) {
+    priv := testRSAKey(t)
+    digest := sha256.Sum256([]byte("message"))
+    card := &softKey{priv: priv}
+    prompts := 0
+    key, _ := NewPrivateKey(card, RSA_PADDING_NONE, KeyAuth{
+        PINPrompt: func() (string, error) {
+            prompts++
+            return "1234", nil
+        }})
+    for i := 0; i < 2; i++ {
+        if _, err := key.Sign(nil, digest[:], crypto.SHA256); err != nil {
+            t.Fatal(err)
+        }
+    }
+    if prompts != 2 || card.verifications != 2 {
+        t.Errorf("unexpected %d prompts, %d verifications", prompts,
+            card.verifications)
+    }
+    key, _ = NewPrivateKey(card, RSA_PADDING_NONE, KeyAuth{})
+    if _, err := key.Sign(nil, digest[:],
+        crypto.SHA256); err != SWError(SW.SECURITY_STATUS_NOT_SATISFIED) {
+        t.Errorf("expected security status not satisfied, got %v", err)
+    }
+    key, _ = NewPrivateKey(card, RSA_PADDING_NONE, KeyAuth{PIN: "0000"})
+    if _, err := key.Sign(nil, digest[:],
+        crypto.SHA256); err != SWError(0x63c2) {
+        t.Errorf("expected wrong PIN, got %v", err)
+    }
+    if _, err := NewPrivateKey(card, 2, KeyAuth{}); err == nil {
+        t.Error("invalid padding accepted")
+    }
+}
+
+func TestCreateCertificate(t *testing.T) {
+    priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+    if err != nil { t.Fatal(err) }
+    key, err := NewPrivateKey(&softKey{priv: priv, rawECDSA: true},
+        RSA_PADDING_NONE, KeyAuth{PIN: "1234"})
+    if err != nil { t.Fatal(err) }
+    template := &x509.Certificate{
+        SerialNumber: big.NewInt(1),
+        Subject: pkix.Name{CommonName: "card"},
+        NotBefore: time.Now(),
+        NotAfter: time.Now().Add(time.Hour),
+    }
+    der, err := x509.CreateCertificate(rand.Reader, template, template,
+        key.Public(), key)
+    if err != nil { t.Fatal(err) }
+    cert, err := x509.ParseCertificate(der)
+    if err != nil { t.Fatal(err) }
+    if err := cert.CheckSignature(cert.SignatureAlgorithm,
+        cert.RawTBSCertificate, cert.Signature); err != nil {
+        t.Error(err)
+    }
+}
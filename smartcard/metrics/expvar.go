@@ -0,0 +1,179 @@
+package metrics
+
+import (
+    "bytes"
+    "expvar"
+    "fmt"
+    "strconv"
+    "sync"
+    "time"
+)
+
+// Upper bounds in seconds of latency histogram buckets.
+var Buckets = []float64{
+    0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5,
+}
+
+// Latency histogram with cumulative bucket counts as in Prometheus,
+// published as {"buckets": {"0.001": n, ..., "+Inf": n}, "count": n,
+// "sum": seconds}.
+type Histogram struct {
+    mutex sync.Mutex
+    counts []uint64
+    count uint64
+    sum float64
+}
+
+func newHistogram() *Histogram {
+    return &Histogram{counts: make([]uint64, len(Buckets))}
+}
+
+// Add observation.
+func (h *Histogram) Observe(d time.Duration) {
+    s := d.Seconds()
+    h.mutex.Lock()
+    defer h.mutex.Unlock()
+    for i, bound := range Buckets {
+        if s <= bound { h.counts[i]++ }
+    }
+    h.count++
+    h.sum += s
+}
+
+// Return number of observations and their sum in seconds.
+func (h *Histogram) Count() (uint64, float64) {
+    h.mutex.Lock()
+    defer h.mutex.Unlock()
+    return h.count, h.sum
+}
+
+// Return JSON form.
+func (h *Histogram) String() string {
+    h.mutex.Lock()
+    defer h.mutex.Unlock()
+    var buffer bytes.Buffer
+    buffer.WriteString(`{"buckets": {`)
+    for i, bound := range Buckets {
+        buffer.WriteString(fmt.Sprintf(`"%s": %d, `,
+            strconv.FormatFloat(bound, 'g', -1, 64), h.counts[i]))
+    }
+    buffer.WriteString(fmt.Sprintf(`"+Inf": %d}, "count": %d, "sum": %s}`,
+        h.count, h.count, strconv.FormatFloat(h.sum, 'g', -1, 64)))
+    return buffer.String()
+}
+
+// Metrics of one reader.
+type readerVars struct {
+    vars *expvar.Map
+    transmits *expvar.Int
+    transmitErrors *expvar.Map
+    statusWords *expvar.Map
+    transmitSeconds *Histogram
+    connects *expvar.Int
+    connectErrors *expvar.Map
+    connectSeconds *Histogram
+    disconnects *expvar.Int
+    disconnectErrors *expvar.Map
+    inserts *expvar.Int
+    removes *expvar.Int
+}
+
+// Metrics published with expvar as map of reader name to
+//
+//     {"transmits": n, "transmit_errors": {"SCARD_W_REMOVED_CARD": n},
+//      "status_words": {"9000": n, "6982": n},
+//      "transmit_seconds": histogram, "connects": n,
+//      "connect_errors": {...}, "connect_seconds": histogram,
+//      "disconnects": n, "disconnect_errors": {...}, "inserts": n,
+//      "removes": n}
+type Expvar struct {
+    mutex sync.Mutex
+    vars *expvar.Map
+    readers map[string]*readerVars
+}
+
+// Create metrics published under name, or unpublished if name is empty.
+// Panics if name is already published.
+func NewExpvar(name string) *Expvar {
+    m := &Expvar{readers: map[string]*readerVars{}}
+    if name != "" {
+        m.vars = expvar.NewMap(name)
+    } else {
+        m.vars = new(expvar.Map).Init()
+    }
+    return m
+}
+
+// Return map of reader metrics.
+func (m *Expvar) Map() *expvar.Map {
+    return m.vars
+}
+
+// Return metrics of reader, creating them on first use.
+func (m *Expvar) reader(name string) *readerVars {
+    m.mutex.Lock()
+    defer m.mutex.Unlock()
+    r, ok := m.readers[name]
+    if ok { return r }
+    r = &readerVars{
+        vars: new(expvar.Map).Init(),
+        transmits: new(expvar.Int),
+        transmitErrors: new(expvar.Map).Init(),
+        statusWords: new(expvar.Map).Init(),
+        transmitSeconds: newHistogram(),
+        connects: new(expvar.Int),
+        connectErrors: new(expvar.Map).Init(),
+        connectSeconds: newHistogram(),
+        disconnects: new(expvar.Int),
+        disconnectErrors: new(expvar.Map).Init(),
+        inserts: new(expvar.Int),
+        removes: new(expvar.Int),
+    }
+    r.vars.Set("transmits", r.transmits)
+    r.vars.Set("transmit_errors", r.transmitErrors)
+    r.vars.Set("status_words", r.statusWords)
+    r.vars.Set("transmit_seconds", r.transmitSeconds)
+    r.vars.Set("connects", r.connects)
+    r.vars.Set("connect_errors", r.connectErrors)
+    r.vars.Set("connect_seconds", r.connectSeconds)
+    r.vars.Set("disconnects", r.disconnects)
+    r.vars.Set("disconnect_errors", r.disconnectErrors)
+    r.vars.Set("inserts", r.inserts)
+    r.vars.Set("removes", r.removes)
+    m.readers[name] = r
+    m.vars.Set(name, r.vars)
+    return r
+}
+
+func (m *Expvar) Transmit(reader string, d time.Duration, sw uint16,
+    err error) {
+    r := m.reader(reader)
+    r.transmits.Add(1)
+    r.transmitSeconds.Observe(d)
+    if err != nil {
+        r.transmitErrors.Add(ErrorCode(err), 1)
+    } else if sw != 0 {
+        r.statusWords.Add(fmt.Sprintf("%04X", sw), 1)
+    }
+}
+
+func (m *Expvar) Connect(reader string, d time.Duration, err error) {
+    r := m.reader(reader)
+    r.connects.Add(1)
+    r.connectSeconds.Observe(d)
+    if err != nil { r.connectErrors.Add(ErrorCode(err), 1) }
+}
+
+func (m *Expvar) Disconnect(reader string, err error) {
+    r := m.reader(reader)
+    r.disconnects.Add(1)
+    if err != nil { r.disconnectErrors.Add(ErrorCode(err), 1) }
+}
+
+func (m *Expvar) CardInserted(reader string) {
+    m.reader(reader).inserts.Add(1)
+}
+
+func (m *Expvar) CardRemoved(reader string) {
+    m.reader(reader).removes.Add(1)
+}
@@ -0,0 +1,108 @@
+/*
+Package metrics collects per-reader metrics of card operations: transmits,
+errors by PC/SC code and status word, Transmit and Connect latencies, and
+card inserts and removals.
+
+Metrics are reported to a Metrics implementation, e.g. Expvar, which
+publishes them with expvar. Other systems such as Prometheus or
+OpenTelemetry plug in by implementing Metrics; spans for card operations
+are created by the separate module smartcard/metrics/otelspan, so this
+package has no dependencies.
+
+Example:
+
+    m := metrics.NewExpvar("smartcard")
+    ctx.SetObserver(metrics.NewObserver(m))
+    stop := make(chan struct{})
+    go metrics.Watch(ctx, m, stop)
+*/
+package metrics
+
+import (
+    "fmt"
+    "regexp"
+    "time"
+    "github.com/sf1/go-card/smartcard"
+    "github.com/sf1/go-card/smartcard/pcsc"
+)
+
+// Receiver of card metrics. Implementations must be safe for concurrent
+// use.
+type Metrics interface {
+    // Transmit to card in reader with duration and status word (0 if the
+    // response has none, or on error)
+    Transmit(reader string, d time.Duration, sw uint16, err error)
+    // Connect to card in reader with duration
+    Connect(reader string, d time.Duration, err error)
+    Disconnect(reader string, err error)
+    CardInserted(reader string)
+    CardRemoved(reader string)
+}
+
+type observer struct {
+    m Metrics
+}
+
+// Return observer reporting the card events of a context to m.
+func NewObserver(m Metrics) smartcard.Observer {
+    return observer{m}
+}
+
+func (o observer) Observe(e *smartcard.Event) {
+    switch e.Kind {
+        case smartcard.EVENT_CONNECT:
+            o.m.Connect(e.Reader, e.Duration, e.Err)
+        case smartcard.EVENT_DISCONNECT:
+            o.m.Disconnect(e.Reader, e.Err)
+        case smartcard.EVENT_TRANSMIT:
+            var sw uint16
+            if n := len(e.Response); e.Err == nil && n >= 2 {
+                sw = uint16(e.Response[n-2]) << 8 | uint16(e.Response[n-1])
+            }
+            o.m.Transmit(e.Reader, e.Duration, sw, e.Err)
+    }
+}
+
+var errorCodePattern = regexp.MustCompile(`SCARD_[EFWP]_[A-Z_]+`)
+
+// Return PC/SC code name of err, e.g. "SCARD_W_REMOVED_CARD", "" if err is
+// nil, or "OTHER" for errors not from PC/SC.
+func ErrorCode(err error) string {
+    if err == nil { return "" }
+    if e, ok := err.(pcsc.Error); ok {
+        if code := errorCodePattern.FindString(e.Error()); code != "" {
+            return code
+        }
+        return fmt.Sprintf("0x%08X", uint32(e))
+    }
+    // pcsc-lite client errors carry the code name in the message
+    if code := errorCodePattern.FindString(err.Error()); code != "" {
+        return code
+    }
+    return "OTHER"
+}
+
+// Report card inserts and removals in the readers of ctx to m until stop
+// is closed. Reader states are polled every 250 ms.
+func Watch(ctx *smartcard.Context, m Metrics, stop <-chan struct{}) error {
+    present := map[string]bool{}
+    first := true
+    for {
+        readers, err := ctx.ListReadersWithCard()
+        if err != nil { return err }
+        current := map[string]bool{}
+        for _, r := range readers {
+            current[r.Name()] = true
+            if !present[r.Name()] && !first { m.CardInserted(r.Name()) }
+        }
+        for name := range present {
+            if !current[name] { m.CardRemoved(name) }
+        }
+        present, first = current, false
+        select {
+            case <-stop:
+                return nil
+            case <-time.After(250*time.Millisecond):
+        }
+    }
+}
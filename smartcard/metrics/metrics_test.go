@@ -0,0 +1,139 @@
+package metrics
+
+import (
+    "encoding/json"
+    "fmt"
+    "testing"
+    "time"
+    "github.com/sf1/go-card/smartcard"
+    "github.com/sf1/go-card/smartcard/mock"
+    "github.com/sf1/go-card/smartcard/pcsc"
+)
+
+func TestErrorCode(t *testing.T) {
+    tests := []struct {
+        err error
+        code string
+    }{
+        {nil, ""},
+        {pcsc.Error(pcsc.SCARD_E_TIMEOUT), "SCARD_E_TIMEOUT"},
+        {pcsc.Error(0x80100099), "0x80100099"},
+        {fmt.Errorf("transmission failed: SCARD_W_REMOVED_CARD"),
+            "SCARD_W_REMOVED_CARD"},
+        {fmt.Errorf("mock: unexpected command"), "OTHER"},
+    }
+    for _, test := range tests {
+        if code := ErrorCode(test.err); code != test.code {
+            t.Errorf("%v: unexpected code %q", test.err, code)
+        }
+    }
+}
+
+// Backend signalling reader state polls.
+type pollingBackend struct {
+    *mock.Backend
+    polled chan struct{}
+}
+
+func (b pollingBackend) GetStatusChange(ctx uintptr, timeout uint32,
+    states []smartcard.ReaderState) error {
+    err := b.Backend.GetStatusChange(ctx, timeout, states)
+    select {
+        case b.polled <- struct{}{}:
+        default:
+    }
+    return err
+}
+
+// Metrics signalling card inserts and removals.
+type watchedExpvar struct {
+    *Expvar
+    events chan string
+}
+
+func (m watchedExpvar) CardInserted(reader string) {
+    m.Expvar.CardInserted(reader)
+    m.events <- "inserted"
+}
+
+func (m watchedExpvar) CardRemoved(reader string) {
+    m.Expvar.CardRemoved(reader)
+    m.events <- "removed"
+}
+
+// Wait for card event of m.
+func waitEvent(t *testing.T, m watchedExpvar, expected string) {
+    t.Helper()
+    select {
+        case event := <-m.events:
+            if event != expected { t.Fatalf("unexpected event %s", event) }
+        case <-time.After(5*time.Second):
+            t.Fatalf("card %s not reported", expected)
+    }
+}
+
+func TestExpvar(t *testing.T) {
+    backend := pollingBackend{mock.NewBackend(), make(chan struct{})}
+    reader := backend.AddReader("Virtual Reader 00")
+    ctx, err := smartcard.EstablishContextWithBackend(backend)
+    if err != nil { t.Fatal(err) }
+    defer ctx.Release()
+    m := watchedExpvar{NewExpvar(""), make(chan string)}
+    ctx.SetObserver(NewObserver(m))
+    readers, _ := ctx.ListReaders()
+    if _, err := readers[0].Connect(); err == nil {
+        t.Fatal("connected to empty reader")
+    }
+    stop := make(chan struct{})
+    done := make(chan error)
+    go func() { done <- Watch(ctx, m, stop) }()
+    // Insert after the first poll
+    <-backend.polled
+    reader.Insert(mock.NewCard(mock.Hex("3b 80 80 01 01")).
+        Rule("00 a4 *", "90 00").Rule("00 b0 *", "6b 00"))
+    card, err := readers[0].Connect()
+    if err != nil { t.Fatal(err) }
+    for _, cmd := range []string{"00 a4 04 00 00", "00 a4 04 00 00",
+        "00 b0 00 00 00", "00 20 00 81 00"} {
+        card.Transmit(mock.Hex(cmd))
+    }
+    waitEvent(t, m, "inserted")
+    reader.Remove()
+    card.Transmit(mock.Hex("00 a4 04 00 00"))
+    card.Disconnect()
+    card.Disconnect()
+    waitEvent(t, m, "removed")
+    close(stop)
+    if err := <-done; err != nil { t.Error(err) }
+    var vars map[string]struct {
+        Transmits int `json:"transmits"`
+        TransmitErrors map[string]int `json:"transmit_errors"`
+        StatusWords map[string]int `json:"status_words"`
+        TransmitSeconds struct {
+            Buckets map[string]int `json:"buckets"`
+            Count int `json:"count"`
+        } `json:"transmit_seconds"`
+        Connects int `json:"connects"`
+        ConnectErrors map[string]int `json:"connect_errors"`
+        Disconnects int `json:"disconnects"`
+        DisconnectErrors map[string]int `json:"disconnect_errors"`
+        Inserts int `json:"inserts"`
+        Removes int `json:"removes"`
+    }
+    if err := json.Unmarshal([]byte(m.Map().String()), &vars); err != nil {
+        t.Fatalf("%s: %s", err, m.Map())
+    }
+    r, ok := vars["Virtual Reader 00"]
+    if !ok ||
+        r.Transmits != 5 ||
+        fmt.Sprint(r.TransmitErrors) != "map[OTHER:1 SCARD_W_REMOVED_CARD:1]" ||
+        fmt.Sprint(r.StatusWords) != "map[6B00:1 9000:2]" ||
+        r.TransmitSeconds.Count != 5 || r.TransmitSeconds.Buckets["+Inf"] != 5 ||
+        r.Connects != 2 ||
+        fmt.Sprint(r.ConnectErrors) != "map[SCARD_E_NO_SMARTCARD:1]" ||
+        r.Disconnects != 2 ||
+        fmt.Sprint(r.DisconnectErrors) != "map[SCARD_E_INVALID_HANDLE:1]" ||
+        r.Inserts != 1 || r.Removes != 1 {
+        t.Errorf("unexpected metrics %s", m.Map())
+    }
+}
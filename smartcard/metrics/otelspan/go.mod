@@ -0,0 +1,17 @@
+module github.com/sf1/go-card/smartcard/metrics/otelspan
+
+go 1.21
+
+require (
+	github.com/sf1/go-card v0.0.0-20261019174611-c9fa187a70f0
+	go.opentelemetry.io/otel v1.24.0
+	go.opentelemetry.io/otel/sdk v1.24.0
+	go.opentelemetry.io/otel/trace v1.24.0
+)
+
+require (
+	github.com/go-logr/logr v1.4.1 // indirect
+	github.com/go-logr/stdr v1.2.2 // indirect
+	go.opentelemetry.io/otel/metric v1.24.0 // indirect
+	golang.org/x/sys v0.17.0 // indirect
+)
@@ -0,0 +1,87 @@
+/*
+Package otelspan creates OpenTelemetry spans for card operations. It is a
+separate module so that go-card itself does not depend on OpenTelemetry.
+
+Spans are named "smartcard.connect", "smartcard.transmit" and
+"smartcard.disconnect" and carry the reader name, the command header
+(CLA INS P1 P2, never command data) and the status word. Failed operations
+have error status.
+
+Example:
+
+    tracer := otel.Tracer("github.com/sf1/go-card")
+    ctx.SetObserver(otelspan.NewObserver(tracer))
+*/
+package otelspan
+
+import (
+    "context"
+    "fmt"
+    "time"
+    "go.opentelemetry.io/otel/attribute"
+    "go.opentelemetry.io/otel/codes"
+    "go.opentelemetry.io/otel/trace"
+    "github.com/sf1/go-card/smartcard"
+)
+
+// Observer creating a span per card event.
+type Observer struct {
+    tracer trace.Tracer
+    parent context.Context
+}
+
+// Create observer starting root spans with tracer.
+func NewObserver(tracer trace.Tracer) *Observer {
+    return &Observer{tracer, context.Background()}
+}
+
+// Return observer starting spans as children of the span in ctx, e.g. of
+// the request being served.
+func (o *Observer) WithContext(ctx context.Context) *Observer {
+    return &Observer{o.tracer, ctx}
+}
+
+// Record span for event. Spans end when the observer is called and start
+// the event's duration before.
+func (o *Observer) Observe(e *smartcard.Event) {
+    end := time.Now()
+    attrs := []attribute.KeyValue{attribute.String("smartcard.reader",
+        e.Reader)}
+    var name string
+    switch e.Kind {
+        case smartcard.EVENT_CONNECT:
+            name = "smartcard.connect"
+            if e.Err == nil {
+                attrs = append(attrs,
+                    attribute.String("smartcard.atr", e.ATR.String()),
+                    attribute.Int64("smartcard.protocol",
+                        int64(e.Protocol)))
+            }
+        case smartcard.EVENT_DISCONNECT:
+            name = "smartcard.disconnect"
+            attrs = append(attrs, attribute.Int64("smartcard.disposition",
+                int64(e.Disposition)))
+        case smartcard.EVENT_TRANSMIT:
+            name = "smartcard.transmit"
+            if len(e.Command) >= 4 {
+                attrs = append(attrs, attribute.String("smartcard.command",
+                    fmt.Sprintf("%X", e.Command[:4])))
+            }
+            if n := len(e.Response); e.Err == nil && n >= 2 {
+                attrs = append(attrs, attribute.String("smartcard.sw",
+                    fmt.Sprintf("%X", e.Response[n-2:])),
+                    attribute.Int("smartcard.response.length", n - 2))
+            }
+        default:
+            return
+    }
+    _, span := o.tracer.Start(o.parent, name,
+        trace.WithTimestamp(end.Add(-e.Duration)),
+        trace.WithSpanKind(trace.SpanKindClient),
+        trace.WithAttributes(attrs...))
+    if e.Err != nil {
+        span.RecordError(e.Err)
+        span.SetStatus(codes.Error, e.Err.Error())
+    }
+    span.End(trace.WithTimestamp(end))
+}
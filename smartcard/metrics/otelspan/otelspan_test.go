@@ -0,0 +1,95 @@
+package otelspan
+
+import (
+    "context"
+    "errors"
+    "testing"
+    "time"
+    "go.opentelemetry.io/otel/attribute"
+    "go.opentelemetry.io/otel/codes"
+    sdktrace "go.opentelemetry.io/otel/sdk/trace"
+    "go.opentelemetry.io/otel/sdk/trace/tracetest"
+    "github.com/sf1/go-card/smartcard"
+)
+
+// Return attributes of span as map.
+func attributes(span sdktrace.ReadOnlySpan) map[attribute.Key]string {
+    attrs := map[attribute.Key]string{}
+    for _, kv := range span.Attributes() {
+        attrs[kv.Key] = kv.Value.Emit()
+    }
+    return attrs
+}
+
+func TestObserver(t *testing.T) {
+    recorder := tracetest.NewSpanRecorder()
+    provider := sdktrace.NewTracerProvider(
+        sdktrace.WithSpanProcessor(recorder))
+    tracer := provider.Tracer("test")
+    parent, root := tracer.Start(context.Background(), "request")
+    o := NewObserver(tracer).WithContext(parent)
+    o.Observe(&smartcard.Event{Kind: smartcard.EVENT_CONNECT,
+        Reader: "Reader 0", ATR: smartcard.ATR{0x3b, 0x00}, Protocol: 2,
+        Duration: time.Millisecond})
+    o.Observe(&smartcard.Event{Kind: smartcard.EVENT_TRANSMIT,
+        Reader: "Reader 0", Command: []byte{0x00, 0xb0, 0x00, 0x00, 0x02},
+        Response: []byte{0x01, 0x02, 0x90, 0x00}})
+    o.Observe(&smartcard.Event{Kind: smartcard.EVENT_TRANSMIT,
+        Reader: "Reader 0", Command: []byte{0x00, 0x84, 0x00, 0x00, 0x08},
+        Err: errors.New("card removed")})
+    o.Observe(&smartcard.Event{Kind: smartcard.EVENT_DISCONNECT,
+        Reader: "Reader 0", Disposition: 1})
+    root.End()
+    spans := recorder.Ended()
+    if len(spans) != 5 { t.Fatalf("expected 5 spans, got %d", len(spans)) }
+    for i, expected := range []struct {
+        name string
+        attrs map[attribute.Key]string
+        status codes.Code
+    }{
+        {"smartcard.connect", map[attribute.Key]string{
+            "smartcard.reader": "Reader 0", "smartcard.atr": "3b00",
+            "smartcard.protocol": "2"}, codes.Unset},
+        {"smartcard.transmit", map[attribute.Key]string{
+            "smartcard.reader": "Reader 0", "smartcard.command": "00B00000",
+            "smartcard.sw": "9000", "smartcard.response.length": "2"},
+            codes.Unset},
+        {"smartcard.transmit", map[attribute.Key]string{
+            "smartcard.reader": "Reader 0", "smartcard.command": "00840000"},
+            codes.Error},
+        {"smartcard.disconnect", map[attribute.Key]string{
+            "smartcard.reader": "Reader 0", "smartcard.disposition": "1"},
+            codes.Unset},
+    } {
+        span := spans[i]
+        if span.Name() != expected.name {
+            t.Errorf("span %d: unexpected name %s", i, span.Name())
+        }
+        attrs := attributes(span)
+        if len(attrs) != len(expected.attrs) {
+            t.Errorf("%s: unexpected attributes %v", span.Name(), attrs)
+        }
+        for k, v := range expected.attrs {
+            if attrs[k] != v {
+                t.Errorf("%s: %s is %q, want %q", span.Name(), k, attrs[k], v)
+            }
+        }
+        if span.Status().Code != expected.status {
+            t.Errorf("%s: unexpected status %v", span.Name(), span.Status())
+        }
+        if span.Parent().SpanID() != root.SpanContext().SpanID() {
+            t.Errorf("%s: not a child of the request span", span.Name())
+        }
+        if span.SpanKind().String() != "client" {
+            t.Errorf("%s: unexpected kind %s", span.Name(), span.SpanKind())
+        }
+    }
+    if d := spans[0].EndTime().Sub(spans[0].StartTime()); d < time.Millisecond {
+        t.Errorf("unexpected duration %s", d)
+    }
+    events := spans[2].Events()
+    if status := spans[2].Status(); status.Description != "card removed" ||
+        len(events) != 1 || events[0].Name != "exception" {
+        t.Errorf("error not recorded: %v, %v", status, events)
+    }
+}
@@ -0,0 +1,424 @@
+package mock
+
+import (
+    "sync"
+    "time"
+    "github.com/sf1/go-card/smartcard"
+    "github.com/sf1/go-card/smartcard/pcsc"
+)
+
+// Virtual card reader of a Backend.
+type Reader struct {
+    backend *Backend
+    name string
+    card *Card
+    events uint32
+    attribs map[uint32][]byte
+    control func(code uint32, data []byte) ([]byte, error)
+    connections int
+    exclusive bool
+    transaction uintptr
+}
+
+// Return reader name.
+func (r *Reader) Name() string {
+    return r.name
+}
+
+// Insert card, replacing any card in the reader.
+func (r *Reader) Insert(card *Card) {
+    b := r.backend
+    b.mutex.Lock()
+    defer b.mutex.Unlock()
+    b.removeCard(r)
+    r.card = card
+    r.events++
+    b.notify()
+}
+
+// Remove card. Connections to it fail with SCARD_W_REMOVED_CARD.
+func (r *Reader) Remove() {
+    b := r.backend
+    b.mutex.Lock()
+    defer b.mutex.Unlock()
+    b.removeCard(r)
+    b.notify()
+}
+
+// Return inserted card, or nil.
+func (r *Reader) Card() *Card {
+    r.backend.mutex.Lock()
+    defer r.backend.mutex.Unlock()
+    return r.card
+}
+
+// Set reader attribute returned by GetAttrib. SCARD_ATTR_ATR_STRING is
+// provided by the card.
+func (r *Reader) SetAttrib(attr uint32, value []byte) {
+    r.backend.mutex.Lock()
+    defer r.backend.mutex.Unlock()
+    r.attribs[attr] = value
+}
+
+// Handle control commands with fn. By default control commands fail with
+// SCARD_E_UNSUPPORTED_FEATURE.
+func (r *Reader) HandleControl(fn func(code uint32, data []byte) ([]byte,
+    error)) {
+    r.backend.mutex.Lock()
+    defer r.backend.mutex.Unlock()
+    r.control = fn
+}
+
+// Connection to a card.
+type connection struct {
+    reader *Reader
+    card *Card
+    protocol uint32
+    exclusive bool
+}
+
+// Virtual reader backend implementing smartcard.Backend. Reader state
+// changes wake up GetStatusChange; the upper 16 bits of event states count
+// card insertions and removals.
+type Backend struct {
+    mutex sync.Mutex
+    changed chan struct{}
+    released *sync.Cond
+    readers []*Reader
+    contexts map[uintptr]bool
+    cards map[uintptr]*connection
+    next uintptr
+}
+
+// Create backend without readers.
+func NewBackend() *Backend {
+    b := &Backend{
+        changed: make(chan struct{}),
+        contexts: map[uintptr]bool{},
+        cards: map[uintptr]*connection{},
+    }
+    b.released = sync.NewCond(&b.mutex)
+    return b
+}
+
+// Add reader.
+func (b *Backend) AddReader(name string) *Reader {
+    b.mutex.Lock()
+    defer b.mutex.Unlock()
+    r := &Reader{backend: b, name: name, attribs: map[uint32][]byte{}}
+    b.readers = append(b.readers, r)
+    b.notify()
+    return r
+}
+
+// Remove reader, e.g. to simulate unplugging it.
+func (b *Backend) RemoveReader(name string) {
+    b.mutex.Lock()
+    defer b.mutex.Unlock()
+    for i, r := range b.readers {
+        if r.name == name {
+            b.removeCard(r)
+            b.readers = append(b.readers[:i:i], b.readers[i+1:]...)
+            b.notify()
+            return
+        }
+    }
+}
+
+// Return reader by name, or nil.
+func (b *Backend) Reader(name string) *Reader {
+    b.mutex.Lock()
+    defer b.mutex.Unlock()
+    return b.reader(name)
+}
+
+func (b *Backend) reader(name string) *Reader {
+    for _, r := range b.readers {
+        if r.name == name { return r }
+    }
+    return nil
+}
+
+// Return number of established contexts and connected cards, e.g. to
+// check that code under test releases them.
+func (b *Backend) Open() (int, int) {
+    b.mutex.Lock()
+    defer b.mutex.Unlock()
+    return len(b.contexts), len(b.cards)
+}
+
+// Remove card of reader and invalidate its connections.
+func (b *Backend) removeCard(r *Reader) {
+    if r.card == nil { return }
+    for id, c := range b.cards {
+        if c.reader == r {
+            c.card = nil
+            c.reader = nil
+            if r.transaction == id { r.transaction = 0 }
+        }
+    }
+    r.card = nil
+    r.connections = 0
+    r.exclusive = false
+    r.events++
+    b.released.Broadcast()
+}
+
+// Wake up GetStatusChange. Must be called with the mutex held.
+func (b *Backend) notify() {
+    close(b.changed)
+    b.changed = make(chan struct{})
+}
+
+func (b *Backend) EstablishContext(scope uint32) (uintptr, error) {
+    b.mutex.Lock()
+    defer b.mutex.Unlock()
+    b.next++
+    b.contexts[b.next] = true
+    return b.next, nil
+}
+
+func (b *Backend) ReleaseContext(ctx uintptr) error {
+    b.mutex.Lock()
+    defer b.mutex.Unlock()
+    if !b.contexts[ctx] { return pcsc.Error(pcsc.SCARD_E_INVALID_HANDLE) }
+    delete(b.contexts, ctx)
+    return nil
+}
+
+func (b *Backend) ListReaders(ctx uintptr) ([]string, error) {
+    b.mutex.Lock()
+    defer b.mutex.Unlock()
+    if !b.contexts[ctx] { return nil, pcsc.Error(pcsc.SCARD_E_INVALID_HANDLE) }
+    names := make([]string, len(b.readers))
+    for i, r := range b.readers {
+        names[i] = r.name
+    }
+    return names, nil
+}
+
+// Return event state of reader.
+func (r *Reader) state() uint32 {
+    state := r.events << 16
+    if r.card == nil {
+        return state | pcsc.SCARD_STATE_EMPTY
+    }
+    state |= pcsc.SCARD_STATE_PRESENT
+    if len(r.card.atr) == 0 {
+        state |= pcsc.SCARD_STATE_MUTE
+    }
+    if r.connections > 0 {
+        state |= pcsc.SCARD_STATE_INUSE
+    }
+    if r.exclusive {
+        state |= pcsc.SCARD_STATE_EXCLUSIVE
+    }
+    return state
+}
+
+func (b *Backend) GetStatusChange(ctx uintptr, timeout uint32,
+    states []smartcard.ReaderState) error {
+    var expired <-chan time.Time
+    if timeout != smartcard.INFINITE {
+        timer := time.NewTimer(time.Duration(timeout) * time.Millisecond)
+        defer timer.Stop()
+        expired = timer.C
+    }
+    for {
+        b.mutex.Lock()
+        if !b.contexts[ctx] {
+            b.mutex.Unlock()
+            return pcsc.Error(pcsc.SCARD_E_INVALID_HANDLE)
+        }
+        changed := false
+        for i := range states {
+            s := &states[i]
+            if s.CurrentState & pcsc.SCARD_STATE_IGNORE != 0 { continue }
+            state, atr := uint32(pcsc.SCARD_STATE_UNKNOWN), []byte(nil)
+            if r := b.reader(s.Reader); r != nil {
+                state = r.state()
+                if r.card != nil { atr = r.card.atr }
+            }
+            if state != s.CurrentState &^ pcsc.SCARD_STATE_CHANGED {
+                state |= pcsc.SCARD_STATE_CHANGED
+                changed = true
+            }
+            s.EventState, s.ATR = state, atr
+        }
+        wait := b.changed
+        b.mutex.Unlock()
+        if changed { return nil }
+        select {
+            case <-wait:
+            case <-expired:
+                return pcsc.Error(pcsc.SCARD_E_TIMEOUT)
+        }
+    }
+}
+
+func (b *Backend) Connect(ctx uintptr, reader string, shareMode,
+    protocols uint32) (uintptr, uint32, error) {
+    b.mutex.Lock()
+    defer b.mutex.Unlock()
+    if !b.contexts[ctx] {
+        return 0, 0, pcsc.Error(pcsc.SCARD_E_INVALID_HANDLE)
+    }
+    r := b.reader(reader)
+    if r == nil { return 0, 0, pcsc.Error(pcsc.SCARD_E_UNKNOWN_READER) }
+    if r.card == nil { return 0, 0, pcsc.Error(pcsc.SCARD_E_NO_SMARTCARD) }
+    if len(r.card.atr) == 0 {
+        return 0, 0, pcsc.Error(pcsc.SCARD_W_UNRESPONSIVE_CARD)
+    }
+    exclusive := shareMode == smartcard.SHARE_EXCLUSIVE
+    if r.exclusive || exclusive && r.connections > 0 {
+        return 0, 0, pcsc.Error(pcsc.SCARD_E_SHARING_VIOLATION)
+    }
+    protocol := uint32(smartcard.PROTOCOL_T1)
+    if protocols & smartcard.PROTOCOL_T1 == 0 {
+        protocol = smartcard.PROTOCOL_T0
+    }
+    if shareMode != smartcard.SHARE_DIRECT &&
+        protocols & smartcard.PROTOCOL_ANY == 0 {
+        return 0, 0, pcsc.Error(pcsc.SCARD_E_PROTO_MISMATCH)
+    }
+    b.next++
+    b.cards[b.next] = &connection{r, r.card, protocol, exclusive}
+    r.connections++
+    r.exclusive = exclusive
+    b.notify()
+    return b.next, protocol, nil
+}
+
+// Return connection to a present card. Must be called with the mutex held.
+func (b *Backend) connection(card uintptr) (*connection, error) {
+    c, ok := b.cards[card]
+    if !ok { return nil, pcsc.Error(pcsc.SCARD_E_INVALID_HANDLE) }
+    if c.card == nil { return nil, pcsc.Error(pcsc.SCARD_W_REMOVED_CARD) }
+    return c, nil
+}
+
+func (b *Backend) Disconnect(card uintptr, disposition uint32) error {
+    b.mutex.Lock()
+    c, ok := b.cards[card]
+    if !ok {
+        b.mutex.Unlock()
+        return pcsc.Error(pcsc.SCARD_E_INVALID_HANDLE)
+    }
+    delete(b.cards, card)
+    if c.card == nil {
+        b.mutex.Unlock()
+        return nil
+    }
+    r := c.reader
+    r.connections--
+    if c.exclusive { r.exclusive = false }
+    if r.transaction == card {
+        r.transaction = 0
+        b.released.Broadcast()
+    }
+    b.notify()
+    b.mutex.Unlock()
+    b.dispose(c.card, disposition)
+    return nil
+}
+
+// Reset card according to disposition.
+func (b *Backend) dispose(card *Card, disposition uint32) {
+    switch disposition {
+        case smartcard.RESET_CARD, smartcard.UNPOWER_CARD:
+            card.reset()
+    }
+}
+
+func (b *Backend) Status(card uintptr) (smartcard.CardStatus, error) {
+    b.mutex.Lock()
+    defer b.mutex.Unlock()
+    c, err := b.connection(card)
+    if err != nil { return smartcard.CardStatus{}, err }
+    return smartcard.CardStatus{
+        Reader: c.reader.name,
+        State: pcsc.SCARD_PRESENT | pcsc.SCARD_POWERED |
+            pcsc.SCARD_SPECIFIC,
+        Protocol: c.protocol,
+        ATR: c.card.atr,
+    }, nil
+}
+
+// Wait until no other connection holds a transaction on the reader and
+// return the card. Must be called with the mutex held.
+func (b *Backend) acquire(card uintptr) (*Card, error) {
+    for {
+        c, err := b.connection(card)
+        if err != nil { return nil, err }
+        if c.reader.transaction == 0 || c.reader.transaction == card {
+            return c.card, nil
+        }
+        b.released.Wait()
+    }
+}
+
+func (b *Backend) Transmit(card uintptr, protocol uint32,
+    command []byte) ([]byte, error) {
+    b.mutex.Lock()
+    c, err := b.acquire(card)
+    b.mutex.Unlock()
+    if err != nil { return nil, err }
+    if !smartcard.CommandAPDU(command).IsValid() {
+        return nil, pcsc.Error(pcsc.SCARD_E_INVALID_PARAMETER)
+    }
+    rsp, err := c.TransmitAPDU(command)
+    if err != nil { return nil, err }
+    return rsp, nil
+}
+
+func (b *Backend) Control(card uintptr, code uint32,
+    data []byte) ([]byte, error) {
+    b.mutex.Lock()
+    conn, err := b.connection(card)
+    var control func(code uint32, data []byte) ([]byte, error)
+    if err == nil { control = conn.reader.control }
+    b.mutex.Unlock()
+    if err != nil { return nil, err }
+    if control == nil {
+        return nil, pcsc.Error(pcsc.SCARD_E_UNSUPPORTED_FEATURE)
+    }
+    return control(code, data)
+}
+
+func (b *Backend) GetAttrib(card uintptr, attr uint32) ([]byte, error) {
+    b.mutex.Lock()
+    defer b.mutex.Unlock()
+    c, err := b.connection(card)
+    if err != nil { return nil, err }
+    if attr == pcsc.SCARD_ATTR_ATR_STRING {
+        return append([]byte{}, c.card.atr...), nil
+    }
+    value, ok := c.reader.attribs[attr]
+    if !ok { return nil, pcsc.Error(pcsc.SCARD_E_UNSUPPORTED_FEATURE) }
+    return append([]byte{}, value...), nil
+}
+
+func (b *Backend) BeginTransaction(card uintptr) error {
+    b.mutex.Lock()
+    defer b.mutex.Unlock()
+    if _, err := b.acquire(card); err != nil { return err }
+    b.cards[card].reader.transaction = card
+    return nil
+}
+
+func (b *Backend) EndTransaction(card uintptr, disposition uint32) error {
+    b.mutex.Lock()
+    c, err := b.connection(card)
+    if err == nil && c.reader.transaction != card {
+        err = pcsc.Error(pcsc.SCARD_E_NOT_TRANSACTED)
+    }
+    if err != nil {
+        b.mutex.Unlock()
+        return err
+    }
+    c.reader.transaction = 0
+    b.released.Broadcast()
+    b.mutex.Unlock()
+    b.dispose(c.card, disposition)
+    return nil
+}
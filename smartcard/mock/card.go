@@ -0,0 +1,284 @@
+/*
+Package mock provides virtual smart card readers and cards for unit tests
+without pcscd or physical readers.
+
+A Card answers command APDUs from exact-match expectations (consumed in
+order), pattern rules and Go handlers, e.g. simulators implementing
+smartcard.Transmitter. A Backend holds virtual readers into which cards are
+inserted and removed, and plugs into smartcard.EstablishContextWithBackend,
+so code using Context, Reader and Card runs unchanged. Recorded APDU
+traces are replayed with LoadTrace and written with Recorder.
+
+Example:
+
+    card := mock.NewCard(mock.Hex("3b 80 80 01 01")).
+        Expect("00 a4 04 00 02 a0 00", "90 00").
+        Rule("80 ca ?? ?? *", "6a 88")
+    backend := mock.NewBackend()
+    backend.AddReader("Virtual Reader 00").Insert(card)
+    ctx, err := smartcard.EstablishContextWithBackend(backend)
+    // run code under test with ctx
+    if err := card.Verify(); err != nil {
+        t.Error(err)
+    }
+*/
+package mock
+
+import (
+    "bytes"
+    "encoding/hex"
+    "fmt"
+    "strings"
+    "sync"
+    "github.com/sf1/go-card/smartcard"
+)
+
+// Return bytes of hex string, ignoring spaces. Panics on invalid hex.
+func Hex(s string) []byte {
+    b, err := hex.DecodeString(strings.Join(strings.Fields(s), ""))
+    if err != nil { panic(fmt.Sprintf("mock: invalid hex %q", s)) }
+    return b
+}
+
+// Adapter to use a function as card handler.
+type HandlerFunc func(cmd smartcard.CommandAPDU) (smartcard.ResponseAPDU,
+    error)
+
+// Call f.
+func (f HandlerFunc) TransmitAPDU(cmd smartcard.CommandAPDU) (
+    smartcard.ResponseAPDU, error) {
+    return f(cmd)
+}
+
+// Command pattern: hex bytes with ?? matching any byte and a trailing *
+// matching any remaining bytes.
+type pattern struct {
+    bytes []byte
+    wildcard []bool
+    prefix bool
+}
+
+func parsePattern(s string) (*pattern, error) {
+    p := &pattern{}
+    fields := strings.Fields(s)
+    if len(fields) > 0 && fields[len(fields)-1] == "*" {
+        p.prefix = true
+        fields = fields[:len(fields)-1]
+    }
+    for _, f := range fields {
+        if len(f) % 2 != 0 {
+            return nil, fmt.Errorf("mock: invalid pattern %q", s)
+        }
+        for i := 0; i < len(f); i += 2 {
+            if f[i:i+2] == "??" {
+                p.bytes = append(p.bytes, 0)
+                p.wildcard = append(p.wildcard, true)
+                continue
+            }
+            b, err := hex.DecodeString(f[i:i+2])
+            if err != nil {
+                return nil, fmt.Errorf("mock: invalid pattern %q", s)
+            }
+            p.bytes = append(p.bytes, b[0])
+            p.wildcard = append(p.wildcard, false)
+        }
+    }
+    return p, nil
+}
+
+func (p *pattern) match(cmd []byte) bool {
+    if len(cmd) < len(p.bytes) || !p.prefix && len(cmd) != len(p.bytes) {
+        return false
+    }
+    for i, b := range p.bytes {
+        if !p.wildcard[i] && cmd[i] != b { return false }
+    }
+    return true
+}
+
+type expectation struct {
+    command []byte
+    response smartcard.ResponseAPDU
+}
+
+type rule struct {
+    pattern *pattern
+    handler smartcard.Transmitter
+}
+
+// Command and response (or error) exchanged with a Card.
+type Exchange struct {
+    Command smartcard.CommandAPDU
+    Response smartcard.ResponseAPDU
+    Err error
+}
+
+// Virtual smart card. A command is answered by the next expectation if it
+// matches, else by the first matching rule, else by the handler. Other
+// commands fail and are reported by Verify. Card implements
+// smartcard.Transmitter and is safe for concurrent use.
+type Card struct {
+    mutex sync.Mutex
+    atr smartcard.ATR
+    expectations []expectation
+    rules []rule
+    handler smartcard.Transmitter
+    exchanges []Exchange
+    failures []string
+    resets int
+}
+
+// Create card with ATR. A card with empty ATR is mute.
+func NewCard(atr []byte) *Card {
+    return &Card{atr: smartcard.ATR(atr)}
+}
+
+// Return ATR.
+func (c *Card) ATR() smartcard.ATR {
+    return c.atr
+}
+
+// Expect command (hex) next and answer with response (hex, including SW).
+// Panics on invalid hex.
+func (c *Card) Expect(command, response string) *Card {
+    return c.ExpectAPDU(Hex(command), Hex(response))
+}
+
+// Expect command next and answer with response.
+func (c *Card) ExpectAPDU(command smartcard.CommandAPDU,
+    response smartcard.ResponseAPDU) *Card {
+    c.mutex.Lock()
+    defer c.mutex.Unlock()
+    c.expectations = append(c.expectations, expectation{command, response})
+    return c
+}
+
+// Answer commands matching pattern with response (hex). In the pattern ??
+// matches any byte and a trailing * any remaining bytes, e.g. "00 b0 *".
+// Panics on invalid pattern or hex.
+func (c *Card) Rule(pattern, response string) *Card {
+    rsp := smartcard.ResponseAPDU(Hex(response))
+    return c.RuleFunc(pattern, func(smartcard.CommandAPDU) (
+        smartcard.ResponseAPDU, error) {
+        return rsp, nil
+    })
+}
+
+// Answer commands matching pattern by calling fn.
+func (c *Card) RuleFunc(pattern string, fn HandlerFunc) *Card {
+    p, err := parsePattern(pattern)
+    if err != nil { panic(err.Error()) }
+    c.mutex.Lock()
+    defer c.mutex.Unlock()
+    c.rules = append(c.rules, rule{p, fn})
+    return c
+}
+
+// Answer commands without expectation or rule with handler, e.g. a card
+// simulator.
+func (c *Card) Handle(handler smartcard.Transmitter) *Card {
+    c.mutex.Lock()
+    defer c.mutex.Unlock()
+    c.handler = handler
+    return c
+}
+
+// Answer commands without expectation or rule by calling fn.
+func (c *Card) HandleFunc(fn HandlerFunc) *Card {
+    return c.Handle(fn)
+}
+
+// Process command APDU.
+func (c *Card) TransmitAPDU(cmd smartcard.CommandAPDU) (
+    smartcard.ResponseAPDU, error) {
+    c.mutex.Lock()
+    handler := c.handler
+    var rsp smartcard.ResponseAPDU
+    matched := false
+    if len(c.expectations) > 0 &&
+        bytes.Equal(c.expectations[0].command, cmd) {
+        rsp, matched = c.expectations[0].response, true
+        c.expectations = c.expectations[1:]
+    } else {
+        for _, r := range c.rules {
+            if r.pattern.match(cmd) {
+                handler = r.handler
+                break
+            }
+        }
+    }
+    if !matched && handler == nil {
+        msg := fmt.Sprintf("unexpected command %X", []byte(cmd))
+        if len(c.expectations) > 0 {
+            msg += fmt.Sprintf(", expected %X", c.expectations[0].command)
+        }
+        c.failures = append(c.failures, msg)
+        c.exchanges = append(c.exchanges, Exchange{Command: cmd,
+            Err: fmt.Errorf("mock: %s", msg)})
+        c.mutex.Unlock()
+        return nil, fmt.Errorf("mock: %s", msg)
+    }
+    c.mutex.Unlock()
+    var err error
+    if !matched {
+        rsp, err = handler.TransmitAPDU(cmd)
+    }
+    c.mutex.Lock()
+    c.exchanges = append(c.exchanges, Exchange{cmd, rsp, err})
+    c.mutex.Unlock()
+    return rsp, err
+}
+
+// Return exchanged commands and responses.
+func (c *Card) Exchanges() []Exchange {
+    c.mutex.Lock()
+    defer c.mutex.Unlock()
+    return append([]Exchange{}, c.exchanges...)
+}
+
+// Return number of resets by readers (disconnect with RESET_CARD or
+// UNPOWER_CARD).
+func (c *Card) Resets() int {
+    c.mutex.Lock()
+    defer c.mutex.Unlock()
+    return c.resets
+}
+
+// Reset card, calling Reset of the handler if it has one.
+func (c *Card) reset() {
+    c.mutex.Lock()
+    c.resets++
+    handler := c.handler
+    c.mutex.Unlock()
+    if r, ok := handler.(interface{ Reset() }); ok {
+        r.Reset()
+    }
+}
+
+// Return error describing unexpected commands and unconsumed expectations,
+// if any.
+func (c *Card) Verify() error {
+    c.mutex.Lock()
+    defer c.mutex.Unlock()
+    msgs := append([]string{}, c.failures...)
+    for _, e := range c.expectations {
+        msgs = append(msgs, fmt.Sprintf("expected command %X not received",
+            e.command))
+    }
+    if len(msgs) == 0 { return nil }
+    return fmt.Errorf("mock: %s", strings.Join(msgs, "; "))
+}
+
+// Subset of testing.TB used by AssertExpectations.
+type TestingT interface {
+    Helper()
+    Errorf(format string, args ...interface{})
+}
+
+// Report unexpected commands and unconsumed expectations as test errors.
+func (c *Card) AssertExpectations(t TestingT) {
+    t.Helper()
+    if err := c.Verify(); err != nil {
+        t.Errorf("%s", err)
+    }
+}
@@ -0,0 +1,241 @@
+package mock
+
+import (
+    "bytes"
+    "fmt"
+    "strings"
+    "testing"
+    "time"
+    "github.com/sf1/go-card/smartcard"
+    "github.com/sf1/go-card/smartcard/pcsc"
+)
+
+var testATR = Hex("3b 80 80 01 01")
+
+type recorder struct {
+    errors []string
+}
+
+func (r *recorder) Helper() {}
+
+func (r *recorder) Errorf(format string, args ...interface{}) {
+    r.errors = append(r.errors, fmt.Sprintf(format, args...))
+}
+
+func transmit(t *testing.T, c smartcard.Transmitter,
+    cmd string) smartcard.ResponseAPDU {
+    t.Helper()
+    rsp, err := c.TransmitAPDU(Hex(cmd))
+    if err != nil { t.Fatal(err) }
+    return rsp
+}
+
+func TestCard(t *testing.T) {
+    card := NewCard(testATR).
+        Expect("00 a4 04 00 02 a0 00", "90 00").
+        Expect("00 b0 00 00 02", "01 02 90 00").
+        Rule("80 ca ?? ?? *", "6a 88").
+        RuleFunc("00 c0 00 00 ??", func(cmd smartcard.CommandAPDU) (
+            smartcard.ResponseAPDU, error) {
+            return append(bytes.Repeat([]byte{0xaa}, int(cmd[4])), 0x90,
+                0x00), nil
+        }).
+        HandleFunc(func(cmd smartcard.CommandAPDU) (smartcard.ResponseAPDU,
+            error) {
+            return smartcard.ResponseAPDU{0x6d, 0x00}, nil
+        })
+    // Rules apply while expectations are pending
+    if rsp := transmit(t, card, "80 ca 9f 7f 00"); rsp.SW() != 0x6a88 {
+        t.Errorf("unexpected response %s", rsp)
+    }
+    if rsp := transmit(t, card, "00 a4 04 00 02 a0 00"); rsp.SW() != 0x9000 {
+        t.Errorf("unexpected response %s", rsp)
+    }
+    if rsp := transmit(t, card, "00 c0 00 00 03"); !bytes.Equal(rsp,
+        Hex("aa aa aa 90 00")) {
+        t.Errorf("unexpected response %s", rsp)
+    }
+    if rsp := transmit(t, card, "00 c0 00 00 03 00"); rsp.SW() != 0x6d00 {
+        t.Errorf("handler not called: %s", rsp)
+    }
+    if err := card.Verify(); err == nil ||
+        !strings.Contains(err.Error(), "expected command 00B0000002") {
+        t.Errorf("unconsumed expectation not reported: %v", err)
+    }
+    if rsp := transmit(t, card, "00 b0 00 00 02"); !bytes.Equal(rsp,
+        Hex("01 02 90 00")) {
+        t.Errorf("unexpected response %s", rsp)
+    }
+    card.AssertExpectations(t)
+    if n := len(card.Exchanges()); n != 5 {
+        t.Errorf("unexpected %d exchanges", n)
+    }
+}
+
+func TestCardUnexpected(t *testing.T) {
+    card := NewCard(testATR).Expect("00 a4 04 00 00", "90 00")
+    if _, err := card.TransmitAPDU(Hex("00 b0 00 00 00")); err == nil {
+        t.Error("unexpected command accepted")
+    }
+    transmit(t, card, "00 a4 04 00 00")
+    r := &recorder{}
+    card.AssertExpectations(r)
+    if len(r.errors) != 1 ||
+        !strings.Contains(r.errors[0], "unexpected command 00B0000000, " +
+        "expected 00A4040000") {
+        t.Errorf("unexpected errors %q", r.errors)
+    }
+    for _, p := range []string{"00 a", "00 zz", "00 a4 ???"} {
+        func() {
+            defer func() {
+                if recover() == nil { t.Errorf("pattern %q accepted", p) }
+            }()
+            card.Rule(p, "90 00")
+        }()
+    }
+}
+
+func TestTrace(t *testing.T) {
+    var buf bytes.Buffer
+    buf.WriteString("# test trace\n\n")
+    rec := NewRecorder(NewCard(testATR).Rule("00 b0 *", "01 02 90 00").
+        Rule("00 84 *", "6a 81"), &buf)
+    transmit(t, rec, "00 b0 00 00 02")
+    transmit(t, rec, "00 84 00 00 08")
+    expected := "# test trace\n\n> 00B0000002\n< 01029000\n" +
+        "> 0084000008\n< 6A81\n"
+    if buf.String() != expected {
+        t.Fatalf("unexpected trace %q", buf.String())
+    }
+    card, err := ReadTrace(&buf)
+    if err != nil { t.Fatal(err) }
+    if rsp := transmit(t, card, "00 b0 00 00 02"); !bytes.Equal(rsp,
+        Hex("01 02 90 00")) {
+        t.Errorf("unexpected response %s", rsp)
+    }
+    if card.Verify() == nil { t.Error("missing command not reported") }
+    transmit(t, card, "00 84 00 00 08")
+    card.AssertExpectations(t)
+    for _, s := range []string{"> 00\n", "< 9000\n", "> 00\n> 00\n",
+        "00a4\n", "> 0g\n"} {
+        if _, err := ReadTrace(strings.NewReader(s)); err == nil {
+            t.Errorf("trace %q accepted", s)
+        }
+    }
+}
+
+func TestBackend(t *testing.T) {
+    backend := NewBackend()
+    reader := backend.AddReader("Virtual Reader 00")
+    backend.AddReader("Virtual Reader 01")
+    ctx, err := smartcard.EstablishContextWithBackend(backend)
+    if err != nil { t.Fatal(err) }
+    readers, err := ctx.ListReadersWithCard()
+    if err != nil || len(readers) != 0 {
+        t.Fatalf("unexpected readers %v, %v", readers, err)
+    }
+    card := NewCard(testATR).Rule("*", "90 00")
+    go func() {
+        time.Sleep(20*time.Millisecond)
+        reader.Insert(card)
+    }()
+    states := []smartcard.ReaderState{{Reader: reader.Name()}}
+    if err := backend.GetStatusChange(1, 0, states); err != nil {
+        t.Fatal(err)
+    }
+    states[0].CurrentState = states[0].EventState
+    if err := backend.GetStatusChange(1, 0, states); err != pcsc.Error(
+        pcsc.SCARD_E_TIMEOUT) {
+        t.Fatalf("expected timeout, got %v", err)
+    }
+    if err := backend.GetStatusChange(1, smartcard.INFINITE,
+        states); err != nil {
+        t.Fatal(err)
+    }
+    if states[0].EventState & pcsc.SCARD_STATE_PRESENT == 0 ||
+        states[0].EventState & pcsc.SCARD_STATE_CHANGED == 0 ||
+        !bytes.Equal(states[0].ATR, testATR) {
+        t.Errorf("unexpected state %x", states[0].EventState)
+    }
+    r, err := ctx.WaitForCardPresent()
+    if err != nil || r.Name() != reader.Name() {
+        t.Fatalf("unexpected reader %v, %v", r, err)
+    }
+    c, err := r.Connect()
+    if err != nil { t.Fatal(err) }
+    if !bytes.Equal(c.ATR(), testATR) { t.Errorf("unexpected ATR %s", c.ATR()) }
+    if _, err := r.ConnectMode(smartcard.SHARE_EXCLUSIVE,
+        smartcard.PROTOCOL_ANY); err != pcsc.Error(
+        pcsc.SCARD_E_SHARING_VIOLATION) {
+        t.Errorf("expected sharing violation, got %v", err)
+    }
+    if rsp := transmit(t, c, "00 84 00 00 08"); rsp.SW() != 0x9000 {
+        t.Errorf("unexpected response %s", rsp)
+    }
+    if _, err := c.Control(0x42000d48, nil); err != pcsc.Error(
+        pcsc.SCARD_E_UNSUPPORTED_FEATURE) {
+        t.Errorf("expected unsupported control, got %v", err)
+    }
+    reader.HandleControl(func(code uint32, data []byte) ([]byte, error) {
+        return []byte{byte(code)}, nil
+    })
+    if rsp, err := c.Control(0x42000d48, nil); err != nil ||
+        !bytes.Equal(rsp, []byte{0x48}) {
+        t.Errorf("unexpected control response %X, %v", rsp, err)
+    }
+    reader.Remove()
+    if r.IsCardPresent() { t.Error("card still present") }
+    if _, err := c.Transmit(Hex("00 84 00 00 08")); err != pcsc.Error(
+        pcsc.SCARD_W_REMOVED_CARD) {
+        t.Errorf("expected removed card, got %v", err)
+    }
+    if err := c.Disconnect(); err != nil { t.Error(err) }
+    if card.Resets() != 0 { t.Error("removed card reset") }
+    if err := ctx.Release(); err != nil { t.Fatal(err) }
+    if contexts, cards := backend.Open(); contexts != 0 || cards != 0 {
+        t.Errorf("%d contexts, %d cards open", contexts, cards)
+    }
+}
+
+func TestTransactions(t *testing.T) {
+    backend := NewBackend()
+    reader := backend.AddReader("Virtual Reader 00")
+    card := NewCard(testATR).Rule("*", "90 00")
+    reader.Insert(card)
+    ctx, err := smartcard.EstablishContextWithBackend(backend)
+    if err != nil { t.Fatal(err) }
+    defer ctx.Release()
+    readers, _ := ctx.ListReaders()
+    r := readers[0]
+    c1, err := r.Connect()
+    if err != nil { t.Fatal(err) }
+    c2, err := r.Connect()
+    if err != nil { t.Fatal(err) }
+    if err := c1.BeginTransaction(); err != nil { t.Fatal(err) }
+    done := make(chan error)
+    go func() {
+        _, err := c2.Transmit(Hex("00 84 00 00 08"))
+        done <- err
+    }()
+    select {
+        case <-done:
+            t.Fatal("transmit not blocked by transaction")
+        case <-time.After(20*time.Millisecond):
+    }
+    if err := c2.EndTransaction(smartcard.LEAVE_CARD); err != pcsc.Error(
+        pcsc.SCARD_E_NOT_TRANSACTED) {
+        t.Errorf("expected not transacted, got %v", err)
+    }
+    if err := c1.EndTransaction(smartcard.RESET_CARD); err != nil {
+        t.Fatal(err)
+    }
+    if err := <-done; err != nil { t.Error(err) }
+    if card.Resets() != 1 { t.Errorf("unexpected %d resets", card.Resets()) }
+    c1.Disconnect()
+    c2.DisconnectMode(smartcard.LEAVE_CARD)
+    if card.Resets() != 2 { t.Errorf("unexpected %d resets", card.Resets()) }
+    // Mute card
+    reader.Insert(NewCard(nil))
+    if r.IsCardPresent() { t.Error("mute card present") }
+    if _, err := r.Connect(); err == nil { t.Error("connected to mute card") }
+}
@@ -0,0 +1,86 @@
+package mock
+
+import (
+    "bufio"
+    "encoding/hex"
+    "fmt"
+    "io"
+    "os"
+    "strings"
+    "github.com/sf1/go-card/smartcard"
+)
+
+// Read APDU trace and return a card expecting its commands in order.
+// Lines starting with ">" hold commands, lines starting with "<" the
+// card's responses, "#" starts a comment:
+//
+//     # SELECT
+//     > 00A4040007A0000000031010
+//     < 6F108407A0000000031010A5059F6501FF9000
+func ReadTrace(r io.Reader) (*Card, error) {
+    var commands, responses [][]byte
+    scanner := bufio.NewScanner(r)
+    n := 0
+    for scanner.Scan() {
+        n++
+        line := strings.TrimSpace(scanner.Text())
+        if line == "" || line[0] == '#' {
+            continue
+        }
+        data, err := hex.DecodeString(strings.TrimSpace(line[1:]))
+        if err != nil { return nil, fmt.Errorf("line %d: %s", n, err) }
+        switch line[0] {
+            case '>':
+                commands = append(commands, data)
+            case '<':
+                responses = append(responses, data)
+            default:
+                return nil, fmt.Errorf("line %d: invalid line %q", n, line)
+        }
+        if len(responses) > len(commands) ||
+            len(commands) > len(responses) + 1 {
+            return nil, fmt.Errorf("line %d: unbalanced trace", n)
+        }
+    }
+    if err := scanner.Err(); err != nil { return nil, err }
+    if len(commands) != len(responses) {
+        return nil, fmt.Errorf("command without response")
+    }
+    card := NewCard(nil)
+    for i := range commands {
+        card.ExpectAPDU(commands[i], responses[i])
+    }
+    return card, nil
+}
+
+// Load APDU trace file, see ReadTrace.
+func LoadTrace(path string) (*Card, error) {
+    f, err := os.Open(path)
+    if err != nil { return nil, err }
+    defer f.Close()
+    card, err := ReadTrace(f)
+    if err != nil { return nil, fmt.Errorf("%s: %s", path, err) }
+    return card, nil
+}
+
+// Transmitter writing the exchange with a card in trace format, e.g. to
+// record traces from a simulator or a real card for ReadTrace.
+type Recorder struct {
+    card smartcard.Transmitter
+    w io.Writer
+}
+
+// Create recorder of the exchange with card.
+func NewRecorder(card smartcard.Transmitter, w io.Writer) *Recorder {
+    return &Recorder{card, w}
+}
+
+// Transmit command to the card and write command and response.
+func (r *Recorder) TransmitAPDU(cmd smartcard.CommandAPDU) (
+    smartcard.ResponseAPDU, error) {
+    rsp, err := r.card.TransmitAPDU(cmd)
+    if err != nil { return nil, err }
+    _, err = fmt.Fprintf(r.w, "> %X\n< %X\n", []byte(cmd), []byte(rsp))
+    if err != nil { return nil, err }
+    return rsp, nil
+}
@@ -0,0 +1,185 @@
+/*
+Package monitor reports reader and card state transitions of a
+smartcard.Backend: readers attached and detached, cards inserted, removed
+or mute, and cards taken into and out of use by applications.
+
+Example:
+
+    backend, err := smartcard.DefaultBackend()
+    // handle error, if any
+    m, err := monitor.New(backend)
+    // handle error, if any
+    defer m.Close()
+    for {
+        events, err := m.Next(time.Second)
+        // handle error, if any
+        for _, e := range events {
+            fmt.Println(e.Time, e.Reader, e.Type)
+        }
+    }
+*/
+package monitor
+
+import (
+    "bytes"
+    "sort"
+    "time"
+    "github.com/sf1/go-card/smartcard"
+    "github.com/sf1/go-card/smartcard/pcsc"
+)
+
+// Event types
+const (
+    EVENT_ATTACHED = "attached"
+    EVENT_DETACHED = "detached"
+    EVENT_INSERTED = "inserted"
+    EVENT_REMOVED = "removed"
+    EVENT_MUTE = "mute"
+    EVENT_IN_USE = "in_use"
+    EVENT_NOT_IN_USE = "not_in_use"
+)
+
+// Reader state flags reported
+const STATE_MASK = pcsc.SCARD_STATE_EMPTY | pcsc.SCARD_STATE_PRESENT |
+    pcsc.SCARD_STATE_MUTE | pcsc.SCARD_STATE_INUSE |
+    pcsc.SCARD_STATE_EXCLUSIVE | pcsc.SCARD_STATE_UNAVAILABLE
+
+// State transition of a reader.
+type Event struct {
+    Time time.Time
+    Type string
+    Reader string
+    // Reader state after the event (pcsc.SCARD_STATE_*, see STATE_MASK)
+    State uint32
+    // ATR of the card in the reader, if any
+    ATR smartcard.ATR
+}
+
+// Reader state watcher.
+type Monitor struct {
+    backend smartcard.Backend
+    ctx uintptr
+    states map[string]*smartcard.ReaderState
+}
+
+// Create monitor with its own context of backend.
+func New(backend smartcard.Backend) (*Monitor, error) {
+    ctx, err := backend.EstablishContext(smartcard.SCOPE_SYSTEM)
+    if err != nil { return nil, err }
+    return &Monitor{backend: backend, ctx: ctx,
+        states: map[string]*smartcard.ReaderState{}}, nil
+}
+
+// Release the context of the monitor.
+func (m *Monitor) Close() error {
+    return m.backend.ReleaseContext(m.ctx)
+}
+
+// Return current states of the readers, sorted by name.
+func (m *Monitor) States() []smartcard.ReaderState {
+    states := make([]smartcard.ReaderState, 0, len(m.states))
+    for _, s := range m.states {
+        states = append(states, *s)
+    }
+    sort.Slice(states, func(i, j int) bool {
+        return states[i].Reader < states[j].Reader
+    })
+    return states
+}
+
+// Wait up to timeout for state changes and return the resulting events.
+// The first call reports all readers as attached and present cards as
+// inserted. Readers attached while waiting are noticed at the next call.
+func (m *Monitor) Next(timeout time.Duration) ([]Event, error) {
+    names, err := m.backend.ListReaders(m.ctx)
+    if err == pcsc.Error(pcsc.SCARD_E_NO_READERS_AVAILABLE) {
+        names, err = nil, nil
+    }
+    if err != nil { return nil, err }
+    var events []Event
+    now := time.Now()
+    current := map[string]bool{}
+    states := make([]smartcard.ReaderState, len(names))
+    for i, name := range names {
+        current[name] = true
+        states[i].Reader = name
+        if s, ok := m.states[name]; ok {
+            states[i].CurrentState = s.EventState
+        }
+    }
+    for name, s := range m.states {
+        if current[name] { continue }
+        delete(m.states, name)
+        if s.EventState & pcsc.SCARD_STATE_PRESENT != 0 {
+            events = append(events, Event{now, EVENT_REMOVED, name, 0, nil})
+        }
+        events = append(events, Event{now, EVENT_DETACHED, name, 0, nil})
+    }
+    if len(states) == 0 {
+        if events == nil { time.Sleep(timeout) }
+        return events, nil
+    }
+    // Report new readers without waiting
+    ms := uint32(timeout / time.Millisecond)
+    if len(m.states) != len(names) { ms = 0 }
+    err = m.backend.GetStatusChange(m.ctx, ms, states)
+    if err == pcsc.Error(pcsc.SCARD_E_TIMEOUT) ||
+        err == pcsc.Error(pcsc.SCARD_E_UNKNOWN_READER) {
+        // Readers detached while waiting are reported next time
+        return events, nil
+    }
+    if err != nil { return events, err }
+    now = time.Now()
+    for i := range states {
+        s := &states[i]
+        s.EventState &^= pcsc.SCARD_STATE_CHANGED
+        old, known := m.states[s.Reader]
+        var before uint32
+        var oldATR []byte
+        if known {
+            before, oldATR = old.EventState, old.ATR
+        } else {
+            events = append(events, Event{now, EVENT_ATTACHED, s.Reader,
+                s.EventState & STATE_MASK, nil})
+        }
+        m.states[s.Reader] = s
+        events = append(events, transitions(now, s, before, oldATR)...)
+    }
+    return events, nil
+}
+
+// Return card events for the change of a reader's state from before.
+func transitions(now time.Time, s *smartcard.ReaderState, before uint32,
+    oldATR []byte) []Event {
+    var events []Event
+    after := s.EventState
+    add := func(typ string) {
+        var atr smartcard.ATR
+        if typ != EVENT_REMOVED { atr = s.ATR }
+        events = append(events, Event{now, typ, s.Reader, after & STATE_MASK,
+            atr})
+    }
+    rising := func(flag uint32) bool {
+        return before & flag == 0 && after & flag != 0
+    }
+    falling := func(flag uint32) bool {
+        return before & flag != 0 && after & flag == 0
+    }
+    // A card may have been swapped between two calls
+    if before & after & pcsc.SCARD_STATE_PRESENT != 0 &&
+        !bytes.Equal(oldATR, s.ATR) {
+        add(EVENT_REMOVED)
+        before = 0
+    }
+    switch {
+        case falling(pcsc.SCARD_STATE_PRESENT):
+            add(EVENT_REMOVED)
+            return events
+        case rising(pcsc.SCARD_STATE_PRESENT):
+            add(EVENT_INSERTED)
+    }
+    if rising(pcsc.SCARD_STATE_MUTE) { add(EVENT_MUTE) }
+    if rising(pcsc.SCARD_STATE_INUSE) { add(EVENT_IN_USE) }
+    if falling(pcsc.SCARD_STATE_INUSE) { add(EVENT_NOT_IN_USE) }
+    return events
+}
@@ -0,0 +1,75 @@
+package monitor
+
+import (
+    "testing"
+    "time"
+    "github.com/sf1/go-card/smartcard"
+    "github.com/sf1/go-card/smartcard/mock"
+)
+
+var testATR = mock.Hex("3b 80 80 01 01")
+
+// Return types and readers of events as strings.
+func summary(events []Event) []string {
+    s := make([]string, len(events))
+    for i, e := range events {
+        s[i] = e.Reader + " " + e.Type
+    }
+    return s
+}
+
+func expectEvents(t *testing.T, m *Monitor, expected ...string) []Event {
+    t.Helper()
+    events, err := m.Next(100*time.Millisecond)
+    if err != nil { t.Fatal(err) }
+    s := summary(events)
+    if len(s) != len(expected) {
+        t.Fatalf("expected %v, got %v", expected, s)
+    }
+    for i := range s {
+        if s[i] != expected[i] {
+            t.Fatalf("expected %v, got %v", expected, s)
+        }
+    }
+    return events
+}
+
+func TestMonitor(t *testing.T) {
+    backend := mock.NewBackend()
+    r0 := backend.AddReader("Reader 0")
+    r0.Insert(mock.NewCard(testATR))
+    m, err := New(backend)
+    if err != nil { t.Fatal(err) }
+    events := expectEvents(t, m, "Reader 0 attached", "Reader 0 inserted")
+    if events[1].ATR.String() != "3b80800101" {
+        t.Errorf("unexpected ATR %s", events[1].ATR)
+    }
+    expectEvents(t, m)
+    // Reader attached, mute card inserted
+    r1 := backend.AddReader("Reader 1")
+    expectEvents(t, m, "Reader 1 attached")
+    r1.Insert(mock.NewCard(nil))
+    expectEvents(t, m, "Reader 1 inserted", "Reader 1 mute")
+    // Card used by an application
+    ctx, err := smartcard.EstablishContextWithBackend(backend)
+    if err != nil { t.Fatal(err) }
+    defer ctx.Release()
+    readers, _ := ctx.ListReaders()
+    card, err := readers[0].Connect()
+    if err != nil { t.Fatal(err) }
+    expectEvents(t, m, "Reader 0 in_use")
+    card.Disconnect()
+    expectEvents(t, m, "Reader 0 not_in_use")
+    // Card swapped between calls
+    r0.Remove()
+    r0.Insert(mock.NewCard(mock.Hex("3b 00")))
+    expectEvents(t, m, "Reader 0 removed", "Reader 0 inserted")
+    // Reader with card detached
+    backend.RemoveReader("Reader 0")
+    expectEvents(t, m, "Reader 0 removed", "Reader 0 detached")
+    if states := m.States(); len(states) != 1 ||
+        states[0].Reader != "Reader 1" {
+        t.Errorf("unexpected states %v", states)
+    }
+    if err := m.Close(); err != nil { t.Fatal(err) }
+}
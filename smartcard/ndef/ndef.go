@@ -0,0 +1,168 @@
+/*
+Package ndef implements the NFC Data Exchange Format (NFC Forum NDEF 1.0)
+with the common record types URI, Text, Smart Poster and MIME, and
+reading and writing NDEF messages on NFC Forum Type 4 Tags (T4T 2.0)
+through a smartcard.Transmitter.
+
+Example:
+
+    tag, err := ndef.Select(card)
+    // handle error, if any
+    err = tag.WriteMessage(ndef.Message{
+        ndef.NewURIRecord("https://example.com/visitor/0042")})
+    // handle error, if any
+    msg, err := tag.ReadMessage()
+*/
+package ndef
+
+import (
+    "encoding/binary"
+    "fmt"
+)
+
+const (
+    // Record header flags
+    FLAG_MB = 0x80
+    FLAG_ME = 0x40
+    FLAG_CF = 0x20
+    FLAG_SR = 0x10
+    FLAG_IL = 0x08
+    // Type name formats
+    TNF_EMPTY = 0x00
+    TNF_WELL_KNOWN = 0x01
+    TNF_MEDIA = 0x02
+    TNF_ABSOLUTE_URI = 0x03
+    TNF_EXTERNAL = 0x04
+    TNF_UNKNOWN = 0x05
+    TNF_UNCHANGED = 0x06
+)
+
+// NDEF record. Chunked records are joined when parsing.
+type Record struct {
+    TNF byte
+    Type []byte
+    ID []byte
+    Payload []byte
+}
+
+// Check whether record has type name format and type.
+func (r *Record) Is(tnf byte, typ string) bool {
+    return r.TNF == tnf && string(r.Type) == typ
+}
+
+func (r *Record) String() string {
+    return fmt.Sprintf("TNF=%d type=%q payload=%X", r.TNF, r.Type,
+        r.Payload)
+}
+
+// NDEF message, a sequence of records.
+type Message []Record
+
+// Encode message. An empty message is encoded as a single empty record.
+func (m Message) Bytes() []byte {
+    if len(m) == 0 {
+        return []byte{FLAG_MB | FLAG_ME | FLAG_SR | TNF_EMPTY, 0x00, 0x00}
+    }
+    var out []byte
+    for i, r := range m {
+        header := r.TNF & 0x07
+        if i == 0 { header |= FLAG_MB }
+        if i == len(m) - 1 { header |= FLAG_ME }
+        if len(r.Payload) < 256 { header |= FLAG_SR }
+        if len(r.ID) > 0 { header |= FLAG_IL }
+        out = append(out, header, byte(len(r.Type)))
+        if header & FLAG_SR != 0 {
+            out = append(out, byte(len(r.Payload)))
+        } else {
+            var l [4]byte
+            binary.BigEndian.PutUint32(l[:], uint32(len(r.Payload)))
+            out = append(out, l[:]...)
+        }
+        if len(r.ID) > 0 { out = append(out, byte(len(r.ID))) }
+        out = append(out, r.Type...)
+        out = append(out, r.ID...)
+        out = append(out, r.Payload...)
+    }
+    return out
+}
+
+// Parse NDEF message.
+func ParseMessage(data []byte) (Message, error) {
+    var m Message
+    var chunked *Record
+    for i := 0; len(data) > 0; i++ {
+        if len(data) < 3 {
+            return nil, fmt.Errorf("truncated record header")
+        }
+        header := data[0]
+        if i == 0 && header & FLAG_MB == 0 {
+            return nil, fmt.Errorf("missing message begin flag")
+        }
+        if i > 0 && header & FLAG_MB != 0 {
+            return nil, fmt.Errorf("unexpected message begin flag")
+        }
+        typeLen := int(data[1])
+        pos := 2
+        var payloadLen int
+        if header & FLAG_SR != 0 {
+            payloadLen = int(data[pos])
+            pos++
+        } else {
+            if len(data) < pos + 4 {
+                return nil, fmt.Errorf("truncated record header")
+            }
+            l := binary.BigEndian.Uint32(data[pos:])
+            if l > uint32(len(data)) {
+                return nil, fmt.Errorf("payload length %d exceeds data", l)
+            }
+            payloadLen = int(l)
+            pos += 4
+        }
+        idLen := 0
+        if header & FLAG_IL != 0 {
+            if len(data) <= pos {
+                return nil, fmt.Errorf("truncated record header")
+            }
+            idLen = int(data[pos])
+            pos++
+        }
+        end := pos + typeLen + idLen + payloadLen
+        if len(data) < end {
+            return nil, fmt.Errorf("truncated record")
+        }
+        r := Record{TNF: header & 0x07,
+            Type: data[pos:pos+typeLen],
+            ID: data[pos+typeLen:pos+typeLen+idLen],
+            Payload: data[pos+typeLen+idLen:end]}
+        data = data[end:]
+        switch {
+            case chunked != nil:
+                // Middle or terminating chunk
+                if r.TNF != TNF_UNCHANGED || typeLen != 0 || idLen != 0 {
+                    return nil, fmt.Errorf("invalid record chunk")
+                }
+                chunked.Payload = append(chunked.Payload, r.Payload...)
+                if header & FLAG_CF == 0 {
+                    m = append(m, *chunked)
+                    chunked = nil
+                }
+            case r.TNF == TNF_UNCHANGED:
+                return nil, fmt.Errorf("unexpected record chunk")
+            case header & FLAG_CF != 0:
+                r.Payload = append([]byte{}, r.Payload...)
+                chunked = &r
+            default:
+                m = append(m, r)
+        }
+        if header & FLAG_ME != 0 {
+            if chunked != nil {
+                return nil, fmt.Errorf("message ends within chunked record")
+            }
+            if len(data) > 0 {
+                return nil, fmt.Errorf("data after message end")
+            }
+            return m, nil
+        }
+    }
+    return nil, fmt.Errorf("missing message end flag")
+}
@@ -0,0 +1,182 @@
+package ndef
+
+import (
+    "bytes"
+    "encoding/hex"
+    "strings"
+    "testing"
+    "github.com/sf1/go-card/smartcard/mock"
+)
+
+func unhex(s string) []byte {
+    b, err := hex.DecodeString(strings.Replace(s, " ", "", -1))
+    if err != nil { panic(err) }
+    return b
+}
+
+func TestURIRecord(t *testing.T) {
+    m := Message{NewURIRecord("https://www.example.com")}
+    if b := m.Bytes(); !bytes.Equal(b,
+        unhex("d1010c55026578616d706c652e636f6d")) {
+        t.Errorf("unexpected encoding %X", b)
+    }
+    for _, uri := range []string{"https://example.com/visitor/0042",
+        "tel:+4912345", "urn:epc:id:sgtin:1", "custom:x", ""} {
+        r := NewURIRecord(uri)
+        decoded, err := r.URI()
+        if err != nil { t.Fatal(err) }
+        if decoded != uri {
+            t.Errorf("got %q, want %q", decoded, uri)
+        }
+    }
+    if r := NewURIRecord("urn:epc:id:sgtin:1"); r.Payload[0] != 0x1e {
+        t.Errorf("longest prefix not used: %02X", r.Payload[0])
+    }
+}
+
+func TestTextRecord(t *testing.T) {
+    r := NewTextRecord("Hello", "en")
+    if b := (Message{r}).Bytes(); !bytes.Equal(b,
+        unhex("d101085402656e48656c6c6f")) {
+        t.Errorf("unexpected encoding %X", b)
+    }
+    // UTF-16 with and without byte order mark
+    for _, payload := range []string{"82 6465 feff 0048 00e4",
+        "82 6465 0048 00e4", "82 6465 fffe 4800 e400"} {
+        r := Record{TNF: TNF_WELL_KNOWN, Type: []byte("T"),
+            Payload: unhex(payload)}
+        text, err := r.Text()
+        if err != nil { t.Fatal(err) }
+        if text.Lang != "de" || text.Text != "Hä" {
+            t.Errorf("unexpected text %+v", text)
+        }
+    }
+}
+
+func TestSmartPoster(t *testing.T) {
+    sp := &SmartPoster{URI: "https://example.com/badge",
+        Titles: []Text{{"en", "Visitor badge"}, {"de", "Besucherausweis"}},
+        Action: ACTION_OPEN, Size: 1024, Type: "text/html",
+        Records: []Record{NewMIMERecord("image/png", []byte{0x89, 0x50})}}
+    m, err := ParseMessage((Message{NewSmartPosterRecord(sp)}).Bytes())
+    if err != nil { t.Fatal(err) }
+    decoded, err := m[0].SmartPoster()
+    if err != nil { t.Fatal(err) }
+    if decoded.URI != sp.URI || len(decoded.Titles) != 2 ||
+        decoded.Titles[1] != sp.Titles[1] || decoded.Action != ACTION_OPEN ||
+        decoded.Size != 1024 || decoded.Type != "text/html" ||
+        len(decoded.Records) != 1 ||
+        !decoded.Records[0].Is(TNF_MEDIA, "image/png") {
+        t.Errorf("unexpected smart poster %+v", decoded)
+    }
+    sp = &SmartPoster{URI: "tel:123", Action: ACTION_NONE}
+    r := NewSmartPosterRecord(sp)
+    decoded, err = r.SmartPoster()
+    if err != nil { t.Fatal(err) }
+    if decoded.Action != ACTION_NONE || len(r.Payload) != 8 {
+        t.Errorf("unexpected smart poster %+v %X", decoded, r.Payload)
+    }
+}
+
+func TestParseMessage(t *testing.T) {
+    long := bytes.Repeat([]byte{0xab}, 300)
+    m := Message{
+        NewMIMERecord("application/vnd.example", long),
+        {TNF: TNF_EXTERNAL, Type: []byte("example.com:badge"),
+            ID: []byte("1"), Payload: []byte{0x42}},
+    }
+    b := m.Bytes()
+    if b[0] != FLAG_MB | TNF_MEDIA || b[2] != 0x00 || b[5] != 0x2c {
+        t.Errorf("unexpected long record header %X", b[:6])
+    }
+    parsed, err := ParseMessage(b)
+    if err != nil { t.Fatal(err) }
+    if len(parsed) != 2 || !bytes.Equal(parsed[0].Payload, long) ||
+        string(parsed[1].ID) != "1" {
+        t.Errorf("unexpected message %v", parsed)
+    }
+    // Chunked record
+    chunked := unhex("b1 01 03 55 03 61 62  36 00 02 63 64  56 00 01 65")
+    parsed, err = ParseMessage(chunked)
+    if err != nil { t.Fatal(err) }
+    if uri, _ := parsed[0].URI(); len(parsed) != 1 || uri != "http://abcde" {
+        t.Errorf("unexpected chunked message %v", parsed)
+    }
+    for _, bad := range []string{"", "51 01 00 55", "91 01 00 55",
+        "d1 01 05 55 00", "b5 01 01 55 00", "d1 01 00 55 00"} {
+        if _, err := ParseMessage(unhex(bad)); err == nil {
+            t.Errorf("%s: no error", bad)
+        }
+    }
+    if b := (Message{}).Bytes(); !bytes.Equal(b, []byte{0xd0, 0, 0}) {
+        t.Errorf("unexpected empty message %X", b)
+    }
+}
+
+func TestType4Tag(t *testing.T) {
+    sim := newSimTag(0x3b, 0x34, 0x800, ACCESS_GRANTED)
+    tag, err := Select(sim)
+    if err != nil { t.Fatal(err) }
+    cc := tag.CapabilityContainer()
+    if cc.Version != 0x20 || cc.MLe != 0x3b || cc.FileID != 0xe104 ||
+        cc.MaxSize != 0x800 || !cc.Writable() {
+        t.Errorf("unexpected CC %+v", cc)
+    }
+    m, err := tag.ReadMessage()
+    if err != nil || m != nil {
+        t.Errorf("unexpected empty tag content %v %v", m, err)
+    }
+    m = Message{NewURIRecord("https://example.com/visitor/0042"),
+        NewTextRecord(strings.Repeat("Welcome! ", 20), "en")}
+    if err := tag.WriteMessage(m); err != nil { t.Fatal(err) }
+    // NLEN cleared, 216 bytes in 5 chunks of MLc, NLEN set
+    if sim.updates != 7 {
+        t.Errorf("unexpected number of updates: %d", sim.updates)
+    }
+    read, err := tag.ReadMessage()
+    if err != nil { t.Fatal(err) }
+    if uri, _ := read[0].URI(); len(read) != 2 ||
+        uri != "https://example.com/visitor/0042" {
+        t.Errorf("unexpected message %v", read)
+    }
+    if err := tag.WriteNDEF(make([]byte, 0x7ff)); err == nil {
+        t.Errorf("oversized message written")
+    }
+}
+
+func TestReadOnlyTag(t *testing.T) {
+    tag, err := Select(newSimTag(0xff, 0xff, 0x100, ACCESS_DENIED))
+    if err != nil { t.Fatal(err) }
+    if err := tag.WriteMessage(Message{NewURIRecord("tel:1")}); err == nil {
+        t.Errorf("read-only tag written")
+    }
+}
+
+// Detection and read of a factory NTAG 424 DNA (capability container of
+// the datasheet) holding the "http://www.nfc.com" example of the NFC Forum
+// URI RTD.
+func TestType4TagTrace(t *testing.T) {
+    card := mock.NewCard(nil).
+        Expect("00 a4 04 00 07 d2 76 00 00 85 01 01 00", "90 00").
+        Expect("00 a4 00 0c 02 e1 03", "90 00").
+        Expect("00 b0 00 00 0f",
+            "00 17 20 01 00 00 ff 04 06 e1 04 01 00 00 00 90 00").
+        Expect("00 a4 00 0c 02 e1 04", "90 00").
+        Expect("00 b0 00 00 02", "00 0c 90 00").
+        Expect("00 b0 00 02 0c", "d1 01 08 55 01 6e 66 63 2e 63 6f 6d 90 00")
+    tag, err := Select(card)
+    if err != nil { t.Fatal(err) }
+    cc := tag.CapabilityContainer()
+    if cc.Len != 0x17 || cc.Version != 0x20 || cc.MLe != 0x100 ||
+        cc.MLc != 0xff || cc.FileID != 0xe104 || cc.MaxSize != 0x100 ||
+        !cc.Writable() {
+        t.Errorf("unexpected capability container %+v", cc)
+    }
+    m, err := tag.ReadMessage()
+    if err != nil { t.Fatal(err) }
+    if uri, err := m[0].URI(); len(m) != 1 || err != nil ||
+        uri != "http://www.nfc.com" {
+        t.Errorf("unexpected message %v", m)
+    }
+    card.AssertExpectations(t)
+}
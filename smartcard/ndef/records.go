@@ -0,0 +1,221 @@
+package ndef
+
+import (
+    "encoding/binary"
+    "fmt"
+    "strings"
+    "unicode/utf16"
+    "unicode/utf8"
+)
+
+// URI identifier codes (NFC Forum URI RTD 1.0). The index is the code.
+var URIPrefixes = []string{
+    "",
+    "http://www.",
+    "https://www.",
+    "http://",
+    "https://",
+    "tel:",
+    "mailto:",
+    "ftp://anonymous:anonymous@",
+    "ftp://ftp.",
+    "ftps://",
+    "sftp://",
+    "smb://",
+    "nfs://",
+    "ftp://",
+    "dav://",
+    "news:",
+    "telnet://",
+    "imap:",
+    "rtsp://",
+    "urn:",
+    "pop:",
+    "sip:",
+    "sips:",
+    "tftp:",
+    "btspp://",
+    "btl2cap://",
+    "btgoep://",
+    "tcpobex://",
+    "irdaobex://",
+    "file://",
+    "urn:epc:id:",
+    "urn:epc:tag:",
+    "urn:epc:pat:",
+    "urn:epc:raw:",
+    "urn:epc:",
+    "urn:nfc:",
+}
+
+// Create URI record, abbreviating the longest matching prefix.
+func NewURIRecord(uri string) Record {
+    code := 0
+    for i, p := range URIPrefixes {
+        if len(p) > len(URIPrefixes[code]) && strings.HasPrefix(uri, p) {
+            code = i
+        }
+    }
+    payload := append([]byte{byte(code)}, uri[len(URIPrefixes[code]):]...)
+    return Record{TNF: TNF_WELL_KNOWN, Type: []byte("U"), Payload: payload}
+}
+
+// Return URI of URI record or absolute URI record.
+func (r *Record) URI() (string, error) {
+    if r.TNF == TNF_ABSOLUTE_URI {
+        return string(r.Type), nil
+    }
+    if !r.Is(TNF_WELL_KNOWN, "U") {
+        return "", fmt.Errorf("not a URI record: %s", r)
+    }
+    if len(r.Payload) < 1 {
+        return "", fmt.Errorf("empty URI record")
+    }
+    code := int(r.Payload[0])
+    if code >= len(URIPrefixes) {
+        return "", fmt.Errorf("unknown URI identifier code %02X", code)
+    }
+    return URIPrefixes[code] + string(r.Payload[1:]), nil
+}
+
+// Text with IANA language code.
+type Text struct {
+    Lang string
+    Text string
+}
+
+// Create Text record with UTF-8 encoding.
+func NewTextRecord(text, lang string) Record {
+    payload := append([]byte{byte(len(lang)) & 0x3f}, lang...)
+    payload = append(payload, text...)
+    return Record{TNF: TNF_WELL_KNOWN, Type: []byte("T"), Payload: payload}
+}
+
+// Return text and language of Text record. UTF-16 text without byte
+// order mark is big-endian.
+func (r *Record) Text() (*Text, error) {
+    if !r.Is(TNF_WELL_KNOWN, "T") {
+        return nil, fmt.Errorf("not a Text record: %s", r)
+    }
+    if len(r.Payload) < 1 {
+        return nil, fmt.Errorf("empty Text record")
+    }
+    status := r.Payload[0]
+    n := int(status & 0x3f)
+    if len(r.Payload) < 1 + n {
+        return nil, fmt.Errorf("truncated language code")
+    }
+    t := &Text{Lang: string(r.Payload[1:1+n])}
+    data := r.Payload[1+n:]
+    if status & 0x80 == 0 {
+        if !utf8.Valid(data) {
+            return nil, fmt.Errorf("invalid UTF-8 text")
+        }
+        t.Text = string(data)
+        return t, nil
+    }
+    if len(data) % 2 != 0 {
+        return nil, fmt.Errorf("invalid UTF-16 text length")
+    }
+    var order binary.ByteOrder = binary.BigEndian
+    if len(data) >= 2 {
+        switch {
+            case data[0] == 0xfe && data[1] == 0xff:
+                data = data[2:]
+            case data[0] == 0xff && data[1] == 0xfe:
+                order = binary.LittleEndian
+                data = data[2:]
+        }
+    }
+    units := make([]uint16, len(data) / 2)
+    for i := range units {
+        units[i] = order.Uint16(data[2*i:])
+    }
+    t.Text = string(utf16.Decode(units))
+    return t, nil
+}
+
+// Create media-type record.
+func NewMIMERecord(mimeType string, data []byte) Record {
+    return Record{TNF: TNF_MEDIA, Type: []byte(mimeType), Payload: data}
+}
+
+// Smart Poster actions
+const (
+    ACTION_NONE = -1
+    ACTION_DO = 0
+    ACTION_SAVE = 1
+    ACTION_OPEN = 2
+)
+
+// Smart Poster (NFC Forum Smart Poster RTD 1.0). Size 0 and empty Type
+// are omitted.
+type SmartPoster struct {
+    URI string
+    Titles []Text
+    Action int
+    Size uint32
+    Type string
+    // Other records, e.g. icons
+    Records []Record
+}
+
+// Create Smart Poster record.
+func NewSmartPosterRecord(sp *SmartPoster) Record {
+    m := Message{NewURIRecord(sp.URI)}
+    for _, t := range sp.Titles {
+        m = append(m, NewTextRecord(t.Text, t.Lang))
+    }
+    if sp.Action != ACTION_NONE {
+        m = append(m, Record{TNF: TNF_WELL_KNOWN, Type: []byte("act"),
+            Payload: []byte{byte(sp.Action)}})
+    }
+    if sp.Size != 0 {
+        var s [4]byte
+        binary.BigEndian.PutUint32(s[:], sp.Size)
+        m = append(m, Record{TNF: TNF_WELL_KNOWN, Type: []byte("s"),
+            Payload: s[:]})
+    }
+    if sp.Type != "" {
+        m = append(m, Record{TNF: TNF_WELL_KNOWN, Type: []byte("t"),
+            Payload: []byte(sp.Type)})
+    }
+    m = append(m, sp.Records...)
+    return Record{TNF: TNF_WELL_KNOWN, Type: []byte("Sp"),
+        Payload: m.Bytes()}
+}
+
+// Decode Smart Poster record.
+func (r *Record) SmartPoster() (*SmartPoster, error) {
+    if !r.Is(TNF_WELL_KNOWN, "Sp") {
+        return nil, fmt.Errorf("not a Smart Poster record: %s", r)
+    }
+    m, err := ParseMessage(r.Payload)
+    if err != nil { return nil, err }
+    sp := &SmartPoster{Action: ACTION_NONE}
+    uris := 0
+    for i := range m {
+        rec := &m[i]
+        switch {
+            case rec.Is(TNF_WELL_KNOWN, "U"):
+                if sp.URI, err = rec.URI(); err != nil { return nil, err }
+                uris++
+            case rec.Is(TNF_WELL_KNOWN, "T"):
+                t, err := rec.Text()
+                if err != nil { return nil, err }
+                sp.Titles = append(sp.Titles, *t)
+            case rec.Is(TNF_WELL_KNOWN, "act") && len(rec.Payload) == 1:
+                sp.Action = int(rec.Payload[0])
+            case rec.Is(TNF_WELL_KNOWN, "s") && len(rec.Payload) == 4:
+                sp.Size = binary.BigEndian.Uint32(rec.Payload)
+            case rec.Is(TNF_WELL_KNOWN, "t"):
+                sp.Type = string(rec.Payload)
+            default:
+                sp.Records = append(sp.Records, *rec)
+        }
+    }
+    if uris != 1 {
+        return nil, fmt.Errorf("Smart Poster has %d URI records", uris)
+    }
+    return sp, nil
+}
@@ -0,0 +1,86 @@
+package ndef
+
+import (
+    "github.com/sf1/go-card/smartcard"
+    "github.com/sf1/go-card/smartcard/mock"
+)
+
+// Simulated Type 4 Tag (mapping version 2.0) for tests: a mock card with a
+// rule per instruction working on the tag files.
+type simTag struct {
+    *mock.Card
+    files map[uint16][]byte
+    selectedApp bool
+    selected uint16
+    mle, mlc int
+    // Number of UPDATE BINARY commands
+    updates int
+}
+
+func newSimTag(mle, mlc, size int, writeAccess byte) *simTag {
+    cc := []byte{0x00, 0x0f, 0x20, byte(mle >> 8), byte(mle),
+        byte(mlc >> 8), byte(mlc), 0x04, 0x06, 0xe1, 0x04,
+        byte(size >> 8), byte(size), 0x00, writeAccess}
+    s := &simTag{
+        files: map[uint16][]byte{FID_CC: cc, 0xe104: make([]byte, size)},
+        mle: mle, mlc: mlc,
+    }
+    s.Card = mock.NewCard(mock.Hex("3b 80 80 01 01")).
+        RuleFunc("00 a4 04 00 *", s.selectApplication).
+        RuleFunc("00 a4 00 0c 02 ?? ??", s.selectFile).
+        Rule("00 a4 *", "6a 86").
+        RuleFunc("00 b0 *", s.read).
+        RuleFunc("00 d6 *", s.update)
+    return s
+}
+
+func sw(code uint16) (smartcard.ResponseAPDU, error) {
+    return smartcard.ResponseAPDU{byte(code >> 8), byte(code)}, nil
+}
+
+func (s *simTag) selectApplication(cmd smartcard.CommandAPDU) (
+    smartcard.ResponseAPDU, error) {
+    if string(cmd.Data()) != string(AID) { return sw(0x6a82) }
+    s.selectedApp, s.selected = true, 0
+    return sw(0x9000)
+}
+
+func (s *simTag) selectFile(cmd smartcard.CommandAPDU) (
+    smartcard.ResponseAPDU, error) {
+    if !s.selectedApp { return sw(0x6a86) }
+    fid := uint16(cmd[5]) << 8 | uint16(cmd[6])
+    if s.files[fid] == nil { return sw(0x6a82) }
+    s.selected = fid
+    return sw(0x9000)
+}
+
+func (s *simTag) read(cmd smartcard.CommandAPDU) (smartcard.ResponseAPDU,
+    error) {
+    file := s.files[s.selected]
+    if file == nil { return sw(0x6986) }
+    l, _ := cmd.Le()
+    offset, le := int(cmd[2]) << 8 | int(cmd[3]), int(l)
+    if le == 0 { le = 256 }
+    if le > s.mle && s.selected != FID_CC { return sw(0x6700) }
+    if offset > len(file) { return sw(0x6b00) }
+    end := offset + le
+    if end > len(file) { end = len(file) }
+    rsp := append(append([]byte{}, file[offset:end]...), 0x90, 0x00)
+    return smartcard.ResponseAPDU(rsp), nil
+}
+
+func (s *simTag) update(cmd smartcard.CommandAPDU) (smartcard.ResponseAPDU,
+    error) {
+    file := s.files[s.selected]
+    if file == nil { return sw(0x6986) }
+    if s.selected == FID_CC || s.files[FID_CC][14] != 0x00 {
+        return sw(0x6982)
+    }
+    data := cmd.Data()
+    if len(data) > s.mlc { return sw(0x6700) }
+    offset := int(cmd[2]) << 8 | int(cmd[3])
+    if offset + len(data) > len(file) { return sw(0x6b00) }
+    copy(file[offset:], data)
+    s.updates++
+    return sw(0x9000)
+}
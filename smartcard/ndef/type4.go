@@ -0,0 +1,230 @@
+package ndef
+
+import (
+    "encoding/binary"
+    "fmt"
+    "github.com/sf1/go-card/smartcard"
+    "github.com/sf1/go-card/smartcard/SW"
+)
+
+var (
+    // NDEF Tag Application (T4T 2.0 and later)
+    AID = []byte{0xd2, 0x76, 0x00, 0x00, 0x85, 0x01, 0x01}
+    // NDEF Tag Application (T4T 1.0)
+    AID_V1 = []byte{0xd2, 0x76, 0x00, 0x00, 0x85, 0x01, 0x00}
+)
+
+const (
+    // Capability container file identifier
+    FID_CC = 0xe103
+    // Instructions
+    INS_SELECT = 0xa4
+    INS_READ_BINARY = 0xb0
+    INS_UPDATE_BINARY = 0xd6
+    // Access conditions
+    ACCESS_GRANTED = 0x00
+    ACCESS_DENIED = 0xff
+    // Size of the NLEN field
+    NLEN_SIZE = 2
+)
+
+// Type 4 Tag capability container.
+type CapabilityContainer struct {
+    Len int
+    Version byte
+    // Maximum R-APDU data size
+    MLe int
+    // Maximum C-APDU data size
+    MLc int
+    // NDEF file control TLV
+    FileID uint16
+    MaxSize int
+    ReadAccess byte
+    WriteAccess byte
+}
+
+// Check if NDEF file can be written.
+func (cc *CapabilityContainer) Writable() bool {
+    return cc.WriteAccess == ACCESS_GRANTED
+}
+
+// Parse capability container file.
+func ParseCapabilityContainer(data []byte) (*CapabilityContainer, error) {
+    if len(data) < 15 {
+        return nil, fmt.Errorf("capability container too short")
+    }
+    cc := &CapabilityContainer{
+        Len: int(binary.BigEndian.Uint16(data)),
+        Version: data[2],
+        MLe: int(binary.BigEndian.Uint16(data[3:])),
+        MLc: int(binary.BigEndian.Uint16(data[5:])),
+    }
+    if cc.Version >> 4 != 1 && cc.Version >> 4 != 2 {
+        return nil, fmt.Errorf("unsupported mapping version %d.%d",
+            cc.Version >> 4, cc.Version & 0x0f)
+    }
+    if data[7] != 0x04 || data[8] != 0x06 {
+        return nil, fmt.Errorf("NDEF file control TLV missing")
+    }
+    cc.FileID = binary.BigEndian.Uint16(data[9:])
+    cc.MaxSize = int(binary.BigEndian.Uint16(data[11:]))
+    cc.ReadAccess = data[13]
+    cc.WriteAccess = data[14]
+    if cc.MLe < 1 || cc.MLc < 1 || cc.MaxSize < NLEN_SIZE {
+        return nil, fmt.Errorf("invalid capability container")
+    }
+    return cc, nil
+}
+
+// Type 4 Tag with selected NDEF application.
+type Tag struct {
+    card smartcard.Transmitter
+    cc *CapabilityContainer
+    selected uint16
+}
+
+// Select NDEF Tag Application and read capability container.
+func Select(card smartcard.Transmitter) (*Tag, error) {
+    t := &Tag{card: card}
+    // Mapping version 2.0 requires Le, version 1.0 tags may reject it
+    _, err := t.transmit(smartcard.Command4(0x00, INS_SELECT, 0x04, 0x00,
+        AID, 0x00))
+    if err != nil {
+        if _, ok := err.(smartcard.SWError); !ok { return nil, err }
+        if _, err := t.transmit(smartcard.Command3(0x00, INS_SELECT, 0x04,
+            0x00, AID_V1)); err != nil {
+            return nil, fmt.Errorf("selecting NDEF application: %s", err)
+        }
+    }
+    if err := t.selectFile(FID_CC); err != nil { return nil, err }
+    data, err := t.transmit(smartcard.Command2(0x00, INS_READ_BINARY, 0x00,
+        0x00, 15))
+    if err != nil {
+        return nil, fmt.Errorf("reading capability container: %s", err)
+    }
+    t.cc, err = ParseCapabilityContainer(data)
+    if err != nil { return nil, err }
+    return t, nil
+}
+
+// Return underlying transmitter.
+func (t *Tag) Transmitter() smartcard.Transmitter {
+    return t.card
+}
+
+// Return capability container.
+func (t *Tag) CapabilityContainer() *CapabilityContainer {
+    return t.cc
+}
+
+func (t *Tag) transmit(cmd smartcard.CommandAPDU) ([]byte, error) {
+    rsp, err := t.card.TransmitAPDU(cmd)
+    if err != nil { return nil, err }
+    if rsp.SW() != SW.SUCCESS {
+        return nil, smartcard.SWError(rsp.SW())
+    }
+    return rsp.Data(), nil
+}
+
+func (t *Tag) selectFile(fid uint16) error {
+    if t.selected == fid && fid != 0 { return nil }
+    p2 := byte(0x0c)
+    if t.cc != nil && t.cc.Version >> 4 == 1 { p2 = 0x00 }
+    _, err := t.transmit(smartcard.Command3(0x00, INS_SELECT, 0x00, p2,
+        []byte{byte(fid >> 8), byte(fid)}))
+    if err != nil {
+        t.selected = 0
+        return fmt.Errorf("selecting file %04X: %s", fid, err)
+    }
+    t.selected = fid
+    return nil
+}
+
+// Read n bytes at offset of the selected file in chunks of at most MLe.
+func (t *Tag) read(offset, n int) ([]byte, error) {
+    chunk := 255
+    if t.cc != nil && t.cc.MLe < chunk { chunk = t.cc.MLe }
+    var out []byte
+    for n > 0 {
+        l := n
+        if l > chunk { l = chunk }
+        data, err := t.transmit(smartcard.Command2(0x00, INS_READ_BINARY,
+            byte(offset >> 8), byte(offset), byte(l)))
+        if err != nil {
+            return nil, fmt.Errorf("reading offset %d: %s", offset, err)
+        }
+        if len(data) == 0 || len(data) > l {
+            return nil, fmt.Errorf("reading offset %d: got %d bytes", offset,
+                len(data))
+        }
+        out = append(out, data...)
+        offset += len(data)
+        n -= len(data)
+    }
+    return out, nil
+}
+
+// Write data at offset of the selected file in chunks of at most MLc.
+func (t *Tag) write(offset int, data []byte) error {
+    chunk := 255
+    if t.cc.MLc < chunk { chunk = t.cc.MLc }
+    for len(data) > 0 {
+        l := len(data)
+        if l > chunk { l = chunk }
+        _, err := t.transmit(smartcard.Command3(0x00, INS_UPDATE_BINARY,
+            byte(offset >> 8), byte(offset), data[:l]))
+        if err != nil {
+            return fmt.Errorf("writing offset %d: %s", offset, err)
+        }
+        offset += l
+        data = data[l:]
+    }
+    return nil
+}
+
+// Read raw NDEF message.
+func (t *Tag) ReadNDEF() ([]byte, error) {
+    if t.cc.ReadAccess != ACCESS_GRANTED {
+        return nil, fmt.Errorf("NDEF file not readable (access %02X)",
+            t.cc.ReadAccess)
+    }
+    if err := t.selectFile(t.cc.FileID); err != nil { return nil, err }
+    nlen, err := t.read(0, NLEN_SIZE)
+    if err != nil { return nil, err }
+    n := int(binary.BigEndian.Uint16(nlen))
+    if n > t.cc.MaxSize - NLEN_SIZE {
+        return nil, fmt.Errorf("NDEF length %d exceeds file size %d", n,
+            t.cc.MaxSize)
+    }
+    return t.read(NLEN_SIZE, n)
+}
+
+// Read and parse NDEF message. Returns nil for an empty NDEF file.
+func (t *Tag) ReadMessage() (Message, error) {
+    data, err := t.ReadNDEF()
+    if err != nil || len(data) == 0 { return nil, err }
+    return ParseMessage(data)
+}
+
+// Write raw NDEF message. NLEN is cleared during the update, so an
+// interrupted write leaves an empty NDEF file rather than a corrupted
+// message.
+func (t *Tag) WriteNDEF(data []byte) error {
+    if !t.cc.Writable() {
+        return fmt.Errorf("NDEF file is read-only (access %02X)",
+            t.cc.WriteAccess)
+    }
+    if len(data) > t.cc.MaxSize - NLEN_SIZE {
+        return fmt.Errorf("NDEF message of %d bytes exceeds maximum of %d",
+            len(data), t.cc.MaxSize - NLEN_SIZE)
+    }
+    if err := t.selectFile(t.cc.FileID); err != nil { return err }
+    if err := t.write(0, []byte{0x00, 0x00}); err != nil { return err }
+    if err := t.write(NLEN_SIZE, data); err != nil { return err }
+    return t.write(0, []byte{byte(len(data) >> 8), byte(len(data))})
+}
+
+// Encode and write NDEF message.
+func (t *Tag) WriteMessage(m Message) error {
+    return t.WriteNDEF(m.Bytes())
+}
@@ -0,0 +1,237 @@
+package ntag
+
+import (
+    "fmt"
+)
+
+// Tag model and memory layout.
+type Model struct {
+    Name string
+    // Total number of pages
+    Pages int
+    // First and last user memory page
+    UserStart int
+    UserEnd int
+    // Page holding the dynamic lock bytes, 0 if not supported
+    DynamicLockPage int
+    // Number of pages locked by one dynamic lock bit
+    DynamicLockGranularity int
+    // First configuration page (CFG0, followed by CFG1, PWD and PACK)
+    ConfigPage int
+    productType byte
+    storageSize byte
+}
+
+// Supported tag models.
+var Models = []Model{
+    {"NTAG213", 45, 4, 39, 40, 2, 41, 0x04, 0x0f},
+    {"NTAG215", 135, 4, 129, 130, 16, 131, 0x04, 0x11},
+    {"NTAG216", 231, 4, 225, 226, 16, 227, 0x04, 0x13},
+    {"MIFARE Ultralight EV1 MF0UL11", 20, 4, 15, 0, 0, 16, 0x03, 0x0b},
+    {"MIFARE Ultralight EV1 MF0UL21", 41, 4, 35, 0, 0, 37, 0x03, 0x0e},
+}
+
+// Return user memory size in bytes.
+func (m *Model) UserSize() int {
+    return (m.UserEnd - m.UserStart + 1) * PAGE_SIZE
+}
+
+// Capability Container (page 3) of NFC Forum Type 2 tags.
+type CapabilityContainer struct {
+    // 0xE1 if the tag is NDEF formatted
+    Magic byte
+    // Major version in the upper nibble
+    Version byte
+    // Data area size in bytes
+    Size int
+    // 0x00 read/write, 0x0F read-only
+    Access byte
+}
+
+// Check if the tag is formatted for NDEF.
+func (c *CapabilityContainer) NDEF() bool {
+    return c.Magic == 0xe1
+}
+
+// Check if write access is denied.
+func (c *CapabilityContainer) ReadOnly() bool {
+    return c.Access & 0x0f != 0
+}
+
+// Return encoded capability container.
+func (c *CapabilityContainer) Bytes() []byte {
+    return []byte{c.Magic, c.Version, byte(c.Size / 8), c.Access}
+}
+
+// Read capability container.
+func (t *Tag) CapabilityContainer() (*CapabilityContainer, error) {
+    data, err := t.Read(3)
+    if err != nil { return nil, err }
+    return &CapabilityContainer{
+        Magic: data[0],
+        Version: data[1],
+        Size: int(data[2]) * 8,
+        Access: data[3],
+    }, nil
+}
+
+// Lock bytes.
+type Locks struct {
+    // Static lock bytes (page 2, bytes 2 and 3)
+    Static [2]byte
+    // Dynamic lock bytes, nil if the model has none
+    Dynamic []byte
+    model *Model
+}
+
+// Check if page is locked (read-only).
+func (l *Locks) PageLocked(page int) bool {
+    switch {
+        case page < 3:
+            return true
+        case page < 8:
+            // L-CC (bit 3) and L4 to L7 in lock byte 0
+            return l.Static[0] & (1 << uint(page)) != 0
+        case page < 16:
+            return l.Static[1] & (1 << uint(page - 8)) != 0
+        case l.Dynamic == nil || l.model == nil ||
+            page > l.model.UserEnd:
+            return false
+    }
+    group := (page - 16) / l.model.DynamicLockGranularity
+    if group / 8 > 1 {
+        return false
+    }
+    return l.Dynamic[group / 8] & (1 << uint(group % 8)) != 0
+}
+
+// Check if the static lock bit of page can no longer be changed (block
+// lock bits BL-CC, BL 9-4 and BL 15-10).
+func (l *Locks) BlockLocked(page int) bool {
+    switch {
+        case page == 3:
+            return l.Static[0] & 0x01 != 0
+        case page >= 4 && page <= 9:
+            return l.Static[0] & 0x02 != 0
+        case page >= 10 && page <= 15:
+            return l.Static[0] & 0x04 != 0
+    }
+    return false
+}
+
+// Read static and dynamic lock bytes.
+func (t *Tag) Locks() (*Locks, error) {
+    model, err := t.Identify()
+    if err != nil { return nil, err }
+    data, err := t.Read(2)
+    if err != nil { return nil, err }
+    locks := &Locks{Static: [2]byte{data[2], data[3]}, model: model}
+    if model.DynamicLockPage != 0 {
+        data, err = t.Read(model.DynamicLockPage)
+        if err != nil { return nil, err }
+        locks.Dynamic = data[:3]
+    }
+    return locks, nil
+}
+
+// Lock pages by setting static lock bits (ORed with the current value).
+// Locking is irreversible.
+func (t *Tag) SetStaticLock(lock [2]byte) error {
+    return t.WritePage(2, []byte{0x00, 0x00, lock[0], lock[1]})
+}
+
+// Configuration pages.
+type Config struct {
+    // NTAG21x: MIRROR byte and page; Ultralight EV1: MOD byte
+    Mirror byte
+    MirrorPage byte
+    // First page protected by the password
+    AUTH0 int
+    // Protect read access as well as write access
+    ReadProtected bool
+    // Configuration permanently locked
+    ConfigLocked bool
+    // NTAG21x NFC counter enabled and password protected
+    CounterEnabled bool
+    CounterProtected bool
+    // Maximum number of failed password attempts, 0 for no limit
+    AuthLimit int
+}
+
+const (
+    accessProt = 0x80
+    accessCfgLck = 0x40
+    accessNFCCntEn = 0x10
+    accessNFCCntPwdProt = 0x08
+)
+
+func parseConfig(data []byte) *Config {
+    access := data[4]
+    return &Config{
+        Mirror: data[0],
+        MirrorPage: data[2],
+        AUTH0: int(data[3]),
+        ReadProtected: access & accessProt != 0,
+        ConfigLocked: access & accessCfgLck != 0,
+        CounterEnabled: access & accessNFCCntEn != 0,
+        CounterProtected: access & accessNFCCntPwdProt != 0,
+        AuthLimit: int(access & 0x07),
+    }
+}
+
+// Return CFG0 and CFG1 pages.
+func (c *Config) Bytes() []byte {
+    access := byte(c.AuthLimit & 0x07)
+    if c.ReadProtected {
+        access |= accessProt
+    }
+    if c.ConfigLocked {
+        access |= accessCfgLck
+    }
+    if c.CounterEnabled {
+        access |= accessNFCCntEn
+    }
+    if c.CounterProtected {
+        access |= accessNFCCntPwdProt
+    }
+    return []byte{c.Mirror, 0x00, c.MirrorPage, byte(c.AUTH0),
+        access, 0x00, 0x00, 0x00}
+}
+
+// Read configuration pages.
+func (t *Tag) Config() (*Config, error) {
+    model, err := t.Identify()
+    if err != nil { return nil, err }
+    data, err := t.Read(model.ConfigPage)
+    if err != nil { return nil, err }
+    return parseConfig(data), nil
+}
+
+// Write configuration pages CFG0 and CFG1.
+func (t *Tag) WriteConfig(c *Config) error {
+    model, err := t.Identify()
+    if err != nil { return err }
+    if c.AuthLimit < 0 || c.AuthLimit > 7 {
+        return fmt.Errorf("invalid authentication limit %d", c.AuthLimit)
+    }
+    data := c.Bytes()
+    // CFG1 first, so protection only applies once the limit is set
+    if err := t.WritePage(model.ConfigPage + 1, data[4:]); err != nil {
+        return err
+    }
+    return t.WritePage(model.ConfigPage, data[:4])
+}
+
+// Set 4 byte password and 2 byte password acknowledge.
+func (t *Tag) SetPassword(password, pack []byte) error {
+    model, err := t.Identify()
+    if err != nil { return err }
+    if len(password) != 4 || len(pack) != 2 {
+        return fmt.Errorf("password must be 4 and PACK 2 bytes")
+    }
+    if err := t.WritePage(model.ConfigPage + 2, password); err != nil {
+        return err
+    }
+    return t.WritePage(model.ConfigPage + 3, append(append([]byte{},
+        pack...), 0x00, 0x00))
+}
@@ -0,0 +1,220 @@
+/*
+Package ntag implements access to NXP NTAG21x and MIFARE Ultralight EV1
+memory tags on PC/SC contactless readers. Pages are read and written with
+the storage card pseudo-APDUs of PC/SC Part 3 (READ BINARY and UPDATE
+BINARY); tag commands without a pseudo-APDU (PWD_AUTH, READ_CNT, READ_SIG,
+GET_VERSION) are sent through the reader's transparent exchange.
+
+Example:
+
+    tag := ntag.New(card)
+    model, err := tag.Identify()
+    // handle error, if any
+    data, err := tag.ReadPages(model.UserStart, model.UserEnd)
+*/
+package ntag
+
+import (
+    "fmt"
+    "github.com/sf1/go-card/smartcard"
+    "github.com/sf1/go-card/smartcard/SW"
+)
+
+const (
+    // Pseudo-APDU instructions (PC/SC Part 3)
+    INS_GET_DATA = 0xca
+    INS_READ_BINARY = 0xb0
+    INS_UPDATE_BINARY = 0xd6
+    // Tag commands
+    CMD_GET_VERSION = 0x60
+    CMD_READ = 0x30
+    CMD_FAST_READ = 0x3a
+    CMD_WRITE = 0xa2
+    CMD_READ_CNT = 0x39
+    CMD_READ_SIG = 0x3c
+    CMD_PWD_AUTH = 0x1b
+    // Page size in bytes
+    PAGE_SIZE = 4
+)
+
+// Tag on a contactless reader.
+type Tag struct {
+    card smartcard.Transmitter
+    transceiver Transceiver
+    model *Model
+}
+
+// Create tag from transmitter, e.g. a *smartcard.Card. Tag commands are
+// sent with PC/SC transparent exchange unless another transceiver is set.
+func New(card smartcard.Transmitter) *Tag {
+    return &Tag{card: card, transceiver: NewPCSCTransceiver(card)}
+}
+
+// Set transceiver used for tag commands.
+func (t *Tag) SetTransceiver(transceiver Transceiver) {
+    t.transceiver = transceiver
+}
+
+// Send raw tag command and return the tag's response.
+func (t *Tag) Transceive(cmd []byte) ([]byte, error) {
+    return t.transceiver.Transceive(cmd)
+}
+
+func (t *Tag) transmit(cmd smartcard.CommandAPDU) ([]byte, error) {
+    rsp, err := t.card.TransmitAPDU(cmd)
+    if err != nil { return nil, err }
+    if rsp.SW() != SW.SUCCESS {
+        return nil, smartcard.SWError(rsp.SW())
+    }
+    return rsp.Data(), nil
+}
+
+// Return UID of the tag (GET DATA pseudo-APDU).
+func (t *Tag) UID() ([]byte, error) {
+    return t.transmit(smartcard.Command2(0xff, INS_GET_DATA, 0x00, 0x00,
+        0x00))
+}
+
+// Read four pages (16 bytes) starting at page. Reads wrap around at the
+// end of the memory as done by the tag's READ command.
+func (t *Tag) Read(page int) ([]byte, error) {
+    data, err := t.transmit(smartcard.Command2(0xff, INS_READ_BINARY,
+        byte(page >> 8), byte(page), 4 * PAGE_SIZE))
+    if err != nil {
+        return nil, fmt.Errorf("reading page %d: %s", page, err)
+    }
+    if len(data) != 4 * PAGE_SIZE {
+        return nil, fmt.Errorf("reading page %d: got %d bytes", page,
+            len(data))
+    }
+    return data, nil
+}
+
+// Read pages first to last (inclusive).
+func (t *Tag) ReadPages(first, last int) ([]byte, error) {
+    if last < first {
+        return nil, fmt.Errorf("invalid page range %d-%d", first, last)
+    }
+    var out []byte
+    for page := first; page <= last; page += 4 {
+        data, err := t.Read(page)
+        if err != nil { return nil, err }
+        out = append(out, data...)
+    }
+    return out[:(last - first + 1) * PAGE_SIZE], nil
+}
+
+// Write one page (4 bytes).
+func (t *Tag) WritePage(page int, data []byte) error {
+    if len(data) != PAGE_SIZE {
+        return fmt.Errorf("page data must be %d bytes", PAGE_SIZE)
+    }
+    _, err := t.transmit(smartcard.Command3(0xff, INS_UPDATE_BINARY,
+        byte(page >> 8), byte(page), data))
+    if err != nil {
+        return fmt.Errorf("writing page %d: %s", page, err)
+    }
+    return nil
+}
+
+// Write data starting at page, padding the last page with zeros.
+func (t *Tag) Write(page int, data []byte) error {
+    for len(data) > 0 {
+        chunk := make([]byte, PAGE_SIZE)
+        n := copy(chunk, data)
+        if err := t.WritePage(page, chunk); err != nil {
+            return err
+        }
+        data = data[n:]
+        page++
+    }
+    return nil
+}
+
+// Version information returned by GET_VERSION.
+type Version struct {
+    Raw []byte
+    Vendor byte
+    ProductType byte
+    ProductSubtype byte
+    MajorVersion byte
+    MinorVersion byte
+    StorageSize byte
+    ProtocolType byte
+}
+
+// Send GET_VERSION.
+func (t *Tag) GetVersion() (*Version, error) {
+    data, err := t.Transceive([]byte{CMD_GET_VERSION})
+    if err != nil { return nil, err }
+    if len(data) != 8 {
+        return nil, fmt.Errorf("invalid GET_VERSION response %X", data)
+    }
+    return &Version{
+        Raw: data,
+        Vendor: data[1],
+        ProductType: data[2],
+        ProductSubtype: data[3],
+        MajorVersion: data[4],
+        MinorVersion: data[5],
+        StorageSize: data[6],
+        ProtocolType: data[7],
+    }, nil
+}
+
+// Identify tag model with GET_VERSION.
+func (t *Tag) Identify() (*Model, error) {
+    if t.model != nil {
+        return t.model, nil
+    }
+    v, err := t.GetVersion()
+    if err != nil { return nil, err }
+    for i := range Models {
+        m := &Models[i]
+        if m.productType == v.ProductType && m.storageSize == v.StorageSize {
+            t.model = m
+            return m, nil
+        }
+    }
+    return nil, fmt.Errorf("unknown tag version %X", v.Raw)
+}
+
+// Authenticate with 4 byte password and return the 2 byte password
+// acknowledge (PACK) for the caller to check.
+func (t *Tag) PasswordAuth(password []byte) ([]byte, error) {
+    if len(password) != 4 {
+        return nil, fmt.Errorf("password must be 4 bytes")
+    }
+    pack, err := t.Transceive(append([]byte{CMD_PWD_AUTH}, password...))
+    if err != nil {
+        return nil, fmt.Errorf("password authentication failed: %s", err)
+    }
+    if len(pack) != 2 {
+        return nil, fmt.Errorf("password authentication failed")
+    }
+    return pack, nil
+}
+
+// Read 24-bit one-way counter (NTAG21x: counter 2, the NFC counter;
+// Ultralight EV1: counters 0 to 2).
+func (t *Tag) ReadCounter(counter int) (uint32, error) {
+    data, err := t.Transceive([]byte{CMD_READ_CNT, byte(counter)})
+    if err != nil { return 0, err }
+    if len(data) != 3 {
+        return 0, fmt.Errorf("invalid READ_CNT response %X", data)
+    }
+    // least significant byte first
+    return uint32(data[0]) | uint32(data[1]) << 8 | uint32(data[2]) << 16,
+        nil
+}
+
+// Read 32 byte originality signature.
+func (t *Tag) ReadSignature() ([]byte, error) {
+    data, err := t.Transceive([]byte{CMD_READ_SIG, 0x00})
+    if err != nil { return nil, err }
+    if len(data) != 32 {
+        return nil, fmt.Errorf("invalid READ_SIG response length %d",
+            len(data))
+    }
+    return data, nil
+}
@@ -0,0 +1,194 @@
+package ntag
+
+import (
+    "bytes"
+    "crypto/elliptic"
+    "testing"
+    "github.com/sf1/go-card/smartcard/mock"
+)
+
+func TestReadWrite(t *testing.T) {
+    sim := newSimTag()
+    tag := New(sim)
+    uid, err := tag.UID()
+    if err != nil { t.Fatal(err) }
+    if !bytes.Equal(uid, sim.uid) {
+        t.Errorf("unexpected UID %X", uid)
+    }
+    model, err := tag.Identify()
+    if err != nil { t.Fatal(err) }
+    if model.Name != "NTAG213" || model.UserSize() != 144 {
+        t.Errorf("unexpected model %+v", model)
+    }
+    cc, err := tag.CapabilityContainer()
+    if err != nil { t.Fatal(err) }
+    if !cc.NDEF() || cc.ReadOnly() || cc.Size != 144 {
+        t.Errorf("unexpected CC %+v", cc)
+    }
+    data := []byte("wristband 0042 access: VIP")
+    if err := tag.Write(model.UserStart, data); err != nil {
+        t.Fatal(err)
+    }
+    read, err := tag.ReadPages(model.UserStart, model.UserStart + 6)
+    if err != nil { t.Fatal(err) }
+    if !bytes.Equal(read[:len(data)], data) || len(read) != 28 {
+        t.Errorf("unexpected data %q", read)
+    }
+    // READ wraps around at the end of memory
+    wrapped, err := tag.Read(44)
+    if err != nil { t.Fatal(err) }
+    if !bytes.Equal(wrapped[4:7], uid[:3]) {
+        t.Errorf("unexpected wrapped read %X", wrapped)
+    }
+}
+
+func TestLocks(t *testing.T) {
+    sim := newSimTag()
+    tag := New(sim)
+    // lock page 4 and 8 statically, pages 16-17 and 38-39 dynamically
+    if err := tag.SetStaticLock([2]byte{0x12, 0x01}); err != nil {
+        t.Fatal(err)
+    }
+    if err := tag.WritePage(40, []byte{0x01, 0x08, 0x00, 0x00}); err != nil {
+        t.Fatal(err)
+    }
+    locks, err := tag.Locks()
+    if err != nil { t.Fatal(err) }
+    for page, expected := range map[int]bool{3: false, 4: true, 5: false,
+        8: true, 9: false, 16: true, 17: true, 18: false, 37: false,
+        38: true, 39: true} {
+        if locks.PageLocked(page) != expected {
+            t.Errorf("page %d: locked %t", page, !expected)
+        }
+    }
+    if !locks.BlockLocked(5) || locks.BlockLocked(12) {
+        t.Error("unexpected block lock bits")
+    }
+    if err := tag.WritePage(4, []byte{1, 2, 3, 4}); err == nil {
+        t.Error("write to locked page succeeded")
+    }
+}
+
+func TestPasswordProtection(t *testing.T) {
+    sim := newSimTag()
+    tag := New(sim)
+    password, pack := []byte{0x12, 0x34, 0x56, 0x78}, []byte{0xab, 0xcd}
+    if err := tag.SetPassword(password, pack); err != nil {
+        t.Fatal(err)
+    }
+    config, err := tag.Config()
+    if err != nil { t.Fatal(err) }
+    if config.AUTH0 != 0xff || config.ReadProtected {
+        t.Errorf("unexpected config %+v", config)
+    }
+    config.AUTH0 = 16
+    config.ReadProtected = true
+    config.CounterEnabled = true
+    config.AuthLimit = 3
+    if err := tag.WriteConfig(config); err != nil {
+        t.Fatal(err)
+    }
+    if _, err := tag.Read(16); err == nil {
+        t.Error("read of protected page succeeded")
+    }
+    if _, err := tag.PasswordAuth([]byte{0, 0, 0, 0}); err == nil {
+        t.Error("wrong password accepted")
+    }
+    got, err := tag.PasswordAuth(password)
+    if err != nil { t.Fatal(err) }
+    if !bytes.Equal(got, pack) {
+        t.Errorf("unexpected PACK %X", got)
+    }
+    config, err = tag.Config()
+    if err != nil { t.Fatal(err) }
+    if config.AUTH0 != 16 || !config.ReadProtected ||
+        !config.CounterEnabled || config.AuthLimit != 3 {
+        t.Errorf("unexpected config %+v", config)
+    }
+    counter, err := tag.ReadCounter(2)
+    if err != nil { t.Fatal(err) }
+    if counter != 0x0102 {
+        t.Errorf("unexpected counter %06X", counter)
+    }
+}
+
+func TestOriginality(t *testing.T) {
+    sim := newSimTag()
+    tag := New(sim)
+    sig, err := tag.ReadSignature()
+    if err != nil { t.Fatal(err) }
+    if err := VerifyOriginality(sim.publicKey(), sim.uid, sig); err != nil {
+        t.Error(err)
+    }
+    // simulated tags aren't signed by NXP
+    if err := tag.CheckOriginality(); err == nil {
+        t.Error("simulated tag passed NXP originality check")
+    }
+}
+
+func identify(t *testing.T, version string) (*Model, error) {
+    t.Helper()
+    // PC/SC transparent exchange: start session, GET_VERSION
+    card := mock.NewCard(nil).
+        Expect("ff c2 00 00 02 81 00 00", "c0 03 00 90 00 90 00").
+        Expect("ff c2 00 01 03 95 01 60 00",
+            "c0 03 00 90 00 97 08 " + version + " 90 00")
+    model, err := New(card).Identify()
+    card.AssertExpectations(t)
+    return model, err
+}
+
+// GET_VERSION responses of the NTAG213/215/216 and MF0ULx1 datasheets.
+func TestVersionVectors(t *testing.T) {
+    vectors := []struct {
+        name, version string
+    }{
+        {"NTAG213", "00 04 04 02 01 00 0f 03"},
+        {"NTAG215", "00 04 04 02 01 00 11 03"},
+        {"NTAG216", "00 04 04 02 01 00 13 03"},
+        {"MIFARE Ultralight EV1 MF0UL11", "00 04 03 01 01 00 0b 03"},
+        {"MIFARE Ultralight EV1 MF0UL21", "00 04 03 01 01 00 0e 03"},
+    }
+    for _, v := range vectors {
+        model, err := identify(t, v.version)
+        if err != nil { t.Fatal(err) }
+        if model.Name != v.name {
+            t.Errorf("%s identified as %s", v.name, model.Name)
+        }
+    }
+    // NTAG210 isn't supported
+    if model, err := identify(t, "00 04 04 01 01 00 0b 03"); err == nil {
+        t.Errorf("NTAG210 identified as %s", model.Name)
+    }
+}
+
+// Factory capability containers of the NTAG213/215/216 datasheet.
+func TestCapabilityContainerVectors(t *testing.T) {
+    for i, cc := range []string{"e1 10 12 00", "e1 10 3e 00", "e1 10 6d 00"} {
+        model := &Models[i]
+        card := mock.NewCard(nil).Expect("ff b0 00 03 10", cc +
+            " 03 00 fe 00 00 00 00 00 00 00 00 00 90 00")
+        c, err := New(card).CapabilityContainer()
+        if err != nil { t.Fatal(err) }
+        if !bytes.Equal(c.Bytes(), mock.Hex(cc)) || !c.NDEF() ||
+            c.ReadOnly() || c.Size > model.UserSize() {
+            t.Errorf("%s: unexpected CC %+v", model.Name, c)
+        }
+        card.AssertExpectations(t)
+    }
+}
+
+// Domain parameters of SEC 2 secp128r1 and the NXP key of AN11350.
+func TestOriginalityKey(t *testing.T) {
+    if !secp128r1.IsOnCurve(secp128r1.Gx, secp128r1.Gy) {
+        t.Error("generator not on secp128r1")
+    }
+    if x, y := secp128r1.ScalarBaseMult(secp128r1.N.Bytes()); x.Sign() != 0 ||
+        y.Sign() != 0 {
+        t.Error("generator order isn't N")
+    }
+    if x, _ := elliptic.Unmarshal(secp128r1, NTAG21xOriginalityKey);
+        x == nil {
+        t.Error("NXP originality key not on secp128r1")
+    }
+}
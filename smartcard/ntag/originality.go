@@ -0,0 +1,59 @@
+package ntag
+
+import (
+    "crypto/ecdsa"
+    "crypto/elliptic"
+    "fmt"
+    "math/big"
+)
+
+var secp128r1 *elliptic.CurveParams
+
+func init() {
+    secp128r1 = &elliptic.CurveParams{Name: "secp128r1", BitSize: 128}
+    secp128r1.P, _ = new(big.Int).SetString(
+        "FFFFFFFDFFFFFFFFFFFFFFFFFFFFFFFF", 16)
+    secp128r1.N, _ = new(big.Int).SetString(
+        "FFFFFFFE0000000075A30D1B9038A115", 16)
+    secp128r1.B, _ = new(big.Int).SetString(
+        "E87579C11079F43DD824993C2CEE5ED3", 16)
+    secp128r1.Gx, _ = new(big.Int).SetString(
+        "161FF7528B899B2D0C28607CA52C5B86", 16)
+    secp128r1.Gy, _ = new(big.Int).SetString(
+        "CF5AC8395BAFEB13C02DA292DDED7A83", 16)
+}
+
+// NXP originality check public key for NTAG21x (secp128r1).
+var NTAG21xOriginalityKey = []byte{0x04,
+    0x49, 0x4e, 0x1a, 0x38, 0x6d, 0x3d, 0x3c, 0xfe,
+    0x3d, 0xc1, 0x0e, 0x5d, 0xe6, 0x8a, 0x49, 0x9b,
+    0x1c, 0x20, 0x2d, 0xb5, 0xb1, 0x32, 0x39, 0x3e,
+    0x89, 0xed, 0x19, 0xfe, 0x5b, 0xe8, 0xbc, 0x61}
+
+// Verify originality signature (r||s over the UID, without hashing)
+// with an uncompressed secp128r1 public key.
+func VerifyOriginality(publicKey, uid, signature []byte) error {
+    x, y := elliptic.Unmarshal(secp128r1, publicKey)
+    if x == nil {
+        return fmt.Errorf("invalid originality public key")
+    }
+    if len(signature) != 32 {
+        return fmt.Errorf("invalid signature length %d", len(signature))
+    }
+    pub := &ecdsa.PublicKey{Curve: secp128r1, X: x, Y: y}
+    r := new(big.Int).SetBytes(signature[:16])
+    s := new(big.Int).SetBytes(signature[16:])
+    if !ecdsa.Verify(pub, uid, r, s) {
+        return fmt.Errorf("originality signature invalid")
+    }
+    return nil
+}
+
+// Read UID and originality signature and verify them with the NXP key.
+func (t *Tag) CheckOriginality() error {
+    uid, err := t.UID()
+    if err != nil { return err }
+    sig, err := t.ReadSignature()
+    if err != nil { return err }
+    return VerifyOriginality(NTAG21xOriginalityKey, uid, sig)
+}
@@ -0,0 +1,203 @@
+package ntag
+
+import (
+    "crypto/ecdsa"
+    "crypto/elliptic"
+    "crypto/rand"
+    "fmt"
+    "github.com/sf1/go-card/smartcard"
+    "github.com/sf1/go-card/smartcard/mock"
+    "github.com/sf1/go-card/smartcard/tlv"
+)
+
+// Simulated NTAG213 on a PC/SC reader for tests: a mock card with a rule
+// per pseudo-APDU working on the tag memory.
+type simTag struct {
+    *mock.Card
+    version []byte
+    memory []byte
+    uid []byte
+    counter uint32
+    authenticated bool
+    session bool
+    key *ecdsa.PrivateKey
+    signature []byte
+}
+
+func newSimTag() *simTag {
+    s := &simTag{
+        memory: make([]byte, 45 * PAGE_SIZE),
+        uid: []byte{0x04, 0x11, 0x22, 0x33, 0x44, 0x55, 0x66},
+        counter: 0x0102,
+        // GET_VERSION response of the NTAG213 datasheet
+        version: []byte{0x00, 0x04, 0x04, 0x02, 0x01, 0x00, 0x0f, 0x03},
+    }
+    s.Card = mock.NewCard(mock.Hex("3b 8f 80 01 80 4f 0c a0 00 00 03 06 03 " +
+        "00 03 00 00 00 00 68")).
+        RuleFunc("ff ca 00 00 *", s.rule(s.getUID)).
+        RuleFunc("ff b0 *", s.rule(s.read)).
+        RuleFunc("ff d6 *", s.rule(s.update)).
+        RuleFunc("ff c2 00 *", s.rule(s.transparent))
+    copy(s.memory, []byte{0x04, 0x11, 0x22, 0x04 ^ 0x11 ^ 0x22 ^ 0x88,
+        0x33, 0x44, 0x55, 0x66, 0x33 ^ 0x44 ^ 0x55 ^ 0x66, 0x48, 0x00, 0x00,
+        0xe1, 0x10, 0x12, 0x00})
+    // NDEF TLV with empty message, terminator
+    copy(s.memory[16:], []byte{0x03, 0x00, 0xfe})
+    // CFG0: AUTH0 0xFF (no protection), CFG1: ACCESS 0
+    copy(s.memory[41*PAGE_SIZE:], []byte{0x04, 0x00, 0x00, 0xff})
+    // PWD FFFFFFFF, PACK 0000
+    copy(s.memory[43*PAGE_SIZE:], []byte{0xff, 0xff, 0xff, 0xff})
+    var err error
+    s.key, err = ecdsa.GenerateKey(secp128r1, rand.Reader)
+    if err != nil { panic(err) }
+    r, ss, err := ecdsa.Sign(rand.Reader, s.key, s.uid)
+    if err != nil { panic(err) }
+    s.signature = make([]byte, 32)
+    r.FillBytes(s.signature[:16])
+    ss.FillBytes(s.signature[16:])
+    return s
+}
+
+func (s *simTag) publicKey() []byte {
+    return elliptic.Marshal(secp128r1, s.key.X, s.key.Y)
+}
+
+func (s *simTag) page(n int) []byte {
+    return s.memory[n*PAGE_SIZE:(n+1)*PAGE_SIZE]
+}
+
+func (s *simTag) auth0() int {
+    return int(s.page(41)[3])
+}
+
+func (s *simTag) protected(page int, write bool) bool {
+    if s.authenticated || page < s.auth0() {
+        return false
+    }
+    return write || s.page(42)[0] & accessProt != 0
+}
+
+func (s *simTag) locked(page int) bool {
+    locks := &Locks{Static: [2]byte{s.page(2)[2], s.page(2)[3]},
+        Dynamic: s.page(40)[:3], model: &Models[0]}
+    return page > 2 && page < 40 && locks.PageLocked(page)
+}
+
+func sw(code uint16) smartcard.ResponseAPDU {
+    return smartcard.ResponseAPDU{byte(code >> 8), byte(code)}
+}
+
+func ok(data []byte) smartcard.ResponseAPDU {
+    return append(append([]byte{}, data...), 0x90, 0x00)
+}
+
+// Check command and call fn with P1-P2 (the page number) and data.
+func (s *simTag) rule(fn func(page int, data []byte) smartcard.ResponseAPDU,
+    ) mock.HandlerFunc {
+    return func(cmd smartcard.CommandAPDU) (smartcard.ResponseAPDU, error) {
+        if !cmd.IsValid() {
+            return nil, fmt.Errorf("invalid APDU %X", []byte(cmd))
+        }
+        return fn(int(cmd[2]) << 8 | int(cmd[3]), cmd.Data()), nil
+    }
+}
+
+func (s *simTag) getUID(page int, data []byte) smartcard.ResponseAPDU {
+    return ok(s.uid)
+}
+
+func (s *simTag) read(page int, data []byte) smartcard.ResponseAPDU {
+    if page >= 45 {
+        return sw(0x6a82)
+    }
+    for i := 0; i < 4; i++ {
+        p := (page + i) % 45
+        switch {
+            case s.protected(p, false):
+                return sw(0x6982)
+            case p >= 43:
+                // PWD and PACK read as zeros
+                data = append(data, 0, 0, 0, 0)
+            default:
+                data = append(data, s.page(p)...)
+        }
+    }
+    return ok(data)
+}
+
+func (s *simTag) update(page int, data []byte) smartcard.ResponseAPDU {
+    if page < 2 || page >= 45 || len(data) != PAGE_SIZE {
+        return sw(0x6a82)
+    }
+    if s.protected(page, true) {
+        return sw(0x6982)
+    }
+    if s.locked(page) || page >= 41 && s.page(42)[0] & accessCfgLck != 0 {
+        return sw(0x6981)
+    }
+    if page == 2 || page == 3 || page == 40 {
+        // lock bytes and CC are one time programmable
+        p := s.page(page)
+        start := 0
+        if page == 2 {
+            start = 2
+        }
+        for i := start; i < 4; i++ {
+            p[i] |= data[i]
+        }
+        return ok(nil)
+    }
+    copy(s.page(page), data)
+    return ok(nil)
+}
+
+func (s *simTag) transparent(p2 int, data []byte) smartcard.ResponseAPDU {
+    status := tlv.New(0xc0, []byte{0x00, 0x90, 0x00})
+    list, err := tlv.Parse(data)
+    if err != nil { return sw(0x6a80) }
+    if p2 == 0x00 {
+        switch {
+            case len(list) > 0 && list[0].Tag == 0x81:
+                s.session = true
+            case len(list) > 0 && list[0].Tag == 0x82:
+                s.session = false
+            default:
+                return sw(0x6a80)
+        }
+        return ok(status.Bytes())
+    }
+    if !s.session {
+        return ok(tlv.New(0xc0, []byte{0x03, 0x6a, 0x81}).Bytes())
+    }
+    cmd := list.Value(0x95)
+    if len(cmd) == 0 {
+        return sw(0x6a80)
+    }
+    var rsp []byte
+    switch {
+        case cmd[0] == CMD_GET_VERSION:
+            rsp = s.version
+        case cmd[0] == CMD_PWD_AUTH && len(cmd) == 5:
+            pwd := s.page(43)
+            if string(cmd[1:]) == string(pwd) {
+                s.authenticated = true
+                rsp = s.page(44)[:2]
+            } else {
+                rsp = []byte{0x04}
+            }
+        case cmd[0] == CMD_READ_CNT && len(cmd) == 2 && cmd[1] == 2:
+            if s.page(42)[0] & accessNFCCntEn == 0 ||
+                s.page(42)[0] & accessNFCCntPwdProt != 0 &&
+                !s.authenticated {
+                rsp = []byte{0x00}
+            } else {
+                rsp = []byte{byte(s.counter), byte(s.counter >> 8),
+                    byte(s.counter >> 16)}
+            }
+        case cmd[0] == CMD_READ_SIG:
+            rsp = s.signature
+        default:
+            rsp = []byte{0x00}
+    }
+    return ok(append(status.Bytes(), tlv.Encode(0x97, rsp)...))
+}
@@ -0,0 +1,114 @@
+package ntag
+
+import (
+    "fmt"
+    "github.com/sf1/go-card/smartcard"
+    "github.com/sf1/go-card/smartcard/SW"
+    "github.com/sf1/go-card/smartcard/tlv"
+)
+
+// Sends raw commands to a contactless tag through the reader.
+type Transceiver interface {
+    Transceive(cmd []byte) ([]byte, error)
+}
+
+// Transceiver using the transparent exchange of PC/SC Part 3 Supplement
+// (MANAGE SESSION and TRANSPARENT EXCHANGE, FF C2).
+type PCSCTransceiver struct {
+    card smartcard.Transmitter
+    started bool
+}
+
+// Create PC/SC transparent exchange transceiver.
+func NewPCSCTransceiver(card smartcard.Transmitter) *PCSCTransceiver {
+    return &PCSCTransceiver{card: card}
+}
+
+func (p *PCSCTransceiver) exchange(p2 byte, data []byte) (tlv.List,
+    error) {
+    rsp, err := smartcard.TransmitAndGetResponse(p.card, smartcard.Command4(
+        0xff, 0xc2, 0x00, p2, data, 0x00))
+    if err != nil { return nil, err }
+    if rsp.SW() != SW.SUCCESS {
+        return nil, smartcard.SWError(rsp.SW())
+    }
+    list, err := tlv.Parse(rsp.Data())
+    if err != nil { return nil, err }
+    // generic error status: 00 90 00 on success
+    status := list.Value(0xc0)
+    if len(status) == 3 && (status[1] != 0x90 || status[2] != 0x00) {
+        return nil, fmt.Errorf("transparent exchange failed: %X", status)
+    }
+    return list, nil
+}
+
+// Start transparent session. Called implicitly by Transceive.
+func (p *PCSCTransceiver) Start() error {
+    _, err := p.exchange(0x00, []byte{0x81, 0x00})
+    if err != nil { return err }
+    p.started = true
+    return nil
+}
+
+// End transparent session.
+func (p *PCSCTransceiver) End() error {
+    if !p.started {
+        return nil
+    }
+    p.started = false
+    _, err := p.exchange(0x00, []byte{0x82, 0x00})
+    return err
+}
+
+// Send command to the tag and return its response.
+func (p *PCSCTransceiver) Transceive(cmd []byte) ([]byte, error) {
+    if !p.started {
+        if err := p.Start(); err != nil {
+            return nil, err
+        }
+    }
+    list, err := p.exchange(0x01, tlv.Encode(0x95, cmd))
+    if err != nil { return nil, err }
+    data, ok := list.Find(0x97)
+    if !ok {
+        return nil, fmt.Errorf("no response from tag")
+    }
+    return nackError(data.Value)
+}
+
+// Transceiver for ACS ACR122U and other PN53x based readers
+// (InCommunicateThru via direct transmit, FF 00 00 00).
+type PN53xTransceiver struct {
+    card smartcard.Transmitter
+}
+
+// Create PN53x transceiver.
+func NewPN53xTransceiver(card smartcard.Transmitter) *PN53xTransceiver {
+    return &PN53xTransceiver{card: card}
+}
+
+// Send command to the tag and return its response.
+func (p *PN53xTransceiver) Transceive(cmd []byte) ([]byte, error) {
+    rsp, err := smartcard.TransmitAndGetResponse(p.card, smartcard.Command4(
+        0xff, 0x00, 0x00, 0x00, append([]byte{0xd4, 0x42}, cmd...), 0x00))
+    if err != nil { return nil, err }
+    if rsp.SW() != SW.SUCCESS {
+        return nil, smartcard.SWError(rsp.SW())
+    }
+    data := rsp.Data()
+    if len(data) < 3 || data[0] != 0xd5 || data[1] != 0x43 {
+        return nil, fmt.Errorf("invalid PN53x response %X", data)
+    }
+    if data[2] & 0x3f != 0 {
+        return nil, fmt.Errorf("PN53x error %02X", data[2])
+    }
+    return nackError(data[3:])
+}
+
+// Tag NAK responses are single 4-bit values other than ACK (0xA).
+func nackError(data []byte) ([]byte, error) {
+    if len(data) == 1 && data[0] & 0xf0 == 0 && data[0] != 0x0a {
+        return nil, fmt.Errorf("tag returned NAK %X", data[0])
+    }
+    return data, nil
+}
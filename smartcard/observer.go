@@ -0,0 +1,75 @@
+package smartcard
+
+import (
+    "time"
+)
+
+const (
+    // Event kinds
+    EVENT_CONNECT = 1
+    EVENT_DISCONNECT = 2
+    EVENT_TRANSMIT = 3
+)
+
+// Card event reported to an Observer.
+type Event struct {
+    // EVENT_CONNECT, EVENT_DISCONNECT or EVENT_TRANSMIT
+    Kind int
+    Reader string
+    // ATR and protocol of the card (connect)
+    ATR ATR
+    Protocol uint32
+    // Card disposition (disconnect)
+    Disposition uint32
+    // Exchanged bytes (transmit). Must not be modified or retained.
+    Command []byte
+    Response []byte
+    Duration time.Duration
+    Err error
+}
+
+// Receiver of card events of a Context, e.g. for logging or metrics.
+// Observers are called synchronously and must be safe for concurrent use.
+type Observer interface {
+    Observe(e *Event)
+}
+
+// Set observer of connect, disconnect and transmit events of the context's
+// cards. Pass nil to remove it. Should be set before connecting.
+func (ctx *Context) SetObserver(o Observer) {
+    ctx.observer = o
+}
+
+// Return observer of the context, or nil.
+func (ctx *Context) Observer() Observer {
+    return ctx.observer
+}
+
+// Instructions whose command data holds PINs: VERIFY, CHANGE REFERENCE
+// DATA and RESET RETRY COUNTER (ISO 7816-4, also VERIFY CHV, CHANGE CHV and
+// UNBLOCK CHV of GSM 11.11), with their odd INS variants.
+var sensitiveInstructions = map[byte]bool{
+    0x20: true, 0x21: true,
+    0x24: true, 0x25: true,
+    0x2c: true, 0x2d: true,
+}
+
+// Check if command data may hold PINs or other secrets and must not be
+// logged.
+func SensitiveCommand(cmd []byte) bool {
+    return len(cmd) > 5 && sensitiveInstructions[cmd[1]]
+}
+
+type multiObserver []Observer
+
+func (m multiObserver) Observe(e *Event) {
+    for _, o := range m {
+        o.Observe(e)
+    }
+}
+
+// Return observer passing events to all observers in order, e.g. to log
+// and collect metrics.
+func MultiObserver(observers ...Observer) Observer {
+    return multiObserver(append([]Observer{}, observers...))
+}
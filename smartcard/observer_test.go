@@ -0,0 +1,38 @@
+package smartcard
+
+import (
+    "fmt"
+    "testing"
+)
+
+type testObserver []string
+
+func (o *testObserver) Observe(e *Event) {
+    *o = append(*o, fmt.Sprintf("%d %s %X %X %v", e.Kind, e.Reader,
+        e.Command, e.Response, e.Err))
+}
+
+func TestObserver(t *testing.T) {
+    ctx, err := EstablishContextWithBackend(&testBackend{})
+    if err != nil { t.Fatal(err) }
+    defer ctx.Release()
+    o1, o2 := &testObserver{}, &testObserver{}
+    ctx.SetObserver(MultiObserver(o1, o2))
+    readers, _ := ctx.ListReaders()
+    card, err := readers[1].Connect()
+    if err != nil { t.Fatal(err) }
+    card.Transmit([]byte{0x00, 0xb0, 0x00, 0x00, 0x00})
+    card.Disconnect()
+    expected := []string{"1 Test Reader 01   <nil>",
+        "3 Test Reader 01 00B0000000 9000 <nil>",
+        "2 Test Reader 01   <nil>"}
+    if fmt.Sprint(*o1) != fmt.Sprint(expected) ||
+        fmt.Sprint(*o2) != fmt.Sprint(expected) {
+        t.Errorf("unexpected events %q, %q", *o1, *o2)
+    }
+    if !SensitiveCommand([]byte{0x00, 0x24, 0x00, 0x80, 0x01, 0x31}) ||
+        SensitiveCommand([]byte{0x00, 0x20, 0x00, 0x81}) ||
+        SensitiveCommand([]byte{0x00, 0xa4, 0x04, 0x00, 0x01, 0xa0}) {
+        t.Error("unexpected sensitive commands")
+    }
+}
@@ -0,0 +1,261 @@
+package openpgp
+
+import (
+    "bytes"
+    "encoding/binary"
+    "fmt"
+    "time"
+    "github.com/sf1/go-card/smartcard/tlv"
+)
+
+// Key reference.
+type Key int
+
+const (
+    KEY_SIGNATURE Key = iota
+    KEY_DECRYPTION
+    KEY_AUTHENTICATION
+)
+
+// Control reference template tag of key.
+func (k Key) crt() tlv.Tag {
+    return []tlv.Tag{0xb6, 0xb8, 0xa4}[k]
+}
+
+// Return string form of key reference.
+func (k Key) String() string {
+    switch k {
+        case KEY_SIGNATURE:
+            return "signature"
+        case KEY_DECRYPTION:
+            return "decryption"
+        case KEY_AUTHENTICATION:
+            return "authentication"
+    }
+    return fmt.Sprintf("key %d", int(k))
+}
+
+const (
+    // Algorithm IDs
+    ALG_RSA = 0x01
+    ALG_ECDH = 0x12
+    ALG_ECDSA = 0x13
+    ALG_EDDSA = 0x16
+    // RSA import formats
+    RSA_IMPORT_STANDARD = 0x00
+    RSA_IMPORT_STANDARD_N = 0x01
+    RSA_IMPORT_CRT = 0x02
+    RSA_IMPORT_CRT_N = 0x03
+)
+
+// Curve OIDs (without ASN.1 tag and length).
+var (
+    OID_NIST_P256 = []byte{0x2a, 0x86, 0x48, 0xce, 0x3d, 0x03, 0x01, 0x07}
+    OID_NIST_P384 = []byte{0x2b, 0x81, 0x04, 0x00, 0x22}
+    OID_NIST_P521 = []byte{0x2b, 0x81, 0x04, 0x00, 0x23}
+    OID_ED25519 = []byte{0x2b, 0x06, 0x01, 0x04, 0x01, 0xda, 0x47, 0x0f,
+        0x01}
+    OID_X25519 = []byte{0x2b, 0x06, 0x01, 0x04, 0x01, 0x97, 0x55, 0x01,
+        0x05, 0x01}
+)
+
+var curveNames = []struct {
+    oid []byte
+    name string
+}{
+    {OID_NIST_P256, "nistp256"},
+    {OID_NIST_P384, "nistp384"},
+    {OID_NIST_P521, "nistp521"},
+    {OID_ED25519, "ed25519"},
+    {OID_X25519, "cv25519"},
+}
+
+// Algorithm attributes of a key slot (C1, C2, C3).
+type AlgorithmAttributes struct {
+    Algorithm byte
+    // RSA parameters
+    ModulusBits int
+    ExponentBits int
+    ImportFormat byte
+    // ECC curve OID
+    OID []byte
+}
+
+// Return curve name of ECC attributes.
+func (a AlgorithmAttributes) Curve() string {
+    for _, c := range curveNames {
+        if bytes.Equal(c.oid, a.OID) {
+            return c.name
+        }
+    }
+    return fmt.Sprintf("%X", a.OID)
+}
+
+// Return encoded attributes.
+func (a AlgorithmAttributes) Bytes() []byte {
+    if a.Algorithm == ALG_RSA {
+        out := []byte{ALG_RSA, 0, 0, 0, 0, a.ImportFormat}
+        binary.BigEndian.PutUint16(out[1:], uint16(a.ModulusBits))
+        binary.BigEndian.PutUint16(out[3:], uint16(a.ExponentBits))
+        return out
+    }
+    out := append([]byte{a.Algorithm}, a.OID...)
+    if a.ImportFormat != 0 {
+        out = append(out, a.ImportFormat)
+    }
+    return out
+}
+
+// Return string form of attributes.
+func (a AlgorithmAttributes) String() string {
+    switch a.Algorithm {
+        case ALG_RSA:
+            return fmt.Sprintf("rsa%d", a.ModulusBits)
+        case ALG_ECDH, ALG_ECDSA, ALG_EDDSA:
+            return a.Curve()
+    }
+    return fmt.Sprintf("algorithm %02X", a.Algorithm)
+}
+
+func parseAlgorithmAttributes(data []byte) (AlgorithmAttributes, error) {
+    var a AlgorithmAttributes
+    if len(data) == 0 {
+        return a, nil
+    }
+    a.Algorithm = data[0]
+    if a.Algorithm == ALG_RSA {
+        if len(data) < 5 {
+            return a, fmt.Errorf("invalid RSA algorithm attributes")
+        }
+        a.ModulusBits = int(binary.BigEndian.Uint16(data[1:]))
+        a.ExponentBits = int(binary.BigEndian.Uint16(data[3:]))
+        if len(data) > 5 {
+            a.ImportFormat = data[5]
+        }
+        return a, nil
+    }
+    a.OID = data[1:]
+    // optional import format byte (FF: with public key)
+    if len(a.OID) > 0 && a.OID[len(a.OID)-1] == 0xff {
+        a.ImportFormat = 0xff
+        a.OID = a.OID[:len(a.OID)-1]
+    }
+    return a, nil
+}
+
+// PW status bytes (C4).
+type PWStatus struct {
+    // PW1 valid for more than one signature
+    PW1ValidForMultiple bool
+    MaxPW1Length int
+    MaxRCLength int
+    MaxPW3Length int
+    PW1Retries int
+    RCRetries int
+    PW3Retries int
+}
+
+func parsePWStatus(data []byte) (*PWStatus, error) {
+    if len(data) < 7 {
+        return nil, fmt.Errorf("invalid PW status bytes")
+    }
+    return &PWStatus{
+        PW1ValidForMultiple: data[0] != 0x00,
+        MaxPW1Length: int(data[1] & 0x7f),
+        MaxRCLength: int(data[2]),
+        MaxPW3Length: int(data[3] & 0x7f),
+        PW1Retries: int(data[4]),
+        RCRetries: int(data[5]),
+        PW3Retries: int(data[6]),
+    }, nil
+}
+
+// Cardholder related data.
+type Cardholder struct {
+    // Name in the format "Surname<<Given name"
+    Name string
+    Language string
+    // ISO 5218 (0x31 male, 0x32 female, 0x39 not announced)
+    Sex byte
+}
+
+// Application identifier details.
+type ApplicationID struct {
+    Raw []byte
+    Version uint16
+    Manufacturer uint16
+    Serial uint32
+}
+
+// Return version as string.
+func (a ApplicationID) VersionString() string {
+    return fmt.Sprintf("%d.%d", a.Version >> 8, a.Version & 0xff)
+}
+
+// Application Related Data (6E).
+type ApplicationData struct {
+    AID ApplicationID
+    HistoricalBytes []byte
+    ExtendedCapabilities []byte
+    // Indexed by Key
+    Algorithms [3]AlgorithmAttributes
+    Fingerprints [3][]byte
+    CAFingerprints [3][]byte
+    GenerationTimes [3]time.Time
+    PWStatus *PWStatus
+    KeyInformation []byte
+}
+
+func parseApplicationData(data []byte) (*ApplicationData, error) {
+    list, err := tlv.Parse(data)
+    if err != nil { return nil, err }
+    if t, ok := list.Find(TAG_APPLICATION_RELATED_DATA); ok {
+        list, err = t.Children()
+        if err != nil { return nil, err }
+    }
+    ad := &ApplicationData{}
+    aid := list.Value(0x4f)
+    if len(aid) == 16 {
+        ad.AID = ApplicationID{
+            Raw: aid,
+            Version: binary.BigEndian.Uint16(aid[6:8]),
+            Manufacturer: binary.BigEndian.Uint16(aid[8:10]),
+            Serial: binary.BigEndian.Uint32(aid[10:14]),
+        }
+    }
+    ad.HistoricalBytes = list.Value(0x5f52)
+    // Discretionary data objects (73) are part of 6E since version 3.0
+    // but may also appear at the top level.
+    if d, ok := list.Find(0x73); ok {
+        children, err := d.Children()
+        if err != nil { return nil, err }
+        list = append(list, children...)
+    }
+    ad.ExtendedCapabilities = list.Value(0xc0)
+    for i, tag := range []tlv.Tag{0xc1, 0xc2, 0xc3} {
+        ad.Algorithms[i], err = parseAlgorithmAttributes(list.Value(tag))
+        if err != nil { return nil, err }
+    }
+    if status := list.Value(TAG_PW_STATUS); status != nil {
+        ad.PWStatus, err = parsePWStatus(status)
+        if err != nil { return nil, err }
+    }
+    ad.Fingerprints = split3(list.Value(0xc5), 20)
+    ad.CAFingerprints = split3(list.Value(0xc6), 20)
+    for i, ts := range split3(list.Value(0xcd), 4) {
+        if ts != nil && binary.BigEndian.Uint32(ts) != 0 {
+            ad.GenerationTimes[i] = time.Unix(
+                int64(binary.BigEndian.Uint32(ts)), 0).UTC()
+        }
+    }
+    ad.KeyInformation = list.Value(0xde)
+    return ad, nil
+}
+
+func split3(data []byte, size int) [3][]byte {
+    var out [3][]byte
+    for i := 0; i < 3 && len(data) >= (i+1)*size; i++ {
+        out[i] = data[i*size:(i+1)*size]
+    }
+    return out
+}
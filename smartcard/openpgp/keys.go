@@ -0,0 +1,223 @@
+package openpgp
+
+import (
+    "bytes"
+    "crypto"
+    "crypto/ecdsa"
+    "crypto/ed25519"
+    "crypto/elliptic"
+    "crypto/rsa"
+    "fmt"
+    "math/big"
+    "github.com/sf1/go-card/smartcard"
+    "github.com/sf1/go-card/smartcard/SW"
+    "github.com/sf1/go-card/smartcard/tlv"
+)
+
+func check(rsp smartcard.ResponseAPDU, err error) ([]byte, error) {
+    if err != nil { return nil, err }
+    if rsp.SW() != SW.SUCCESS {
+        return nil, smartcard.SWError(rsp.SW())
+    }
+    return rsp.Data(), nil
+}
+
+// Compute digital signature with the signature key (PSO:CDS). For RSA
+// keys data is a DigestInfo, for ECDSA the hash and for EdDSA the message.
+// ECDSA and EdDSA signatures are returned in raw r||s format.
+func (c *Card) ComputeSignature(data []byte) ([]byte, error) {
+    rsp, err := smartcard.TransmitChained(c.card, 0x00, INS_PSO, 0x9e, 0x9a,
+        data, true)
+    return check(rsp, err)
+}
+
+// Decrypt with the decryption key (PSO:DECIPHER). For RSA keys data is
+// the cryptogram, for ECDH keys the ephemeral public key of the peer.
+func (c *Card) Decipher(data []byte, ecdh bool) ([]byte, error) {
+    if ecdh {
+        data = tlv.NewConstructed(0xa6, tlv.NewConstructed(0x7f49,
+            tlv.New(0x86, data))).Bytes()
+    } else {
+        data = append([]byte{0x00}, data...)
+    }
+    rsp, err := smartcard.TransmitChained(c.card, 0x00, INS_PSO, 0x80, 0x86,
+        data, true)
+    return check(rsp, err)
+}
+
+// Sign data with the authentication key (INTERNAL AUTHENTICATE).
+func (c *Card) InternalAuthenticate(data []byte) ([]byte, error) {
+    rsp, err := smartcard.TransmitChained(c.card, 0x00,
+        INS_INTERNAL_AUTHENTICATE, 0x00, 0x00, data, true)
+    return check(rsp, err)
+}
+
+// Read public key of key slot.
+func (c *Card) PublicKey(key Key) (crypto.PublicKey, error) {
+    return c.keyPair(key, 0x81)
+}
+
+// Generate key pair in key slot according to its algorithm attributes
+// and return the public key. Requires PW3 verification.
+func (c *Card) GenerateKey(key Key) (crypto.PublicKey, error) {
+    return c.keyPair(key, 0x80)
+}
+
+func (c *Card) keyPair(key Key, p1 byte) (crypto.PublicKey, error) {
+    ad, err := c.ApplicationRelatedData()
+    if err != nil { return nil, err }
+    crt := tlv.New(key.crt(), nil).Bytes()
+    rsp, err := smartcard.TransmitAndGetResponse(c.card, smartcard.Command4(
+        0x00, INS_GENERATE_ASYMMETRIC_KEY_PAIR, p1, 0x00, crt, 0x00))
+    data, err := check(rsp, err)
+    if err != nil { return nil, err }
+    obj, _, err := tlv.ParseOne(data)
+    if err != nil { return nil, err }
+    if obj.Tag != 0x7f49 {
+        return nil, fmt.Errorf("unexpected public key template %s", obj.Tag)
+    }
+    fields, err := obj.Children()
+    if err != nil { return nil, err }
+    return decodePublicKey(ad.Algorithms[key], fields)
+}
+
+func decodePublicKey(attrs AlgorithmAttributes, fields tlv.List) (
+    crypto.PublicKey, error) {
+    if attrs.Algorithm == ALG_RSA {
+        n := new(big.Int).SetBytes(fields.Value(0x81))
+        e := new(big.Int).SetBytes(fields.Value(0x82))
+        if n.Sign() == 0 || !e.IsInt64() || e.Int64() > 1 << 31 {
+            return nil, fmt.Errorf("invalid RSA public key")
+        }
+        return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+    }
+    point := fields.Value(0x86)
+    switch {
+        case bytes.Equal(attrs.OID, OID_ED25519):
+            if len(point) == 33 && point[0] == 0x40 {
+                point = point[1:]
+            }
+            if len(point) != ed25519.PublicKeySize {
+                return nil, fmt.Errorf("invalid Ed25519 public key")
+            }
+            return ed25519.PublicKey(point), nil
+        case bytes.Equal(attrs.OID, OID_X25519):
+            if len(point) == 33 && point[0] == 0x40 {
+                point = point[1:]
+            }
+            if len(point) != 32 {
+                return nil, fmt.Errorf("invalid X25519 public key")
+            }
+            return X25519PublicKey(point), nil
+    }
+    curve := curveByOID(attrs.OID)
+    if curve == nil {
+        return nil, fmt.Errorf("unsupported curve %s", attrs.Curve())
+    }
+    x, y := elliptic.Unmarshal(curve, point)
+    if x == nil {
+        return nil, fmt.Errorf("invalid EC public key")
+    }
+    return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+}
+
+func curveByOID(oid []byte) elliptic.Curve {
+    switch {
+        case bytes.Equal(oid, OID_NIST_P256):
+            return elliptic.P256()
+        case bytes.Equal(oid, OID_NIST_P384):
+            return elliptic.P384()
+        case bytes.Equal(oid, OID_NIST_P521):
+            return elliptic.P521()
+    }
+    return nil
+}
+
+// X25519 public key (native little-endian encoding).
+type X25519PublicKey []byte
+
+// PIN handling for private key operations.
+type KeyAuth = smartcard.KeyAuth
+
+// Return crypto.Signer for the signature key (PSO:CDS). pub must be the
+// public key of the signature key.
+func (c *Card) Signer(pub crypto.PublicKey, auth KeyAuth) (crypto.Signer,
+    error) {
+    return c.newPrivateKey(KEY_SIGNATURE, pub, auth)
+}
+
+// Return crypto.Signer for the authentication key (INTERNAL
+// AUTHENTICATE), e.g. for TLS client authentication or SSH.
+func (c *Card) AuthenticationSigner(pub crypto.PublicKey, auth KeyAuth) (
+    crypto.Signer, error) {
+    return c.newPrivateKey(KEY_AUTHENTICATION, pub, auth)
+}
+
+// Return crypto.Decrypter for the RSA decryption key. Only PKCS#1 v1.5
+// padding is supported, as the card removes the padding itself.
+func (c *Card) Decrypter(pub *rsa.PublicKey, auth KeyAuth) (
+    crypto.Decrypter, error) {
+    return c.newPrivateKey(KEY_DECRYPTION, pub, auth)
+}
+
+func (c *Card) newPrivateKey(key Key, pub crypto.PublicKey,
+    auth KeyAuth) (*PrivateKey, error) {
+    k, err := smartcard.NewPrivateKey(&cardKey{c, key, pub},
+        smartcard.RSA_PADDING_PKCS1, auth)
+    if err != nil { return nil, err }
+    return &PrivateKey{k}, nil
+}
+
+// Private key on the card. Signs DigestInfos (RSA), hashes (ECDSA) or
+// messages (Ed25519) and decrypts PKCS#1 v1.5 cryptograms; ECDSA
+// signatures are returned ASN.1 DER encoded.
+type PrivateKey struct {
+    *smartcard.PrivateKey
+}
+
+// Card primitives of an OpenPGP key.
+type cardKey struct {
+    card *Card
+    key Key
+    public crypto.PublicKey
+}
+
+// Return public key.
+func (k *cardKey) Public() crypto.PublicKey {
+    return k.public
+}
+
+// Sign with PSO:CDS or, for the authentication key, INTERNAL AUTHENTICATE.
+func (k *cardKey) SignRaw(input []byte) ([]byte, error) {
+    if k.key == KEY_AUTHENTICATION {
+        return k.card.InternalAuthenticate(input)
+    }
+    return k.card.ComputeSignature(input)
+}
+
+// Decrypt RSA cryptogram with PSO:DECIPHER.
+func (k *cardKey) DecryptRaw(ciphertext []byte) ([]byte, error) {
+    return k.card.Decipher(ciphertext, false)
+}
+
+// Verify PW1 for the key.
+func (k *cardKey) VerifyPIN(pin string) error {
+    return k.card.Verify(pinRef(k.key), pin)
+}
+
+// Return PW1 reference for key.
+func pinRef(key Key) byte {
+    if key == KEY_SIGNATURE { return PW1_SIGN }
+    return PW1
+}
+
+// Compute ECDH shared secret with the decryption key. peer is the encoded
+// public key of the peer (04||x||y or native X25519).
+func (c *Card) SharedKey(peer []byte, auth KeyAuth) ([]byte, error) {
+    verify := func(pin string) error {
+        return c.Verify(pinRef(KEY_DECRYPTION), pin)
+    }
+    return auth.Run(verify, func() ([]byte, error) {
+        return c.Decipher(peer, true)
+    })
+}
@@ -0,0 +1,217 @@
+package openpgp
+
+import (
+    "bytes"
+    "crypto"
+    "crypto/ecdsa"
+    "crypto/ed25519"
+    "crypto/rsa"
+    "crypto/sha1"
+    "encoding/binary"
+    "fmt"
+    "math/big"
+    "time"
+    "github.com/sf1/go-card/smartcard"
+    "github.com/sf1/go-card/smartcard/tlv"
+)
+
+// Set algorithm attributes of key slot. Requires PW3 verification.
+func (c *Card) SetAlgorithmAttributes(key Key, attrs AlgorithmAttributes) error {
+    return c.PutData(uint16(0xc1 + key), attrs.Bytes())
+}
+
+// Set 20 byte fingerprint of key slot. Requires PW3 verification.
+func (c *Card) SetFingerprint(key Key, fingerprint []byte) error {
+    if len(fingerprint) != 20 {
+        return fmt.Errorf("invalid fingerprint length: %d", len(fingerprint))
+    }
+    return c.PutData(uint16(0xc7 + key), fingerprint)
+}
+
+// Set generation time of key slot. Requires PW3 verification.
+func (c *Card) SetGenerationTime(key Key, t time.Time) error {
+    data := make([]byte, 4)
+    binary.BigEndian.PutUint32(data, uint32(t.Unix()))
+    return c.PutData(uint16(0xce + key), data)
+}
+
+// Import private key into key slot (extended header list, PUT DATA 3FFF).
+// The slot's algorithm attributes must match the key. Requires PW3
+// verification. Supported key types are *rsa.PrivateKey, *ecdsa.PrivateKey
+// and ed25519.PrivateKey.
+func (c *Card) ImportKey(key Key, priv crypto.PrivateKey) error {
+    ad, err := c.ApplicationRelatedData()
+    if err != nil { return err }
+    attrs := ad.Algorithms[key]
+    var fields []tlv.TLV
+    switch k := priv.(type) {
+        case *rsa.PrivateKey:
+            if attrs.Algorithm != ALG_RSA ||
+                attrs.ModulusBits != k.N.BitLen() {
+                return fmt.Errorf("key does not match algorithm attributes %s",
+                    attrs)
+            }
+            fields, err = rsaKeyFields(k, attrs)
+            if err != nil { return err }
+        case *ecdsa.PrivateKey:
+            curve := curveByOID(attrs.OID)
+            if curve == nil || curve.Params().Name != k.Curve.Params().Name {
+                return fmt.Errorf("key does not match algorithm attributes %s",
+                    attrs)
+            }
+            size := (curve.Params().BitSize + 7) / 8
+            fields = append(fields, tlv.New(0x92, leftPad(k.D.Bytes(), size)))
+            if attrs.ImportFormat == 0xff {
+                fields = append(fields, tlv.New(0x99,
+                    marshalPoint(&k.PublicKey)))
+            }
+        case ed25519.PrivateKey:
+            if !bytes.Equal(attrs.OID, OID_ED25519) {
+                return fmt.Errorf("key does not match algorithm attributes %s",
+                    attrs)
+            }
+            fields = append(fields, tlv.New(0x92, k.Seed()))
+            if attrs.ImportFormat == 0xff {
+                fields = append(fields, tlv.New(0x99, k[32:]))
+            }
+        default:
+            return fmt.Errorf("unsupported private key type %T", priv)
+    }
+    // template holds tags and lengths only, data the concatenated values
+    var template, data []byte
+    for _, f := range fields {
+        template = append(template, f.Tag.Bytes()...)
+        template = append(template, tlv.EncodeLength(len(f.Value))...)
+        data = append(data, f.Value...)
+    }
+    ehl := tlv.NewConstructed(0x4d,
+        tlv.New(key.crt(), nil),
+        tlv.New(0x7f48, template),
+        tlv.New(0x5f48, data)).Bytes()
+    rsp, err := smartcard.TransmitChained(c.card, 0x00, INS_PUT_DATA_ODD,
+        0x3f, 0xff, ehl, false)
+    _, err = check(rsp, err)
+    return err
+}
+
+func rsaKeyFields(k *rsa.PrivateKey, attrs AlgorithmAttributes) (
+    []tlv.TLV, error) {
+    if len(k.Primes) != 2 {
+        return nil, fmt.Errorf("multi-prime RSA keys not supported")
+    }
+    k.Precompute()
+    half := (attrs.ModulusBits / 2 + 7) / 8
+    eSize := (attrs.ExponentBits + 7) / 8
+    e := big.NewInt(int64(k.E)).Bytes()
+    if len(e) > eSize {
+        return nil, fmt.Errorf("public exponent exceeds %d bits",
+            attrs.ExponentBits)
+    }
+    fields := []tlv.TLV{
+        tlv.New(0x91, leftPad(e, eSize)),
+        tlv.New(0x92, leftPad(k.Primes[0].Bytes(), half)),
+        tlv.New(0x93, leftPad(k.Primes[1].Bytes(), half)),
+    }
+    switch attrs.ImportFormat {
+        case RSA_IMPORT_CRT, RSA_IMPORT_CRT_N:
+            fields = append(fields,
+                tlv.New(0x94, leftPad(k.Precomputed.Qinv.Bytes(), half)),
+                tlv.New(0x95, leftPad(k.Precomputed.Dp.Bytes(), half)),
+                tlv.New(0x96, leftPad(k.Precomputed.Dq.Bytes(), half)))
+    }
+    switch attrs.ImportFormat {
+        case RSA_IMPORT_STANDARD_N, RSA_IMPORT_CRT_N:
+            fields = append(fields, tlv.New(0x97,
+                leftPad(k.N.Bytes(), (attrs.ModulusBits + 7) / 8)))
+    }
+    return fields, nil
+}
+
+func leftPad(b []byte, size int) []byte {
+    if len(b) >= size {
+        return b
+    }
+    out := make([]byte, size)
+    copy(out[size-len(b):], b)
+    return out
+}
+
+func marshalPoint(pub *ecdsa.PublicKey) []byte {
+    size := (pub.Curve.Params().BitSize + 7) / 8
+    out := []byte{0x04}
+    out = append(out, leftPad(pub.X.Bytes(), size)...)
+    return append(out, leftPad(pub.Y.Bytes(), size)...)
+}
+
+// Compute OpenPGP v4 fingerprint (RFC 4880, 12.2) of public key created
+// at t. ECDH keys (*ecdsa.PublicKey or X25519PublicKey with
+// ecdh set) use SHA-256 and AES-128 KDF parameters.
+func Fingerprint(pub crypto.PublicKey, created time.Time, ecdh bool) (
+    []byte, error) {
+    body := []byte{0x04, 0, 0, 0, 0}
+    binary.BigEndian.PutUint32(body[1:], uint32(created.Unix()))
+    var oid, point []byte
+    switch k := pub.(type) {
+        case *rsa.PublicKey:
+            body = append(body, ALG_RSA)
+            body = appendMPI(body, k.N.Bytes())
+            body = appendMPI(body, big.NewInt(int64(k.E)).Bytes())
+        case *ecdsa.PublicKey:
+            switch k.Curve.Params().Name {
+                case "P-256":
+                    oid = OID_NIST_P256
+                case "P-384":
+                    oid = OID_NIST_P384
+                case "P-521":
+                    oid = OID_NIST_P521
+                default:
+                    return nil, fmt.Errorf("unsupported curve %s",
+                        k.Curve.Params().Name)
+            }
+            point = marshalPoint(k)
+        case ed25519.PublicKey:
+            if ecdh {
+                return nil, fmt.Errorf("Ed25519 keys can't be used for ECDH")
+            }
+            oid, point = OID_ED25519, append([]byte{0x40}, k...)
+        case X25519PublicKey:
+            if !ecdh {
+                return nil, fmt.Errorf("X25519 keys can only be used for ECDH")
+            }
+            oid, point = OID_X25519, append([]byte{0x40}, k...)
+        default:
+            return nil, fmt.Errorf("unsupported public key type %T", pub)
+    }
+    if oid != nil {
+        alg := byte(ALG_ECDSA)
+        switch {
+            case ecdh:
+                alg = ALG_ECDH
+            case bytes.Equal(oid, OID_ED25519):
+                alg = ALG_EDDSA
+        }
+        body = append(body, alg, byte(len(oid)))
+        body = append(body, oid...)
+        body = appendMPI(body, point)
+        if ecdh {
+            // KDF parameters: SHA-256, AES-128
+            body = append(body, 0x03, 0x01, 0x08, 0x07)
+        }
+    }
+    h := sha1.New()
+    h.Write([]byte{0x99, byte(len(body) >> 8), byte(len(body))})
+    h.Write(body)
+    return h.Sum(nil), nil
+}
+
+func appendMPI(b, value []byte) []byte {
+    for len(value) > 0 && value[0] == 0 {
+        value = value[1:]
+    }
+    bits := len(value) * 8
+    if len(value) > 0 {
+        bits -= 8 - new(big.Int).SetBytes(value[:1]).BitLen()
+    }
+    b = append(b, byte(bits >> 8), byte(bits))
+    return append(b, value...)
+}
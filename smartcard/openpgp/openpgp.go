@@ -0,0 +1,232 @@
+/*
+Package openpgp implements a client for the OpenPGP smart card application
+(version 3.4).
+
+Example:
+
+    pgp, err := openpgp.Select(card)
+    // handle error, if any
+    data, err := pgp.ApplicationRelatedData()
+    // handle error, if any
+    pub, err := pgp.PublicKey(openpgp.KEY_SIGNATURE)
+    // handle error, if any
+    signer, err := pgp.Signer(pub, openpgp.KeyAuth{PIN: "123456"})
+*/
+package openpgp
+
+import (
+    "fmt"
+    "github.com/sf1/go-card/smartcard"
+    "github.com/sf1/go-card/smartcard/SW"
+    "github.com/sf1/go-card/smartcard/tlv"
+)
+
+// OpenPGP application identifier (RID and PIX prefix).
+var AID = []byte{0xd2, 0x76, 0x00, 0x01, 0x24, 0x01}
+
+const (
+    // Instructions
+    INS_VERIFY = 0x20
+    INS_CHANGE_REFERENCE_DATA = 0x24
+    INS_RESET_RETRY_COUNTER = 0x2c
+    INS_PSO = 0x2a
+    INS_INTERNAL_AUTHENTICATE = 0x88
+    INS_GENERATE_ASYMMETRIC_KEY_PAIR = 0x47
+    INS_GET_DATA = 0xca
+    INS_PUT_DATA = 0xda
+    INS_PUT_DATA_ODD = 0xdb
+    INS_GET_CHALLENGE = 0x84
+    // Password references
+    PW1_SIGN = 0x81
+    PW1 = 0x82
+    PW3 = 0x83
+    // Resetting code, only used for its retry counter
+    _RC = 0x84
+    // Data objects
+    TAG_APPLICATION_RELATED_DATA = 0x6e
+    TAG_CARDHOLDER_RELATED_DATA = 0x65
+    TAG_SECURITY_SUPPORT_TEMPLATE = 0x7a
+    TAG_URL = 0x5f50
+    TAG_LOGIN = 0x5e
+    TAG_NAME = 0x5b
+    TAG_LANGUAGE = 0x5f2d
+    TAG_SEX = 0x5f35
+    TAG_PW_STATUS = 0xc4
+    TAG_CARDHOLDER_CERTIFICATE = 0x7f21
+)
+
+// Error returned if a password is wrong or blocked.
+type PINError struct {
+    // Remaining attempts, 0 if blocked
+    Retries int
+}
+
+func (e *PINError) Error() string {
+    if e.Retries == 0 {
+        return "password blocked"
+    }
+    return fmt.Sprintf("wrong password, %d tries left", e.Retries)
+}
+
+// OpenPGP card application.
+type Card struct {
+    card smartcard.Transmitter
+}
+
+// Select OpenPGP application.
+func Select(card smartcard.Transmitter) (*Card, error) {
+    rsp, err := card.TransmitAPDU(smartcard.Command4(0x00, 0xa4, 0x04, 0x00,
+        AID, 0x00))
+    if err != nil { return nil, err }
+    if rsp.SW() != SW.SUCCESS {
+        return nil, fmt.Errorf("can't select OpenPGP application: %s",
+            smartcard.SWError(rsp.SW()))
+    }
+    return &Card{card: card}, nil
+}
+
+// Return the underlying transmitter.
+func (c *Card) Transmitter() smartcard.Transmitter {
+    return c.card
+}
+
+// Read data object.
+func (c *Card) GetData(tag uint16) ([]byte, error) {
+    rsp, err := smartcard.TransmitAndGetResponse(c.card, smartcard.Command2(
+        0x00, INS_GET_DATA, byte(tag >> 8), byte(tag), 0x00))
+    if err != nil { return nil, err }
+    if rsp.SW() != SW.SUCCESS {
+        return nil, smartcard.SWError(rsp.SW())
+    }
+    return rsp.Data(), nil
+}
+
+// Write data object. Most data objects require PW3 verification.
+func (c *Card) PutData(tag uint16, data []byte) error {
+    rsp, err := smartcard.TransmitChained(c.card, 0x00, INS_PUT_DATA,
+        byte(tag >> 8), byte(tag), data, false)
+    if err != nil { return err }
+    if rsp.SW() != SW.SUCCESS {
+        return fmt.Errorf("put data %04X failed: %s", tag,
+            smartcard.SWError(rsp.SW()))
+    }
+    return nil
+}
+
+// Read and parse Application Related Data (6E).
+func (c *Card) ApplicationRelatedData() (*ApplicationData, error) {
+    data, err := c.GetData(TAG_APPLICATION_RELATED_DATA)
+    if err != nil { return nil, err }
+    return parseApplicationData(data)
+}
+
+// Read and parse Cardholder Related Data (65).
+func (c *Card) CardholderData() (*Cardholder, error) {
+    data, err := c.GetData(TAG_CARDHOLDER_RELATED_DATA)
+    if err != nil { return nil, err }
+    list, err := tlv.Parse(data)
+    if err != nil { return nil, err }
+    if t, ok := list.Find(TAG_CARDHOLDER_RELATED_DATA); ok {
+        list, err = t.Children()
+        if err != nil { return nil, err }
+    }
+    holder := &Cardholder{
+        Name: string(list.Value(TAG_NAME)),
+        Language: string(list.Value(TAG_LANGUAGE)),
+    }
+    if sex := list.Value(TAG_SEX); len(sex) > 0 {
+        holder.Sex = sex[0]
+    }
+    return holder, nil
+}
+
+// Read PW status bytes.
+func (c *Card) PWStatus() (*PWStatus, error) {
+    data, err := c.GetData(TAG_PW_STATUS)
+    if err != nil { return nil, err }
+    if t, _, err := tlv.ParseOne(data); err == nil &&
+        t.Tag == TAG_PW_STATUS {
+        data = t.Value
+    }
+    return parsePWStatus(data)
+}
+
+// Read digital signature counter.
+func (c *Card) SignatureCounter() (int, error) {
+    data, err := c.GetData(TAG_SECURITY_SUPPORT_TEMPLATE)
+    if err != nil { return 0, err }
+    list, err := tlv.Parse(data)
+    if err != nil { return 0, err }
+    if t, ok := list.Find(TAG_SECURITY_SUPPORT_TEMPLATE); ok {
+        list, err = t.Children()
+        if err != nil { return 0, err }
+    }
+    counter := 0
+    for _, b := range list.Value(0x93) {
+        counter = counter << 8 | int(b)
+    }
+    return counter, nil
+}
+
+// Verify PW1 for signing (PW1_SIGN), PW1 for other operations (PW1) or
+// the admin password (PW3). Returns *PINError if the password is wrong.
+func (c *Card) Verify(ref byte, pin string) error {
+    rsp, err := c.card.TransmitAPDU(smartcard.Command3(0x00, INS_VERIFY,
+        0x00, ref, []byte(pin)))
+    if err != nil { return err }
+    return c.pinError(ref, rsp.SW())
+}
+
+func (c *Card) pinError(ref byte, sw uint16) error {
+    switch {
+        case sw == SW.SUCCESS:
+            return nil
+        case sw == SW.AUTH_METHOD_BLOCKED:
+            return &PINError{Retries: 0}
+        case sw & 0xfff0 == SW.AUTH_FAILED:
+            return &PINError{Retries: int(sw & 0x0f)}
+        case sw == SW.SECURITY_STATUS_NOT_SATISFIED:
+            status, err := c.PWStatus()
+            if err != nil {
+                return smartcard.SWError(sw)
+            }
+            retries := status.PW1Retries
+            switch ref {
+                case PW3:
+                    retries = status.PW3Retries
+                case _RC:
+                    retries = status.RCRetries
+            }
+            return &PINError{Retries: retries}
+    }
+    return smartcard.SWError(sw)
+}
+
+// Change PW1 (PW1 or PW1_SIGN) or PW3.
+func (c *Card) ChangePassword(ref byte, oldPIN, newPIN string) error {
+    if ref != PW3 {
+        ref = PW1_SIGN
+    }
+    data := append([]byte(oldPIN), newPIN...)
+    rsp, err := c.card.TransmitAPDU(smartcard.Command3(0x00,
+        INS_CHANGE_REFERENCE_DATA, 0x00, ref, data))
+    if err != nil { return err }
+    return c.pinError(ref, rsp.SW())
+}
+
+// Reset PW1 with the resetting code, or with PW3 if resettingCode is empty
+// (PW3 must have been verified).
+func (c *Card) ResetPW1(resettingCode, newPIN string) error {
+    p1 := byte(0x00)
+    if resettingCode == "" {
+        p1 = 0x02
+    }
+    data := append([]byte(resettingCode), newPIN...)
+    rsp, err := c.card.TransmitAPDU(smartcard.Command3(0x00,
+        INS_RESET_RETRY_COUNTER, p1, PW1_SIGN, data))
+    if err != nil { return err }
+    if p1 == 0x00 {
+        return c.pinError(_RC, rsp.SW())
+    }
+    return c.pinError(PW1, rsp.SW())
+}
@@ -0,0 +1,315 @@
+package openpgp
+
+import (
+    "bytes"
+    "crypto"
+    "crypto/ecdsa"
+    "crypto/ed25519"
+    "crypto/elliptic"
+    "crypto/rand"
+    "crypto/rsa"
+    "crypto/sha256"
+    "testing"
+    "time"
+    "github.com/sf1/go-card/smartcard/mock"
+)
+
+var testRSAKey *rsa.PrivateKey
+
+func rsaTestKey(t *testing.T) *rsa.PrivateKey {
+    if testRSAKey == nil {
+        var err error
+        testRSAKey, err = rsa.GenerateKey(rand.Reader, 2048)
+        if err != nil { t.Fatal(err) }
+    }
+    return testRSAKey
+}
+
+func selectSim(t *testing.T, sim *simCard) *Card {
+    card, err := Select(sim)
+    if err != nil { t.Fatal(err) }
+    return card
+}
+
+func TestApplicationData(t *testing.T) {
+    sim := newSimCard()
+    sim.objects[TAG_NAME] = []byte("Doe<<John")
+    sim.objects[TAG_LANGUAGE] = []byte("en")
+    sim.objects[TAG_SEX] = []byte{0x31}
+    card := selectSim(t, sim)
+    ad, err := card.ApplicationRelatedData()
+    if err != nil { t.Fatal(err) }
+    if ad.AID.VersionString() != "3.4" || ad.AID.Manufacturer != 0x0006 ||
+        ad.AID.Serial != 0x12345678 {
+        t.Errorf("unexpected AID: %+v", ad.AID)
+    }
+    for i, a := range ad.Algorithms {
+        if a.String() != "rsa2048" {
+            t.Errorf("algorithm %d: %s", i, a)
+        }
+    }
+    if ad.PWStatus == nil || ad.PWStatus.PW1Retries != 3 ||
+        ad.PWStatus.PW3Retries != 3 {
+        t.Errorf("unexpected PW status: %+v", ad.PWStatus)
+    }
+    ch, err := card.CardholderData()
+    if err != nil { t.Fatal(err) }
+    if ch.Name != "Doe<<John" || ch.Language != "en" || ch.Sex != 0x31 {
+        t.Errorf("unexpected cardholder data: %+v", ch)
+    }
+}
+
+func TestVerify(t *testing.T) {
+    sim := newSimCard()
+    card := selectSim(t, sim)
+    err := card.Verify(PW1, "000000")
+    pinErr, ok := err.(*PINError)
+    if !ok || pinErr.Retries != 2 {
+        t.Fatalf("expected PINError with 2 retries, got %v", err)
+    }
+    status, err := card.PWStatus()
+    if err != nil { t.Fatal(err) }
+    if status.PW1Retries != 2 {
+        t.Errorf("expected 2 retries, got %d", status.PW1Retries)
+    }
+    if err := card.Verify(PW1, "123456"); err != nil {
+        t.Fatal(err)
+    }
+    if err := card.ChangePassword(PW1, "123456", "654321"); err != nil {
+        t.Fatal(err)
+    }
+    if err := card.Verify(PW3, "12345678"); err != nil {
+        t.Fatal(err)
+    }
+    if err := card.ResetPW1("", "111111"); err != nil {
+        t.Fatal(err)
+    }
+    if sim.pw1 != "111111" {
+        t.Errorf("PW1 not reset: %s", sim.pw1)
+    }
+    // Wrong resetting code reports the RC retry counter
+    sim.rc, sim.retries[1] = "87654321", 3
+    err = card.ResetPW1("00000000", "222222")
+    if pinErr, ok := err.(*PINError); !ok || pinErr.Retries != 2 {
+        t.Fatalf("expected PINError with 2 retries, got %v", err)
+    }
+    if err := card.ResetPW1("87654321", "222222"); err != nil {
+        t.Fatal(err)
+    }
+    if sim.pw1 != "222222" {
+        t.Errorf("PW1 not reset: %s", sim.pw1)
+    }
+}
+
+func TestGenerateAndSign(t *testing.T) {
+    sim := newSimCard()
+    card := selectSim(t, sim)
+    if _, err := card.GenerateKey(KEY_SIGNATURE); err == nil {
+        t.Fatal("key generation without PW3 succeeded")
+    }
+    if err := card.Verify(PW3, "12345678"); err != nil {
+        t.Fatal(err)
+    }
+    err := card.SetAlgorithmAttributes(KEY_SIGNATURE, AlgorithmAttributes{
+        Algorithm: ALG_ECDSA, OID: OID_NIST_P256})
+    if err != nil { t.Fatal(err) }
+    err = card.SetAlgorithmAttributes(KEY_AUTHENTICATION,
+        AlgorithmAttributes{Algorithm: ALG_EDDSA, OID: OID_ED25519})
+    if err != nil { t.Fatal(err) }
+    pub, err := card.GenerateKey(KEY_SIGNATURE)
+    if err != nil { t.Fatal(err) }
+    ecPub, ok := pub.(*ecdsa.PublicKey)
+    if !ok {
+        t.Fatalf("unexpected public key type %T", pub)
+    }
+    read, err := card.PublicKey(KEY_SIGNATURE)
+    if err != nil { t.Fatal(err) }
+    if read.(*ecdsa.PublicKey).X.Cmp(ecPub.X) != 0 {
+        t.Error("public key mismatch")
+    }
+    prompts := 0
+    signer, err := card.Signer(pub, KeyAuth{PINPrompt: func() (string,
+        error) {
+        prompts++
+        return "123456", nil
+    }})
+    if err != nil { t.Fatal(err) }
+    for i := 0; i < 2; i++ {
+        digest := sha256.Sum256([]byte{byte(i)})
+        sig, err := signer.Sign(rand.Reader, digest[:], crypto.SHA256)
+        if err != nil { t.Fatal(err) }
+        if !ecdsa.VerifyASN1(ecPub, digest[:], sig) {
+            t.Error("ECDSA signature verification failed")
+        }
+    }
+    // PW1 is only valid for one signature
+    if prompts != 2 {
+        t.Errorf("expected 2 PIN prompts, got %d", prompts)
+    }
+    counter, err := card.SignatureCounter()
+    if err != nil { t.Fatal(err) }
+    if counter != 2 {
+        t.Errorf("expected signature counter 2, got %d", counter)
+    }
+
+    pub, err = card.GenerateKey(KEY_AUTHENTICATION)
+    if err != nil { t.Fatal(err) }
+    edPub, ok := pub.(ed25519.PublicKey)
+    if !ok {
+        t.Fatalf("unexpected public key type %T", pub)
+    }
+    auth, err := card.AuthenticationSigner(pub, KeyAuth{PIN: "123456"})
+    if err != nil { t.Fatal(err) }
+    msg := []byte("challenge")
+    sig, err := auth.Sign(rand.Reader, msg, crypto.Hash(0))
+    if err != nil { t.Fatal(err) }
+    if !ed25519.Verify(edPub, msg, sig) {
+        t.Error("Ed25519 signature verification failed")
+    }
+}
+
+func TestImportRSA(t *testing.T) {
+    priv := rsaTestKey(t)
+    for _, format := range []byte{RSA_IMPORT_STANDARD, RSA_IMPORT_CRT_N} {
+        sim := newSimCard()
+        card := selectSim(t, sim)
+        if err := card.Verify(PW3, "12345678"); err != nil {
+            t.Fatal(err)
+        }
+        attrs := AlgorithmAttributes{Algorithm: ALG_RSA, ModulusBits: 2048,
+            ExponentBits: 32, ImportFormat: format}
+        for _, key := range []Key{KEY_SIGNATURE, KEY_DECRYPTION} {
+            if err := card.SetAlgorithmAttributes(key, attrs); err != nil {
+                t.Fatal(err)
+            }
+            if err := card.ImportKey(key, priv); err != nil {
+                t.Fatal(err)
+            }
+        }
+        signer, err := card.Signer(&priv.PublicKey, KeyAuth{PIN: "123456"})
+        if err != nil { t.Fatal(err) }
+        digest := sha256.Sum256([]byte("data"))
+        sig, err := signer.Sign(rand.Reader, digest[:], crypto.SHA256)
+        if err != nil { t.Fatal(err) }
+        err = rsa.VerifyPKCS1v15(&priv.PublicKey, crypto.SHA256, digest[:],
+            sig)
+        if err != nil { t.Error(err) }
+        decrypter, err := card.Decrypter(&priv.PublicKey,
+            KeyAuth{PIN: "123456"})
+        if err != nil { t.Fatal(err) }
+        ct, err := rsa.EncryptPKCS1v15(rand.Reader, &priv.PublicKey,
+            []byte("secret"))
+        if err != nil { t.Fatal(err) }
+        plain, err := decrypter.Decrypt(rand.Reader, ct, nil)
+        if err != nil { t.Fatal(err) }
+        if string(plain) != "secret" {
+            t.Errorf("unexpected plaintext %q", plain)
+        }
+    }
+}
+
+func TestImportECDH(t *testing.T) {
+    sim := newSimCard()
+    card := selectSim(t, sim)
+    if err := card.Verify(PW3, "12345678"); err != nil {
+        t.Fatal(err)
+    }
+    err := card.SetAlgorithmAttributes(KEY_DECRYPTION, AlgorithmAttributes{
+        Algorithm: ALG_ECDH, OID: OID_NIST_P256})
+    if err != nil { t.Fatal(err) }
+    priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+    if err != nil { t.Fatal(err) }
+    if err := card.ImportKey(KEY_DECRYPTION, priv); err != nil {
+        t.Fatal(err)
+    }
+    peer, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+    if err != nil { t.Fatal(err) }
+    shared, err := card.SharedKey(marshalPoint(&peer.PublicKey),
+        KeyAuth{PIN: "123456"})
+    if err != nil { t.Fatal(err) }
+    x, _ := elliptic.P256().ScalarMult(priv.X, priv.Y, peer.D.Bytes())
+    if !bytes.Equal(shared, leftPad(x.Bytes(), 32)) {
+        t.Error("shared secret mismatch")
+    }
+}
+
+func TestFingerprint(t *testing.T) {
+    sim := newSimCard()
+    card := selectSim(t, sim)
+    if err := card.Verify(PW3, "12345678"); err != nil {
+        t.Fatal(err)
+    }
+    created := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+    priv := rsaTestKey(t)
+    fp, err := Fingerprint(&priv.PublicKey, created, false)
+    if err != nil { t.Fatal(err) }
+    if err := card.SetFingerprint(KEY_DECRYPTION, fp); err != nil {
+        t.Fatal(err)
+    }
+    if err := card.SetGenerationTime(KEY_DECRYPTION, created); err != nil {
+        t.Fatal(err)
+    }
+    ad, err := card.ApplicationRelatedData()
+    if err != nil { t.Fatal(err) }
+    if !bytes.Equal(ad.Fingerprints[KEY_DECRYPTION], fp) {
+        t.Errorf("fingerprint mismatch: %X", ad.Fingerprints[KEY_DECRYPTION])
+    }
+    if !ad.GenerationTimes[KEY_DECRYPTION].Equal(created) {
+        t.Errorf("generation time mismatch: %s",
+            ad.GenerationTimes[KEY_DECRYPTION])
+    }
+    if !ad.GenerationTimes[KEY_SIGNATURE].IsZero() {
+        t.Error("unset generation time not zero")
+    }
+}
+
+func TestAppendMPI(t *testing.T) {
+    // RFC 4880, 3.2: the string of octets [00 01 01] forms an MPI with
+    // the value 1, [00 09 01 FF] an MPI with the value 511.
+    if mpi := appendMPI(nil, []byte{0x01}); !bytes.Equal(mpi,
+        []byte{0x00, 0x01, 0x01}) {
+        t.Errorf("unexpected MPI %X", mpi)
+    }
+    if mpi := appendMPI(nil, []byte{0x00, 0x01, 0xff}); !bytes.Equal(mpi,
+        []byte{0x00, 0x09, 0x01, 0xff}) {
+        t.Errorf("unexpected MPI %X", mpi)
+    }
+}
+
+// Ed25519 key of RFC 8032 (7.1, test 1) imported, read back and used for
+// signing, and the sample EdDSA key of draft-ietf-openpgp-rfc4880bis
+// (appendix A.1) fingerprinted.
+func TestEd25519Vectors(t *testing.T) {
+    card := selectSim(t, newSimCard())
+    if err := card.Verify(PW3, "12345678"); err != nil { t.Fatal(err) }
+    err := card.SetAlgorithmAttributes(KEY_SIGNATURE,
+        AlgorithmAttributes{Algorithm: ALG_EDDSA, OID: OID_ED25519})
+    if err != nil { t.Fatal(err) }
+    priv := ed25519.NewKeyFromSeed(mock.Hex("9d61b19deffd5a60ba844af492ec2c" +
+        "c44449c5697b326919703bac031cae7f60"))
+    if err := card.ImportKey(KEY_SIGNATURE, priv); err != nil {
+        t.Fatal(err)
+    }
+    pub, err := card.PublicKey(KEY_SIGNATURE)
+    if err != nil { t.Fatal(err) }
+    if key, ok := pub.(ed25519.PublicKey); !ok || !bytes.Equal(key,
+        mock.Hex("d75a980182b10ab7d54bfed3c964073a0ee172f3daa62325af021a" +
+        "68f707511a")) {
+        t.Errorf("unexpected public key %X", pub)
+    }
+    if err := card.Verify(PW1_SIGN, "123456"); err != nil { t.Fatal(err) }
+    sig, err := card.ComputeSignature(nil)
+    if err != nil { t.Fatal(err) }
+    if !bytes.Equal(sig, mock.Hex("e5564300c360ac729086e2cc806e828a84877f" +
+        "1eb8e5d974d873e065224901555fb8821590a33bacc61e39701cf9b46bd25bf5" +
+        "f0595bbe24655141438e7a100b")) {
+        t.Errorf("unexpected signature %X", sig)
+    }
+    fp, err := Fingerprint(ed25519.PublicKey(mock.Hex("3f098994bdd916ed40" +
+        "53197934e4a87c80733a1280d62f8010992e43ee3b2406")),
+        time.Date(2014, 8, 19, 14, 28, 27, 0, time.UTC), false)
+    if err != nil { t.Fatal(err) }
+    if !bytes.Equal(fp, mock.Hex("c959bdbafa32a2f89a153b678cfde12197965a9a")) {
+        t.Errorf("unexpected fingerprint %X", fp)
+    }
+}
@@ -0,0 +1,449 @@
+package openpgp
+
+import (
+    "bytes"
+    "crypto"
+    "crypto/ecdsa"
+    "crypto/ed25519"
+    "crypto/elliptic"
+    "crypto/rand"
+    "crypto/rsa"
+    "fmt"
+    "math/big"
+    "github.com/sf1/go-card/smartcard"
+    "github.com/sf1/go-card/smartcard/mock"
+    "github.com/sf1/go-card/smartcard/tlv"
+)
+
+// Simulated OpenPGP card application for tests: a mock card with a rule
+// per instruction working on the card state.
+type simCard struct {
+    *mock.Card
+    pw1 string
+    pw3 string
+    rc string
+    retries [3]int // PW1, RC, PW3
+    pw1SignVerified bool
+    pw1Verified bool
+    pw3Verified bool
+    multipleSignatures bool
+    signatures int
+    objects map[uint16][]byte
+    attrs [3]AlgorithmAttributes
+    keys [3]crypto.PrivateKey
+    chained []byte
+    pending []byte
+}
+
+var simAID = []byte{0xd2, 0x76, 0x00, 0x01, 0x24, 0x01, 0x03, 0x04,
+    0x00, 0x06, 0x12, 0x34, 0x56, 0x78, 0x00, 0x00}
+
+func newSimCard() *simCard {
+    s := &simCard{
+        pw1: "123456",
+        pw3: "12345678",
+        retries: [3]int{3, 0, 3},
+        objects: make(map[uint16][]byte),
+    }
+    rsa2048 := AlgorithmAttributes{Algorithm: ALG_RSA, ModulusBits: 2048,
+        ExponentBits: 32, ImportFormat: RSA_IMPORT_STANDARD}
+    s.attrs = [3]AlgorithmAttributes{rsa2048, rsa2048, rsa2048}
+    s.Card = mock.NewCard(mock.Hex("3b da 18 ff 81 b1 fe 75 1f 03 00 31 " +
+        "c5 73 c0 01 40 00 90 00 0c")).
+        RuleFunc("10 *", s.chain).
+        RuleFunc("00 a4 04 00 *", s.rule(s.selectApplication)).
+        RuleFunc("00 c0 00 00 *", s.rule(s.getResponse)).
+        RuleFunc("00 ca *", s.rule(s.getData)).
+        RuleFunc("00 da *", s.rule(s.putData)).
+        RuleFunc("00 db 3f ff *", s.rule(s.importKey)).
+        RuleFunc("00 20 00 *", s.rule(s.verify)).
+        RuleFunc("00 24 00 *", s.rule(s.change)).
+        RuleFunc("00 2c *", s.rule(s.resetRetryCounter)).
+        RuleFunc("00 47 *", s.rule(s.generate)).
+        RuleFunc("00 2a 9e 9a *", s.rule(s.computeSignature)).
+        RuleFunc("00 2a 80 86 *", s.rule(s.decipher)).
+        RuleFunc("00 88 00 00 *", s.rule(s.internalAuthenticate))
+    return s
+}
+
+func sw(code uint16) smartcard.ResponseAPDU {
+    return smartcard.ResponseAPDU{byte(code >> 8), byte(code)}
+}
+
+// Return response data, at most 256 bytes at a time (T=0 style).
+func (s *simCard) respond(data []byte) smartcard.ResponseAPDU {
+    if len(data) <= 256 {
+        s.pending = nil
+        return append(append([]byte{}, data...), 0x90, 0x00)
+    }
+    s.pending = data[256:]
+    n := len(s.pending)
+    if n > 255 {
+        n = 0
+    }
+    return append(append([]byte{}, data[:256]...), 0x61, byte(n))
+}
+
+func (s *simCard) pwStatus() []byte {
+    multiple := byte(0x00)
+    if s.multipleSignatures {
+        multiple = 0x01
+    }
+    return []byte{multiple, 0x7f, 0x7f, 0x7f, byte(s.retries[0]),
+        byte(s.retries[1]), byte(s.retries[2])}
+}
+
+func (s *simCard) applicationData() []byte {
+    var fingerprints, times []byte
+    for i := 0; i < 3; i++ {
+        fp := s.objects[uint16(0xc7 + i)]
+        if fp == nil {
+            fp = make([]byte, 20)
+        }
+        fingerprints = append(fingerprints, fp...)
+        ts := s.objects[uint16(0xce + i)]
+        if ts == nil {
+            ts = make([]byte, 4)
+        }
+        times = append(times, ts...)
+    }
+    return tlv.NewConstructed(TAG_APPLICATION_RELATED_DATA,
+        tlv.New(0x4f, simAID),
+        tlv.New(0x5f52, []byte{0x00, 0x73, 0x00, 0x00, 0xe0, 0x05, 0x90,
+            0x00}),
+        tlv.NewConstructed(0x73,
+            tlv.New(0xc0, []byte{0x7d, 0x00, 0x0b, 0xfe, 0x08, 0x00, 0x00,
+                0xff, 0x00, 0x00}),
+            tlv.New(0xc1, s.attrs[0].Bytes()),
+            tlv.New(0xc2, s.attrs[1].Bytes()),
+            tlv.New(0xc3, s.attrs[2].Bytes()),
+            tlv.New(TAG_PW_STATUS, s.pwStatus()),
+            tlv.New(0xc5, fingerprints),
+            tlv.New(0xc6, make([]byte, 60)),
+            tlv.New(0xcd, times))).Bytes()
+}
+
+// Collect data of chained command.
+func (s *simCard) chain(cmd smartcard.CommandAPDU) (smartcard.ResponseAPDU,
+    error) {
+    if !cmd.IsValid() {
+        return nil, fmt.Errorf("invalid APDU %X", []byte(cmd))
+    }
+    s.chained = append(s.chained, cmd.Data()...)
+    return sw(0x9000), nil
+}
+
+// Return rule calling fn with the data of the command and the preceding
+// chained commands.
+func (s *simCard) rule(fn func(cmd smartcard.CommandAPDU,
+    data []byte) smartcard.ResponseAPDU) mock.HandlerFunc {
+    return func(cmd smartcard.CommandAPDU) (smartcard.ResponseAPDU, error) {
+        if !cmd.IsValid() {
+            return nil, fmt.Errorf("invalid APDU %X", []byte(cmd))
+        }
+        data := append(s.chained, cmd.Data()...)
+        s.chained = nil
+        return fn(cmd, data), nil
+    }
+}
+
+func (s *simCard) selectApplication(cmd smartcard.CommandAPDU,
+    data []byte) smartcard.ResponseAPDU {
+    if !bytes.HasPrefix(simAID, data) || len(data) < len(AID) {
+        return sw(0x6a82)
+    }
+    return sw(0x9000)
+}
+
+func (s *simCard) getResponse(cmd smartcard.CommandAPDU,
+    data []byte) smartcard.ResponseAPDU {
+    return s.respond(s.pending)
+}
+
+func (s *simCard) putData(cmd smartcard.CommandAPDU,
+    data []byte) smartcard.ResponseAPDU {
+    if !s.pw3Verified {
+        return sw(0x6982)
+    }
+    tag := uint16(cmd[2]) << 8 | uint16(cmd[3])
+    if tag >= 0xc1 && tag <= 0xc3 {
+        attrs, err := parseAlgorithmAttributes(data)
+        if err != nil { return sw(0x6a80) }
+        s.attrs[tag-0xc1] = attrs
+        return sw(0x9000)
+    }
+    s.objects[tag] = data
+    return sw(0x9000)
+}
+
+func (s *simCard) resetRetryCounter(cmd smartcard.CommandAPDU,
+    data []byte) smartcard.ResponseAPDU {
+    if cmd[2] == 0x00 {
+        if s.rc == "" || s.retries[1] == 0 ||
+            !bytes.HasPrefix(data, []byte(s.rc)) {
+            if s.retries[1] > 0 { s.retries[1]-- }
+            return sw(0x6982)
+        }
+        s.retries[1] = 3
+        data = data[len(s.rc):]
+    } else if !s.pw3Verified {
+        return sw(0x6982)
+    }
+    s.pw1 = string(data)
+    s.retries[0] = 3
+    return sw(0x9000)
+}
+
+func (s *simCard) computeSignature(cmd smartcard.CommandAPDU,
+    data []byte) smartcard.ResponseAPDU {
+    if !s.pw1SignVerified {
+        return sw(0x6982)
+    }
+    if !s.multipleSignatures {
+        s.pw1SignVerified = false
+    }
+    s.signatures++
+    return s.sign(KEY_SIGNATURE, data)
+}
+
+func (s *simCard) internalAuthenticate(cmd smartcard.CommandAPDU,
+    data []byte) smartcard.ResponseAPDU {
+    if !s.pw1Verified {
+        return sw(0x6982)
+    }
+    return s.sign(KEY_AUTHENTICATION, data)
+}
+
+func (s *simCard) getData(cmd smartcard.CommandAPDU,
+    data []byte) smartcard.ResponseAPDU {
+    tag := uint16(cmd[2]) << 8 | uint16(cmd[3])
+    switch tag {
+        case TAG_APPLICATION_RELATED_DATA:
+            return s.respond(s.applicationData())
+        case TAG_CARDHOLDER_RELATED_DATA:
+            return s.respond(tlv.NewConstructed(TAG_CARDHOLDER_RELATED_DATA,
+                tlv.New(TAG_NAME, s.objects[TAG_NAME]),
+                tlv.New(TAG_LANGUAGE, s.objects[TAG_LANGUAGE]),
+                tlv.New(TAG_SEX, s.objects[TAG_SEX])).Bytes())
+        case TAG_PW_STATUS:
+            return s.respond(tlv.Encode(TAG_PW_STATUS, s.pwStatus()))
+        case TAG_SECURITY_SUPPORT_TEMPLATE:
+            return s.respond(tlv.NewConstructed(TAG_SECURITY_SUPPORT_TEMPLATE,
+                tlv.New(0x93, []byte{0, 0, byte(s.signatures)})).Bytes())
+    }
+    obj, ok := s.objects[tag]
+    if !ok {
+        return sw(0x6a88)
+    }
+    return s.respond(tlv.Encode(tlv.Tag(tag), obj))
+}
+
+func (s *simCard) verify(cmd smartcard.CommandAPDU,
+    pin []byte) smartcard.ResponseAPDU {
+    ref := cmd[3]
+    expected, counter := s.pw1, &s.retries[0]
+    if ref == PW3 {
+        expected, counter = s.pw3, &s.retries[2]
+    }
+    if *counter == 0 {
+        return sw(0x6983)
+    }
+    if string(pin) != expected {
+        *counter--
+        return sw(0x63c0 | uint16(*counter))
+    }
+    *counter = 3
+    switch ref {
+        case PW1_SIGN:
+            s.pw1SignVerified = true
+        case PW1:
+            s.pw1Verified = true
+        case PW3:
+            s.pw3Verified = true
+    }
+    return sw(0x9000)
+}
+
+func (s *simCard) change(cmd smartcard.CommandAPDU,
+    data []byte) smartcard.ResponseAPDU {
+    current := &s.pw1
+    if cmd[3] == PW3 {
+        current = &s.pw3
+    }
+    if !bytes.HasPrefix(data, []byte(*current)) {
+        return s.verify(cmd, data)
+    }
+    *current = string(data[len(*current):])
+    return sw(0x9000)
+}
+
+func simKey(crt []byte) (Key, bool) {
+    if len(crt) == 0 {
+        return 0, false
+    }
+    for _, k := range []Key{KEY_SIGNATURE, KEY_DECRYPTION,
+        KEY_AUTHENTICATION} {
+        if tlv.Tag(crt[0]) == k.crt() {
+            return k, true
+        }
+    }
+    return 0, false
+}
+
+func (s *simCard) publicKeyTemplate(key Key) []byte {
+    switch k := s.keys[key].(type) {
+        case *rsa.PrivateKey:
+            return tlv.NewConstructed(0x7f49,
+                tlv.New(0x81, k.N.Bytes()),
+                tlv.New(0x82, big.NewInt(int64(k.E)).Bytes())).Bytes()
+        case *ecdsa.PrivateKey:
+            return tlv.NewConstructed(0x7f49, tlv.New(0x86,
+                marshalPoint(&k.PublicKey))).Bytes()
+        case ed25519.PrivateKey:
+            return tlv.NewConstructed(0x7f49, tlv.New(0x86,
+                []byte(k[32:]))).Bytes()
+    }
+    return nil
+}
+
+func (s *simCard) generate(cmd smartcard.CommandAPDU,
+    crt []byte) smartcard.ResponseAPDU {
+    p1 := cmd[2]
+    key, ok := simKey(crt)
+    if !ok {
+        return sw(0x6a80)
+    }
+    if p1 == 0x80 {
+        if !s.pw3Verified {
+            return sw(0x6982)
+        }
+        attrs := s.attrs[key]
+        var err error
+        switch {
+            case attrs.Algorithm == ALG_RSA:
+                s.keys[key], err = rsa.GenerateKey(rand.Reader,
+                    attrs.ModulusBits)
+            case bytes.Equal(attrs.OID, OID_ED25519):
+                _, s.keys[key], err = ed25519.GenerateKey(rand.Reader)
+            default:
+                s.keys[key], err = ecdsa.GenerateKey(curveByOID(attrs.OID),
+                    rand.Reader)
+        }
+        if err != nil { return sw(0x6f00) }
+    }
+    if s.keys[key] == nil {
+        return sw(0x6a88)
+    }
+    return s.respond(s.publicKeyTemplate(key))
+}
+
+func (s *simCard) importKey(cmd smartcard.CommandAPDU,
+    data []byte) smartcard.ResponseAPDU {
+    if !s.pw3Verified {
+        return sw(0x6982)
+    }
+    ehl, _, err := tlv.ParseOne(data)
+    if err != nil || ehl.Tag != 0x4d { return sw(0x6a80) }
+    list, err := ehl.Children()
+    if err != nil || len(list) != 3 { return sw(0x6a80) }
+    key, ok := simKey(list[0].Tag.Bytes())
+    if !ok {
+        return sw(0x6a80)
+    }
+    // split key data according to the template of tags and lengths
+    fields := make(map[tlv.Tag][]byte)
+    template, values := list.Value(0x7f48), list.Value(0x5f48)
+    for len(template) > 0 {
+        var tag tlv.Tag
+        var length int
+        tag, template, err = tlv.ParseTag(template)
+        if err != nil { return sw(0x6a80) }
+        length, template, err = tlv.ParseLength(template)
+        if err != nil || length > len(values) { return sw(0x6a80) }
+        fields[tag], values = values[:length], values[length:]
+    }
+    attrs := s.attrs[key]
+    switch {
+        case attrs.Algorithm == ALG_RSA:
+            e := new(big.Int).SetBytes(fields[0x91])
+            p := new(big.Int).SetBytes(fields[0x92])
+            q := new(big.Int).SetBytes(fields[0x93])
+            n := new(big.Int).Mul(p, q)
+            if n97, ok := fields[0x97]; ok &&
+                new(big.Int).SetBytes(n97).Cmp(n) != 0 {
+                return sw(0x6a80)
+            }
+            one := big.NewInt(1)
+            phi := new(big.Int).Mul(new(big.Int).Sub(p, one),
+                new(big.Int).Sub(q, one))
+            k := &rsa.PrivateKey{
+                PublicKey: rsa.PublicKey{N: n, E: int(e.Int64())},
+                D: new(big.Int).ModInverse(e, phi),
+                Primes: []*big.Int{p, q},
+            }
+            k.Precompute()
+            if dp, ok := fields[0x95]; ok &&
+                new(big.Int).SetBytes(dp).Cmp(k.Precomputed.Dp) != 0 {
+                return sw(0x6a80)
+            }
+            s.keys[key] = k
+        case bytes.Equal(attrs.OID, OID_ED25519):
+            s.keys[key] = ed25519.NewKeyFromSeed(fields[0x92])
+        default:
+            curve := curveByOID(attrs.OID)
+            k := &ecdsa.PrivateKey{D: new(big.Int).SetBytes(fields[0x92])}
+            k.Curve = curve
+            k.X, k.Y = curve.ScalarBaseMult(fields[0x92])
+            s.keys[key] = k
+    }
+    return sw(0x9000)
+}
+
+func (s *simCard) sign(key Key, data []byte) smartcard.ResponseAPDU {
+    switch k := s.keys[key].(type) {
+        case *rsa.PrivateKey:
+            sig, err := rsa.SignPKCS1v15(nil, k, 0, data)
+            if err != nil { return sw(0x6a80) }
+            return s.respond(sig)
+        case *ecdsa.PrivateKey:
+            r, ss, err := ecdsa.Sign(rand.Reader, k, data)
+            if err != nil { return sw(0x6a80) }
+            size := (k.Curve.Params().BitSize + 7) / 8
+            return s.respond(append(leftPad(r.Bytes(), size),
+                leftPad(ss.Bytes(), size)...))
+        case ed25519.PrivateKey:
+            return s.respond(ed25519.Sign(k, data))
+    }
+    return sw(0x6a88)
+}
+
+func (s *simCard) decipher(cmd smartcard.CommandAPDU,
+    data []byte) smartcard.ResponseAPDU {
+    if !s.pw1Verified {
+        return sw(0x6982)
+    }
+    switch k := s.keys[KEY_DECRYPTION].(type) {
+        case *rsa.PrivateKey:
+            if len(data) == 0 || data[0] != 0x00 {
+                return sw(0x6a80)
+            }
+            plain, err := rsa.DecryptPKCS1v15(nil, k, data[1:])
+            if err != nil { return sw(0x6a80) }
+            return s.respond(plain)
+        case *ecdsa.PrivateKey:
+            list, err := tlv.Parse(data)
+            if err != nil { return sw(0x6a80) }
+            point, ok := list.Search(0x86)
+            if !ok {
+                return sw(0x6a80)
+            }
+            x, y := elliptic.Unmarshal(k.Curve, point.Value)
+            if x == nil {
+                return sw(0x6a80)
+            }
+            sx, _ := k.Curve.ScalarMult(x, y, k.D.Bytes())
+            return s.respond(leftPad(sx.Bytes(),
+                (k.Curve.Params().BitSize + 7) / 8))
+    }
+    return sw(0x6a88)
+}
@@ -0,0 +1,182 @@
+package smartcard
+
+import (
+    "bytes"
+    "crypto"
+    "crypto/rand"
+    "crypto/subtle"
+    "encoding/asn1"
+    "fmt"
+    "hash"
+    "io"
+    "math/big"
+)
+
+// DigestInfo prefixes (RFC 8017, 9.2).
+var digestInfoPrefixes = map[crypto.Hash][]byte{
+    crypto.SHA1: {0x30, 0x21, 0x30, 0x09, 0x06, 0x05, 0x2b, 0x0e, 0x03,
+        0x02, 0x1a, 0x05, 0x00, 0x04, 0x14},
+    crypto.SHA224: {0x30, 0x2d, 0x30, 0x0d, 0x06, 0x09, 0x60, 0x86, 0x48,
+        0x01, 0x65, 0x03, 0x04, 0x02, 0x04, 0x05, 0x00, 0x04, 0x1c},
+    crypto.SHA256: {0x30, 0x31, 0x30, 0x0d, 0x06, 0x09, 0x60, 0x86, 0x48,
+        0x01, 0x65, 0x03, 0x04, 0x02, 0x01, 0x05, 0x00, 0x04, 0x20},
+    crypto.SHA384: {0x30, 0x41, 0x30, 0x0d, 0x06, 0x09, 0x60, 0x86, 0x48,
+        0x01, 0x65, 0x03, 0x04, 0x02, 0x02, 0x05, 0x00, 0x04, 0x30},
+    crypto.SHA512: {0x30, 0x51, 0x30, 0x0d, 0x06, 0x09, 0x60, 0x86, 0x48,
+        0x01, 0x65, 0x03, 0x04, 0x02, 0x03, 0x05, 0x00, 0x04, 0x40},
+}
+
+// EMSA-PKCS1-v1_5 encoding of digest for a k byte modulus.
+// A zero hash signs the digest without DigestInfo (e.g. for TLS 1.1).
+func pkcs1v15Encode(h crypto.Hash, digest []byte, k int) ([]byte, error) {
+    var prefix []byte
+    if h != 0 {
+        var ok bool
+        prefix, ok = digestInfoPrefixes[h]
+        if !ok {
+            return nil, fmt.Errorf("unsupported hash function: %v", h)
+        }
+        if len(digest) != h.Size() {
+            return nil, fmt.Errorf("invalid digest length: %d", len(digest))
+        }
+    }
+    tLen := len(prefix) + len(digest)
+    if k < tLen + 11 {
+        return nil, fmt.Errorf("key too small for digest")
+    }
+    em := make([]byte, k)
+    em[1] = 0x01
+    for i := 2; i < k - tLen - 1; i++ {
+        em[i] = 0xff
+    }
+    copy(em[k-tLen:], prefix)
+    copy(em[k-len(digest):], digest)
+    return em, nil
+}
+
+func mgf1XOR(out []byte, h hash.Hash, seed []byte) {
+    var counter [4]byte
+    var digest []byte
+    done := 0
+    for done < len(out) {
+        h.Reset()
+        h.Write(seed)
+        h.Write(counter[:])
+        digest = h.Sum(digest[:0])
+        for i := 0; i < len(digest) && done < len(out); i++ {
+            out[done] ^= digest[i]
+            done++
+        }
+        for i := 3; i >= 0; i-- {
+            counter[i]++
+            if counter[i] != 0 {
+                break
+            }
+        }
+    }
+}
+
+// EMSA-PSS encoding (RFC 8017, 9.1.1) of digest for a modulus with
+// modBits bits. The result is left padded to the modulus length.
+func pssEncode(h crypto.Hash, digest []byte, saltLen int, modBits int,
+    random io.Reader) ([]byte, error) {
+    if !h.Available() {
+        return nil, fmt.Errorf("hash function unavailable: %v", h)
+    }
+    hLen := h.Size()
+    emBits := modBits - 1
+    emLen := (emBits + 7) / 8
+    if saltLen < 0 {
+        // maximum salt length
+        saltLen = emLen - hLen - 2
+    }
+    if len(digest) != hLen || emLen < hLen + saltLen + 2 {
+        return nil, fmt.Errorf("invalid PSS parameters")
+    }
+    salt := make([]byte, saltLen)
+    _, err := io.ReadFull(random, salt)
+    if err != nil { return nil, err }
+    hh := h.New()
+    hh.Write(make([]byte, 8))
+    hh.Write(digest)
+    hh.Write(salt)
+    H := hh.Sum(nil)
+    db := make([]byte, emLen - hLen - 1)
+    db[len(db) - saltLen - 1] = 0x01
+    copy(db[len(db)-saltLen:], salt)
+    mgf1XOR(db, h.New(), H)
+    db[0] &= 0xff >> uint(8*emLen - emBits)
+    em := make([]byte, 0, (modBits + 7) / 8)
+    if emLen < (modBits + 7) / 8 {
+        em = append(em, 0x00)
+    }
+    em = append(em, db...)
+    em = append(em, H...)
+    return append(em, 0xbc), nil
+}
+
+// Remove PKCS#1 v1.5 encryption padding (block type 2).
+func pkcs1v15Decode(em []byte) ([]byte, error) {
+    if len(em) < 11 || em[0] != 0x00 || em[1] != 0x02 {
+        return nil, fmt.Errorf("decryption error")
+    }
+    i := bytes.IndexByte(em[2:], 0x00)
+    if i < 8 {
+        return nil, fmt.Errorf("decryption error")
+    }
+    return em[i+3:], nil
+}
+
+// Remove OAEP padding (RFC 8017, 7.1.2).
+func oaepDecode(h crypto.Hash, label []byte, em []byte) ([]byte, error) {
+    if !h.Available() {
+        return nil, fmt.Errorf("hash function unavailable: %v", h)
+    }
+    hh := h.New()
+    hLen := hh.Size()
+    if len(em) < 2*hLen + 2 {
+        return nil, fmt.Errorf("decryption error")
+    }
+    hh.Write(label)
+    lHash := hh.Sum(nil)
+    seed := append([]byte{}, em[1:1+hLen]...)
+    db := append([]byte{}, em[1+hLen:]...)
+    mgf1XOR(seed, h.New(), db)
+    mgf1XOR(db, h.New(), seed)
+    valid := subtle.ConstantTimeByteEq(em[0], 0) &
+        subtle.ConstantTimeCompare(db[:hLen], lHash)
+    rest := db[hLen:]
+    i := bytes.IndexByte(rest, 0x01)
+    if valid != 1 || i < 0 {
+        return nil, fmt.Errorf("decryption error")
+    }
+    for _, b := range rest[:i] {
+        if b != 0x00 {
+            return nil, fmt.Errorf("decryption error")
+        }
+    }
+    return rest[i+1:], nil
+}
+
+func randReader(r io.Reader) io.Reader {
+    if r == nil {
+        return rand.Reader
+    }
+    return r
+}
+
+// Return ECDSA signature ASN.1 DER encoded. Cards return either DER or the
+// raw r||s format with size bytes per integer.
+func ecdsaSignature(sig []byte, size int) ([]byte, error) {
+    var rs struct {
+        R, S *big.Int
+    }
+    rest, err := asn1.Unmarshal(sig, &rs)
+    if err == nil && len(rest) == 0 { return sig, nil }
+    if len(sig) != 2*size {
+        return nil, fmt.Errorf("invalid ECDSA signature length: %d", len(sig))
+    }
+    rs.R = new(big.Int).SetBytes(sig[:size])
+    rs.S = new(big.Int).SetBytes(sig[size:])
+    return asn1.Marshal(rs)
+}
@@ -1,5 +1,12 @@
 package pcsc
 
+// PC/SC error code, e.g. SCARD_E_TIMEOUT.
+type Error uint32
+
+func (e Error) Error() string {
+    return errorString(uint32(e))
+}
+
 func errorString(code uint32) string {
     str := "Unknown error"
     switch code {
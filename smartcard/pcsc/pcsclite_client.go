@@ -4,9 +4,12 @@ package pcsc
 
 import (
     "net"
+    "os"
     "unsafe"
     "bytes"
     "fmt"
+    "io"
+    "time"
 )
 
 const (
@@ -39,6 +42,7 @@ const (
     // Limits
     _PCSCLITE_MAX_READERS_CONTEXTS = 16
     _MAX_READERNAME = 128
+    _MAX_BUFFER_SIZE = 264
 )
 
 type rxHeader struct {
@@ -90,6 +94,39 @@ type transmitStruct struct {
     rv uint32
 }
 
+type controlStruct struct {
+    card int32
+    controlCode uint32
+    sendLength uint32
+    recvLength uint32
+    bytesReturned uint32
+    rv uint32
+}
+
+type getSetStruct struct {
+    card int32
+    attrID uint32
+    attr [_MAX_BUFFER_SIZE]byte
+    attrLen uint32
+    rv uint32
+}
+
+type beginStruct struct {
+    card int32
+    rv uint32
+}
+
+type endStruct struct {
+    card int32
+    disposition uint32
+    rv uint32
+}
+
+type statusStruct struct {
+    card int32
+    rv uint32
+}
+
 type waitReaderStateChangeStruct struct {
     timeOutMs uint32
     rv uint32
@@ -162,10 +199,23 @@ type PCSCLiteClient struct {
     readerCount uint32
 }
 
+// Default pcscd socket. Like libpcsclite, PCSCLiteConnect uses the
+// socket named by the PCSCLITE_CSOCK_NAME environment variable instead, if
+// set.
+const PCSCLITE_CSOCK_NAME = "/var/run/pcscd/pcscd.comm"
+
+// Interval of BeginTransaction retries while another application holds a
+// transaction, as in libpcsclite.
+const LOCK_POLL_RATE = 100*time.Millisecond
+
 func PCSCLiteConnect() (*PCSCLiteClient, error) {
     var err error
+    path := PCSCLITE_CSOCK_NAME
+    if env := os.Getenv("PCSCLITE_CSOCK_NAME"); env != "" {
+        path = env
+    }
     client := &PCSCLiteClient{}
-    client.connection, err = net.Dial("unix","/var/run/pcscd/pcscd.comm")
+    client.connection, err = net.Dial("unix", path)
     if err != nil { return nil, fmt.Errorf("can't connect to PCSCD") }
     /*
     version := versionStruct{
@@ -201,7 +251,7 @@ func (client *PCSCLiteClient) ExchangeMessage(cmd uint32, msg []byte) error {
     if err != nil { return err }
     _, err = client.connection.Write(msg)
     if err != nil { return err }
-    _, err = client.connection.Read(msg)
+    _, err = io.ReadFull(client.connection, msg)
     return err
 }
 
@@ -247,7 +297,8 @@ func (client *PCSCLiteClient) SyncReaders() (
     ptr := (*[unsafe.Sizeof(client.readers)]byte)(
         unsafe.Pointer(&client.readers))
     err := client.SendHeader(_CMD_GET_READERS_STATE, 0)
-    _, err = client.Read(ptr[:])
+    if err != nil { return count, err }
+    _, err = io.ReadFull(client.connection, ptr[:])
     if err != nil { return count, err }
     for count = 0; count < _PCSCLITE_MAX_READERS_CONTEXTS; count++ {
         ri := client.readers[count]
@@ -270,6 +321,13 @@ func (client *PCSCLiteClient) ListReaders() ([]*Reader, error) {
 
 func (client *PCSCLiteClient) CardConnect(context uint32, readerName string) (
     int32, uint32, error) {
+    return client.CardConnectMode(context, readerName, SCARD_SHARE_SHARED,
+        SCARD_PROTOCOL_ANY)
+}
+
+// Connect to card with share mode and preferred protocols.
+func (client *PCSCLiteClient) CardConnectMode(context uint32,
+    readerName string, shareMode, protocols uint32) (int32, uint32, error) {
     cstruct := connectStruct{context: context}
     readerBytes := ([]byte)(readerName)
     limit := len(readerBytes)
@@ -277,8 +335,8 @@ func (client *PCSCLiteClient) CardConnect(context uint32, readerName string) (
     for i := 0; i < limit; i++ {
         cstruct.readerName[i] = readerBytes[i]
     }
-    cstruct.shareMode = SCARD_SHARE_SHARED
-    cstruct.preferredProtocols = SCARD_PROTOCOL_ANY
+    cstruct.shareMode = shareMode
+    cstruct.preferredProtocols = protocols
     ptr := (*[unsafe.Sizeof(cstruct)]byte)(unsafe.Pointer(&cstruct))
     err := client.ExchangeMessage(_SCARD_CONNECT, ptr[:])
     if err != nil { return 0, 0, err }
@@ -289,11 +347,16 @@ func (client *PCSCLiteClient) CardConnect(context uint32, readerName string) (
     return cstruct.card, cstruct.activeProtocol, nil
 }
 
-func (client *PCSCLiteClient) CardDisconnect(card int32) error {
+// Disconnect from card. The card is reset unless a disposition is given.
+func (client *PCSCLiteClient) CardDisconnect(card int32,
+    disposition ...uint32) error {
     dstruct := disconnectStruct{
         card: card,
         disposition: SCARD_RESET_CARD,
     }
+    if len(disposition) > 0 {
+        dstruct.disposition = disposition[0]
+    }
     ptr := (*[unsafe.Sizeof(dstruct)]byte)(unsafe.Pointer(&dstruct))
     err := client.ExchangeMessage(_SCARD_DISCONNECT, ptr[:])
     if err != nil { return err }
@@ -322,16 +385,123 @@ func (client *PCSCLiteClient) Transmit(card int32, protocol uint32,
     if err != nil { return 0, err }
     _, err = client.connection.Write(sendBuffer)
     if err != nil { return 0, err }
-    _, err = client.connection.Read(tsBytes)
+    _, err = io.ReadFull(client.connection, tsBytes)
     if err != nil { return 0, err }
     if tstruct.rv != SCARD_S_SUCCESS {
         return 0, fmt.Errorf("transmission failed: %s", errorString(tstruct.rv))
     }
-    _, err = client.connection.Read(recvBuffer)
+    if tstruct.recvLength > uint32(len(recvBuffer)) {
+        return 0, fmt.Errorf("transmission failed: response too long")
+    }
+    _, err = io.ReadFull(client.connection, recvBuffer[:tstruct.recvLength])
     if err != nil { return 0, err }
     return tstruct.recvLength, nil
 }
 
+// Send control command to the reader driver and return the response.
+func (client *PCSCLiteClient) Control(card int32, code uint32,
+    sendBuffer []byte, recvBuffer []byte) (uint32, error) {
+    cstruct := controlStruct{
+        card: card,
+        controlCode: code,
+        sendLength: uint32(len(sendBuffer)),
+        recvLength: uint32(len(recvBuffer)),
+    }
+    csBytes := (*[unsafe.Sizeof(cstruct)]byte)(unsafe.Pointer(&cstruct))[:]
+    err := client.SendHeader(_SCARD_CONTROL, uint32(len(csBytes)))
+    if err != nil { return 0, err }
+    _, err = client.connection.Write(csBytes)
+    if err != nil { return 0, err }
+    if len(sendBuffer) > 0 {
+        _, err = client.connection.Write(sendBuffer)
+        if err != nil { return 0, err }
+    }
+    _, err = io.ReadFull(client.connection, csBytes)
+    if err != nil { return 0, err }
+    if cstruct.rv != SCARD_S_SUCCESS {
+        return 0, fmt.Errorf("control failed: %s", errorString(cstruct.rv))
+    }
+    if cstruct.bytesReturned > uint32(len(recvBuffer)) {
+        return 0, fmt.Errorf("control failed: response too long")
+    }
+    _, err = io.ReadFull(client.connection,
+        recvBuffer[:cstruct.bytesReturned])
+    if err != nil { return 0, err }
+    return cstruct.bytesReturned, nil
+}
+
+// Return reader attribute, e.g. SCARD_ATTR_ATR_STRING.
+func (client *PCSCLiteClient) GetAttrib(card int32, attr uint32) ([]byte,
+    error) {
+    gstruct := getSetStruct{card: card, attrID: attr,
+        attrLen: _MAX_BUFFER_SIZE}
+    ptr := (*[unsafe.Sizeof(gstruct)]byte)(unsafe.Pointer(&gstruct))
+    err := client.ExchangeMessage(_SCARD_GET_ATTRIB, ptr[:])
+    if err != nil { return nil, err }
+    if gstruct.rv != SCARD_S_SUCCESS {
+        return nil, fmt.Errorf("can't get attribute: %s",
+            errorString(gstruct.rv))
+    }
+    if gstruct.attrLen > _MAX_BUFFER_SIZE {
+        return nil, fmt.Errorf("can't get attribute: invalid length")
+    }
+    return append([]byte{}, gstruct.attr[:gstruct.attrLen]...), nil
+}
+
+// Start transaction, blocking other applications from accessing the card.
+// Waits while another application holds a transaction.
+func (client *PCSCLiteClient) BeginTransaction(card int32) error {
+    for {
+        err := client.TryBeginTransaction(card)
+        if err != Error(SCARD_E_SHARING_VIOLATION) { return err }
+        time.Sleep(LOCK_POLL_RATE)
+    }
+}
+
+// Start transaction. Returns Error(SCARD_E_SHARING_VIOLATION) if another
+// application holds a transaction.
+func (client *PCSCLiteClient) TryBeginTransaction(card int32) error {
+    bstruct := beginStruct{card: card}
+    ptr := (*[unsafe.Sizeof(bstruct)]byte)(unsafe.Pointer(&bstruct))
+    err := client.ExchangeMessage(_SCARD_BEGIN_TRANSACTION, ptr[:])
+    if err != nil { return err }
+    if bstruct.rv == SCARD_E_SHARING_VIOLATION {
+        return Error(bstruct.rv)
+    }
+    if bstruct.rv != SCARD_S_SUCCESS {
+        return fmt.Errorf("can't begin transaction: %s",
+            errorString(bstruct.rv))
+    }
+    return nil
+}
+
+// End transaction, leaving, resetting, unpowering or ejecting the card.
+func (client *PCSCLiteClient) EndTransaction(card int32,
+    disposition uint32) error {
+    estruct := endStruct{card: card, disposition: disposition}
+    ptr := (*[unsafe.Sizeof(estruct)]byte)(unsafe.Pointer(&estruct))
+    err := client.ExchangeMessage(_SCARD_END_TRANSACTION, ptr[:])
+    if err != nil { return err }
+    if estruct.rv != SCARD_S_SUCCESS {
+        return fmt.Errorf("can't end transaction: %s",
+            errorString(estruct.rv))
+    }
+    return nil
+}
+
+// Check that the card handle is still valid. Card state, protocol and ATR
+// are published in the reader states (see SyncReaders).
+func (client *PCSCLiteClient) Status(card int32) error {
+    sstruct := statusStruct{card: card}
+    ptr := (*[unsafe.Sizeof(sstruct)]byte)(unsafe.Pointer(&sstruct))
+    err := client.ExchangeMessage(_SCARD_STATUS, ptr[:])
+    if err != nil { return err }
+    if sstruct.rv != SCARD_S_SUCCESS {
+        return fmt.Errorf("can't get status: %s", errorString(sstruct.rv))
+    }
+    return nil
+}
+
 /*
 func (client *PCSCLiteClient) WaitReaderStateChange() error {
     wrstruct := waitReaderStateChangeStruct{ timeOutMs: uint32(60000) }
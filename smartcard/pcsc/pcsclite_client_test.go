@@ -1,10 +1,17 @@
 // +build !windows
 
-package pcsc
+package pcsc_test
 
 import (
     "fmt"
+    "io/ioutil"
+    "os"
+    "path/filepath"
     "testing"
+    "time"
+    "github.com/sf1/go-card/smartcard/mock"
+    "github.com/sf1/go-card/smartcard/pcsc"
+    "github.com/sf1/go-card/smartcard/pcscd"
 )
 
 var CMD_SELECT = []byte{
@@ -16,6 +23,35 @@ var CMD_10 = []byte{
     0x00, 0x10, 0x00, 0x00, 0x0B,
 }
 
+// Run tests against a fake pcscd with the hello world applet unless a
+// daemon is configured or running.
+func TestMain(m *testing.M) {
+    _, err := os.Stat(pcsc.PCSCLITE_CSOCK_NAME)
+    if os.Getenv("PCSCLITE_CSOCK_NAME") != "" || err == nil {
+        os.Exit(m.Run())
+    }
+    dir, err := ioutil.TempDir("", "pcscd")
+    if err != nil { panic(err) }
+    card := mock.NewCard(mock.Hex("3b 80 80 01 01")).
+        Rule(fmt.Sprintf("%x", CMD_SELECT), "90 00").
+        Rule(fmt.Sprintf("%x", CMD_10), fmt.Sprintf("%x 90 00",
+            "Hello world"))
+    backend := mock.NewBackend()
+    backend.AddReader("Virtual Reader 00").Insert(card)
+    server := pcscd.NewServer(backend)
+    path := filepath.Join(dir, "pcscd.comm")
+    go server.ListenAndServe(path)
+    for i := 0; i < 100; i++ {
+        if _, err := os.Stat(path); err == nil { break }
+        time.Sleep(10*time.Millisecond)
+    }
+    os.Setenv("PCSCLITE_CSOCK_NAME", path)
+    code := m.Run()
+    server.Close()
+    os.RemoveAll(dir)
+    os.Exit(code)
+}
+
 func printHex(buffer []byte) {
     for _, b := range buffer {
         fmt.Printf("%02x", b)
@@ -29,7 +65,7 @@ func TestClient(t *testing.T) {
     fmt.Printf("=================\n\n")
     fmt.Println("Connect to daemon")
     fmt.Printf("-----------------\n\n")
-    client, err := PCSCLiteConnect()
+    client, err := pcsc.PCSCLiteConnect()
     if err != nil { t.Error(err); return }
     defer client.Close()
     fmt.Println("OK")
@@ -43,7 +79,7 @@ func TestClient(t *testing.T) {
 
     fmt.Println("\nList Readers")
     fmt.Printf("------------\n\n")
-    var selectedReader *Reader = nil
+    var selectedReader *pcsc.Reader = nil
     readers, err := client.ListReaders()
     if err != nil { t.Error(err); return }
     for _, reader := range readers {
@@ -36,6 +36,10 @@ type WinscardWrapper struct {
     transmit *syscall.LazyProc
     getStatusChange *syscall.LazyProc
     getAttrib *syscall.LazyProc
+    control *syscall.LazyProc
+    beginTransaction *syscall.LazyProc
+    endTransaction *syscall.LazyProc
+    status *syscall.LazyProc
     t0PCI uintptr
     t1PCI uintptr
 }
@@ -59,6 +63,10 @@ func Winscard() (*WinscardWrapper, error) {
     winscard.transmit = dll.NewProc("SCardTransmit")
     winscard.getStatusChange = dll.NewProc("SCardGetStatusChangeA")
     winscard.getAttrib = dll.NewProc("SCardGetAttrib")
+    winscard.control = dll.NewProc("SCardControl")
+    winscard.beginTransaction = dll.NewProc("SCardBeginTransaction")
+    winscard.endTransaction = dll.NewProc("SCardEndTransaction")
+    winscard.status = dll.NewProc("SCardStatusA")
     t0 := dll.NewProc("g_rgSCardT0Pci")
     t1 := dll.NewProc("g_rgSCardT1Pci")
     if t0.Find() != nil || t1.Find() != nil {
@@ -149,6 +157,9 @@ func (ww *WinscardWrapper) GetStatusChange(ctx uintptr, timeout uint32,
     }
     rv, _, _ := ww.getStatusChange.Call(ctx, uintptr(timeout),
         uintptr(unsafe.Pointer(&_states[0])), uintptr(len(_states)))
+    if rv == SCARD_E_TIMEOUT {
+        return Error(rv)
+    }
     if rv != SCARD_S_SUCCESS {
         return fmt.Errorf("get status change failed: %s",
             errorString(uint32(rv)))
@@ -182,11 +193,18 @@ func (ww *WinscardWrapper) GetStatusChangeAll(ctx uintptr, timeout uint32,
 
 func (ww *WinscardWrapper) CardConnect(ctx uintptr, reader string) (
     uintptr, uintptr, error) {
+    return ww.CardConnectMode(ctx, reader, SCARD_SHARE_SHARED,
+        SCARD_PROTOCOL_ANY)
+}
+
+// Connect to card with share mode and preferred protocols.
+func (ww *WinscardWrapper) CardConnectMode(ctx uintptr, reader string,
+    shareMode, protocols uint32) (uintptr, uintptr, error) {
     var card, activeProtocol uintptr
     rv, _, _ := ww.cardConnect.Call(
         ctx,
         uintptr(unsafe.Pointer(unsafe.Pointer(&ww.stringToBytes(reader)[0]))),
-        uintptr(SCARD_SHARE_SHARED), uintptr(SCARD_PROTOCOL_ANY),
+        uintptr(shareMode), uintptr(protocols),
         uintptr(unsafe.Pointer(&card)),
         uintptr(unsafe.Pointer(&activeProtocol)),
     )
@@ -197,8 +215,14 @@ func (ww *WinscardWrapper) CardConnect(ctx uintptr, reader string) (
     return card, activeProtocol, nil
 }
 
-func (ww *WinscardWrapper) CardDisconnect(card uintptr) error {
-    rv, _, _ := ww.cardDisconnect.Call(card, uintptr(SCARD_RESET_CARD))
+// Disconnect from card. The card is reset unless a disposition is given.
+func (ww *WinscardWrapper) CardDisconnect(card uintptr,
+    disposition ...uint32) error {
+    d := uint32(SCARD_RESET_CARD)
+    if len(disposition) > 0 {
+        d = disposition[0]
+    }
+    rv, _, _ := ww.cardDisconnect.Call(card, uintptr(d))
     if rv != SCARD_S_SUCCESS {
         return fmt.Errorf("can't disconnect from card: %s",
             errorString(uint32(rv)))
@@ -245,3 +269,65 @@ func (ww WinscardWrapper) GetAttrib(card uintptr, attr uint32) ([]byte, error) {
     }
     return buffer[:size], nil
 }
+
+// Send control command to the reader driver and return the response.
+func (ww *WinscardWrapper) Control(card uintptr, code uint32,
+    sendBuffer []byte, recvBuffer []byte) (uint32, error) {
+    var send, recv uintptr
+    var returned uint32
+    if len(sendBuffer) > 0 {
+        send = uintptr(unsafe.Pointer(&sendBuffer[0]))
+    }
+    if len(recvBuffer) > 0 {
+        recv = uintptr(unsafe.Pointer(&recvBuffer[0]))
+    }
+    rv, _, _ := ww.control.Call(card, uintptr(code), send,
+        uintptr(len(sendBuffer)), recv, uintptr(len(recvBuffer)),
+        uintptr(unsafe.Pointer(&returned)))
+    if rv != SCARD_S_SUCCESS {
+        return 0, fmt.Errorf("control failed: %s", errorString(uint32(rv)))
+    }
+    return returned, nil
+}
+
+// Start transaction, blocking other applications from accessing the card.
+func (ww *WinscardWrapper) BeginTransaction(card uintptr) error {
+    rv, _, _ := ww.beginTransaction.Call(card)
+    if rv != SCARD_S_SUCCESS {
+        return fmt.Errorf("can't begin transaction: %s",
+            errorString(uint32(rv)))
+    }
+    return nil
+}
+
+// End transaction, leaving, resetting, unpowering or ejecting the card.
+func (ww *WinscardWrapper) EndTransaction(card uintptr,
+    disposition uint32) error {
+    rv, _, _ := ww.endTransaction.Call(card, uintptr(disposition))
+    if rv != SCARD_S_SUCCESS {
+        return fmt.Errorf("can't end transaction: %s",
+            errorString(uint32(rv)))
+    }
+    return nil
+}
+
+// Return reader name, state, protocol and ATR of the card.
+func (ww *WinscardWrapper) Status(card uintptr) (string, uint32, uint32,
+    []byte, error) {
+    var state, protocol uint32
+    reader := make([]byte, 1024)
+    readerLen := uint32(len(reader))
+    atr := make([]byte, _MAX_ATR_SIZE)
+    atrLen := uint32(len(atr))
+    rv, _, _ := ww.status.Call(card, uintptr(unsafe.Pointer(&reader[0])),
+        uintptr(unsafe.Pointer(&readerLen)), uintptr(unsafe.Pointer(&state)),
+        uintptr(unsafe.Pointer(&protocol)), uintptr(unsafe.Pointer(&atr[0])),
+        uintptr(unsafe.Pointer(&atrLen)))
+    if rv != SCARD_S_SUCCESS {
+        return "", 0, 0, nil, fmt.Errorf("can't get status: %s",
+            errorString(uint32(rv)))
+    }
+    n := bytes.IndexByte(reader, 0)
+    if n < 0 { n = len(reader) }
+    return string(reader[:n]), state, protocol, atr[:atrLen], nil
+}
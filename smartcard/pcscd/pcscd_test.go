@@ -0,0 +1,275 @@
+// +build !windows
+
+package pcscd
+
+import (
+    "bytes"
+    "io"
+    "io/ioutil"
+    "os"
+    "path/filepath"
+    "testing"
+    "time"
+    "unsafe"
+    "github.com/sf1/go-card/smartcard"
+    "github.com/sf1/go-card/smartcard/mock"
+    "github.com/sf1/go-card/smartcard/pcsc"
+)
+
+var testATR = mock.Hex("3b 80 80 01 01")
+
+// Start server for backend on a temporary socket named by
+// PCSCLITE_CSOCK_NAME.
+func start(t *testing.T, backend smartcard.Backend) (*Server, func()) {
+    t.Helper()
+    dir, err := ioutil.TempDir("", "pcscd")
+    if err != nil { t.Fatal(err) }
+    path := filepath.Join(dir, "pcscd.comm")
+    server := NewServer(backend)
+    go server.ListenAndServe(path)
+    for i := 0; i < 100; i++ {
+        if _, err := os.Stat(path); err == nil { break }
+        time.Sleep(10*time.Millisecond)
+    }
+    env, set := os.LookupEnv("PCSCLITE_CSOCK_NAME")
+    os.Setenv("PCSCLITE_CSOCK_NAME", path)
+    return server, func() {
+        server.Close()
+        os.RemoveAll(dir)
+        if set {
+            os.Setenv("PCSCLITE_CSOCK_NAME", env)
+        } else {
+            os.Unsetenv("PCSCLITE_CSOCK_NAME")
+        }
+    }
+}
+
+// Wait until the server state satisfies cond.
+func waitServer(t *testing.T, server *Server, cond func() bool) {
+    t.Helper()
+    for i := 0; i < 100; i++ {
+        server.mutex.Lock()
+        ok := cond()
+        server.mutex.Unlock()
+        if ok { return }
+        time.Sleep(10*time.Millisecond)
+    }
+    t.Fatal("server state not reached")
+}
+
+// Wait until all contexts and cards of the backend are released.
+func waitReleased(t *testing.T, backend *mock.Backend) {
+    t.Helper()
+    for i := 0; i < 100; i++ {
+        // The server's monitor keeps one context
+        if contexts, cards := backend.Open(); contexts == 1 && cards == 0 {
+            return
+        }
+        time.Sleep(10*time.Millisecond)
+    }
+    contexts, cards := backend.Open()
+    t.Errorf("%d contexts, %d cards open", contexts, cards)
+}
+
+func TestServer(t *testing.T) {
+    backend := mock.NewBackend()
+    reader := backend.AddReader("Virtual Reader 00")
+    backend.AddReader("Virtual Reader 01")
+    reader.SetAttrib(0x10100, []byte{0x01})
+    reader.HandleControl(func(code uint32, data []byte) ([]byte, error) {
+        return append([]byte{byte(code)}, data...), nil
+    })
+    _, stop := start(t, backend)
+    defer stop()
+    ctx, err := smartcard.EstablishContext()
+    if err != nil { t.Fatal(err) }
+    readers, err := ctx.ListReaders()
+    if err != nil || len(readers) != 2 ||
+        readers[0].Name() != "Virtual Reader 00" {
+        t.Fatalf("unexpected readers %v, %v", readers, err)
+    }
+    readers, err = ctx.ListReadersWithCard()
+    if err != nil || len(readers) != 0 {
+        t.Fatalf("unexpected readers %v, %v", readers, err)
+    }
+    card := mock.NewCard(testATR).Rule("00 84 00 00 ??", "01 02 90 00")
+    go func() {
+        time.Sleep(20*time.Millisecond)
+        reader.Insert(card)
+    }()
+    r, err := ctx.WaitForCardPresent()
+    if err != nil || r.Name() != reader.Name() {
+        t.Fatalf("unexpected reader %v, %v", r, err)
+    }
+    c, err := r.Connect()
+    if err != nil { t.Fatal(err) }
+    if !bytes.Equal(c.ATR(), testATR) { t.Errorf("unexpected ATR %s", c.ATR()) }
+    rsp, err := c.Transmit(mock.Hex("00 84 00 00 02"))
+    if err != nil || !bytes.Equal(rsp, mock.Hex("01 02 90 00")) {
+        t.Errorf("unexpected response %X, %v", rsp, err)
+    }
+    if _, err := c.Transmit(mock.Hex("00 b0 00 00 00")); err == nil {
+        t.Error("unexpected command accepted")
+    }
+    rsp, err = c.Control(0x42000d48, []byte{0xaa})
+    if err != nil || !bytes.Equal(rsp, []byte{0x48, 0xaa}) {
+        t.Errorf("unexpected control response %X, %v", rsp, err)
+    }
+    value, err := c.GetAttrib(0x10100)
+    if err != nil || !bytes.Equal(value, []byte{0x01}) {
+        t.Errorf("unexpected attribute %X, %v", value, err)
+    }
+    status, err := c.Status()
+    if err != nil || status.Reader != reader.Name() ||
+        !bytes.Equal(status.ATR, testATR) {
+        t.Errorf("unexpected status %v, %v", status, err)
+    }
+    // Transactions of another client block transmit
+    ctx2, err := smartcard.EstablishContext()
+    if err != nil { t.Fatal(err) }
+    readers, _ = ctx2.ListReaders()
+    c2, err := readers[0].Connect()
+    if err != nil { t.Fatal(err) }
+    if err := c.BeginTransaction(); err != nil { t.Fatal(err) }
+    done := make(chan error)
+    go func() {
+        _, err := c2.Transmit(mock.Hex("00 84 00 00 02"))
+        done <- err
+    }()
+    select {
+        case <-done:
+            t.Fatal("transmit not blocked by transaction")
+        case <-time.After(20*time.Millisecond):
+    }
+    if err := c.EndTransaction(smartcard.LEAVE_CARD); err != nil {
+        t.Fatal(err)
+    }
+    if err := <-done; err != nil { t.Error(err) }
+    // Client closing its connection releases its handles
+    ctx2.Release()
+    reader.Remove()
+    if r.IsCardPresent() { t.Error("card still present") }
+    if _, err := c.Transmit(mock.Hex("00 84 00 00 02")); err == nil {
+        t.Error("transmit to removed card succeeded")
+    }
+    c.Disconnect()
+    if err := ctx.Release(); err != nil { t.Fatal(err) }
+    waitReleased(t, backend)
+}
+
+func TestWaitReaderStateChange(t *testing.T) {
+    backend := mock.NewBackend()
+    reader := backend.AddReader("Virtual Reader 00")
+    server, stop := start(t, backend)
+    defer stop()
+    client, err := pcsc.PCSCLiteConnect()
+    if err != nil { t.Fatal(err) }
+    defer client.Close()
+    context, err := client.EstablishContext()
+    if err != nil { t.Fatal(err) }
+    readers, err := client.ListReaders()
+    if err != nil || len(readers) != 1 || readers[0].IsCardPresent() {
+        t.Fatalf("unexpected readers %v, %v", readers, err)
+    }
+    // Let the monitor count the new reader
+    waitServer(t, server, func() bool {
+        return server.events[reader.Name()] > 0
+    })
+    counter := server.events[reader.Name()]
+    var wait waitReaderStateChangeStruct
+    msg := raw(unsafe.Pointer(&wait), unsafe.Sizeof(wait))
+    if err := client.SendHeader(CMD_WAIT_READER_STATE_CHANGE,
+        0); err != nil {
+        t.Fatal(err)
+    }
+    waitServer(t, server, func() bool { return len(server.waiting) > 0 })
+    reader.Insert(mock.NewCard(testATR))
+    if _, err := io.ReadFull(client, msg); err != nil { t.Fatal(err) }
+    if wait.rv != pcsc.SCARD_S_SUCCESS {
+        t.Errorf("wait failed: %x", wait.rv)
+    }
+    readers, err = client.ListReaders()
+    if err != nil || !readers[0].IsCardPresent() ||
+        readers[0].EventCounter != counter + 1 ||
+        !bytes.Equal(readers[0].CardAtr[:readers[0].CardAtrLength], testATR) {
+        t.Errorf("unexpected reader state %v, %v", readers[0], err)
+    }
+    _, protocol, err := client.CardConnectMode(context, reader.Name(),
+        pcsc.SCARD_SHARE_EXCLUSIVE, pcsc.SCARD_PROTOCOL_ANY)
+    if err != nil { t.Fatal(err) }
+    readers, _ = client.ListReaders()
+    if readers[0].ReaderSharing != -1 || readers[0].CardProtocol != protocol {
+        t.Errorf("unexpected reader state %v", readers[0])
+    }
+    // Stop waiting without event
+    if err := client.SendHeader(CMD_WAIT_READER_STATE_CHANGE,
+        0); err != nil {
+        t.Fatal(err)
+    }
+    if err := client.SendHeader(CMD_STOP_WAITING_READER_STATE_CHANGE,
+        0); err != nil {
+        t.Fatal(err)
+    }
+    wait.rv = 1
+    if _, err := io.ReadFull(client, msg); err != nil { t.Fatal(err) }
+    if wait.rv != pcsc.SCARD_S_SUCCESS {
+        t.Errorf("stop waiting failed: %x", wait.rv)
+    }
+    // Closing the connection releases context and card
+    client.Close()
+    waitReleased(t, backend)
+}
+
+func TestTransactions(t *testing.T) {
+    backend := mock.NewBackend()
+    reader := backend.AddReader("Virtual Reader 00")
+    reader.Insert(mock.NewCard(testATR).Rule("00 84 00 00 ??", "90 00"))
+    _, stop := start(t, backend)
+    defer stop()
+    ctx, err := smartcard.EstablishContext()
+    if err != nil { t.Fatal(err) }
+    readers, _ := ctx.ListReaders()
+    c1, err := readers[0].Connect()
+    if err != nil { t.Fatal(err) }
+    c2, err := readers[0].Connect()
+    if err != nil { t.Fatal(err) }
+    if err := c1.BeginTransaction(); err != nil { t.Fatal(err) }
+    // Like pcscd, the server doesn't block
+    client, err := pcsc.PCSCLiteConnect()
+    if err != nil { t.Fatal(err) }
+    context, err := client.EstablishContext()
+    if err != nil { t.Fatal(err) }
+    card, _, err := client.CardConnect(context, reader.Name())
+    if err != nil { t.Fatal(err) }
+    if err := client.TryBeginTransaction(card); err != pcsc.Error(
+        pcsc.SCARD_E_SHARING_VIOLATION) {
+        t.Errorf("expected sharing violation, got %v", err)
+    }
+    client.Close()
+    // The backend retries without blocking other card handles
+    done := make(chan error)
+    go func() { done <- c2.BeginTransaction() }()
+    select {
+        case err := <-done:
+            t.Fatalf("begin transaction not blocked: %v", err)
+        case <-time.After(3*pcsc.LOCK_POLL_RATE):
+    }
+    if _, err := c1.Transmit(mock.Hex("00 84 00 00 08")); err != nil {
+        t.Error(err)
+    }
+    if err := c1.EndTransaction(smartcard.LEAVE_CARD); err != nil {
+        t.Fatal(err)
+    }
+    if err := <-done; err != nil { t.Fatal(err) }
+    // Waiting ends when the card is disconnected
+    go func() { done <- c1.BeginTransaction() }()
+    time.Sleep(pcsc.LOCK_POLL_RATE)
+    c1.Disconnect()
+    if err := <-done; err == nil { t.Error("transaction begun") }
+    if err := c2.EndTransaction(smartcard.LEAVE_CARD); err != nil {
+        t.Error(err)
+    }
+    c2.Disconnect()
+    if err := ctx.Release(); err != nil { t.Fatal(err) }
+    waitReleased(t, backend)
+}
@@ -0,0 +1,140 @@
+// +build !windows
+
+package pcscd
+
+// Messages of the pcsc-lite client protocol 4.4 (winscard_msg.h). A
+// request is a header followed by the message struct, the response the
+// same struct with results filled in. Transmit and control data follows
+// the struct.
+
+const (
+    // Protocol version
+    PROTOCOL_VERSION_MAJOR = 4
+    PROTOCOL_VERSION_MINOR = 4
+    // Commands
+    SCARD_ESTABLISH_CONTEXT = 0x01
+    SCARD_RELEASE_CONTEXT = 0x02
+    SCARD_LIST_READERS = 0x03
+    SCARD_CONNECT = 0x04
+    SCARD_RECONNECT = 0x05
+    SCARD_DISCONNECT = 0x06
+    SCARD_BEGIN_TRANSACTION = 0x07
+    SCARD_END_TRANSACTION = 0x08
+    SCARD_TRANSMIT = 0x09
+    SCARD_CONTROL = 0x0a
+    SCARD_STATUS = 0x0b
+    SCARD_GET_STATUS_CHANGE = 0x0c
+    SCARD_CANCEL = 0x0d
+    SCARD_CANCEL_TRANSACTION = 0x0e
+    SCARD_GET_ATTRIB = 0x0f
+    SCARD_SET_ATTRIB = 0x10
+    CMD_VERSION = 0x11
+    CMD_GET_READERS_STATE = 0x12
+    CMD_WAIT_READER_STATE_CHANGE = 0x13
+    CMD_STOP_WAITING_READER_STATE_CHANGE = 0x14
+    // Limits
+    MAX_READERNAME = 128
+    MAX_BUFFER_SIZE = 264
+    MAX_BUFFER_SIZE_EXTENDED = 4 + 3 + (1<<16) + 3 + 2
+)
+
+type header struct {
+    size uint32
+    command uint32
+}
+
+type versionStruct struct {
+    major int32
+    minor int32
+    rv uint32
+}
+
+type establishStruct struct {
+    scope uint32
+    context uint32
+    rv uint32
+}
+
+type releaseStruct struct {
+    context uint32
+    rv uint32
+}
+
+type connectStruct struct {
+    context uint32
+    readerName [MAX_READERNAME]byte
+    shareMode uint32
+    preferredProtocols uint32
+    card int32
+    activeProtocol uint32
+    rv uint32
+}
+
+type reconnectStruct struct {
+    card int32
+    shareMode uint32
+    preferredProtocols uint32
+    initialization uint32
+    activeProtocol uint32
+    rv uint32
+}
+
+type disconnectStruct struct {
+    card int32
+    disposition uint32
+    rv uint32
+}
+
+type beginStruct struct {
+    card int32
+    rv uint32
+}
+
+type endStruct struct {
+    card int32
+    disposition uint32
+    rv uint32
+}
+
+type cancelStruct struct {
+    context int32
+    rv uint32
+}
+
+type statusStruct struct {
+    card int32
+    rv uint32
+}
+
+type transmitStruct struct {
+    card int32
+    sendPciProtocol uint32
+    sendPciLength uint32
+    sendLength uint32
+    recvPciProtocol uint32
+    recvPciLength uint32
+    recvLength uint32
+    rv uint32
+}
+
+type controlStruct struct {
+    card int32
+    controlCode uint32
+    sendLength uint32
+    recvLength uint32
+    bytesReturned uint32
+    rv uint32
+}
+
+type getSetStruct struct {
+    card int32
+    attrID uint32
+    attr [MAX_BUFFER_SIZE]byte
+    attrLen uint32
+    rv uint32
+}
+
+type waitReaderStateChangeStruct struct {
+    timeout uint32
+    rv uint32
+}
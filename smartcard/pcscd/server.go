@@ -0,0 +1,588 @@
+// +build !windows
+
+/*
+Package pcscd implements the daemon side of the pcsc-lite client protocol,
+serving the readers and cards of a smartcard.Backend over a Unix socket.
+Backed by mock readers it lets PCSCLiteClient and the default smartcard
+backend be tested without pcscd, and exposes Go-implemented virtual cards
+to any PC/SC application using libpcsclite (via PCSCLITE_CSOCK_NAME).
+
+Example:
+
+    backend := mock.NewBackend()
+    backend.AddReader("Virtual Reader 00").Insert(card)
+    server := pcscd.NewServer(backend)
+    go server.ListenAndServe("/tmp/pcscd.comm")
+    defer server.Close()
+    os.Setenv("PCSCLITE_CSOCK_NAME", "/tmp/pcscd.comm")
+    ctx, err := smartcard.EstablishContext()
+*/
+package pcscd
+
+import (
+    "bytes"
+    "fmt"
+    "io"
+    "net"
+    "os"
+    "sync"
+    "time"
+    "unsafe"
+    "github.com/sf1/go-card/smartcard"
+    "github.com/sf1/go-card/smartcard/pcsc"
+)
+
+// Return bytes of message struct at p.
+func raw(p unsafe.Pointer, size uintptr) []byte {
+    return (*[1 << 16]byte)(p)[:size:size]
+}
+
+// Return PC/SC return value for err.
+func returnValue(err error, fallback uint32) uint32 {
+    if err == nil { return pcsc.SCARD_S_SUCCESS }
+    if e, ok := err.(pcsc.Error); ok { return uint32(e) }
+    return fallback
+}
+
+// Card connection of a client.
+type card struct {
+    handle uintptr
+    ctx uintptr
+    reader string
+}
+
+// Client connection.
+type client struct {
+    conn net.Conn
+    writeMutex sync.Mutex
+    contexts map[uint32]uintptr
+    cards map[int32]*card
+}
+
+func (c *client) write(data []byte) error {
+    c.writeMutex.Lock()
+    defer c.writeMutex.Unlock()
+    _, err := c.conn.Write(data)
+    return err
+}
+
+// Fake pcscd serving a backend.
+type Server struct {
+    backend smartcard.Backend
+    mutex sync.Mutex
+    ctx uintptr
+    started bool
+    closed bool
+    done chan struct{}
+    listeners []net.Listener
+    clients map[*client]bool
+    waiting map[*client]bool
+    events map[string]uint32
+    protocols map[string]uint32
+    transactions map[string]*card
+    next uint32
+}
+
+// Create server for backend.
+func NewServer(backend smartcard.Backend) *Server {
+    return &Server{
+        backend: backend,
+        done: make(chan struct{}),
+        clients: map[*client]bool{},
+        waiting: map[*client]bool{},
+        events: map[string]uint32{},
+        protocols: map[string]uint32{},
+        transactions: map[string]*card{},
+        next: 0x1000,
+    }
+}
+
+// Listen on Unix socket path, removing a stale socket file, and serve.
+func (s *Server) ListenAndServe(path string) error {
+    os.Remove(path)
+    l, err := net.Listen("unix", path)
+    if err != nil { return err }
+    return s.Serve(l)
+}
+
+// Accept and serve client connections on l until Close is called.
+func (s *Server) Serve(l net.Listener) error {
+    s.mutex.Lock()
+    if s.closed {
+        s.mutex.Unlock()
+        l.Close()
+        return fmt.Errorf("server closed")
+    }
+    s.listeners = append(s.listeners, l)
+    if !s.started {
+        ctx, err := s.backend.EstablishContext(pcsc.CARD_SCOPE_SYSTEM)
+        if err != nil {
+            s.mutex.Unlock()
+            return err
+        }
+        s.ctx, s.started = ctx, true
+        go s.monitor()
+    }
+    s.mutex.Unlock()
+    for {
+        conn, err := l.Accept()
+        if err != nil {
+            select {
+                case <-s.done:
+                    return nil
+                default:
+                    return err
+            }
+        }
+        c := &client{conn: conn, contexts: map[uint32]uintptr{},
+            cards: map[int32]*card{}}
+        s.mutex.Lock()
+        s.clients[c] = true
+        s.mutex.Unlock()
+        go s.serve(c)
+    }
+}
+
+// Stop serving, closing listeners and client connections.
+func (s *Server) Close() error {
+    s.mutex.Lock()
+    if s.closed {
+        s.mutex.Unlock()
+        return nil
+    }
+    s.closed = true
+    close(s.done)
+    listeners := s.listeners
+    var conns []net.Conn
+    for c := range s.clients {
+        conns = append(conns, c.conn)
+    }
+    s.mutex.Unlock()
+    for _, l := range listeners {
+        l.Close()
+    }
+    for _, conn := range conns {
+        conn.Close()
+    }
+    return nil
+}
+
+// Return new handle.
+func (s *Server) handle() uint32 {
+    s.mutex.Lock()
+    defer s.mutex.Unlock()
+    s.next++
+    return s.next
+}
+
+// Watch backend readers, counting events and notifying waiting clients.
+func (s *Server) monitor() {
+    var states []smartcard.ReaderState
+    for {
+        select {
+            case <-s.done:
+                s.backend.ReleaseContext(s.ctx)
+                return
+            default:
+        }
+        names, err := s.backend.ListReaders(s.ctx)
+        if err != nil { names = nil }
+        changed := len(names) != len(states)
+        for i := 0; !changed && i < len(names); i++ {
+            changed = names[i] != states[i].Reader
+        }
+        if changed {
+            old := states
+            states = make([]smartcard.ReaderState, len(names))
+            for i, name := range names {
+                states[i].Reader = name
+                for _, o := range old {
+                    if o.Reader == name { states[i] = o }
+                }
+            }
+        }
+        if len(states) == 0 {
+            if changed { s.signal(nil) }
+            select {
+                case <-s.done:
+                case <-time.After(250*time.Millisecond):
+            }
+            continue
+        }
+        err = s.backend.GetStatusChange(s.ctx, 250, states)
+        var readers []string
+        if err == nil {
+            for i := range states {
+                if states[i].EventState & pcsc.SCARD_STATE_CHANGED != 0 {
+                    readers = append(readers, states[i].Reader)
+                }
+                states[i].CurrentState = states[i].EventState &^
+                    pcsc.SCARD_STATE_CHANGED
+            }
+        } else if err != pcsc.Error(pcsc.SCARD_E_TIMEOUT) {
+            select {
+                case <-s.done:
+                case <-time.After(250*time.Millisecond):
+            }
+        }
+        if changed || len(readers) > 0 { s.signal(readers) }
+    }
+}
+
+// Count events of readers and notify waiting clients.
+func (s *Server) signal(readers []string) {
+    s.mutex.Lock()
+    for _, name := range readers {
+        s.events[name]++
+    }
+    waiting := s.waiting
+    s.waiting = map[*client]bool{}
+    s.mutex.Unlock()
+    msg := waitReaderStateChangeStruct{rv: pcsc.SCARD_S_SUCCESS}
+    for c := range waiting {
+        c.write(raw(unsafe.Pointer(&msg), unsafe.Sizeof(msg)))
+    }
+}
+
+// Return states of all readers (at most 16) in pcscd's shared format.
+func (s *Server) readerStates() pcsc.ReaderArray {
+    var readers pcsc.ReaderArray
+    names, err := s.backend.ListReaders(s.ctx)
+    if err != nil || len(names) == 0 { return readers }
+    if len(names) > len(readers) { names = names[:len(readers)] }
+    states := make([]smartcard.ReaderState, len(names))
+    for i, name := range names {
+        states[i].Reader = name
+    }
+    if err := s.backend.GetStatusChange(s.ctx, 0, states); err != nil {
+        return readers
+    }
+    s.mutex.Lock()
+    defer s.mutex.Unlock()
+    for i, state := range states {
+        r := &readers[i]
+        copy(r.ReaderName[:MAX_READERNAME-1], state.Reader)
+        r.EventCounter = s.events[state.Reader]
+        event := state.EventState
+        switch {
+            case event & pcsc.SCARD_STATE_PRESENT == 0:
+                r.ReaderState = pcsc.SCARD_ABSENT
+            case event & pcsc.SCARD_STATE_MUTE != 0:
+                r.ReaderState = pcsc.SCARD_PRESENT | pcsc.SCARD_SWALLOWED
+            default:
+                r.ReaderState = pcsc.SCARD_PRESENT | pcsc.SCARD_POWERED |
+                    pcsc.SCARD_NEGOTIABLE
+                r.CardAtrLength = uint32(copy(r.CardAtr[:], state.ATR))
+                r.CardProtocol = s.protocols[state.Reader]
+        }
+        switch {
+            case event & pcsc.SCARD_STATE_EXCLUSIVE != 0:
+                r.ReaderSharing = -1
+            case event & pcsc.SCARD_STATE_INUSE != 0:
+                r.ReaderSharing = 1
+        }
+    }
+    return readers
+}
+
+// Serve client until it disconnects, then release its resources.
+func (s *Server) serve(c *client) {
+    defer func() {
+        c.conn.Close()
+        s.mutex.Lock()
+        delete(s.clients, c)
+        delete(s.waiting, c)
+        s.mutex.Unlock()
+        for _, k := range c.cards {
+            s.endTransaction(k)
+            s.backend.Disconnect(k.handle, pcsc.SCARD_RESET_CARD)
+        }
+        for _, ctx := range c.contexts {
+            s.backend.ReleaseContext(ctx)
+        }
+    }()
+    for {
+        var h header
+        _, err := io.ReadFull(c.conn, raw(unsafe.Pointer(&h),
+            unsafe.Sizeof(h)))
+        if err != nil { return }
+        if err := s.dispatch(c, h); err != nil { return }
+    }
+}
+
+// Start transaction on card and return the PC/SC return value. Like pcscd,
+// fails with SCARD_E_SHARING_VIOLATION instead of blocking while another
+// card handle holds a transaction on the reader.
+func (s *Server) beginTransaction(k *card) uint32 {
+    s.mutex.Lock()
+    holder := s.transactions[k.reader]
+    if holder != nil && holder != k {
+        s.mutex.Unlock()
+        return pcsc.SCARD_E_SHARING_VIOLATION
+    }
+    s.transactions[k.reader] = k
+    s.mutex.Unlock()
+    err := s.backend.BeginTransaction(k.handle)
+    if err != nil && holder == nil { s.endTransaction(k) }
+    return returnValue(err, pcsc.SCARD_F_INTERNAL_ERROR)
+}
+
+// Forget transaction of card.
+func (s *Server) endTransaction(k *card) {
+    s.mutex.Lock()
+    defer s.mutex.Unlock()
+    if s.transactions[k.reader] == k { delete(s.transactions, k.reader) }
+}
+
+// Read request struct of the expected size.
+func read(c *client, h header, msg []byte) error {
+    if h.size != uint32(len(msg)) {
+        return fmt.Errorf("invalid message size %d for command %d", h.size,
+            h.command)
+    }
+    _, err := io.ReadFull(c.conn, msg)
+    return err
+}
+
+// Process one request. Returns an error if the connection must be closed.
+func (s *Server) dispatch(c *client, h header) error {
+    switch h.command {
+        case CMD_VERSION:
+            var m versionStruct
+            msg := raw(unsafe.Pointer(&m), unsafe.Sizeof(m))
+            if err := read(c, h, msg); err != nil { return err }
+            m.rv = pcsc.SCARD_S_SUCCESS
+            if m.major != PROTOCOL_VERSION_MAJOR {
+                m.rv = pcsc.SCARD_E_SERVICE_STOPPED
+            }
+            m.major, m.minor = PROTOCOL_VERSION_MAJOR, PROTOCOL_VERSION_MINOR
+            return c.write(msg)
+        case CMD_GET_READERS_STATE:
+            if h.size != 0 { return fmt.Errorf("invalid message size") }
+            readers := s.readerStates()
+            return c.write(raw(unsafe.Pointer(&readers),
+                unsafe.Sizeof(readers)))
+        case CMD_WAIT_READER_STATE_CHANGE, CMD_STOP_WAITING_READER_STATE_CHANGE:
+            // Clients before pcsc-lite 1.8.x send a wait struct
+            var m waitReaderStateChangeStruct
+            if h.size != 0 {
+                err := read(c, h, raw(unsafe.Pointer(&m), unsafe.Sizeof(m)))
+                if err != nil { return err }
+            }
+            s.mutex.Lock()
+            waiting := s.waiting[c]
+            if h.command == CMD_WAIT_READER_STATE_CHANGE {
+                s.waiting[c] = true
+            } else {
+                delete(s.waiting, c)
+            }
+            s.mutex.Unlock()
+            if h.command == CMD_WAIT_READER_STATE_CHANGE || !waiting {
+                // Answered on the next event or already notified
+                return nil
+            }
+            m.rv = pcsc.SCARD_S_SUCCESS
+            return c.write(raw(unsafe.Pointer(&m), unsafe.Sizeof(m)))
+        case SCARD_ESTABLISH_CONTEXT:
+            var m establishStruct
+            msg := raw(unsafe.Pointer(&m), unsafe.Sizeof(m))
+            if err := read(c, h, msg); err != nil { return err }
+            ctx, err := s.backend.EstablishContext(m.scope)
+            m.rv = returnValue(err, pcsc.SCARD_F_INTERNAL_ERROR)
+            if err == nil {
+                m.context = s.handle()
+                c.contexts[m.context] = ctx
+            }
+            return c.write(msg)
+        case SCARD_RELEASE_CONTEXT:
+            var m releaseStruct
+            msg := raw(unsafe.Pointer(&m), unsafe.Sizeof(m))
+            if err := read(c, h, msg); err != nil { return err }
+            m.rv = pcsc.SCARD_E_INVALID_HANDLE
+            if ctx, ok := c.contexts[m.context]; ok {
+                for id, k := range c.cards {
+                    if k.ctx == ctx {
+                        s.backend.Disconnect(k.handle, pcsc.SCARD_RESET_CARD)
+                        delete(c.cards, id)
+                    }
+                }
+                delete(c.contexts, m.context)
+                m.rv = returnValue(s.backend.ReleaseContext(ctx),
+                    pcsc.SCARD_F_INTERNAL_ERROR)
+            }
+            return c.write(msg)
+        case SCARD_CONNECT:
+            var m connectStruct
+            msg := raw(unsafe.Pointer(&m), unsafe.Sizeof(m))
+            if err := read(c, h, msg); err != nil { return err }
+            ctx, ok := c.contexts[m.context]
+            if !ok {
+                m.rv = pcsc.SCARD_E_INVALID_HANDLE
+                return c.write(msg)
+            }
+            n := bytes.IndexByte(m.readerName[:], 0)
+            if n < 0 { n = len(m.readerName) }
+            reader := string(m.readerName[:n])
+            handle, protocol, err := s.backend.Connect(ctx, reader,
+                m.shareMode, m.preferredProtocols)
+            m.rv = returnValue(err, pcsc.SCARD_F_INTERNAL_ERROR)
+            if err == nil {
+                m.card = int32(s.handle())
+                m.activeProtocol = protocol
+                c.cards[m.card] = &card{handle, ctx, reader}
+                s.mutex.Lock()
+                s.protocols[reader] = protocol
+                s.mutex.Unlock()
+            }
+            return c.write(msg)
+        case SCARD_RECONNECT:
+            var m reconnectStruct
+            msg := raw(unsafe.Pointer(&m), unsafe.Sizeof(m))
+            if err := read(c, h, msg); err != nil { return err }
+            k, ok := c.cards[m.card]
+            if !ok {
+                m.rv = pcsc.SCARD_E_INVALID_HANDLE
+                return c.write(msg)
+            }
+            s.endTransaction(k)
+            err := s.backend.Disconnect(k.handle, m.initialization)
+            if err == nil {
+                k.handle, m.activeProtocol, err = s.backend.Connect(k.ctx,
+                    k.reader, m.shareMode, m.preferredProtocols)
+            }
+            if err != nil { delete(c.cards, m.card) }
+            m.rv = returnValue(err, pcsc.SCARD_F_INTERNAL_ERROR)
+            return c.write(msg)
+        case SCARD_DISCONNECT:
+            var m disconnectStruct
+            msg := raw(unsafe.Pointer(&m), unsafe.Sizeof(m))
+            if err := read(c, h, msg); err != nil { return err }
+            m.rv = pcsc.SCARD_E_INVALID_HANDLE
+            if k, ok := c.cards[m.card]; ok {
+                delete(c.cards, m.card)
+                s.endTransaction(k)
+                m.rv = returnValue(s.backend.Disconnect(k.handle,
+                    m.disposition), pcsc.SCARD_F_INTERNAL_ERROR)
+            }
+            return c.write(msg)
+        case SCARD_BEGIN_TRANSACTION:
+            var m beginStruct
+            msg := raw(unsafe.Pointer(&m), unsafe.Sizeof(m))
+            if err := read(c, h, msg); err != nil { return err }
+            m.rv = pcsc.SCARD_E_INVALID_HANDLE
+            if k, ok := c.cards[m.card]; ok {
+                m.rv = s.beginTransaction(k)
+            }
+            return c.write(msg)
+        case SCARD_END_TRANSACTION:
+            var m endStruct
+            msg := raw(unsafe.Pointer(&m), unsafe.Sizeof(m))
+            if err := read(c, h, msg); err != nil { return err }
+            m.rv = pcsc.SCARD_E_INVALID_HANDLE
+            if k, ok := c.cards[m.card]; ok {
+                err := s.backend.EndTransaction(k.handle, m.disposition)
+                if err == nil { s.endTransaction(k) }
+                m.rv = returnValue(err, pcsc.SCARD_F_INTERNAL_ERROR)
+            }
+            return c.write(msg)
+        case SCARD_CANCEL, SCARD_CANCEL_TRANSACTION:
+            var m cancelStruct
+            msg := raw(unsafe.Pointer(&m), unsafe.Sizeof(m))
+            if err := read(c, h, msg); err != nil { return err }
+            m.rv = pcsc.SCARD_S_SUCCESS
+            return c.write(msg)
+        case SCARD_STATUS:
+            var m statusStruct
+            msg := raw(unsafe.Pointer(&m), unsafe.Sizeof(m))
+            if err := read(c, h, msg); err != nil { return err }
+            m.rv = pcsc.SCARD_E_INVALID_HANDLE
+            if k, ok := c.cards[m.card]; ok {
+                _, err := s.backend.Status(k.handle)
+                m.rv = returnValue(err, pcsc.SCARD_F_INTERNAL_ERROR)
+            }
+            return c.write(msg)
+        case SCARD_TRANSMIT:
+            return s.transmit(c, h)
+        case SCARD_CONTROL:
+            return s.control(c, h)
+        case SCARD_GET_ATTRIB, SCARD_SET_ATTRIB:
+            var m getSetStruct
+            msg := raw(unsafe.Pointer(&m), unsafe.Sizeof(m))
+            if err := read(c, h, msg); err != nil { return err }
+            k, ok := c.cards[m.card]
+            switch {
+                case !ok:
+                    m.rv = pcsc.SCARD_E_INVALID_HANDLE
+                case h.command == SCARD_SET_ATTRIB:
+                    m.rv = pcsc.SCARD_E_UNSUPPORTED_FEATURE
+                default:
+                    value, err := s.backend.GetAttrib(k.handle, m.attrID)
+                    m.rv = returnValue(err, pcsc.SCARD_F_INTERNAL_ERROR)
+                    if err == nil && len(value) > int(m.attrLen) {
+                        m.rv = pcsc.SCARD_E_INSUFFICIENT_BUFFER
+                    } else if err == nil {
+                        m.attrLen = uint32(copy(m.attr[:], value))
+                    }
+            }
+            return c.write(msg)
+    }
+    return fmt.Errorf("unsupported command %d", h.command)
+}
+
+// Process SCARD_TRANSMIT: struct and command in, struct and response out.
+func (s *Server) transmit(c *client, h header) error {
+    var m transmitStruct
+    msg := raw(unsafe.Pointer(&m), unsafe.Sizeof(m))
+    if err := read(c, h, msg); err != nil { return err }
+    if m.sendLength > MAX_BUFFER_SIZE_EXTENDED {
+        return fmt.Errorf("command too long")
+    }
+    cmd := make([]byte, m.sendLength)
+    if _, err := io.ReadFull(c.conn, cmd); err != nil { return err }
+    var rsp []byte
+    k, ok := c.cards[m.card]
+    if !ok {
+        m.rv = pcsc.SCARD_E_INVALID_HANDLE
+    } else {
+        var err error
+        rsp, err = s.backend.Transmit(k.handle, m.sendPciProtocol, cmd)
+        m.rv = returnValue(err, pcsc.SCARD_F_COMM_ERROR)
+        if err == nil && len(rsp) > int(m.recvLength) {
+            m.rv = pcsc.SCARD_E_INSUFFICIENT_BUFFER
+        }
+    }
+    if m.rv != pcsc.SCARD_S_SUCCESS {
+        rsp = nil
+    }
+    m.recvLength = uint32(len(rsp))
+    return c.write(append(append([]byte{}, msg...), rsp...))
+}
+
+// Process SCARD_CONTROL: struct and data in, struct and response out.
+func (s *Server) control(c *client, h header) error {
+    var m controlStruct
+    msg := raw(unsafe.Pointer(&m), unsafe.Sizeof(m))
+    if err := read(c, h, msg); err != nil { return err }
+    if m.sendLength > MAX_BUFFER_SIZE_EXTENDED {
+        return fmt.Errorf("control data too long")
+    }
+    data := make([]byte, m.sendLength)
+    if _, err := io.ReadFull(c.conn, data); err != nil { return err }
+    var rsp []byte
+    k, ok := c.cards[m.card]
+    if !ok {
+        m.rv = pcsc.SCARD_E_INVALID_HANDLE
+    } else {
+        var err error
+        rsp, err = s.backend.Control(k.handle, m.controlCode, data)
+        m.rv = returnValue(err, pcsc.SCARD_F_COMM_ERROR)
+        if err == nil && len(rsp) > int(m.recvLength) {
+            m.rv = pcsc.SCARD_E_INSUFFICIENT_BUFFER
+        }
+    }
+    if m.rv != pcsc.SCARD_S_SUCCESS {
+        rsp = nil
+    }
+    m.bytesReturned = uint32(len(rsp))
+    return c.write(append(append([]byte{}, msg...), rsp...))
+}
@@ -0,0 +1,127 @@
+package piv
+
+import (
+    "crypto"
+    "crypto/ecdsa"
+    "crypto/elliptic"
+    "crypto/rsa"
+    "fmt"
+    "github.com/sf1/go-card/smartcard"
+    "github.com/sf1/go-card/smartcard/tlv"
+)
+
+// PIN handling for private key operations.
+type KeyAuth = smartcard.KeyAuth
+
+// Return private key for slot. The key implements crypto.Signer and, for
+// RSA keys, crypto.Decrypter. public must be the public key of the slot,
+// e.g. from the slot certificate.
+func (c *Card) PrivateKey(slot Slot, public crypto.PublicKey,
+    auth KeyAuth) (crypto.PrivateKey, error) {
+    switch pub := public.(type) {
+        case *rsa.PublicKey:
+            alg, err := rsaAlgorithm(pub)
+            if err != nil { return nil, err }
+            key, err := smartcard.NewPrivateKey(&slotKey{c, slot, alg, pub},
+                smartcard.RSA_PADDING_NONE, auth)
+            if err != nil { return nil, err }
+            return &RSAKey{key}, nil
+        case *ecdsa.PublicKey:
+            alg, err := ecAlgorithm(pub.Curve)
+            if err != nil { return nil, err }
+            sk := &slotKey{c, slot, alg, pub}
+            key, err := smartcard.NewPrivateKey(sk, smartcard.RSA_PADDING_NONE,
+                auth)
+            if err != nil { return nil, err }
+            return &ECKey{key, sk, auth}, nil
+    }
+    return nil, fmt.Errorf("unsupported public key type %T", public)
+}
+
+func rsaAlgorithm(pub *rsa.PublicKey) (byte, error) {
+    switch pub.N.BitLen() {
+        case 1024:
+            return ALG_RSA_1024, nil
+        case 2048:
+            return ALG_RSA_2048, nil
+        case 3072:
+            return ALG_RSA_3072, nil
+        case 4096:
+            return ALG_RSA_4096, nil
+    }
+    return 0, fmt.Errorf("unsupported RSA key size: %d", pub.N.BitLen())
+}
+
+func ecAlgorithm(curve elliptic.Curve) (byte, error) {
+    switch curve {
+        case elliptic.P256():
+            return ALG_ECC_P256, nil
+        case elliptic.P384():
+            return ALG_ECC_P384, nil
+    }
+    return 0, fmt.Errorf("unsupported curve: %s", curve.Params().Name)
+}
+
+// Card primitives of a slot key.
+type slotKey struct {
+    card *Card
+    slot Slot
+    alg byte
+    public crypto.PublicKey
+}
+
+// Return public key.
+func (k *slotKey) Public() crypto.PublicKey {
+    return k.public
+}
+
+// Sign encoded message (RSA) or hash (ECDSA).
+func (k *slotKey) SignRaw(input []byte) ([]byte, error) {
+    return k.authenticate(0x81, input)
+}
+
+// Apply the raw RSA private key operation to ciphertext.
+func (k *slotKey) DecryptRaw(ciphertext []byte) ([]byte, error) {
+    return k.authenticate(0x81, ciphertext)
+}
+
+// Verify PIV card PIN.
+func (k *slotKey) VerifyPIN(pin string) error {
+    return k.card.VerifyPIN(pin)
+}
+
+// Run GENERAL AUTHENTICATE with data in tag and return the response (82).
+func (k *slotKey) authenticate(tag tlv.Tag, data []byte) ([]byte, error) {
+    template := []tlv.TLV{tlv.New(0x82, nil), tlv.New(tag, data)}
+    rsp, err := k.card.GeneralAuthenticate(k.alg, k.slot.Key, template...)
+    if err != nil { return nil, err }
+    result, ok := rsp.Find(0x82)
+    if !ok {
+        return nil, fmt.Errorf("missing response in GENERAL AUTHENTICATE")
+    }
+    return result.Value, nil
+}
+
+// RSA private key in a PIV slot. Signs with PKCS#1 v1.5 or PSS and
+// decrypts with PKCS#1 v1.5 or OAEP padding.
+type RSAKey struct {
+    *smartcard.PrivateKey
+}
+
+// EC private key in a PIV slot. Signatures are ASN.1 DER encoded.
+type ECKey struct {
+    *smartcard.PrivateKey
+    slot *slotKey
+    auth KeyAuth
+}
+
+// Compute ECDH shared secret (x coordinate) with peer public key.
+func (k *ECKey) SharedKey(peer *ecdsa.PublicKey) ([]byte, error) {
+    if peer.Curve != k.slot.public.(*ecdsa.PublicKey).Curve {
+        return nil, fmt.Errorf("peer key on different curve")
+    }
+    point := elliptic.Marshal(peer.Curve, peer.X, peer.Y)
+    return k.auth.Run(k.slot.VerifyPIN, func() ([]byte, error) {
+        return k.slot.authenticate(0x85, point)
+    })
+}
@@ -0,0 +1,302 @@
+package piv
+
+import (
+    "bytes"
+    "compress/gzip"
+    "crypto"
+    "crypto/aes"
+    "crypto/cipher"
+    "crypto/des"
+    "crypto/ecdsa"
+    "crypto/elliptic"
+    "crypto/rand"
+    "crypto/rsa"
+    "crypto/subtle"
+    "crypto/x509"
+    "fmt"
+    "math/big"
+    "github.com/sf1/go-card/smartcard"
+    "github.com/sf1/go-card/smartcard/SW"
+    "github.com/sf1/go-card/smartcard/tlv"
+)
+
+const (
+    // Vendor (YubiKey) instructions
+    INS_YK_SET_MANAGEMENT_KEY = 0xff
+    INS_YK_SET_PIN_RETRIES = 0xfa
+    INS_YK_ATTEST = 0xf9
+    INS_YK_GET_SERIAL = 0xf8
+    INS_YK_GET_VERSION = 0xfd
+    // Vendor (YubiKey) PIN and touch policies
+    PIN_POLICY_DEFAULT = 0x00
+    PIN_POLICY_NEVER = 0x01
+    PIN_POLICY_ONCE = 0x02
+    PIN_POLICY_ALWAYS = 0x03
+    TOUCH_POLICY_DEFAULT = 0x00
+    TOUCH_POLICY_NEVER = 0x01
+    TOUCH_POLICY_ALWAYS = 0x02
+    TOUCH_POLICY_CACHED = 0x03
+)
+
+var (
+    // Vendor (YubiKey) attestation key slot
+    SLOT_ATTESTATION = Slot{0xf9, 0x5fff01}
+    // Well-known default management key (3DES)
+    DEFAULT_MANAGEMENT_KEY = []byte{
+        0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08,
+        0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08,
+        0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08,
+    }
+)
+
+// Return retired key management slot n (1 to 20).
+func RetiredSlot(n int) (Slot, error) {
+    if n < 1 || n > 20 {
+        return Slot{}, fmt.Errorf("invalid retired slot number: %d", n)
+    }
+    return Slot{byte(0x81 + n), uint32(0x5fc10c + n)}, nil
+}
+
+func managementCipher(alg byte, key []byte) (cipher.Block, error) {
+    switch alg {
+        case ALG_3DES:
+            if len(key) != 24 {
+                return nil, fmt.Errorf("3DES management key must be 24 bytes")
+            }
+            return des.NewTripleDESCipher(key)
+        case ALG_AES_128, ALG_AES_192, ALG_AES_256:
+            expected := map[byte]int{ALG_AES_128: 16, ALG_AES_192: 24,
+                ALG_AES_256: 32}[alg]
+            if len(key) != expected {
+                return nil, fmt.Errorf("AES management key must be %d bytes",
+                    expected)
+            }
+            return aes.NewCipher(key)
+    }
+    return nil, fmt.Errorf("unsupported management key algorithm: %02x", alg)
+}
+
+// Authenticate with the card management key (9B) using mutual
+// authentication. alg is ALG_3DES or one of the ALG_AES_* identifiers.
+func (c *Card) AuthenticateManagementKey(alg byte, key []byte) error {
+    block, err := managementCipher(alg, key)
+    if err != nil { return err }
+    size := block.BlockSize()
+    // request witness
+    rsp, err := c.GeneralAuthenticate(alg, KEY_MANAGEMENT,
+        tlv.New(0x80, nil))
+    if err != nil { return err }
+    witness := rsp.Value(0x80)
+    if len(witness) != size {
+        return fmt.Errorf("invalid witness length: %d", len(witness))
+    }
+    decrypted := make([]byte, size)
+    block.Decrypt(decrypted, witness)
+    challenge := make([]byte, size)
+    _, err = rand.Read(challenge)
+    if err != nil { return err }
+    rsp, err = c.GeneralAuthenticate(alg, KEY_MANAGEMENT,
+        tlv.New(0x80, decrypted), tlv.New(0x81, challenge))
+    if err != nil { return err }
+    expected := make([]byte, size)
+    block.Encrypt(expected, challenge)
+    if subtle.ConstantTimeCompare(expected, rsp.Value(0x82)) != 1 {
+        return fmt.Errorf("card failed management key authentication")
+    }
+    return nil
+}
+
+// Key generation options. The PIN and touch policies are YubiKey
+// extensions and only sent if not default.
+type KeyOptions struct {
+    Algorithm byte
+    PINPolicy byte
+    TouchPolicy byte
+}
+
+// Generate key pair in slot and return the public key. Requires
+// management key authentication.
+func (c *Card) GenerateKey(slot Slot, opts KeyOptions) (crypto.PublicKey,
+    error) {
+    template := []tlv.TLV{tlv.New(0x80, []byte{opts.Algorithm})}
+    if opts.PINPolicy != PIN_POLICY_DEFAULT {
+        template = append(template, tlv.New(0xaa, []byte{opts.PINPolicy}))
+    }
+    if opts.TouchPolicy != TOUCH_POLICY_DEFAULT {
+        template = append(template, tlv.New(0xab, []byte{opts.TouchPolicy}))
+    }
+    data := tlv.NewConstructed(0xac, template...).Bytes()
+    rsp, err := smartcard.TransmitAndGetResponse(c.card, smartcard.Command4(
+        0x00, INS_GENERATE_ASYMMETRIC_KEY_PAIR, 0x00, slot.Key, data, 0x00))
+    if err != nil { return nil, err }
+    if rsp.SW() != SW.SUCCESS {
+        return nil, fmt.Errorf("key generation failed: %s",
+            smartcard.SWError(rsp.SW()))
+    }
+    obj, _, err := tlv.ParseOne(rsp.Data())
+    if err != nil { return nil, err }
+    if obj.Tag != 0x7f49 {
+        return nil, fmt.Errorf("unexpected public key template %s", obj.Tag)
+    }
+    fields, err := obj.Children()
+    if err != nil { return nil, err }
+    return decodePublicKey(opts.Algorithm, fields)
+}
+
+func decodePublicKey(alg byte, fields tlv.List) (crypto.PublicKey, error) {
+    switch alg {
+        case ALG_RSA_1024, ALG_RSA_2048, ALG_RSA_3072, ALG_RSA_4096:
+            n := new(big.Int).SetBytes(fields.Value(0x81))
+            e := new(big.Int).SetBytes(fields.Value(0x82))
+            if n.Sign() == 0 || !e.IsInt64() || e.Int64() > 1 << 31 {
+                return nil, fmt.Errorf("invalid RSA public key")
+            }
+            return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+        case ALG_ECC_P256, ALG_ECC_P384:
+            curve := elliptic.P256()
+            if alg == ALG_ECC_P384 {
+                curve = elliptic.P384()
+            }
+            x, y := elliptic.Unmarshal(curve, fields.Value(0x86))
+            if x == nil {
+                return nil, fmt.Errorf("invalid EC public key")
+            }
+            return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+    }
+    return nil, fmt.Errorf("unsupported algorithm: %02x", alg)
+}
+
+// Write data object. data is the content of the 53 template.
+// Requires management key authentication.
+func (c *Card) PutData(tag uint32, data []byte) error {
+    var payload []byte
+    if tag == TAG_DISCOVERY {
+        payload = tlv.Encode(0x7e, data)
+    } else {
+        payload = tlv.Encode(0x5c, tlv.Tag(tag).Bytes())
+        payload = append(payload, tlv.Encode(0x53, data)...)
+    }
+    rsp, err := smartcard.TransmitChained(c.card, 0x00, INS_PUT_DATA, 0x3f,
+        0xff, payload, false)
+    if err != nil { return err }
+    if rsp.SW() != SW.SUCCESS {
+        return fmt.Errorf("put data failed: %s", smartcard.SWError(rsp.SW()))
+    }
+    return nil
+}
+
+// Store certificate in slot, optionally gzip compressed.
+// Requires management key authentication.
+func (c *Card) PutCertificate(slot Slot, cert *x509.Certificate,
+    compress bool) error {
+    der := cert.Raw
+    info := byte(0x00)
+    if compress {
+        var buffer bytes.Buffer
+        w := gzip.NewWriter(&buffer)
+        _, err := w.Write(der)
+        if err != nil { return err }
+        err = w.Close()
+        if err != nil { return err }
+        der = buffer.Bytes()
+        info = 0x01
+    }
+    data := tlv.List{
+        tlv.New(0x70, der),
+        tlv.New(0x71, []byte{info}),
+        tlv.New(0xfe, nil),
+    }.Bytes()
+    return c.PutData(slot.Object, data)
+}
+
+// Change PIN.
+func (c *Card) ChangePIN(oldPIN, newPIN string) error {
+    return c.changeReferenceData(KEY_PIN, oldPIN, newPIN)
+}
+
+// Change PUK.
+func (c *Card) ChangePUK(oldPUK, newPUK string) error {
+    return c.changeReferenceData(KEY_PUK, oldPUK, newPUK)
+}
+
+func (c *Card) changeReferenceData(key byte, oldValue,
+    newValue string) error {
+    oldBlock, err := pinBlock(oldValue)
+    if err != nil { return err }
+    newBlock, err := pinBlock(newValue)
+    if err != nil { return err }
+    rsp, err := c.card.TransmitAPDU(smartcard.Command3(0x00,
+        INS_CHANGE_REFERENCE_DATA, 0x00, key, append(oldBlock, newBlock...)))
+    if err != nil { return err }
+    return pinError(rsp.SW())
+}
+
+// Unblock PIN with PUK and set new PIN.
+func (c *Card) UnblockPIN(puk, newPIN string) error {
+    pukBlock, err := pinBlock(puk)
+    if err != nil { return err }
+    pinData, err := pinBlock(newPIN)
+    if err != nil { return err }
+    rsp, err := c.card.TransmitAPDU(smartcard.Command3(0x00,
+        INS_RESET_RETRY_COUNTER, 0x00, KEY_PIN, append(pukBlock, pinData...)))
+    if err != nil { return err }
+    return pinError(rsp.SW())
+}
+
+// Return attestation certificate for key generated in slot (YubiKey
+// extension).
+func (c *Card) Attest(slot Slot) (*x509.Certificate, error) {
+    rsp, err := smartcard.TransmitAndGetResponse(c.card,
+        smartcard.Command2(0x00, INS_YK_ATTEST, slot.Key, 0x00, 0x00))
+    if err != nil { return nil, err }
+    if rsp.SW() != SW.SUCCESS {
+        return nil, fmt.Errorf("attestation failed: %s",
+            smartcard.SWError(rsp.SW()))
+    }
+    return x509.ParseCertificate(rsp.Data())
+}
+
+// Return firmware version (YubiKey extension).
+func (c *Card) Version() (string, error) {
+    rsp, err := c.card.TransmitAPDU(
+        smartcard.Command2(0x00, INS_YK_GET_VERSION, 0x00, 0x00, 0x00))
+    if err != nil { return "", err }
+    if rsp.SW() != SW.SUCCESS || len(rsp.Data()) != 3 {
+        return "", smartcard.SWError(rsp.SW())
+    }
+    v := rsp.Data()
+    return fmt.Sprintf("%d.%d.%d", v[0], v[1], v[2]), nil
+}
+
+// Set management key (YubiKey extension). Requires management key
+// authentication.
+func (c *Card) SetManagementKey(alg byte, key []byte, requireTouch bool) error {
+    _, err := managementCipher(alg, key)
+    if err != nil { return err }
+    p2 := byte(0xff)
+    if requireTouch {
+        p2 = 0xfe
+    }
+    data := append([]byte{alg, KEY_MANAGEMENT, byte(len(key))}, key...)
+    rsp, err := c.card.TransmitAPDU(smartcard.Command3(0x00,
+        INS_YK_SET_MANAGEMENT_KEY, 0xff, p2, data))
+    if err != nil { return err }
+    if rsp.SW() != SW.SUCCESS {
+        return fmt.Errorf("set management key failed: %s",
+            smartcard.SWError(rsp.SW()))
+    }
+    return nil
+}
+
+// Set PIN and PUK retry counters (YubiKey extension). This resets PIN and
+// PUK to their defaults and requires PIN and management key verification.
+func (c *Card) SetPINRetries(pinRetries, pukRetries byte) error {
+    rsp, err := c.card.TransmitAPDU(smartcard.Command1(0x00,
+        INS_YK_SET_PIN_RETRIES, pinRetries, pukRetries))
+    if err != nil { return err }
+    if rsp.SW() != SW.SUCCESS {
+        return fmt.Errorf("set PIN retries failed: %s",
+            smartcard.SWError(rsp.SW()))
+    }
+    return nil
+}
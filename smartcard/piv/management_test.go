@@ -0,0 +1,167 @@
+package piv
+
+import (
+    "crypto"
+    "crypto/aes"
+    "crypto/cipher"
+    "crypto/des"
+    "crypto/ecdsa"
+    "crypto/rsa"
+    "crypto/sha256"
+    "crypto/x509"
+    "fmt"
+    "testing"
+    "github.com/sf1/go-card/smartcard"
+    "github.com/sf1/go-card/smartcard/mock"
+)
+
+func TestManagementKey(t *testing.T) {
+    card, err := Select(newSimCard())
+    if err != nil { t.Fatal(err) }
+    wrong := make([]byte, 24)
+    err = card.AuthenticateManagementKey(ALG_3DES, wrong)
+    if err == nil {
+        t.Errorf("wrong management key accepted")
+    }
+    err = card.AuthenticateManagementKey(ALG_3DES, DEFAULT_MANAGEMENT_KEY)
+    if err != nil { t.Fatal(err) }
+    err = card.AuthenticateManagementKey(ALG_AES_128, DEFAULT_MANAGEMENT_KEY)
+    if err == nil {
+        t.Errorf("invalid AES key length accepted")
+    }
+}
+
+// Card encrypting the published FIPS 197 (appendix C.1) and SP 800-67
+// (TDEA example) plaintexts as witness.
+func TestManagementKeyVectors(t *testing.T) {
+    for _, test := range []struct {
+        alg byte
+        key, plaintext, ciphertext string
+    }{
+        {ALG_AES_128, "000102030405060708090a0b0c0d0e0f",
+            "00112233445566778899aabbccddeeff",
+            "69c4e0d86a7b0430d8cdb78070b4c55a"},
+        {ALG_3DES, "0123456789abcdef23456789abcdef01456789abcdef0123",
+            "5468652071756663", "a826fd8ce53b855f"},
+    } {
+        var block cipher.Block
+        if test.alg == ALG_3DES {
+            block, _ = des.NewTripleDESCipher(mock.Hex(test.key))
+        } else {
+            block, _ = aes.NewCipher(mock.Hex(test.key))
+        }
+        size := block.BlockSize()
+        sim := mock.NewCard(nil).
+            Expect(fmt.Sprintf("00 87 %02x 9b 04 7c 02 80 00 00", test.alg),
+                fmt.Sprintf("7c %02x 80 %02x %s 90 00", size + 2, size,
+                test.ciphertext)).
+            RuleFunc(fmt.Sprintf("00 87 %02x 9b %02x 7c %02x 80 %02x %s " +
+                "81 %02x *", test.alg, 2*size + 6, 2*size + 4, size,
+                test.plaintext, size), func(cmd smartcard.CommandAPDU) (
+                smartcard.ResponseAPDU, error) {
+                rsp := append([]byte{0x7c, byte(size + 2), 0x82,
+                    byte(size)}, make([]byte, size)...)
+                block.Encrypt(rsp[4:], cmd.Data()[size+6:])
+                return append(rsp, 0x90, 0x00), nil
+            })
+        card := &Card{card: sim}
+        err := card.AuthenticateManagementKey(test.alg, mock.Hex(test.key))
+        if err != nil { t.Errorf("%02x: %s", test.alg, err) }
+        sim.AssertExpectations(t)
+        if n := len(sim.Exchanges()); n != 2 {
+            t.Errorf("%02x: unexpected %d exchanges", test.alg, n)
+        }
+    }
+}
+
+func TestGenerateAndImport(t *testing.T) {
+    sim := newSimCard()
+    card, err := Select(sim)
+    if err != nil { t.Fatal(err) }
+    _, err = card.GenerateKey(SLOT_AUTHENTICATION,
+        KeyOptions{Algorithm: ALG_ECC_P256})
+    if err == nil {
+        t.Errorf("key generation without management key succeeded")
+    }
+    err = card.AuthenticateManagementKey(ALG_3DES, DEFAULT_MANAGEMENT_KEY)
+    if err != nil { t.Fatal(err) }
+    slot, err := RetiredSlot(1)
+    if err != nil || slot.Key != 0x82 || slot.Object != 0x5fc10d {
+        t.Fatalf("unexpected retired slot %v, %v", slot, err)
+    }
+    for _, alg := range []byte{ALG_ECC_P256, ALG_RSA_1024} {
+        pub, err := card.GenerateKey(slot, KeyOptions{Algorithm: alg,
+            PINPolicy: PIN_POLICY_ONCE})
+        if err != nil { t.Fatal(err) }
+        key, err := card.PrivateKey(slot, pub, KeyAuth{PIN: "123456"})
+        if err != nil { t.Fatal(err) }
+        der := selfSigned(t, key.(crypto.Signer))
+        cert, err := x509.ParseCertificate(der)
+        if err != nil { t.Fatal(err) }
+        err = card.PutCertificate(slot, cert, alg == ALG_RSA_1024)
+        if err != nil { t.Fatal(err) }
+        stored, err := card.Certificate(slot)
+        if err != nil { t.Fatal(err) }
+        digest := sha256.Sum256(stored.RawTBSCertificate)
+        switch p := stored.PublicKey.(type) {
+            case *ecdsa.PublicKey:
+                if !ecdsa.VerifyASN1(p, digest[:], stored.Signature) {
+                    t.Errorf("EC certificate signature invalid")
+                }
+            case *rsa.PublicKey:
+                err = rsa.VerifyPKCS1v15(p, crypto.SHA256, digest[:],
+                    stored.Signature)
+                if err != nil { t.Errorf("RSA certificate: %s", err) }
+        }
+    }
+}
+
+func TestAttestation(t *testing.T) {
+    sim := newSimCard()
+    card, err := Select(sim)
+    if err != nil { t.Fatal(err) }
+    err = card.AuthenticateManagementKey(ALG_3DES, DEFAULT_MANAGEMENT_KEY)
+    if err != nil { t.Fatal(err) }
+    _, err = card.Attest(SLOT_AUTHENTICATION)
+    if err == nil {
+        t.Errorf("attestation of empty slot succeeded")
+    }
+    pub, err := card.GenerateKey(SLOT_AUTHENTICATION,
+        KeyOptions{Algorithm: ALG_ECC_P256})
+    if err != nil { t.Fatal(err) }
+    key, _ := card.PrivateKey(SLOT_AUTHENTICATION, pub,
+        KeyAuth{PIN: "123456"})
+    sim.attestation = selfSigned(t, key.(crypto.Signer))
+    cert, err := card.Attest(SLOT_AUTHENTICATION)
+    if err != nil { t.Fatal(err) }
+    if cert.Subject.CommonName != "PIV Test" {
+        t.Errorf("unexpected attestation certificate %s", cert.Subject)
+    }
+}
+
+func TestPINAdministration(t *testing.T) {
+    card, err := Select(newSimCard())
+    if err != nil { t.Fatal(err) }
+    err = card.ChangePIN("123456", "654321")
+    if err != nil { t.Fatal(err) }
+    for i := 2; i >= 0; i-- {
+        err = card.VerifyPIN("123456")
+        if pe, ok := err.(*PINError); !ok || pe.Retries != i {
+            t.Fatalf("expected %d retries, got %v", i, err)
+        }
+    }
+    err = card.VerifyPIN("654321")
+    if pe, ok := err.(*PINError); !ok || pe.Retries != 0 {
+        t.Errorf("expected blocked PIN, got %v", err)
+    }
+    err = card.UnblockPIN("00000000", "111111")
+    if pe, ok := err.(*PINError); !ok || pe.Retries != 2 {
+        t.Errorf("expected PUK error, got %v", err)
+    }
+    err = card.UnblockPIN("12345678", "111111")
+    if err != nil { t.Fatal(err) }
+    err = card.VerifyPIN("111111")
+    if err != nil { t.Fatal(err) }
+    err = card.ChangePUK("12345678", "87654321")
+    if err != nil { t.Fatal(err) }
+}
@@ -0,0 +1,137 @@
+package piv
+
+import (
+    "bytes"
+    "compress/gzip"
+    "crypto/x509"
+    "fmt"
+    "io/ioutil"
+    "github.com/sf1/go-card/smartcard/tlv"
+)
+
+// Card Holder Unique Identifier (SP 800-73-4 Part 1, 3.1.2).
+type CHUID struct {
+    FASCN []byte
+    OrganizationID []byte
+    DUNS []byte
+    GUID []byte
+    // Expiration date (YYYYMMDD)
+    Expiration string
+    CardholderUUID []byte
+    // Issuer asymmetric signature (CMS SignedData)
+    Signature []byte
+}
+
+// Card Capability Container (SP 800-73-4 Part 1, 3.1.1).
+type CCC struct {
+    CardIdentifier []byte
+    ContainerVersion byte
+    GrammarVersion byte
+    ApplicationsURL []byte
+    PKCS15 byte
+    DataModel byte
+    // All data elements
+    Elements tlv.List
+}
+
+// PIN usage policy flags (first byte of tag 5F2F).
+const (
+    PIN_USAGE_APPLICATION_PIN = 0x40
+    PIN_USAGE_GLOBAL_PIN = 0x20
+    PIN_USAGE_OCC = 0x10
+    PIN_USAGE_VCI = 0x08
+)
+
+// Discovery object (SP 800-73-4 Part 1, 3.3.2).
+type Discovery struct {
+    AID []byte
+    // PIN usage policy, flags and preferred PIN
+    PINPolicy [2]byte
+}
+
+// Check if the global PIN is the primary PIN.
+func (d *Discovery) GlobalPINPreferred() bool {
+    return d.PINPolicy[0] & PIN_USAGE_GLOBAL_PIN != 0 &&
+        d.PINPolicy[1] == 0x20
+}
+
+// Read Card Holder Unique Identifier.
+func (c *Card) CHUID() (*CHUID, error) {
+    data, err := c.GetData(TAG_CHUID)
+    if err != nil { return nil, err }
+    list, err := tlv.Parse(data)
+    if err != nil { return nil, err }
+    return &CHUID{
+        FASCN: list.Value(0x30),
+        OrganizationID: list.Value(0x32),
+        DUNS: list.Value(0x33),
+        GUID: list.Value(0x34),
+        Expiration: string(list.Value(0x35)),
+        CardholderUUID: list.Value(0x36),
+        Signature: list.Value(0x3e),
+    }, nil
+}
+
+// Read Card Capability Container.
+func (c *Card) CCC() (*CCC, error) {
+    data, err := c.GetData(TAG_CCC)
+    if err != nil { return nil, err }
+    list, err := tlv.Parse(data)
+    if err != nil { return nil, err }
+    ccc := &CCC{
+        CardIdentifier: list.Value(0xf0),
+        ApplicationsURL: list.Value(0xf3),
+        Elements: list,
+    }
+    if v := list.Value(0xf1); len(v) > 0 {
+        ccc.ContainerVersion = v[0]
+    }
+    if v := list.Value(0xf2); len(v) > 0 {
+        ccc.GrammarVersion = v[0]
+    }
+    if v := list.Value(0xf4); len(v) > 0 {
+        ccc.PKCS15 = v[0]
+    }
+    if v := list.Value(0xf5); len(v) > 0 {
+        ccc.DataModel = v[0]
+    }
+    return ccc, nil
+}
+
+// Read discovery object.
+func (c *Card) Discovery() (*Discovery, error) {
+    data, err := c.GetData(TAG_DISCOVERY)
+    if err != nil { return nil, err }
+    list, err := tlv.Parse(data)
+    if err != nil { return nil, err }
+    d := &Discovery{AID: list.Value(0x4f)}
+    copy(d.PINPolicy[:], list.Value(0x5f2f))
+    return d, nil
+}
+
+// Read certificate stored in key slot.
+func (c *Card) Certificate(slot Slot) (*x509.Certificate, error) {
+    data, err := c.GetData(slot.Object)
+    if err != nil { return nil, err }
+    der, err := decodeCertificateObject(data)
+    if err != nil { return nil, err }
+    return x509.ParseCertificate(der)
+}
+
+// Extract (and decompress) DER certificate from certificate object.
+func decodeCertificateObject(data []byte) ([]byte, error) {
+    list, err := tlv.Parse(data)
+    if err != nil { return nil, err }
+    cert, ok := list.Find(0x70)
+    if !ok {
+        return nil, fmt.Errorf("certificate object without certificate")
+    }
+    info := list.Value(0x71)
+    if len(info) > 0 && info[0] & 0x01 != 0 {
+        r, err := gzip.NewReader(bytes.NewReader(cert.Value))
+        if err != nil { return nil, err }
+        defer r.Close()
+        return ioutil.ReadAll(r)
+    }
+    return cert.Value, nil
+}
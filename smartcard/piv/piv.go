@@ -0,0 +1,242 @@
+/*
+Package piv implements a client for the Personal Identity Verification (PIV)
+card application specified in NIST SP 800-73-4.
+
+Example:
+
+    p, err := piv.Select(card)
+    // handle error, if any
+    cert, err := p.Certificate(piv.SLOT_AUTHENTICATION)
+    // handle error, if any
+    key, err := p.PrivateKey(piv.SLOT_AUTHENTICATION, cert.PublicKey,
+        piv.KeyAuth{PIN: "123456"})
+    // handle error, if any
+    signer := key.(crypto.Signer)
+*/
+package piv
+
+import (
+    "fmt"
+    "github.com/sf1/go-card/smartcard"
+    "github.com/sf1/go-card/smartcard/SW"
+    "github.com/sf1/go-card/smartcard/tlv"
+)
+
+// PIV application identifier (without version).
+var AID = []byte{0xa0, 0x00, 0x00, 0x03, 0x08, 0x00, 0x00, 0x10, 0x00}
+
+const (
+    // Instructions
+    INS_VERIFY = 0x20
+    INS_CHANGE_REFERENCE_DATA = 0x24
+    INS_RESET_RETRY_COUNTER = 0x2c
+    INS_GENERAL_AUTHENTICATE = 0x87
+    INS_GENERATE_ASYMMETRIC_KEY_PAIR = 0x47
+    INS_GET_DATA = 0xcb
+    INS_PUT_DATA = 0xdb
+    // Key references
+    KEY_GLOBAL_PIN = 0x00
+    KEY_PIN = 0x80
+    KEY_PUK = 0x81
+    KEY_MANAGEMENT = 0x9b
+    // Algorithm identifiers (SP 800-78-4)
+    ALG_3DES = 0x03
+    ALG_RSA_3072 = 0x05
+    ALG_RSA_1024 = 0x06
+    ALG_RSA_2048 = 0x07
+    ALG_AES_128 = 0x08
+    ALG_AES_192 = 0x0a
+    ALG_AES_256 = 0x0c
+    ALG_ECC_P256 = 0x11
+    ALG_ECC_P384 = 0x14
+    ALG_RSA_4096 = 0x16
+    // Data object tags
+    TAG_CCC = 0x5fc107
+    TAG_CHUID = 0x5fc102
+    TAG_DISCOVERY = 0x7e
+    TAG_PRINTED_INFORMATION = 0x5fc109
+    TAG_SECURITY_OBJECT = 0x5fc106
+    TAG_KEY_HISTORY = 0x5fc10c
+    TAG_FINGERPRINTS = 0x5fc103
+    TAG_FACIAL_IMAGE = 0x5fc108
+)
+
+// Key slot, i.e. key reference and associated certificate data object.
+type Slot struct {
+    Key byte
+    Object uint32
+}
+
+var (
+    SLOT_AUTHENTICATION = Slot{0x9a, 0x5fc105}
+    SLOT_SIGNATURE = Slot{0x9c, 0x5fc10a}
+    SLOT_KEY_MANAGEMENT = Slot{0x9d, 0x5fc10b}
+    SLOT_CARD_AUTHENTICATION = Slot{0x9e, 0x5fc101}
+)
+
+// Return string form of slot.
+func (s Slot) String() string {
+    return fmt.Sprintf("%02X", s.Key)
+}
+
+// Error returned if PIN or PUK verification failed.
+type PINError struct {
+    // Remaining attempts, 0 if blocked
+    Retries int
+}
+
+func (e *PINError) Error() string {
+    if e.Retries == 0 {
+        return "PIN blocked"
+    }
+    return fmt.Sprintf("wrong PIN, %d tries left", e.Retries)
+}
+
+// Convert status word of PIN related commands into error.
+func pinError(sw uint16) error {
+    switch {
+        case sw == SW.SUCCESS:
+            return nil
+        case sw & 0xfff0 == SW.AUTH_FAILED:
+            return &PINError{Retries: int(sw & 0x000f)}
+        case sw == SW.AUTH_METHOD_BLOCKED:
+            return &PINError{Retries: 0}
+    }
+    return smartcard.SWError(sw)
+}
+
+// Application property template returned on selection.
+type ApplicationProperties struct {
+    AID []byte
+    Label string
+    URL string
+    Algorithms []byte
+}
+
+// PIV card application.
+type Card struct {
+    card smartcard.Transmitter
+    properties ApplicationProperties
+}
+
+// Select PIV application.
+func Select(card smartcard.Transmitter) (*Card, error) {
+    rsp, err := smartcard.TransmitAndGetResponse(card,
+        smartcard.Command4(0x00, 0xa4, 0x04, 0x00, AID, 0x00))
+    if err != nil { return nil, err }
+    if rsp.SW() != SW.SUCCESS {
+        return nil, fmt.Errorf("can't select PIV application: %s",
+            smartcard.SWError(rsp.SW()))
+    }
+    c := &Card{card: card}
+    list, err := tlv.Parse(rsp.Data())
+    if err != nil { return nil, err }
+    if apt, ok := list.Find(0x61); ok {
+        fields, err := apt.Children()
+        if err != nil { return nil, err }
+        c.properties.AID = fields.Value(0x4f)
+        c.properties.Label = string(fields.Value(0x50))
+        if ref, ok := fields.Find(0x5f50); ok {
+            c.properties.URL = string(ref.Value)
+        }
+        if algs, ok := fields.Find(0xac); ok {
+            children, err := algs.Children()
+            if err != nil { return nil, err }
+            for _, a := range children.FindAll(0x80) {
+                c.properties.Algorithms = append(c.properties.Algorithms,
+                    a.Value...)
+            }
+        }
+    }
+    return c, nil
+}
+
+// Return application properties reported on selection.
+func (c *Card) Properties() ApplicationProperties {
+    return c.properties
+}
+
+// Return the underlying transmitter.
+func (c *Card) Transmitter() smartcard.Transmitter {
+    return c.card
+}
+
+// Read data object and return the contents of its 53 template.
+func (c *Card) GetData(tag uint32) ([]byte, error) {
+    data := tlv.Encode(0x5c, tlv.Tag(tag).Bytes())
+    rsp, err := smartcard.TransmitAndGetResponse(c.card,
+        smartcard.Command4(0x00, INS_GET_DATA, 0x3f, 0xff, data, 0x00))
+    if err != nil { return nil, err }
+    if rsp.SW() != SW.SUCCESS {
+        return nil, smartcard.SWError(rsp.SW())
+    }
+    obj, _, err := tlv.ParseOne(rsp.Data())
+    if err != nil { return nil, err }
+    if obj.Tag != 0x53 && obj.Tag != tlv.Tag(tag) {
+        return nil, fmt.Errorf("unexpected data object %s", obj.Tag)
+    }
+    return obj.Value, nil
+}
+
+// Verify PIN. Returns *PINError if the PIN is wrong or blocked.
+func (c *Card) VerifyPIN(pin string) error {
+    return c.verify(KEY_PIN, pin)
+}
+
+// Verify global PIN.
+func (c *Card) VerifyGlobalPIN(pin string) error {
+    return c.verify(KEY_GLOBAL_PIN, pin)
+}
+
+func (c *Card) verify(key byte, pin string) error {
+    data, err := pinBlock(pin)
+    if err != nil { return err }
+    rsp, err := c.card.TransmitAPDU(
+        smartcard.Command3(0x00, INS_VERIFY, 0x00, key, data))
+    if err != nil { return err }
+    return pinError(rsp.SW())
+}
+
+// Return whether the PIN is verified and, if not, the remaining tries.
+func (c *Card) PINStatus() (bool, int, error) {
+    rsp, err := c.card.TransmitAPDU(
+        smartcard.Command1(0x00, INS_VERIFY, 0x00, KEY_PIN))
+    if err != nil { return false, 0, err }
+    err = pinError(rsp.SW())
+    if err == nil {
+        return true, 0, nil
+    }
+    if pe, ok := err.(*PINError); ok {
+        return false, pe.Retries, nil
+    }
+    return false, 0, err
+}
+
+// Encode PIN padded to 8 bytes with FF.
+func pinBlock(pin string) ([]byte, error) {
+    if len(pin) < 6 || len(pin) > 8 {
+        return nil, fmt.Errorf("PIN must be 6 to 8 characters")
+    }
+    data := []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}
+    copy(data, pin)
+    return data, nil
+}
+
+// Perform GENERAL AUTHENTICATE with dynamic authentication template
+// (7C) and return the parsed response template.
+func (c *Card) GeneralAuthenticate(alg, key byte, template ...tlv.TLV) (
+    tlv.List, error) {
+    data := tlv.NewConstructed(0x7c, template...).Bytes()
+    rsp, err := smartcard.TransmitChained(c.card, 0x00,
+        INS_GENERAL_AUTHENTICATE, alg, key, data, true)
+    if err != nil { return nil, err }
+    if rsp.SW() != SW.SUCCESS {
+        return nil, smartcard.SWError(rsp.SW())
+    }
+    obj, _, err := tlv.ParseOne(rsp.Data())
+    if err != nil { return nil, err }
+    if obj.Tag != 0x7c {
+        return nil, fmt.Errorf("unexpected response template %s", obj.Tag)
+    }
+    return obj.Children()
+}
@@ -0,0 +1,208 @@
+package piv
+
+import (
+    "bytes"
+    "compress/gzip"
+    "crypto"
+    "crypto/ecdsa"
+    "crypto/elliptic"
+    "crypto/rand"
+    "crypto/rsa"
+    "crypto/sha256"
+    "crypto/x509"
+    "crypto/x509/pkix"
+    "math/big"
+    "testing"
+    "time"
+    "github.com/sf1/go-card/smartcard/tlv"
+)
+
+var testRSAKey *rsa.PrivateKey
+
+func rsaTestKey(t *testing.T) *rsa.PrivateKey {
+    if testRSAKey == nil {
+        var err error
+        testRSAKey, err = rsa.GenerateKey(rand.Reader, 2048)
+        if err != nil { t.Fatal(err) }
+    }
+    return testRSAKey
+}
+
+func selfSigned(t *testing.T, signer crypto.Signer) []byte {
+    template := &x509.Certificate{
+        SerialNumber: big.NewInt(1),
+        Subject: pkix.Name{CommonName: "PIV Test"},
+        NotBefore: time.Now().Add(-time.Hour),
+        NotAfter: time.Now().Add(time.Hour),
+    }
+    der, err := x509.CreateCertificate(rand.Reader, template, template,
+        signer.Public(), signer)
+    if err != nil { t.Fatal(err) }
+    return der
+}
+
+func TestSelectAndObjects(t *testing.T) {
+    sim := newSimCard()
+    sim.objects[TAG_CHUID] = tlv.List{
+        tlv.New(0x30, bytes.Repeat([]byte{0xd4}, 25)),
+        tlv.New(0x34, bytes.Repeat([]byte{0x01}, 16)),
+        tlv.New(0x35, []byte("20301231")),
+        tlv.New(0x3e, nil),
+        tlv.New(0xfe, nil),
+    }.Bytes()
+    sim.objects[TAG_DISCOVERY] = tlv.NewConstructed(0x7e,
+        tlv.New(0x4f, append(AID, 0x01, 0x00)),
+        tlv.New(0x5f2f, []byte{0x60, 0x20})).Value
+    sim.objects[TAG_CCC] = tlv.List{
+        tlv.New(0xf0, bytes.Repeat([]byte{0xa0}, 21)),
+        tlv.New(0xf1, []byte{0x21}),
+        tlv.New(0xf2, []byte{0x21}),
+    }.Bytes()
+    card, err := Select(sim)
+    if err != nil { t.Fatal(err) }
+    if card.Properties().Label != "Simulated PIV" ||
+        !bytes.Equal(card.Properties().Algorithms,
+            []byte{ALG_RSA_2048, ALG_ECC_P256}) {
+        t.Errorf("unexpected properties %+v", card.Properties())
+    }
+    chuid, err := card.CHUID()
+    if err != nil { t.Fatal(err) }
+    if chuid.Expiration != "20301231" || len(chuid.FASCN) != 25 {
+        t.Errorf("unexpected CHUID %+v", chuid)
+    }
+    discovery, err := card.Discovery()
+    if err != nil { t.Fatal(err) }
+    if !discovery.GlobalPINPreferred() {
+        t.Errorf("unexpected PIN policy %X", discovery.PINPolicy)
+    }
+    ccc, err := card.CCC()
+    if err != nil { t.Fatal(err) }
+    if ccc.ContainerVersion != 0x21 || len(ccc.CardIdentifier) != 21 {
+        t.Errorf("unexpected CCC %+v", ccc)
+    }
+    _, err = card.Certificate(SLOT_SIGNATURE)
+    if err == nil {
+        t.Errorf("missing certificate not reported")
+    }
+}
+
+func TestPIN(t *testing.T) {
+    card, err := Select(newSimCard())
+    if err != nil { t.Fatal(err) }
+    verified, retries, err := card.PINStatus()
+    if err != nil || verified || retries != 3 {
+        t.Errorf("unexpected PIN status %t %d %v", verified, retries, err)
+    }
+    err = card.VerifyPIN("654321")
+    if pe, ok := err.(*PINError); !ok || pe.Retries != 2 {
+        t.Errorf("expected PINError with 2 retries, got %v", err)
+    }
+    err = card.VerifyPIN("12345")
+    if err == nil {
+        t.Errorf("short PIN accepted")
+    }
+    err = card.VerifyPIN("123456")
+    if err != nil { t.Fatal(err) }
+    verified, _, err = card.PINStatus()
+    if err != nil || !verified {
+        t.Errorf("PIN not verified")
+    }
+}
+
+func TestRSAKey(t *testing.T) {
+    priv := rsaTestKey(t)
+    sim := newSimCard()
+    sim.keys[SLOT_AUTHENTICATION.Key] = priv
+    card, err := Select(sim)
+    if err != nil { t.Fatal(err) }
+    key, err := card.PrivateKey(SLOT_AUTHENTICATION, &priv.PublicKey,
+        KeyAuth{PIN: "123456"})
+    if err != nil { t.Fatal(err) }
+    signer := key.(crypto.Signer)
+    digest := sha256.Sum256([]byte("hello"))
+    sig, err := signer.Sign(rand.Reader, digest[:], crypto.SHA256)
+    if err != nil { t.Fatal(err) }
+    err = rsa.VerifyPKCS1v15(&priv.PublicKey, crypto.SHA256, digest[:], sig)
+    if err != nil { t.Errorf("PKCS#1 v1.5: %s", err) }
+    for _, saltLen := range []int{rsa.PSSSaltLengthEqualsHash,
+        rsa.PSSSaltLengthAuto} {
+        opts := &rsa.PSSOptions{Hash: crypto.SHA256, SaltLength: saltLen}
+        sig, err = signer.Sign(rand.Reader, digest[:], opts)
+        if err != nil { t.Fatal(err) }
+        err = rsa.VerifyPSS(&priv.PublicKey, crypto.SHA256, digest[:], sig,
+            &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthAuto})
+        if err != nil { t.Errorf("PSS: %s", err) }
+    }
+    decrypter := key.(crypto.Decrypter)
+    ciphertext, _ := rsa.EncryptPKCS1v15(rand.Reader, &priv.PublicKey,
+        []byte("secret"))
+    plain, err := decrypter.Decrypt(rand.Reader, ciphertext, nil)
+    if err != nil || string(plain) != "secret" {
+        t.Errorf("PKCS#1 v1.5 decryption: %q, %v", plain, err)
+    }
+    ciphertext, _ = rsa.EncryptOAEP(sha256.New(), rand.Reader,
+        &priv.PublicKey, []byte("secret"), []byte("label"))
+    plain, err = decrypter.Decrypt(rand.Reader, ciphertext,
+        &rsa.OAEPOptions{Hash: crypto.SHA256, Label: []byte("label")})
+    if err != nil || string(plain) != "secret" {
+        t.Errorf("OAEP decryption: %q, %v", plain, err)
+    }
+}
+
+func TestECKeyWithCertificate(t *testing.T) {
+    priv, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+    sim := newSimCard()
+    sim.keys[SLOT_SIGNATURE.Key] = priv
+    card, err := Select(sim)
+    if err != nil { t.Fatal(err) }
+    prompted := 0
+    key, err := card.PrivateKey(SLOT_SIGNATURE, &priv.PublicKey,
+        KeyAuth{PINPrompt: func() (string, error) {
+            prompted++
+            return "123456", nil
+        }})
+    if err != nil { t.Fatal(err) }
+    der := selfSigned(t, key.(crypto.Signer))
+    if prompted != 1 {
+        t.Errorf("expected one PIN prompt, got %d", prompted)
+    }
+    // store certificate compressed and read it back
+    var buffer bytes.Buffer
+    w := gzip.NewWriter(&buffer)
+    w.Write(der)
+    w.Close()
+    sim.objects[SLOT_SIGNATURE.Object] = tlv.List{
+        tlv.New(0x70, buffer.Bytes()),
+        tlv.New(0x71, []byte{0x01}),
+        tlv.New(0xfe, nil),
+    }.Bytes()
+    cert, err := card.Certificate(SLOT_SIGNATURE)
+    if err != nil { t.Fatal(err) }
+    err = cert.CheckSignature(cert.SignatureAlgorithm,
+        cert.RawTBSCertificate, cert.Signature)
+    if err != nil { t.Errorf("certificate signature: %s", err) }
+
+    peer, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+    secret, err := key.(*ECKey).SharedKey(&peer.PublicKey)
+    if err != nil { t.Fatal(err) }
+    x, _ := elliptic.P256().ScalarMult(priv.X, priv.Y, peer.D.Bytes())
+    if new(big.Int).SetBytes(secret).Cmp(x) != 0 {
+        t.Errorf("shared secret mismatch")
+    }
+}
+
+func TestLongCertificate(t *testing.T) {
+    priv := rsaTestKey(t)
+    sim := newSimCard()
+    der := selfSigned(t, priv)
+    sim.objects[SLOT_AUTHENTICATION.Object] = tlv.List{
+        tlv.New(0x70, der), tlv.New(0x71, []byte{0x00}),
+    }.Bytes()
+    card, err := Select(sim)
+    if err != nil { t.Fatal(err) }
+    cert, err := card.Certificate(SLOT_AUTHENTICATION)
+    if err != nil { t.Fatal(err) }
+    if !bytes.Equal(cert.Raw, der) {
+        t.Errorf("certificate mismatch")
+    }
+}
@@ -0,0 +1,328 @@
+package piv
+
+import (
+    "bytes"
+    "crypto/des"
+    "crypto/ecdsa"
+    "crypto/elliptic"
+    "crypto/rand"
+    "crypto/rsa"
+    "fmt"
+    "math/big"
+    "github.com/sf1/go-card/smartcard"
+    "github.com/sf1/go-card/smartcard/mock"
+    "github.com/sf1/go-card/smartcard/tlv"
+)
+
+// Simulated PIV card application for tests: a mock card with a rule per
+// instruction working on the card state.
+type simCard struct {
+    *mock.Card
+    pin string
+    pinRetries int
+    pinVerified bool
+    puk string
+    pukRetries int
+    managementKey []byte
+    managementAuthenticated bool
+    witness []byte
+    attestation []byte
+    objects map[uint32][]byte
+    keys map[byte]interface{}
+    chained []byte
+    pending []byte
+}
+
+func newSimCard() *simCard {
+    s := &simCard{
+        pin: "123456",
+        pinRetries: 3,
+        puk: "12345678",
+        pukRetries: 3,
+        managementKey: DEFAULT_MANAGEMENT_KEY,
+        objects: make(map[uint32][]byte),
+        keys: make(map[byte]interface{}),
+    }
+    s.Card = mock.NewCard(mock.Hex("3b 80 80 01 01")).
+        RuleFunc("10 *", s.chain).
+        RuleFunc("00 a4 04 00 *", s.rule(s.selectApplication)).
+        RuleFunc("00 c0 00 00 *", s.rule(s.getResponse)).
+        RuleFunc("00 cb 3f ff *", s.rule(s.getData)).
+        RuleFunc("00 20 00 80 *", s.rule(s.verify)).
+        RuleFunc("00 87 ?? 9b *", s.rule(s.authenticateManagementKey)).
+        RuleFunc("00 87 *", s.rule(s.generalAuthenticate)).
+        RuleFunc("00 47 00 *", s.rule(s.generate)).
+        RuleFunc("00 db 3f ff *", s.rule(s.putData)).
+        RuleFunc("00 24 00 *", s.rule(s.changeReferenceData)).
+        RuleFunc("00 2c 00 80 *", s.rule(s.changeReferenceData)).
+        RuleFunc("00 f9 ?? 00 *", s.rule(s.attest))
+    return s
+}
+
+func sw(code uint16) smartcard.ResponseAPDU {
+    return smartcard.ResponseAPDU{byte(code >> 8), byte(code)}
+}
+
+// Return response data, at most 256 bytes at a time (T=0 style).
+func (s *simCard) respond(data []byte) smartcard.ResponseAPDU {
+    if len(data) <= 256 {
+        s.pending = nil
+        return append(append([]byte{}, data...), 0x90, 0x00)
+    }
+    s.pending = data[256:]
+    n := len(s.pending)
+    if n > 255 {
+        n = 0
+    }
+    return append(append([]byte{}, data[:256]...), 0x61, byte(n))
+}
+
+// Collect data of chained command.
+func (s *simCard) chain(cmd smartcard.CommandAPDU) (smartcard.ResponseAPDU,
+    error) {
+    if !cmd.IsValid() {
+        return nil, fmt.Errorf("invalid APDU %X", []byte(cmd))
+    }
+    s.chained = append(s.chained, cmd.Data()...)
+    return sw(0x9000), nil
+}
+
+// Return rule calling fn with the data of the command and the preceding
+// chained commands.
+func (s *simCard) rule(fn func(cmd smartcard.CommandAPDU,
+    data []byte) smartcard.ResponseAPDU) mock.HandlerFunc {
+    return func(cmd smartcard.CommandAPDU) (smartcard.ResponseAPDU, error) {
+        if !cmd.IsValid() {
+            return nil, fmt.Errorf("invalid APDU %X", []byte(cmd))
+        }
+        data := append(s.chained, cmd.Data()...)
+        s.chained = nil
+        return fn(cmd, data), nil
+    }
+}
+
+func (s *simCard) selectApplication(cmd smartcard.CommandAPDU,
+    data []byte) smartcard.ResponseAPDU {
+    if !bytes.HasPrefix(data, AID) {
+        return sw(0x6a82)
+    }
+    apt := tlv.NewConstructed(0x61,
+        tlv.New(0x4f, []byte{0x00, 0x00, 0x10, 0x00, 0x01, 0x00}),
+        tlv.NewConstructed(0x79, tlv.New(0x4f, AID)),
+        tlv.New(0x50, []byte("Simulated PIV")),
+        tlv.NewConstructed(0xac, tlv.New(0x80, []byte{ALG_RSA_2048}),
+            tlv.New(0x80, []byte{ALG_ECC_P256}),
+            tlv.New(0x06, []byte{0x00})))
+    return s.respond(apt.Bytes())
+}
+
+func (s *simCard) getResponse(cmd smartcard.CommandAPDU,
+    data []byte) smartcard.ResponseAPDU {
+    return s.respond(s.pending)
+}
+
+func (s *simCard) getData(cmd smartcard.CommandAPDU,
+    data []byte) smartcard.ResponseAPDU {
+    list, err := tlv.Parse(data)
+    if err != nil { return sw(0x6a80) }
+    tag, _, err := tlv.ParseTag(list.Value(0x5c))
+    if err != nil { return sw(0x6a80) }
+    obj, ok := s.objects[uint32(tag)]
+    if !ok {
+        return sw(0x6a82)
+    }
+    return s.respond(tlv.Encode(0x53, obj))
+}
+
+func (s *simCard) putData(cmd smartcard.CommandAPDU,
+    data []byte) smartcard.ResponseAPDU {
+    if !s.managementAuthenticated {
+        return sw(0x6982)
+    }
+    list, err := tlv.Parse(data)
+    if err != nil { return sw(0x6a80) }
+    tag, _, err := tlv.ParseTag(list.Value(0x5c))
+    if err != nil { return sw(0x6a80) }
+    s.objects[uint32(tag)] = list.Value(0x53)
+    return sw(0x9000)
+}
+
+func (s *simCard) attest(cmd smartcard.CommandAPDU,
+    data []byte) smartcard.ResponseAPDU {
+    if _, ok := s.keys[cmd[2]]; !ok || s.attestation == nil {
+        return sw(0x6a88)
+    }
+    return s.respond(s.attestation)
+}
+
+func (s *simCard) verify(cmd smartcard.CommandAPDU,
+    data []byte) smartcard.ResponseAPDU {
+    if len(data) == 0 {
+        if s.pinVerified {
+            return sw(0x9000)
+        }
+        return sw(0x63c0 | uint16(s.pinRetries))
+    }
+    if s.pinRetries == 0 {
+        return sw(0x6983)
+    }
+    if !bytes.Equal(bytes.TrimRight(data, "\xff"), []byte(s.pin)) {
+        s.pinRetries--
+        s.pinVerified = false
+        return sw(0x63c0 | uint16(s.pinRetries))
+    }
+    s.pinRetries = 3
+    s.pinVerified = true
+    return sw(0x9000)
+}
+
+func (s *simCard) generalAuthenticate(cmd smartcard.CommandAPDU,
+    data []byte) smartcard.ResponseAPDU {
+    slot := cmd[3]
+    if !s.pinVerified && slot != 0x9e {
+        return sw(0x6982)
+    }
+    if slot == 0x9c {
+        // PIN always
+        s.pinVerified = false
+    }
+    obj, _, err := tlv.ParseOne(data)
+    if err != nil || obj.Tag != 0x7c {
+        return sw(0x6a80)
+    }
+    template, err := obj.Children()
+    if err != nil { return sw(0x6a80) }
+    var result []byte
+    switch key := s.keys[slot].(type) {
+        case *rsa.PrivateKey:
+            c := new(big.Int).SetBytes(template.Value(0x81))
+            m := new(big.Int).Exp(c, key.D, key.N).Bytes()
+            result = make([]byte, key.Size())
+            copy(result[len(result)-len(m):], m)
+        case *ecdsa.PrivateKey:
+            if challenge, ok := template.Find(0x81); ok {
+                result, err = ecdsa.SignASN1(rand.Reader, key,
+                    challenge.Value)
+                if err != nil { return sw(0x6f00) }
+            } else if point, ok := template.Find(0x85); ok {
+                x, y := unmarshalPoint(key, point.Value)
+                if x == nil {
+                    return sw(0x6a80)
+                }
+                sx, _ := key.Curve.ScalarMult(x, y, key.D.Bytes())
+                result = make([]byte, (key.Curve.Params().BitSize + 7) / 8)
+                b := sx.Bytes()
+                copy(result[len(result)-len(b):], b)
+            }
+        default:
+            return sw(0x6a88)
+    }
+    rsp := tlv.NewConstructed(0x7c, tlv.New(0x82, result))
+    return s.respond(rsp.Bytes())
+}
+
+func (s *simCard) authenticateManagementKey(cmd smartcard.CommandAPDU,
+    data []byte) smartcard.ResponseAPDU {
+    obj, _, err := tlv.ParseOne(data)
+    if err != nil { return sw(0x6a80) }
+    template, err := obj.Children()
+    if err != nil { return sw(0x6a80) }
+    block, _ := des.NewTripleDESCipher(s.managementKey)
+    witness, ok := template.Find(0x80)
+    if !ok { return sw(0x6a80) }
+    if len(witness.Value) == 0 {
+        s.witness = make([]byte, 8)
+        rand.Read(s.witness)
+        encrypted := make([]byte, 8)
+        block.Encrypt(encrypted, s.witness)
+        return s.respond(tlv.NewConstructed(0x7c,
+            tlv.New(0x80, encrypted)).Bytes())
+    }
+    if s.witness == nil || !bytes.Equal(witness.Value, s.witness) {
+        s.witness = nil
+        return sw(0x6982)
+    }
+    s.witness = nil
+    challenge := template.Value(0x81)
+    if len(challenge) != 8 { return sw(0x6a80) }
+    response := make([]byte, 8)
+    block.Encrypt(response, challenge)
+    s.managementAuthenticated = true
+    return s.respond(tlv.NewConstructed(0x7c,
+        tlv.New(0x82, response)).Bytes())
+}
+
+func (s *simCard) generate(cmd smartcard.CommandAPDU,
+    data []byte) smartcard.ResponseAPDU {
+    slot := cmd[3]
+    if !s.managementAuthenticated {
+        return sw(0x6982)
+    }
+    obj, _, err := tlv.ParseOne(data)
+    if err != nil { return sw(0x6a80) }
+    template, err := obj.Children()
+    if err != nil { return sw(0x6a80) }
+    var rsp tlv.TLV
+    switch template.Value(0x80)[0] {
+        case ALG_ECC_P256:
+            key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+            s.keys[slot] = key
+            rsp = tlv.NewConstructed(0x7f49, tlv.New(0x86,
+                elliptic.Marshal(key.Curve, key.X, key.Y)))
+        case ALG_RSA_1024:
+            key, _ := rsa.GenerateKey(rand.Reader, 1024)
+            s.keys[slot] = key
+            rsp = tlv.NewConstructed(0x7f49, tlv.New(0x81, key.N.Bytes()),
+                tlv.New(0x82, big.NewInt(int64(key.E)).Bytes()))
+        default:
+            return sw(0x6a80)
+    }
+    return s.respond(rsp.Bytes())
+}
+
+func (s *simCard) changeReferenceData(cmd smartcard.CommandAPDU,
+    data []byte) smartcard.ResponseAPDU {
+    ins, key := cmd[1], cmd[3]
+    if len(data) != 16 {
+        return sw(0x6a80)
+    }
+    old := string(bytes.TrimRight(data[:8], "\xff"))
+    value := string(bytes.TrimRight(data[8:], "\xff"))
+    if ins == INS_RESET_RETRY_COUNTER || key == KEY_PUK {
+        if s.pukRetries == 0 {
+            return sw(0x6983)
+        }
+        if old != s.puk {
+            s.pukRetries--
+            return sw(0x63c0 | uint16(s.pukRetries))
+        }
+        s.pukRetries = 3
+        if ins == INS_RESET_RETRY_COUNTER {
+            s.pin = value
+            s.pinRetries = 3
+        } else {
+            s.puk = value
+        }
+        return sw(0x9000)
+    }
+    if s.pinRetries == 0 {
+        return sw(0x6983)
+    }
+    if old != s.pin {
+        s.pinRetries--
+        return sw(0x63c0 | uint16(s.pinRetries))
+    }
+    s.pin = value
+    s.pinRetries = 3
+    return sw(0x9000)
+}
+
+func unmarshalPoint(key *ecdsa.PrivateKey, data []byte) (*big.Int,
+    *big.Int) {
+    size := (key.Curve.Params().BitSize + 7) / 8
+    if len(data) != 2*size + 1 || data[0] != 0x04 {
+        return nil, nil
+    }
+    return new(big.Int).SetBytes(data[1:1+size]),
+        new(big.Int).SetBytes(data[1+size:])
+}
@@ -0,0 +1,199 @@
+package remote
+
+import (
+    "crypto/tls"
+    "encoding/gob"
+    "fmt"
+    "net"
+    "sync"
+    "github.com/sf1/go-card/smartcard"
+)
+
+// Backend talking to a card server over one connection. Calls may be made
+// concurrently; blocking calls such as GetStatusChange do not hold up
+// others. The connection is closed when the last context is released.
+type Client struct {
+    conn net.Conn
+    encMutex sync.Mutex
+    enc *gob.Encoder
+    mutex sync.Mutex
+    next uint64
+    pending map[uint64]chan *response
+    contexts int
+    err error
+}
+
+// Connect to server at address with TLS, or without if config is nil
+// (e.g. behind an SSH tunnel).
+func Dial(network, address string, config *tls.Config) (*Client, error) {
+    var conn net.Conn
+    var err error
+    if config != nil {
+        conn, err = tls.Dial(network, address, config)
+    } else {
+        conn, err = net.Dial(network, address)
+    }
+    if err != nil { return nil, err }
+    return NewClient(conn), nil
+}
+
+// Create client on established connection.
+func NewClient(conn net.Conn) *Client {
+    c := &Client{
+        conn: conn,
+        enc: gob.NewEncoder(conn),
+        pending: map[uint64]chan *response{},
+    }
+    go c.receive()
+    return c
+}
+
+// Close connection. Pending and later calls fail.
+func (c *Client) Close() error {
+    return c.conn.Close()
+}
+
+// Dispatch responses to waiting calls until the connection fails.
+func (c *Client) receive() {
+    dec := gob.NewDecoder(c.conn)
+    var err error
+    for {
+        rsp := &response{}
+        if err = dec.Decode(rsp); err != nil { break }
+        c.mutex.Lock()
+        ch, ok := c.pending[rsp.ID]
+        delete(c.pending, rsp.ID)
+        c.mutex.Unlock()
+        if ok { ch <- rsp }
+    }
+    c.conn.Close()
+    c.mutex.Lock()
+    defer c.mutex.Unlock()
+    c.err = fmt.Errorf("remote: connection closed: %s", err)
+    for id, ch := range c.pending {
+        delete(c.pending, id)
+        close(ch)
+    }
+}
+
+// Send request and wait for response.
+func (c *Client) call(req *request) (*response, error) {
+    ch := make(chan *response, 1)
+    c.mutex.Lock()
+    if c.err != nil {
+        c.mutex.Unlock()
+        return nil, c.err
+    }
+    c.next++
+    req.ID = c.next
+    c.pending[req.ID] = ch
+    c.mutex.Unlock()
+    c.encMutex.Lock()
+    err := c.enc.Encode(req)
+    c.encMutex.Unlock()
+    if err != nil {
+        c.conn.Close()
+        return nil, err
+    }
+    rsp, ok := <-ch
+    if !ok {
+        c.mutex.Lock()
+        defer c.mutex.Unlock()
+        return nil, c.err
+    }
+    return rsp, rsp.error()
+}
+
+func (c *Client) EstablishContext(scope uint32) (uintptr, error) {
+    rsp, err := c.call(&request{Op: OP_ESTABLISH_CONTEXT, Arg1: scope})
+    if err != nil { return 0, err }
+    c.mutex.Lock()
+    c.contexts++
+    c.mutex.Unlock()
+    return uintptr(rsp.Handle), nil
+}
+
+func (c *Client) ReleaseContext(ctx uintptr) error {
+    _, err := c.call(&request{Op: OP_RELEASE_CONTEXT, Context: uint64(ctx)})
+    if err != nil { return err }
+    c.mutex.Lock()
+    c.contexts--
+    last := c.contexts == 0
+    c.mutex.Unlock()
+    if last { c.Close() }
+    return nil
+}
+
+func (c *Client) ListReaders(ctx uintptr) ([]string, error) {
+    rsp, err := c.call(&request{Op: OP_LIST_READERS, Context: uint64(ctx)})
+    if err != nil { return nil, err }
+    return rsp.Readers, nil
+}
+
+func (c *Client) GetStatusChange(ctx uintptr, timeout uint32,
+    states []smartcard.ReaderState) error {
+    rsp, err := c.call(&request{Op: OP_GET_STATUS_CHANGE,
+        Context: uint64(ctx), Arg1: timeout, States: states})
+    if rsp == nil { return err }
+    for i := range states {
+        if i < len(rsp.States) {
+            states[i].EventState = rsp.States[i].EventState
+            states[i].ATR = rsp.States[i].ATR
+        }
+    }
+    return err
+}
+
+func (c *Client) Connect(ctx uintptr, reader string, shareMode,
+    protocols uint32) (uintptr, uint32, error) {
+    rsp, err := c.call(&request{Op: OP_CONNECT, Context: uint64(ctx),
+        Reader: reader, Arg1: shareMode, Arg2: protocols})
+    if err != nil { return 0, 0, err }
+    return uintptr(rsp.Handle), rsp.Protocol, nil
+}
+
+func (c *Client) Disconnect(card uintptr, disposition uint32) error {
+    _, err := c.call(&request{Op: OP_DISCONNECT, Card: uint64(card),
+        Arg1: disposition})
+    return err
+}
+
+func (c *Client) Status(card uintptr) (smartcard.CardStatus, error) {
+    rsp, err := c.call(&request{Op: OP_STATUS, Card: uint64(card)})
+    if err != nil { return smartcard.CardStatus{}, err }
+    return rsp.Status, nil
+}
+
+func (c *Client) Transmit(card uintptr, protocol uint32,
+    command []byte) ([]byte, error) {
+    rsp, err := c.call(&request{Op: OP_TRANSMIT, Card: uint64(card),
+        Arg1: protocol, Data: command})
+    if err != nil { return nil, err }
+    return rsp.Data, nil
+}
+
+func (c *Client) Control(card uintptr, code uint32,
+    data []byte) ([]byte, error) {
+    rsp, err := c.call(&request{Op: OP_CONTROL, Card: uint64(card),
+        Arg1: code, Data: data})
+    if err != nil { return nil, err }
+    return rsp.Data, nil
+}
+
+func (c *Client) GetAttrib(card uintptr, attr uint32) ([]byte, error) {
+    rsp, err := c.call(&request{Op: OP_GET_ATTRIB, Card: uint64(card),
+        Arg1: attr})
+    if err != nil { return nil, err }
+    return rsp.Data, nil
+}
+
+func (c *Client) BeginTransaction(card uintptr) error {
+    _, err := c.call(&request{Op: OP_BEGIN_TRANSACTION, Card: uint64(card)})
+    return err
+}
+
+func (c *Client) EndTransaction(card uintptr, disposition uint32) error {
+    _, err := c.call(&request{Op: OP_END_TRANSACTION, Card: uint64(card),
+        Arg1: disposition})
+    return err
+}
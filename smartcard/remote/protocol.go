@@ -0,0 +1,117 @@
+/*
+Package remote gives access to smart cards attached to another machine. A
+Server exports the readers of a smartcard.Backend over TCP, normally TLS
+with client certificates, and a Client is a smartcard.Backend talking to a
+server, so Context, Reader and Card work unchanged on the remote readers,
+including reader events and transactions.
+
+Server:
+
+    backend, err := smartcard.DefaultBackend()
+    // handle error, if any
+    config := remote.ServerTLSConfig(serverCert, clientCAs)
+    err = remote.NewServer(backend).ListenAndServeTLS(":7470", config)
+
+Client:
+
+    config := remote.ClientTLSConfig(clientCert, serverCAs)
+    smartcard.SetDefaultBackend(func() (smartcard.Backend, error) {
+        return remote.Dial("tcp", "cardhost:7470", config)
+    })
+    ctx, err := smartcard.EstablishContext()
+*/
+package remote
+
+import (
+    "crypto/tls"
+    "crypto/x509"
+    "errors"
+    "github.com/sf1/go-card/smartcard"
+    "github.com/sf1/go-card/smartcard/pcsc"
+)
+
+// Operations
+const (
+    OP_ESTABLISH_CONTEXT = iota + 1
+    OP_RELEASE_CONTEXT
+    OP_LIST_READERS
+    OP_GET_STATUS_CHANGE
+    OP_CONNECT
+    OP_DISCONNECT
+    OP_STATUS
+    OP_TRANSMIT
+    OP_CONTROL
+    OP_GET_ATTRIB
+    OP_BEGIN_TRANSACTION
+    OP_END_TRANSACTION
+)
+
+// Request of a client, gob encoded. Requests are answered in any order;
+// the response carries the request ID.
+type request struct {
+    ID uint64
+    Op int
+    Context uint64
+    Card uint64
+    // Scope, timeout, share mode, protocol, disposition, control code or
+    // attribute, depending on Op
+    Arg1 uint32
+    Arg2 uint32
+    Reader string
+    Data []byte
+    States []smartcard.ReaderState
+}
+
+// Response of the server.
+type response struct {
+    ID uint64
+    Handle uint64
+    Protocol uint32
+    Data []byte
+    Readers []string
+    States []smartcard.ReaderState
+    Status smartcard.CardStatus
+    // PC/SC error code, or message of other errors
+    Code uint32
+    Err string
+}
+
+// Set error of response.
+func (rsp *response) setError(err error) {
+    if err == nil { return }
+    if e, ok := err.(pcsc.Error); ok {
+        rsp.Code = uint32(e)
+    } else {
+        rsp.Err = err.Error()
+    }
+}
+
+// Return error of response.
+func (rsp *response) error() error {
+    if rsp.Code != 0 { return pcsc.Error(rsp.Code) }
+    if rsp.Err != "" { return errors.New(rsp.Err) }
+    return nil
+}
+
+// Return server TLS configuration requiring client certificates issued by
+// clientCAs.
+func ServerTLSConfig(cert tls.Certificate,
+    clientCAs *x509.CertPool) *tls.Config {
+    return &tls.Config{
+        Certificates: []tls.Certificate{cert},
+        ClientAuth: tls.RequireAndVerifyClientCert,
+        ClientCAs: clientCAs,
+        MinVersion: tls.VersionTLS12,
+    }
+}
+
+// Return client TLS configuration authenticating with cert and accepting
+// server certificates issued by rootCAs.
+func ClientTLSConfig(cert tls.Certificate,
+    rootCAs *x509.CertPool) *tls.Config {
+    return &tls.Config{
+        Certificates: []tls.Certificate{cert},
+        RootCAs: rootCAs,
+        MinVersion: tls.VersionTLS12,
+    }
+}
@@ -0,0 +1,261 @@
+package remote
+
+import (
+    "bytes"
+    "crypto/ecdsa"
+    "crypto/elliptic"
+    "crypto/rand"
+    "crypto/tls"
+    "crypto/x509"
+    "crypto/x509/pkix"
+    "math/big"
+    "net"
+    "sync"
+    "testing"
+    "time"
+    "github.com/sf1/go-card/smartcard"
+    "github.com/sf1/go-card/smartcard/mock"
+    "github.com/sf1/go-card/smartcard/pcsc"
+)
+
+var testATR = mock.Hex("3b 80 80 01 01")
+
+// Create certificate for name signed by parent (self-signed if nil).
+func certificate(t *testing.T, name string, parent *tls.Certificate,
+    ca bool) tls.Certificate {
+    t.Helper()
+    key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+    if err != nil { t.Fatal(err) }
+    template := &x509.Certificate{
+        SerialNumber: big.NewInt(time.Now().UnixNano()),
+        Subject: pkix.Name{CommonName: name},
+        NotBefore: time.Now().Add(-time.Hour),
+        NotAfter: time.Now().Add(time.Hour),
+        KeyUsage: x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+        ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth,
+            x509.ExtKeyUsageClientAuth},
+        IPAddresses: []net.IP{net.IPv4(127, 0, 0, 1)},
+        BasicConstraintsValid: true,
+        IsCA: ca,
+    }
+    issuer, signer := template, interface{}(key)
+    if parent != nil {
+        issuer, signer = parent.Leaf, parent.PrivateKey
+    }
+    der, err := x509.CreateCertificate(rand.Reader, template, issuer,
+        &key.PublicKey, signer)
+    if err != nil { t.Fatal(err) }
+    leaf, err := x509.ParseCertificate(der)
+    if err != nil { t.Fatal(err) }
+    return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key,
+        Leaf: leaf}
+}
+
+// Start TLS server and return its address and client TLS configuration.
+func start(t *testing.T, server *Server) (string, *tls.Config, func()) {
+    t.Helper()
+    ca := certificate(t, "Test CA", nil, true)
+    pool := x509.NewCertPool()
+    pool.AddCert(ca.Leaf)
+    serverCert := certificate(t, "server", &ca, false)
+    clientCert := certificate(t, "client", &ca, false)
+    // Client certificates are required anyway
+    config := ServerTLSConfig(serverCert, pool)
+    config.ClientAuth = tls.NoClientCert
+    l, err := listenTLS("127.0.0.1:0", config)
+    if err != nil { t.Fatal(err) }
+    go server.Serve(l)
+    return l.Addr().String(), ClientTLSConfig(clientCert, pool),
+        func() { server.Close() }
+}
+
+// Wait until all contexts and cards of the backend are released.
+func waitReleased(t *testing.T, backend *mock.Backend) {
+    t.Helper()
+    for i := 0; i < 100; i++ {
+        if contexts, cards := backend.Open(); contexts == 0 && cards == 0 {
+            return
+        }
+        time.Sleep(10*time.Millisecond)
+    }
+    contexts, cards := backend.Open()
+    t.Errorf("%d contexts, %d cards open", contexts, cards)
+}
+
+func TestRemote(t *testing.T) {
+    backend := mock.NewBackend()
+    reader := backend.AddReader("Virtual Reader 00")
+    backend.AddReader("Virtual Reader 01")
+    reader.HandleControl(func(code uint32, data []byte) ([]byte, error) {
+        return []byte{byte(code)}, nil
+    })
+    addr, config, stop := start(t, NewServer(backend))
+    defer stop()
+    smartcard.SetDefaultBackend(func() (smartcard.Backend, error) {
+        return Dial("tcp", addr, config)
+    })
+    defer smartcard.SetDefaultBackend(nil)
+    ctx, err := smartcard.EstablishContext()
+    if err != nil { t.Fatal(err) }
+    readers, err := ctx.ListReaders()
+    if err != nil || len(readers) != 2 {
+        t.Fatalf("unexpected readers %v, %v", readers, err)
+    }
+    // Events
+    states := []smartcard.ReaderState{{Reader: reader.Name()}}
+    b := ctx.Backend()
+    if err := b.GetStatusChange(0, 0, states); err != pcsc.Error(
+        pcsc.SCARD_E_INVALID_HANDLE) {
+        t.Errorf("expected invalid handle, got %v", err)
+    }
+    card := mock.NewCard(testATR).Rule("00 84 00 00 ??", "01 02 90 00")
+    go func() {
+        time.Sleep(50*time.Millisecond)
+        reader.Insert(card)
+    }()
+    r, err := ctx.WaitForCardPresent()
+    if err != nil || r.Name() != reader.Name() {
+        t.Fatalf("unexpected reader %v, %v", r, err)
+    }
+    c, err := r.Connect()
+    if err != nil { t.Fatal(err) }
+    if !bytes.Equal(c.ATR(), testATR) { t.Errorf("unexpected ATR %s", c.ATR()) }
+    rsp, err := c.Transmit(mock.Hex("00 84 00 00 02"))
+    if err != nil || !bytes.Equal(rsp, mock.Hex("01 02 90 00")) {
+        t.Errorf("unexpected response %X, %v", rsp, err)
+    }
+    if rsp, err := c.Control(0x42000d48, nil); err != nil ||
+        !bytes.Equal(rsp, []byte{0x48}) {
+        t.Errorf("unexpected control response %X, %v", rsp, err)
+    }
+    if _, err := c.GetAttrib(0x10100); err != pcsc.Error(
+        pcsc.SCARD_E_UNSUPPORTED_FEATURE) {
+        t.Errorf("expected unsupported feature, got %v", err)
+    }
+    if _, err := r.ConnectMode(smartcard.SHARE_EXCLUSIVE,
+        smartcard.PROTOCOL_ANY); err != pcsc.Error(
+        pcsc.SCARD_E_SHARING_VIOLATION) {
+        t.Errorf("expected sharing violation, got %v", err)
+    }
+    // Transactions of another client block transmit
+    ctx2, err := smartcard.EstablishContext()
+    if err != nil { t.Fatal(err) }
+    readers, _ = ctx2.ListReaders()
+    c2, err := readers[0].Connect()
+    if err != nil { t.Fatal(err) }
+    if err := c.BeginTransaction(); err != nil { t.Fatal(err) }
+    done := make(chan error)
+    go func() {
+        _, err := c2.Transmit(mock.Hex("00 84 00 00 02"))
+        done <- err
+    }()
+    select {
+        case <-done:
+            t.Fatal("transmit not blocked by transaction")
+        case <-time.After(50*time.Millisecond):
+    }
+    // Calls on the same connection go on
+    if !r.IsCardPresent() { t.Error("card not present") }
+    if err := c.EndTransaction(smartcard.LEAVE_CARD); err != nil {
+        t.Fatal(err)
+    }
+    if err := <-done; err != nil { t.Error(err) }
+    // Closing the connection releases context and card of the client
+    ctx2.Backend().(*Client).Close()
+    reader.Remove()
+    if _, err := c.Transmit(mock.Hex("00 84 00 00 02")); err != pcsc.Error(
+        pcsc.SCARD_W_REMOVED_CARD) {
+        t.Errorf("expected removed card, got %v", err)
+    }
+    c.Disconnect()
+    if err := ctx.Release(); err != nil { t.Fatal(err) }
+    if _, err := ctx.ListReaders(); err == nil {
+        t.Error("connection not closed after release")
+    }
+    waitReleased(t, backend)
+}
+
+func TestRemoteAuthentication(t *testing.T) {
+    backend := mock.NewBackend()
+    addr, config, stop := start(t, NewServer(backend))
+    defer stop()
+    // Client without certificate
+    noCert := config.Clone()
+    noCert.Certificates = nil
+    client, err := Dial("tcp", addr, noCert)
+    if err == nil {
+        _, err = client.EstablishContext(smartcard.SCOPE_SYSTEM)
+        client.Close()
+    }
+    if err == nil { t.Error("client without certificate accepted") }
+    // Client with certificate of another CA
+    other := certificate(t, "Other CA", nil, true)
+    foreign := config.Clone()
+    foreign.Certificates = []tls.Certificate{certificate(t, "client",
+        &other, false)}
+    client, err = Dial("tcp", addr, foreign)
+    if err == nil {
+        _, err = client.EstablishContext(smartcard.SCOPE_SYSTEM)
+        client.Close()
+    }
+    if err == nil { t.Error("client with foreign certificate accepted") }
+    if contexts, _ := backend.Open(); contexts != 0 {
+        t.Errorf("%d contexts open", contexts)
+    }
+}
+
+func TestClientCAsRequired(t *testing.T) {
+    ca := certificate(t, "Test CA", nil, true)
+    config := ServerTLSConfig(certificate(t, "server", &ca, false), nil)
+    err := NewServer(mock.NewBackend()).ListenAndServeTLS("127.0.0.1:0",
+        config)
+    if err == nil { t.Error("server without client CAs started") }
+}
+
+func TestTooBusy(t *testing.T) {
+    backend := mock.NewBackend()
+    release := make(chan struct{})
+    var mutex sync.Mutex
+    active, max := 0, 0
+    card := mock.NewCard(testATR).HandleFunc(func(
+        cmd smartcard.CommandAPDU) (smartcard.ResponseAPDU, error) {
+        mutex.Lock()
+        active++
+        if active > max { max = active }
+        mutex.Unlock()
+        <-release
+        mutex.Lock()
+        active--
+        mutex.Unlock()
+        return smartcard.ResponseAPDU{0x90, 0x00}, nil
+    })
+    backend.AddReader("Virtual Reader 00").Insert(card)
+    server := NewServer(backend)
+    server.maxRequests = 2
+    addr, config, stop := start(t, server)
+    defer stop()
+    client, err := Dial("tcp", addr, config)
+    if err != nil { t.Fatal(err) }
+    defer client.Close()
+    ctx, err := client.EstablishContext(smartcard.SCOPE_SYSTEM)
+    if err != nil { t.Fatal(err) }
+    h, protocol, err := client.Connect(ctx, "Virtual Reader 00",
+        smartcard.SHARE_SHARED, smartcard.PROTOCOL_ANY)
+    if err != nil { t.Fatal(err) }
+    errs := make(chan error, 3)
+    for i := 0; i < 3; i++ {
+        go func() {
+            _, err := client.Transmit(h, protocol, mock.Hex("00 84 00 00 08"))
+            errs <- err
+        }()
+    }
+    // Two requests are processed, the third is rejected
+    if err := <-errs; err != pcsc.Error(pcsc.SCARD_E_SERVER_TOO_BUSY) {
+        t.Errorf("expected server too busy, got %v", err)
+    }
+    close(release)
+    for i := 0; i < 2; i++ {
+        if err := <-errs; err != nil { t.Error(err) }
+    }
+    if max != 2 { t.Errorf("%d requests processed concurrently", max) }
+}
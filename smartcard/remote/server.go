@@ -0,0 +1,290 @@
+package remote
+
+import (
+    "crypto/tls"
+    "encoding/gob"
+    "fmt"
+    "net"
+    "sync"
+    "github.com/sf1/go-card/smartcard"
+    "github.com/sf1/go-card/smartcard/pcsc"
+)
+
+// Maximum number of requests of a connection processed concurrently.
+// Further requests fail with SCARD_E_SERVER_TOO_BUSY.
+const MAX_REQUESTS = 32
+
+// Card server exporting the readers of a backend.
+type Server struct {
+    backend smartcard.Backend
+    maxRequests int
+    mutex sync.Mutex
+    listeners []net.Listener
+    conns map[net.Conn]bool
+    closed bool
+}
+
+// Create server for backend.
+func NewServer(backend smartcard.Backend) *Server {
+    return &Server{backend: backend, maxRequests: MAX_REQUESTS,
+        conns: map[net.Conn]bool{}}
+}
+
+// Listen on TCP address with TLS and serve. Client certificates issued by
+// config.ClientCAs are required even if config does not say so; without
+// ClientCAs an error is returned rather than accepting certificates of
+// the system roots.
+func (s *Server) ListenAndServeTLS(addr string, config *tls.Config) error {
+    l, err := listenTLS(addr, config)
+    if err != nil { return err }
+    return s.Serve(l)
+}
+
+// Listen on TCP address with TLS requiring client certificates.
+func listenTLS(addr string, config *tls.Config) (net.Listener, error) {
+    if config.ClientCAs == nil {
+        return nil, fmt.Errorf("remote: client CAs missing in TLS config")
+    }
+    config = config.Clone()
+    config.ClientAuth = tls.RequireAndVerifyClientCert
+    return tls.Listen("tcp", addr, config)
+}
+
+// Accept and serve connections on l until Close is called. The listener
+// is responsible for authentication, e.g. a TLS listener requiring client
+// certificates.
+func (s *Server) Serve(l net.Listener) error {
+    s.mutex.Lock()
+    if s.closed {
+        s.mutex.Unlock()
+        l.Close()
+        return fmt.Errorf("remote: server closed")
+    }
+    s.listeners = append(s.listeners, l)
+    s.mutex.Unlock()
+    for {
+        conn, err := l.Accept()
+        if err != nil {
+            s.mutex.Lock()
+            closed := s.closed
+            s.mutex.Unlock()
+            if closed { return nil }
+            return err
+        }
+        s.mutex.Lock()
+        s.conns[conn] = true
+        s.mutex.Unlock()
+        go s.serve(conn)
+    }
+}
+
+// Stop serving, closing listeners and connections.
+func (s *Server) Close() error {
+    s.mutex.Lock()
+    defer s.mutex.Unlock()
+    if s.closed { return nil }
+    s.closed = true
+    for _, l := range s.listeners {
+        l.Close()
+    }
+    for conn := range s.conns {
+        conn.Close()
+    }
+    return nil
+}
+
+// Client session. Handles are local to the session.
+type session struct {
+    server *Server
+    conn net.Conn
+    done chan struct{}
+    encMutex sync.Mutex
+    enc *gob.Encoder
+    mutex sync.Mutex
+    next uint64
+    contexts map[uint64]uintptr
+    cards map[uint64]uintptr
+    wg sync.WaitGroup
+}
+
+// Serve connection until closed, then release its contexts and cards.
+func (s *Server) serve(conn net.Conn) {
+    ss := &session{
+        server: s,
+        conn: conn,
+        done: make(chan struct{}),
+        enc: gob.NewEncoder(conn),
+        contexts: map[uint64]uintptr{},
+        cards: map[uint64]uintptr{},
+    }
+    dec := gob.NewDecoder(conn)
+    pending := make(chan struct{}, s.maxRequests)
+    for {
+        req := &request{}
+        if err := dec.Decode(req); err != nil { break }
+        select {
+            case pending <- struct{}{}:
+            default:
+                rsp := &response{}
+                rsp.setError(pcsc.Error(pcsc.SCARD_E_SERVER_TOO_BUSY))
+                ss.send(req, rsp)
+                continue
+        }
+        ss.wg.Add(1)
+        go func() {
+            defer func() {
+                <-pending
+                ss.wg.Done()
+            }()
+            ss.send(req, ss.handle(req))
+        }()
+    }
+    close(ss.done)
+    conn.Close()
+    s.mutex.Lock()
+    delete(s.conns, conn)
+    s.mutex.Unlock()
+    ss.release()
+    // Release what pending requests acquired meanwhile
+    ss.wg.Wait()
+    ss.release()
+}
+
+// Send response to req, closing the connection on errors.
+func (ss *session) send(req *request, rsp *response) {
+    rsp.ID = req.ID
+    ss.encMutex.Lock()
+    defer ss.encMutex.Unlock()
+    if err := ss.enc.Encode(rsp); err != nil { ss.conn.Close() }
+}
+
+// Disconnect cards and release contexts of the session.
+func (ss *session) release() {
+    ss.mutex.Lock()
+    cards, contexts := ss.cards, ss.contexts
+    ss.cards, ss.contexts = map[uint64]uintptr{}, map[uint64]uintptr{}
+    ss.mutex.Unlock()
+    backend := ss.server.backend
+    for _, card := range cards {
+        backend.Disconnect(card, smartcard.RESET_CARD)
+    }
+    for _, ctx := range contexts {
+        backend.ReleaseContext(ctx)
+    }
+}
+
+var errInvalidHandle = pcsc.Error(pcsc.SCARD_E_INVALID_HANDLE)
+
+// Return backend handle of context.
+func (ss *session) context(id uint64) (uintptr, error) {
+    ss.mutex.Lock()
+    defer ss.mutex.Unlock()
+    ctx, ok := ss.contexts[id]
+    if !ok { return 0, errInvalidHandle }
+    return ctx, nil
+}
+
+// Return backend handle of card.
+func (ss *session) card(id uint64) (uintptr, error) {
+    ss.mutex.Lock()
+    defer ss.mutex.Unlock()
+    card, ok := ss.cards[id]
+    if !ok { return 0, errInvalidHandle }
+    return card, nil
+}
+
+// Register backend handle of context or card and return its session
+// handle.
+func (ss *session) add(h uintptr, card bool) uint64 {
+    ss.mutex.Lock()
+    defer ss.mutex.Unlock()
+    ss.next++
+    if card {
+        ss.cards[ss.next] = h
+    } else {
+        ss.contexts[ss.next] = h
+    }
+    return ss.next
+}
+
+// Wait for status change in slices of at most a second, so that waits of
+// closed sessions end.
+func (ss *session) getStatusChange(ctx uintptr, timeout uint32,
+    states []smartcard.ReaderState) error {
+    const slice = 1000
+    for {
+        t := uint32(slice)
+        if timeout < slice { t = timeout }
+        err := ss.server.backend.GetStatusChange(ctx, t, states)
+        if err != pcsc.Error(pcsc.SCARD_E_TIMEOUT) || timeout == t {
+            return err
+        }
+        if timeout != smartcard.INFINITE { timeout -= t }
+        select {
+            case <-ss.done:
+                return pcsc.Error(pcsc.SCARD_E_CANCELLED)
+            default:
+        }
+    }
+}
+
+// Process request.
+func (ss *session) handle(req *request) *response {
+    backend := ss.server.backend
+    rsp := &response{}
+    var err error
+    var ctx, card uintptr
+    switch req.Op {
+        case OP_ESTABLISH_CONTEXT, OP_CONNECT, OP_RELEASE_CONTEXT,
+            OP_LIST_READERS, OP_GET_STATUS_CHANGE:
+            if req.Op != OP_ESTABLISH_CONTEXT {
+                ctx, err = ss.context(req.Context)
+            }
+        default:
+            card, err = ss.card(req.Card)
+    }
+    if err != nil {
+        rsp.setError(err)
+        return rsp
+    }
+    switch req.Op {
+        case OP_ESTABLISH_CONTEXT:
+            ctx, err = backend.EstablishContext(req.Arg1)
+            if err == nil { rsp.Handle = ss.add(ctx, false) }
+        case OP_RELEASE_CONTEXT:
+            ss.mutex.Lock()
+            delete(ss.contexts, req.Context)
+            ss.mutex.Unlock()
+            err = backend.ReleaseContext(ctx)
+        case OP_LIST_READERS:
+            rsp.Readers, err = backend.ListReaders(ctx)
+        case OP_GET_STATUS_CHANGE:
+            err = ss.getStatusChange(ctx, req.Arg1, req.States)
+            rsp.States = req.States
+        case OP_CONNECT:
+            card, rsp.Protocol, err = backend.Connect(ctx, req.Reader,
+                req.Arg1, req.Arg2)
+            if err == nil { rsp.Handle = ss.add(card, true) }
+        case OP_DISCONNECT:
+            ss.mutex.Lock()
+            delete(ss.cards, req.Card)
+            ss.mutex.Unlock()
+            err = backend.Disconnect(card, req.Arg1)
+        case OP_STATUS:
+            rsp.Status, err = backend.Status(card)
+        case OP_TRANSMIT:
+            rsp.Data, err = backend.Transmit(card, req.Arg1, req.Data)
+        case OP_CONTROL:
+            rsp.Data, err = backend.Control(card, req.Arg1, req.Data)
+        case OP_GET_ATTRIB:
+            rsp.Data, err = backend.GetAttrib(card, req.Arg1)
+        case OP_BEGIN_TRANSACTION:
+            err = backend.BeginTransaction(card)
+        case OP_END_TRANSACTION:
+            err = backend.EndTransaction(card, req.Arg1)
+        default:
+            err = pcsc.Error(pcsc.SCARD_E_UNSUPPORTED_FEATURE)
+    }
+    rsp.setError(err)
+    return rsp
+}
@@ -0,0 +1,235 @@
+package script
+
+import (
+    "fmt"
+    "io"
+    "os"
+    "strings"
+    "github.com/sf1/go-card/smartcard"
+    "github.com/sf1/go-card/smartcard/tlv"
+)
+
+// Error for a status word not matching the expectation.
+type ExpectationError struct {
+    Line int
+    Expected []string
+    SW uint16
+}
+
+func (e *ExpectationError) Error() string {
+    return fmt.Sprintf("line %d: expected SW %s, got %04X", e.Line,
+        strings.Join(e.Expected, "|"), e.SW)
+}
+
+// Script interpreter.
+type Runner struct {
+    card smartcard.Transmitter
+    out io.Writer
+    // Variables, initially those set by the caller
+    Vars map[string][]byte
+    // Print commands (responses are always printed)
+    Echo bool
+    // Print all response data as BER-TLV
+    TLV bool
+    // Retrieve response data announced with SW1 61 (GET RESPONSE) or
+    // SW1 6C (repeat with Le = SW2)
+    GetResponse bool
+    // Continue after failed expectations
+    KeepGoing bool
+    // Number of failed expectations
+    Failures int
+}
+
+// Create runner sending commands to card and printing to out.
+func NewRunner(card smartcard.Transmitter, out io.Writer) *Runner {
+    return &Runner{
+        card: card,
+        out: out,
+        Vars: map[string][]byte{},
+        Echo: true,
+        GetResponse: true,
+    }
+}
+
+// Run script. Stops at the first error or, unless KeepGoing is set,
+// failed expectation (*ExpectationError).
+func (r *Runner) Run(s *Script) error {
+    return r.run(s.statements)
+}
+
+func (r *Runner) run(statements []statement) error {
+    for _, s := range statements {
+        if err := r.exec(s); err != nil { return err }
+    }
+    return nil
+}
+
+// Execute statement.
+func (r *Runner) exec(s statement) error {
+    fail := func(err error) error {
+        if _, ok := err.(*ExpectationError); ok { return err }
+        return fmt.Errorf("line %d: %s", s.line(), err)
+    }
+    switch s := s.(type) {
+        case *setStmt:
+            value, err := r.eval(s.value)
+            if err != nil { return fail(err) }
+            r.Vars[s.name] = value
+        case *echoStmt:
+            var err error
+            text := os.Expand(s.text, func(name string) string {
+                value, ok := r.Vars[name]
+                if !ok && err == nil {
+                    err = fmt.Errorf("undefined variable %s", name)
+                }
+                return fmt.Sprintf("%X", value)
+            })
+            if err != nil { return fail(err) }
+            fmt.Fprintln(r.out, text)
+        case *repeatStmt:
+            for i := 0; i < s.count; i++ {
+                if s.name != "" { r.Vars[s.name] = []byte{byte(i)} }
+                if err := r.run(s.body); err != nil { return err }
+            }
+        case *forStmt:
+            for _, v := range s.values {
+                value, err := r.eval(v)
+                if err != nil { return fail(err) }
+                r.Vars[s.name] = value
+                if err := r.run(s.body); err != nil { return err }
+            }
+        case *sendStmt:
+            if err := r.send(s); err != nil { return fail(err) }
+    }
+    return nil
+}
+
+// Evaluate byte string expression.
+func (r *Runner) eval(e expr) ([]byte, error) {
+    out := []byte{}
+    for _, t := range e {
+        switch {
+            case t.group != nil:
+                value, err := r.eval(t.group)
+                if err != nil { return nil, err }
+                if len(value) > 0xff {
+                    return nil, fmt.Errorf("group longer than 255 bytes")
+                }
+                out = append(out, byte(len(value)))
+                out = append(out, value...)
+            case t.variable != "":
+                value, ok := r.Vars[t.variable]
+                if !ok {
+                    return nil, fmt.Errorf("undefined variable %s",
+                        t.variable)
+                }
+                out = append(out, value...)
+            default:
+                out = append(out, t.literal...)
+        }
+    }
+    return out, nil
+}
+
+// Send command of statement and check response.
+func (r *Runner) send(s *sendStmt) error {
+    apdu, err := r.eval(s.apdu)
+    if err != nil { return err }
+    cmd := smartcard.CommandAPDU(apdu)
+    if s.selectAID {
+        if len(apdu) > 0xff { return fmt.Errorf("AID too long") }
+        cmd = smartcard.SelectCommand(apdu...)
+    }
+    if len(cmd) < 4 { return fmt.Errorf("APDU too short") }
+    if r.Echo { fmt.Fprintf(r.out, ">> %s\n", formatCommand(cmd)) }
+    rsp, err := r.transmit(cmd)
+    if err != nil { return err }
+    fmt.Fprintf(r.out, "<< %s\n", rsp)
+    if data := rsp.Data(); len(data) > 0 && (r.TLV || s.tlv) {
+        if list, err := tlv.Parse(data); err == nil {
+            dumpTLV(r.out, list, "   ")
+        } else {
+            fmt.Fprintf(r.out, "   (no TLV: %s)\n", err)
+        }
+    }
+    sw := rsp.SW()
+    r.Vars["RESPONSE"] = append([]byte{}, rsp.Data()...)
+    r.Vars["SW"] = []byte{rsp.SW1(), rsp.SW2()}
+    if s.capture != "" { r.Vars[s.capture] = r.Vars["RESPONSE"] }
+    if len(s.expect) == 0 || matchSW(s.expect, sw) { return nil }
+    r.Failures++
+    e := &ExpectationError{s.pos, s.expect, sw}
+    fmt.Fprintf(r.out, "FAILED %s\n", e)
+    if r.KeepGoing { return nil }
+    return e
+}
+
+// Transmit command, retrieving response data if enabled.
+func (r *Runner) transmit(cmd smartcard.CommandAPDU) (smartcard.ResponseAPDU,
+    error) {
+    rsp, err := r.card.TransmitAPDU(cmd)
+    if err != nil || !r.GetResponse { return rsp, err }
+    if rsp.SW1() == 0x6c {
+        // Wrong Le, repeat with the right one
+        retry := append(smartcard.CommandAPDU{}, cmd...)
+        if _, ok := cmd.Le(); ok {
+            retry[len(retry)-1] = rsp.SW2()
+        } else {
+            retry = append(retry, rsp.SW2())
+        }
+        rsp, err = r.card.TransmitAPDU(retry)
+        if err != nil { return nil, err }
+    }
+    var data []byte
+    for rsp.SW1() == 0x61 {
+        data = append(data, rsp.Data()...)
+        rsp, err = r.card.TransmitAPDU(smartcard.Command2(cmd[0] & 0x03,
+            0xc0, 0x00, 0x00, rsp.SW2()))
+        if err != nil { return nil, err }
+    }
+    if data == nil { return rsp, nil }
+    return smartcard.ResponseAPDU(append(data, rsp...)), nil
+}
+
+// Return string form of command, also for extended length APDUs.
+func formatCommand(cmd smartcard.CommandAPDU) string {
+    if cmd.IsValid() { return cmd.String() }
+    return fmt.Sprintf("%X", []byte(cmd))
+}
+
+// Check if sw matches one of the patterns.
+func matchSW(patterns []string, sw uint16) bool {
+    s := fmt.Sprintf("%04X", sw)
+    for _, p := range patterns {
+        match := true
+        for i := 0; i < 4; i++ {
+            if p[i] != '?' && p[i] != s[i] { match = false }
+        }
+        if match { return true }
+    }
+    return false
+}
+
+// Print data objects indented, recursing into constructed ones.
+func dumpTLV(w io.Writer, list tlv.List, indent string) {
+    for _, t := range list {
+        if t.Tag.Constructed() {
+            if children, err := t.Children(); err == nil {
+                fmt.Fprintf(w, "%s%s\n", indent, t.Tag)
+                dumpTLV(w, children, indent + "  ")
+                continue
+            }
+        }
+        fmt.Fprintf(w, "%s%s: %X%s\n", indent, t.Tag, t.Value,
+            printable(t.Value))
+    }
+}
+
+// Return value as quoted text if it is printable ASCII.
+func printable(value []byte) string {
+    if len(value) == 0 { return "" }
+    for _, b := range value {
+        if b < 0x20 || b > 0x7e { return "" }
+    }
+    return fmt.Sprintf(" %q", value)
+}
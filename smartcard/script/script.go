@@ -0,0 +1,379 @@
+/*
+Package script implements a small language for APDU scripts, e.g. for
+card personalization or tests in CI against a virtual card.
+
+Each line holds one statement; "#" starts a comment:
+
+    # Select application and read a record
+    set AID = A0 00 00 00 03 10 10
+    select $AID expect 9000|61?? -> FCI
+    00 B2 01 0C 00 expect 9000 tlv
+    send 00 A4 04 00 {$AID} 00
+    echo FCI: $FCI, status $SW
+    repeat 3 I
+        00 B2 ${I} 0C 00 expect 9000|6A83
+    end
+    for KEY in 01 02 03
+        80 CA 00 $KEY 00
+    end
+
+Byte strings are hex digits (whitespace between bytes is optional),
+variables ($NAME or ${NAME}) and groups in braces, which are replaced by
+their length byte followed by their content. A statement is:
+
+    set NAME = BYTES        set variable
+    send BYTES [OPTIONS]    send command APDU (also without "send")
+    select BYTES [OPTIONS]  send SELECT by name (00 A4 04 00) for the AID
+    echo TEXT               print text with variables expanded (as hex)
+    repeat N [NAME] ... end run block N times, setting NAME to 00, 01, ...
+    for NAME in BYTES... ... end  run block for each value
+
+Options of send and select are "expect SW" with alternatives separated
+by "|" and "?" matching any hex digit, "-> NAME" to store the response
+data in a variable and "tlv" to print the response data as BER-TLV. After
+each command $RESPONSE holds the response data and $SW the status word.
+
+Example:
+
+    s, err := script.Parse(file)
+    // handle error, if any
+    runner := script.NewRunner(card, os.Stdout)
+    err = runner.Run(s)
+*/
+package script
+
+import (
+    "bufio"
+    "encoding/hex"
+    "fmt"
+    "io"
+    "regexp"
+    "strconv"
+    "strings"
+)
+
+// Statement of a script.
+type statement interface {
+    line() int
+}
+
+// Byte string expression.
+type expr []term
+
+// Literal bytes, variable or length-prefixed group.
+type term struct {
+    literal []byte
+    variable string
+    group expr
+}
+
+type setStmt struct {
+    pos int
+    name string
+    value expr
+}
+
+type sendStmt struct {
+    pos int
+    apdu expr
+    // SELECT by name for AID in apdu
+    selectAID bool
+    // Allowed status words, e.g. "9000", "61??"
+    expect []string
+    capture string
+    tlv bool
+}
+
+type echoStmt struct {
+    pos int
+    text string
+}
+
+type repeatStmt struct {
+    pos int
+    count int
+    name string
+    body []statement
+}
+
+type forStmt struct {
+    pos int
+    name string
+    values []expr
+    body []statement
+}
+
+func (s *setStmt) line() int { return s.pos }
+func (s *sendStmt) line() int { return s.pos }
+func (s *echoStmt) line() int { return s.pos }
+func (s *repeatStmt) line() int { return s.pos }
+func (s *forStmt) line() int { return s.pos }
+
+// Parsed script.
+type Script struct {
+    statements []statement
+}
+
+// Error in a script line.
+type SyntaxError struct {
+    Line int
+    Msg string
+}
+
+func (e *SyntaxError) Error() string {
+    return fmt.Sprintf("line %d: %s", e.Line, e.Msg)
+}
+
+// Error for scripts ending inside a block. Interactive callers may read
+// more lines.
+type UnterminatedError struct {
+    Line int
+}
+
+func (e *UnterminatedError) Error() string {
+    return fmt.Sprintf("line %d: block not terminated by end", e.Line)
+}
+
+var (
+    namePattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+    swPattern = regexp.MustCompile(`^[0-9A-Fa-f?]{4}$`)
+)
+
+// Parse script.
+func Parse(r io.Reader) (*Script, error) {
+    scanner := bufio.NewScanner(r)
+    var lines []string
+    for scanner.Scan() {
+        lines = append(lines, scanner.Text())
+    }
+    if err := scanner.Err(); err != nil { return nil, err }
+    p := &parser{lines: lines}
+    statements, err := p.block(0)
+    if err != nil { return nil, err }
+    return &Script{statements}, nil
+}
+
+// Parse script in string.
+func ParseString(s string) (*Script, error) {
+    return Parse(strings.NewReader(s))
+}
+
+type parser struct {
+    lines []string
+    pos int
+}
+
+// Parse statements until "end" or the end of the script. start is the
+// line of the block statement, 0 for the script itself.
+func (p *parser) block(start int) ([]statement, error) {
+    var statements []statement
+    for p.pos < len(p.lines) {
+        line := p.lines[p.pos]
+        p.pos++
+        if i := strings.Index(line, "#"); i >= 0 { line = line[:i] }
+        words := strings.Fields(line)
+        if len(words) == 0 { continue }
+        if strings.ToLower(words[0]) == "end" {
+            if start == 0 || len(words) > 1 {
+                return nil, &SyntaxError{p.pos, "unexpected end"}
+            }
+            return statements, nil
+        }
+        s, err := p.statement(words)
+        if err != nil { return nil, err }
+        statements = append(statements, s)
+    }
+    if start != 0 { return nil, &UnterminatedError{start} }
+    return statements, nil
+}
+
+// Parse statement of the current line.
+func (p *parser) statement(words []string) (statement, error) {
+    pos := p.pos
+    fail := func(format string, args ...interface{}) error {
+        return &SyntaxError{pos, fmt.Sprintf(format, args...)}
+    }
+    switch strings.ToLower(words[0]) {
+        case "set":
+            if len(words) < 4 || words[2] != "=" ||
+                !namePattern.MatchString(words[1]) {
+                return nil, fail("expected set NAME = BYTES")
+            }
+            value, err := parseExpr(strings.Join(words[3:], " "))
+            if err != nil { return nil, fail("%s", err) }
+            return &setStmt{pos, words[1], value}, nil
+        case "echo":
+            line := strings.TrimSpace(p.lines[pos-1])
+            if i := strings.Index(line, "#"); i >= 0 { line = line[:i] }
+            return &echoStmt{pos, strings.TrimSpace(line[len(words[0]):])},
+                nil
+        case "repeat":
+            if len(words) < 2 || len(words) > 3 {
+                return nil, fail("expected repeat N [NAME]")
+            }
+            count, err := strconv.Atoi(words[1])
+            if err != nil || count < 0 || count > 256 {
+                return nil, fail("invalid count %q", words[1])
+            }
+            s := &repeatStmt{pos: pos, count: count}
+            if len(words) == 3 {
+                if !namePattern.MatchString(words[2]) {
+                    return nil, fail("invalid name %q", words[2])
+                }
+                s.name = words[2]
+            }
+            s.body, err = p.block(pos)
+            if err != nil { return nil, err }
+            return s, nil
+        case "for":
+            if len(words) < 4 || strings.ToLower(words[2]) != "in" ||
+                !namePattern.MatchString(words[1]) {
+                return nil, fail("expected for NAME in BYTES...")
+            }
+            s := &forStmt{pos: pos, name: words[1]}
+            for _, w := range words[3:] {
+                value, err := parseExpr(w)
+                if err != nil { return nil, fail("%s", err) }
+                s.values = append(s.values, value)
+            }
+            body, err := p.block(pos)
+            if err != nil { return nil, err }
+            s.body = body
+            return s, nil
+    }
+    s := &sendStmt{pos: pos}
+    switch strings.ToLower(words[0]) {
+        case "select":
+            s.selectAID = true
+            words = words[1:]
+        case "send":
+            words = words[1:]
+    }
+    // Options follow the APDU
+    n := len(words)
+    for i, w := range words {
+        switch strings.ToLower(w) {
+            case "expect", "->", "tlv":
+                n = i
+        }
+        if n < len(words) { break }
+    }
+    apdu, err := parseExpr(strings.Join(words[:n], " "))
+    if err != nil { return nil, fail("%s", err) }
+    if len(apdu) == 0 { return nil, fail("missing APDU") }
+    s.apdu = apdu
+    options := words[n:]
+    for i := 0; i < len(options); i++ {
+        switch strings.ToLower(options[i]) {
+            case "expect":
+                i++
+                if i == len(options) { return nil, fail("missing status word") }
+                for _, sw := range strings.Split(options[i], "|") {
+                    if !swPattern.MatchString(sw) {
+                        return nil, fail("invalid status word %q", sw)
+                    }
+                    s.expect = append(s.expect, strings.ToUpper(sw))
+                }
+            case "->":
+                i++
+                if i == len(options) || !namePattern.MatchString(options[i]) {
+                    return nil, fail("expected -> NAME")
+                }
+                s.capture = options[i]
+            case "tlv":
+                s.tlv = true
+            default:
+                return nil, fail("unexpected %q", options[i])
+        }
+    }
+    return s, nil
+}
+
+// Parse byte string expression.
+func parseExpr(s string) (expr, error) {
+    e, rest, err := parseTerms(s, false)
+    if err != nil { return nil, err }
+    if rest != "" { return nil, fmt.Errorf("unexpected %q", rest) }
+    return e, nil
+}
+
+// Parse terms up to the end of s or, in groups, the closing brace, and
+// return the remainder after it.
+func parseTerms(s string, group bool) (expr, string, error) {
+    var e expr
+    var digits []byte
+    // Append pending hex digits as literal
+    flush := func() error {
+        if len(digits) == 0 { return nil }
+        if len(digits) % 2 != 0 {
+            return fmt.Errorf("odd number of hex digits in %q", digits)
+        }
+        b, err := hex.DecodeString(string(digits))
+        if err != nil { return err }
+        e = append(e, term{literal: b})
+        digits = nil
+        return nil
+    }
+    for len(s) > 0 {
+        c := s[0]
+        switch {
+            case isHexDigit(c):
+                digits = append(digits, c)
+                s = s[1:]
+                continue
+            case c == ' ' || c == '\t':
+                // Bytes may be separated, digits of a byte not
+                if len(digits) % 2 != 0 {
+                    return nil, "", fmt.Errorf("odd number of hex digits " +
+                        "in %q", digits)
+                }
+                s = s[1:]
+                continue
+        }
+        if err := flush(); err != nil { return nil, "", err }
+        switch c {
+            case '$':
+                name, rest, err := parseVariable(s[1:])
+                if err != nil { return nil, "", err }
+                e = append(e, term{variable: name})
+                s = rest
+            case '{':
+                g, rest, err := parseTerms(s[1:], true)
+                if err != nil { return nil, "", err }
+                e = append(e, term{group: g})
+                if g == nil { e[len(e)-1].group = expr{} }
+                s = rest
+            case '}':
+                if !group { return nil, "", fmt.Errorf("unexpected }") }
+                return e, s[1:], nil
+            default:
+                return nil, "", fmt.Errorf("unexpected %q", s)
+        }
+    }
+    if err := flush(); err != nil { return nil, "", err }
+    if group { return nil, "", fmt.Errorf("missing }") }
+    return e, "", nil
+}
+
+// Parse variable name (NAME or {NAME}) and return the remainder.
+func parseVariable(s string) (string, string, error) {
+    if strings.HasPrefix(s, "{") {
+        i := strings.Index(s, "}")
+        if i < 0 || !namePattern.MatchString(s[1:i]) {
+            return "", "", fmt.Errorf("invalid variable in %q", s)
+        }
+        return s[1:i], s[i+1:], nil
+    }
+    i := 0
+    for i < len(s) && (s[i] == '_' || s[i] >= 'a' && s[i] <= 'z' ||
+        s[i] >= 'A' && s[i] <= 'Z' || i > 0 && s[i] >= '0' && s[i] <= '9') {
+        i++
+    }
+    if i == 0 { return "", "", fmt.Errorf("invalid variable in %q", s) }
+    return s[:i], s[i:], nil
+}
+
+func isHexDigit(c byte) bool {
+    return c >= '0' && c <= '9' || c >= 'a' && c <= 'f' ||
+        c >= 'A' && c <= 'F'
+}
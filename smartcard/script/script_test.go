@@ -0,0 +1,119 @@
+package script
+
+import (
+    "bytes"
+    "strings"
+    "testing"
+    "github.com/sf1/go-card/smartcard/mock"
+)
+
+const testScript = `
+# Select and read
+set AID = A0 00 00 00 03 10 10
+select $AID expect 9000|61?? -> FCI
+echo FCI $FCI SW ${SW}
+repeat 2 I
+    00 B2 ${I}0C 00 expect 9000 tlv   # record I
+end
+for P2 in 01 02
+    send 80CA00$P2 00 -> DO
+end
+send 00 84 00 00 00
+`
+
+func TestRun(t *testing.T) {
+    card := mock.NewCard(mock.Hex("3b 80 80 01 01")).
+        Expect("00 a4 04 00 07 a0 00 00 00 03 10 10", "61 04").
+        Expect("00 c0 00 00 04", "6f 02 84 00 90 00").
+        Expect("00 b2 00 0c 00", "70 03 5a 01 41 90 00").
+        Expect("00 b2 01 0c 00", "90 00").
+        Expect("80 ca 00 01 00", "01 90 00").
+        Expect("80 ca 00 02 00", "6c 02").
+        Expect("80 ca 00 02 02", "02 02 90 00").
+        Expect("00 84 00 00 00", "6d 00")
+    s, err := ParseString(testScript)
+    if err != nil { t.Fatal(err) }
+    var out bytes.Buffer
+    r := NewRunner(card, &out)
+    if err := r.Run(s); err != nil { t.Fatal(err) }
+    card.AssertExpectations(t)
+    for _, expected := range []string{
+        ">> 00 A4 04 00 07 A0000000031010\n<< 6F028400 9000\n",
+        "FCI 6F028400 SW 9000\n",
+        "<< 70035A0141 9000\n   70\n     5A: 41 \"A\"\n",
+        "<< 6D00\n",
+    } {
+        if !strings.Contains(out.String(), expected) {
+            t.Errorf("output %q does not contain %q", out.String(), expected)
+        }
+    }
+    if !bytes.Equal(r.Vars["DO"], mock.Hex("02 02")) ||
+        !bytes.Equal(r.Vars["SW"], mock.Hex("6d 00")) {
+        t.Errorf("unexpected variables %X", r.Vars)
+    }
+}
+
+func TestExpectations(t *testing.T) {
+    card := mock.NewCard(nil).Rule("00 84 00 00 ??", "6a 82")
+    s, err := ParseString("0084000008 expect 9000\n0084000008 expect 6A8?")
+    if err != nil { t.Fatal(err) }
+    r := NewRunner(card, &bytes.Buffer{})
+    err = r.Run(s)
+    if e, ok := err.(*ExpectationError); !ok || e.Line != 1 ||
+        e.SW != 0x6a82 || r.Failures != 1 {
+        t.Errorf("unexpected error %v", err)
+    }
+    r = NewRunner(card, &bytes.Buffer{})
+    r.KeepGoing = true
+    if err := r.Run(s); err != nil || r.Failures != 1 {
+        t.Errorf("unexpected result %v, %d failures", err, r.Failures)
+    }
+    if len(card.Exchanges()) != 3 {
+        t.Errorf("unexpected exchanges %v", card.Exchanges())
+    }
+}
+
+func TestGroups(t *testing.T) {
+    card := mock.NewCard(nil).
+        Expect("00 a4 04 00 07 a0 00 00 00 03 10 10 00", "90 00").
+        Expect("80 e2 00 00 06 5f 03 02 00 ff 00", "90 00").
+        Expect("80 e2 00 00 00", "90 00")
+    s, err := ParseString("set AID = A0 00 00 00 03 10 10\n" +
+        "send 00 A4 04 00 {$AID} 00\n" +
+        "set X = 02\n80 E2 00 00 {5F {$X 00 FF} 00}\n80 E2 00 00 {}")
+    if err != nil { t.Fatal(err) }
+    if err := NewRunner(card, &bytes.Buffer{}).Run(s); err != nil {
+        t.Fatal(err)
+    }
+    card.AssertExpectations(t)
+}
+
+func TestParseErrors(t *testing.T) {
+    for _, test := range []struct {
+        script string
+        line int
+    }{
+        {"00 A", 1},
+        {"00 A4 {00", 1},
+        {"\nset X 00", 2},
+        {"00 84 00 00 expect 900", 1},
+        {"00 84 00 00 -> 1X", 1},
+        {"end", 1},
+        {"repeat x\nend", 1},
+        {"00 84 00 00 bogus", 1},
+    } {
+        _, err := ParseString(test.script)
+        if e, ok := err.(*SyntaxError); !ok || e.Line != test.line {
+            t.Errorf("%q: unexpected error %v", test.script, err)
+        }
+    }
+    _, err := ParseString("00 84 00 00\nrepeat 2\n00 84 00 00")
+    if e, ok := err.(*UnterminatedError); !ok || e.Line != 2 {
+        t.Errorf("expected unterminated block, got %v", err)
+    }
+    s, _ := ParseString("00 84 00 00 $X")
+    if err := NewRunner(mock.NewCard(nil), &bytes.Buffer{}).Run(
+        s); err == nil || !strings.Contains(err.Error(), "undefined") {
+        t.Errorf("expected undefined variable, got %v", err)
+    }
+}
@@ -0,0 +1,97 @@
+// +build go1.21
+
+package smartcard
+
+import (
+    "context"
+    "encoding/hex"
+    "fmt"
+    "log/slog"
+)
+
+// Observer logging card events with log/slog: connects and disconnects at
+// Info, exchanges at Debug and failures at Warn level. The data of
+// sensitive commands (see SensitiveCommand) is never logged.
+//
+// Example:
+//
+//     ctx.SetObserver(smartcard.NewSlogObserver(slog.Default()))
+type SlogObserver struct {
+    logger *slog.Logger
+    // Check if command data must be redacted. Defaults to SensitiveCommand.
+    Redact func(cmd []byte) bool
+}
+
+// Create observer logging to logger, or to slog.Default() if nil.
+func NewSlogObserver(logger *slog.Logger) *SlogObserver {
+    if logger == nil { logger = slog.Default() }
+    return &SlogObserver{logger: logger, Redact: SensitiveCommand}
+}
+
+// Return loggable form of command: hex, with data replaced by <redacted>
+// for sensitive commands.
+func (o *SlogObserver) command(cmd []byte) string {
+    if o.Redact == nil || !o.Redact(cmd) || len(cmd) < 5 {
+        return hex.EncodeToString(cmd)
+    }
+    // Keep header and Lc (extended Lc if first byte is 0)
+    n := 5
+    if cmd[4] == 0 && len(cmd) >= 7 { n = 7 }
+    return hex.EncodeToString(cmd[:n]) + "<redacted>"
+}
+
+// Return name of protocol.
+func protocolName(protocol uint32) string {
+    switch protocol {
+        case PROTOCOL_T0:
+            return "T=0"
+        case PROTOCOL_T1:
+            return "T=1"
+    }
+    return fmt.Sprintf("0x%x", protocol)
+}
+
+// Log event.
+func (o *SlogObserver) Observe(e *Event) {
+    level, msg := slog.LevelInfo, ""
+    switch e.Kind {
+        case EVENT_CONNECT:
+            msg = "smartcard connect"
+        case EVENT_DISCONNECT:
+            msg = "smartcard disconnect"
+        case EVENT_TRANSMIT:
+            level, msg = slog.LevelDebug, "smartcard transmit"
+        default:
+            return
+    }
+    if e.Err != nil { level = slog.LevelWarn }
+    ctx := context.Background()
+    if !o.logger.Enabled(ctx, level) { return }
+    attrs := []slog.Attr{slog.String("reader", e.Reader)}
+    switch e.Kind {
+        case EVENT_CONNECT:
+            if e.Err == nil {
+                attrs = append(attrs, slog.String("atr", e.ATR.String()),
+                    slog.String("protocol", protocolName(e.Protocol)))
+            }
+        case EVENT_DISCONNECT:
+            attrs = append(attrs, slog.Uint64("disposition",
+                uint64(e.Disposition)))
+        case EVENT_TRANSMIT:
+            attrs = append(attrs, slog.String("command",
+                o.command(e.Command)))
+            if e.Err == nil {
+                attrs = append(attrs, slog.String("response",
+                    hex.EncodeToString(e.Response)))
+            }
+            if n := len(e.Response); e.Err == nil && n >= 2 {
+                attrs = append(attrs, slog.String("sw",
+                    hex.EncodeToString(e.Response[n-2:])))
+            }
+    }
+    attrs = append(attrs, slog.Duration("duration", e.Duration))
+    if e.Err != nil {
+        attrs = append(attrs, slog.String("error", e.Err.Error()))
+    }
+    o.logger.LogAttrs(ctx, level, msg, attrs...)
+}
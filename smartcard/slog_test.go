@@ -0,0 +1,66 @@
+// +build go1.21
+
+package smartcard
+
+import (
+    "bytes"
+    "encoding/json"
+    "log/slog"
+    "strings"
+    "testing"
+)
+
+func TestSlogObserver(t *testing.T) {
+    var buffer bytes.Buffer
+    logger := slog.New(slog.NewJSONHandler(&buffer,
+        &slog.HandlerOptions{Level: slog.LevelDebug}))
+    ctx, err := EstablishContextWithBackend(&testBackend{})
+    if err != nil { t.Fatal(err) }
+    defer ctx.Release()
+    ctx.SetObserver(NewSlogObserver(logger))
+    readers, _ := ctx.ListReaders()
+    readers[0].Connect()
+    card, err := readers[1].Connect()
+    if err != nil { t.Fatal(err) }
+    pin := []byte("31323334ffffffff")
+    verify := append([]byte{0x00, 0x20, 0x00, 0x81, 0x08}, pin...)
+    if _, err := card.Transmit(verify); err != nil { t.Fatal(err) }
+    if _, err := card.TransmitAPDU(SelectCommand(0xa0, 0x00)); err != nil {
+        t.Fatal(err)
+    }
+    card.DisconnectMode(LEAVE_CARD)
+    if strings.Contains(buffer.String(), "3132333466") {
+        t.Fatalf("PIN logged: %s", buffer.String())
+    }
+    var records []map[string]interface{}
+    for _, line := range strings.Split(strings.TrimSpace(buffer.String()),
+        "\n") {
+        var r map[string]interface{}
+        if err := json.Unmarshal([]byte(line), &r); err != nil {
+            t.Fatal(err)
+        }
+        records = append(records, r)
+    }
+    expected := []map[string]interface{}{
+        {"level": "WARN", "msg": "smartcard connect",
+            "reader": testReaders[0]},
+        {"level": "INFO", "msg": "smartcard connect", "atr": "3b80800101",
+            "protocol": "T=1"},
+        {"level": "DEBUG", "msg": "smartcard transmit",
+            "command": "0020008108<redacted>", "sw": "9000"},
+        {"level": "DEBUG", "msg": "smartcard transmit",
+            "command": "00a4040002a000", "response": "9000"},
+        {"level": "INFO", "msg": "smartcard disconnect", "disposition": 0.0},
+    }
+    if len(records) != len(expected) {
+        t.Fatalf("unexpected records %s", buffer.String())
+    }
+    for i, r := range records {
+        for k, v := range expected[i] {
+            if r[k] != v {
+                t.Errorf("record %d: %s = %v, expected %v", i, k, r[k], v)
+            }
+        }
+    }
+    if _, ok := records[0]["error"]; !ok { t.Error("error not logged") }
+}
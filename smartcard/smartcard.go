@@ -19,6 +19,14 @@ Example:
     response, err := card.TransmitAPDU(command)
     // handle error, if any
     fmt.Printf("Response: %s\n", response)
+
+Readers and cards are accessed through a Backend: pcsc-lite on Unix and
+WinSCard on Windows by default. EstablishContextWithBackend uses another
+implementation, e.g. a mock, remote reader or virtual card.
+
+An Observer set with Context.SetObserver receives connect, disconnect and
+transmit events, e.g. to log APDU traffic with NewSlogObserver (log/slog,
+Go 1.21 and later). PINs of VERIFY and similar commands are redacted.
 */
 package smartcard
 
@@ -46,6 +54,12 @@ func (atr ATR) String() string {
     return buffer.String()
 }
 
+// Anything that exchanges command and response APDUs with a card.
+// Implemented by Card and by wrappers such as secure channel sessions.
+type Transmitter interface {
+    TransmitAPDU(cmd CommandAPDU) (ResponseAPDU, error)
+}
+
 // Transmit command APDU to the card and return response.
 func (c *Card) TransmitAPDU(cmd CommandAPDU) (ResponseAPDU, error) {
     bytes, err := c.Transmit(cmd)
@@ -55,6 +69,54 @@ func (c *Card) TransmitAPDU(cmd CommandAPDU) (ResponseAPDU, error) {
     return r, nil
 }
 
+// Transmit command APDU and retrieve the complete response, issuing
+// GET RESPONSE as long as the card indicates more data with SW1 = 61.
+func TransmitAndGetResponse(t Transmitter, cmd CommandAPDU) (
+    ResponseAPDU, error) {
+    rsp, err := t.TransmitAPDU(cmd)
+    if err != nil { return nil, err }
+    var data []byte
+    for rsp.SW1() == 0x61 {
+        data = append(data, rsp.Data()...)
+        rsp, err = t.TransmitAPDU(Command2(cmd[0] & 0x03, 0xc0, 0x00, 0x00,
+            rsp.SW2()))
+        if err != nil { return nil, err }
+    }
+    if data == nil {
+        return rsp, nil
+    }
+    data = append(data, rsp...)
+    return ResponseAPDU(data), nil
+}
+
+// Transmit command with data of arbitrary length using command chaining
+// (ISO7816-4 5.1.1) and retrieve the complete response. If withLe is set,
+// the last command of the chain requests response data.
+func TransmitChained(t Transmitter, cla, ins, p1, p2 byte, data []byte,
+    withLe bool) (ResponseAPDU, error) {
+    for len(data) > 0xff {
+        cmd := Command3(cla | 0x10, ins, p1, p2, data[:0xff])
+        rsp, err := t.TransmitAPDU(cmd)
+        if err != nil { return nil, err }
+        if rsp.SW() != 0x9000 {
+            return rsp, nil
+        }
+        data = data[0xff:]
+    }
+    var cmd CommandAPDU
+    switch {
+        case len(data) == 0 && withLe:
+            cmd = Command2(cla, ins, p1, p2, 0x00)
+        case len(data) == 0:
+            cmd = Command1(cla, ins, p1, p2)
+        case withLe:
+            cmd = Command4(cla, ins, p1, p2, data, 0x00)
+        default:
+            cmd = Command3(cla, ins, p1, p2, data)
+    }
+    return TransmitAndGetResponse(t, cmd)
+}
+
 // ISO7816-4 command APDU.
 type CommandAPDU []byte
 
@@ -128,6 +190,29 @@ func (cmd CommandAPDU) IsValid() bool {
     return true
 }
 
+// Return data part of command, if any.
+func (cmd CommandAPDU) Data() []byte {
+    if len(cmd) <= 5 {
+        return nil
+    }
+    lc := int(cmd[4])
+    if len(cmd) < 5 + lc {
+        return nil
+    }
+    return cmd[5:5+lc]
+}
+
+// Return Le and whether the command expects response data.
+func (cmd CommandAPDU) Le() (byte, bool) {
+    if len(cmd) == 5 {
+        return cmd[4], true
+    }
+    if len(cmd) > 5 && len(cmd) == int(cmd[4]) + 6 {
+        return cmd[len(cmd)-1], true
+    }
+    return 0, false
+}
+
 // Return string form of APDU.
 func (cmd CommandAPDU) String() string {
     if !cmd.IsValid() {
@@ -184,6 +269,13 @@ func (r ResponseAPDU) Data() []byte {
     return r[:len(r)-2]
 }
 
+// Error for responses with a status word other than the expected one.
+type SWError uint16
+
+func (sw SWError) Error() string {
+    return fmt.Sprintf("card returned status word %04X", uint16(sw))
+}
+
 // Return string form of APDU.
 func (r ResponseAPDU) String() string {
     var bytes []byte = r
@@ -3,161 +3,226 @@
 package smartcard
 
 import (
+    "fmt"
+    "sync"
     "time"
     "github.com/sf1/go-card/smartcard/pcsc"
 )
 
-// A smart card context is required to access readers and cards.
-type Context struct {
-    client *pcsc.PCSCLiteClient
-    ctxID uint32
+// Return platform backend, connecting to pcscd.
+func DefaultBackend() (Backend, error) {
+    client, err := pcsc.PCSCLiteConnect()
+    if err != nil { return nil, err }
+    return &pcscLiteBackend{client: client,
+        cards: map[uintptr]pcscLiteCard{}}, nil
 }
 
-// Establish smart card context.
-// This should be the first function to be called.
-func EstablishContext(scope ...uint32) (*Context, error) {
-    var err error
-    scp := uint32(SCOPE_SYSTEM)
-    if len(scope) > 0 {
-        scp = scope[0]
-    }
-    context := &Context{}
-    context.client, err = pcsc.PCSCLiteConnect()
-    if err != nil { return nil, err }
-    context.ctxID, err = context.client.EstablishContext(scp)
-    return context, nil
+// Reader and context of a card handle.
+type pcscLiteCard struct {
+    reader string
+    ctx uintptr
 }
 
-// Release resources associated with smart card context.
-func (ctx *Context) Release() error {
-    return ctx.client.ReleaseContext(ctx.ctxID)
+// Backend talking to pcscd over its client socket. Reader states are read
+// from the daemon; GetStatusChange polls them.
+type pcscLiteBackend struct {
+    mutex sync.Mutex
+    client *pcsc.PCSCLiteClient
+    contexts int
+    cards map[uintptr]pcscLiteCard
 }
 
-// List all smart card readers.
-func (ctx *Context) ListReaders() ([]*Reader, error) {
-    return ctx.listReaders(false)
+func (b *pcscLiteBackend) EstablishContext(scope uint32) (uintptr, error) {
+    b.mutex.Lock()
+    defer b.mutex.Unlock()
+    ctxID, err := b.client.EstablishContext(scope)
+    if err != nil { return 0, err }
+    b.contexts++
+    return uintptr(ctxID), nil
+}
+
+func (b *pcscLiteBackend) ReleaseContext(ctx uintptr) error {
+    b.mutex.Lock()
+    defer b.mutex.Unlock()
+    err := b.client.ReleaseContext(uint32(ctx))
+    if err != nil { return err }
+    // pcscd disconnects the cards of the context
+    for card, c := range b.cards {
+        if c.ctx == ctx { delete(b.cards, card) }
+    }
+    b.contexts--
+    if b.contexts == 0 {
+        b.client.Close()
+    }
+    return nil
 }
 
-// List smart card readers with inserted cards.
-func (ctx *Context) ListReadersWithCard() ([]*Reader, error) {
-    return ctx.listReaders(true)
+// Return states of all readers.
+func (b *pcscLiteBackend) readers() ([]pcsc.Reader, error) {
+    count, err := b.client.SyncReaders()
+    if err != nil { return nil, err }
+    readers := b.client.Readers()
+    return readers[:count], nil
 }
 
-func (ctx *Context) listReaders(withCard bool) ([]*Reader, error) {
-    readers, err := ctx.client.ListReaders()
+func (b *pcscLiteBackend) ListReaders(ctx uintptr) ([]string, error) {
+    b.mutex.Lock()
+    defer b.mutex.Unlock()
+    readers, err := b.readers()
     if err != nil { return nil, err }
-    result := make([]*Reader, 0, len(readers))
-    for i := 0; i < len(readers); i++ {
-        if withCard {
-            if readers[i].IsCardPresent() {
-                result = append(result, &Reader{
-                    context: ctx, reader: *readers[i]})
-            }
-        } else {
-            result = append(result, &Reader{
-                context: ctx, reader: *readers[i]})
-        }
+    names := make([]string, len(readers))
+    for i := range readers {
+        names[i] = readers[i].Name()
+    }
+    return names, nil
+}
+
+// Return GetStatusChange state and ATR of reader.
+func readerState(r *pcsc.Reader) (uint32, []byte) {
+    if r.ReaderState & pcsc.SCARD_PRESENT == 0 {
+        return pcsc.SCARD_STATE_EMPTY, nil
+    }
+    state := uint32(pcsc.SCARD_STATE_PRESENT)
+    if r.ReaderState & pcsc.SCARD_POWERED == 0 {
+        state |= pcsc.SCARD_STATE_UNPOWERED
     }
-    return result, nil
-}
-
-// Block until a smart card is inserted into any reader.
-// Returns immediately if card already present.
-func (ctx *Context) WaitForCardPresent() (*Reader, error) {
-    var reader *Reader
-    for reader == nil {
-        count, err := ctx.client.SyncReaders()
-        if err != nil { return nil, err}
-        for i := uint32(0); i < count; i++ {
-            r := ctx.client.Readers()[i]
-            if r.IsCardPresent() {
-                reader = &Reader{context: ctx, reader: r}
-                break
+    if r.CardAtrLength == 0 {
+        state |= pcsc.SCARD_STATE_MUTE
+    }
+    switch {
+        case r.ReaderSharing < 0:
+            state |= pcsc.SCARD_STATE_EXCLUSIVE | pcsc.SCARD_STATE_INUSE
+        case r.ReaderSharing > 0:
+            state |= pcsc.SCARD_STATE_INUSE
+    }
+    return state, append([]byte{}, r.CardAtr[:r.CardAtrLength]...)
+}
+
+func (b *pcscLiteBackend) GetStatusChange(ctx uintptr, timeout uint32,
+    states []ReaderState) error {
+    deadline := time.Now().Add(time.Duration(timeout) * time.Millisecond)
+    for {
+        b.mutex.Lock()
+        readers, err := b.readers()
+        b.mutex.Unlock()
+        if err != nil { return err }
+        changed := false
+        for i := range states {
+            s := &states[i]
+            if s.CurrentState & pcsc.SCARD_STATE_IGNORE != 0 { continue }
+            state, atr := uint32(pcsc.SCARD_STATE_UNKNOWN), []byte(nil)
+            for j := range readers {
+                if readers[j].Name() == s.Reader {
+                    state, atr = readerState(&readers[j])
+                }
+            }
+            if state != s.CurrentState &^ pcsc.SCARD_STATE_CHANGED {
+                state |= pcsc.SCARD_STATE_CHANGED
+                changed = true
             }
+            s.EventState, s.ATR = state, atr
         }
-        if reader != nil {
-            break
+        if changed {
+            return nil
+        }
+        if timeout != INFINITE && !time.Now().Before(deadline) {
+            return pcsc.Error(pcsc.SCARD_E_TIMEOUT)
         }
         time.Sleep(250*time.Millisecond)
     }
-    return reader, nil
 }
 
-// Smart card reader. 
-// Note that physical card readers with slots for multiple cards are
-// represented by one Reader instance per slot.
-type Reader struct {
-    context *Context
-    reader pcsc.Reader
+func (b *pcscLiteBackend) Connect(ctx uintptr, reader string, shareMode,
+    protocols uint32) (uintptr, uint32, error) {
+    b.mutex.Lock()
+    defer b.mutex.Unlock()
+    card, protocol, err := b.client.CardConnectMode(uint32(ctx), reader,
+        shareMode, protocols)
+    if err != nil { return 0, 0, err }
+    b.cards[uintptr(card)] = pcscLiteCard{reader, ctx}
+    return uintptr(card), protocol, nil
 }
 
-// Return name of card reader.
-func (r *Reader) Name() string {
-    return r.reader.Name()
+func (b *pcscLiteBackend) Disconnect(card uintptr, disposition uint32) error {
+    b.mutex.Lock()
+    defer b.mutex.Unlock()
+    delete(b.cards, card)
+    return b.client.CardDisconnect(int32(card), disposition)
 }
 
-// Check if card is present.
-func (r *Reader) IsCardPresent() bool {
-    count, err := r.context.client.SyncReaders()
-    if err != nil {
-        return false
+func (b *pcscLiteBackend) Status(card uintptr) (CardStatus, error) {
+    b.mutex.Lock()
+    defer b.mutex.Unlock()
+    c, ok := b.cards[card]
+    if !ok {
+        return CardStatus{}, fmt.Errorf("can't get status: %s",
+            pcsc.Error(pcsc.SCARD_E_INVALID_HANDLE))
     }
-    readers := r.context.client.Readers()
-    for i := uint32(0); i < count; i++ {
-        if r.Name() == readers[i].Name() {
-            r.reader = readers[i]
-            if r.reader.IsCardPresent() {
-                return true
-            }
+    err := b.client.Status(int32(card))
+    if err != nil { return CardStatus{}, err }
+    readers, err := b.readers()
+    if err != nil { return CardStatus{}, err }
+    for i := range readers {
+        if readers[i].Name() == c.reader {
+            r := &readers[i]
+            return CardStatus{
+                Reader: c.reader,
+                State: r.ReaderState,
+                Protocol: r.CardProtocol,
+                ATR: append(ATR{}, r.CardAtr[:r.CardAtrLength]...),
+            }, nil
         }
     }
-    return false
-}
-
-func (r *Reader) WaitUntilCardRemoved() {
-    for r.IsCardPresent() {
-        time.Sleep(250*time.Millisecond)
-    }
+    return CardStatus{}, fmt.Errorf("can't get status: %s",
+        pcsc.Error(pcsc.SCARD_E_READER_UNAVAILABLE))
 }
 
-// Connect to card.
-func (r *Reader) Connect() (*Card, error) {
-    cardID, protocol, err := r.context.client.CardConnect(
-        r.context.ctxID, r.reader.Name())
+func (b *pcscLiteBackend) Transmit(card uintptr, protocol uint32,
+    command []byte) ([]byte, error) {
+    b.mutex.Lock()
+    defer b.mutex.Unlock()
+    response := make([]byte, 65538)
+    received, err := b.client.Transmit(int32(card), protocol, command,
+        response)
     if err != nil { return nil, err }
-    return &Card{
-        context: r.context,
-        cardID: cardID,
-        protocol: protocol,
-        atr: r.reader.CardAtr[:r.reader.CardAtrLength],
-    }, nil
+    return response[:received], nil
 }
 
-// Smart card.
-type Card struct {
-    context *Context
-    cardID int32
-    protocol uint32
-    atr ATR
+func (b *pcscLiteBackend) Control(card uintptr, code uint32,
+    data []byte) ([]byte, error) {
+    b.mutex.Lock()
+    defer b.mutex.Unlock()
+    response := make([]byte, 65538)
+    received, err := b.client.Control(int32(card), code, data, response)
+    if err != nil { return nil, err }
+    return response[:received], nil
 }
 
-// Return card ATR (answer to reset).
-func (c *Card) ATR() ATR {
-    return c.atr
+func (b *pcscLiteBackend) GetAttrib(card uintptr, attr uint32) ([]byte,
+    error) {
+    b.mutex.Lock()
+    defer b.mutex.Unlock()
+    return b.client.GetAttrib(int32(card), attr)
 }
 
-// Trasmit bytes to card and return response.
-func (c *Card) Transmit(command []byte) ([]byte, error) {
-    response := make([]byte, 258)
-    received, err := c.context.client.Transmit(c.cardID, c.protocol,
-        command, response)
-    if err != nil { return nil, err }
-    return response[:received], nil
+// Start transaction, waiting like libpcsclite while another application
+// holds one, until the card is disconnected or its context released.
+func (b *pcscLiteBackend) BeginTransaction(card uintptr) error {
+    for {
+        b.mutex.Lock()
+        err := error(pcsc.Error(pcsc.SCARD_E_INVALID_HANDLE))
+        if _, ok := b.cards[card]; ok {
+            err = b.client.TryBeginTransaction(int32(card))
+        }
+        b.mutex.Unlock()
+        if err != pcsc.Error(pcsc.SCARD_E_SHARING_VIOLATION) { return err }
+        time.Sleep(pcsc.LOCK_POLL_RATE)
+    }
 }
 
-// Disconnect from card.
-func (c *Card) Disconnect() error {
-    err := c.context.client.CardDisconnect(c.cardID)
-    if err != nil { return err }
-    return nil
+func (b *pcscLiteBackend) EndTransaction(card uintptr,
+    disposition uint32) error {
+    b.mutex.Lock()
+    defer b.mutex.Unlock()
+    return b.client.EndTransaction(int32(card), disposition)
 }
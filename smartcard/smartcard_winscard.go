@@ -4,199 +4,103 @@ package smartcard
 
 import (
     "fmt"
-    "time"
     "github.com/sf1/go-card/smartcard/pcsc"
 )
 
-// A smart card context is required to access readers and cards.
-type Context struct {
-    ctxID uintptr
-    winscard *pcsc.WinscardWrapper
-}
-
-// Establish smart card context.
-// This should be the first function to be called.
-func EstablishContext(scope ...uint32) (*Context, error) {
-    scp := uint32(SCOPE_SYSTEM)
-    if len(scope) > 0 {
-        scp = scope[0]
-    }
+// Return platform backend, loading winscard.dll.
+func DefaultBackend() (Backend, error) {
     winscard, err := pcsc.Winscard()
-    if err != nil {
-        return nil, err
-    }
-    ctxID, err := winscard.EstablishContext(scp)
     if err != nil { return nil, err }
-    return &Context{ctxID, winscard}, nil
+    return &winscardBackend{winscard}, nil
 }
 
-// Release resources associated with smart card context.
-func (ctx *Context) Release() error {
-    return ctx.winscard.ReleaseContext(ctx.ctxID)
+// Backend calling the WinSCard API.
+type winscardBackend struct {
+    winscard *pcsc.WinscardWrapper
 }
 
-// List all smart card readers.
-func (ctx *Context) ListReaders() ([]*Reader, error) {
-    readerNames, err := ctx.winscard.ListReaders(ctx.ctxID)
-    if err != nil { return nil, err }
-    readers := make([]*Reader, len(readerNames))
-    for i := 0; i < len(readerNames); i++ {
-        readers[i] = &Reader{context: ctx, name: readerNames[i]}
-    }
-    return readers, nil
+func (b *winscardBackend) EstablishContext(scope uint32) (uintptr, error) {
+    return b.winscard.EstablishContext(scope)
 }
 
-// List smart card readers with inserted cards.
-func (ctx *Context) ListReadersWithCard() ([]*Reader, error) {
-    states, err := ctx.winscard.GetStatusChangeAll(
-        ctx.ctxID, pcsc.SCARD_INFINITE, pcsc.SCARD_STATE_UNAWARE)
-    if err != nil { return nil, err }
-    readers := make([]*Reader, 0, len(states))
-    for _, state := range states {
-        if state.EventState & pcsc.SCARD_STATE_MUTE != 0 {
-            continue
-        }
-        if state.EventState & pcsc.SCARD_STATE_PRESENT != 0 {
-            readers = append(readers, &Reader{context: ctx, name: state.Reader})
-        }
-    }
-    return readers, nil
+func (b *winscardBackend) ReleaseContext(ctx uintptr) error {
+    return b.winscard.ReleaseContext(ctx)
 }
 
-// Block until a smart card is inserted into any reader.
-// Returns immediately if card already present.
-func (ctx *Context) WaitForCardPresent() (*Reader, error) {
-    var err error
-    var reader *Reader = nil
-    var states []pcsc.ReaderState
-    for reader == nil {
-        states, err = ctx.winscard.GetStatusChangeAll(
-            ctx.ctxID, pcsc.SCARD_INFINITE, pcsc.SCARD_STATE_UNAWARE)
-        if err != nil { return nil, err }
-        if states == nil {
-            time.Sleep(500*time.Millisecond)
-            continue
-        }
-        for _, state := range states {
-            state.CurrentState = state.EventState
-            if state.EventState & pcsc.SCARD_STATE_MUTE != 0 {
-                continue
-            }
-            if state.EventState & pcsc.SCARD_STATE_PRESENT != 0 {
-                reader = &Reader{context: ctx, name: state.Reader}
-                break
-            }
-        }
-        if reader == nil {
-            err = ctx.winscard.GetStatusChange(
-                ctx.ctxID, pcsc.SCARD_INFINITE, states,
-            )
-            if err != nil { return nil, err }
-            time.Sleep(500*time.Millisecond)
-        }
-    }
-    return reader, nil
+func (b *winscardBackend) ListReaders(ctx uintptr) ([]string, error) {
+    return b.winscard.ListReaders(ctx)
 }
 
-// Smart card reader. 
-// Note that physical card readers with slots for multiple cards are
-// represented by one Reader instance per slot.
-type Reader struct {
-    context *Context
-    name string
+func (b *winscardBackend) GetStatusChange(ctx uintptr, timeout uint32,
+    states []ReaderState) error {
+    if len(states) == 0 { return nil }
+    ws := make([]pcsc.ReaderState, len(states))
+    for i := range states {
+        ws[i].Reader = states[i].Reader
+        ws[i].CurrentState = states[i].CurrentState
+    }
+    err := b.winscard.GetStatusChange(ctx, timeout, ws)
+    if err != nil { return err }
+    for i := range states {
+        states[i].EventState = ws[i].EventState
+        states[i].ATR = append([]byte{}, ws[i].Atr[:ws[i].AtrLen]...)
+    }
+    return nil
 }
 
-// Return name of card reader.
-func (r *Reader) Name() string {
-    return r.name
+func (b *winscardBackend) Connect(ctx uintptr, reader string, shareMode,
+    protocols uint32) (uintptr, uint32, error) {
+    card, protocol, err := b.winscard.CardConnectMode(ctx, reader, shareMode,
+        protocols)
+    if err != nil { return 0, 0, err }
+    return card, uint32(protocol), nil
 }
 
-// Check if card is present.
-func (r *Reader) IsCardPresent() bool {
-    states := make([]pcsc.ReaderState, 1)
-    states[0].Reader = r.name
-    states[0].CurrentState = pcsc.SCARD_STATE_UNAWARE
-    err := r.context.winscard.GetStatusChange(r.context.ctxID,
-        pcsc.SCARD_INFINITE, states)
-    if err != nil {
-        return false
-    }
-    if states[0].EventState & pcsc.SCARD_STATE_MUTE != 0 {
-        return false
-    }
-    return states[0].EventState & pcsc.SCARD_STATE_PRESENT != 0
+func (b *winscardBackend) Disconnect(card uintptr, disposition uint32) error {
+    return b.winscard.CardDisconnect(card, disposition)
 }
 
-// Wait until card removed
-func (r *Reader) WaitUntilCardRemoved() {
-    states := make([]pcsc.ReaderState, 1)
-    for {
-        states[0].Reader = r.name
-        states[0].CurrentState = pcsc.SCARD_STATE_UNAWARE
-        err := r.context.winscard.GetStatusChange(r.context.ctxID,
-            pcsc.SCARD_INFINITE, states)
-        if err != nil {
-            return
-        }
-        if states[0].EventState & pcsc.SCARD_STATE_MUTE != 0 ||
-            states[0].EventState & pcsc.SCARD_STATE_PRESENT == 0 {
-                return
-        }
-        time.Sleep(500*time.Millisecond)
-    }
+func (b *winscardBackend) Status(card uintptr) (CardStatus, error) {
+    reader, state, protocol, atr, err := b.winscard.Status(card)
+    if err != nil { return CardStatus{}, err }
+    return CardStatus{reader, state, protocol, atr}, nil
 }
 
-
-// Connect to card.
-func (r *Reader) Connect() (*Card, error) {
+func (b *winscardBackend) Transmit(card uintptr, protocol uint32,
+    command []byte) ([]byte, error) {
     var pci uintptr
-    cardID, protocol, err := r.context.winscard.CardConnect(
-        r.context.ctxID, r.name)
-    if err != nil { return nil, err }
-    switch(protocol) {
+    switch protocol {
         case pcsc.SCARD_PROTOCOL_T0:
-            pci = r.context.winscard.T0PCI()
+            pci = b.winscard.T0PCI()
         case pcsc.SCARD_PROTOCOL_T1:
-            pci = r.context.winscard.T1PCI()
+            pci = b.winscard.T1PCI()
         default:
             return nil, fmt.Errorf("Unknown protocol: %08x", protocol)
     }
-    return &Card{
-        context:r.context, 
-        cardID: cardID,
-        sendPCI: pci, 
-    }, nil
+    response := make([]byte, 65538)
+    received, err := b.winscard.Transmit(card, pci, command, response)
+    if err != nil { return nil, err }
+    return response[:received], nil
 }
 
-// Smart card.
-type Card struct {
-    context *Context
-    cardID uintptr
-    sendPCI uintptr
-    atr ATR
+func (b *winscardBackend) Control(card uintptr, code uint32,
+    data []byte) ([]byte, error) {
+    response := make([]byte, 65538)
+    received, err := b.winscard.Control(card, code, data, response)
+    if err != nil { return nil, err }
+    return response[:received], nil
 }
 
-// Disconnect from card.
-func (c *Card) Disconnect() error {
-    err := c.context.winscard.CardDisconnect(c.cardID)
-    if err != nil { return err }
-    return nil
+func (b *winscardBackend) GetAttrib(card uintptr, attr uint32) ([]byte,
+    error) {
+    return b.winscard.GetAttrib(card, attr)
 }
 
-// Return card ATR (answer to reset).
-func (c *Card) ATR() ATR {
-    var err error
-    if c.atr != nil { return c.atr }
-    c.atr, err = c.context.winscard.GetAttrib(c.cardID, pcsc.SCARD_ATTR_ATR_STRING)
-    if err != nil { return nil }
-    return c.atr
+func (b *winscardBackend) BeginTransaction(card uintptr) error {
+    return b.winscard.BeginTransaction(card)
 }
 
-// Trasmit bytes to card and return response.
-func (c *Card) Transmit(command []byte) ([]byte, error) {
-    response := make([]byte, 258)
-    received, err := c.context.winscard.Transmit(c.cardID, c.sendPCI,
-        command, response)
-    if err != nil { return nil, err }
-    return response[:received], nil
+func (b *winscardBackend) EndTransaction(card uintptr,
+    disposition uint32) error {
+    return b.winscard.EndTransaction(card, disposition)
 }
@@ -0,0 +1,230 @@
+/*
+Package tlv implements encoding and decoding of BER-TLV data objects as used
+by ISO 7816-4 and the application specifications built upon it.
+*/
+package tlv
+
+import (
+    "bytes"
+    "fmt"
+)
+
+// BER-TLV tag. Multi-byte tags are stored big endian, e.g. 0x9f36.
+type Tag uint32
+
+// Return the tag bytes.
+func (t Tag) Bytes() []byte {
+    switch {
+        case t > 0xffffff:
+            return []byte{byte(t >> 24), byte(t >> 16), byte(t >> 8), byte(t)}
+        case t > 0xffff:
+            return []byte{byte(t >> 16), byte(t >> 8), byte(t)}
+        case t > 0xff:
+            return []byte{byte(t >> 8), byte(t)}
+    }
+    return []byte{byte(t)}
+}
+
+// Check if tag denotes a constructed data object.
+func (t Tag) Constructed() bool {
+    return t.Bytes()[0] & 0x20 != 0
+}
+
+// Return string form of tag.
+func (t Tag) String() string {
+    return fmt.Sprintf("%X", t.Bytes())
+}
+
+// BER-TLV data object.
+type TLV struct {
+    Tag Tag
+    Value []byte
+}
+
+// List of data objects.
+type List []TLV
+
+// Create data object.
+func New(tag Tag, value []byte) TLV {
+    return TLV{Tag: tag, Value: value}
+}
+
+// Create constructed data object from children.
+func NewConstructed(tag Tag, children ...TLV) TLV {
+    var buffer bytes.Buffer
+    for _, c := range children {
+        buffer.Write(c.Bytes())
+    }
+    return TLV{Tag: tag, Value: buffer.Bytes()}
+}
+
+// Return encoded data object.
+func (t TLV) Bytes() []byte {
+    return Encode(t.Tag, t.Value)
+}
+
+// Parse children of constructed data object.
+func (t TLV) Children() (List, error) {
+    return Parse(t.Value)
+}
+
+// Return string form of data object.
+func (t TLV) String() string {
+    return fmt.Sprintf("%s: %X", t.Tag, t.Value)
+}
+
+// Encode data object.
+func Encode(tag Tag, value []byte) []byte {
+    out := tag.Bytes()
+    out = append(out, EncodeLength(len(value))...)
+    return append(out, value...)
+}
+
+// Encode length field.
+func EncodeLength(length int) []byte {
+    switch {
+        case length < 0x80:
+            return []byte{byte(length)}
+        case length <= 0xff:
+            return []byte{0x81, byte(length)}
+        case length <= 0xffff:
+            return []byte{0x82, byte(length >> 8), byte(length)}
+        case length <= 0xffffff:
+            return []byte{0x83, byte(length >> 16), byte(length >> 8),
+                byte(length)}
+    }
+    return []byte{0x84, byte(length >> 24), byte(length >> 16),
+        byte(length >> 8), byte(length)}
+}
+
+// Parse tag at the start of data.
+func ParseTag(data []byte) (Tag, []byte, error) {
+    if len(data) == 0 {
+        return 0, nil, fmt.Errorf("missing tag")
+    }
+    tag := Tag(data[0])
+    i := 1
+    if data[0] & 0x1f == 0x1f {
+        for {
+            if i >= len(data) || i > 3 {
+                return 0, nil, fmt.Errorf("invalid tag")
+            }
+            tag = tag << 8 | Tag(data[i])
+            i++
+            if data[i-1] & 0x80 == 0 {
+                break
+            }
+        }
+    }
+    return tag, data[i:], nil
+}
+
+// Parse length field at the start of data.
+func ParseLength(data []byte) (int, []byte, error) {
+    if len(data) == 0 {
+        return 0, nil, fmt.Errorf("missing length")
+    }
+    if data[0] < 0x80 {
+        return int(data[0]), data[1:], nil
+    }
+    n := int(data[0] & 0x7f)
+    if n == 0 || n > 4 || len(data) < n + 1 {
+        return 0, nil, fmt.Errorf("invalid length")
+    }
+    length := 0
+    for i := 1; i <= n; i++ {
+        length = length << 8 | int(data[i])
+    }
+    if length < 0 {
+        return 0, nil, fmt.Errorf("invalid length")
+    }
+    return length, data[n+1:], nil
+}
+
+// Parse the first data object in data and return it along with the
+// remaining bytes.
+func ParseOne(data []byte) (TLV, []byte, error) {
+    tag, rest, err := ParseTag(data)
+    if err != nil { return TLV{}, nil, err }
+    length, rest, err := ParseLength(rest)
+    if err != nil { return TLV{}, nil, err }
+    if length > len(rest) {
+        return TLV{}, nil, fmt.Errorf("data object %s truncated", tag)
+    }
+    return TLV{Tag: tag, Value: rest[:length]}, rest[length:], nil
+}
+
+// Parse sequence of data objects. Padding bytes (00 or FF) between data
+// objects are skipped.
+func Parse(data []byte) (List, error) {
+    var list List
+    for len(data) > 0 {
+        if data[0] == 0x00 || data[0] == 0xff {
+            data = data[1:]
+            continue
+        }
+        t, rest, err := ParseOne(data)
+        if err != nil { return nil, err }
+        list = append(list, t)
+        data = rest
+    }
+    return list, nil
+}
+
+// Find first data object with tag.
+func (l List) Find(tag Tag) (TLV, bool) {
+    for _, t := range l {
+        if t.Tag == tag {
+            return t, true
+        }
+    }
+    return TLV{}, false
+}
+
+// Find all data objects with tag.
+func (l List) FindAll(tag Tag) List {
+    var result List
+    for _, t := range l {
+        if t.Tag == tag {
+            result = append(result, t)
+        }
+    }
+    return result
+}
+
+// Return value of first data object with tag, nil if not present.
+func (l List) Value(tag Tag) []byte {
+    t, ok := l.Find(tag)
+    if !ok {
+        return nil
+    }
+    return t.Value
+}
+
+// Find first data object with tag, descending into constructed objects.
+func (l List) Search(tag Tag) (TLV, bool) {
+    for _, t := range l {
+        if t.Tag == tag {
+            return t, true
+        }
+        if t.Tag.Constructed() {
+            children, err := t.Children()
+            if err != nil {
+                continue
+            }
+            if found, ok := children.Search(tag); ok {
+                return found, true
+            }
+        }
+    }
+    return TLV{}, false
+}
+
+// Return encoded list.
+func (l List) Bytes() []byte {
+    var buffer bytes.Buffer
+    for _, t := range l {
+        buffer.Write(t.Bytes())
+    }
+    return buffer.Bytes()
+}
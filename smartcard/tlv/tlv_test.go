@@ -0,0 +1,64 @@
+package tlv
+
+import (
+    "bytes"
+    "encoding/hex"
+    "testing"
+)
+
+func unhex(s string) []byte {
+    b, err := hex.DecodeString(s)
+    if err != nil { panic(err) }
+    return b
+}
+
+func TestParse(t *testing.T) {
+    data := unhex("6f1a840e315041592e5359532e4444463031a5088801025f2d02656e" +
+        "9f3602001a")
+    list, err := Parse(data)
+    if err != nil { t.Error(err); return }
+    if len(list) != 2 {
+        t.Errorf("expected 2 objects, got %d", len(list))
+        return
+    }
+    if list[1].Tag != 0x9f36 || !bytes.Equal(list[1].Value, unhex("001a")) {
+        t.Errorf("unexpected object %s", list[1])
+    }
+    fci, ok := list.Find(0x6f)
+    if !ok || !fci.Tag.Constructed() {
+        t.Errorf("6F not found or not constructed")
+        return
+    }
+    lang, ok := list.Search(0x5f2d)
+    if !ok || string(lang.Value) != "en" {
+        t.Errorf("5F2D not found: %s", lang)
+    }
+    if !bytes.Equal(list.Bytes(), data) {
+        t.Errorf("re-encoding mismatch")
+    }
+}
+
+func TestLength(t *testing.T) {
+    for _, n := range []int{0, 0x7f, 0x80, 0xff, 0x100, 0xffff, 0x10000} {
+        enc := EncodeLength(n)
+        length, rest, err := ParseLength(enc)
+        if err != nil || length != n || len(rest) != 0 {
+            t.Errorf("length %d: got %d, %v", n, length, err)
+        }
+    }
+    _, _, err := ParseOne(unhex("5a0812"))
+    if err == nil {
+        t.Errorf("truncated object accepted")
+    }
+}
+
+func TestConstructed(t *testing.T) {
+    obj := NewConstructed(0x7f49, New(0x86, []byte{1, 2}), New(0x81, nil))
+    if !bytes.Equal(obj.Bytes(), unhex("7f4906860201028100")) {
+        t.Errorf("unexpected encoding %X", obj.Bytes())
+    }
+    children, err := obj.Children()
+    if err != nil || len(children) != 2 {
+        t.Errorf("unexpected children %v, %v", children, err)
+    }
+}
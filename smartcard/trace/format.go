@@ -0,0 +1,293 @@
+package trace
+
+import (
+    "bufio"
+    "bytes"
+    "encoding/hex"
+    "encoding/json"
+    "fmt"
+    "io"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+    "github.com/sf1/go-card/smartcard"
+)
+
+// JSON form of an entry. Binary fields are hex strings, the duration is in
+// microseconds.
+type jsonEntry struct {
+    Time string `json:"time"`
+    Duration int64 `json:"duration_us"`
+    Reader string `json:"reader"`
+    ATR string `json:"atr"`
+    Command string `json:"command"`
+    Response string `json:"response"`
+    Err string `json:"error,omitempty"`
+}
+
+type jsonWriter struct {
+    mutex sync.Mutex
+    w io.Writer
+}
+
+// Create writer of entries as JSON lines, e.g.
+//
+//     {"time":"2024-01-01T12:00:00.000001Z","duration_us":1200,
+//      "reader":"Virtual Reader 00","atr":"3b80800101",
+//      "command":"00a4040000","response":"9000"}
+//
+// (one line per entry).
+func NewJSONWriter(w io.Writer) EntryWriter {
+    return &jsonWriter{w: w}
+}
+
+func (w *jsonWriter) WriteEntry(e *Entry) error {
+    data, err := json.Marshal(&jsonEntry{
+        Time: e.Time.UTC().Format(time.RFC3339Nano),
+        Duration: int64(e.Duration / time.Microsecond),
+        Reader: e.Reader,
+        ATR: hex.EncodeToString(e.ATR),
+        Command: hex.EncodeToString(e.Command),
+        Response: hex.EncodeToString(e.Response),
+        Err: e.Err,
+    })
+    if err != nil { return err }
+    w.mutex.Lock()
+    defer w.mutex.Unlock()
+    _, err = w.w.Write(append(data, '\n'))
+    return err
+}
+
+// Read entries from JSON lines.
+func ReadJSON(r io.Reader) ([]Entry, error) {
+    var entries []Entry
+    scanner := bufio.NewScanner(r)
+    scanner.Buffer(nil, 1 << 20)
+    for n := 1; scanner.Scan(); n++ {
+        line := bytes.TrimSpace(scanner.Bytes())
+        if len(line) == 0 { continue }
+        var j jsonEntry
+        if err := json.Unmarshal(line, &j); err != nil {
+            return nil, fmt.Errorf("trace: line %d: %s", n, err)
+        }
+        e := Entry{
+            Duration: time.Duration(j.Duration) * time.Microsecond,
+            Reader: j.Reader,
+            Err: j.Err,
+        }
+        var err error
+        if j.Time != "" {
+            e.Time, err = time.Parse(time.RFC3339Nano, j.Time)
+        }
+        if err == nil { e.ATR, err = hex.DecodeString(j.ATR) }
+        if err == nil { e.Command, err = hex.DecodeString(j.Command) }
+        if err == nil { e.Response, err = hex.DecodeString(j.Response) }
+        if err != nil {
+            return nil, fmt.Errorf("trace: line %d: %s", n, err)
+        }
+        entries = append(entries, e)
+    }
+    if err := scanner.Err(); err != nil { return nil, err }
+    return entries, nil
+}
+
+type spyWriter struct {
+    mutex sync.Mutex
+    w io.Writer
+    reader string
+    atr smartcard.ATR
+    started bool
+}
+
+// Create writer of entries in the text format of pcsc-spy. Each exchange
+// is an SCardTransmit call, preceded by an SCardStatus call with reader
+// name and ATR whenever they change. Times are not kept, only durations.
+func NewSpyWriter(w io.Writer) EntryWriter {
+    return &spyWriter{w: w}
+}
+
+// Append hex dump of data in pcsc-spy layout to buffer.
+func spyDump(buffer *bytes.Buffer, dir string, data []byte) {
+    for offset := 0; offset < len(data); offset += 16 {
+        line := data[offset:]
+        if len(line) > 16 { line = line[:16] }
+        buffer.WriteString(fmt.Sprintf(" %s     %04X", dir, offset))
+        for _, b := range line {
+            buffer.WriteString(fmt.Sprintf(" %02X", b))
+        }
+        buffer.WriteString(" ")
+        for _, b := range line {
+            buffer.WriteByte(printable(b))
+        }
+        buffer.WriteString("\n")
+    }
+}
+
+// Return pcsc-spy result line.
+func spyResult(msg string, rv uint32, d time.Duration) string {
+    return fmt.Sprintf(" => %s [0x%08X]  [%.6f]\n", msg, rv, d.Seconds())
+}
+
+func (w *spyWriter) WriteEntry(e *Entry) error {
+    var buffer bytes.Buffer
+    w.mutex.Lock()
+    defer w.mutex.Unlock()
+    if !w.started || e.Reader != w.reader || !bytes.Equal(e.ATR, w.atr) {
+        buffer.WriteString("SCardStatus\n")
+        buffer.WriteString(fmt.Sprintf(" o szReaderName: %s\n", e.Reader))
+        buffer.WriteString(" o pbAtr\n")
+        spyDump(&buffer, "o", e.ATR)
+        buffer.WriteString(spyResult("Command successful", 0, 0))
+        w.started, w.reader, w.atr = true, e.Reader, e.ATR
+    }
+    buffer.WriteString("SCardTransmit\n")
+    buffer.WriteString(" i pbSendBuffer\n")
+    spyDump(&buffer, "i", e.Command)
+    buffer.WriteString(" o pbRecvBuffer\n")
+    spyDump(&buffer, "o", e.Response)
+    if e.Err == "" {
+        buffer.WriteString(spyResult("Command successful", 0, e.Duration))
+    } else {
+        buffer.WriteString(spyResult(e.Err, 0x80100013, e.Duration))
+    }
+    _, err := w.w.Write(buffer.Bytes())
+    return err
+}
+
+// Return character for b in the ASCII column of hex dumps.
+func printable(b byte) byte {
+    if b < 0x20 || b > 0x7e { return '.' }
+    return b
+}
+
+// Parse hex dump line (after the direction) of pcsc-spy. The dump is
+// followed by an ASCII column of the same number of characters, which
+// tells where the hex bytes end. Trailing spaces may be missing.
+func spyParseDump(line string) ([]byte, bool) {
+    line = strings.TrimLeft(line, " ")
+    if len(line) < 7 || line[4] != ' ' { return nil, false }
+    if _, err := strconv.ParseUint(line[:4], 16, 16); err != nil {
+        return nil, false
+    }
+    rest := line[5:]
+    next:
+    for n := 16; n > 0; n-- {
+        if len(rest) < 3*n - 1 || len(rest) > 4*n { continue }
+        data := make([]byte, n)
+        for i := range data {
+            if i > 0 && rest[3*i-1] != ' ' { continue next }
+            b, err := strconv.ParseUint(rest[3*i:3*i+2], 16, 8)
+            if err != nil { continue next }
+            data[i] = byte(b)
+        }
+        ascii := ""
+        if len(rest) > 3*n - 1 {
+            if rest[3*n-1] != ' ' { continue }
+            ascii = rest[3*n:]
+        }
+        for i, b := range data {
+            if i < len(ascii) && ascii[i] != printable(b) ||
+                i >= len(ascii) && len(ascii) > 0 && b != ' ' {
+                continue next
+            }
+        }
+        return data, true
+    }
+    return nil, false
+}
+
+// Read entries from pcsc-spy output. Calls other than SCardStatus and
+// SCardTransmit are skipped.
+func ReadSpy(r io.Reader) ([]Entry, error) {
+    var entries []Entry
+    var reader string
+    var atr smartcard.ATR
+    var call string
+    var field *[]byte
+    var e Entry
+    scanner := bufio.NewScanner(r)
+    for n := 1; scanner.Scan(); n++ {
+        line := strings.TrimRight(scanner.Text(), " \r")
+        switch {
+            case line == "":
+                continue
+            case line[0] != ' ':
+                // pcsc-spy prefixes calls with the thread
+                fields := strings.Fields(line)
+                call, field, e = fields[len(fields)-1], nil, Entry{}
+                continue
+            case call != "SCardStatus" && call != "SCardTransmit":
+                continue
+        }
+        body := strings.TrimLeft(line, " ")
+        switch {
+            case strings.HasPrefix(body, "=> "):
+                rv, d, msg, err := spyParseResult(body[3:])
+                if err != nil {
+                    return nil, fmt.Errorf("trace: line %d: %s", n, err)
+                }
+                if call == "SCardStatus" {
+                    reader, atr = e.Reader, e.ATR
+                } else {
+                    e.Reader, e.ATR, e.Duration = reader, atr, d
+                    if rv != 0 { e.Err = msg }
+                    entries = append(entries, e)
+                }
+                call = ""
+            case len(body) < 2 || body[1] != ' ':
+                continue
+            case strings.HasPrefix(body[2:], "szReaderName: "):
+                e.Reader = body[len("o szReaderName: "):]
+            case body[2:] == "pbAtr":
+                e.ATR, field = smartcard.ATR{}, (*[]byte)(&e.ATR)
+            case body[2:] == "pbSendBuffer":
+                e.Command, field = []byte{}, &e.Command
+            case body[2:] == "pbRecvBuffer":
+                e.Response, field = []byte{}, &e.Response
+            default:
+                if data, ok := spyParseDump(body[2:]); ok && field != nil {
+                    *field = append(*field, data...)
+                } else {
+                    field = nil
+                }
+        }
+    }
+    if err := scanner.Err(); err != nil { return nil, err }
+    return entries, nil
+}
+
+// Parse pcsc-spy result line "message [0xrv]  [duration]".
+func spyParseResult(s string) (uint32, time.Duration, string, error) {
+    i := strings.LastIndex(s, "[0x")
+    if i < 0 || len(s) < i + 12 || s[i+11] != ']' {
+        return 0, 0, "", fmt.Errorf("invalid result %q", s)
+    }
+    rv, err := strconv.ParseUint(s[i+3:i+11], 16, 32)
+    if err != nil { return 0, 0, "", fmt.Errorf("invalid result %q", s) }
+    var d time.Duration
+    rest := strings.TrimSpace(s[i+12:])
+    if strings.HasPrefix(rest, "[") && strings.HasSuffix(rest, "]") {
+        secs, err := strconv.ParseFloat(rest[1:len(rest)-1], 64)
+        if err == nil { d = time.Duration(secs * float64(time.Second)) }
+    }
+    return uint32(rv), d, strings.TrimSpace(s[:i]), nil
+}
+
+// Read entries from JSON lines or pcsc-spy output.
+func Read(r io.Reader) ([]Entry, error) {
+    br := bufio.NewReader(r)
+    for {
+        b, err := br.Peek(1)
+        if err == io.EOF { return nil, nil }
+        if err != nil { return nil, err }
+        switch b[0] {
+            case ' ', '\t', '\r', '\n':
+                br.ReadByte()
+                continue
+            case '{':
+                return ReadJSON(br)
+        }
+        return ReadSpy(br)
+    }
+}
@@ -0,0 +1,84 @@
+package trace
+
+import (
+    "bytes"
+    "fmt"
+    "sync"
+    "github.com/sf1/go-card/smartcard"
+)
+
+// Card replaying recorded entries. Commands must be those recorded, in
+// order; the first divergence fails this and all following exchanges.
+// Replay implements smartcard.Transmitter and can be used as handler of a
+// mock card.
+type Replay struct {
+    mutex sync.Mutex
+    entries []Entry
+    pos int
+    err error
+}
+
+// Create replay of entries.
+func NewReplay(entries []Entry) *Replay {
+    return &Replay{entries: entries}
+}
+
+// Return reader name of the first entry.
+func (r *Replay) Reader() string {
+    if len(r.entries) == 0 { return "" }
+    return r.entries[0].Reader
+}
+
+// Return ATR of the first entry.
+func (r *Replay) ATR() smartcard.ATR {
+    if len(r.entries) == 0 { return nil }
+    return r.entries[0].ATR
+}
+
+// Return recorded response to cmd, or recorded error.
+func (r *Replay) Transmit(cmd []byte) ([]byte, error) {
+    r.mutex.Lock()
+    defer r.mutex.Unlock()
+    if r.err != nil { return nil, r.err }
+    if r.pos == len(r.entries) {
+        r.err = fmt.Errorf("trace: command %X after end of recording", cmd)
+        return nil, r.err
+    }
+    e := &r.entries[r.pos]
+    if !bytes.Equal(cmd, e.Command) {
+        r.err = fmt.Errorf("trace: command %X diverges from recorded %X " +
+            "(exchange %d)", cmd, e.Command, r.pos + 1)
+        return nil, r.err
+    }
+    r.pos++
+    if e.Err != "" { return nil, fmt.Errorf("%s", e.Err) }
+    return append([]byte{}, e.Response...), nil
+}
+
+// Return recorded response to command APDU, or recorded error.
+func (r *Replay) TransmitAPDU(cmd smartcard.CommandAPDU) (
+    smartcard.ResponseAPDU, error) {
+    rsp, err := r.Transmit(cmd)
+    if err != nil { return nil, err }
+    return smartcard.Response(rsp)
+}
+
+// Return number of replayed entries.
+func (r *Replay) Position() int {
+    r.mutex.Lock()
+    defer r.mutex.Unlock()
+    return r.pos
+}
+
+// Return error if a command diverged or recorded entries were not
+// replayed.
+func (r *Replay) Verify() error {
+    r.mutex.Lock()
+    defer r.mutex.Unlock()
+    if r.err != nil { return r.err }
+    if r.pos < len(r.entries) {
+        return fmt.Errorf("trace: %d of %d recorded exchanges not replayed",
+            len(r.entries) - r.pos, len(r.entries))
+    }
+    return nil
+}
@@ -0,0 +1,139 @@
+/*
+Package trace records APDU exchanges with smart cards and replays them, so
+that code depending on rare card models can be tested without the cards.
+
+A Recorder wraps a Transmitter, Record a connected Card, and every command
+and response is written with timestamp, reader name and ATR to an
+EntryWriter: JSON lines (NewJSONWriter) or the text format of pcsc-spy
+(NewSpyWriter). A Replay serves the recorded responses in order and fails
+as soon as a command diverges from the recording.
+
+Example:
+
+    f, err := os.Create("session.jsonl")
+    // handle error, if any
+    card, err := trace.Record(card, trace.NewJSONWriter(f))
+    // use card as usual
+
+Replaying in a test:
+
+    f, err := os.Open("testdata/session.jsonl")
+    // handle error, if any
+    entries, err := trace.Read(f)
+    // handle error, if any
+    replay := trace.NewReplay(entries)
+    // run code under test with replay, or behind a virtual reader:
+    // backend.AddReader(replay.Reader()).Insert(
+    //     mock.NewCard(replay.ATR()).Handle(replay))
+    if err := replay.Verify(); err != nil {
+        t.Error(err)
+    }
+*/
+package trace
+
+import (
+    "sync"
+    "time"
+    "github.com/sf1/go-card/smartcard"
+)
+
+// Recorded command and response. Err is the error message if the exchange
+// failed.
+type Entry struct {
+    Time time.Time
+    Duration time.Duration
+    Reader string
+    ATR smartcard.ATR
+    Command []byte
+    Response []byte
+    Err string
+}
+
+// Destination of recorded entries.
+type EntryWriter interface {
+    WriteEntry(e *Entry) error
+}
+
+// Transmitter recording all exchanges.
+type Recorder struct {
+    mutex sync.Mutex
+    transmit func(cmd []byte) ([]byte, error)
+    reader string
+    atr smartcard.ATR
+    w EntryWriter
+    err error
+}
+
+// Create recorder for exchanges with t, logged with reader name and ATR.
+func NewRecorder(t smartcard.Transmitter, reader string, atr smartcard.ATR,
+    w EntryWriter) *Recorder {
+    return newRecorder(func(cmd []byte) ([]byte, error) {
+        return t.TransmitAPDU(cmd)
+    }, reader, atr, w)
+}
+
+func newRecorder(transmit func(cmd []byte) ([]byte, error), reader string,
+    atr smartcard.ATR, w EntryWriter) *Recorder {
+    return &Recorder{transmit: transmit, reader: reader, atr: atr, w: w}
+}
+
+// Transmit command and record it with the response.
+func (r *Recorder) Transmit(cmd []byte) ([]byte, error) {
+    e := &Entry{
+        Time: time.Now(),
+        Reader: r.reader,
+        ATR: r.atr,
+        Command: append([]byte{}, cmd...),
+    }
+    rsp, err := r.transmit(cmd)
+    e.Duration = time.Since(e.Time)
+    e.Response = append([]byte{}, rsp...)
+    if err != nil { e.Err = err.Error() }
+    r.mutex.Lock()
+    if werr := r.w.WriteEntry(e); werr != nil && r.err == nil {
+        r.err = werr
+    }
+    r.mutex.Unlock()
+    return rsp, err
+}
+
+// Transmit command APDU and record it with the response.
+func (r *Recorder) TransmitAPDU(cmd smartcard.CommandAPDU) (
+    smartcard.ResponseAPDU, error) {
+    rsp, err := r.Transmit(cmd)
+    if err != nil { return nil, err }
+    return smartcard.Response(rsp)
+}
+
+// Return first error writing an entry. Write errors do not fail exchanges.
+func (r *Recorder) Err() error {
+    r.mutex.Lock()
+    defer r.mutex.Unlock()
+    return r.err
+}
+
+// Card recording its exchanges. Other methods are those of the wrapped
+// card.
+type Card struct {
+    *smartcard.Card
+    *Recorder
+}
+
+// Record exchanges with card to w.
+func Record(card *smartcard.Card, w EntryWriter) (*Card, error) {
+    status, err := card.Status()
+    if err != nil { return nil, err }
+    return &Card{card, newRecorder(card.Transmit, status.Reader, card.ATR(),
+        w)}, nil
+}
+
+// Transmit command and record it with the response.
+func (c *Card) Transmit(cmd []byte) ([]byte, error) {
+    return c.Recorder.Transmit(cmd)
+}
+
+// Transmit command APDU and record it with the response.
+func (c *Card) TransmitAPDU(cmd smartcard.CommandAPDU) (
+    smartcard.ResponseAPDU, error) {
+    return c.Recorder.TransmitAPDU(cmd)
+}
@@ -0,0 +1,151 @@
+package trace
+
+import (
+    "bytes"
+    "reflect"
+    "strings"
+    "testing"
+    "github.com/sf1/go-card/smartcard"
+    "github.com/sf1/go-card/smartcard/mock"
+)
+
+// Writer to several entry writers.
+type tee []EntryWriter
+
+func (t tee) WriteEntry(e *Entry) error {
+    for _, w := range t {
+        if err := w.WriteEntry(e); err != nil { return err }
+    }
+    return nil
+}
+
+var commands = []string{
+    "00 a4 04 00 07 a0 00 00 02 47 10 01",
+    "00 b0 00 00 00",
+    "00 b2 01 0c 00",
+}
+
+func record(t *testing.T, w EntryWriter) {
+    t.Helper()
+    card := mock.NewCard(mock.Hex("3b 80 80 01 01")).
+        Expect(commands[0], "90 00").
+        Rule("00 b0 *", strings.Repeat("20 41 ", 12) + "00 90 00")
+    backend := mock.NewBackend()
+    backend.AddReader("Virtual Reader 00").Insert(card)
+    ctx, err := smartcard.EstablishContextWithBackend(backend)
+    if err != nil { t.Fatal(err) }
+    defer ctx.Release()
+    readers, _ := ctx.ListReaders()
+    c, err := readers[0].Connect()
+    if err != nil { t.Fatal(err) }
+    defer c.Disconnect()
+    rc, err := Record(c, w)
+    if err != nil { t.Fatal(err) }
+    for i, cmd := range commands {
+        _, err := rc.TransmitAPDU(mock.Hex(cmd))
+        if (err != nil) != (i == 2) { t.Errorf("unexpected error %v", err) }
+    }
+    if err := rc.Err(); err != nil { t.Error(err) }
+}
+
+func TestRecordReplay(t *testing.T) {
+    var jsonl, spy bytes.Buffer
+    record(t, tee{NewJSONWriter(&jsonl), NewSpyWriter(&spy)})
+    entries, err := Read(&jsonl)
+    if err != nil { t.Fatal(err) }
+    if len(entries) != 3 { t.Fatalf("unexpected %d entries", len(entries)) }
+    for i, e := range entries {
+        if e.Time.IsZero() || e.Reader != "Virtual Reader 00" ||
+            !bytes.Equal(e.ATR, mock.Hex("3b 80 80 01 01")) ||
+            !bytes.Equal(e.Command, mock.Hex(commands[i])) {
+            t.Errorf("unexpected entry %+v", e)
+        }
+    }
+    if len(entries[1].Response) != 27 || entries[2].Err == "" {
+        t.Errorf("unexpected entries %+v", entries)
+    }
+    spyEntries, err := Read(&spy)
+    if err != nil { t.Fatal(err) }
+    for i := range entries {
+        entries[i].Time = spyEntries[i].Time
+        entries[i].Duration = spyEntries[i].Duration
+    }
+    if !reflect.DeepEqual(entries, spyEntries) {
+        t.Errorf("pcsc-spy entries %+v differ from %+v", spyEntries, entries)
+    }
+    // Replay
+    replay := NewReplay(entries)
+    if replay.Reader() != "Virtual Reader 00" { t.Error("unexpected reader") }
+    for i, cmd := range commands {
+        rsp, err := replay.TransmitAPDU(mock.Hex(cmd))
+        if i < 2 && (err != nil || !bytes.Equal(rsp, entries[i].Response)) ||
+            i == 2 && (err == nil || err.Error() != entries[2].Err) {
+            t.Errorf("unexpected response %s, %v", rsp, err)
+        }
+    }
+    if err := replay.Verify(); err != nil { t.Error(err) }
+    // Divergence
+    replay = NewReplay(entries)
+    if _, err := replay.Transmit(mock.Hex(commands[1])); err == nil ||
+        !strings.Contains(err.Error(), "diverges") {
+        t.Errorf("divergence not detected: %v", err)
+    }
+    if _, err := replay.Transmit(mock.Hex(commands[0])); err == nil {
+        t.Error("replay continued after divergence")
+    }
+    if err := replay.Verify(); err == nil { t.Error("divergence not reported") }
+    replay = NewReplay(entries[:1])
+    replay.Transmit(mock.Hex(commands[0]))
+    if _, err := replay.Transmit(mock.Hex(commands[0])); err == nil {
+        t.Error("replay continued after end")
+    }
+    if err := NewReplay(entries).Verify(); err == nil {
+        t.Error("pending entries not reported")
+    }
+}
+
+func TestReadSpy(t *testing.T) {
+    log := `
+SCardEstablishContext
+ i dwScope: SCARD_SCOPE_USER (0x00000000)
+ o hContext: 0x1234
+ => Command successful (SCARD_S_SUCCESS) [0x00000000]  [0.000085]
+[7F1A] SCardStatus
+ i hCard: 0x5678
+ o szReaderName: Gemalto PC Twin Reader 00 00
+ o pbAtr
+ o     0000 3B 8F 80 01 80 4F 0C A0 00 00 03 06 03 00 03 00 ;....O..........
+ o     0010 00 00 00 00 68 ....h
+ => Command successful (SCARD_S_SUCCESS) [0x00000000]  [0.000051]
+[7F1A] SCardTransmit
+ i hCard: 0x5678
+ i pioSendPci
+ i    dwProtocol: 2, cbPciLength: 8
+ i pbSendBuffer
+ i     0000 FF CA 00 00 00 .....
+ i cbSendLength: 5
+ o pbRecvBuffer
+ o     0000 04 20 41 20 90 00 . A ..
+ o pcbRecvLength: 6
+ => Command successful (SCARD_S_SUCCESS) [0x00000000]  [0.012500]
+[7F1A] SCardTransmit
+ i pbSendBuffer
+ i     0000 30 31 41 42 01AB
+ o pbRecvBuffer
+ => Card was removed. (SCARD_W_REMOVED_CARD) [0x80100069]  [0.000100]
+`
+    entries, err := Read(strings.NewReader(log))
+    if err != nil { t.Fatal(err) }
+    atr := mock.Hex("3b 8f 80 01 80 4f 0c a0 00 00 03 06 03 00 03 00 00 00 " +
+        "00 00 68")
+    if len(entries) != 2 ||
+        entries[0].Reader != "Gemalto PC Twin Reader 00 00" ||
+        !bytes.Equal(entries[0].ATR, atr) ||
+        !bytes.Equal(entries[0].Command, mock.Hex("ff ca 00 00 00")) ||
+        !bytes.Equal(entries[0].Response, mock.Hex("04 20 41 20 90 00")) ||
+        entries[0].Duration.Seconds() != 0.0125 ||
+        !bytes.Equal(entries[1].Command, mock.Hex("30 31 41 42")) ||
+        entries[1].Err != "Card was removed. (SCARD_W_REMOVED_CARD)" {
+        t.Errorf("unexpected entries %+v", entries)
+    }
+}
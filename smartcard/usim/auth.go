@@ -0,0 +1,100 @@
+package usim
+
+import (
+    "fmt"
+    "github.com/sf1/go-card/smartcard"
+)
+
+// Result of a successful AUTHENTICATE in 3G security context.
+type AuthResult struct {
+    RES []byte
+    // Cipher key
+    CK []byte
+    // Integrity key
+    IK []byte
+    // GSM cipher key, present if service 27 is available
+    Kc []byte
+}
+
+// Error returned by Authenticate on a sequence number mismatch. AUTS is
+// passed to the network for resynchronisation.
+type SyncFailure struct {
+    AUTS []byte
+}
+
+func (e *SyncFailure) Error() string {
+    return fmt.Sprintf("synchronisation failure, AUTS %X", e.AUTS)
+}
+
+// Split length-prefixed values (TS 31.102, 7.1.2).
+func lvs(data []byte) ([][]byte, error) {
+    var values [][]byte
+    for len(data) > 0 {
+        n := int(data[0])
+        if 1 + n > len(data) {
+            return nil, fmt.Errorf("invalid AUTHENTICATE response")
+        }
+        values = append(values, data[1:1+n])
+        data = data[1+n:]
+    }
+    return values, nil
+}
+
+// Run AUTHENTICATE in 3G security context with the 16 byte RAND and AUTN
+// challenge. Returns *SyncFailure on a sequence number mismatch and
+// smartcard.SWError 9862 if the card rejects the network's MAC.
+func (c *Card) Authenticate(rand, autn []byte) (*AuthResult, error) {
+    if c.GSM() { return nil, fmt.Errorf("3G context not supported by SIM") }
+    if len(rand) != 16 || len(autn) != 16 {
+        return nil, fmt.Errorf("RAND and AUTN must have 16 bytes")
+    }
+    if _, err := c.Select(ADF_USIM); err != nil { return nil, err }
+    data := append([]byte{16}, rand...)
+    data = append(append(data, 16), autn...)
+    rsp, err := c.transmit(smartcard.Command4(CLA_UICC, INS_AUTHENTICATE,
+        0x00, 0x81, data, 0x00))
+    if err != nil { return nil, err }
+    if len(rsp) < 1 { return nil, fmt.Errorf("empty AUTHENTICATE response") }
+    values, err := lvs(rsp[1:])
+    if err != nil { return nil, err }
+    switch rsp[0] {
+        case 0xdb:
+            if len(values) < 3 {
+                return nil, fmt.Errorf("invalid AUTHENTICATE response")
+            }
+            res := &AuthResult{RES: values[0], CK: values[1], IK: values[2]}
+            if len(values) > 3 { res.Kc = values[3] }
+            return res, nil
+        case 0xdc:
+            if len(values) < 1 {
+                return nil, fmt.Errorf("invalid AUTHENTICATE response")
+            }
+            return nil, &SyncFailure{AUTS: values[0]}
+    }
+    return nil, fmt.Errorf("unknown AUTHENTICATE response tag %02X", rsp[0])
+}
+
+// Run AUTHENTICATE in GSM security context (RUN GSM ALGORITHM on SIMs)
+// with the 16 byte RAND. Returns SRES and Kc.
+func (c *Card) AuthenticateGSM(rand []byte) (sres, kc []byte, err error) {
+    if len(rand) != 16 { return nil, nil, fmt.Errorf("RAND must have 16 bytes") }
+    if _, err = c.Select(ADF_USIM); err != nil { return nil, nil, err }
+    if c.GSM() {
+        rsp, err := c.transmit(smartcard.Command3(CLA_GSM, INS_AUTHENTICATE,
+            0x00, 0x00, rand))
+        if err != nil { return nil, nil, err }
+        if len(rsp) < 12 {
+            return nil, nil, fmt.Errorf("invalid RUN GSM ALGORITHM response")
+        }
+        return rsp[:4], rsp[4:12], nil
+    }
+    rsp, err := c.transmit(smartcard.Command4(CLA_UICC, INS_AUTHENTICATE,
+        0x00, 0x80, append([]byte{16}, rand...), 0x00))
+    if err != nil { return nil, nil, err }
+    values, err := lvs(rsp)
+    if err != nil { return nil, nil, err }
+    if len(values) < 2 || len(values[0]) != 4 || len(values[1]) != 8 {
+        return nil, nil, fmt.Errorf("invalid AUTHENTICATE response")
+    }
+    return values[0], values[1], nil
+}
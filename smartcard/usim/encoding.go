@@ -0,0 +1,159 @@
+package usim
+
+import (
+    "strings"
+    "unicode/utf16"
+)
+
+// GSM 7 bit default alphabet (3GPP TS 23.038, 6.2.1).
+var gsmAlphabet = []rune("@£$¥èéùìòÇ\nØø\rÅåΔ_ΦΓΛΩΠΨΣΘΞ\x1bÆæßÉ" +
+    " !\"#¤%&'()*+,-./0123456789:;<=>?" +
+    "¡ABCDEFGHIJKLMNOPQRSTUVWXYZÄÖÑÜ§" +
+    "¿abcdefghijklmnopqrstuvwxyzäöñüà")
+
+// GSM 7 bit default alphabet extension table.
+var gsmExtension = map[byte]rune{
+    0x0a: '\f',
+    0x14: '^',
+    0x28: '{',
+    0x29: '}',
+    0x2f: '\\',
+    0x3c: '[',
+    0x3d: '~',
+    0x3e: ']',
+    0x40: '|',
+    0x65: '€',
+}
+
+// Decode GSM 7 bit default alphabet characters, one per byte.
+func decodeGSM(septets []byte) string {
+    var sb strings.Builder
+    for i := 0; i < len(septets); i++ {
+        s := septets[i] & 0x7f
+        if s == 0x1b && i + 1 < len(septets) {
+            i++
+            if r, ok := gsmExtension[septets[i] & 0x7f]; ok {
+                sb.WriteRune(r)
+            } else {
+                sb.WriteRune(' ')
+            }
+            continue
+        }
+        sb.WriteRune(gsmAlphabet[s])
+    }
+    return sb.String()
+}
+
+// Unpack n septets packed into octets, starting after skip fill bits.
+func unpack7(data []byte, n, skip int) []byte {
+    out := make([]byte, 0, n)
+    for i := 0; i < n; i++ {
+        bit := skip + 7 * i
+        idx, shift := bit / 8, uint(bit % 8)
+        if idx >= len(data) { break }
+        v := int(data[idx]) >> shift
+        if shift > 1 && idx + 1 < len(data) {
+            v |= int(data[idx+1]) << (8 - shift)
+        }
+        out = append(out, byte(v & 0x7f))
+    }
+    return out
+}
+
+func decodeUCS2(data []byte) string {
+    units := make([]uint16, 0, len(data) / 2)
+    for i := 0; i + 1 < len(data); i += 2 {
+        units = append(units, uint16(data[i]) << 8 | uint16(data[i+1]))
+    }
+    return string(utf16.Decode(units))
+}
+
+// Decode alpha identifier (TS 102 221, annex A): GSM default alphabet
+// unpacked, or one of the three UCS2 coding schemes. Trailing FF padding
+// is removed.
+func decodeAlpha(data []byte) string {
+    if len(data) == 0 { return "" }
+    switch data[0] {
+        case 0x80:
+            data = data[1:]
+            for len(data) >= 2 && data[len(data)-2] == 0xff &&
+                data[len(data)-1] == 0xff {
+                data = data[:len(data)-2]
+            }
+            return decodeUCS2(data)
+        case 0x81, 0x82:
+            var base, start int
+            if data[0] == 0x81 && len(data) >= 3 {
+                base, start = int(data[2]) << 7, 3
+            } else if len(data) >= 4 {
+                base, start = int(data[2]) << 8 | int(data[3]), 4
+            } else {
+                return ""
+            }
+            n := int(data[1])
+            if start + n > len(data) { n = len(data) - start }
+            var sb strings.Builder
+            for _, b := range data[start:start+n] {
+                if b & 0x80 != 0 {
+                    sb.WriteRune(rune(base + int(b & 0x7f)))
+                } else {
+                    sb.WriteRune(gsmAlphabet[b])
+                }
+            }
+            return sb.String()
+    }
+    if i := strings.IndexByte(string(data), 0xff); i >= 0 {
+        data = data[:i]
+    }
+    return decodeGSM(data)
+}
+
+// BCD digits of dialling numbers (TS 31.102, 4.4.2.3).
+const bcdDigits = "0123456789*#pw?"
+
+// Decode BCD with swapped nibbles, stopping at the first F nibble.
+func decodeBCD(data []byte) string {
+    var sb strings.Builder
+    for _, b := range data {
+        for _, n := range []byte{b & 0x0f, b >> 4} {
+            if n == 0x0f { return sb.String() }
+            sb.WriteByte(bcdDigits[n])
+        }
+    }
+    return sb.String()
+}
+
+// Decode dialling number: type of number and BCD digits. International
+// numbers get a leading "+".
+func decodeNumber(ton byte, digits []byte) string {
+    number := decodeBCD(digits)
+    if ton & 0x70 == 0x10 && number != "" {
+        number = "+" + number
+    }
+    return number
+}
+
+// Public land mobile network identity.
+type PLMN struct {
+    MCC string
+    MNC string
+}
+
+func (p PLMN) String() string {
+    return p.MCC + p.MNC
+}
+
+// Decode 3-byte PLMN identity (TS 24.008, 10.5.1.3). Returns false for
+// unused entries.
+func decodePLMN(b []byte) (PLMN, bool) {
+    if b[0] == 0xff && b[1] == 0xff && b[2] == 0xff {
+        return PLMN{}, false
+    }
+    digit := func(n byte) string {
+        if n > 9 { return "" }
+        return string('0' + rune(n))
+    }
+    mcc := digit(b[0] & 0x0f) + digit(b[0] >> 4) + digit(b[1] & 0x0f)
+    mnc := digit(b[2] & 0x0f) + digit(b[2] >> 4) + digit(b[1] >> 4)
+    return PLMN{MCC: mcc, MNC: mnc}, true
+}
@@ -0,0 +1,174 @@
+package usim
+
+import (
+    "encoding/binary"
+    "fmt"
+    "github.com/sf1/go-card/smartcard/tlv"
+)
+
+// Access technologies of PLMN lists with access technology.
+const (
+    ACT_UTRAN = 0x8000
+    ACT_EUTRAN = 0x4000
+    ACT_NGRAN = 0x0800
+    ACT_GSM = 0x0080
+    ACT_GSM_COMPACT = 0x0040
+    ACT_CDMA2000_HRPD = 0x0020
+    ACT_CDMA2000_1XRTT = 0x0010
+)
+
+// Return integrated circuit card identifier.
+func (c *Card) ICCID() (string, error) {
+    data, err := c.ReadFile(MF, EF_ICCID)
+    if err != nil { return "", err }
+    return decodeBCD(data), nil
+}
+
+// Return international mobile subscriber identity. Usually requires PIN
+// verification.
+func (c *Card) IMSI() (string, error) {
+    data, err := c.ReadFile(ADF_USIM, EF_IMSI)
+    if err != nil { return "", err }
+    if len(data) < 2 || int(data[0]) > len(data) - 1 || data[0] == 0 {
+        return "", fmt.Errorf("IMSI not set")
+    }
+    data = data[1:1+int(data[0])]
+    // Low nibble of the first byte holds the parity indicator
+    imsi := ""
+    if d := data[0] >> 4; d <= 9 {
+        imsi = string('0' + rune(d))
+    }
+    return imsi + decodeBCD(data[1:]), nil
+}
+
+// Service provider name and display condition.
+type SPN struct {
+    Name string
+    // Display condition byte (TS 31.102, 4.2.12)
+    DisplayCondition byte
+}
+
+// Return service provider name.
+func (c *Card) SPN() (*SPN, error) {
+    data, err := c.ReadFile(ADF_USIM, EF_SPN)
+    if err != nil { return nil, err }
+    if len(data) < 1 { return nil, fmt.Errorf("invalid EF_SPN") }
+    return &SPN{Name: decodeAlpha(data[1:]), DisplayCondition: data[0]}, nil
+}
+
+// PLMN list entry with access technologies (ACT_* bit mask, 0 for lists
+// without access technology).
+type PLMNEntry struct {
+    PLMN
+    AccessTechnologies uint16
+}
+
+func parsePLMNList(data []byte, size int) []PLMNEntry {
+    var list []PLMNEntry
+    for ; len(data) >= size; data = data[size:] {
+        plmn, ok := decodePLMN(data)
+        if !ok { continue }
+        entry := PLMNEntry{PLMN: plmn}
+        if size == 5 {
+            entry.AccessTechnologies = binary.BigEndian.Uint16(data[3:5])
+        }
+        list = append(list, entry)
+    }
+    return list
+}
+
+// Return user controlled PLMN selector list. GSM SIMs without
+// EF_PLMNwAcT fall back to EF_PLMNsel.
+func (c *Card) UserPLMNs() ([]PLMNEntry, error) {
+    data, err := c.ReadFile(ADF_USIM, EF_PLMN_WACT)
+    if err != nil && c.GSM() {
+        if data, err = c.ReadFile(ADF_USIM, EF_PLMN_SEL); err == nil {
+            return parsePLMNList(data, 3), nil
+        }
+    }
+    if err != nil { return nil, err }
+    return parsePLMNList(data, 5), nil
+}
+
+// Return operator controlled PLMN selector list.
+func (c *Card) OperatorPLMNs() ([]PLMNEntry, error) {
+    data, err := c.ReadFile(ADF_USIM, EF_OPLMN_WACT)
+    if err != nil { return nil, err }
+    return parsePLMNList(data, 5), nil
+}
+
+// Return home PLMN selector list.
+func (c *Card) HomePLMNs() ([]PLMNEntry, error) {
+    data, err := c.ReadFile(ADF_USIM, EF_HPLMN_WACT)
+    if err != nil { return nil, err }
+    return parsePLMNList(data, 5), nil
+}
+
+// Return forbidden PLMNs.
+func (c *Card) ForbiddenPLMNs() ([]PLMN, error) {
+    data, err := c.ReadFile(ADF_USIM, EF_FPLMN)
+    if err != nil { return nil, err }
+    var list []PLMN
+    for _, entry := range parsePLMNList(data, 3) {
+        list = append(list, entry.PLMN)
+    }
+    return list, nil
+}
+
+// Phone book entry.
+type Contact struct {
+    // Record number
+    Record int
+    Name string
+    Number string
+}
+
+// Parse abbreviated dialling number records (TS 31.102, 4.4.2.3), skipping
+// empty ones.
+func parseADN(records [][]byte) []Contact {
+    var contacts []Contact
+    for i, r := range records {
+        if len(r) < 14 { continue }
+        alpha, number := r[:len(r)-14], r[len(r)-14:]
+        contact := Contact{Record: i + 1, Name: decodeAlpha(alpha)}
+        if n := int(number[0]); n >= 2 && n <= 11 {
+            contact.Number = decodeNumber(number[1], number[2:1+n])
+        }
+        if contact.Name == "" && contact.Number == "" { continue }
+        contacts = append(contacts, contact)
+    }
+    return contacts
+}
+
+// Return phone book entries: EF_ADN of DF_TELECOM, or the global USIM
+// phone book located through EF_PBR.
+func (c *Card) Phonebook() ([]Contact, error) {
+    records, err := c.ReadRecords(MF, DF_TELECOM, EF_ADN)
+    if err == nil { return parseADN(records), nil }
+    pbr, perr := c.ReadRecords(MF, DF_TELECOM, DF_PHONEBOOK, EF_PBR)
+    if perr != nil || len(pbr) == 0 { return nil, err }
+    var contacts []Contact
+    offset := 0
+    for _, record := range pbr {
+        list, err := tlv.Parse(trimFF(record))
+        if err != nil { return nil, fmt.Errorf("invalid EF_PBR: %s", err) }
+        adn, ok := list.Search(0xc0)
+        if !ok || len(adn.Value) < 2 { continue }
+        fid := binary.BigEndian.Uint16(adn.Value)
+        records, err := c.ReadRecords(MF, DF_TELECOM, DF_PHONEBOOK, fid)
+        if err != nil { return nil, err }
+        for _, contact := range parseADN(records) {
+            contact.Record += offset
+            contacts = append(contacts, contact)
+        }
+        offset += len(records)
+    }
+    return contacts, nil
+}
+
+func trimFF(data []byte) []byte {
+    for len(data) > 0 && data[len(data)-1] == 0xff {
+        data = data[:len(data)-1]
+    }
+    return data
+}
@@ -0,0 +1,100 @@
+package usim
+
+import (
+    "fmt"
+    "github.com/sf1/go-card/smartcard"
+    "github.com/sf1/go-card/smartcard/SW"
+)
+
+// PIN references.
+const (
+    PIN1 = 0x01
+    PIN2 = 0x81
+    // GSM CHV2 reference
+    CHV2 = 0x02
+)
+
+// Error returned if a PIN is wrong or blocked.
+type PINError struct {
+    // Remaining attempts, 0 if blocked, -1 if unknown
+    Retries int
+}
+
+func (e *PINError) Error() string {
+    switch {
+        case e.Retries == 0:
+            return "PIN blocked"
+        case e.Retries < 0:
+            return "wrong PIN"
+    }
+    return fmt.Sprintf("wrong PIN, %d tries left", e.Retries)
+}
+
+func pinError(sw uint16) error {
+    switch {
+        case sw == SW.SUCCESS:
+            return nil
+        case sw == SW.AUTH_METHOD_BLOCKED, sw == 0x9840:
+            return &PINError{Retries: 0}
+        case sw & 0xfff0 == SW.AUTH_FAILED:
+            return &PINError{Retries: int(sw & 0x0f)}
+        case sw == 0x9804:
+            return &PINError{Retries: -1}
+    }
+    return smartcard.SWError(sw)
+}
+
+// Pad PIN to eight bytes with FF.
+func padPIN(pin string) ([]byte, error) {
+    if len(pin) < 4 || len(pin) > 8 {
+        return nil, fmt.Errorf("PIN must have 4 to 8 digits")
+    }
+    data := []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}
+    copy(data, pin)
+    return data, nil
+}
+
+// Verify PIN1 (CHV1). Returns *PINError if the PIN is wrong.
+func (c *Card) VerifyPIN(pin string) error {
+    return c.Verify(PIN1, pin)
+}
+
+// Verify PIN with the given reference (PIN1, PIN2 or CHV2 on GSM SIMs).
+// Returns *PINError if the PIN is wrong.
+func (c *Card) Verify(ref byte, pin string) error {
+    data, err := padPIN(pin)
+    if err != nil { return err }
+    if c.GSM() && ref == PIN2 { ref = CHV2 }
+    rsp, err := c.exchange(smartcard.Command3(c.cla, INS_VERIFY, 0x00, ref,
+        data))
+    if err != nil { return err }
+    return pinError(rsp.SW())
+}
+
+// Return remaining attempts of the PIN with the given reference. On UICCs
+// a PIN that is already verified or disabled reports 0 as well.
+func (c *Card) PINRetries(ref byte) (int, error) {
+    if c.GSM() {
+        // CHV status bytes of the MF SELECT response (TS 51.011, 9.2.1)
+        data, err := c.transmit(smartcard.Command3(CLA_GSM, INS_SELECT, 0x00,
+            0x00, []byte{MF >> 8, MF & 0xff}))
+        if err != nil { return 0, err }
+        offset := 18
+        if ref == PIN2 || ref == CHV2 { offset = 20 }
+        if len(data) <= offset {
+            return 0, fmt.Errorf("CHV status missing")
+        }
+        c.current = nil
+        return int(data[offset] & 0x0f), nil
+    }
+    rsp, err := c.exchange(smartcard.Command1(CLA_UICC, INS_VERIFY, 0x00, ref))
+    if err != nil { return 0, err }
+    sw := rsp.SW()
+    switch {
+        case sw == SW.SUCCESS, sw == SW.AUTH_METHOD_BLOCKED:
+            return 0, nil
+        case sw & 0xfff0 == SW.AUTH_FAILED:
+            return int(sw & 0x0f), nil
+    }
+    return 0, smartcard.SWError(sw)
+}
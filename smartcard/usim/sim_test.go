@@ -0,0 +1,347 @@
+package usim
+
+import (
+    "bytes"
+    "encoding/binary"
+    "encoding/hex"
+    "fmt"
+    "github.com/sf1/go-card/smartcard"
+    "github.com/sf1/go-card/smartcard/SW"
+    "github.com/sf1/go-card/smartcard/mock"
+)
+
+// File of the simulated card. DFs have children, EFs data or records.
+type simFile struct {
+    fid uint16
+    aid []byte
+    parent *simFile
+    children []*simFile
+    data []byte
+    records [][]byte
+    // Access requires PIN1
+    protected bool
+}
+
+func (f *simFile) df() bool {
+    return f.data == nil && f.records == nil
+}
+
+func (f *simFile) add(children ...*simFile) *simFile {
+    for _, child := range children {
+        child.parent = f
+        f.children = append(f.children, child)
+    }
+    return f
+}
+
+func (f *simFile) child(fid uint16) *simFile {
+    for _, child := range f.children {
+        if child.fid == fid { return child }
+    }
+    return nil
+}
+
+func (f *simFile) size() int {
+    if f.records != nil { return len(f.records) * len(f.records[0]) }
+    return len(f.data)
+}
+
+func ef(fid uint16, data []byte) *simFile {
+    return &simFile{fid: fid, data: data}
+}
+
+func records(fid uint16, length int, recs ...[]byte) *simFile {
+    f := &simFile{fid: fid}
+    for _, r := range recs {
+        f.records = append(f.records, pad(r, length))
+    }
+    return f
+}
+
+func pad(data []byte, n int) []byte {
+    out := bytes.Repeat([]byte{0xff}, n)
+    copy(out, data)
+    return out
+}
+
+func h(s string) []byte {
+    data, err := hex.DecodeString(s)
+    if err != nil { panic(err) }
+    return data
+}
+
+// Simulated SIM (class A0, TS 51.011) or UICC with USIM application for
+// tests: a mock card with a rule per instruction working on the card state.
+type simCard struct {
+    *mock.Card
+    gsm bool
+    mf *simFile
+    adf *simFile
+    current *simFile
+    pin string
+    retries int
+    verified bool
+    pending []byte
+}
+
+var simUSIMAID = h("a0000000871002ff44ff1289000001ff")
+
+// Milenage test set 1 (3GPP TS 35.208), including the GSM SRES and Kc of
+// the conversion functions c2 and c3.
+var (
+    simRAND = h("23553cbe9637a89d218ae64dae47bf35")
+    simAUTN = h("55f328b43577b9b94a9ffac354dfafb3")
+    simRES = h("a54211d5e3ba50bf")
+    simCK = h("b40ba9a3c58b2a05bbf0d987b21bf8cb")
+    simIK = h("f769bcd751044604127672711c6d3441")
+    simSRES = h("46f8416a")
+    simKc = h("eae4be823af9a08b")
+    // AUTN triggering a synchronisation failure; AUTS is SQN 0 concealed
+    // with AK* of the test set and an arbitrary MAC-S
+    simSyncAUTN = h("000000000000b9b94a9ffac354dfafb3")
+    simAUTS = h("451e8beca43b8b3e1e8e3ab2a2c4")
+)
+
+var simSMS = [][]byte{
+    append(h("03079144775810065004"+"0b914477280080f6"+"0000"+"42015121430080"+
+        "0a"), h("e8329bfd4697d9ec37")...),
+    {0x00},
+    h("0500" + "1100" + "048121430008aa" + "0400480069"),
+}
+
+var simADN = [][]byte{
+    append(pad([]byte("Alice"), 8), pad(h("07914477280080f6"), 14)...),
+    {},
+    append(pad(h("800042006f0062"), 8), pad(h("03812143"), 14)...),
+}
+
+func newSimCard(gsm bool) *simCard {
+    s := &simCard{gsm: gsm, pin: "1234", retries: 3}
+    adn := records(EF_ADN, 22, simADN...)
+    sms := records(EF_SMS, 176, simSMS...)
+    for _, f := range []*simFile{adn, sms} { f.protected = true }
+    imsi := ef(EF_IMSI, h("082943511032547698"))
+    imsi.protected = true
+    app := (&simFile{fid: DF_GSM}).add(imsi,
+        ef(EF_SPN, pad(append([]byte{0x01}, "Test"...), 17)),
+        ef(EF_FPLMN, h("130014ffffffffffffffffff")))
+    telecom := &simFile{fid: DF_TELECOM}
+    s.mf = (&simFile{fid: MF}).add(ef(EF_ICCID, h("98442143658709214365")),
+        telecom)
+    if gsm {
+        app.add(ef(EF_PLMN_SEL, h("32f45102f810ffffff")))
+        telecom.add(adn, sms)
+        s.mf.add(app)
+    } else {
+        app.fid, app.aid = ADF_USIM, simUSIMAID
+        app.add(sms, ef(EF_PLMN_WACT, h("32f451800002f8100080ffffff0000")),
+            ef(EF_OPLMN_WACT, h("130014c000")))
+        adn.fid = 0x4f3a
+        telecom.add((&simFile{fid: DF_PHONEBOOK}).add(
+            records(EF_PBR, 16, h("a808c0024f3ac4024f09")), adn))
+        s.mf.add(records(EF_DIR, 32, append(h("611b4f10"), append(
+            simUSIMAID, h("50074d79205553494d")...)...)))
+        s.adf = app
+    }
+    s.current = s.mf
+    cla := fmt.Sprintf("%02x ", CLA_UICC)
+    if gsm { cla = fmt.Sprintf("%02x ", CLA_GSM) }
+    s.Card = mock.NewCard(mock.Hex("3b 80 80 01 01")).
+        RuleFunc(cla + "c0 *", s.getResponse).
+        RuleFunc(cla + "a4 *", s.rule(s.selectFile)).
+        RuleFunc(cla + "b0 *", s.rule(s.readBinary)).
+        RuleFunc(cla + "b2 *", s.rule(s.readRecord)).
+        RuleFunc(cla + "20 *", s.rule(s.verify)).
+        RuleFunc(cla + "88 *", s.rule(s.authenticate))
+    return s
+}
+
+func sw(code uint16) smartcard.ResponseAPDU {
+    return smartcard.ResponseAPDU{byte(code >> 8), byte(code)}
+}
+
+// Announce response data with 61xx (UICC) or 9Fxx (SIM).
+func (s *simCard) announce(data []byte) smartcard.ResponseAPDU {
+    s.pending = data
+    if s.gsm { return sw(0x9f00 | uint16(len(data))) }
+    return sw(0x6100 | uint16(len(data)))
+}
+
+func (s *simCard) fcp(f *simFile) []byte {
+    var fcp []byte
+    switch {
+        case f.df():
+            fcp = h("82027821")
+        case f.records != nil:
+            fcp = []byte{0x82, 0x05, 0x42, 0x21, 0x00,
+                byte(len(f.records[0])), byte(len(f.records))}
+        default:
+            fcp = h("82024121")
+    }
+    fcp = append(fcp, 0x83, 0x02, byte(f.fid >> 8), byte(f.fid))
+    if f.aid != nil {
+        fcp = append(append(fcp, 0x84, byte(len(f.aid))), f.aid...)
+    }
+    if !f.df() {
+        fcp = append(fcp, 0x80, 0x02, byte(f.size() >> 8), byte(f.size()))
+    }
+    return append([]byte{0x62, byte(len(fcp))}, fcp...)
+}
+
+// GSM SELECT response (TS 51.011, 9.2.1).
+func (s *simCard) gsmResponse(f *simFile) []byte {
+    rsp := make([]byte, 15)
+    binary.BigEndian.PutUint16(rsp[2:], uint16(f.size()))
+    binary.BigEndian.PutUint16(rsp[4:], f.fid)
+    switch {
+        case f.df():
+            rsp[6] = 0x02
+            if f == s.mf { rsp[6] = 0x01 }
+            chv := byte(0x80 | s.retries)
+            rsp = append(rsp[:13], 0x00, 0x00, 0x00, 0x00, 0x00, chv, 0x8a,
+                0x83, 0x8a)
+            rsp[12] = byte(len(rsp) - 13)
+        case f.records != nil:
+            rsp[6], rsp[13], rsp[14] = 0x04, 0x01, byte(len(f.records[0]))
+        default:
+            rsp[6] = 0x04
+    }
+    return rsp
+}
+
+func (s *simCard) denied() smartcard.ResponseAPDU {
+    if s.gsm { return sw(0x9804) }
+    return sw(SW.SECURITY_STATUS_NOT_SATISFIED)
+}
+
+// Call fn with the command data, dropping unfetched response data.
+func (s *simCard) rule(fn func(cmd smartcard.CommandAPDU,
+    data []byte) smartcard.ResponseAPDU) mock.HandlerFunc {
+    return func(cmd smartcard.CommandAPDU) (smartcard.ResponseAPDU, error) {
+        var data []byte
+        if len(cmd) > 5 { data = cmd[5:5+int(cmd[4])] }
+        s.pending = nil
+        return fn(cmd, data), nil
+    }
+}
+
+func (s *simCard) getResponse(cmd smartcard.CommandAPDU) (
+    smartcard.ResponseAPDU, error) {
+    if s.pending == nil || int(cmd[4]) != len(s.pending) {
+        return sw(0x6f00), nil
+    }
+    rsp := append(append([]byte{}, s.pending...), 0x90, 0x00)
+    s.pending = nil
+    return rsp, nil
+}
+
+func (s *simCard) selectFile(cmd smartcard.CommandAPDU,
+    data []byte) smartcard.ResponseAPDU {
+    var f *simFile
+    switch {
+        case cmd[2] == 0x04 && !s.gsm:
+            if s.adf != nil && bytes.HasPrefix(s.adf.aid, data) {
+                f = s.adf
+            }
+        case len(data) == 2:
+            fid := binary.BigEndian.Uint16(data)
+            dir := s.current
+            if !dir.df() { dir = dir.parent }
+            if fid == MF {
+                f = s.mf
+            } else if f = dir.child(fid); f == nil && dir.parent != nil {
+                f = dir.parent.child(fid)
+            }
+    }
+    if f == nil {
+        if s.gsm { return sw(0x9404) }
+        return sw(0x6a82)
+    }
+    s.current = f
+    if s.gsm { return s.announce(s.gsmResponse(f)) }
+    return s.announce(s.fcp(f))
+}
+
+func (s *simCard) readBinary(cmd smartcard.CommandAPDU,
+    data []byte) smartcard.ResponseAPDU {
+    f := s.current
+    if f.data == nil { return sw(0x6981) }
+    if f.protected && !s.verified { return s.denied() }
+    offset := int(cmd[2]) << 8 | int(cmd[3])
+    end := offset + int(cmd[4])
+    if end > len(f.data) { return sw(0x6b00) }
+    return append(append([]byte{}, f.data[offset:end]...), 0x90, 0x00)
+}
+
+func (s *simCard) readRecord(cmd smartcard.CommandAPDU,
+    data []byte) smartcard.ResponseAPDU {
+    f := s.current
+    p1, p2 := cmd[2], cmd[3]
+    if f.records == nil { return sw(0x6981) }
+    if f.protected && !s.verified { return s.denied() }
+    if p2 != 0x04 || p1 == 0 || int(p1) > len(f.records) {
+        return sw(0x6a83)
+    }
+    r := f.records[p1-1]
+    if int(cmd[4]) != len(r) { return sw(0x6c00 | uint16(len(r))) }
+    return append(append([]byte{}, r...), 0x90, 0x00)
+}
+
+func (s *simCard) verify(cmd smartcard.CommandAPDU,
+    data []byte) smartcard.ResponseAPDU {
+    if cmd[3] != PIN1 { return sw(0x6a88) }
+    if data == nil {
+        if s.verified { return sw(0x9000) }
+        return sw(0x63c0 | uint16(s.retries))
+    }
+    if s.retries == 0 {
+        if s.gsm { return sw(0x9840) }
+        return sw(0x6983)
+    }
+    if bytes.Equal(data, pad([]byte(s.pin), 8)) {
+        s.retries, s.verified = 3, true
+        return sw(0x9000)
+    }
+    s.retries--
+    switch {
+        case s.gsm && s.retries == 0:
+            return sw(0x9840)
+        case s.gsm:
+            return sw(0x9804)
+    }
+    return sw(0x63c0 | uint16(s.retries))
+}
+
+func (s *simCard) authenticate(cmd smartcard.CommandAPDU,
+    data []byte) smartcard.ResponseAPDU {
+    if !s.verified { return s.denied() }
+    if s.gsm {
+        if !bytes.Equal(data, simRAND) { return sw(0x6f00) }
+        return s.announce(append(append([]byte{}, simSRES...), simKc...))
+    }
+    if s.current != s.adf { return sw(0x6985) }
+    if cmd[3] == 0x80 {
+        if len(data) != 17 || !bytes.Equal(data[1:], simRAND) {
+            return sw(0x6f00)
+        }
+        rsp := append([]byte{4}, simSRES...)
+        return s.announce(append(append(rsp, 8), simKc...))
+    }
+    if cmd[3] != 0x81 || len(data) != 34 ||
+        !bytes.Equal(data[1:17], simRAND) {
+        return sw(0x6a86)
+    }
+    autn := data[18:]
+    switch {
+        case bytes.Equal(autn, simAUTN):
+            rsp := []byte{0xdb}
+            for _, v := range [][]byte{simRES, simCK, simIK, simKc} {
+                rsp = append(append(rsp, byte(len(v))), v...)
+            }
+            return s.announce(rsp)
+        case bytes.Equal(autn, simSyncAUTN):
+            rsp := append([]byte{0xdc, byte(len(simAUTS))}, simAUTS...)
+            return s.announce(rsp)
+    }
+    return sw(0x9862)
+}
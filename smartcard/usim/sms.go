@@ -0,0 +1,172 @@
+package usim
+
+import (
+    "fmt"
+    "time"
+)
+
+// Status of short messages stored in EF_SMS.
+const (
+    SMS_FREE = 0x00
+    SMS_READ = 0x01
+    SMS_UNREAD = 0x03
+    SMS_SENT = 0x05
+    SMS_TO_BE_SENT = 0x07
+)
+
+// Short message stored on the card.
+type SMS struct {
+    // Record number
+    Record int
+    // Status (SMS_* constant)
+    Status byte
+    // Service centre address
+    SMSC string
+    // Originating address of received, destination address of sent messages
+    Address string
+    // Service centre time stamp of received messages
+    Time time.Time
+    Text string
+    // Raw TP-DU (3GPP TS 23.040)
+    TPDU []byte
+}
+
+// Return short messages, skipping free records.
+func (c *Card) Messages() ([]SMS, error) {
+    path := []uint16{ADF_USIM, EF_SMS}
+    if c.GSM() {
+        path = []uint16{MF, DF_TELECOM, EF_SMS}
+    }
+    records, err := c.ReadRecords(path...)
+    if err != nil { return nil, err }
+    var messages []SMS
+    for i, r := range records {
+        if len(r) < 2 || r[0] & 0x01 == SMS_FREE { continue }
+        sms, err := parseSMS(r)
+        if err != nil {
+            return nil, fmt.Errorf("record %d: %s", i + 1, err)
+        }
+        sms.Record = i + 1
+        messages = append(messages, *sms)
+    }
+    return messages, nil
+}
+
+// Parse EF_SMS record: status, service centre address and TP-DU.
+func parseSMS(record []byte) (*SMS, error) {
+    sms := &SMS{Status: record[0] & 0x07}
+    n := int(record[1])
+    if 2 + n > len(record) { return nil, fmt.Errorf("invalid SMSC address") }
+    if n >= 2 && n != 0xff {
+        sms.SMSC = decodeNumber(record[2], record[3:2+n])
+    }
+    if n == 0xff { n = 0 }
+    sms.TPDU = append([]byte{}, record[2+n:]...)
+    if err := sms.parseTPDU(); err != nil { return nil, err }
+    return sms, nil
+}
+
+// Parse SMS-DELIVER or SMS-SUBMIT TP-DU (3GPP TS 23.040, 9.2.2).
+func (sms *SMS) parseTPDU() error {
+    p := sms.TPDU
+    if len(p) < 1 { return fmt.Errorf("empty TPDU") }
+    fo := p[0]
+    pos := 1
+    submit := false
+    switch fo & 0x03 {
+        case 0x00:
+        case 0x01:
+            submit = true
+            pos++ // message reference
+        default:
+            return fmt.Errorf("unsupported message type %d", fo & 0x03)
+    }
+    if pos >= len(p) { return fmt.Errorf("TPDU too short") }
+    addr, n, err := decodeAddress(p[pos:])
+    if err != nil { return err }
+    sms.Address = addr
+    pos += n
+    if pos + 2 > len(p) { return fmt.Errorf("TPDU too short") }
+    dcs := p[pos+1]
+    pos += 2
+    if submit {
+        switch fo & 0x18 {
+            case 0x10:
+                pos++
+            case 0x08, 0x18:
+                pos += 7
+        }
+    } else {
+        if pos + 7 > len(p) { return fmt.Errorf("TPDU too short") }
+        sms.Time = decodeSCTS(p[pos:pos+7])
+        pos += 7
+    }
+    if pos >= len(p) { return fmt.Errorf("user data missing") }
+    text, err := decodeUserData(dcs, fo & 0x40 != 0, int(p[pos]), p[pos+1:])
+    if err != nil { return err }
+    sms.Text = text
+    return nil
+}
+
+// Decode TP address, returning the address and its encoded length.
+func decodeAddress(data []byte) (string, int, error) {
+    if len(data) < 2 { return "", 0, fmt.Errorf("invalid address") }
+    digits := int(data[0])
+    n := 2 + (digits + 1) / 2
+    if n > len(data) { return "", 0, fmt.Errorf("invalid address") }
+    ton := data[1]
+    if ton & 0x70 == 0x50 {
+        // Alphanumeric address in GSM 7 bit default alphabet
+        return decodeGSM(unpack7(data[2:n], digits * 4 / 7, 0)), n, nil
+    }
+    return decodeNumber(ton, data[2:n]), n, nil
+}
+
+// Decode service centre time stamp with time zone in quarter hours.
+func decodeSCTS(b []byte) time.Time {
+    d := func(v byte) int {
+        return int(v & 0x0f) * 10 + int(v >> 4)
+    }
+    tz := (int(b[6] & 0x07) * 10 + int(b[6] >> 4)) * 15 * 60
+    if b[6] & 0x08 != 0 { tz = -tz }
+    return time.Date(2000 + d(b[0]), time.Month(d(b[1])), d(b[2]), d(b[3]),
+        d(b[4]), d(b[5]), 0, time.FixedZone("", tz))
+}
+
+// Decode user data according to the data coding scheme (3GPP TS 23.038).
+// udl counts septets for the GSM 7 bit alphabet and octets otherwise.
+func decodeUserData(dcs byte, udhi bool, udl int, ud []byte) (string,
+    error) {
+    alphabet := 0
+    switch {
+        case dcs & 0xc0 == 0x00:
+            alphabet = int(dcs >> 2) & 0x03
+        case dcs & 0xf0 == 0xf0:
+            alphabet = int(dcs >> 2) & 0x01
+        case dcs & 0xf0 == 0xe0:
+            alphabet = 2
+    }
+    header := 0
+    if udhi {
+        if len(ud) < 1 { return "", fmt.Errorf("invalid user data header") }
+        header = int(ud[0]) + 1
+        if header > len(ud) {
+            return "", fmt.Errorf("invalid user data header")
+        }
+    }
+    switch alphabet {
+        case 0:
+            fill := (7 - header * 8 % 7) % 7
+            skip := (header * 8 + fill) / 7
+            if udl < skip { return "", fmt.Errorf("invalid user data length") }
+            return decodeGSM(unpack7(ud[header:], udl - skip, fill)), nil
+        case 1, 2:
+            if udl > len(ud) { udl = len(ud) }
+            if udl < header {
+                return "", fmt.Errorf("invalid user data length")
+            }
+            if alphabet == 2 { return decodeUCS2(ud[header:udl]), nil }
+            return string(ud[header:udl]), nil
+    }
+    return "", fmt.Errorf("unsupported data coding scheme %02X", dcs)
+}
@@ -0,0 +1,338 @@
+/*
+Package usim implements access to SIM and USIM cards: the UICC file
+system (3GPP TS 31.102, ETSI TS 102 221) as well as GSM SIMs using class
+A0 (3GPP TS 51.011), PIN verification and network authentication.
+
+Example:
+
+    sim, err := usim.New(card)
+    // handle error, if any
+    iccid, err := sim.ICCID()
+    // handle error, if any
+    err = sim.VerifyPIN("1234")
+    // handle error, if any
+    imsi, err := sim.IMSI()
+    // handle error, if any
+    res, err := sim.Authenticate(rand, autn)
+
+Files are addressed by path from the MF. ADF_USIM stands for the USIM
+application, which is selected by its AID; on GSM SIMs it maps to DF_GSM.
+*/
+package usim
+
+import (
+    "bytes"
+    "encoding/binary"
+    "fmt"
+    "github.com/sf1/go-card/smartcard"
+    "github.com/sf1/go-card/smartcard/SW"
+    "github.com/sf1/go-card/smartcard/tlv"
+)
+
+// USIM application identifier prefix (RID and application code).
+var AID_USIM = []byte{0xa0, 0x00, 0x00, 0x00, 0x87, 0x10, 0x02}
+
+const (
+    // Classes
+    CLA_UICC = 0x00
+    CLA_GSM = 0xa0
+    // Instructions
+    INS_SELECT = 0xa4
+    INS_STATUS = 0xf2
+    INS_READ_BINARY = 0xb0
+    INS_UPDATE_BINARY = 0xd6
+    INS_READ_RECORD = 0xb2
+    INS_UPDATE_RECORD = 0xdc
+    INS_VERIFY = 0x20
+    INS_AUTHENTICATE = 0x88
+    INS_GET_RESPONSE = 0xc0
+    // Dedicated files
+    MF = 0x3f00
+    DF_TELECOM = 0x7f10
+    DF_GSM = 0x7f20
+    DF_PHONEBOOK = 0x5f3a
+    // Current application; selected by AID
+    ADF_USIM = 0x7fff
+    // Elementary files under the MF
+    EF_DIR = 0x2f00
+    EF_ICCID = 0x2fe2
+    // Elementary files under ADF_USIM (DF_GSM)
+    EF_IMSI = 0x6f07
+    EF_SPN = 0x6f46
+    EF_PLMN_SEL = 0x6f30
+    EF_PLMN_WACT = 0x6f60
+    EF_OPLMN_WACT = 0x6f61
+    EF_HPLMN_WACT = 0x6f62
+    EF_FPLMN = 0x6f7b
+    EF_AD = 0x6fad
+    // Elementary files under DF_TELECOM (and ADF_USIM for EF_SMS)
+    EF_SMS = 0x6f3c
+    EF_ADN = 0x6f3a
+    EF_MSISDN = 0x6f40
+    // Phone book reference file under DF_PHONEBOOK
+    EF_PBR = 0x4f30
+)
+
+// File structures.
+const (
+    STRUCTURE_TRANSPARENT = 1
+    STRUCTURE_LINEAR_FIXED = 2
+    STRUCTURE_CYCLIC = 6
+)
+
+// File information from the FCP template (UICC) or the GSM SELECT
+// response.
+type File struct {
+    FID uint16
+    // Dedicated file (MF, DF or ADF)
+    DF bool
+    // Structure of elementary files
+    Structure int
+    // Size of elementary files in bytes
+    Size int
+    RecordLength int
+    RecordCount int
+    // DF name of ADFs
+    AID []byte
+}
+
+// SIM or USIM card.
+type Card struct {
+    card smartcard.Transmitter
+    cla byte
+    aid []byte
+    current *File
+}
+
+// Connect to card, using the UICC command set if supported and GSM
+// class A0 otherwise. On UICCs the USIM application is looked up in EF_DIR.
+func New(card smartcard.Transmitter) (*Card, error) {
+    c := &Card{card: card, cla: CLA_UICC}
+    if _, err := c.Select(MF); err == nil {
+        records, err := c.ReadRecords(MF, EF_DIR)
+        if err != nil { return c, nil }
+        for _, record := range records {
+            app, _, err := tlv.ParseOne(record)
+            if err != nil || app.Tag != 0x61 { continue }
+            children, err := app.Children()
+            if err != nil { continue }
+            aid := children.Value(0x4f)
+            if bytes.HasPrefix(aid, AID_USIM) {
+                c.aid = aid
+                break
+            }
+        }
+        return c, nil
+    }
+    c = NewGSM(card)
+    if _, err := c.Select(MF); err != nil {
+        return nil, fmt.Errorf("neither UICC nor GSM SIM: %s", err)
+    }
+    return c, nil
+}
+
+// Create GSM SIM card using class A0.
+func NewGSM(card smartcard.Transmitter) *Card {
+    return &Card{card: card, cla: CLA_GSM}
+}
+
+// Return underlying transmitter.
+func (c *Card) Transmitter() smartcard.Transmitter {
+    return c.card
+}
+
+// Check whether the card is accessed as GSM SIM (class A0).
+func (c *Card) GSM() bool {
+    return c.cla == CLA_GSM
+}
+
+// Return AID of the USIM application, nil for GSM SIMs.
+func (c *Card) USIM() []byte {
+    return c.aid
+}
+
+// Transmit command, fetching response data announced with 61xx or 9Fxx
+// and repeating the command with the right Le on 6Cxx.
+func (c *Card) exchange(cmd smartcard.CommandAPDU) (smartcard.ResponseAPDU,
+    error) {
+    rsp, err := c.card.TransmitAPDU(cmd)
+    if err != nil { return nil, err }
+    if rsp.SW1() == 0x6c && len(cmd) >= 5 {
+        retry := append(smartcard.CommandAPDU{}, cmd...)
+        retry[len(retry)-1] = rsp.SW2()
+        if rsp, err = c.card.TransmitAPDU(retry); err != nil { return nil, err }
+    }
+    if rsp.SW1() == 0x61 || rsp.SW1() == 0x9f {
+        rsp, err = c.card.TransmitAPDU(smartcard.Command2(c.cla,
+            INS_GET_RESPONSE, 0x00, 0x00, rsp.SW2()))
+        if err != nil { return nil, err }
+    }
+    return rsp, nil
+}
+
+// Transmit command and return response data. Besides 9000, 91xx (proactive
+// command pending) indicates success.
+func (c *Card) transmit(cmd smartcard.CommandAPDU) ([]byte, error) {
+    rsp, err := c.exchange(cmd)
+    if err != nil { return nil, err }
+    if rsp.SW() != SW.SUCCESS && rsp.SW1() != 0x91 {
+        return nil, smartcard.SWError(rsp.SW())
+    }
+    return rsp.Data(), nil
+}
+
+// Parse FCP template of a UICC SELECT response.
+func parseFCP(fid uint16, data []byte) (*File, error) {
+    obj, _, err := tlv.ParseOne(data)
+    if err != nil { return nil, err }
+    if obj.Tag != 0x62 { return nil, fmt.Errorf("invalid FCP tag %s", obj.Tag) }
+    fcp, err := obj.Children()
+    if err != nil { return nil, err }
+    f := &File{FID: fid}
+    if v := fcp.Value(0x83); len(v) == 2 {
+        f.FID = binary.BigEndian.Uint16(v)
+    }
+    f.AID = fcp.Value(0x84)
+    fd := fcp.Value(0x82)
+    if len(fd) < 2 { return nil, fmt.Errorf("file descriptor missing") }
+    if fd[0] & 0x38 == 0x38 {
+        f.DF = true
+        return f, nil
+    }
+    f.Structure = int(fd[0] & 0x07)
+    if len(fd) >= 5 {
+        f.RecordLength = int(binary.BigEndian.Uint16(fd[2:4]))
+        f.RecordCount = int(fd[4])
+    }
+    for _, b := range fcp.Value(0x80) {
+        f.Size = f.Size << 8 | int(b)
+    }
+    return f, nil
+}
+
+// Parse GSM SELECT response (TS 51.011, 9.2.1).
+func parseGSMResponse(data []byte) (*File, error) {
+    if len(data) < 14 { return nil, fmt.Errorf("invalid SELECT response") }
+    f := &File{FID: binary.BigEndian.Uint16(data[4:6])}
+    switch data[6] {
+        case 0x01, 0x02:
+            f.DF = true
+            return f, nil
+        case 0x04:
+        default:
+            return nil, fmt.Errorf("unknown file type %02X", data[6])
+    }
+    f.Size = int(binary.BigEndian.Uint16(data[2:4]))
+    if len(data) < 15 { return nil, fmt.Errorf("invalid SELECT response") }
+    switch data[13] {
+        case 0x00:
+            f.Structure = STRUCTURE_TRANSPARENT
+        case 0x01:
+            f.Structure = STRUCTURE_LINEAR_FIXED
+        case 0x03:
+            f.Structure = STRUCTURE_CYCLIC
+    }
+    if f.Structure != STRUCTURE_TRANSPARENT && data[14] > 0 {
+        f.RecordLength = int(data[14])
+        f.RecordCount = f.Size / f.RecordLength
+    }
+    return f, nil
+}
+
+func (c *Card) selectFID(fid uint16) (*File, error) {
+    fidBytes := []byte{byte(fid >> 8), byte(fid)}
+    if c.GSM() {
+        data, err := c.transmit(smartcard.Command3(CLA_GSM, INS_SELECT, 0x00,
+            0x00, fidBytes))
+        if err != nil { return nil, err }
+        return parseGSMResponse(data)
+    }
+    data, err := c.transmit(smartcard.Command4(CLA_UICC, INS_SELECT, 0x00,
+        0x04, fidBytes, 0x00))
+    if err != nil { return nil, err }
+    return parseFCP(fid, data)
+}
+
+func (c *Card) selectAID(aid []byte) (*File, error) {
+    data, err := c.transmit(smartcard.Command4(CLA_UICC, INS_SELECT, 0x04,
+        0x04, aid, 0x00))
+    if err != nil { return nil, err }
+    return parseFCP(ADF_USIM, data)
+}
+
+// Select file by path from the MF, e.g. Select(MF, DF_TELECOM, EF_ADN) or
+// Select(ADF_USIM, EF_IMSI).
+func (c *Card) Select(path ...uint16) (*File, error) {
+    var f *File
+    var err error
+    for _, fid := range path {
+        switch {
+            case fid == ADF_USIM && c.GSM():
+                f, err = c.selectFID(DF_GSM)
+            case fid == ADF_USIM:
+                if c.aid == nil {
+                    return nil, fmt.Errorf("no USIM application")
+                }
+                f, err = c.selectAID(c.aid)
+            default:
+                f, err = c.selectFID(fid)
+        }
+        if err != nil {
+            c.current = nil
+            return nil, fmt.Errorf("selecting %04X: %s", fid, err)
+        }
+    }
+    c.current = f
+    return f, nil
+}
+
+// Read size bytes of the selected transparent file at offset.
+func (c *Card) ReadBinary(offset, size int) ([]byte, error) {
+    var data []byte
+    for len(data) < size {
+        n := size - len(data)
+        if n > 0xff { n = 0xff }
+        pos := offset + len(data)
+        chunk, err := c.transmit(smartcard.Command2(c.cla, INS_READ_BINARY,
+            byte(pos >> 8), byte(pos), byte(n)))
+        if err != nil { return nil, err }
+        if len(chunk) == 0 { break }
+        data = append(data, chunk...)
+    }
+    return data, nil
+}
+
+// Read record n (1-based) of the selected file.
+func (c *Card) ReadRecord(n int) ([]byte, error) {
+    length := 0
+    if c.current != nil { length = c.current.RecordLength }
+    return c.transmit(smartcard.Command2(c.cla, INS_READ_RECORD, byte(n),
+        0x04, byte(length)))
+}
+
+// Read complete transparent file.
+func (c *Card) ReadFile(path ...uint16) ([]byte, error) {
+    f, err := c.Select(path...)
+    if err != nil { return nil, err }
+    if f.DF || f.Structure != STRUCTURE_TRANSPARENT {
+        return nil, fmt.Errorf("%04X is not a transparent file", f.FID)
+    }
+    return c.ReadBinary(0, f.Size)
+}
+
+// Read all records of a linear fixed or cyclic file.
+func (c *Card) ReadRecords(path ...uint16) ([][]byte, error) {
+    f, err := c.Select(path...)
+    if err != nil { return nil, err }
+    if f.DF || f.Structure == STRUCTURE_TRANSPARENT {
+        return nil, fmt.Errorf("%04X is not a record file", f.FID)
+    }
+    records := make([][]byte, f.RecordCount)
+    for i := range records {
+        if records[i], err = c.ReadRecord(i + 1); err != nil {
+            return nil, fmt.Errorf("reading record %d of %04X: %s", i + 1,
+                f.FID, err)
+        }
+    }
+    return records, nil
+}
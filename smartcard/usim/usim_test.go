@@ -0,0 +1,245 @@
+package usim
+
+import (
+    "bytes"
+    "testing"
+    "time"
+    "github.com/sf1/go-card/smartcard"
+    "github.com/sf1/go-card/smartcard/mock"
+)
+
+func newCard(t *testing.T, sim *simCard) *Card {
+    card, err := New(sim)
+    if err != nil { t.Fatal(err) }
+    if card.GSM() != sim.gsm {
+        t.Fatalf("expected GSM mode %v", sim.gsm)
+    }
+    return card
+}
+
+func TestFiles(t *testing.T) {
+    for _, gsm := range []bool{false, true} {
+        card := newCard(t, newSimCard(gsm))
+        if !gsm && !bytes.Equal(card.USIM(), simUSIMAID) {
+            t.Errorf("unexpected USIM AID %X", card.USIM())
+        }
+        iccid, err := card.ICCID()
+        if err != nil { t.Fatal(err) }
+        if iccid != "89441234567890123456" {
+            t.Errorf("unexpected ICCID %s", iccid)
+        }
+        if _, err := card.IMSI(); err == nil {
+            t.Error("IMSI read without PIN")
+        }
+        if err := card.VerifyPIN("1234"); err != nil { t.Fatal(err) }
+        imsi, err := card.IMSI()
+        if err != nil { t.Fatal(err) }
+        if imsi != "234150123456789" { t.Errorf("unexpected IMSI %s", imsi) }
+        spn, err := card.SPN()
+        if err != nil { t.Fatal(err) }
+        if spn.Name != "Test" || spn.DisplayCondition != 0x01 {
+            t.Errorf("unexpected SPN %+v", spn)
+        }
+        plmns, err := card.UserPLMNs()
+        if err != nil { t.Fatal(err) }
+        if len(plmns) != 2 || plmns[0].String() != "23415" ||
+            plmns[1].MCC != "208" || plmns[1].MNC != "01" {
+            t.Errorf("unexpected PLMNs %v", plmns)
+        }
+        if !gsm && (plmns[0].AccessTechnologies != ACT_UTRAN ||
+            plmns[1].AccessTechnologies != ACT_GSM) {
+            t.Errorf("unexpected access technologies %v", plmns)
+        }
+        forbidden, err := card.ForbiddenPLMNs()
+        if err != nil { t.Fatal(err) }
+        if len(forbidden) != 1 || forbidden[0].String() != "310410" {
+            t.Errorf("unexpected forbidden PLMNs %v", forbidden)
+        }
+    }
+}
+
+func TestPhonebook(t *testing.T) {
+    for _, gsm := range []bool{false, true} {
+        card := newCard(t, newSimCard(gsm))
+        if err := card.VerifyPIN("1234"); err != nil { t.Fatal(err) }
+        contacts, err := card.Phonebook()
+        if err != nil { t.Fatal(err) }
+        expected := []Contact{{1, "Alice", "+44778200086"}, {3, "Bob", "1234"}}
+        if len(contacts) != len(expected) {
+            t.Fatalf("unexpected contacts %v", contacts)
+        }
+        for i := range expected {
+            if contacts[i] != expected[i] {
+                t.Errorf("expected %v, got %v", expected[i], contacts[i])
+            }
+        }
+    }
+}
+
+func TestMessages(t *testing.T) {
+    for _, gsm := range []bool{false, true} {
+        card := newCard(t, newSimCard(gsm))
+        if err := card.VerifyPIN("1234"); err != nil { t.Fatal(err) }
+        messages, err := card.Messages()
+        if err != nil { t.Fatal(err) }
+        if len(messages) != 2 { t.Fatalf("unexpected messages %v", messages) }
+        m := messages[0]
+        scts := time.Date(2024, 10, 15, 12, 34, 0, 0,
+            time.FixedZone("", 2 * 3600))
+        if m.Record != 1 || m.Status != SMS_UNREAD ||
+            m.SMSC != "+447785016005" || m.Address != "+44778200086" ||
+            !m.Time.Equal(scts) || m.Text != "hellohello" {
+            t.Errorf("unexpected message %+v", m)
+        }
+        m = messages[1]
+        if m.Record != 3 || m.Status != SMS_SENT || m.SMSC != "" ||
+            m.Address != "1234" || m.Text != "Hi" {
+            t.Errorf("unexpected message %+v", m)
+        }
+    }
+}
+
+// Pack septets into octets after fill bits.
+func pack7(septets []byte, fill int) []byte {
+    out := make([]byte, (fill + 7 * len(septets) + 7) / 8)
+    for i, s := range septets {
+        for b := 0; b < 7; b++ {
+            if s & (1 << uint(b)) != 0 {
+                bit := fill + 7 * i + b
+                out[bit/8] |= 1 << uint(bit % 8)
+            }
+        }
+    }
+    return out
+}
+
+func TestUserData(t *testing.T) {
+    // Concatenated message header; one fill bit aligns the text
+    udh := []byte{0x05, 0x00, 0x03, 0x2a, 0x02, 0x01}
+    text := []byte("Part [one]")
+    septets := []byte{}
+    for _, c := range text {
+        switch c {
+            case '[':
+                septets = append(septets, 0x1b, 0x3c)
+            case ']':
+                septets = append(septets, 0x1b, 0x3e)
+            default:
+                septets = append(septets, c)
+        }
+    }
+    ud := append(append([]byte{}, udh...), pack7(septets, 1)...)
+    s, err := decodeUserData(0x00, true, 7 + len(septets), ud)
+    if err != nil { t.Fatal(err) }
+    if s != string(text) { t.Errorf("unexpected text %q", s) }
+    s, err = decodeUserData(0x04, false, 3, []byte("abc"))
+    if err != nil || s != "abc" { t.Errorf("unexpected 8 bit text %q", s) }
+    if _, err := decodeUserData(0x0c, false, 1, []byte{0}); err == nil {
+        t.Error("reserved alphabet accepted")
+    }
+    // Alphanumeric originating address "Test"
+    addr := append([]byte{0x07, 0xd0}, pack7([]byte("Test"), 0)...)
+    a, n, err := decodeAddress(addr)
+    if err != nil || a != "Test" || n != len(addr) {
+        t.Errorf("unexpected address %q (%d)", a, n)
+    }
+}
+
+func TestAlpha(t *testing.T) {
+    tests := []struct {
+        data []byte
+        text string
+    }{
+        {[]byte{'A', 'b', 0x1b, 0x65, 0xff, 0xff}, "Ab€"},
+        {[]byte{0x80, 0x04, 0x1f, 0xff, 0xff}, "П"},
+        {[]byte{0x81, 0x02, 0x08, 0x9f, 0x41, 0xff}, "ПA"},
+        {[]byte{0x82, 0x02, 0x04, 0x10, 0x8f, 0x20}, "П "},
+        {[]byte{0xff, 0xff}, ""},
+    }
+    for _, test := range tests {
+        if s := decodeAlpha(test.data); s != test.text {
+            t.Errorf("%X: expected %q, got %q", test.data, test.text, s)
+        }
+    }
+}
+
+func TestVerifyPIN(t *testing.T) {
+    for _, gsm := range []bool{false, true} {
+        card := newCard(t, newSimCard(gsm))
+        retries, err := card.PINRetries(PIN1)
+        if err != nil || retries != 3 {
+            t.Fatalf("expected 3 retries, got %d, %v", retries, err)
+        }
+        err = card.VerifyPIN("0000")
+        pinErr, ok := err.(*PINError)
+        expected := 2
+        if gsm { expected = -1 }
+        if !ok || pinErr.Retries != expected {
+            t.Fatalf("expected PINError with %d retries, got %v", expected,
+                err)
+        }
+        card.VerifyPIN("0000")
+        err = card.VerifyPIN("0000")
+        if pinErr, ok := err.(*PINError); !ok || pinErr.Retries != 0 {
+            t.Fatalf("expected blocked PIN, got %v", err)
+        }
+        err = card.VerifyPIN("1234")
+        if pinErr, ok := err.(*PINError); !ok || pinErr.Retries != 0 {
+            t.Fatalf("expected blocked PIN, got %v", err)
+        }
+    }
+    card := newCard(t, newSimCard(false))
+    if err := card.VerifyPIN("12"); err == nil { t.Error("short PIN accepted") }
+}
+
+func TestAuthenticate(t *testing.T) {
+    card := newCard(t, newSimCard(false))
+    if err := card.VerifyPIN("1234"); err != nil { t.Fatal(err) }
+    res, err := card.Authenticate(simRAND, simAUTN)
+    if err != nil { t.Fatal(err) }
+    if !bytes.Equal(res.RES, simRES) || !bytes.Equal(res.CK, simCK) ||
+        !bytes.Equal(res.IK, simIK) || !bytes.Equal(res.Kc, simKc) {
+        t.Errorf("unexpected result %+v", res)
+    }
+    _, err = card.Authenticate(simRAND, simSyncAUTN)
+    if sync, ok := err.(*SyncFailure); !ok || !bytes.Equal(sync.AUTS, simAUTS) {
+        t.Errorf("expected synchronisation failure, got %v", err)
+    }
+    bad := append([]byte{}, simAUTN...)
+    bad[15] ^= 1
+    _, err = card.Authenticate(simRAND, bad)
+    if err != smartcard.SWError(0x9862) {
+        t.Errorf("expected MAC failure, got %v", err)
+    }
+    for _, gsm := range []bool{false, true} {
+        card := newCard(t, newSimCard(gsm))
+        if err := card.VerifyPIN("1234"); err != nil { t.Fatal(err) }
+        sres, kc, err := card.AuthenticateGSM(simRAND)
+        if err != nil { t.Fatal(err) }
+        if !bytes.Equal(sres, simSRES) || !bytes.Equal(kc, simKc) {
+            t.Errorf("unexpected SRES %X, Kc %X", sres, kc)
+        }
+    }
+    card = newCard(t, newSimCard(true))
+    if _, err := card.Authenticate(simRAND, simAUTN); err == nil {
+        t.Error("3G context accepted by SIM")
+    }
+}
+
+// RUN GSM ALGORITHM (TS 51.011) with RAND, SRES and Kc of Milenage test
+// set 1.
+func TestGSMAlgorithmTrace(t *testing.T) {
+    card := mock.NewCard(nil).
+        Expect("a0 a4 00 00 02 7f 20", "9f 16").
+        Expect("a0 c0 00 00 16", "00 00 00 00 7f 20 02 00 00 00 00 00 09" +
+            "00 00 00 00 00 83 8a 83 8a 90 00").
+        Expect("a0 88 00 00 10 23 55 3c be 96 37 a8 9d 21 8a e6 4d ae 47 " +
+            "bf 35", "9f 0c").
+        Expect("a0 c0 00 00 0c", "46 f8 41 6a ea e4 be 82 3a f9 a0 8b 90 00")
+    sres, kc, err := NewGSM(card).AuthenticateGSM(simRAND)
+    if err != nil { t.Fatal(err) }
+    if !bytes.Equal(sres, simSRES) || !bytes.Equal(kc, simKc) {
+        t.Errorf("unexpected SRES %X, Kc %X", sres, kc)
+    }
+    card.AssertExpectations(t)
+}